@@ -0,0 +1,221 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// BatchPath is the path which clients POST a batch of requests to. The request body is an array of
+// BatchRequest and the response body is an array of BatchResponse, in the same order.
+const BatchPath = "/_lb/batch"
+
+// MaxBatchSize is the maximum number of requests in a single batch
+const MaxBatchSize = 32
+
+// BatchRequest is a single request in a batch
+type BatchRequest struct {
+	Method string `json:"method"`
+	// The path and query string e.g "/_matrix/client/r0/profile/@alice:example.com?foo=bar"
+	Path string `json:"path"`
+	// Optional JSON request body
+	Body stdjson.RawMessage `json:"body,omitempty"`
+}
+
+// BatchResponse is the response to a single request in a batch
+type BatchResponse struct {
+	Status int `json:"status"`
+	// The JSON response body. If the response was not JSON, this is a JSON string of the response.
+	Body stdjson.RawMessage `json:"body,omitempty"`
+}
+
+// BatchHandler wraps a CBOR http handler (e.g the output of CBORToJSONHandler) to handle POST requests
+// for BatchPath. Each request in the batch is sent to next one at a time in the order given, with the
+// Authorization header of the batch request. A failing request does not stop the rest of the batch: its
+// status and body are returned in its BatchResponse, so clients must check the status of every response.
+// The batch itself only fails with a 400 if it is malformed or has more than MaxBatchSize requests.
+// The batch is decoded with the dictionary of its Content-Type and the responses are encoded with the dictionary it
+// Accepts, as CBORToJSONHandler does, and each request in the batch is sent to next with the same Content-Type and
+// Accept. All other requests are passed through to next.
+func BatchHandler(next http.Handler, codec *CBORCodec) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != BatchPath {
+			next.ServeHTTP(w, req)
+			return
+		}
+		format := batchFormatFor(codec, req)
+		if req.Method != "POST" {
+			writeBatchError(w, format.resCodec, format.resContentType, http.StatusMethodNotAllowed, "M_UNRECOGNIZED", "batches must be POSTed")
+			return
+		}
+		batchJSON, err := format.reqCodec.CBORToJSON(req.Body)
+		if err != nil {
+			writeBatchError(w, format.resCodec, format.resContentType, http.StatusBadRequest, "M_NOT_JSON", "batch is not valid CBOR")
+			return
+		}
+		var batch []BatchRequest
+		if err = json.Unmarshal(batchJSON, &batch); err != nil {
+			writeBatchError(w, format.resCodec, format.resContentType, http.StatusBadRequest, "M_BAD_JSON", "batch must be an array of requests")
+			return
+		}
+		if len(batch) > MaxBatchSize {
+			writeBatchError(w, format.resCodec, format.resContentType, http.StatusBadRequest, "M_TOO_LARGE", "too many requests in batch")
+			return
+		}
+		responses := make([]BatchResponse, len(batch))
+		for i := range batch {
+			responses[i] = serveBatchRequest(next, codec, format, req, &batch[i])
+		}
+		resJSON, err := json.Marshal(responses)
+		if err != nil {
+			writeBatchError(w, format.resCodec, format.resContentType, http.StatusInternalServerError, "M_UNKNOWN", "failed to marshal responses")
+			return
+		}
+		resCBOR, err := format.resCodec.JSONToCBOR(bytes.NewReader(resJSON))
+		if err != nil {
+			writeBatchError(w, format.resCodec, format.resContentType, http.StatusInternalServerError, "M_UNKNOWN", "failed to convert responses to CBOR")
+			return
+		}
+		w.Header().Set("Content-Type", format.resContentType)
+		w.WriteHeader(200)
+		w.Write(resCBOR)
+	})
+}
+
+// batchFormat is how the bodies of a batch and of the requests in it are encoded
+type batchFormat struct {
+	reqCodec       *CBORCodec
+	reqContentType string
+	resCodec       *CBORCodec
+	resContentType string
+	// the Accept header of the batch, which is set on each request in it
+	accept string
+}
+
+// batchFormatFor returns the format of the batch request, which is application/cbor unless the client negotiated
+// another dictionary
+func batchFormatFor(codec *CBORCodec, req *http.Request) batchFormat {
+	f := batchFormat{
+		reqCodec:       codec,
+		reqContentType: "application/cbor",
+		accept:         req.Header.Get("Accept"),
+	}
+	if reqCodec := codec.ForContentType(req.Header.Get("Content-Type")); reqCodec != nil {
+		f.reqCodec, f.reqContentType = reqCodec, req.Header.Get("Content-Type")
+	}
+	f.resCodec, f.resContentType = codec.ForAccept(f.accept)
+	return f
+}
+
+func serveBatchRequest(next http.Handler, codec *CBORCodec, format batchFormat, batchReq *http.Request, br *BatchRequest) BatchResponse {
+	u, err := url.Parse(br.Path)
+	if err != nil || u.Path == "" || u.Path == BatchPath || u.Host != "" {
+		return batchErrorResponse(http.StatusBadRequest, "M_INVALID_PARAM", "invalid path")
+	}
+	var body []byte
+	if len(br.Body) > 0 {
+		body, err = format.reqCodec.JSONToCBOR(bytes.NewReader(br.Body))
+		if err != nil {
+			return batchErrorResponse(http.StatusBadRequest, "M_NOT_JSON", "invalid body")
+		}
+	}
+	subReq, err := http.NewRequest(br.Method, "https://"+batchReq.Host+u.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return batchErrorResponse(http.StatusBadRequest, "M_UNRECOGNIZED", "invalid request")
+	}
+	subReq = subReq.WithContext(batchReq.Context())
+	if body != nil {
+		subReq.Header.Set("Content-Type", format.reqContentType)
+	}
+	if format.accept != "" {
+		subReq.Header.Set("Accept", format.accept)
+	}
+	if auth := batchReq.Header.Get("Authorization"); auth != "" {
+		subReq.Header.Set("Authorization", auth)
+	}
+	rw := &batchResponseWriter{
+		header: make(http.Header),
+		status: http.StatusOK,
+	}
+	next.ServeHTTP(rw, subReq)
+
+	res := BatchResponse{
+		Status: rw.status,
+	}
+	if rw.body.Len() == 0 {
+		return res
+	}
+	if resCodec := codec.ForContentType(rw.header.Get("Content-Type")); resCodec != nil {
+		resJSON, err := resCodec.CBORToJSON(&rw.body)
+		if err != nil {
+			return batchErrorResponse(http.StatusBadGateway, "M_UNKNOWN", "response is not valid CBOR")
+		}
+		res.Body = resJSON
+		return res
+	}
+	raw := rw.body.Bytes()
+	if json.Valid(raw) {
+		res.Body = raw
+		return res
+	}
+	res.Body, _ = json.Marshal(string(raw))
+	return res
+}
+
+func batchErrorResponse(status int, errcode, msg string) BatchResponse {
+	body, _ := json.Marshal(map[string]string{
+		"errcode": errcode,
+		"error":   msg,
+	})
+	return BatchResponse{
+		Status: status,
+		Body:   body,
+	}
+}
+
+func writeBatchError(w http.ResponseWriter, codec *CBORCodec, contentType string, status int, errcode, msg string) {
+	body, _ := codec.JSONToCBOR(bytes.NewReader(batchErrorResponse(status, errcode, msg).Body))
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// batchResponseWriter buffers the response to a single request in a batch
+type batchResponseWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = statusCode
+}
+
+func (w *batchResponseWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	return w.body.Write(data)
+}
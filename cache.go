@@ -0,0 +1,131 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache is a key-value store where entries can expire. Integrators can implement this to back caches with
+// memory, disk or an external store. Implementations must be safe to call from multiple goroutines.
+type Cache interface {
+	// Get returns the value for the key, or false if there is no value or the value has expired.
+	Get(key string) ([]byte, bool)
+	// Set the value for the key, which expires after ttl. If ttl is 0, the value never expires,
+	// though implementations may still evict it.
+	Set(key string, value []byte, ttl time.Duration)
+	// Delete the value for the key, if it exists.
+	Delete(key string)
+}
+
+// LRUCache is an in-memory Cache which is bounded in size. When adding a value would exceed the size,
+// the least recently used values are evicted. Values expire by the monotonic clock, so changes to the
+// device's clock do not affect them.
+type LRUCache struct {
+	maxBytes int64
+	mu       sync.Mutex
+	size     int64
+	ll       *list.List
+	entries  map[string]*list.Element
+	now      func() time.Time
+}
+
+// lruEntry remembers when it was set and for how long rather than when it expires, so that a clock which jumps
+// backwards expires it early rather than keeping it for the size of the jump
+type lruEntry struct {
+	key   string
+	value []byte
+	set   time.Time
+	ttl   time.Duration
+}
+
+// NewLRUCache creates an in-memory cache which can hold up to maxBytes of values. Values which are
+// larger than maxBytes are never stored.
+func NewLRUCache(maxBytes int64) *LRUCache {
+	return &LRUCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+		now:      time.Now,
+	}
+}
+
+// Get implements Cache
+func (c *LRUCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*lruEntry)
+	if entry.ttl > 0 {
+		if age := c.now().Sub(entry.set); age < 0 || age >= entry.ttl {
+			c.remove(el)
+			return nil, false
+		}
+	}
+	c.ll.MoveToFront(el)
+	return entry.value, true
+}
+
+// Set implements Cache
+func (c *LRUCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	if int64(len(value)) > c.maxBytes {
+		return
+	}
+	entry := &lruEntry{
+		key:   key,
+		value: value,
+	}
+	if ttl > 0 {
+		entry.set = c.now()
+		entry.ttl = ttl
+	}
+	c.entries[key] = c.ll.PushFront(entry)
+	c.size += int64(len(value))
+	for c.size > c.maxBytes {
+		c.remove(c.ll.Back())
+	}
+}
+
+// Delete implements Cache
+func (c *LRUCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Len returns the number of values in the cache, including expired values which have not been evicted yet.
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *LRUCache) remove(el *list.Element) {
+	entry := c.ll.Remove(el).(*lruEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.value))
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRUCache(10)
+	c.Set("a", []byte("aaaa"), 0)
+	c.Set("b", []byte("bbbb"), 0)
+	// touch a so b is the least recently used
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("Get(a) missing")
+	}
+	c.Set("c", []byte("cccc"), 0)
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("Get(b) should have been evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("Get(%s) missing", k)
+		}
+	}
+	// too big to ever store
+	c.Set("d", []byte("ddddddddddd"), 0)
+	if _, ok := c.Get("d"); ok {
+		t.Errorf("Get(d) should not have been stored")
+	}
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Get(a) should have been deleted")
+	}
+	if c.Len() != 1 {
+		t.Errorf("Len: got %d want 1", c.Len())
+	}
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	now := time.Now()
+	c := NewLRUCache(100)
+	c.now = func() time.Time { return now }
+	c.Set("a", []byte("a"), time.Minute)
+	c.Set("b", []byte("b"), 0)
+	now = now.Add(59 * time.Second)
+	if _, ok := c.Get("a"); !ok {
+		t.Errorf("Get(a) expired too early")
+	}
+	now = now.Add(time.Second)
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Get(a) should have expired")
+	}
+	if v, ok := c.Get("b"); !ok || string(v) != "b" {
+		t.Errorf("Get(b) got %s,%v want b,true", string(v), ok)
+	}
+}
+
+// TestLRUCacheClockJump checks that a wall clock which jumps a day in either direction expires values rather than
+// keeping them for the size of the jump
+func TestLRUCacheClockJump(t *testing.T) {
+	for _, jump := range []time.Duration{-24 * time.Hour, 24 * time.Hour} {
+		// Round(0) strips the monotonic reading, as a clock which is set would
+		now := time.Now().Round(0)
+		c := NewLRUCache(100)
+		c.now = func() time.Time { return now }
+		c.Set("a", []byte("a"), time.Minute)
+		c.Set("b", []byte("b"), 0)
+		now = now.Add(jump)
+		if _, ok := c.Get("a"); ok {
+			t.Errorf("jump %v: Get(a) should have expired", jump)
+		}
+		if v, ok := c.Get("b"); !ok || string(v) != "b" {
+			t.Errorf("jump %v: Get(b) got %s,%v want b,true", jump, string(v), ok)
+		}
+		// values set after the jump expire after their ttl by the new time
+		c.Set("a", []byte("a"), time.Minute)
+		now = now.Add(59 * time.Second)
+		if _, ok := c.Get("a"); !ok {
+			t.Errorf("jump %v: Get(a) set after the jump expired too early", jump)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// CapabilitiesPath is the path which clients GET the server's Capabilities from
+const CapabilitiesPath = "/_lb/capabilities"
+
+// Capabilities are the low bandwidth features a server supports. Clients use these to work out which of
+// their requested parameters are actually in use.
+type Capabilities struct {
+	// The largest block size in bytes the server uses for block-wise transfers
+	BlockSize int `json:"block_size"`
+	// The version of the CBOR keys and CoAP path enums the server uses e.g "v1"
+	DictionaryVersion string `json:"dictionary_version"`
+	// All the dictionary versions the server accepts, if it accepts more than DictionaryVersion, e.g ["v1","v2"].
+	// Clients use the newest one they know as well.
+	DictionaryVersions []string `json:"dictionary_versions,omitempty"`
+	// The version of the path segment dictionary the server expands e.g "v1", if it has one. Clients only compress
+	// paths with PathSegments of this version.
+	PathSegmentsVersion string `json:"path_segments_version,omitempty"`
+	// True if the server supports OBSERVE on /sync
+	Observe bool `json:"observe"`
+}
+
+// CapabilitiesHandler wraps a CBOR http handler to respond to GET requests for CapabilitiesPath with caps.
+// All other requests are passed through to next.
+func CapabilitiesHandler(next http.Handler, codec *CBORCodec, caps Capabilities) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != CapabilitiesPath {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if req.Method != "GET" {
+			writeBatchError(w, codec, "application/cbor", http.StatusMethodNotAllowed, "M_UNRECOGNIZED", "capabilities must be fetched with GET")
+			return
+		}
+		capsJSON, err := json.Marshal(caps)
+		if err != nil {
+			writeBatchError(w, codec, "application/cbor", http.StatusInternalServerError, "M_UNKNOWN", "failed to marshal capabilities")
+			return
+		}
+		capsCBOR, err := codec.JSONToCBOR(bytes.NewReader(capsJSON))
+		if err != nil {
+			writeBatchError(w, codec, "application/cbor", http.StatusInternalServerError, "M_UNKNOWN", "failed to convert capabilities to CBOR")
+			return
+		}
+		w.Header().Set("Content-Type", "application/cbor")
+		w.WriteHeader(200)
+		w.Write(capsCBOR)
+	})
+}
@@ -38,6 +38,8 @@ type jsonToCBORWriter struct {
 	http.ResponseWriter
 	*CBORCodec
 	isSendingJSON bool
+	// the Content-Type of the CBOR response, which is application/cbor if empty
+	contentType string
 }
 
 func (j *jsonToCBORWriter) WriteHeader(statusCode int) {
@@ -46,7 +48,10 @@ func (j *jsonToCBORWriter) WriteHeader(statusCode int) {
 	}
 	if j.Header().Get("Content-Type") == "application/json" {
 		j.isSendingJSON = true
-		j.Header().Set("Content-Type", "application/cbor")
+		if j.contentType == "" {
+			j.contentType = "application/cbor"
+		}
+		j.Header().Set("Content-Type", j.contentType)
 	}
 	j.ResponseWriter.WriteHeader(statusCode)
 }
@@ -142,6 +147,8 @@ func cborInterfaceToJSONInterface(cborInt interface{}, lookup map[int]string) in
 		var intKeys []int
 		intMap := make(map[int]interface{})
 		var strKeys []string
+		var bigKeys []string
+		bigMap := make(map[string]interface{})
 		for k, v := range m {
 			// accept string keys
 			kstr, ok := k.(string)
@@ -159,6 +166,12 @@ func cborInterfaceToJSONInterface(cborInt interface{}, lookup map[int]string) in
 				intMap[kint] = v
 				continue
 			}
+			// integers too large for an int are never in the lookup, so are sent as decimal strings
+			if kstr, ok := bigIntKey(k); ok {
+				bigKeys = append(bigKeys, kstr)
+				bigMap[kstr] = v
+				continue
+			}
 			// drop the key
 		}
 		sort.Ints(intKeys)
@@ -173,6 +186,9 @@ func cborInterfaceToJSONInterface(cborInt interface{}, lookup map[int]string) in
 				result[fmt.Sprintf("%d", ik)] = cborInterfaceToJSONInterface(intMap[ik], lookup)
 			}
 		}
+		for _, bk := range bigKeys {
+			result[bk] = cborInterfaceToJSONInterface(bigMap[bk], lookup)
+		}
 		// loop all str keys and resolve them fully: this will clobber int keys mapped to str keys if int->str
 		// resolved to the same value, which is what we want
 		for _, is := range strKeys {
@@ -184,14 +200,14 @@ func cborInterfaceToJSONInterface(cborInt interface{}, lookup map[int]string) in
 	}
 }
 
-// num converts the input into an int if it is a number
+// num converts the input into an int if it is a number which fits in an int
 func num(k interface{}) (kint int, ok bool) {
 	ku64, ok := k.(uint64)
-	if ok {
+	if ok && ku64 <= uint64(maxInt) {
 		return int(ku64), true
 	}
 	k64, ok := k.(int64)
-	if ok {
+	if ok && int64(int(k64)) == k64 {
 		return int(k64), true
 	}
 	ki, ok := k.(int)
@@ -0,0 +1,141 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"encoding/base64"
+
+	cbor "github.com/fxamacker/cbor/v2"
+)
+
+// Signatures, keys and hashes are base64 strings, which are a third larger than the bytes they encode and do not
+// compress with the dictionary. They can be sent as CBOR byte strings instead, wrapped in a tag which says how to
+// encode them as base64 again:
+//   - Tag 21 is base64url without padding, and tag 22 is base64 with padding, as in RFC 8949 Section 3.4.5.2.
+//   - Tag 115 is base64url with padding.
+//   - Tag 116 is base64 without padding, which is what Matrix uses almost everywhere. Tags 113 and 114 are taken by
+//     interning and compact errors.
+//
+// Only strings which are exactly the canonical encoding of their bytes are replaced, so decoding them always gives
+// back the same string.
+const (
+	cborTagBase64URL       = 21
+	cborTagBase64          = 22
+	cborTagBase64URLPadded = 115
+	cborTagBase64Unpadded  = 116
+	// anything shorter is more likely to be an ID which happens to be valid base64 than a key. Ed25519 and
+	// Curve25519 keys are 32 bytes, signatures are 64 bytes and attachment IVs are 16 bytes.
+	minBase64Bytes = 16
+)
+
+// base64Encodings are tried in order, so strings which are valid in more than one encoding use the first
+var base64Encodings = []struct {
+	tag uint64
+	enc *base64.Encoding
+}{
+	{cborTagBase64Unpadded, base64.RawStdEncoding},
+	{cborTagBase64, base64.StdEncoding},
+	{cborTagBase64URL, base64.RawURLEncoding},
+	{cborTagBase64URLPadded, base64.URLEncoding},
+}
+
+// base64Fields are the keys whose values contain base64 strings, at any depth e.g "signatures" is a map of
+// server names to maps of key IDs to signatures. Other strings are never replaced.
+var base64Fields = map[string]bool{
+	"ciphertext":    true, // m.room.encrypted, and key backup session data
+	"commitment":    true, // m.key.verification.accept
+	"fallback_keys": true,
+	"hashes":        true, // events, and encrypted attachments
+	"iv":            true, // encrypted attachments
+	"k":             true, // the JWK of encrypted attachments, which is base64url
+	"key":           true,
+	"keys":          true,
+	"mac":           true,
+	"one_time_keys": true,
+	"sender_key":    true,
+	"session_data":  true,
+	"session_key":   true,
+	"signatures":    true,
+}
+
+// packBase64String returns the string as a tagged byte string if it is base64, else the string
+func packBase64String(s string) interface{} {
+	for _, e := range base64Encodings {
+		b, err := e.enc.Strict().DecodeString(s)
+		if err != nil || len(b) < minBase64Bytes || e.enc.EncodeToString(b) != s {
+			continue
+		}
+		return cbor.Tag{Number: e.tag, Content: b}
+	}
+	return s
+}
+
+// packBase64 replaces base64 strings in base64Fields in the output of jsonInterfaceToCBORInterface with tagged byte
+// strings. inField is set if cborInt is within one of base64Fields.
+func (c *CBORCodec) packBase64(cborInt interface{}, inField bool) interface{} {
+	switch v := cborInt.(type) {
+	case string:
+		if inField {
+			return packBase64String(v)
+		}
+		return v
+	case []interface{}:
+		for i, element := range v {
+			v[i] = c.packBase64(element, inField)
+		}
+		return v
+	case map[interface{}]interface{}:
+		for k, val := range v {
+			name, ok := k.(string)
+			if kint, isNum := num(k); !ok && isNum {
+				name = c.enumKeys[kint]
+			}
+			v[k] = c.packBase64(val, inField || base64Fields[name])
+		}
+		return v
+	default:
+		return cborInt
+	}
+}
+
+// unpackBase64 replaces tagged byte strings from the CBOR decoder with base64 strings, before calling
+// cborInterfaceToJSONInterface
+func unpackBase64(cborInt interface{}) interface{} {
+	switch v := cborInt.(type) {
+	case cbor.Tag:
+		b, ok := v.Content.([]byte)
+		if !ok {
+			return v
+		}
+		for _, e := range base64Encodings {
+			if e.tag == v.Number {
+				return e.enc.EncodeToString(b)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, element := range v {
+			v[i] = unpackBase64(element)
+		}
+		return v
+	case map[interface{}]interface{}:
+		for k, val := range v {
+			v[k] = unpackBase64(val)
+		}
+		return v
+	default:
+		return cborInt
+	}
+}
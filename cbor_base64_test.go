@@ -0,0 +1,261 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// cborBase64Bytes returns the encoding of b as a byte string wrapped in the tag
+func cborBase64Bytes(tag uint64, b []byte) []byte {
+	var out []byte
+	if tag < 24 {
+		out = append(out, 0xc0|byte(tag))
+	} else {
+		out = append(out, 0xd8, byte(tag))
+	}
+	if len(b) < 24 {
+		out = append(out, 0x40|byte(len(b)))
+	} else {
+		out = append(out, 0x58, byte(len(b)))
+	}
+	return append(out, b...)
+}
+
+func TestCBORBinaryBase64Formats(t *testing.T) {
+	raw := make([]byte, 64)
+	for i := range raw {
+		// includes the bytes which encode as + and / or - and _
+		raw[i] = byte(i*37 + 251)
+	}
+	testCases := []struct {
+		name  string
+		field string
+		value string
+		// 0 if the value must be sent as a string
+		wantTag uint64
+		wantRaw []byte
+	}{
+		{name: "unpadded signature", field: "signatures", value: base64.RawStdEncoding.EncodeToString(raw),
+			wantTag: cborTagBase64Unpadded, wantRaw: raw},
+		{name: "padded key", field: "key", value: base64.StdEncoding.EncodeToString(raw[:32]),
+			wantTag: cborTagBase64, wantRaw: raw[:32]},
+		{name: "unpadded base64url JWK", field: "k", value: base64.RawURLEncoding.EncodeToString(raw[:32]),
+			wantTag: cborTagBase64URL, wantRaw: raw[:32]},
+		{name: "padded base64url", field: "mac", value: base64.URLEncoding.EncodeToString(raw[:20]),
+			wantTag: cborTagBase64URLPadded, wantRaw: raw[:20]},
+		// a multiple of 3 bytes has no padding, so is the same in both
+		{name: "no padding needed", field: "hashes", value: base64.StdEncoding.EncodeToString(raw[:48]),
+			wantTag: cborTagBase64Unpadded, wantRaw: raw[:48]},
+		{name: "IV", field: "iv", value: base64.RawStdEncoding.EncodeToString(raw[:16]),
+			wantTag: cborTagBase64Unpadded, wantRaw: raw[:16]},
+		{name: "too short", field: "key", value: base64.RawStdEncoding.EncodeToString(raw[:15])},
+		{name: "not a base64 field", field: "body", value: base64.RawStdEncoding.EncodeToString(raw)},
+		{name: "not base64", field: "key", value: "this is not base64 at all, it is a sentence"},
+		{name: "mixed alphabets", field: "key", value: strings.Repeat("ab+_", 11)},
+		// the last character has bits set which do not fit in the bytes, so the bytes would encode differently
+		{name: "non-zero padding bits", field: "key", value: base64.RawStdEncoding.EncodeToString(raw[:32])[:42] + "B"},
+		{name: "newline", field: "key", value: base64.RawStdEncoding.EncodeToString(raw[:24]) + "\n" +
+			base64.RawStdEncoding.EncodeToString(raw[24:48])},
+	}
+	codec := NewCBORCodecV1(true)
+	codec.BinaryBase64 = true
+	plain := NewCBORCodecV1(true)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// nested inside another field, so the field applies at any depth
+			input := fmt.Sprintf(`{"content":{%q:{"a":[%q]}}}`, tc.field, tc.value)
+			want, err := gomatrixserverlib.CanonicalJSON([]byte(input))
+			if err != nil {
+				t.Fatalf("CanonicalJSON: %s", err)
+			}
+			cborBytes, err := codec.JSONToCBOR(bytes.NewBufferString(input))
+			if err != nil {
+				t.Fatalf("JSONToCBOR: %s", err)
+			}
+			plainCBOR, err := plain.JSONToCBOR(bytes.NewBufferString(input))
+			if err != nil {
+				t.Fatalf("JSONToCBOR: %s", err)
+			}
+			if tc.wantTag == 0 {
+				if !bytes.Equal(cborBytes, plainCBOR) {
+					t.Errorf("value was modified: got %x want %x", cborBytes, plainCBOR)
+				}
+			} else {
+				if !bytes.Contains(cborBytes, cborBase64Bytes(tc.wantTag, tc.wantRaw)) {
+					t.Errorf("value was not sent as tag %d wrapping the raw bytes: %x", tc.wantTag, cborBytes)
+				}
+				if len(cborBytes) >= len(plainCBOR) {
+					t.Errorf("got %d bytes, was %d bytes as a string", len(cborBytes), len(plainCBOR))
+				}
+			}
+			// both codecs must decode byte strings, regardless of BinaryBase64
+			for _, c := range []*CBORCodec{codec, plain} {
+				got, err := c.CBORToJSON(bytes.NewReader(cborBytes))
+				if err != nil {
+					t.Fatalf("CBORToJSON: %s", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("did not pass through CBOR successfully:\ngot  %s\nwant %s", string(got), string(want))
+				}
+			}
+		})
+	}
+}
+
+// TestCBORBinaryBase64RoundTrip checks that E2EE payloads are smaller with binary base64, and are byte for byte the
+// same after the round trip, including with interning.
+func TestCBORBinaryBase64RoundTrip(t *testing.T) {
+	for name, input := range map[string]string{
+		"/keys/query":    keysQueryResponse,
+		"/sendToDevice":  sendToDeviceRequest,
+		"encrypted file": encryptedFileEvent,
+	} {
+		t.Run(name, func(t *testing.T) {
+			want, err := gomatrixserverlib.CanonicalJSON([]byte(input))
+			if err != nil {
+				t.Fatalf("CanonicalJSON: %s", err)
+			}
+			plain := NewCBORCodecV1(true)
+			plainCBOR, err := plain.JSONToCBOR(bytes.NewBufferString(input))
+			if err != nil {
+				t.Fatalf("JSONToCBOR: %s", err)
+			}
+			for _, intern := range []bool{false, true} {
+				codec := NewCBORCodecV1(true)
+				codec.BinaryBase64 = true
+				codec.InternIdentifiers = intern
+				cborBytes, err := codec.JSONToCBOR(bytes.NewBufferString(input))
+				if err != nil {
+					t.Fatalf("JSONToCBOR: %s", err)
+				}
+				t.Logf("interning=%v: JSON %d bytes, CBOR %d bytes, CBOR with binary base64 %d bytes",
+					intern, len(want), len(plainCBOR), len(cborBytes))
+				if len(cborBytes) >= len(plainCBOR) {
+					t.Errorf("binary base64 did not reduce size: got %d bytes, was %d bytes", len(cborBytes), len(plainCBOR))
+				}
+				got, err := plain.CBORToJSON(bytes.NewReader(cborBytes))
+				if err != nil {
+					t.Fatalf("CBORToJSON: %s", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("did not pass through CBOR successfully:\ngot  %s\nwant %s", string(got), string(want))
+				}
+			}
+		})
+	}
+}
+
+// TestCBORBinaryBase64CompactErrors checks that errors and base64 values are told apart when both are in one
+// document, e.g a batch with a rate limited request and a /keys/query, and that every CBOR tag is distinct
+func TestCBORBinaryBase64CompactErrors(t *testing.T) {
+	tags := map[uint64]string{}
+	for name, tag := range map[string]uint64{
+		"shared value":        cborTagSharedValue,
+		"intern table":        cborTagInternTable,
+		"intern reference":    cborTagInternReference,
+		"error":               cborTagError,
+		"base64url":           cborTagBase64URL,
+		"base64":              cborTagBase64,
+		"base64 unpadded":     cborTagBase64Unpadded,
+		"base64url padded":    cborTagBase64URLPadded,
+		"prefix range start":  cborTagPrefixStart,
+		"prefix range finish": cborTagPrefixEnd,
+	} {
+		if other, ok := tags[tag]; ok {
+			t.Errorf("tag %d is used for both %s and %s", tag, name, other)
+		}
+		tags[tag] = name
+	}
+	for tag := uint64(cborTagPrefixStart); tag <= cborTagPrefixEnd; tag++ {
+		if name, ok := tags[tag]; ok && tag != cborTagPrefixStart && tag != cborTagPrefixEnd {
+			t.Errorf("tag %d is used for %s and is within the prefix range", tag, name)
+		}
+	}
+
+	raw := make([]byte, 32)
+	for i := range raw {
+		raw[i] = byte(i*37 + 251)
+	}
+	key := base64.RawStdEncoding.EncodeToString(raw)
+	errorBody := `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":2000}`
+	input := `[{"status":429,"body":` + errorBody + `},` +
+		`{"status":200,"body":{"device_keys":{"@alice:localhost":{"DEVICE":{"keys":{"ed25519:DEVICE":"` + key + `"}}}}}}]`
+	codec := NewCBORCodecV2(true)
+	codec.BinaryBase64 = true
+	codec.CompactErrors = true
+	for name, input := range map[string]string{"batch": input, "error": errorBody} {
+		want, err := gomatrixserverlib.CanonicalJSON([]byte(input))
+		if err != nil {
+			t.Fatalf("%s: CanonicalJSON: %s", name, err)
+		}
+		cborBytes, err := codec.JSONToCBOR(bytes.NewBufferString(input))
+		if err != nil {
+			t.Fatalf("%s: JSONToCBOR: %s", name, err)
+		}
+		if name == "batch" && !bytes.Contains(cborBytes, cborBase64Bytes(cborTagBase64Unpadded, raw)) {
+			t.Errorf("%s: key was not sent as tag %d wrapping the raw bytes: %x", name, cborTagBase64Unpadded, cborBytes)
+		}
+		if name == "error" && !bytes.HasPrefix(cborBytes, []byte{0xd8, cborTagError}) {
+			t.Errorf("%s: error was not sent as tag %d: %x", name, cborTagError, cborBytes)
+		}
+		got, err := codec.CBORToJSON(bytes.NewReader(cborBytes))
+		if err != nil {
+			t.Fatalf("%s: CBORToJSON: %s", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: did not pass through CBOR successfully:\ngot  %s\nwant %s", name, string(got), string(want))
+		}
+	}
+}
+
+// An m.room.message event with an encrypted attachment, which has every base64 format Matrix uses
+var encryptedFileEvent = `{
+	"type": "m.room.message",
+	"content": {
+		"msgtype": "m.file",
+		"body": "secrets.txt",
+		"file": {
+			"url": "mxc://example.com/FHyPlCeYUSFFxlgbQYZmoEoe",
+			"key": {
+				"kty": "oct",
+				"key_ops": ["encrypt", "decrypt"],
+				"alg": "A256CTR",
+				"k": "aWF6-32KGYaC3A_FEUCk1Bt0JA37zP0wrStgmdCaW-0",
+				"ext": true
+			},
+			"iv": "w+sE15fzSc0AAAAAAAAAAA",
+			"hashes": {
+				"sha256": "fdSLu/YkRx3Wyh3KQabP3rd6+SFiKg5lsJZQHtkSAYA"
+			},
+			"v": "v2"
+		}
+	},
+	"event_id": "$143273582443PhrSn:example.org",
+	"hashes": {
+		"sha256": "5jM4wQpv6lnBo7CLIghJuHdW+s2CMBJPUOGOC89ncos"
+	},
+	"signatures": {
+		"example.org": {
+			"ed25519:key_version": "Wm+VzmOUOz08Ds+0NTWb1d4CZrVsJSikkeRxh6aCcUwu6pNC78FunoD7KNWzqFn241eYHYMGCA5McEiVPdhzBA=="
+		}
+	}
+}`
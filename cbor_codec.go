@@ -17,6 +17,7 @@ package lb
 import (
 	"fmt"
 	"io"
+	"time"
 
 	cbor "github.com/fxamacker/cbor/v2"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -26,10 +27,31 @@ import (
 type CBORCodec struct {
 	keys     map[string]int
 	enumKeys map[int]string
+	// If set, frequent string values and prefixes are replaced with CBOR tags
+	values *valueDict
 	// If set:
 	// - CBORToJSON emits Canonical JSON: https://matrix.org/docs/spec/appendices#canonical-json
 	// - JSONToCBOR emits Canonical CBOR: RFC 7049 Section 3.9
 	canonical bool
+	// If set, JSONToCBOR replaces identifiers which are repeated within a document with references to a table
+	// at the start of the document. CBORToJSON always accepts documents with a table, so this can be enabled
+	// once all clients understand it.
+	InternIdentifiers bool
+	// If set, JSONToCBOR sends standard Matrix error responses as a compact array rather than a map. CBORToJSON
+	// always accepts compact errors, so this can be enabled once all clients understand them.
+	CompactErrors bool
+	// If set, JSONToCBOR sends base64 signatures, keys and hashes as byte strings. CBORToJSON always accepts
+	// byte strings, so this can be enabled once all clients understand them.
+	BinaryBase64 bool
+	// If set, JSONToCBOR sends the keys from 24 to 47 as the negative integers -1 to -24, which take one byte rather
+	// than two. CBORToJSON always accepts signed keys, so this can be enabled once all clients understand them.
+	SignedKeys bool
+	// Optional sink for metrics about conversions
+	Metrics MetricsSink
+	// the dictionary version e.g DictionaryV1, or empty for custom keys
+	dictionary string
+	// set if any of the keys are negative, in which case keys are never signed
+	negativeKeys bool
 }
 
 // NewCBORCodec creates a CBOR codec which will map the enum keys given. If canonical is set,
@@ -41,6 +63,16 @@ type CBORCodec struct {
 // Users of this library should prefer NewCBORCodecV1 which sets up all the enum keys for you. This
 // function is exposed for bleeding edge or custom enums.
 func NewCBORCodec(keys map[string]int, canonical bool) (*CBORCodec, error) {
+	return NewCBORCodecWithValues(keys, nil, nil, canonical)
+}
+
+// NewCBORCodecWithValues creates a CBOR codec which will map the enum keys given, and additionally replace
+// frequent strings with CBOR tags. Strings which exactly match an entry in values are replaced with
+// tag 6 wrapping the index of the entry. Strings which begin with an entry in prefixes are replaced with
+// tag 225+N wrapping the rest of the string, where N is the index of the prefix. This is used for
+// identifiers like "ed25519:DEVICEID". There can be at most 31 prefixes. Both values and prefixes are
+// ordered lists, so new entries must only ever be appended.
+func NewCBORCodecWithValues(keys map[string]int, values, prefixes []string, canonical bool) (*CBORCodec, error) {
 	c := &CBORCodec{
 		keys:      keys,
 		enumKeys:  make(map[int]string),
@@ -51,20 +83,112 @@ func NewCBORCodec(keys map[string]int, canonical bool) (*CBORCodec, error) {
 			return nil, fmt.Errorf("cbor key map: duplicate integer %d - %s", v, k)
 		}
 		c.enumKeys[v] = k
+		if v < 0 {
+			c.negativeKeys = true
+		}
+	}
+	if len(values) > 0 || len(prefixes) > 0 {
+		vd, err := newValueDict(values, prefixes)
+		if err != nil {
+			return nil, err
+		}
+		c.values = vd
 	}
 	return c, nil
 }
 
+// WithoutDictionary returns a codec which converts between JSON and plain CBOR, without replacing keys, values or
+// identifiers, for debugging whether a mismatch is caused by the dictionary or by the base codec.
+func (c *CBORCodec) WithoutDictionary() *CBORCodec {
+	return &CBORCodec{
+		keys:      map[string]int{},
+		enumKeys:  map[int]string{},
+		canonical: c.canonical,
+		Metrics:   c.Metrics,
+	}
+}
+
+// ForDictionary returns a codec which uses the keys and values of the dictionary version, with the same options as
+// c, or nil if the version is unknown
+func (c *CBORCodec) ForDictionary(version string) *CBORCodec {
+	if version == c.dictionary {
+		return c
+	}
+	d, ok := dictionaryCodecs[version]
+	if !ok {
+		return nil
+	}
+	codec := *c
+	codec.keys, codec.enumKeys, codec.values, codec.dictionary = d.keys, d.enumKeys, d.values, d.dictionary
+	codec.negativeKeys = d.negativeKeys
+	return &codec
+}
+
+// ForContentType returns the codec to decode a body of the Content-Type with: c for application/cbor, a codec without
+// the dictionary for ContentTypePlainCBOR and the v2 codec for ContentTypeCBORV2. Returns nil if the body is not CBOR.
+func (c *CBORCodec) ForContentType(contentType string) *CBORCodec {
+	switch contentType {
+	case "application/cbor":
+		return c
+	case ContentTypePlainCBOR:
+		return c.WithoutDictionary()
+	case ContentTypeCBORV2:
+		return c.ForDictionary(DictionaryV2)
+	}
+	return nil
+}
+
+// ForAccept returns the codec to encode the response to a request with the Accept header given, and the Content-Type
+// of the response. Requests which do not Accept ContentTypePlainCBOR or ContentTypeCBORV2 get application/cbor from c.
+func (c *CBORCodec) ForAccept(accept string) (*CBORCodec, string) {
+	switch accept {
+	case ContentTypePlainCBOR:
+		return c.WithoutDictionary(), ContentTypePlainCBOR
+	case ContentTypeCBORV2:
+		return c.ForDictionary(DictionaryV2), ContentTypeCBORV2
+	}
+	return c, "application/cbor"
+}
+
+// Dictionary returns the dictionary version of the codec e.g DictionaryV1, or an empty string if it was made with
+// custom keys
+func (c *CBORCodec) Dictionary() string {
+	return c.dictionary
+}
+
 // CBORToJSON converts a single CBOR object into a single JSON object
 func (c *CBORCodec) CBORToJSON(input io.Reader) ([]byte, error) {
+	start := time.Now()
+	b, err := c.cborToJSON(input)
+	c.observeConversion("cbor_to_json", start, err)
+	return b, err
+}
+
+func (c *CBORCodec) cborToJSON(input io.Reader) ([]byte, error) {
 	var intermediate interface{}
 	if err := cbor.NewDecoder(input).Decode(&intermediate); err != nil {
-		return nil, fmt.Errorf("CBORToJSON: unmarshalling cbor: %w", err)
+		return nil, NewError(ErrCBORDecode, fmt.Errorf("CBORToJSON: unmarshalling cbor: %w", err))
+	}
+	// before anything else looks at the keys
+	intermediate = c.unsignKeys(intermediate)
+	errJSON, err := c.expandError(intermediate)
+	if err != nil {
+		return nil, NewError(ErrCBORDecode, fmt.Errorf("CBORToJSON: %w", err))
+	}
+	if errJSON != nil {
+		intermediate = errJSON
+	} else {
+		intermediate = unintern(intermediate)
+		if c.values != nil {
+			intermediate = c.values.unpack(intermediate)
+		}
+		intermediate = unpackBase64(intermediate)
+		intermediate = cborInterfaceToJSONInterface(intermediate, c.enumKeys)
 	}
-	intermediate = cborInterfaceToJSONInterface(intermediate, c.enumKeys)
 	b, err := json.Marshal(intermediate)
 	if err != nil {
-		return nil, err
+		// e.g a map with keys which cannot be JSON object keys
+		return nil, NewError(ErrCBORDecode, fmt.Errorf("CBORToJSON: marshalling json: %w", err))
 	}
 	if c.canonical {
 		return gomatrixserverlib.CanonicalJSON(b)
@@ -74,12 +198,42 @@ func (c *CBORCodec) CBORToJSON(input io.Reader) ([]byte, error) {
 
 // JSONToCBOR converts a single JSON object into a single CBOR object
 func (c *CBORCodec) JSONToCBOR(input io.Reader) ([]byte, error) {
+	start := time.Now()
+	b, err := c.jsonToCBOR(input)
+	c.observeConversion("json_to_cbor", start, err)
+	return b, err
+}
+
+func (c *CBORCodec) jsonToCBOR(input io.Reader) ([]byte, error) {
 	var intermediate interface{}
 
 	if err := json.NewDecoder(input).Decode(&intermediate); err != nil {
 		return nil, fmt.Errorf("JSONToCBOR: unmarshalling json: %w", err)
 	}
-	intermediate = jsonInterfaceToCBORInterface(intermediate, c.keys)
+	if compact, ok := c.compactError(intermediate); ok {
+		intermediate = compact
+	} else {
+		intermediate = jsonInterfaceToCBORInterface(intermediate, c.keys)
+		if c.BinaryBase64 {
+			// before interning, as base64 strings can begin with "+"
+			intermediate = c.packBase64(intermediate, false)
+		}
+		var table []interface{}
+		if c.InternIdentifiers {
+			intermediate, table = intern(intermediate)
+		}
+		if c.values != nil {
+			intermediate = c.values.pack(intermediate)
+		}
+		if len(table) > 0 {
+			// the table is added after packing so it is always plain strings
+			intermediate = cbor.Tag{Number: cborTagInternTable, Content: []interface{}{table, intermediate}}
+		}
+		if c.SignedKeys && !c.negativeKeys {
+			// last, as the other passes look keys up in the dictionary
+			intermediate = signKeys(intermediate)
+		}
+	}
 	if c.canonical {
 		enc, err := cbor.CanonicalEncOptions().EncMode()
 		if err != nil {
@@ -89,3 +243,21 @@ func (c *CBORCodec) JSONToCBOR(input io.Reader) ([]byte, error) {
 	}
 	return cbor.Marshal(intermediate)
 }
+
+// observeConversion emits the metrics for a conversion which began at start
+func (c *CBORCodec) observeConversion(conversion string, start time.Time, err error) {
+	m := metricsOrNop(c.Metrics)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.Counter(metricCodecConversions, map[string]string{"conversion": conversion, "result": result}, 1)
+	m.Histogram(metricCodecDuration, map[string]string{"conversion": conversion}, time.Since(start).Seconds())
+}
+
+func (c *CBORCodec) valuesLen() int {
+	if c.values == nil {
+		return 0
+	}
+	return len(c.values.enumValues)
+}
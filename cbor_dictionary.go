@@ -0,0 +1,49 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"fmt"
+	"io"
+)
+
+// DictionaryFile is the JSON file format of a custom dictionary, which LoadDictionary reads, e.g
+// {"keys":{"type":0,"content":1},"values":["m.room.message"],"prefixes":["ed25519:"]}. The fields are the arguments
+// of NewCBORCodecWithValues.
+type DictionaryFile struct {
+	// JSON keys and the integers they are sent as
+	Keys map[string]int `json:"keys"`
+	// Frequent strings, which are sent as their index in this list
+	Values []string `json:"values,omitempty"`
+	// Frequent string prefixes, which are sent as their index in this list and the rest of the string
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// LoadDictionary reads a DictionaryFile and returns a codec which uses it. Custom dictionaries are not negotiated
+// with the Capabilities exchange, so both peers must load the same file.
+func LoadDictionary(r io.Reader, canonical bool) (*CBORCodec, error) {
+	var f DictionaryFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, fmt.Errorf("LoadDictionary: %w", err)
+	}
+	if len(f.Keys) == 0 {
+		return nil, fmt.Errorf("LoadDictionary: no keys")
+	}
+	codec, err := NewCBORCodecWithValues(f.Keys, f.Values, f.Prefixes, canonical)
+	if err != nil {
+		return nil, fmt.Errorf("LoadDictionary: %w", err)
+	}
+	return codec, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestLoadDictionary(t *testing.T) {
+	codec, err := LoadDictionary(strings.NewReader(
+		`{"keys":{"type":0,"content":1,"msgtype":2},"values":["m.room.message","m.text"],"prefixes":["ed25519:"]}`), true)
+	if err != nil {
+		t.Fatalf("LoadDictionary: %s", err)
+	}
+	input := `{"content":{"key":"ed25519:ABC","msgtype":"m.text"},"type":"m.room.message"}`
+	output, err := codec.JSONToCBOR(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	// {0: 6(0), 1: {2: 6(1), "key": 225("ABC")}}
+	if want := "a200c600" + "01a202c601636b6579d8e163414243"; hex.EncodeToString(output) != want {
+		t.Errorf("got %x want %s", output, want)
+	}
+	got, err := codec.CBORToJSON(bytes.NewReader(output))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	if string(got) != input {
+		t.Errorf("round trip: got %s want %s", got, input)
+	}
+
+	for _, file := range []string{
+		``,
+		`{"keys":{}}`,
+		`{"keys":{"type":0,"content":0}}`,
+		`{"keys":{"type":0},"values":["a","a"]}`,
+		`{"keys":["type"]}`,
+	} {
+		if _, err := LoadDictionary(strings.NewReader(file), true); err == nil {
+			t.Errorf("LoadDictionary accepted %q", file)
+		}
+	}
+}
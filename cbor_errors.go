@@ -0,0 +1,103 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"fmt"
+	"math"
+
+	cbor "github.com/fxamacker/cbor/v2"
+)
+
+// Standard Matrix error responses, which are all a rate limited client or a client with an expired token sees,
+// can be sent without the map keys:
+//   - Tag 114 wraps an array of [errcode, error] or [errcode, error, retry_after_ms].
+//   - errcode is the index of the errcode in the values list, or a text string if it is not in the list.
+//
+// e.g {"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":2000} is 26 bytes rather than
+// 31 as a map, or 80 as JSON. Errors with any other keys (e.g soft_logout) are encoded as maps as usual.
+const cborTagError = 114
+
+// compactError returns the compact form of a JSON error response, or false if it is not a standard error or
+// CompactErrors is not set
+func (c *CBORCodec) compactError(jsonInt interface{}) (interface{}, bool) {
+	if !c.CompactErrors {
+		return nil, false
+	}
+	m, ok := jsonInt.(map[string]interface{})
+	if !ok || len(m) < 2 || len(m) > 3 {
+		return nil, false
+	}
+	errcode, ok := m["errcode"].(string)
+	if !ok {
+		return nil, false
+	}
+	msg, ok := m["error"].(string)
+	if !ok {
+		return nil, false
+	}
+	var code interface{} = errcode
+	if c.values != nil {
+		if i, ok := c.values.values[errcode]; ok {
+			code = i
+		}
+	}
+	content := []interface{}{code, msg}
+	if len(m) == 3 {
+		retry, ok := m["retry_after_ms"].(float64)
+		if !ok || retry < 0 || retry != math.Trunc(retry) {
+			return nil, false
+		}
+		content = append(content, uint64(retry))
+	}
+	return cbor.Tag{Number: cborTagError, Content: content}, true
+}
+
+// expandError returns the JSON error response for a compact error, or nil if it is not one
+func (c *CBORCodec) expandError(cborInt interface{}) (map[string]interface{}, error) {
+	tag, ok := cborInt.(cbor.Tag)
+	if !ok || tag.Number != cborTagError {
+		return nil, nil
+	}
+	content, ok := tag.Content.([]interface{})
+	if !ok || len(content) < 2 || len(content) > 3 {
+		return nil, fmt.Errorf("compact error: want an array of 2 or 3 elements, got %v", tag.Content)
+	}
+	result := make(map[string]interface{}, len(content))
+	switch code := content[0].(type) {
+	case string:
+		result["errcode"] = code
+	case uint64:
+		if code >= uint64(c.valuesLen()) {
+			return nil, fmt.Errorf("compact error: errcode %d is not in the values list", code)
+		}
+		result["errcode"] = c.values.enumValues[code]
+	default:
+		return nil, fmt.Errorf("compact error: errcode is a %T", content[0])
+	}
+	msg, ok := content[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("compact error: error is a %T", content[1])
+	}
+	result["error"] = msg
+	if len(content) == 3 {
+		retry, ok := content[2].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("compact error: retry_after_ms is a %T", content[2])
+		}
+		result["retry_after_ms"] = retry
+	}
+	return result, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCBORCompactErrors(t *testing.T) {
+	compact := NewCBORCodecV2(true)
+	compact.CompactErrors = true
+	plain := NewCBORCodecV2(true)
+	roundTrip := func(t *testing.T, input string) (compactSize, plainSize int) {
+		t.Helper()
+		b, err := compact.JSONToCBOR(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("JSONToCBOR: %s", err)
+		}
+		got, err := compact.CBORToJSON(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("CBORToJSON: %s", err)
+		}
+		if string(got) != input {
+			t.Errorf("round trip: got %s want %s", got, input)
+		}
+		// codecs without CompactErrors still decode them
+		got, err = plain.CBORToJSON(bytes.NewReader(b))
+		if err != nil || string(got) != input {
+			t.Errorf("round trip without CompactErrors: got %s, %v want %s", got, err, input)
+		}
+		pb, err := plain.JSONToCBOR(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("JSONToCBOR without CompactErrors: %s", err)
+		}
+		return len(b), len(pb)
+	}
+
+	var errcodes int
+	for _, v := range cborv2Values {
+		if !strings.HasPrefix(v, "M_") {
+			continue
+		}
+		errcodes++
+		compactSize, plainSize := roundTrip(t, `{"errcode":"`+v+`","error":"Something went wrong"}`)
+		// the tag and array header cost 3 bytes, rather than 6 bytes for the map header, two keys and tag 6
+		if compactSize != plainSize-3 {
+			t.Errorf("%s: got %d bytes want %d", v, compactSize, plainSize-3)
+		}
+	}
+	if errcodes < 40 {
+		t.Errorf("got %d errcodes in the values list, want all of them", errcodes)
+	}
+
+	// rate limiting, which needs to be cheap as clients retry
+	in := `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":2000}`
+	compactSize, plainSize := roundTrip(t, in)
+	if compactSize != 26 || plainSize != 31 || len(in) != 80 {
+		t.Errorf("M_LIMIT_EXCEEDED: got %d bytes compact, %d bytes plain from %d bytes of JSON", compactSize, plainSize, len(in))
+	}
+
+	// errcodes which are not in the dictionary are sent as strings
+	roundTrip(t, `{"errcode":"ORG.EXAMPLE_CUSTOM","error":"custom"}`)
+	// anything else is a map as usual
+	for _, in := range []string{
+		`{"errcode":"M_UNKNOWN_TOKEN","error":"Token expired","soft_logout":true}`,
+		`{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":1.5}`,
+		`{"errcode":"M_FORBIDDEN"}`,
+		`{"errcode":"M_FORBIDDEN","error":null}`,
+	} {
+		compactSize, plainSize := roundTrip(t, in)
+		if compactSize != plainSize {
+			t.Errorf("%s: got %d bytes want the %d bytes of a map", in, compactSize, plainSize)
+		}
+	}
+
+	// malformed compact errors fail to decode
+	for _, b := range [][]byte{
+		{0xd8, 0x72, 0x81, 0x00},             // 114([0])
+		{0xd8, 0x72, 0x82, 0x18, 0xff, 0x60}, // 114([255, ""])
+		{0xd8, 0x72, 0x82, 0x00, 0x00},       // 114([0, 0])
+		{0xd8, 0x72, 0x83, 0x00, 0x60, 0x20}, // 114([0, "", -1])
+	} {
+		if _, err := compact.CBORToJSON(bytes.NewReader(b)); !errors.Is(err, ErrCBORDecode) {
+			t.Errorf("%x: got error %v want ErrCBORDecode", b, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"sort"
+	"strings"
+
+	cbor "github.com/fxamacker/cbor/v2"
+)
+
+// Identifiers which are repeated within a single document (user IDs, room IDs, event IDs, mxc:// URIs) can be
+// replaced with references to a table at the start of the document, in the same way as draft-ietf-cbor-packed:
+//   - Tag 113 wraps a two element array: [table, document]. The table is an array of strings.
+//   - Tag 117 wrapping N is a reference to table[N]. References are numbered from 0 whatever the dictionary, so they
+//     never depend on the length of the values list, which grows as values are appended to it.
+//
+// References do not depend on the order in which the document is encoded, as Go maps have no fixed order.
+// This applies to map keys as well as values. Only exact matches are replaced, so identifiers which differ by
+// a single character have their own table entries.
+const (
+	cborTagInternTable     = 113
+	cborTagInternReference = 117
+)
+
+// internPrefixes are the prefixes of strings which are considered identifiers worth interning. Other strings are
+// rarely repeated within a document, so are left alone to avoid the cost of counting them.
+var internPrefixes = []string{"@", "!", "#", "$", "+", "mxc://"}
+
+func isInternable(s string) bool {
+	// anything shorter is never smaller as a reference
+	if len(s) < 4 {
+		return false
+	}
+	for _, p := range internPrefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// cborUintSize returns the number of bytes needed to encode an unsigned integer or the header for a string of length n
+func cborUintSize(n int) int {
+	switch {
+	case n < 24:
+		return 1
+	case n <= 0xff:
+		return 2
+	case n <= 0xffff:
+		return 3
+	case n <= 0xffffffff:
+		return 5
+	default:
+		return 9
+	}
+}
+
+// intern replaces repeated identifiers in the output of jsonInterfaceToCBORInterface with references, and returns
+// the table the references point to. Returns the input unchanged and an empty table if no identifiers are repeated
+// enough to make the document smaller.
+func intern(cborInt interface{}) (interface{}, []interface{}) {
+	counts := make(map[string]int)
+	countInternable(cborInt, counts)
+	candidates := make([]string, 0, len(counts))
+	for s, n := range counts {
+		if n > 1 {
+			candidates = append(candidates, s)
+		}
+	}
+	// most frequent identifiers first, so they get the smallest references
+	sort.Slice(candidates, func(i, j int) bool {
+		if counts[candidates[i]] != counts[candidates[j]] {
+			return counts[candidates[i]] > counts[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+	refs := make(map[string]uint64)
+	var table []interface{}
+	saved := 0
+	for _, s := range candidates {
+		ref := len(table)
+		// tag 117 is 2 bytes, then the reference number
+		refSize := 2 + cborUintSize(ref)
+		strSize := cborUintSize(len(s)) + len(s)
+		n := counts[s]
+		// the string is written once in the table and then n references, rather than n times
+		if n*strSize <= strSize+n*refSize {
+			continue
+		}
+		saved += n*strSize - (strSize + n*refSize)
+		refs[s] = uint64(ref)
+		table = append(table, s)
+	}
+	// tag 113 is 2 bytes, then the headers for the outer array and the table
+	if saved <= 3+cborUintSize(len(table)) {
+		return cborInt, nil
+	}
+	return replaceInterned(cborInt, refs), table
+}
+
+func countInternable(cborInt interface{}, counts map[string]int) {
+	switch v := cborInt.(type) {
+	case string:
+		if isInternable(v) {
+			counts[v]++
+		}
+	case []interface{}:
+		for _, element := range v {
+			countInternable(element, counts)
+		}
+	case map[interface{}]interface{}:
+		for k, val := range v {
+			countInternable(k, counts)
+			countInternable(val, counts)
+		}
+	}
+}
+
+func replaceInterned(cborInt interface{}, refs map[string]uint64) interface{} {
+	switch v := cborInt.(type) {
+	case string:
+		if ref, ok := refs[v]; ok {
+			return cbor.Tag{Number: cborTagInternReference, Content: ref}
+		}
+		return v
+	case []interface{}:
+		for i, element := range v {
+			v[i] = replaceInterned(element, refs)
+		}
+		return v
+	case map[interface{}]interface{}:
+		result := make(map[interface{}]interface{}, len(v))
+		for k, val := range v {
+			result[replaceInterned(k, refs)] = replaceInterned(val, refs)
+		}
+		return result
+	default:
+		return cborInt
+	}
+}
+
+// unintern replaces references with the strings in the table, if the document has one. Documents without a table
+// are returned unchanged.
+func unintern(cborInt interface{}) interface{} {
+	tag, ok := cborInt.(cbor.Tag)
+	if !ok || tag.Number != cborTagInternTable {
+		return cborInt
+	}
+	content, ok := tag.Content.([]interface{})
+	if !ok || len(content) != 2 {
+		return cborInt
+	}
+	rawTable, ok := content[0].([]interface{})
+	if !ok {
+		return cborInt
+	}
+	table := make([]string, len(rawTable))
+	for i := range rawTable {
+		s, ok := rawTable[i].(string)
+		if !ok {
+			return cborInt
+		}
+		table[i] = s
+	}
+	return resolveInterned(content[1], table)
+}
+
+func resolveInterned(cborInt interface{}, table []string) interface{} {
+	switch v := cborInt.(type) {
+	case cbor.Tag:
+		return resolveInternedTag(v, table)
+	case []interface{}:
+		for i, element := range v {
+			v[i] = resolveInterned(element, table)
+		}
+		return v
+	case map[interface{}]interface{}:
+		result := make(map[interface{}]interface{}, len(v))
+		for k, val := range v {
+			if ktag, ok := k.(cbor.Tag); ok {
+				result[resolveInternedTag(ktag, table)] = resolveInterned(val, table)
+			} else {
+				result[k] = resolveInterned(val, table)
+			}
+		}
+		return result
+	default:
+		return cborInt
+	}
+}
+
+// resolveInternedTag returns the table entry for the tag, or the tag itself if it is not a reference to the table
+func resolveInternedTag(tag cbor.Tag, table []string) interface{} {
+	if tag.Number != cborTagInternReference {
+		return tag
+	}
+	i, ok := num(tag.Content)
+	if !ok || i < 0 || i >= len(table) {
+		return tag
+	}
+	return table[i]
+}
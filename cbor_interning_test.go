@@ -0,0 +1,246 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// busyRoomSync returns a /sync response with a room where a few users have sent many messages, which is the
+// case interning helps the most with.
+func busyRoomSync(numEvents int) []byte {
+	users := []string{"@alice:example.com", "@bob:example.com", "@charlie:example.org", "@alicf:example.com"}
+	roomID := "!aBcDeFgHiJkLmNoP:example.com"
+	var events []map[string]interface{}
+	for i := 0; i < numEvents; i++ {
+		events = append(events, map[string]interface{}{
+			"type":             "m.room.message",
+			"sender":           users[i%len(users)],
+			"event_id":         fmt.Sprintf("$event%d:example.com", i),
+			"origin_server_ts": 1620000000000 + i,
+			"content": map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    fmt.Sprintf("message number %d", i),
+			},
+			"unsigned": map[string]interface{}{
+				"age": 100 * i,
+			},
+		})
+	}
+	var members []map[string]interface{}
+	for _, u := range users {
+		members = append(members, map[string]interface{}{
+			"type":      "m.room.member",
+			"state_key": u,
+			"sender":    u,
+			"event_id":  "$member" + u,
+			"content": map[string]interface{}{
+				"membership": "join",
+				"avatar_url": "mxc://example.com/" + u[1:6],
+			},
+		})
+	}
+	sync := map[string]interface{}{
+		"next_batch": "s123_456",
+		"rooms": map[string]interface{}{
+			"join": map[string]interface{}{
+				roomID: map[string]interface{}{
+					"timeline": map[string]interface{}{
+						"events":     events,
+						"limited":    false,
+						"prev_batch": "t1-2",
+					},
+					"state": map[string]interface{}{
+						"events": members,
+					},
+					"ephemeral": map[string]interface{}{
+						"events": []interface{}{
+							map[string]interface{}{
+								"type":    "m.typing",
+								"content": map[string]interface{}{"user_ids": users[:2]},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	b, err := json.Marshal(sync)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestCBORInternIdentifiers(t *testing.T) {
+	input := busyRoomSync(50)
+	want, err := gomatrixserverlib.CanonicalJSON(input)
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %s", err)
+	}
+	plain := NewCBORCodecV1(true)
+	plainCBOR, err := plain.JSONToCBOR(bytes.NewReader(input))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	codec := NewCBORCodecV1(true)
+	codec.InternIdentifiers = true
+	cborBytes, err := codec.JSONToCBOR(bytes.NewReader(input))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	t.Logf("busy room /sync: JSON %d bytes, CBOR %d bytes, CBOR with interning %d bytes",
+		len(input), len(plainCBOR), len(cborBytes))
+	if len(cborBytes) >= len(plainCBOR) {
+		t.Errorf("interning did not reduce size: got %d bytes, was %d bytes", len(cborBytes), len(plainCBOR))
+	}
+	// both codecs must decode interned documents, regardless of InternIdentifiers
+	for _, c := range []*CBORCodec{codec, plain} {
+		got, err := c.CBORToJSON(bytes.NewReader(cborBytes))
+		if err != nil {
+			t.Fatalf("CBORToJSON: %s", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("did not pass through CBOR successfully:\ngot  %s\nwant %s", string(got), string(want))
+		}
+	}
+}
+
+// TestCBORInternSimilarIdentifiers checks that identifiers which differ by a single character are not confused
+func TestCBORInternSimilarIdentifiers(t *testing.T) {
+	input := `{
+		"@alice:example.com": ["@alice:example.com", "@alicf:example.com", "@alice:example.co", "@alice:example.com"],
+		"@alicf:example.com": ["@alicf:example.com", "@alice:example.com", "mxc://a/b", "mxc://a/c"],
+		"@alice:example.co": ["mxc://a/b", "mxc://a/c", "mxc://a/b", "mxc://a/c", "@alice:example.co"],
+		"avatar_url": "mxc://a/b",
+		"room_id": "!room:a",
+		"other": ["!room:a", "!room:b", "!room:b", "!room:a"]
+	}`
+	want, err := gomatrixserverlib.CanonicalJSON([]byte(input))
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %s", err)
+	}
+	codec := NewCBORCodecV1(true)
+	codec.InternIdentifiers = true
+	cborBytes, err := codec.JSONToCBOR(bytes.NewBufferString(input))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	// tag 113
+	if !bytes.HasPrefix(cborBytes, []byte{0xd8, cborTagInternTable}) {
+		t.Fatalf("document was not interned: %x", cborBytes)
+	}
+	got, err := codec.CBORToJSON(bytes.NewReader(cborBytes))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("did not pass through CBOR successfully:\ngot  %s\nwant %s", string(got), string(want))
+	}
+}
+
+// TestCBORInternValuesListGrowth checks that references to the table still resolve between peers whose values lists
+// have different lengths, as happens once values are appended to the list
+func TestCBORInternValuesListGrowth(t *testing.T) {
+	input := busyRoomSync(20)
+	want, err := gomatrixserverlib.CanonicalJSON(input)
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %s", err)
+	}
+	// an older build, without the values appended since
+	appended := cborv2Values[len(cborv2Values)-3:]
+	for _, v := range appended {
+		if bytes.Contains(input, []byte(`"`+v+`"`)) {
+			t.Fatalf("test document contains %s, which the older values list does not have", v)
+		}
+	}
+	older, err := NewCBORCodecWithValues(cborv2Keys, cborv2Values[:len(cborv2Values)-len(appended)], cborv2Prefixes, true)
+	if err != nil {
+		t.Fatalf("NewCBORCodecWithValues: %s", err)
+	}
+	newer := NewCBORCodecV2(true)
+	older.InternIdentifiers, newer.InternIdentifiers = true, true
+	testCases := []struct {
+		name     string
+		enc, dec *CBORCodec
+	}{
+		{name: "older to newer", enc: older, dec: newer},
+		{name: "newer to older", enc: newer, dec: older},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cborBytes, err := tc.enc.JSONToCBOR(bytes.NewReader(input))
+			if err != nil {
+				t.Fatalf("JSONToCBOR: %s", err)
+			}
+			if !bytes.HasPrefix(cborBytes, []byte{0xd8, cborTagInternTable}) {
+				t.Fatalf("document was not interned: %x", cborBytes)
+			}
+			got, err := tc.dec.CBORToJSON(bytes.NewReader(cborBytes))
+			if err != nil {
+				t.Fatalf("CBORToJSON: %s", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("did not pass through CBOR successfully:\ngot  %s\nwant %s", string(got), string(want))
+			}
+		})
+	}
+}
+
+// TestCBORInternOnlyWhenSmaller checks that documents which would not be smaller with a table are encoded as before
+func TestCBORInternOnlyWhenSmaller(t *testing.T) {
+	plain := NewCBORCodecV1(true)
+	codec := NewCBORCodecV1(true)
+	codec.InternIdentifiers = true
+	for _, input := range []string{
+		`{"user_id":"@alice:example.com","room_id":"!abc:example.com","body":"hello"}`,
+		`{"user_id":"@a:b.c","sender":"@a:b.c"}`,
+	} {
+		want, err := plain.JSONToCBOR(bytes.NewBufferString(input))
+		if err != nil {
+			t.Fatalf("JSONToCBOR: %s", err)
+		}
+		got, err := codec.JSONToCBOR(bytes.NewBufferString(input))
+		if err != nil {
+			t.Fatalf("JSONToCBOR: %s", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: interning did not make the document smaller but was used:\ngot  %x\nwant %x", input, got, want)
+		}
+	}
+}
+
+func BenchmarkCBORInternIdentifiers(b *testing.B) {
+	input := busyRoomSync(200)
+	for _, intern := range []bool{false, true} {
+		b.Run(fmt.Sprintf("intern=%v", intern), func(b *testing.B) {
+			codec := NewCBORCodecV1(false)
+			codec.InternIdentifiers = intern
+			var size int
+			for i := 0; i < b.N; i++ {
+				out, err := codec.JSONToCBOR(bytes.NewReader(input))
+				if err != nil {
+					b.Fatalf("JSONToCBOR: %s", err)
+				}
+				size = len(out)
+			}
+			b.ReportMetric(float64(size), "bytes/doc")
+		})
+	}
+}
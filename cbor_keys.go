@@ -0,0 +1,113 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"strconv"
+
+	cbor "github.com/fxamacker/cbor/v2"
+)
+
+// CBOR encodes integers in their shortest form: 0 to 23 and -1 to -24 fit in the initial byte, and 24 to 255 and -25
+// to -256 take one more byte. The dictionaries have no negative keys, so with SignedKeys the first 24 keys which would
+// take two bytes, 24 to 47, are sent as the negative integers -1 to -24 instead:
+//   - Key k from 24 to 47 is sent as -(k-23), so 24 is -1 and 47 is -24.
+//   - Every other key is sent as it is.
+//
+// Codecs which have negative keys of their own never sign keys, as the two would be ambiguous.
+const (
+	maxInlineKey = 23
+	maxSignedKey = 2*maxInlineKey + 1
+)
+
+// maxInt is the largest int, which is smaller than the largest CBOR integer on 32-bit platforms
+const maxInt = int(^uint(0) >> 1)
+
+// signKeys replaces the keys from 24 to 47 in the output of JSONToCBOR's other passes with negative integers
+func signKeys(cborInt interface{}) interface{} {
+	switch v := cborInt.(type) {
+	case cbor.Tag:
+		v.Content = signKeys(v.Content)
+		return v
+	case []interface{}:
+		for i, element := range v {
+			v[i] = signKeys(element)
+		}
+		return v
+	case map[interface{}]interface{}:
+		result := make(map[interface{}]interface{}, len(v))
+		for k, val := range v {
+			if kint, ok := k.(int); ok && kint > maxInlineKey && kint <= maxSignedKey {
+				k = maxInlineKey - kint
+			}
+			result[k] = signKeys(val)
+		}
+		return result
+	default:
+		return cborInt
+	}
+}
+
+// unsignKeys replaces the negative keys from -1 to -24 from the CBOR decoder with the keys they were signed from,
+// before calling cborInterfaceToJSONInterface. Keys are left as they are if the codec has negative keys, or if the
+// map also has the key they were signed from. Maps are rewritten in place, so documents without signed keys are not
+// copied.
+func (c *CBORCodec) unsignKeys(cborInt interface{}) interface{} {
+	if c.negativeKeys {
+		return cborInt
+	}
+	switch v := cborInt.(type) {
+	case cbor.Tag:
+		v.Content = c.unsignKeys(v.Content)
+		return v
+	case []interface{}:
+		for i, element := range v {
+			v[i] = c.unsignKeys(element)
+		}
+		// rather than v, which would be copied to the heap
+		return cborInt
+	case map[interface{}]interface{}:
+		var signed []int64
+		for k, val := range v {
+			v[k] = c.unsignKeys(val)
+			if k64, ok := k.(int64); ok && k64 < 0 && k64 >= -(maxInlineKey+1) {
+				signed = append(signed, k64)
+			}
+		}
+		// after ranging, as keys added while ranging over a map may or may not be visited
+		for _, k64 := range signed {
+			unsigned := uint64(maxInlineKey - k64)
+			if _, exists := v[unsigned]; !exists {
+				v[unsigned] = v[k64]
+				delete(v, k64)
+			}
+		}
+		return v
+	default:
+		return cborInt
+	}
+}
+
+// bigIntKey returns the decimal string of an integer key which is too large for num, as no lookup can have it.
+// Keys beyond the int64 range are bignums, which the CBOR decoder rejects as map keys.
+func bigIntKey(k interface{}) (string, bool) {
+	switch n := k.(type) {
+	case uint64:
+		return strconv.FormatUint(n, 10), true
+	case int64:
+		return strconv.FormatInt(n, 10), true
+	}
+	return "", false
+}
@@ -0,0 +1,184 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCBORKeyBoundaries(t *testing.T) {
+	testCases := []struct {
+		key        int
+		wantKey    string
+		wantSigned string
+	}{
+		{key: 0, wantKey: "00", wantSigned: "00"},
+		{key: 23, wantKey: "17", wantSigned: "17"},
+		{key: 24, wantKey: "1818", wantSigned: "20"},
+		{key: 47, wantKey: "182f", wantSigned: "37"},
+		{key: 48, wantKey: "1830", wantSigned: "1830"},
+		{key: 255, wantKey: "18ff", wantSigned: "18ff"},
+		{key: 256, wantKey: "190100", wantSigned: "190100"},
+	}
+	keys := make(map[string]int)
+	for _, tc := range testCases {
+		keys[fmt.Sprintf("k%d", tc.key)] = tc.key
+	}
+	codec, err := NewCBORCodec(keys, true)
+	if err != nil {
+		t.Fatalf("NewCBORCodec: %s", err)
+	}
+	signing := *codec
+	signing.SignedKeys = true
+	for _, tc := range testCases {
+		input := fmt.Sprintf(`{"k%d":true}`, tc.key)
+		for _, c := range []struct {
+			codec *CBORCodec
+			want  string
+		}{
+			{codec, tc.wantKey},
+			{&signing, tc.wantSigned},
+		} {
+			output, err := c.codec.JSONToCBOR(bytes.NewBufferString(input))
+			if err != nil {
+				t.Fatalf("JSONToCBOR %s: %s", input, err)
+			}
+			// a map of one key with the value true
+			want := "a1" + c.want + "f5"
+			if got := hex.EncodeToString(output); got != want {
+				t.Errorf("key %d SignedKeys=%v: got %s want %s", tc.key, c.codec.SignedKeys, got, want)
+			}
+			// codecs decode signed keys whether or not they send them
+			for _, decoder := range []*CBORCodec{codec, &signing} {
+				got, err := decoder.CBORToJSON(bytes.NewReader(output))
+				if err != nil {
+					t.Fatalf("CBORToJSON %x: %s", output, err)
+				}
+				if string(got) != input {
+					t.Errorf("key %d round trip: got %s want %s", tc.key, got, input)
+				}
+			}
+		}
+	}
+}
+
+func TestCBORSignedKeys(t *testing.T) {
+	codec := NewCBORCodecV1(true)
+	codec.SignedKeys = true
+	codec.InternIdentifiers = true
+	input := `{"next_batch":"s1","rooms":{"join":{"!a:b":{"timeline":{"events":[` +
+		`{"content":{"body":"hi","msgtype":"m.text"},"event_id":"$1","origin_server_ts":1,"sender":"@a:b","type":"m.room.message"},` +
+		`{"content":{"body":"hi","msgtype":"m.text"},"event_id":"$2","origin_server_ts":2,"sender":"@a:b","type":"m.room.message"}` +
+		`],"limited":false}}}}}`
+	plain, err := NewCBORCodecV1(true).JSONToCBOR(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	signed, err := codec.JSONToCBOR(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	t.Logf("/sync: %d bytes, %d bytes with signed keys", len(plain), len(signed))
+	if len(signed) >= len(plain) {
+		t.Errorf("signed keys did not make the document smaller: %d bytes want fewer than %d", len(signed), len(plain))
+	}
+	got, err := NewCBORCodecV1(true).CBORToJSON(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	if string(got) != input {
+		t.Errorf("round trip:\ngot  %s\nwant %s", got, input)
+	}
+
+	// codecs with negative keys of their own never sign keys
+	negative, err := NewCBORCodec(map[string]int{"minus": -1, "k24": 24}, true)
+	if err != nil {
+		t.Fatalf("NewCBORCodec: %s", err)
+	}
+	negative.SignedKeys = true
+	output, err := negative.JSONToCBOR(strings.NewReader(`{"k24":true,"minus":false}`))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	if want := "a220f41818f5"; hex.EncodeToString(output) != want {
+		t.Errorf("negative keys: got %x want %s", output, want)
+	}
+	got, err = negative.CBORToJSON(bytes.NewReader(output))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	if want := `{"k24":true,"minus":false}`; string(got) != want {
+		t.Errorf("negative keys: got %s want %s", got, want)
+	}
+}
+
+// TestCBORUnsignKeysInPlace checks that decoding a document without signed keys does not copy its maps
+func TestCBORUnsignKeysInPlace(t *testing.T) {
+	codec := NewCBORCodecV1(true)
+	doc := map[interface{}]interface{}{
+		uint64(5):  map[interface{}]interface{}{"body": "hi", uint64(30): []interface{}{map[interface{}]interface{}{uint64(1): true}}},
+		"!a:b":     "x",
+		int64(-30): "not a signed key",
+	}
+	if allocs := testing.AllocsPerRun(100, func() { codec.unsignKeys(doc) }); allocs != 0 {
+		t.Errorf("unsignKeys of a document without signed keys: got %v allocations want 0", allocs)
+	}
+	signed := map[interface{}]interface{}{int64(-1): "a", int64(-24): "b", int64(-2): "c", uint64(25): "d"}
+	got := codec.unsignKeys(signed)
+	want := map[interface{}]interface{}{uint64(24): "a", uint64(47): "b", int64(-2): "c", uint64(25): "d"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("unsignKeys: got %v want %v", got, want)
+	}
+}
+
+func TestCBORIntegerKeyRange(t *testing.T) {
+	codec, err := NewCBORCodec(map[string]int{"k24": 24}, true)
+	if err != nil {
+		t.Fatalf("NewCBORCodec: %s", err)
+	}
+	testCases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "largest uint64", input: "a11bfffffffffffffffff5", want: `{"18446744073709551615":true}`},
+		{name: "smallest int64", input: "a13b7ffffffffffffffff5", want: `{"-9223372036854775808":true}`},
+		{name: "one past the signed keys", input: "a13818f5", want: `{"-25":true}`},
+		{name: "unknown key", input: "a11830f5", want: `{"48":true}`},
+		// the key which -1 was signed from is already in the map, so -1 is sent as it is
+		{name: "signed and unsigned", input: "a2181801" + "2002", want: `{"-1":2,"k24":1}`},
+	}
+	for _, tc := range testCases {
+		input, err := hex.DecodeString(tc.input)
+		if err != nil {
+			t.Fatalf("%s: bad hex: %s", tc.name, err)
+		}
+		got, err := codec.CBORToJSON(bytes.NewReader(input))
+		if err != nil {
+			t.Fatalf("%s: CBORToJSON: %s", tc.name, err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: got %s want %s", tc.name, got, tc.want)
+		}
+	}
+	// keys too small for an int64 are bignums, which cannot be map keys
+	if _, err := codec.CBORToJSON(bytes.NewReader([]byte{0xa1, 0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xf5})); err == nil {
+		t.Errorf("CBORToJSON accepted a key too small for an int64")
+	}
+}
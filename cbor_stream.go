@@ -0,0 +1,341 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bufio"
+	"bytes"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	cbor "github.com/fxamacker/cbor/v2"
+)
+
+// CBOR major types used for the heads of containers
+const (
+	cborMajorArray = 4 << 5
+	cborMajorMap   = 5 << 5
+)
+
+const (
+	cborIndefiniteArray = cborMajorArray | 31
+	cborIndefiniteMap   = cborMajorMap | 31
+	cborBreak           = 0xff
+)
+
+// ErrDuplicateKey is the cause of a StreamingEncoder failing because an object repeats a key, which only a canonical
+// encoder can handle in the same way as JSONToCBOR
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// NewStreamingCBOREncoder returns a writer which converts the JSON written to it into CBOR using the v1 dictionary,
+// writing the CBOR to w as the JSON arrives rather than once the whole document has been written. Close MUST be
+// called once the JSON has been written, and returns an error if the JSON was invalid or incomplete.
+func NewStreamingCBOREncoder(w io.Writer) *StreamingEncoder {
+	return NewCBORCodecV1(false).NewStreamingEncoder(w)
+}
+
+// NewStreamingEncoder returns a writer which converts the JSON written to it into CBOR with the keys and values of
+// this codec, writing the CBOR to w as the JSON arrives. This is for large request bodies like event batches, which
+// would otherwise be held in memory twice over, as JSON and decoded. Close MUST be called once the JSON has been
+// written, and returns an error if the JSON was invalid or incomplete.
+//
+// Objects and arrays are sent with indefinite lengths, as their lengths are not known until they end. Canonical
+// CBOR forbids this, so if the codec is canonical each object and array is buffered as CBOR until it ends, so the
+// output is the same as JSONToCBOR. BinaryBase64 and SignedKeys are applied as each string and key arrives.
+// InternIdentifiers and CompactErrors are not applied, as the table of identifiers comes before the document and an
+// error is only known to be compact once it ends: CBORToJSON accepts documents without them.
+//
+// JSONToCBOR keeps the last value of a key which is repeated in an object. A canonical encoder does the same, but
+// other encoders have written the first value by the time the key is repeated, so return an error which wraps
+// ErrDuplicateKey instead. Callers which still have the JSON can convert it with JSONToCBOR.
+func (c *CBORCodec) NewStreamingEncoder(w io.Writer) *StreamingEncoder {
+	pr, pw := io.Pipe()
+	enc := cbor.EncOptions{}
+	if c.canonical {
+		enc = cbor.CanonicalEncOptions()
+	}
+	s := &StreamingEncoder{
+		codec: c,
+		pw:    pw,
+		done:  make(chan struct{}),
+	}
+	go func() {
+		start := time.Now()
+		err := s.encode(pr, w, enc)
+		c.observeConversion("json_to_cbor", start, err)
+		if err != nil {
+			// fail the writes which are waiting, and any future ones
+			pr.CloseWithError(err)
+		} else {
+			pr.Close()
+		}
+		s.err = err
+		close(s.done)
+	}()
+	return s
+}
+
+// StreamingEncoder converts the JSON written to it into CBOR as it arrives. Make one with NewStreamingEncoder.
+type StreamingEncoder struct {
+	codec *CBORCodec
+	pw    *io.PipeWriter
+	// closed once the JSON has been converted, after setting err
+	done chan struct{}
+	err  error
+}
+
+// Write converts data, which may end part way through a JSON token, returning an error if the JSON so far is invalid
+func (s *StreamingEncoder) Write(data []byte) (int, error) {
+	return s.pw.Write(data)
+}
+
+// Close waits for the JSON written so far to be converted, returning an error if it was not a single JSON value
+func (s *StreamingEncoder) Close() error {
+	s.pw.Close()
+	<-s.done
+	return s.err
+}
+
+// streamingFrame is an object or array which has not ended yet
+type streamingFrame struct {
+	isMap bool
+	// the next token in an object is a key
+	wantKey bool
+	// the elements are within one of base64Fields, and for an object, whether the value of the current key is
+	inField      bool
+	valueInField bool
+	// the keys of an object so far, with the index in items of their values in canonical mode
+	keys map[string]int
+	// in canonical mode, the index in items of the value which the next value replaces, as its key was repeated,
+	// or -1
+	replace int
+	// in canonical mode, the encoded elements, or the encoded keys and values of an object in turn
+	items [][]byte
+}
+
+// nextInField returns true if the next value in the frame is within one of base64Fields
+func (f *streamingFrame) nextInField() bool {
+	if f == nil {
+		return false
+	}
+	if f.isMap {
+		return f.valueInField
+	}
+	return f.inField
+}
+
+func (s *StreamingEncoder) encode(r io.Reader, w io.Writer, opts cbor.EncOptions) error {
+	em, err := opts.EncMode()
+	if err != nil {
+		return fmt.Errorf("JSONToCBOR: failed to make EncMode: %w", err)
+	}
+	canonical := s.codec.canonical
+	out := bufio.NewWriter(w)
+	dec := stdjson.NewDecoder(r)
+	var stack []*streamingFrame
+	top := func() *streamingFrame {
+		if len(stack) == 0 {
+			return nil
+		}
+		return stack[len(stack)-1]
+	}
+	// emit writes an encoded value to its container, or the output if it is not in one
+	emit := func(b []byte) error {
+		if f := top(); f != nil {
+			if f.isMap {
+				f.wantKey = true
+			}
+			if canonical {
+				if f.replace >= 0 {
+					f.items[f.replace] = b
+					f.replace = -1
+				} else {
+					f.items = append(f.items, b)
+				}
+				return nil
+			}
+		}
+		_, err := out.Write(b)
+		return err
+	}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("JSONToCBOR: unmarshalling json: %w", err)
+		}
+		var b []byte
+		switch v := tok.(type) {
+		case stdjson.Delim:
+			switch v {
+			case '{', '[':
+				f := &streamingFrame{isMap: v == '{', wantKey: v == '{', inField: top().nextInField(), replace: -1}
+				if f.isMap {
+					f.keys = make(map[string]int)
+				}
+				stack = append(stack, f)
+				if !canonical {
+					head := byte(cborIndefiniteArray)
+					if v == '{' {
+						head = cborIndefiniteMap
+					}
+					if err = out.WriteByte(head); err != nil {
+						return err
+					}
+				}
+				continue
+			default:
+				f := top()
+				stack = stack[:len(stack)-1]
+				if canonical {
+					b = encodeCanonicalContainer(f)
+				} else {
+					b = []byte{cborBreak}
+				}
+			}
+		case string:
+			if f := top(); f != nil && f.wantKey {
+				if err = s.writeKey(em, out, f, v); err != nil {
+					return err
+				}
+				continue
+			}
+			if s.codec.BinaryBase64 && top().nextInField() {
+				if packed, ok := packBase64String(v).(cbor.Tag); ok {
+					b, err = em.Marshal(packed)
+					break
+				}
+			}
+			b, err = em.Marshal(s.packString(v))
+		default:
+			// float64, bool or nil
+			b, err = em.Marshal(v)
+		}
+		if err != nil {
+			return fmt.Errorf("JSONToCBOR: %w", err)
+		}
+		if err = emit(b); err != nil {
+			return err
+		}
+		if len(stack) == 0 {
+			break
+		}
+	}
+	// a single JSON value, like JSONToCBOR, but there is nowhere to leave the rest so it must be whitespace
+	if _, err = dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("trailing data after JSON value")
+		}
+		return fmt.Errorf("JSONToCBOR: unmarshalling json: %w", err)
+	}
+	return out.Flush()
+}
+
+// writeKey writes the next key of the object f, with the dictionary and SignedKeys applied. If the key is repeated,
+// a canonical encoder replaces its value with the next one.
+func (s *StreamingEncoder) writeKey(em cbor.EncMode, out io.Writer, f *streamingFrame, key string) error {
+	f.wantKey = false
+	f.valueInField = f.inField || base64Fields[key]
+	if i, ok := f.keys[key]; ok {
+		if !s.codec.canonical {
+			return fmt.Errorf("JSONToCBOR: %w %q", ErrDuplicateKey, key)
+		}
+		f.replace = i
+		return nil
+	}
+	var k interface{} = s.packString(key)
+	if knum, ok := s.codec.keys[key]; ok {
+		if s.codec.SignedKeys && !s.codec.negativeKeys && knum > maxInlineKey && knum <= maxSignedKey {
+			knum = maxInlineKey - knum
+		}
+		k = knum
+	}
+	b, err := em.Marshal(k)
+	if err != nil {
+		return fmt.Errorf("JSONToCBOR: %w", err)
+	}
+	if s.codec.canonical {
+		f.items = append(f.items, b)
+		f.keys[key] = len(f.items)
+		return nil
+	}
+	f.keys[key] = 0
+	_, err = out.Write(b)
+	return err
+}
+
+func (s *StreamingEncoder) packString(str string) interface{} {
+	if s.codec.values == nil {
+		return str
+	}
+	return s.codec.values.packString(str)
+}
+
+// encodeCanonicalContainer encodes a buffered object or array with a definite length, sorting the keys of objects
+// in the same order as cbor.SortCanonical: shortest first, then bytewise
+func encodeCanonicalContainer(f *streamingFrame) []byte {
+	major, n := byte(cborMajorArray), len(f.items)
+	if f.isMap {
+		major, n = cborMajorMap, len(f.items)/2
+		pairs := make([][2][]byte, n)
+		for i := range pairs {
+			pairs[i] = [2][]byte{f.items[2*i], f.items[2*i+1]}
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			a, b := pairs[i][0], pairs[j][0]
+			if len(a) != len(b) {
+				return len(a) < len(b)
+			}
+			return bytes.Compare(a, b) < 0
+		})
+		for i := range pairs {
+			f.items[2*i], f.items[2*i+1] = pairs[i][0], pairs[i][1]
+		}
+	}
+	var buf bytes.Buffer
+	writeCBORHead(&buf, major, uint64(n))
+	for _, item := range f.items {
+		buf.Write(item)
+	}
+	return buf.Bytes()
+}
+
+// writeCBORHead writes the initial byte and argument of a data item with the shortest encoding of n
+func writeCBORHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= 0xff:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= 0xffff:
+		buf.WriteByte(major | 25)
+		buf.Write([]byte{byte(n >> 8), byte(n)})
+	case n <= 0xffffffff:
+		buf.WriteByte(major | 26)
+		buf.Write([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+	default:
+		buf.WriteByte(major | 27)
+		for i := 7; i >= 0; i-- {
+			buf.WriteByte(byte(n >> (8 * uint(i))))
+		}
+	}
+}
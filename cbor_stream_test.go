@@ -0,0 +1,243 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var streamingInputs = []string{
+	`{}`,
+	`[]`,
+	`"m.room.message"`,
+	`12.5`,
+	`null`,
+	`{"type":"m.room.message","content":{"msgtype":"m.text","body":"😀 hello \"world\""},"unsigned":{"age":-1}}`,
+	`{"nested":[[],[{}],[1,true,false,null,"x"],{"a":{"b":{"c":[12345678901,0.001,-0]}}}]}`,
+	`{"errcode":"M_FORBIDDEN","error":"You are not allowed"}`,
+	`{"device_keys":{"algorithms":["m.olm.v1.curve25519-aes-sha2","m.megolm.v1.aes-sha2"],"keys":{"ed25519:ABCDEF":"abc"}}}`,
+	string(busyRoomSync(30)),
+	`{"signatures":{"@alice:example.com":{"ed25519:ABCDEF":"dGhpcyBpcyBub3QgYSByZWFsIHNpZ25hdHVyZSBidXQgaXQgaXMgbG9uZw"}},` +
+		`"keys":{"curve25519:ABCDEF":"3C5BFWi2Y8Kz3b2pmoi3TYVhKj7sQEzuwJWOKCOLaBE"},"body":"dGhpcyBpcyBub3QgYmFzZTY0IGluIGEgZmllbGQ"}`,
+}
+
+// duplicateKeyInputs repeat keys, which JSONToCBOR keeps the last value of
+var duplicateKeyInputs = []string{
+	`{"type":"m.room.message","type":"m.room.member"}`,
+	`{"content":{"body":"first","msgtype":"m.text"},"event_id":"$a","content":{"membership":"join"}}`,
+	`[{"a":1,"b":{"a":2,"a":[3]},"a":{"a":4}}]`,
+}
+
+// streamingEncode writes input to a streaming encoder a few bytes at a time
+func streamingEncode(codec *CBORCodec, input string, chunkSize int) ([]byte, error) {
+	var out bytes.Buffer
+	enc := codec.NewStreamingEncoder(&out)
+	for i := 0; i < len(input); i += chunkSize {
+		end := i + chunkSize
+		if end > len(input) {
+			end = len(input)
+		}
+		if _, err := enc.Write([]byte(input[i:end])); err != nil {
+			enc.Close()
+			return nil, err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// TestStreamingEncoderCanonical checks that canonical streaming encoders write the same bytes as JSONToCBOR, with the
+// options which the streaming encoder applies
+func TestStreamingEncoderCanonical(t *testing.T) {
+	var codecs []*CBORCodec
+	for _, newCodec := range []func(bool) *CBORCodec{NewCBORCodecV1, NewCBORCodecV2} {
+		codecs = append(codecs, newCodec(true))
+		codec := newCodec(true)
+		codec.SignedKeys = true
+		codec.BinaryBase64 = true
+		codecs = append(codecs, codec)
+	}
+	for _, codec := range codecs {
+		name := fmt.Sprintf("%s signed=%v base64=%v", codec.Dictionary(), codec.SignedKeys, codec.BinaryBase64)
+		for _, input := range append(append([]string{}, streamingInputs...), duplicateKeyInputs...) {
+			want, err := codec.JSONToCBOR(bytes.NewBufferString(input))
+			if err != nil {
+				t.Fatalf("JSONToCBOR: %s", err)
+			}
+			for _, chunkSize := range []int{1, 7, len(input)} {
+				got, err := streamingEncode(codec, input, chunkSize)
+				if err != nil {
+					t.Fatalf("%s %s: streaming encode failed: %s", name, input, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s %s: chunk size %d:\ngot  %x\nwant %x", name, input, chunkSize, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestStreamingEncoder(t *testing.T) {
+	decoder := NewCBORCodecV1(true)
+	for _, input := range streamingInputs {
+		var out bytes.Buffer
+		enc := NewStreamingCBOREncoder(&out)
+		if _, err := io.Copy(enc, bytes.NewBufferString(input)); err != nil {
+			t.Fatalf("%s: Write failed: %s", input, err)
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatalf("%s: Close failed: %s", input, err)
+		}
+		got, err := decoder.CBORToJSON(&out)
+		if err != nil {
+			t.Fatalf("%s: CBORToJSON: %s", input, err)
+		}
+		want, err := gomatrixserverlib.CanonicalJSON([]byte(input))
+		if err != nil {
+			t.Fatalf("CanonicalJSON: %s", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("round trip:\ngot  %s\nwant %s", got, want)
+		}
+	}
+}
+
+func TestStreamingEncoderInvalid(t *testing.T) {
+	for _, input := range []string{
+		``,
+		`{"type":`,
+		`{"type" "m.room.message"}`,
+		`{"type":"m.room.message"}}`,
+		`{"type":"m.room.message"} {}`,
+		`[1,2,]`,
+	} {
+		_, err := streamingEncode(NewCBORCodecV1(false), input, 1)
+		if err == nil {
+			t.Errorf("%q: streaming encode succeeded, want error", input)
+		}
+	}
+	// the first value has been written by the time the key is repeated
+	for _, input := range duplicateKeyInputs {
+		_, err := streamingEncode(NewCBORCodecV1(false), input, 1)
+		if !errors.Is(err, ErrDuplicateKey) {
+			t.Errorf("%q: streaming encode returned %v, want %v", input, err, ErrDuplicateKey)
+		}
+	}
+}
+
+// eventBatchReader generates a large upload of events as it is read, so that the input is not held in memory
+type eventBatchReader struct {
+	events int
+	next   int
+	buf    bytes.Buffer
+	// called after each read, to sample the heap
+	onRead func()
+}
+
+func (r *eventBatchReader) Read(p []byte) (int, error) {
+	for r.buf.Len() < len(p) && r.next <= r.events {
+		switch {
+		case r.next == 0:
+			r.buf.WriteString(`{"events":[`)
+		case r.next == r.events:
+			r.buf.WriteString(`]}`)
+		default:
+			if r.next > 1 {
+				r.buf.WriteString(",")
+			}
+			fmt.Fprintf(&r.buf, `{"type":"m.room.message","sender":"@alice:example.com","room_id":"!room:example.com",`+
+				`"event_id":"$event%d:example.com","origin_server_ts":%d,"content":{"msgtype":"m.text",`+
+				`"body":"message number %d, which is long enough to look like a real message"}}`, r.next, 1620000000000+r.next, r.next)
+		}
+		r.next++
+	}
+	if r.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	n, _ := r.buf.Read(p)
+	r.onRead()
+	return n, nil
+}
+
+// BenchmarkStreamingEncoder compares the peak heap of converting a large upload, which is what matters on a
+// constrained device, as well as the total allocated.
+func BenchmarkStreamingEncoder(b *testing.B) {
+	const events = 20000
+	var peak uint64
+	sample := func() {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.HeapInuse > peak {
+			peak = m.HeapInuse
+		}
+	}
+	reads := 0
+	onRead := func() {
+		// ReadMemStats stops the world, so only sample every so often
+		if reads++; reads%64 == 0 {
+			sample()
+		}
+	}
+	run := func(b *testing.B, convert func(r io.Reader, w io.Writer) error) {
+		b.ReportAllocs()
+		var base uint64
+		peak = 0
+		for i := 0; i < b.N; i++ {
+			runtime.GC()
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			base = m.HeapInuse
+			if err := convert(&eventBatchReader{events: events, onRead: onRead}, ioutil.Discard); err != nil {
+				b.Fatalf("convert: %s", err)
+			}
+			sample()
+		}
+		if peak > base {
+			b.ReportMetric(float64(peak-base), "peak-heap-B")
+		}
+	}
+	b.Run("buffered", func(b *testing.B) {
+		codec := NewCBORCodecV1(false)
+		run(b, func(r io.Reader, w io.Writer) error {
+			out, err := codec.JSONToCBOR(r)
+			if err != nil {
+				return err
+			}
+			sample()
+			_, err = w.Write(out)
+			return err
+		})
+	})
+	b.Run("streaming", func(b *testing.B) {
+		run(b, func(r io.Reader, w io.Writer) error {
+			enc := NewStreamingCBOREncoder(w)
+			if _, err := io.Copy(enc, r); err != nil {
+				enc.Close()
+				return err
+			}
+			return enc.Close()
+		})
+	})
+}
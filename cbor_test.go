@@ -18,8 +18,11 @@ import (
 	"bytes"
 	"encoding/hex"
 	stdjson "encoding/json"
+	"errors"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 
 	jsoniter "github.com/json-iterator/go"
@@ -220,3 +223,56 @@ func TestJSONToCBORWriter(t *testing.T) {
 		t.Errorf("wrong response body, got %s want %s", gotBody, wantBody)
 	}
 }
+
+func TestCBORToJSONHandlerDictionaryV2(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		w.Write([]byte(`{"error":"something","errcode":"M_UNKNOWN"}`))
+	})
+	handler := CBORToJSONHandler(next, NewCBORCodecV1(true), nil)
+	testCases := []struct {
+		accept          string
+		wantContentType string
+		wantBody        string
+	}{
+		// M_UNKNOWN is not in v1, so is sent as a string
+		{accept: "", wantContentType: "application/cbor", wantBody: "a21866694d5f554e4b4e4f574e186769736f6d657468696e67"},
+		// M_UNKNOWN is in the v2 values list, so is sent as tag 6
+		{accept: ContentTypeCBORV2, wantContentType: ContentTypeCBORV2, wantBody: "a21866c6182e186769736f6d657468696e67"},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/_matrix/client/r0/sync", nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if got := w.Header().Get("Content-Type"); got != tc.wantContentType {
+			t.Errorf("Accept %q: got Content-Type %s want %s", tc.accept, got, tc.wantContentType)
+		}
+		if got := hex.EncodeToString(w.Body.Bytes()); got != tc.wantBody {
+			t.Errorf("Accept %q: wrong response body, got %s want %s", tc.accept, got, tc.wantBody)
+		}
+	}
+}
+
+func TestCBORToJSONDecodeError(t *testing.T) {
+	codec := NewCBORCodecV1(false)
+	// a map header for 2 pairs with only a single key
+	_, err := codec.CBORToJSON(bytes.NewReader([]byte{0xa2, 0x01}))
+	if !errors.Is(err, ErrCBORDecode) {
+		t.Fatalf("CBORToJSON: got %v want %v", err, ErrCBORDecode)
+	}
+	if errors.Is(err, ErrTooLarge) {
+		t.Errorf("CBORToJSON: error %v matches %v", err, ErrTooLarge)
+	}
+	var lbErr *Error
+	if !errors.As(err, &lbErr) || lbErr.Cause != ErrCBORDecode {
+		t.Fatalf("CBORToJSON: error %v is not an *Error with cause %v", err, ErrCBORDecode)
+	}
+	// the underlying error is kept
+	if err.Error() != lbErr.Err.Error() || !strings.Contains(err.Error(), "unmarshalling cbor") {
+		t.Errorf("CBORToJSON: got error message %q", err.Error())
+	}
+}
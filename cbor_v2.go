@@ -0,0 +1,221 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+// The v2 dictionary is the v1 dictionary with more keys, and with frequent values and prefixes. The v1 dictionary is
+// frozen, as peers which only know v1 would silently drop keys they don't know e.g {"105":{}} rather than failing,
+// so additions go here. Peers use v2 only once the capabilities exchange shows both sides know it.
+var cborv2Keys = withCBORKeys(cborv1Keys, map[string]int{
+	// End-to-end encryption: /keys/*, /sync and to-device events
+	"keys":                             105,
+	"one_time_key_counts":              106,
+	"device_one_time_keys_count":       107,
+	"device_unused_fallback_key_types": 108,
+	"fallback_keys":                    109,
+	"master_keys":                      110,
+	"self_signing_keys":                111,
+	"user_signing_keys":                112,
+	"usage":                            113,
+	"algorithms":                       114,
+	"key":                              115,
+	"fallback":                         116,
+	"left":                             117,
+
+	// To-device messages: PUT /sendToDevice and to_device in /sync
+	"messages":             118,
+	"org.matrix.msgid":     119,
+	"action":               120,
+	"requesting_device_id": 121,
+	"request_id":           122,
+	"from_device":          123,
+	"methods":              124,
+	"timestamp":            125,
+	"code":                 126,
+
+	// Filters: POST /user/{userId}/filter and GET /user/{userId}/filter/{filterId}
+	"filter_id":                 127,
+	"event_fields":              128,
+	"event_format":              129,
+	"room":                      130,
+	"limit":                     131,
+	"types":                     132,
+	"not_types":                 133,
+	"senders":                   134,
+	"not_senders":               135,
+	"not_rooms":                 136,
+	"include_leave":             137,
+	"lazy_load_members":         138,
+	"include_redundant_members": 139,
+	"contains_url":              140,
+
+	// QR code login: MSC4108 rendezvous sessions and the messages the two devices exchange over them
+	"url":                        141,
+	"protocols":                  142,
+	"protocol":                   143,
+	"homeserver":                 144,
+	"device_authorization_grant": 145,
+	"verification_uri":           146,
+	"verification_uri_complete":  147,
+
+	// Error responses: https://spec.matrix.org/v1.9/client-server-api/#standard-error-response
+	"retry_after_ms": 148,
+	"soft_logout":    149,
+
+	// Spaces: GET /rooms/{roomId}/hierarchy and m.space.child events
+	"children_state":     150,
+	"room_type":          151,
+	"world_readable":     152,
+	"guest_can_join":     153,
+	"num_joined_members": 154,
+	"canonical_alias":    155,
+	"via":                156,
+	"suggested":          157,
+	"order":              158,
+	"allowed_room_ids":   159,
+
+	// Pagination: GET /rooms/{roomId}/messages
+	"start": 160,
+	"end":   161,
+
+	// GET /capabilities
+	"capabilities":      162,
+	"m.change_password": 163,
+	"enabled":           164,
+	"m.room_versions":   165,
+	"default":           166,
+	"available":         167,
+	"m.set_displayname": 168,
+	"m.set_avatar_url":  169,
+	"m.3pid_changes":    170,
+	"m.get_login_token": 171,
+})
+
+// Entire string values which are replaced with tag 6 wrapping the index in this list. Append only.
+var cborv2Values = []string{
+	"m.olm.v1.curve25519-aes-sha2",
+	"m.megolm.v1.aes-sha2",
+	"signed_curve25519",
+	"curve25519",
+	"ed25519",
+	"master",
+	"self_signing",
+	"user_signing",
+	"m.room.encrypted",
+	"m.room_key",
+	"m.room_key_request",
+	"m.forwarded_room_key",
+	"m.room_key.withheld",
+	"m.secret.request",
+	"m.secret.send",
+	"m.dummy",
+	"m.key.verification.request",
+	"m.key.verification.ready",
+	"m.key.verification.start",
+	"m.key.verification.accept",
+	"m.key.verification.key",
+	"m.key.verification.mac",
+	"m.key.verification.cancel",
+	"m.key.verification.done",
+	"m.sas.v1",
+	"request",
+	"request_cancellation",
+	"client",
+	"federation",
+	"m.login.protocols",
+	"m.login.protocol",
+	"m.login.protocol_accepted",
+	"m.login.success",
+	"m.login.declined",
+	"m.login.failure",
+	"m.login.secrets",
+	"device_authorization_grant",
+	// Error codes: https://spec.matrix.org/v1.9/client-server-api/#common-error-codes and the errors of each
+	// endpoint. M_CONCURRENT_WRITE is from MSC4108.
+	"M_FORBIDDEN",
+	"M_UNKNOWN_TOKEN",
+	"M_MISSING_TOKEN",
+	"M_USER_LOCKED",
+	"M_BAD_JSON",
+	"M_NOT_JSON",
+	"M_NOT_FOUND",
+	"M_LIMIT_EXCEEDED",
+	"M_UNRECOGNIZED",
+	"M_UNKNOWN",
+	"M_UNAUTHORIZED",
+	"M_USER_DEACTIVATED",
+	"M_USER_IN_USE",
+	"M_INVALID_USERNAME",
+	"M_ROOM_IN_USE",
+	"M_INVALID_ROOM_STATE",
+	"M_THREEPID_IN_USE",
+	"M_THREEPID_NOT_FOUND",
+	"M_THREEPID_AUTH_FAILED",
+	"M_THREEPID_DENIED",
+	"M_SERVER_NOT_TRUSTED",
+	"M_UNSUPPORTED_ROOM_VERSION",
+	"M_INCOMPATIBLE_ROOM_VERSION",
+	"M_BAD_STATE",
+	"M_GUEST_ACCESS_FORBIDDEN",
+	"M_CAPTCHA_NEEDED",
+	"M_CAPTCHA_INVALID",
+	"M_MISSING_PARAM",
+	"M_INVALID_PARAM",
+	"M_TOO_LARGE",
+	"M_EXCLUSIVE",
+	"M_RESOURCE_LIMIT_EXCEEDED",
+	"M_CANNOT_LEAVE_SERVER_NOTICE_ROOM",
+	"M_THREEPID_MEDIUM_NOT_SUPPORTED",
+	"M_WEAK_PASSWORD",
+	"M_UNABLE_TO_AUTHORISE_JOIN",
+	"M_UNABLE_TO_GRANT_JOIN",
+	"M_BAD_ALIAS",
+	"M_DUPLICATE_ANNOTATION",
+	"M_NOT_YET_UPLOADED",
+	"M_CANNOT_OVERWRITE_MEDIA",
+	"M_UNKNOWN_POS",
+	"M_URL_NOT_SET",
+	"M_BAD_STATUS",
+	"M_CONNECTION_FAILED",
+	"M_CONNECTION_TIMEOUT",
+	"M_WRONG_ROOM_KEYS_VERSION",
+	"M_INVALID_SIGNATURE",
+	"M_CONCURRENT_WRITE",
+	"m.space",
+	"m.space.child",
+	"m.space.parent",
+	// the stability of room versions in GET /capabilities
+	"stable",
+	"unstable",
+}
+
+// String prefixes which are replaced with tag 225+N wrapping the rest of the string, where N is the index
+// in this list. Append only.
+var cborv2Prefixes = []string{
+	"ed25519:",
+	"curve25519:",
+	"signed_curve25519:",
+}
+
+// withCBORKeys returns a new key map with the keys of base and the additions
+func withCBORKeys(base, additions map[string]int) map[string]int {
+	keys := make(map[string]int, len(base)+len(additions))
+	for k, v := range base {
+		keys[k] = v
+	}
+	for k, v := range additions {
+		keys[k] = v
+	}
+	return keys
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"fmt"
+	"strings"
+
+	cbor "github.com/fxamacker/cbor/v2"
+)
+
+// Frequent strings are replaced with CBOR tags, in the same way as draft-ietf-cbor-packed:
+//   - Tag 6 wraps an unsigned integer which is the index of the entire string in the values list.
+//   - Tags 225-255 wrap the remainder of a string which began with the prefix at index (tag - 225).
+//
+// This applies to map keys which aren't enum keys as well as to values, which matters for key IDs like
+// "ed25519:DEVICEID". Only exact matches are replaced, so arbitrary strings like base64 signatures are
+// never modified.
+const (
+	cborTagSharedValue = 6
+	cborTagPrefixStart = 225
+	cborTagPrefixEnd   = 255
+)
+
+// valueDict replaces frequent string values and string prefixes with CBOR tags
+type valueDict struct {
+	values     map[string]uint64
+	enumValues []string
+	prefixes   []string
+}
+
+func newValueDict(values, prefixes []string) (*valueDict, error) {
+	if len(prefixes) > cborTagPrefixEnd-cborTagPrefixStart+1 {
+		return nil, fmt.Errorf("cbor value dict: too many prefixes: %d", len(prefixes))
+	}
+	d := &valueDict{
+		values:     make(map[string]uint64),
+		enumValues: values,
+		prefixes:   prefixes,
+	}
+	for i, v := range values {
+		if _, ok := d.values[v]; ok {
+			return nil, fmt.Errorf("cbor value dict: duplicate value %s", v)
+		}
+		d.values[v] = uint64(i)
+	}
+	seen := make(map[string]bool)
+	for _, p := range prefixes {
+		if p == "" || seen[p] {
+			return nil, fmt.Errorf("cbor value dict: empty or duplicate prefix '%s'", p)
+		}
+		seen[p] = true
+	}
+	return d, nil
+}
+
+func (d *valueDict) packString(s string) interface{} {
+	if i, ok := d.values[s]; ok {
+		return cbor.Tag{Number: cborTagSharedValue, Content: i}
+	}
+	best := -1
+	for i, p := range d.prefixes {
+		if strings.HasPrefix(s, p) && (best == -1 || len(p) > len(d.prefixes[best])) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return s
+	}
+	return cbor.Tag{Number: uint64(cborTagPrefixStart + best), Content: s[len(d.prefixes[best]):]}
+}
+
+// pack replaces strings in the output of jsonInterfaceToCBORInterface with tags
+func (d *valueDict) pack(cborInt interface{}) interface{} {
+	switch v := cborInt.(type) {
+	case string:
+		return d.packString(v)
+	case []interface{}:
+		for i, element := range v {
+			v[i] = d.pack(element)
+		}
+		return v
+	case map[interface{}]interface{}:
+		result := make(map[interface{}]interface{}, len(v))
+		for k, val := range v {
+			if kstr, ok := k.(string); ok {
+				result[d.packString(kstr)] = d.pack(val)
+			} else {
+				result[k] = d.pack(val)
+			}
+		}
+		return result
+	default:
+		return cborInt
+	}
+}
+
+// unpackTag returns the string for the tag, or the tag itself if it is unknown
+func (d *valueDict) unpackTag(tag cbor.Tag) interface{} {
+	if tag.Number == cborTagSharedValue {
+		i, ok := num(tag.Content)
+		if !ok || i < 0 || i >= len(d.enumValues) {
+			return tag
+		}
+		return d.enumValues[i]
+	}
+	if tag.Number >= cborTagPrefixStart && tag.Number <= cborTagPrefixEnd {
+		i := int(tag.Number - cborTagPrefixStart)
+		suffix, ok := tag.Content.(string)
+		if !ok || i >= len(d.prefixes) {
+			return tag
+		}
+		return d.prefixes[i] + suffix
+	}
+	return tag
+}
+
+// unpack replaces tags from the CBOR decoder with strings, before calling cborInterfaceToJSONInterface
+func (d *valueDict) unpack(cborInt interface{}) interface{} {
+	switch v := cborInt.(type) {
+	case cbor.Tag:
+		return d.unpackTag(v)
+	case []interface{}:
+		for i, element := range v {
+			v[i] = d.unpack(element)
+		}
+		return v
+	case map[interface{}]interface{}:
+		result := make(map[interface{}]interface{}, len(v))
+		for k, val := range v {
+			if ktag, ok := k.(cbor.Tag); ok {
+				result[d.unpackTag(ktag)] = d.unpack(val)
+			} else {
+				result[k] = d.unpack(val)
+			}
+		}
+		return result
+	default:
+		return cborInt
+	}
+}
@@ -0,0 +1,592 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// A /keys/query response for a single user with a single device and cross-signing keys
+var keysQueryResponse = `{
+	"device_keys": {
+		"@alice:example.com": {
+			"JLAFKJWSCS": {
+				"algorithms": ["m.olm.v1.curve25519-aes-sha2", "m.megolm.v1.aes-sha2"],
+				"device_id": "JLAFKJWSCS",
+				"keys": {
+					"curve25519:JLAFKJWSCS": "3C5BFWi2Y8MaVvjM8M22DBmh24PmgR0nPvJOIArzgyI",
+					"ed25519:JLAFKJWSCS": "lEuiRJBit0IG6nUf5pUzWTUEsRVVe/HJkoKuEww9ULI"
+				},
+				"signatures": {
+					"@alice:example.com": {
+						"ed25519:JLAFKJWSCS": "dSO80A01XiigH3uBiDVx/EjzaoycHcjq9lfQX0uWsqxl2giMIiSPR8a4d291W1ihKJL/a+myXS367WT6NAIcBA",
+						"ed25519:85T7JXPFBAySB/jwby4S3lBPTqY3+Zg53nYuGmu1ggY": "L4XpVQYL7dCX6KcnYsSyVs49tsVF4BDrhOgY6kSaoIshLT1MQ8u5gGmSmsg11fbTkuSx/L0mP+dAqMDIbakhCg"
+					}
+				},
+				"unsigned": {
+					"device_display_name": "Alice's mobile phone"
+				},
+				"user_id": "@alice:example.com"
+			}
+		}
+	},
+	"failures": {},
+	"master_keys": {
+		"@alice:example.com": {
+			"keys": {
+				"ed25519:85T7JXPFBAySB/jwby4S3lBPTqY3+Zg53nYuGmu1ggY": "85T7JXPFBAySB/jwby4S3lBPTqY3+Zg53nYuGmu1ggY"
+			},
+			"usage": ["master"],
+			"user_id": "@alice:example.com"
+		}
+	},
+	"self_signing_keys": {
+		"@alice:example.com": {
+			"keys": {
+				"ed25519:EmkqvokUn8p+vQAGZitOk4PWjp7Ukp3txV2TbMPEiBQ": "EmkqvokUn8p+vQAGZitOk4PWjp7Ukp3txV2TbMPEiBQ"
+			},
+			"signatures": {
+				"@alice:example.com": {
+					"ed25519:85T7JXPFBAySB/jwby4S3lBPTqY3+Zg53nYuGmu1ggY": "afkrbGvPn5Zb5zc7Lk9cz2skI3QrzI/L0st1GS+/GATxNjMzc6vKmGu7r9cMb1GJxy4RdeUpfH3L7Fs/fNL1Dw"
+				}
+			},
+			"usage": ["self_signing"],
+			"user_id": "@alice:example.com"
+		}
+	}
+}`
+
+// TestCBORCodecV2EncryptionKeys checks that E2EE responses are smaller with the encryption keys, values and
+// prefixes in the dictionary, and that base64 keys and signatures survive the round trip unmodified.
+func TestCBORCodecV2EncryptionKeys(t *testing.T) {
+	want, err := gomatrixserverlib.CanonicalJSON([]byte(keysQueryResponse))
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %s", err)
+	}
+	// the dictionary before encryption keys were added
+	oldKeys := make(map[string]int)
+	for k, v := range cborv2Keys {
+		if v <= 104 {
+			oldKeys[k] = v
+		}
+	}
+	oldCodec, err := NewCBORCodec(oldKeys, true)
+	if err != nil {
+		t.Fatalf("NewCBORCodec: %s", err)
+	}
+	oldCBOR, err := oldCodec.JSONToCBOR(bytes.NewBufferString(keysQueryResponse))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+
+	codec := NewCBORCodecV2(true)
+	cborBytes, err := codec.JSONToCBOR(bytes.NewBufferString(keysQueryResponse))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	t.Logf("/keys/query response: JSON %d bytes, CBOR without encryption dictionary %d bytes, CBOR %d bytes",
+		len(want), len(oldCBOR), len(cborBytes))
+	if len(cborBytes) >= len(oldCBOR) {
+		t.Errorf("encryption dictionary did not reduce size: got %d bytes, was %d bytes", len(cborBytes), len(oldCBOR))
+	}
+
+	got, err := codec.CBORToJSON(bytes.NewReader(cborBytes))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("did not pass through CBOR successfully:\ngot  %s\nwant %s", string(got), string(want))
+	}
+}
+
+// A PUT /sendToDevice/m.room.encrypted/{txnId} request body sharing a room key with two devices of one user and
+// one device of another
+var sendToDeviceRequest = `{
+	"messages": {
+		"@alice:example.com": {
+			"JLAFKJWSCS": {
+				"algorithm": "m.olm.v1.curve25519-aes-sha2",
+				"sender_key": "3C5BFWi2Y8MaVvjM8M22DBmh24PmgR0nPvJOIArzgyI",
+				"ciphertext": {
+					"7qZcfnBmbEGzxxaWfBjElJuvn7BZx+lSz/SvFrDF/VM": {
+						"type": 0,
+						"body": "AwogGJJzMhf/S3GQFXAOrCZ3iKyGU5ZScVtjI0KypTYrW08SIJUVGQ2pYkRq9gpLTlsaaJLjlBSYsVhh2GtDZSNFjwkaGkMKIC4m0dqd6d9Yk7jlUXzphfaQdKm5Ow6/zwBUv+LR2pTnEiBqahk9rc5ZVb6HTZxG5S0MvtIICh0NjYQevNJoDODbOyJQAwogloUuqwvfPZZtSFeG6Frjpv7fNsAr+ERpcruJUpqtYHkSIK0o9JrxS+sFmlhutodT4ibrNxhRSiUhM+gbEZ7ZV1QKGiAGkNMOwpXNIcrUm33J8Z9+9yXe5l21d3hRy8MQAe81OSIQpSlHdeWlGhEGp9I8A4te3CoQK9ygGpkrGw"
+					}
+				},
+				"org.matrix.msgid": "a1b2c3d4e5f6"
+			},
+			"QBUAZIFURK": {
+				"algorithm": "m.olm.v1.curve25519-aes-sha2",
+				"sender_key": "3C5BFWi2Y8MaVvjM8M22DBmh24PmgR0nPvJOIArzgyI",
+				"ciphertext": {
+					"mnZjhWeSRmnPjFtJUgSbKheRrm7PDkVpqI0nTjp6kSk": {
+						"type": 1,
+						"body": "AwogP2jXdpsXVRpjm+YdHZGSnCD/f1X2oxqUnMa7bMAKUCwSIPrPGRvxRPjmxnpR9d0ivSTNUtyhdbUMyChLmxuwVfBXGiBvtg0TWjBPa96d1hWH/yTN1zNkUfk0xZUWN0D9/OolFiJQAwogJwRm5/1G06i/89j+oIEMXgIa+WuEzhk242nmIn5qZnMSIJK7eFnqj5AMRurMfGv4SuxHeBVt48BHdMmRLIayV4f/GiBPL8aebTjrxcvbU9WwAtRtKXFCpNkTZ5he56kyn/FC5yIQ3vB1vcqDnk50tROpHnOU6Q"
+					}
+				},
+				"org.matrix.msgid": "a1b2c3d4e5f6"
+			}
+		},
+		"@bob:example.org": {
+			"VGXSKHXCYR": {
+				"algorithm": "m.olm.v1.curve25519-aes-sha2",
+				"sender_key": "3C5BFWi2Y8MaVvjM8M22DBmh24PmgR0nPvJOIArzgyI",
+				"ciphertext": {
+					"BN8nZA9Ua5TfHACRdKtTLYsBLBcC+BxQUJq1V2POj2M": {
+						"type": 0,
+						"body": "AwogHk5BQ7QTFNWkEDV9Ms/j6hsa/IREp+P3XrMJd1EKgxwSIDNmBI+uzmK53Qd6QURs8Imdsn2hLlAS7RDaXcqTXg4hGiCb3fmRBnt5m9JLIYaBvH9n2OhcOovmQ4oWWSpfdQEvZiJQAwog2oWIrvB4Bql5bdOzm2j+aZ4p9/a9JKyC2b9VRpdKLC8SIFD5M7kOivs1A9/QNy7/M7MtnyvnbBn+DAqw7x0KyWy4GiD9nSpLv9KXp3SgB+bDUpdV/8YY7gOrA4kgvbAkZRWzXyIQqbQ/OrtFsKOoSiq3H8w5Aw"
+					}
+				},
+				"org.matrix.msgid": "f6e5d4c3b2a1"
+			}
+		}
+	}
+}`
+
+// The to_device section of a /sync response with a room key request and the start of a verification
+var syncToDevice = `{
+	"next_batch": "s72595_4483_1934",
+	"to_device": {
+		"events": [
+			{
+				"type": "m.room_key_request",
+				"sender": "@alice:example.com",
+				"content": {
+					"action": "request",
+					"requesting_device_id": "JLAFKJWSCS",
+					"request_id": "1495474790150.19",
+					"body": {
+						"algorithm": "m.megolm.v1.aes-sha2",
+						"room_id": "!Cuyf34gef24t:localhost",
+						"sender_key": "RF3s+E7RkTQTGF2d8Deol0FkQvgII2aJDf3/Jp5mxVU",
+						"session_id": "X3lUlvLELLYxeTx4yOVu6UDpasGEVO0Jbu+QFnm0cKQ"
+					}
+				}
+			},
+			{
+				"type": "m.key.verification.request",
+				"sender": "@alice:example.com",
+				"content": {
+					"from_device": "JLAFKJWSCS",
+					"methods": ["m.sas.v1"],
+					"transaction_id": "S0meUniqueAndOpaqueString",
+					"timestamp": 1559598944869
+				}
+			}
+		]
+	}
+}`
+
+// TestCBORCodecV2ToDevice checks that to-device messages are smaller with the to-device keys and values in the
+// dictionary, and that they survive the round trip unmodified.
+func TestCBORCodecV2ToDevice(t *testing.T) {
+	// the dictionary before to-device messages were added
+	oldKeys := make(map[string]int)
+	for k, v := range cborv2Keys {
+		if v <= 117 {
+			oldKeys[k] = v
+		}
+	}
+	oldCodec, err := NewCBORCodecWithValues(oldKeys, cborv2Values[:13], cborv2Prefixes, true)
+	if err != nil {
+		t.Fatalf("NewCBORCodecWithValues: %s", err)
+	}
+	codec := NewCBORCodecV2(true)
+	testCases := []struct {
+		name  string
+		input string
+	}{
+		{name: "PUT /sendToDevice request", input: sendToDeviceRequest},
+		{name: "/sync to_device", input: syncToDevice},
+	}
+	for _, tc := range testCases {
+		want, err := gomatrixserverlib.CanonicalJSON([]byte(tc.input))
+		if err != nil {
+			t.Fatalf("%s: CanonicalJSON: %s", tc.name, err)
+		}
+		oldCBOR, err := oldCodec.JSONToCBOR(bytes.NewBufferString(tc.input))
+		if err != nil {
+			t.Fatalf("%s: JSONToCBOR: %s", tc.name, err)
+		}
+		cborBytes, err := codec.JSONToCBOR(bytes.NewBufferString(tc.input))
+		if err != nil {
+			t.Fatalf("%s: JSONToCBOR: %s", tc.name, err)
+		}
+		t.Logf("%s: JSON %d bytes, CBOR without to-device dictionary %d bytes, CBOR %d bytes",
+			tc.name, len(want), len(oldCBOR), len(cborBytes))
+		if len(cborBytes) >= len(oldCBOR) {
+			t.Errorf("%s: to-device dictionary did not reduce size: got %d bytes, was %d bytes",
+				tc.name, len(cborBytes), len(oldCBOR))
+		}
+		got, err := codec.CBORToJSON(bytes.NewReader(cborBytes))
+		if err != nil {
+			t.Fatalf("%s: CBORToJSON: %s", tc.name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: did not pass through CBOR successfully:\ngot  %s\nwant %s", tc.name, string(got), string(want))
+		}
+	}
+}
+
+// A filter like the ones clients upload on first sync, which lazy loads members and limits the timeline
+var syncFilter = `{
+	"event_fields": ["type", "content", "sender", "origin_server_ts", "event_id", "state_key"],
+	"event_format": "client",
+	"presence": {"not_types": ["*"]},
+	"account_data": {"types": ["m.push_rules", "m.direct", "im.vector.setting.breadcrumbs"]},
+	"room": {
+		"include_leave": false,
+		"state": {"lazy_load_members": true, "include_redundant_members": false, "not_senders": ["@spam:example.com"]},
+		"timeline": {"limit": 10, "lazy_load_members": true, "contains_url": false, "types": ["m.room.message", "m.room.encrypted"]},
+		"ephemeral": {"not_types": ["m.receipt"], "not_rooms": ["!busy:example.com"]},
+		"account_data": {"limit": 50, "senders": ["@alice:example.com"]}
+	}
+}`
+
+// TestCBORCodecV2Filter checks that filters are smaller with the filter keys and values in the dictionary
+func TestCBORCodecV2Filter(t *testing.T) {
+	want, err := gomatrixserverlib.CanonicalJSON([]byte(syncFilter))
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %s", err)
+	}
+	// the dictionary before filters were added
+	oldKeys := make(map[string]int)
+	for k, v := range cborv2Keys {
+		if v <= 126 {
+			oldKeys[k] = v
+		}
+	}
+	oldCodec, err := NewCBORCodecWithValues(oldKeys, cborv2Values[:27], cborv2Prefixes, true)
+	if err != nil {
+		t.Fatalf("NewCBORCodecWithValues: %s", err)
+	}
+	oldCBOR, err := oldCodec.JSONToCBOR(bytes.NewBufferString(syncFilter))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+
+	codec := NewCBORCodecV2(true)
+	cborBytes, err := codec.JSONToCBOR(bytes.NewBufferString(syncFilter))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	t.Logf("filter: JSON %d bytes, CBOR without filter dictionary %d bytes, CBOR %d bytes",
+		len(want), len(oldCBOR), len(cborBytes))
+	if len(cborBytes) >= len(oldCBOR) {
+		t.Errorf("filter dictionary did not reduce size: got %d bytes, was %d bytes", len(cborBytes), len(oldCBOR))
+	}
+
+	got, err := codec.CBORToJSON(bytes.NewReader(cborBytes))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("did not pass through CBOR successfully:\ngot  %s\nwant %s", string(got), string(want))
+	}
+}
+
+// A message sent over an MSC4108 rendezvous session when logging in with a QR code
+var rendezvousProtocols = `{
+	"type": "m.login.protocols",
+	"protocols": ["device_authorization_grant"],
+	"homeserver": "https://matrix-client.example.com"
+}`
+
+// TestCBORCodecV2Rendezvous checks that rendezvous messages are smaller with the rendezvous keys and values in
+// the dictionary
+func TestCBORCodecV2Rendezvous(t *testing.T) {
+	want, err := gomatrixserverlib.CanonicalJSON([]byte(rendezvousProtocols))
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %s", err)
+	}
+	// the dictionary before rendezvous sessions were added
+	oldKeys := make(map[string]int)
+	for k, v := range cborv2Keys {
+		if v <= 140 {
+			oldKeys[k] = v
+		}
+	}
+	oldCodec, err := NewCBORCodecWithValues(oldKeys, cborv2Values[:29], cborv2Prefixes, true)
+	if err != nil {
+		t.Fatalf("NewCBORCodecWithValues: %s", err)
+	}
+	oldCBOR, err := oldCodec.JSONToCBOR(bytes.NewBufferString(rendezvousProtocols))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+
+	codec := NewCBORCodecV2(true)
+	cborBytes, err := codec.JSONToCBOR(bytes.NewBufferString(rendezvousProtocols))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	t.Logf("rendezvous: JSON %d bytes, CBOR without rendezvous dictionary %d bytes, CBOR %d bytes",
+		len(want), len(oldCBOR), len(cborBytes))
+	if len(cborBytes) >= len(oldCBOR) {
+		t.Errorf("rendezvous dictionary did not reduce size: got %d bytes, was %d bytes", len(cborBytes), len(oldCBOR))
+	}
+
+	got, err := codec.CBORToJSON(bytes.NewReader(cborBytes))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("did not pass through CBOR successfully:\ngot  %s\nwant %s", string(got), string(want))
+	}
+}
+
+// TestCBORValueDictOnlyExactMatches checks that strings are only replaced if they exactly match a value or begin
+// with a prefix.
+func TestCBORValueDictOnlyExactMatches(t *testing.T) {
+	d, err := newValueDict([]string{"curve25519"}, []string{"ed25519:"})
+	if err != nil {
+		t.Fatalf("newValueDict: %s", err)
+	}
+	for _, s := range []string{"curve25519x", "xcurve25519", "ed25519", "xed25519:A", "bGVtb24gZWQyNTUxOTo="} {
+		if got := d.packString(s); got != s {
+			t.Errorf("packString(%s) modified the string: %+v", s, got)
+		}
+	}
+	for _, s := range []string{"curve25519", "ed25519:", "ed25519:JLAFKJWSCS"} {
+		if got := d.packString(s); got == s {
+			t.Errorf("packString(%s) did not replace the string", s)
+		} else if back := d.unpack(got); back != s {
+			t.Errorf("unpack(packString(%s)) got %v", s, back)
+		}
+	}
+}
+
+var spaceHierarchy = `{
+	"rooms": [
+		{
+			"room_id": "!space:example.com",
+			"room_type": "m.space",
+			"name": "The official Matrix space",
+			"canonical_alias": "#space:example.com",
+			"num_joined_members": 42,
+			"world_readable": true,
+			"guest_can_join": false,
+			"join_rule": "public",
+			"children_state": [
+				{
+					"type": "m.space.child",
+					"state_key": "!room:example.com",
+					"sender": "@alice:example.com",
+					"origin_server_ts": 1629413349153,
+					"content": {"via": ["example.com"], "suggested": true, "order": "a"}
+				}
+			]
+		},
+		{
+			"room_id": "!room:example.com",
+			"name": "General",
+			"num_joined_members": 40,
+			"world_readable": false,
+			"guest_can_join": false,
+			"join_rule": "restricted",
+			"allowed_room_ids": ["!space:example.com"],
+			"children_state": []
+		}
+	],
+	"next_batch": "next_batch_token"
+}`
+
+// TestCBORCodecV2Hierarchy checks that space hierarchies are smaller with the space keys and values in the dictionary
+func TestCBORCodecV2Hierarchy(t *testing.T) {
+	want, err := gomatrixserverlib.CanonicalJSON([]byte(spaceHierarchy))
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %s", err)
+	}
+	// the dictionary before spaces were added
+	oldKeys := make(map[string]int)
+	for k, v := range cborv2Keys {
+		if v <= 149 {
+			oldKeys[k] = v
+		}
+	}
+	var oldValues []string
+	for _, v := range cborv2Values {
+		if v == "m.space" {
+			break
+		}
+		oldValues = append(oldValues, v)
+	}
+	oldCodec, err := NewCBORCodecWithValues(oldKeys, oldValues, cborv2Prefixes, true)
+	if err != nil {
+		t.Fatalf("NewCBORCodecWithValues: %s", err)
+	}
+	oldCBOR, err := oldCodec.JSONToCBOR(bytes.NewBufferString(spaceHierarchy))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+
+	codec := NewCBORCodecV2(true)
+	cborBytes, err := codec.JSONToCBOR(bytes.NewBufferString(spaceHierarchy))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	t.Logf("hierarchy: JSON %d bytes, CBOR without spaces dictionary %d bytes, CBOR %d bytes",
+		len(want), len(oldCBOR), len(cborBytes))
+	if len(cborBytes) >= len(oldCBOR) {
+		t.Errorf("spaces dictionary did not reduce size: got %d bytes, was %d bytes", len(cborBytes), len(oldCBOR))
+	}
+
+	got, err := codec.CBORToJSON(bytes.NewReader(cborBytes))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("did not pass through CBOR successfully:\ngot  %s\nwant %s", string(got), string(want))
+	}
+}
+
+// A page of GET /rooms/{roomId}/messages scrolling back through history
+var messagesPage = `{
+	"chunk": [
+		{
+			"content": {"body": "see you tomorrow", "msgtype": "m.text"},
+			"event_id": "$143273582443PhrSn:example.org",
+			"origin_server_ts": 1432735824653,
+			"room_id": "!636q39766251:example.com",
+			"sender": "@example:example.org",
+			"type": "m.room.message",
+			"unsigned": {"age": 1234}
+		},
+		{
+			"content": {"body": "how was your day?", "msgtype": "m.text"},
+			"event_id": "$143273582443PhrSo:example.org",
+			"origin_server_ts": 1432735824650,
+			"room_id": "!636q39766251:example.com",
+			"sender": "@alice:example.org",
+			"type": "m.room.message",
+			"unsigned": {"age": 1237}
+		}
+	],
+	"end": "t47409-4357353_219380_26003_2265",
+	"start": "t47429-4392820_219380_26003_2265",
+	"state": [
+		{
+			"content": {"displayname": "Example", "membership": "join"},
+			"event_id": "$143273582443PhrSm:example.org",
+			"origin_server_ts": 1432735824600,
+			"room_id": "!636q39766251:example.com",
+			"sender": "@example:example.org",
+			"state_key": "@example:example.org",
+			"type": "m.room.member"
+		}
+	]
+}`
+
+// TestCBORCodecV2Messages checks that pages of history are smaller with the pagination keys in the dictionary
+func TestCBORCodecV2Messages(t *testing.T) {
+	want, err := gomatrixserverlib.CanonicalJSON([]byte(messagesPage))
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %s", err)
+	}
+	// the dictionary before pagination keys were added
+	oldKeys := make(map[string]int)
+	for k, v := range cborv2Keys {
+		if v <= 159 {
+			oldKeys[k] = v
+		}
+	}
+	oldCodec, err := NewCBORCodecWithValues(oldKeys, cborv2Values, cborv2Prefixes, true)
+	if err != nil {
+		t.Fatalf("NewCBORCodecWithValues: %s", err)
+	}
+	oldCBOR, err := oldCodec.JSONToCBOR(bytes.NewBufferString(messagesPage))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+
+	codec := NewCBORCodecV2(true)
+	cborBytes, err := codec.JSONToCBOR(bytes.NewBufferString(messagesPage))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	t.Logf("messages: JSON %d bytes, CBOR without pagination dictionary %d bytes, CBOR %d bytes",
+		len(want), len(oldCBOR), len(cborBytes))
+	if len(cborBytes) >= len(oldCBOR) {
+		t.Errorf("pagination dictionary did not reduce size: got %d bytes, was %d bytes", len(cborBytes), len(oldCBOR))
+	}
+
+	got, err := codec.CBORToJSON(bytes.NewReader(cborBytes))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("did not pass through CBOR successfully:\ngot  %s\nwant %s", string(got), string(want))
+	}
+}
+
+// from https://spec.matrix.org/v1.9/client-server-api/#get_matrixclientv3capabilities
+const capabilitiesResponse = `{
+	"capabilities": {
+		"m.3pid_changes": {"enabled": false},
+		"m.change_password": {"enabled": true},
+		"m.get_login_token": {"enabled": true},
+		"m.room_versions": {
+			"available": {"1": "stable", "2": "stable", "3": "unstable", "test-version": "unstable"},
+			"default": "1"
+		},
+		"m.set_avatar_url": {"enabled": true},
+		"m.set_displayname": {"enabled": true}
+	}
+}`
+
+// TestCBORCodecV2Capabilities checks that GET /capabilities is smaller with its keys and values in the dictionary
+func TestCBORCodecV2Capabilities(t *testing.T) {
+	want, err := gomatrixserverlib.CanonicalJSON([]byte(capabilitiesResponse))
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %s", err)
+	}
+	// the dictionary before capabilities keys were added
+	oldKeys := make(map[string]int)
+	for k, v := range cborv2Keys {
+		if v <= 161 {
+			oldKeys[k] = v
+		}
+	}
+	oldCodec, err := NewCBORCodecWithValues(oldKeys, cborv2Values[:len(cborv2Values)-2], cborv2Prefixes, true)
+	if err != nil {
+		t.Fatalf("NewCBORCodecWithValues: %s", err)
+	}
+	oldCBOR, err := oldCodec.JSONToCBOR(bytes.NewBufferString(capabilitiesResponse))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+
+	codec := NewCBORCodecV2(true)
+	cborBytes, err := codec.JSONToCBOR(bytes.NewBufferString(capabilitiesResponse))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	t.Logf("capabilities: JSON %d bytes, CBOR without capabilities dictionary %d bytes, CBOR %d bytes",
+		len(want), len(oldCBOR), len(cborBytes))
+	if len(cborBytes) >= len(oldCBOR) {
+		t.Errorf("capabilities dictionary did not reduce size: got %d bytes, was %d bytes", len(cborBytes), len(oldCBOR))
+	}
+
+	got, err := codec.CBORToJSON(bytes.NewReader(cborBytes))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("did not pass through CBOR successfully:\ngot  %s\nwant %s", string(got), string(want))
+	}
+}
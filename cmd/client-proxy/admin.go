@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/lb/mobile"
+)
+
+const debugStatePath = "/_lb/debug/state"
+
+// debugState returns the connection and observation state as JSON
+var debugState = mobile.DebugState
+
+// adminHandler serves the admin endpoints, which are only served on --admin-addr so they are never reachable by
+// whoever can reach the client port. Every request must have the admin token as a bearer token.
+func adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(debugStatePath, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte(`{"errcode":"M_UNRECOGNIZED","error":"method not allowed"}`))
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(debugState()))
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got := req.Header.Get("Authorization")
+		if !strings.HasPrefix(got, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(got, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"missing or incorrect admin token"}`))
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminDebugState(t *testing.T) {
+	oldDebugState := debugState
+	debugState = func() string {
+		return `{"connections":[],"observations":[],"pool":{"connections":0}}`
+	}
+	t.Cleanup(func() {
+		debugState = oldDebugState
+	})
+	h := adminHandler("admin_secret")
+
+	testCases := []struct {
+		name     string
+		method   string
+		path     string
+		auth     string
+		wantCode int
+	}{
+		{name: "no token", method: "GET", path: debugStatePath, wantCode: 401},
+		{name: "wrong token", method: "GET", path: debugStatePath, auth: "Bearer nope", wantCode: 401},
+		{name: "token without Bearer", method: "GET", path: debugStatePath, auth: "admin_secret", wantCode: 401},
+		{name: "token", method: "GET", path: debugStatePath, auth: "Bearer admin_secret", wantCode: 200},
+		{name: "POST", method: "POST", path: debugStatePath, auth: "Bearer admin_secret", wantCode: 405},
+		{name: "unknown path", method: "GET", path: "/_matrix/client/versions", auth: "Bearer admin_secret", wantCode: 404},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tc.wantCode {
+				t.Fatalf("got HTTP %d want %d: %s", w.Code, tc.wantCode, w.Body.String())
+			}
+			if w.Code != 200 {
+				return
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("invalid JSON %s: %s", w.Body.String(), err)
+			}
+			for _, key := range []string{"connections", "observations", "pool"} {
+				if _, ok := got[key]; !ok {
+					t.Errorf("response is missing %s: %s", key, w.Body.String())
+				}
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("got Content-Type %s want application/json", ct)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+const blurhashDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// decode83 decodes a base 83 number as used by blurhash
+func decode83(s string) (int, error) {
+	v := 0
+	for _, c := range s {
+		digit := strings.IndexRune(blurhashDigits, c)
+		if digit < 0 {
+			return 0, fmt.Errorf("%q is not a base 83 digit", c)
+		}
+		v = v*83 + digit
+	}
+	return v, nil
+}
+
+// validBlurhash returns an error if hash is not a well formed blurhash
+func validBlurhash(hash string) error {
+	if len(hash) < 6 {
+		return fmt.Errorf("blurhash is %d characters, want at least 6", len(hash))
+	}
+	sizeFlag, err := decode83(hash[:1])
+	if err != nil {
+		return err
+	}
+	numX, numY := sizeFlag%9+1, sizeFlag/9+1
+	if want := 4 + 2*numX*numY; len(hash) != want {
+		return fmt.Errorf("blurhash is %d characters, want %d for %dx%d components", len(hash), want, numX, numY)
+	}
+	_, err = decode83(hash)
+	return err
+}
+
+// decodeBlurhash renders a blurhash (https://blurha.sh) as a width x height image. It is meant for tiny
+// previews: the cost is width * height * components, so images should be a few dozen pixels across.
+func decodeBlurhash(hash string, width, height int) (image.Image, error) {
+	if err := validBlurhash(hash); err != nil {
+		return nil, err
+	}
+	// the digits were checked above
+	sizeFlag, _ := decode83(hash[:1])
+	numX, numY := sizeFlag%9+1, sizeFlag/9+1
+	quantisedMax, _ := decode83(hash[1:2])
+	maxValue := float64(quantisedMax+1) / 166
+
+	colors := make([][3]float64, numX*numY)
+	dc, _ := decode83(hash[2:6])
+	colors[0] = [3]float64{srgbToLinear(dc >> 16), srgbToLinear((dc >> 8) & 255), srgbToLinear(dc & 255)}
+	for i := 1; i < len(colors); i++ {
+		ac, _ := decode83(hash[4+i*2 : 6+i*2])
+		colors[i] = [3]float64{
+			signPow(float64(ac/(19*19)-9)/9, 2) * maxValue,
+			signPow(float64((ac/19)%19-9)/9, 2) * maxValue,
+			signPow(float64(ac%19-9)/9, 2) * maxValue,
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b float64
+			for j := 0; j < numY; j++ {
+				for i := 0; i < numX; i++ {
+					basis := math.Cos(math.Pi*float64(x*i)/float64(width)) * math.Cos(math.Pi*float64(y*j)/float64(height))
+					c := colors[i+j*numX]
+					r += c[0] * basis
+					g += c[1] * basis
+					b += c[2] * basis
+				}
+			}
+			img.SetNRGBA(x, y, color.NRGBA{R: linearToSRGB(r), G: linearToSRGB(g), B: linearToSRGB(b), A: 255})
+		}
+	}
+	return img, nil
+}
+
+func srgbToLinear(v int) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) uint8 {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return uint8(v*12.92*255 + 0.5)
+	}
+	return uint8((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
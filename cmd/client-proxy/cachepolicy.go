@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/lb"
+)
+
+// cachePolicy is how the responses to requests for paths matching Path are cached, from the cache_policies table in
+// the config file, e.g:
+//
+//	cache_policies:
+//	  - path: /_matrix/client/v1/media/download/*
+//	    immutable: true
+//	  - path: /_matrix/client/{version}/profile/{userId}
+//	    ttl: 30s
+//	    vary_by: [Authorization]
+//
+// Media paths are cached by the media cache, and other paths by the response cache. The first policy which matches
+// a path applies.
+type cachePolicy struct {
+	// The path the policy applies to. A {placeholder} segment matches any one segment, and a last segment of *
+	// matches any number of segments.
+	Path string `yaml:"path"`
+	// The longest responses are cached for. Responses with a shorter max-age are cached for that long, and ones with
+	// max-age=0 are not cached. 0 means responses are not cached, unless Immutable is set.
+	TTL time.Duration `yaml:"ttl"`
+	// The methods whose responses are cached. Requests with other methods are passed through. Requests which may
+	// have a body, e.g POST, are cached by their body as well. Defaults to GET.
+	Methods []string `yaml:"methods"`
+	// Request headers whose values are part of the cache key, so requests which differ in them are cached
+	// separately, e.g Authorization for responses which depend on the user
+	VaryBy []string `yaml:"vary_by"`
+	// If set, responses never change once they exist, e.g media, so they are cached without expiry whatever their
+	// Cache-Control says, and TTL is ignored.
+	Immutable bool `yaml:"immutable"`
+
+	pathRegexp *regexp.Regexp
+}
+
+// cachePolicies is a table of cache policies, in the order they are matched
+type cachePolicies []*cachePolicy
+
+// compileCachePolicies checks the policies in a table and compiles their paths
+func compileCachePolicies(policies cachePolicies) error {
+	for i, p := range policies {
+		if !strings.HasPrefix(p.Path, "/") {
+			return fmt.Errorf("cache policy %d: path '%s' must start with /", i, p.Path)
+		}
+		segments := strings.Split(p.Path, "/")
+		for j, seg := range segments {
+			switch {
+			case seg == "*" && j == len(segments)-1:
+				segments[j] = ".*"
+			case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}"):
+				segments[j] = "[^/]+"
+			case strings.ContainsAny(seg, "*{}"):
+				return fmt.Errorf("cache policy %d: path '%s' has an invalid segment '%s'", i, p.Path, seg)
+			default:
+				segments[j] = regexp.QuoteMeta(seg)
+			}
+		}
+		p.pathRegexp = regexp.MustCompile("^" + strings.Join(segments, "/") + "$")
+		if p.TTL < 0 {
+			return fmt.Errorf("cache policy %d: ttl must not be negative, got %v", i, p.TTL)
+		}
+		if len(p.Methods) == 0 {
+			p.Methods = []string{"GET"}
+		}
+		for j, method := range p.Methods {
+			p.Methods[j] = strings.ToUpper(method)
+		}
+	}
+	return nil
+}
+
+// match returns the first policy for path, or nil if there is none
+func (ps cachePolicies) match(path string) *cachePolicy {
+	for _, p := range ps {
+		if p.pathRegexp.MatchString(path) {
+			return p
+		}
+	}
+	return nil
+}
+
+// cacheable returns true if responses to requests with the method are cached
+func (p *cachePolicy) cacheable(method string) bool {
+	for _, m := range p.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the cache key of req, which is base with the values of the VaryBy headers, and the hash of the body
+// for methods which may have one. The body of req is replaced so it can still be read.
+func (p *cachePolicy) key(req *http.Request, base string) string {
+	var key strings.Builder
+	key.WriteString(base)
+	for _, h := range p.VaryBy {
+		key.WriteString("\n" + strings.ToLower(h) + ":" + req.Header.Get(h))
+	}
+	if req.Method != "GET" && req.Method != "HEAD" && req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		key.WriteString("\nbody:" + hex.EncodeToString(sum[:]))
+	}
+	return key.String()
+}
+
+// ttl returns how long a response with the headers h is cached for, or false if it must not be cached
+func (p *cachePolicy) ttl(h http.Header) (time.Duration, bool) {
+	if p.Immutable {
+		return 0, true
+	}
+	if p.TTL == 0 {
+		return 0, false
+	}
+	return cacheTTL(h, p.TTL)
+}
+
+// Headers which are stored alongside cached responses
+var responseCacheHeaders = []string{"Content-Type", "Cache-Control", "ETag"}
+
+// responseCache is an http.Handler which caches successful responses from next to requests matching the policies,
+// other than for media, which mediaCache caches. Requests which match no policy are passed through. Like mediaCache,
+// responses are not separated by access token unless the policy varies by Authorization.
+type responseCache struct {
+	cache    lb.Cache
+	next     http.Handler
+	policies cachePolicies
+	// responses larger than this are never cached
+	maxSize int64
+}
+
+func (c *responseCache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	policy := c.policies.match(req.URL.Path)
+	if policy == nil || !policy.cacheable(req.Method) || mediaUrlRegexp.MatchString(req.URL.Path) {
+		c.next.ServeHTTP(w, req)
+		return
+	}
+	key := policy.key(req, req.Method+" "+mediaCacheKey(req.URL))
+	if data, ok := c.cache.Get(key); ok {
+		if serveCachedResponse(w, req, data) {
+			return
+		}
+		// corrupt entry, refetch it
+		c.cache.Delete(key)
+	}
+	bw := &bufferingWriter{
+		ResponseWriter: w,
+		maxSize:        c.maxSize,
+	}
+	c.next.ServeHTTP(bw, req)
+	if bw.statusCode != http.StatusOK || bw.overflowed {
+		return
+	}
+	ttl, ok := policy.ttl(w.Header())
+	if !ok {
+		return
+	}
+	data, err := encodeCachedResponse(w.Header(), responseCacheHeaders, &bw.buf)
+	if err != nil {
+		return
+	}
+	c.cache.Set(key, data, ttl)
+}
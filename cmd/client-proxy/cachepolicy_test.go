@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadCachePolicies loads the cache policies of a config file
+func loadCachePolicies(t *testing.T, contents string) cachePolicies {
+	t.Helper()
+	fc, err := loadConfigFile(writeConfigFile(t, contents), flag.NewFlagSet("test", flag.ContinueOnError))
+	if err != nil {
+		t.Fatalf("loadConfigFile: %s", err)
+	}
+	return fc.CachePolicies
+}
+
+func TestCachePolicyMatch(t *testing.T) {
+	policies := loadCachePolicies(t, `
+cache_policies:
+  - path: /_matrix/client/v1/media/download/*
+    immutable: true
+  - path: /_matrix/client/{version}/profile/{userId}
+    ttl: 30s
+    methods: [get]
+`)
+	testCases := []struct {
+		path string
+		want *cachePolicy
+	}{
+		{path: "/_matrix/client/v1/media/download/example.com/abc", want: policies[0]},
+		{path: "/_matrix/client/v3/profile/@alice:example.com", want: policies[1]},
+		{path: "/_matrix/client/v3/profile/@alice:example.com/displayname", want: nil},
+		{path: "/_matrix/client/v1/media/thumbnail/example.com/abc", want: nil},
+	}
+	for _, tc := range testCases {
+		if got := policies.match(tc.path); got != tc.want {
+			t.Errorf("%s: got policy %+v want %+v", tc.path, got, tc.want)
+		}
+	}
+	if !policies[1].cacheable("GET") || policies[1].cacheable("PUT") {
+		t.Errorf("profile policy: got methods %v want only GET", policies[1].Methods)
+	}
+	if !policies[0].cacheable("GET") {
+		t.Errorf("media policy: got methods %v want GET by default", policies[0].Methods)
+	}
+
+	for name, contents := range map[string]string{
+		"relative path":    "cache_policies:\n  - path: profile\n",
+		"wildcard segment": "cache_policies:\n  - path: /_matrix/*/profile\n",
+		"negative ttl":     "cache_policies:\n  - path: /a\n    ttl: -1s\n",
+		"unknown key":      "cache_policies:\n  - path: /a\n    max_age: 1s\n",
+	} {
+		if _, err := loadConfigFile(writeConfigFile(t, contents), flag.NewFlagSet("test", flag.ContinueOnError)); err == nil {
+			t.Errorf("%s: expected an error, got none", name)
+		}
+	}
+}
+
+// TestMediaCacheImmutablePolicy checks that media with an immutable policy is cached without expiry, even though the
+// response has a max-age
+func TestMediaCacheImmutablePolicy(t *testing.T) {
+	hits := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(200)
+		w.Write([]byte("PNGDATA"))
+	})
+	cache := newMockCache()
+	mc := &mediaCache{
+		cache: cache,
+		next:  next,
+		ttl:   time.Hour,
+		policies: loadCachePolicies(t, `
+cache_policies:
+  - path: /_matrix/client/v1/media/download/*
+    immutable: true
+`),
+		maxSize: 1024,
+	}
+	for _, path := range []string{"/_matrix/client/v1/media/download/example.com/abc", "/_matrix/client/v1/media/thumbnail/example.com/abc"} {
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			mc.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			if w.Code != 200 || w.Body.String() != "PNGDATA" {
+				t.Fatalf("%s request %d: got %d %s", path, i, w.Code, w.Body.String())
+			}
+		}
+	}
+	if hits != 2 {
+		t.Errorf("media was fetched %d times, want once per path", hits)
+	}
+	if ttl, ok := cache.ttls["/_matrix/client/v1/media/download/example.com/abc"]; !ok || ttl != 0 {
+		t.Errorf("immutable media: got ttl %v want no expiry", ttl)
+	}
+	// media without a policy still uses the media cache's ttl, limited by max-age
+	if ttl := cache.ttls["/_matrix/client/v1/media/thumbnail/example.com/abc"]; ttl != time.Minute {
+		t.Errorf("media without a policy: got ttl %v want the 1m max-age", ttl)
+	}
+}
+
+// TestResponseCacheProfilePolicy checks that profiles are cached for the short ttl of their policy, separately for
+// each access token as the policy varies by Authorization, and that other requests are passed through
+func TestResponseCacheProfilePolicy(t *testing.T) {
+	var fetched []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fetched = append(fetched, req.Method+" "+req.URL.Path+" "+req.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"displayname":"Alice"}`))
+	})
+	cache := newMockCache()
+	rc := &responseCache{
+		cache: cache,
+		next:  next,
+		policies: loadCachePolicies(t, `
+cache_policies:
+  - path: /_matrix/client/{version}/profile/{userId}
+    ttl: 30s
+    vary_by: [Authorization]
+`),
+		maxSize: 1024,
+	}
+	do := func(method, path, token string) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		rc.ServeHTTP(w, req)
+		if body, _ := ioutil.ReadAll(w.Result().Body); w.Code != 200 || string(body) != `{"displayname":"Alice"}` {
+			t.Fatalf("%s %s: got %d %s", method, path, w.Code, string(body))
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: got Content-Type %s", method, path, ct)
+		}
+	}
+	profile := "/_matrix/client/v3/profile/@alice:example.com"
+	do("GET", profile, "alice")
+	do("GET", profile, "alice")
+	do("GET", profile, "bob")
+	do("PUT", profile+"/displayname", "alice")
+	do("PUT", profile+"/displayname", "alice")
+	do("POST", profile, "alice")
+	want := []string{
+		"GET " + profile + " Bearer alice",
+		"GET " + profile + " Bearer bob",
+		"PUT " + profile + "/displayname Bearer alice",
+		"PUT " + profile + "/displayname Bearer alice",
+		"POST " + profile + " Bearer alice",
+	}
+	if strings.Join(fetched, "\n") != strings.Join(want, "\n") {
+		t.Errorf("fetched:\n%s\nwant:\n%s", strings.Join(fetched, "\n"), strings.Join(want, "\n"))
+	}
+	if len(cache.data) != 2 {
+		t.Errorf("cache has %d entries, want one per access token", len(cache.data))
+	}
+	for key, ttl := range cache.ttls {
+		if ttl != 30*time.Second {
+			t.Errorf("%q: got ttl %v want 30s", key, ttl)
+		}
+	}
+}
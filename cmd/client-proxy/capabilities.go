@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/lb"
+)
+
+// capabilitiesPathRegexp matches GET /capabilities
+var capabilitiesPathRegexp = regexp.MustCompile(`^/_matrix/client/(r0|v3)/capabilities$`)
+
+const versionsPath = "/_matrix/client/versions"
+
+// The max number of bytes of capabilities to cache. Responses are a few hundred bytes, and there is one per access
+// token and endpoint version.
+const capabilitiesCacheBytes = 64 * 1024
+
+// capabilitiesCache is an http.Handler which caches GET /capabilities for ttl, as clients fetch it every time they
+// start or reconnect but it only changes when the homeserver is upgraded or reconfigured. Capabilities can depend on
+// the user, so they are only served to the access token which fetched them. When a /versions response differs from
+// the previous one the homeserver has probably changed, so everything cached is dropped.
+type capabilitiesCache struct {
+	cache lb.Cache
+	next  http.Handler
+	ttl   time.Duration
+	mu    sync.Mutex
+	// the latest /versions response
+	versions []byte
+	// part of every cache key, so incrementing it drops everything cached before
+	generation int
+}
+
+func (c *capabilitiesCache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == "GET" && capabilitiesPathRegexp.MatchString(req.URL.Path):
+		c.capabilities(w, req)
+	case req.Method == "GET" && req.URL.Path == versionsPath:
+		c.checkVersions(w, req)
+	default:
+		c.next.ServeHTTP(w, req)
+	}
+}
+
+func (c *capabilitiesCache) key(req *http.Request) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return strconv.Itoa(c.generation) + " " + token + " " + req.URL.Path
+}
+
+func (c *capabilitiesCache) capabilities(w http.ResponseWriter, req *http.Request) {
+	key := c.key(req)
+	if capabilities, ok := c.cache.Get(key); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(capabilities)
+		return
+	}
+	bw := &bufferingWriter{
+		ResponseWriter: w,
+		maxSize:        capabilitiesCacheBytes,
+	}
+	c.next.ServeHTTP(bw, req)
+	if bw.statusCode != http.StatusOK || bw.overflowed || !json.Valid(bw.buf.Bytes()) {
+		return
+	}
+	ttl, ok := cacheTTL(w.Header(), c.ttl)
+	if !ok {
+		return
+	}
+	c.cache.Set(key, bw.buf.Bytes(), ttl)
+}
+
+// checkVersions drops the cached capabilities if the /versions response has changed
+func (c *capabilitiesCache) checkVersions(w http.ResponseWriter, req *http.Request) {
+	bw := &bufferingWriter{
+		ResponseWriter: w,
+		maxSize:        capabilitiesCacheBytes,
+	}
+	c.next.ServeHTTP(bw, req)
+	if bw.statusCode != http.StatusOK || bw.overflowed {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.versions != nil && !bytes.Equal(c.versions, bw.buf.Bytes()) {
+		c.generation++
+	}
+	c.versions = append([]byte(nil), bw.buf.Bytes()...)
+}
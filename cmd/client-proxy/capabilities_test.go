@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCapabilitiesCache(t *testing.T) {
+	capabilities := `{"capabilities":{"m.change_password":{"enabled":true}}}`
+	versions := `{"versions":["r0.6.1"]}`
+	var hits []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits = append(hits, req.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		if req.URL.Path == versionsPath {
+			w.Write([]byte(versions))
+			return
+		}
+		w.Write([]byte(capabilities))
+	})
+	cache := newMockCache()
+	cc := &capabilitiesCache{
+		cache: cache,
+		next:  next,
+		ttl:   time.Hour,
+	}
+	do := func(path, token string) string {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		cc.ServeHTTP(w, req)
+		res := w.Result()
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != 200 {
+			t.Errorf("GET %s: got HTTP %d", path, res.StatusCode)
+		}
+		return string(body)
+	}
+	const path = "/_matrix/client/v3/capabilities"
+	fetches := func() int {
+		n := 0
+		for _, hit := range hits {
+			if hit == path {
+				n++
+			}
+		}
+		return n
+	}
+
+	do(versionsPath, "")
+	// the second request is served from the cache
+	for i := 0; i < 2; i++ {
+		if body := do(path, "alice"); body != capabilities {
+			t.Errorf("request %d: got %s want %s", i, body, capabilities)
+		}
+	}
+	if n := fetches(); n != 1 {
+		t.Errorf("capabilities were fetched %d times want 1", n)
+	}
+	if ttl := cache.ttls["0 alice "+path]; ttl != time.Hour {
+		t.Errorf("got ttl %v want 1h", ttl)
+	}
+	// other users fetch their own
+	do(path, "bob")
+	if n := fetches(); n != 2 {
+		t.Errorf("capabilities were fetched %d times after another user's request want 2", n)
+	}
+
+	// the same /versions does not drop the cache, but an upgraded server does
+	do(versionsPath, "")
+	do(path, "alice")
+	if n := fetches(); n != 2 {
+		t.Errorf("capabilities were fetched %d times after the same /versions want 2", n)
+	}
+	versions = `{"versions":["r0.6.1","v1.1"]}`
+	capabilities = `{"capabilities":{"m.change_password":{"enabled":false}}}`
+	do(versionsPath, "")
+	if body := do(path, "alice"); body != capabilities {
+		t.Errorf("after upgrade: got %s want %s", body, capabilities)
+	}
+	if n := fetches(); n != 3 {
+		t.Errorf("capabilities were fetched %d times after a new /versions want 3", n)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/lb/mobile"
+	"gopkg.in/yaml.v2"
+)
+
+// fileConfig is the structure of the YAML file given by --config, e.g:
+//
+//	server:
+//	  homeserver: "example.com:8008"
+//	  http-bind-addr: ":8008"
+//	params:
+//	  observe_enabled: true
+//	  transmission_nstart: 2
+//
+// Server keys are flag names. Params keys are LB_ env var names, lowercased and without the LB_ prefix. See
+// cachePolicy for cache_policies.
+type fileConfig struct {
+	Server        map[string]string `yaml:"server"`
+	Params        map[string]string `yaml:"params"`
+	CachePolicies cachePolicies     `yaml:"cache_policies"`
+}
+
+func setInt(dst *int) func(val string) error {
+	return func(val string) (err error) {
+		*dst, err = strconv.Atoi(val)
+		return
+	}
+}
+
+func setBool(dst *bool) func(val string) error {
+	return func(val string) (err error) {
+		*dst, err = strconv.ParseBool(val)
+		return
+	}
+}
+
+func setString(dst *string) func(val string) error {
+	return func(val string) error {
+		*dst = val
+		return nil
+	}
+}
+
+// connParamsVars returns a map of env var name to a function which sets the corresponding field in cp
+func connParamsVars(cp *mobile.ConnectionParams) map[string]func(val string) error {
+	return map[string]func(val string) error{
+		"LB_INSECURE_SKIP_VERIFY":                 setBool(&cp.InsecureSkipVerify),
+		"LB_DTLS_MIN_VERSION":                     setString(&cp.DTLSMinVersion),
+		"LB_DTLS_CIPHER_SUITES":                   setString(&cp.DTLSCipherSuites),
+		"LB_SERVER_NAME":                          setString(&cp.ServerName),
+		"LB_SEND_URI_HOST":                        setBool(&cp.SendURIHost),
+		"LB_FLIGHT_INTERVAL_SECS":                 setInt(&cp.FlightIntervalSecs),
+		"LB_HANDSHAKE_TIMEOUT_SECS":               setInt(&cp.HandshakeTimeoutSecs),
+		"LB_MAX_CONCURRENT_HANDSHAKES":            setInt(&cp.MaxConcurrentHandshakes),
+		"LB_HEARTBEAT_TIMEOUT_SECS":               setInt(&cp.HeartbeatTimeoutSecs),
+		"LB_KEEP_ALIVE_MAX_RETRIES":               setInt(&cp.KeepAliveMaxRetries),
+		"LB_KEEP_ALIVE_TIMEOUT_SECS":              setInt(&cp.KeepAliveTimeoutSecs),
+		"LB_TRANSMISSION_NSTART":                  setInt(&cp.TransmissionNStart),
+		"LB_TRANSMISSION_ACK_TIMEOUT_SECS":        setInt(&cp.TransmissionACKTimeoutSecs),
+		"LB_TRANSMISSION_MAX_RETRANSMITS":         setInt(&cp.TransmissionMaxRetransmits),
+		"LB_OBSERVE_ENABLED":                      setBool(&cp.ObserveEnabled),
+		"LB_OBSERVE_BUFFER_SIZE":                  setInt(&cp.ObserveBufferSize),
+		"LB_OBSERVE_NO_RESPONSE_TIMEOUT_SECS":     setInt(&cp.ObserveNoResponseTimeoutSecs),
+		"LB_OBSERVE_REFRESH_SECS":                 setInt(&cp.ObserveRefreshSecs),
+		"LB_OBSERVE_STALL_SECS":                   setInt(&cp.ObserveStallSecs),
+		"LB_OBSERVE_COALESCE_MS":                  setInt(&cp.ObserveCoalesceMs),
+		"LB_OBSERVE_SINCE_MAX_AGE_SECS":           setInt(&cp.ObserveSinceMaxAgeSecs),
+		"LB_OBSERVE_CHANGED_ROOMS_ONLY":           setBool(&cp.ObserveChangedRoomsOnly),
+		"LB_ADAPTIVE_TRANSMISSION":                setBool(&cp.AdaptiveTransmission),
+		"LB_ADAPTIVE_MIN_ACK_TIMEOUT_SECS":        setInt(&cp.AdaptiveMinACKTimeoutSecs),
+		"LB_ADAPTIVE_MIN_BLOCK_SIZE":              setInt(&cp.AdaptiveMinBlockSize),
+		"LB_MAX_BLOCKWISE_ROUND_TRIPS":            setInt(&cp.MaxBlockwiseRoundTrips),
+		"LB_BLOCKWISE_STALL_TIMEOUT_SECS":         setInt(&cp.BlockwiseStallTimeoutSecs),
+		"LB_BLOCKWISE_STALL_POLICY":               setString(&cp.BlockwiseStallPolicy),
+		"LB_INCOMPLETE_UPLOAD_RETRIES":            setInt(&cp.IncompleteUploadRetries),
+		"LB_PATH_MTU":                             setInt(&cp.PathMTU),
+		"LB_REQUEST_OPTIONS":                      setString(&cp.RequestOptions),
+		"LB_TOKEN_COMPRESSION":                    setBool(&cp.TokenCompression),
+		"LB_MAX_BYTES_PER_MINUTE":                 setInt(&cp.MaxBytesPerMinute),
+		"LB_MAX_OBSERVES":                         setInt(&cp.MaxObserves),
+		"LB_OBSERVE_RESYNC_GAP":                   setInt(&cp.ObserveResyncGap),
+		"LB_OBSERVE_SEQ_GAP_THRESHOLD":            setInt(&cp.ObserveSeqGapThreshold),
+		"LB_OBSERVE_PIN_IN_BACKGROUND":            setBool(&cp.ObservePinInBackground),
+		"LB_LOW_POWER_MAX_DEFERRED_NOTIFICATIONS": setInt(&cp.LowPowerMaxDeferredNotifications),
+		"LB_DOWNLOAD_RANGE_BLOCKS":                setInt(&cp.DownloadRangeBlocks),
+		"LB_STRICT_CONTENT_FORMAT":                setBool(&cp.StrictContentFormat),
+		"LB_SCHEMA_VALIDATION":                    setBool(&cp.SchemaValidation),
+		"LB_SCHEMA_VALIDATION_REJECT":             setBool(&cp.SchemaValidationReject),
+		"LB_MAX_CONCURRENT_EXCHANGES":             setInt(&cp.MaxConcurrentExchanges),
+		"LB_DICTIONARY_V2":                        setBool(&cp.DictionaryV2),
+		"LB_ALLOW_UNCOMPRESSED_FALLBACK":          setBool(&cp.AllowUncompressedFallback),
+		"LB_PATH_SEGMENTS":                        setBool(&cp.PathSegments),
+		"LB_REQUIRE_TOKEN_PATHS":                  setString(&cp.RequireTokenPaths),
+		"LB_TXN_CACHE_SECS":                       setInt(&cp.TxnCacheSecs),
+		"LB_PRESENCE_NON_CONFIRMABLE":             setBool(&cp.PresenceNonConfirmable),
+		"LB_OBSERVE_COMPRESSION":                  setString(&cp.ObserveCompression),
+		"LB_MAX_CONNECTION_RETRANSMITS":           setInt(&cp.MaxConnectionRetransmits),
+		"LB_RETRY_BUDGET_PER_MINUTE":              setInt(&cp.RetryBudgetPerMinute),
+		"LB_OBSERVE_ORDERING":                     setString(&cp.ObserveOrdering),
+		"LB_OBSERVE_REORDER_TIMEOUT_MS":           setInt(&cp.ObserveReorderTimeoutMs),
+		"LB_OBSERVE_BATCH_SIZE":                   setInt(&cp.ObserveBatchSize),
+		"LB_OBSERVE_BATCH_INTERVAL_MS":            setInt(&cp.ObserveBatchIntervalMs),
+	}
+}
+
+// loadConfigFile reads and validates the YAML config file at path. Unknown keys are rejected.
+func loadConfigFile(path string, fs *flag.FlagSet) (*fileConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fc fileConfig
+	if err = yaml.UnmarshalStrict(data, &fc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for key := range fc.Server {
+		if key == "config" || fs.Lookup(key) == nil {
+			return nil, fmt.Errorf("unknown server key '%s'", key)
+		}
+	}
+	vars := connParamsVars(&mobile.ConnectionParams{})
+	for key := range fc.Params {
+		if _, ok := vars["LB_"+strings.ToUpper(key)]; !ok {
+			return nil, fmt.Errorf("unknown params key '%s'", key)
+		}
+	}
+	if err = compileCachePolicies(fc.CachePolicies); err != nil {
+		return nil, err
+	}
+	return &fc, nil
+}
+
+// resolveConfig works out the configuration to use, in the order config file < env < flag. Server keys in
+// the config file are applied to fs unless the flag was explicitly set. The params in the config file are
+// applied to cp, then any LB_ env vars returned by getenv. Returns true if cp was modified.
+func resolveConfig(fs *flag.FlagSet, fc *fileConfig, cp *mobile.ConnectionParams, getenv func(string) string) (bool, error) {
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	vars := connParamsVars(cp)
+	changed := false
+	if fc != nil {
+		for key, val := range fc.Server {
+			if setFlags[key] {
+				continue
+			}
+			if err := fs.Set(key, val); err != nil {
+				return false, fmt.Errorf("server key '%s': %w", key, err)
+			}
+		}
+		for key, val := range fc.Params {
+			if err := vars["LB_"+strings.ToUpper(key)](val); err != nil {
+				return false, fmt.Errorf("params key '%s': %w", key, err)
+			}
+			changed = true
+		}
+	}
+	for name, apply := range vars {
+		val := getenv(name)
+		if val == "" {
+			continue
+		}
+		if err := apply(val); err != nil {
+			return false, fmt.Errorf("env var %s: %w", name, err)
+		}
+		changed = true
+	}
+	return changed, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/lb/mobile"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "client-proxy")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	path := filepath.Join(dir, "config.yaml")
+	if err = ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	return path
+}
+
+func TestResolveConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  homeserver: "file.example.com:8008"
+  http-bind-addr: ":1111"
+params:
+  observe_enabled: true
+  transmission_nstart: 2
+  keep_alive_max_retries: 5
+`)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	bindAddr := fs.String("http-bind-addr", ":8008", "")
+	hsAddr := fs.String("homeserver", "", "")
+	if err := fs.Parse([]string{"-homeserver", "flag.example.com:8008"}); err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	fc, err := loadConfigFile(path, fs)
+	if err != nil {
+		t.Fatalf("loadConfigFile: %s", err)
+	}
+	env := map[string]string{
+		"LB_TRANSMISSION_NSTART": "3",
+	}
+	cp := mobile.ConnectionParams{TransmissionNStart: 1, KeepAliveMaxRetries: 1}
+	changed, err := resolveConfig(fs, fc, &cp, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("resolveConfig: %s", err)
+	}
+	if !changed {
+		t.Errorf("resolveConfig returned changed=false")
+	}
+	if *hsAddr != "flag.example.com:8008" {
+		t.Errorf("flag should take precedence over file, got homeserver=%s", *hsAddr)
+	}
+	if *bindAddr != ":1111" {
+		t.Errorf("file should take precedence over flag default, got http-bind-addr=%s", *bindAddr)
+	}
+	if cp.TransmissionNStart != 3 {
+		t.Errorf("env should take precedence over file, got TransmissionNStart=%d", cp.TransmissionNStart)
+	}
+	if cp.KeepAliveMaxRetries != 5 || !cp.ObserveEnabled {
+		t.Errorf("file should take precedence over defaults, got %+v", cp)
+	}
+}
+
+func TestLoadConfigFileRejectsUnknownKeys(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("homeserver", "", "")
+	testCases := map[string]string{
+		"top level": "servers:\n  homeserver: foo\n",
+		"server":    "server:\n  homserver: foo\n",
+		"params":    "params:\n  observe_enable: true\n",
+		"config":    "server:\n  config: other.yaml\n",
+	}
+	for name, contents := range testCases {
+		if _, err := loadConfigFile(writeConfigFile(t, contents), fs); err == nil {
+			t.Errorf("%s: expected error for unknown key, got none", name)
+		}
+	}
+}
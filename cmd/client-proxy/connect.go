@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// connectProxy accepts HTTP CONNECT for Matrix hosts, so clients configured to use this as their system proxy get
+// the low bandwidth path without being modified. Rather than tunnelling the client's traffic to the host, the tunnel
+// is terminated here: TLS with the configured certificate, which the client must trust, then the HTTP requests in it
+// are served by next like any other request. Requests which are not CONNECT go straight to next.
+type connectProxy struct {
+	// host:port -> true for the hosts which may be tunnelled to
+	hosts map[string]bool
+	// the certificate to terminate TLS with, or nil if clients send plain HTTP in the tunnel
+	tlsConfig *tls.Config
+	next      http.Handler
+	// how long a tunnel can be idle before it is closed
+	idleTimeout time.Duration
+}
+
+// parseConnectHosts parses --connect-hosts, a comma separated list of host or host:port. Hosts without a port
+// are port 443. Every tunnel is served by homeserverAddr, so a host other than its host would be answered by the
+// wrong homeserver and is an error.
+func parseConnectHosts(s, homeserverAddr string) (map[string]bool, error) {
+	homeserverHost, _, err := net.SplitHostPort(homeserverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("homeserver %q is not a valid host: %w", homeserverAddr, err)
+	}
+	hosts := make(map[string]bool)
+	for _, h := range strings.Split(s, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			return nil, fmt.Errorf("%q has an empty host", s)
+		}
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(h, "443")
+		}
+		h = strings.ToLower(h)
+		if host, _, _ := net.SplitHostPort(h); host != strings.ToLower(homeserverHost) {
+			return nil, fmt.Errorf("%s is not on the homeserver %s, which every tunnel is sent to", h, homeserverAddr)
+		}
+		hosts[h] = true
+	}
+	return hosts, nil
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect {
+		p.next.ServeHTTP(w, req)
+		return
+	}
+	// only Matrix traffic can go over CoAP, so anything else would be broken rather than proxied
+	if !p.hosts[strings.ToLower(req.Host)] {
+		logrus.Warnf("Rejecting CONNECT to %s which is not in --connect-hosts", req.Host)
+		http.Error(w, "CONNECT is only allowed to Matrix hosts", http.StatusForbidden)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT is not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to hijack CONNECT connection")
+		return
+	}
+	// the timeouts of the server were for the CONNECT request, not the tunnel
+	_ = conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+	logrus.Infof("Tunnelling CONNECT to %s over CoAP", req.Host)
+	var tunnel net.Conn = &bufferedConn{Conn: conn, r: buf.Reader}
+	if p.tlsConfig != nil {
+		tunnel = tls.Server(tunnel, p.tlsConfig)
+	}
+	srv := &http.Server{
+		Handler:           p.next,
+		IdleTimeout:       p.idleTimeout,
+		ReadHeaderTimeout: p.idleTimeout,
+	}
+	_ = srv.Serve(newTunnelListener(tunnel))
+}
+
+// bufferedConn is a hijacked conn which reads whatever the client sent after the CONNECT request first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+var errTunnelClosed = errors.New("tunnel closed")
+
+// tunnelListener is a listener which accepts the conn of a single tunnel, then blocks until it is closed, so
+// http.Server.Serve returns once the tunnel is finished with
+type tunnelListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newTunnelListener(conn net.Conn) *tunnelListener {
+	l := &tunnelListener{closed: make(chan struct{})}
+	l.conn = &closeNotifyConn{Conn: conn, onClose: func() {
+		l.once.Do(func() { close(l.closed) })
+	}}
+	return l
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	if conn := l.conn; conn != nil {
+		l.conn = nil
+		return conn, nil
+	}
+	<-l.closed
+	return nil, errTunnelClosed
+}
+
+func (l *tunnelListener) Close() error {
+	return nil
+}
+
+func (l *tunnelListener) Addr() net.Addr {
+	return tunnelAddr{}
+}
+
+type tunnelAddr struct{}
+
+func (tunnelAddr) Network() string { return "tunnel" }
+func (tunnelAddr) String() string  { return "tunnel" }
+
+// closeNotifyConn calls onClose when it is closed
+type closeNotifyConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	c.onClose()
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/lb/mobile"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+)
+
+func TestParseConnectHosts(t *testing.T) {
+	hosts, err := parseConnectHosts("matrix.example.com, Matrix.Example.com:8448", "matrix.example.com:8008")
+	if err != nil {
+		t.Fatalf("parseConnectHosts: %s", err)
+	}
+	if len(hosts) != 2 || !hosts["matrix.example.com:443"] || !hosts["matrix.example.com:8448"] {
+		t.Errorf("got hosts %v", hosts)
+	}
+	if _, err := parseConnectHosts("matrix.example.com,", "matrix.example.com:8008"); err == nil {
+		t.Errorf("parseConnectHosts accepted an empty host")
+	}
+	// tunnels to the second host would be answered by the homeserver on the first
+	if hosts, err := parseConnectHosts("matrix.example.com,matrix.example.org", "matrix.example.com:8008"); err == nil {
+		t.Errorf("parseConnectHosts accepted a host which is not the homeserver's: %v", hosts)
+	}
+}
+
+func TestConnectProxy(t *testing.T) {
+	var mu sync.Mutex
+	var gotURL, gotToken string
+	oldSend, oldHomeserverAddr := sendRequestWithOptions, *homeserverAddr
+	sendRequestWithOptions = func(method, hsURL, token, body string, opts *mobile.SendOptions) *mobile.Response {
+		mu.Lock()
+		defer mu.Unlock()
+		gotURL, gotToken = hsURL, token
+		return &mobile.Response{Code: 200, Body: `{"user_id":"@alice:example.com"}`}
+	}
+	*homeserverAddr = "matrix.example.com:8008"
+	t.Cleanup(func() {
+		sendRequestWithOptions, *homeserverAddr = oldSend, oldHomeserverAddr
+	})
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		t.Fatalf("GenerateSelfSigned: %s", err)
+	}
+	srv := httptest.NewServer(&connectProxy{
+		hosts:       map[string]bool{"matrix.example.com:443": true},
+		tlsConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		next:        http.HandlerFunc(handler),
+		idleTimeout: time.Minute,
+	})
+	defer srv.Close()
+	proxyURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("cannot parse proxy URL: %s", err)
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		// the client must trust the certificate, which is self-signed here
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+	req, err := http.NewRequest("GET", "https://matrix.example.com/_matrix/client/r0/account/whoami", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request through CONNECT failed: %s", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || string(body) != `{"user_id":"@alice:example.com"}` {
+		t.Errorf("got HTTP %d %s", res.StatusCode, body)
+	}
+	mu.Lock()
+	if gotURL != "//matrix.example.com:8008/_matrix/client/r0/account/whoami" || gotToken != "secret" {
+		t.Errorf("sent %s with token %q over CoAP", gotURL, gotToken)
+	}
+	mu.Unlock()
+
+	// other hosts would not understand CoAP
+	res, err = client.Get("https://other.example.com/")
+	if err == nil {
+		res.Body.Close()
+		t.Errorf("CONNECT to a host not in --connect-hosts got HTTP %d", res.StatusCode)
+	}
+}
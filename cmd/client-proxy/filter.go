@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	"github.com/matrix-org/lb"
+)
+
+// filterPathRegexp matches POST /user/{userId}/filter and GET /user/{userId}/filter/{filterId}
+var filterPathRegexp = regexp.MustCompile(`^/_matrix/client/(r0|v3)/user/[^/]+/filter(/[^/]+)?$`)
+
+// filterCache is an http.Handler which caches filters. Filters cannot be changed once uploaded, so they are cached
+// without expiry. Uploaded filters are cached under the filter ID the homeserver returns, so fetching a filter after
+// uploading it never goes over the network. Like mediaCache, the cache key is the path: this proxy sits alongside a
+// single client.
+type filterCache struct {
+	cache lb.Cache
+	next  http.Handler
+	// filters larger than this are never cached
+	maxSize int64
+}
+
+func (f *filterCache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	m := filterPathRegexp.FindStringSubmatch(req.URL.Path)
+	switch {
+	case m != nil && m[2] == "" && req.Method == "POST":
+		f.upload(w, req)
+	case m != nil && m[2] != "" && req.Method == "GET":
+		f.download(w, req)
+	default:
+		f.next.ServeHTTP(w, req)
+	}
+}
+
+func (f *filterCache) upload(w http.ResponseWriter, req *http.Request) {
+	filter, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"errcode":"PROXY","error":"cannot read request body"}`))
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(filter))
+	bw := &bufferingWriter{
+		ResponseWriter: w,
+		maxSize:        f.maxSize,
+	}
+	f.next.ServeHTTP(bw, req)
+	if bw.statusCode != http.StatusOK || bw.overflowed || int64(len(filter)) > f.maxSize || !json.Valid(filter) {
+		return
+	}
+	var res struct {
+		FilterID string `json:"filter_id"`
+	}
+	if err = json.Unmarshal(bw.buf.Bytes(), &res); err != nil || res.FilterID == "" {
+		return
+	}
+	f.cache.Set(req.URL.Path+"/"+res.FilterID, filter, 0)
+}
+
+func (f *filterCache) download(w http.ResponseWriter, req *http.Request) {
+	if filter, ok := f.cache.Get(req.URL.Path); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(filter)
+		return
+	}
+	bw := &bufferingWriter{
+		ResponseWriter: w,
+		maxSize:        f.maxSize,
+	}
+	f.next.ServeHTTP(bw, req)
+	if bw.statusCode != http.StatusOK || bw.overflowed {
+		return
+	}
+	ttl, ok := cacheTTL(w.Header(), 0)
+	if !ok {
+		return
+	}
+	f.cache.Set(req.URL.Path, bw.buf.Bytes(), ttl)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFilterCache(t *testing.T) {
+	filter := `{"room":{"timeline":{"limit":10}}}`
+	var hits []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits = append(hits, req.Method+" "+req.URL.Path)
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case req.Method == "POST" && string(body) == filter:
+			w.WriteHeader(200)
+			w.Write([]byte(`{"filter_id":"66697"}`))
+		case req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/user/@alice:example.com/filter/other":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"room":{"timeline":{"limit":5}}}`))
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+		}
+	})
+	cache := newMockCache()
+	fc := &filterCache{
+		cache:   cache,
+		next:    next,
+		maxSize: 1024,
+	}
+	do := func(method, path, body string) (int, string) {
+		w := httptest.NewRecorder()
+		fc.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		res := w.Result()
+		resBody, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(resBody)
+	}
+
+	// the upload goes to the homeserver, with the body intact
+	code, body := do("POST", "/_matrix/client/r0/user/@alice:example.com/filter", filter)
+	if code != 200 || body != `{"filter_id":"66697"}` {
+		t.Fatalf("upload: got %d %s", code, body)
+	}
+	// then the filter is served from the cache
+	for i := 0; i < 2; i++ {
+		code, body = do("GET", "/_matrix/client/r0/user/@alice:example.com/filter/66697", "")
+		if code != 200 || body != filter {
+			t.Errorf("download %d: got %d %s want 200 %s", i, code, body, filter)
+		}
+	}
+	if len(hits) != 1 {
+		t.Errorf("filter was fetched from the homeserver: %v", hits)
+	}
+	if ttl := cache.ttls["/_matrix/client/r0/user/@alice:example.com/filter/66697"]; ttl != 0 {
+		t.Errorf("wrong ttl: got %v want 0", ttl)
+	}
+
+	// filters uploaded elsewhere are cached on the first download
+	for i := 0; i < 2; i++ {
+		code, body = do("GET", "/_matrix/client/r0/user/@alice:example.com/filter/other", "")
+		if code != 200 || body != `{"room":{"timeline":{"limit":5}}}` {
+			t.Errorf("download other %d: got %d %s", i, code, body)
+		}
+	}
+	if len(hits) != 2 {
+		t.Errorf("other filter was fetched %d times, want 1: %v", len(hits)-1, hits)
+	}
+
+	// v3 paths are cached in the same way
+	code, body = do("POST", "/_matrix/client/v3/user/@alice:example.com/filter", filter)
+	if code != 200 || body != `{"filter_id":"66697"}` {
+		t.Fatalf("v3 upload: got %d %s", code, body)
+	}
+	code, body = do("GET", "/_matrix/client/v3/user/@alice:example.com/filter/66697", "")
+	if code != 200 || body != filter {
+		t.Errorf("v3 download: got %d %s want 200 %s", code, body, filter)
+	}
+	if len(hits) != 3 {
+		t.Errorf("v3 filter was fetched from the homeserver: %v", hits)
+	}
+
+	// failed uploads, missing filters and other paths are not cached
+	do("POST", "/_matrix/client/r0/user/@alice:example.com/filter", `{"invalid":true}`)
+	do("GET", "/_matrix/client/r0/user/@alice:example.com/filter/missing", "")
+	do("GET", "/_matrix/client/r0/user/@alice:example.com/filter/missing", "")
+	do("GET", "/_matrix/client/r0/user/@alice:example.com/account_data/m.direct", "")
+	if len(cache.data) != 3 {
+		t.Errorf("cache has %d entries, want 3: %v", len(cache.data), cache.data)
+	}
+	if len(hits) != 7 {
+		t.Errorf("got %d requests to the homeserver, want 7: %v", len(hits), hits)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"time"
+
+	"github.com/matrix-org/lb/mobile"
+	"github.com/sirupsen/logrus"
+)
+
+// insecureSkipVerifyVar is 1 while the homeserver's certificate is not being checked, so monitoring of /debug/vars
+// can alert on deployments which were left insecure by accident
+var insecureSkipVerifyVar = expvar.NewInt("lb_insecure_skip_verify")
+
+// How often the insecure warning is logged again, so it is still in the logs long after startup
+var insecureWarningInterval = time.Hour
+
+var errRefuseInsecure = errors.New("LB_INSECURE_SKIP_VERIFY is set but --refuse-insecure does not allow it")
+
+const insecureWarning = "InsecureSkipVerify is set: the homeserver's certificate is NOT being checked, so anyone on " +
+	"the network path can read and modify traffic. This must not be used in production."
+
+// checkInsecure warns that cp skips certificate checks, now and every insecureWarningInterval until stop is closed.
+// Returns errRefuseInsecure instead if refuse is set, so the proxy exits rather than run insecurely.
+func checkInsecure(cp *mobile.ConnectionParams, refuse bool, stop <-chan struct{}) error {
+	if !cp.InsecureSkipVerify {
+		insecureSkipVerifyVar.Set(0)
+		return nil
+	}
+	if refuse {
+		return errRefuseInsecure
+	}
+	insecureSkipVerifyVar.Set(1)
+	logrus.Warn(insecureWarning)
+	go func() {
+		ticker := time.NewTicker(insecureWarningInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				logrus.Warn(insecureWarning)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
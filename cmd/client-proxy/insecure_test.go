@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/lb/mobile"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestCheckInsecure(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	oldInterval := insecureWarningInterval
+	insecureWarningInterval = 20 * time.Millisecond
+	t.Cleanup(func() {
+		insecureWarningInterval = oldInterval
+		insecureSkipVerifyVar.Set(0)
+	})
+	warnings := func() int {
+		n := 0
+		for _, e := range hook.AllEntries() {
+			if e.Level == logrus.WarnLevel && e.Message == insecureWarning {
+				n++
+			}
+		}
+		return n
+	}
+
+	if err := checkInsecure(&mobile.ConnectionParams{}, true, nil); err != nil {
+		t.Errorf("secure params with --refuse-insecure: got %s", err)
+	}
+	if warnings() != 0 || insecureSkipVerifyVar.Value() != 0 {
+		t.Errorf("secure params: got %d warnings and lb_insecure_skip_verify %d", warnings(), insecureSkipVerifyVar.Value())
+	}
+
+	insecure := &mobile.ConnectionParams{InsecureSkipVerify: true}
+	// main exits with this error
+	if err := checkInsecure(insecure, true, nil); err != errRefuseInsecure {
+		t.Errorf("insecure params with --refuse-insecure: got error %v want %s", err, errRefuseInsecure)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := checkInsecure(insecure, false, stop); err != nil {
+		t.Fatalf("insecure params: got %s", err)
+	}
+	if insecureSkipVerifyVar.Value() != 1 {
+		t.Errorf("got lb_insecure_skip_verify %d want 1", insecureSkipVerifyVar.Value())
+	}
+	if warnings() != 1 {
+		t.Errorf("got %d warnings at startup want 1", warnings())
+	}
+	// the warning is repeated
+	for start := time.Now(); warnings() < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("only got %d warnings", warnings())
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/lb/mobile"
+	"github.com/sirupsen/logrus"
+)
+
+// newHTTPServer returns the server for client requests on addr. HTTP connections are independent of the CoAP
+// connection: requests on every HTTP connection share the pooled CoAP connection to the homeserver, on which they
+// are sent concurrently, so HTTP connections opening, idling and closing never make or break a CoAP connection, and
+// a slow request on one HTTP connection does not hold up requests on the others. Requests on a single HTTP/1.1
+// connection are answered one after another, so clients which send many at once should use several connections.
+func newHTTPServer(addr string, handler http.Handler, idleTimeout time.Duration, keepAlive bool) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       5 * time.Minute,
+		WriteTimeout:      5 * time.Minute,
+		IdleTimeout:       idleTimeout,
+		ReadHeaderTimeout: 5 * time.Minute,
+	}
+	srv.SetKeepAlivesEnabled(keepAlive)
+	return srv
+}
+
+// checkExchangeWindow warns if cp lets a single long-polling request block every other request. HTTP clients poll
+// /sync on one keep-alive connection while sending on others, and without ObserveEnabled the poll holds an exchange
+// slot for as long as it waits, so with a window of 1 requests from every other connection wait behind it.
+func checkExchangeWindow(cp *mobile.ConnectionParams) {
+	if cp.MaxConcurrentExchanges == 1 && !cp.ObserveEnabled {
+		logrus.Warn("LB_MAX_CONCURRENT_EXCHANGES is 1 without LB_OBSERVE_ENABLED: requests will wait behind each long-polling /sync")
+	}
+}
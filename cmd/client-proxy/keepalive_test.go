@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	coapnet "github.com/matrix-org/go-coap/v2/net"
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/matrix-org/lb"
+	"github.com/matrix-org/lb/mobile"
+	piondtls "github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+)
+
+// keepAliveProxy is the proxy in front of a CoAP homeserver, counting the HTTP connections made to the proxy and the
+// CoAP connections made to the homeserver
+type keepAliveProxy struct {
+	url       string
+	httpConns int64 // accessed atomically
+	coapConns int64 // accessed atomically
+}
+
+func newKeepAliveProxy(tb testing.TB, keepAlive bool) *keepAliveProxy {
+	tb.Helper()
+	p := &keepAliveProxy{}
+	hs := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"versions":["r0.6.1"]}`))
+	})
+	codec := lb.NewCBORCodecV1(true)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	hsHandler := lb.CBORToJSONHandler(hs, codec, nil)
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		tb.Fatalf("failed to generate certificate: %s", err)
+	}
+	l, err := coapnet.NewDTLSListener("udp", "127.0.0.1:0", &piondtls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		tb.Fatalf("failed to listen: %s", err)
+	}
+	s := dtls.NewServer(
+		dtls.WithMux(coapHTTP.CoAPHTTPHandler(hsHandler, lb.NewSyncObservations(hsHandler, coapHTTP.Paths, codec))),
+		dtls.WithOnNewClientConn(func(cc *client.ClientConn, dtlsConn *piondtls.Conn) {
+			atomic.AddInt64(&p.coapConns, 1)
+		}),
+	)
+	go s.Serve(l)
+
+	oldParams, oldHomeserverAddr := *mobile.Params(), *homeserverAddr
+	cp := oldParams
+	cp.InsecureSkipVerify = true
+	if err := mobile.SetParams(&cp); err != nil {
+		tb.Fatalf("SetParams: %s", err)
+	}
+	*homeserverAddr = l.Addr().String()
+
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config = newHTTPServer("", http.HandlerFunc(handler), time.Minute, keepAlive)
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&p.httpConns, 1)
+		}
+	}
+	srv.Start()
+	p.url = srv.URL
+	tb.Cleanup(func() {
+		srv.Close()
+		mobile.SetParams(&oldParams)
+		*homeserverAddr = oldHomeserverAddr
+		s.Stop()
+		l.Close()
+	})
+	return p
+}
+
+func (p *keepAliveProxy) get(tb testing.TB, client *http.Client) {
+	tb.Helper()
+	res, err := client.Get(p.url + "/_matrix/client/versions")
+	if err != nil {
+		tb.Fatalf("GET: %s", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || string(body) != `{"versions":["r0.6.1"]}` {
+		tb.Fatalf("got HTTP %d %s", res.StatusCode, body)
+	}
+}
+
+// TestKeepAliveSharesCoAPConnection checks that keep-alive HTTP connections are reused unless keep-alives are off,
+// and that HTTP connections coming and going share the one CoAP connection rather than each making their own
+func TestKeepAliveSharesCoAPConnection(t *testing.T) {
+	testCases := []struct {
+		keepAlive     bool
+		wantHTTPConns int64
+	}{
+		{keepAlive: true, wantHTTPConns: 2},
+		{keepAlive: false, wantHTTPConns: 40},
+	}
+	for _, tc := range testCases {
+		p := newKeepAliveProxy(t, tc.keepAlive)
+		transport := &http.Transport{}
+		client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+		for i := 0; i < 20; i++ {
+			p.get(t, client)
+		}
+		// closing the HTTP connections leaves the CoAP connection for the next client
+		transport.CloseIdleConnections()
+		for i := 0; i < 20; i++ {
+			p.get(t, client)
+		}
+		transport.CloseIdleConnections()
+		if got := atomic.LoadInt64(&p.httpConns); got != tc.wantHTTPConns {
+			t.Errorf("keep-alive %v: got %d HTTP connections want %d", tc.keepAlive, got, tc.wantHTTPConns)
+		}
+		if got := atomic.LoadInt64(&p.coapConns); got != 1 {
+			t.Errorf("keep-alive %v: got %d CoAP connections want 1", tc.keepAlive, got)
+		}
+	}
+}
+
+// BenchmarkKeepAliveRequests sends sequential requests on a keep-alive HTTP connection, reporting how many HTTP and
+// CoAP connections they needed, which should be 1 each however many requests are sent
+func BenchmarkKeepAliveRequests(b *testing.B) {
+	p := newKeepAliveProxy(b, true)
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+	// connect first, so the DTLS handshake is not timed
+	p.get(b, client)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.get(b, client)
+	}
+	b.StopTimer()
+	httpConns, coapConns := atomic.LoadInt64(&p.httpConns), atomic.LoadInt64(&p.coapConns)
+	b.ReportMetric(float64(httpConns), "http-conns")
+	b.ReportMetric(float64(coapConns), "coap-conns")
+	if httpConns != 1 || coapConns != 1 {
+		b.Errorf("%d requests used %d HTTP connections and %d CoAP connections, want 1 of each", b.N+1, httpConns, coapConns)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"io/ioutil"
 	"log"
@@ -14,81 +15,90 @@ import (
 	"strings"
 	"time"
 
+	"github.com/matrix-org/lb"
 	"github.com/matrix-org/lb/mobile"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	httpBindAddr                                      = flag.String("http-bind-addr", ":8008", "The HTTP listening port for the server")
-	homeserverAddr                                    = flag.String("homeserver", "", "The homeserver to forward inbound requests to, without the coaps:// e.g localhost:8008")
-	homeserverRoot             *url.URL               = nil
-	mediaProxy                 *httputil.ReverseProxy = nil
-	mediaUrlRegexp, regexp_err                        = regexp.Compile("/_matrix/(client|federation)/v1/media")
+	httpBindAddr                            = flag.String("http-bind-addr", ":8008", "The HTTP listening port for the server")
+	configPath                              = flag.String("config", "", "Optional: a YAML file to read flags and connection params from. Env vars and flags take precedence over this file.")
+	homeserverAddr                          = flag.String("homeserver", "", "The homeserver to forward inbound requests to, without the coaps:// e.g localhost:8008")
+	homeserverRoot             *url.URL     = nil
+	mediaProxy                 http.Handler = nil
+	mediaUrlRegexp, regexp_err              = regexp.Compile("/_matrix/(client|federation)/v1/media")
+	nonConfirmablePaths                     = flag.String("non-confirmable-paths", "",
+		"Optional: a regular expression matching the paths of PUT/POST requests which should be sent without waiting for a response, "+
+			"e.g typing notifications. Matching requests immediately return 200 OK with an empty JSON object.")
+	nonConfirmableRegexp *regexp.Regexp = nil
+	mediaCacheBytes                     = flag.Int64("media-cache-bytes", 0, "Optional: the max number of bytes of media to cache in memory. 0 disables the cache.")
+	mediaCacheTTL                       = flag.Duration("media-cache-ttl", 24*time.Hour, "How long to cache media for, if the media cache is enabled")
+	responseCacheBytes                  = flag.Int64("response-cache-bytes", 4*1024*1024, "The max number of bytes of responses to cache in memory for the cache_policies in --config. 0 disables the cache.")
+	filterCacheBytes                    = flag.Int64("filter-cache-bytes", 1024*1024, "Optional: the max number of bytes of filters to cache in memory. 0 disables the cache.")
+	capabilitiesCacheTTL                = flag.Duration("capabilities-cache-ttl", time.Hour, "Optional: how long to cache GET /capabilities responses for. They are dropped early if the /versions response changes. 0 disables the cache.")
+	selfTest                            = flag.Bool("self-test", false, "Run a series of checks against the homeserver, print a pass/fail report then exit")
+	selfTestJSON                        = flag.Bool("self-test-json", false, "Like --self-test but print the report as JSON")
+	selfTestToken                       = flag.String("self-test-token", "", "Optional: an access token to use with --self-test to check authenticated endpoints e.g OBSERVE /sync. This writes org.matrix.lb.self_test account data to the token's account, so use a test account.")
+	shadowHTTPSEnabled                  = flag.Bool("shadow-https", false,
+		"Debug: repeat GET requests over HTTPS to the homeserver in the background and log any structural differences from the CoAP response")
+	shadow              *shadowHTTPS = nil
+	serverTimingEnabled              = flag.Bool("server-timing", false,
+		"Optional: add a Server-Timing header to responses with the time taken by the DTLS handshake, CoAP exchange, block-wise transfer and CBOR decoding")
+	dictionaryHeaderEnabled = flag.Bool("dictionary-header", false,
+		"Debug: add an X-LB-Dict-Version header to responses with the dictionary version the homeserver proxy encoded the body with e.g v1, v2 or none")
+	slowRequestThreshold = flag.Duration("slow-request-threshold", 0,
+		"Optional: log requests which take longer than this e.g 2s at info level, with the time taken by each stage. Long-polling requests with a timeout are not logged. 0 disables this.")
+	mediaPrefetchThumbnails = flag.Int("media-prefetch-thumbnails", 0,
+		"Optional: the max number of thumbnails of the newest images in each /sync response to fetch into the media cache in the background. Requires --media-cache-bytes. 0 disables prefetching.")
+	mediaPrefetchThumbnailSize = flag.String("media-prefetch-thumbnail-size", "800x600",
+		"The WIDTHxHEIGHT of thumbnails to prefetch. This must match the size the client asks for, or prefetched thumbnails will never be used.")
+	prefetcher            *mediaPrefetcher = nil
+	mediaBlurhashPreviews                  = flag.Bool("media-blurhash-previews", false,
+		"Optional: send clients which accept multipart/x-mixed-replace a preview rendered from the image's blurhash before the full image. Only images seen in /sync responses have a preview.")
+	previews  *mediaPreviews = nil
+	adminAddr                = flag.String("admin-addr", "",
+		"Optional: the address to serve admin endpoints on over HTTP e.g 127.0.0.1:9091, which needs --admin-token. The connection state is served at "+debugStatePath+".")
+	adminToken            = flag.String("admin-token", "", "The bearer token requests to --admin-addr must have")
+	messagesPrefetchPages = flag.Int("messages-prefetch-pages", 0,
+		"Optional: the max number of pages of history to fetch into a cache in the background after each /rooms/{roomId}/messages response, so scrolling back is faster. "+
+			"Prefetching stops when the client fetches another part of history or sends anything. 0 disables prefetching.")
+	messagesCacheBytes = flag.Int64("messages-cache-bytes", 4*1024*1024, "The max number of bytes of prefetched pages of history to cache in memory")
+	connectHosts       = flag.String("connect-hosts", "",
+		"Optional: a comma separated list of Matrix hosts e.g matrix.example.com:443 to accept HTTP CONNECT for, so clients using this as their HTTP proxy are served over CoAP. "+
+			"Hosts without a port are port 443. Every tunnel is sent to --homeserver, so the hosts must be its host. CONNECT to any other host is rejected.")
+	connectCert    = flag.String("connect-cert", "", "The PEM certificate to terminate TLS in CONNECT tunnels with, which clients must trust. If unset, clients must send plain HTTP in the tunnel.")
+	connectKey     = flag.String("connect-key", "", "The PEM private key of --connect-cert")
+	refuseInsecure = flag.Bool("refuse-insecure", false,
+		"Exit rather than run with LB_INSECURE_SKIP_VERIFY set, so a development config can never be deployed to production by accident")
+	httpIdleTimeout = flag.Duration("http-idle-timeout", 5*time.Minute,
+		"How long an idle keep-alive HTTP connection from a client is kept open. This does not affect the CoAP connection to the homeserver, which all HTTP connections share.")
+	httpKeepAlive = flag.Bool("http-keep-alive", true,
+		"Keep HTTP connections from clients open between requests. Turn this off for clients which leak connections.")
+	mockHomeserverEnabled = flag.Bool("mock-homeserver", false,
+		"Demo: serve canned responses for /versions, /login, /account/whoami and a scripted /sync from a homeserver running inside the proxy, over CoAP and CBOR as usual, instead of forwarding to --homeserver")
+	mockScriptPath = flag.String("mock-script", "", "Optional: a JSON file of the user, access token and /sync responses for --mock-homeserver to serve. If unset, a demo room is served.")
 )
 
-func mustInt(val string) int {
-	i, err := strconv.Atoi(val)
-	if err != nil {
-		panic(err)
-	}
-	return i
-}
+// sendRequestWithOptions forwards a request over CoAP
+var sendRequestWithOptions = mobile.SendRequestWithOptions
 
-func setConnParamsFromEnv() {
-	cp := mobile.Params()
-	// map of env var to what to set if it exists
-	envs := map[string]func(val string){
-		"LB_INSECURE_SKIP_VERIFY": func(val string) {
-			cp.InsecureSkipVerify = val == "1"
-		},
-		"LB_FLIGHT_INTERVAL_SECS": func(val string) {
-			cp.FlightIntervalSecs = mustInt(val)
-		},
-		"LB_HEARTBEAT_TIMEOUT_SECS": func(val string) {
-			cp.HeartbeatTimeoutSecs = mustInt(val)
-		},
-		"LB_KEEP_ALIVE_MAX_RETRIES": func(val string) {
-			cp.KeepAliveMaxRetries = mustInt(val)
-		},
-		"LB_KEEP_ALIVE_TIMEOUT_SECS": func(val string) {
-			cp.KeepAliveTimeoutSecs = mustInt(val)
-		},
-		"LB_TRANSMISSION_NSTART": func(val string) {
-			cp.TransmissionNStart = mustInt(val)
-		},
-		"LB_TRANSMISSION_ACK_TIMEOUT_SECS": func(val string) {
-			cp.TransmissionACKTimeoutSecs = mustInt(val)
-		},
-		"LB_TRANSMISSION_MAX_RETRANSMITS": func(val string) {
-			cp.TransmissionMaxRetransmits = mustInt(val)
-		},
-		"LB_OBSERVE_ENABLED": func(val string) {
-			cp.ObserveEnabled = val == "1"
-		},
-		"LB_OBSERVE_BUFFER_SIZE": func(val string) {
-			cp.ObserveBufferSize = mustInt(val)
-		},
-		"LB_OBSERVE_NO_RESPONSE_TIMEOUT_SECS": func(val string) {
-			cp.ObserveNoResponseTimeoutSecs = mustInt(val)
-		},
-	}
-	hasChanges := false
-	for name, apply := range envs {
-		val := os.Getenv(name)
-		if val == "" {
-			continue
-		}
-		apply(val)
-		hasChanges = true
-	}
-	if hasChanges {
-		log.Printf("detected one or more LB_ env vars\n")
-		log.Printf("new config: %+v", cp)
-		mobile.SetParams(cp)
-	}
-}
+// noDictionaryHeader makes the request and response bodies plain CBOR, without the dictionary, for debugging
+const noDictionaryHeader = "X-LB-No-Dictionary"
+
+// dictionaryVersionHeader is the dictionary version the response body was encoded with, if -dictionary-header is set
+const dictionaryVersionHeader = "X-LB-Dict-Version"
 
 func handler(w http.ResponseWriter, req *http.Request) {
+	method, err := effectiveMethod(req)
+	if err != nil {
+		logrus.WithError(err).Warnf("Rejecting %s %s", req.Method, req.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"errcode":"PROXY","error":"X-HTTP-Method-Override is not allowed on this request"}`))
+		return
+	}
+	req.Method = method
+	req.Header.Del(methodOverrideHeader)
 	if mediaUrlRegexp.MatchString(req.URL.Path) {
 		req.Host = homeserverRoot.Host
 		mediaProxy.ServeHTTP(w, req)
@@ -97,9 +107,15 @@ func handler(w http.ResponseWriter, req *http.Request) {
 	reqURL := req.URL
 	reqURL.Host = *homeserverAddr
 	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if wantsEventStream(req) {
+		serveEventStream(w, req, reqURL.String(), token)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	var body string
 	if req.Body != nil {
+		// CoAP has nothing like Expect: 100-continue, so the body is always accepted here. Reading it sends 100 Continue
+		// to clients which are waiting for one.
 		bodyBytes, err := ioutil.ReadAll(req.Body)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
@@ -108,16 +124,57 @@ func handler(w http.ResponseWriter, req *http.Request) {
 		}
 		body = string(bodyBytes)
 	}
-	resp := mobile.SendRequest(
-		req.Method, reqURL.String(), token, body,
-	)
+	if nonConfirmableRegexp != nil && req.Method != "GET" && nonConfirmableRegexp.MatchString(req.URL.Path) {
+		if mobile.SendNonConfirmable(req.Method, reqURL.String(), token, body) {
+			w.WriteHeader(200)
+			w.Write([]byte(`{}`))
+			return
+		}
+		// fallback to a normal request
+	}
+	noDictionary, _ := strconv.ParseBool(req.Header.Get(noDictionaryHeader))
+	start := time.Now()
+	resp := sendRequestWithOptions(req.Method, reqURL.String(), token, body, &mobile.SendOptions{
+		IfMatch:      req.Header.Get("If-Match"),
+		IfNoneMatch:  req.Header.Get("If-None-Match"),
+		NoDictionary: noDictionary,
+		TraceParent:  req.Header.Get("traceparent"),
+	})
+	if took := time.Since(start); *slowRequestThreshold > 0 && took > *slowRequestThreshold && !isLongPoll(req) {
+		logSlowRequest(req.Method, req.URL.Path, took, resp)
+	}
 	if resp == nil {
 		w.WriteHeader(http.StatusBadGateway)
 		w.Write([]byte(`{"errcode":"PROXY","error":"failed to forward request to homeserver"}`))
 		return
 	}
+	if resp.ETag != "" {
+		w.Header().Set("ETag", resp.ETag)
+	}
+	if resp.CacheControl != "" {
+		w.Header().Set("Cache-Control", resp.CacheControl)
+	}
+	if *serverTimingEnabled && resp.Timings != nil {
+		w.Header().Set("Server-Timing", serverTiming(resp.Timings))
+	}
+	if *dictionaryHeaderEnabled && resp.Dictionary != "" {
+		w.Header().Set(dictionaryVersionHeader, resp.Dictionary)
+	}
+	// the body is complete, so HTTP/1.0 clients can use this to detect truncation
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
 	w.WriteHeader(resp.Code)
 	w.Write([]byte(resp.Body))
+	if shadow != nil && shouldShadow(req.Method, reqURL.Path) {
+		go shadow.compare(reqURL.RequestURI(), token, resp)
+	}
+	if resp.Code == 200 && req.Method == "GET" && strings.HasSuffix(reqURL.Path, "/sync") {
+		if prefetcher != nil {
+			go prefetcher.prefetch(resp.Body, token)
+		}
+		if previews != nil {
+			go previews.learn(resp.Body)
+		}
+	}
 }
 
 func main() {
@@ -130,8 +187,53 @@ func main() {
 		ll = logrus.DebugLevel
 	}
 	logrus.SetLevel(ll)
-	setConnParamsFromEnv()
 	flag.Parse()
+	var fc *fileConfig
+	if *configPath != "" {
+		fc, err = loadConfigFile(*configPath, flag.CommandLine)
+		if err != nil {
+			log.Fatalf("invalid --config: %s", err)
+		}
+	}
+	cp := mobile.Params()
+	changed, err := resolveConfig(flag.CommandLine, fc, cp, os.Getenv)
+	if err != nil {
+		log.Fatalf("invalid config: %s", err)
+	}
+	if changed {
+		log.Printf("new config: %+v", cp)
+		if err := mobile.SetParams(cp); err != nil {
+			log.Fatalf("invalid connection params: %s", err)
+		}
+	}
+	if *mockHomeserverEnabled {
+		if *homeserverAddr != "" {
+			log.Fatal("--mock-homeserver cannot be used with --homeserver")
+		}
+		script, err := parseMockScript([]byte(defaultMockScript))
+		if *mockScriptPath != "" {
+			script, err = loadMockScript(*mockScriptPath)
+		}
+		if err != nil {
+			log.Fatalf("invalid --mock-script: %s", err)
+		}
+		addr, _, err := startMockHomeserver(script)
+		if err != nil {
+			log.Fatalf("failed to start mock homeserver: %s", err)
+		}
+		log.Printf("Serving a mock homeserver on %v, log in as %s", addr, script.UserID)
+		*homeserverAddr = addr
+		// the mock's certificate is self-signed
+		cp := mobile.Params()
+		cp.InsecureSkipVerify = true
+		if err := mobile.SetParams(cp); err != nil {
+			log.Fatalf("invalid connection params: %s", err)
+		}
+	}
+	if err := checkInsecure(mobile.Params(), *refuseInsecure, nil); err != nil {
+		log.Fatal(err)
+	}
+	checkExchangeWindow(mobile.Params())
 	if *homeserverAddr == "" {
 		log.Fatal("--homeserver must be set")
 	}
@@ -139,26 +241,134 @@ func main() {
 		log.Fatal("--http-bind-addr must be set")
 	}
 
+	if *selfTest || *selfTestJSON {
+		if !runSelfTest(os.Stdout, "https://"+*homeserverAddr, *selfTestToken, *selfTestJSON) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *nonConfirmablePaths != "" {
+		nonConfirmableRegexp, err = regexp.Compile(*nonConfirmablePaths)
+		if err != nil {
+			log.Fatalf("--non-confirmable-paths is not a valid regular expression: %v", err)
+		}
+	}
+
 	homeserverRootHost, _, err := net.SplitHostPort(*homeserverAddr)
 	if err != nil {
 		log.Fatalf("`%s` not a valid host: %v", *homeserverAddr, err)
 	}
-	homeserverRoot, err := url.Parse("https://" + homeserverRootHost)
+	homeserverRoot, err = url.Parse("https://" + homeserverRootHost)
 	if err != nil {
 		log.Fatalf("`https://%s` not a valid URL: %v", homeserverRootHost, err)
 	}
+	var policies cachePolicies
+	if fc != nil {
+		policies = fc.CachePolicies
+	}
 	mediaProxy = httputil.NewSingleHostReverseProxy(homeserverRoot)
+	if *mediaCacheBytes > 0 {
+		mc := &mediaCache{
+			cache:    lb.NewLRUCache(*mediaCacheBytes),
+			next:     mediaProxy,
+			ttl:      *mediaCacheTTL,
+			policies: policies,
+			maxSize:  *mediaCacheBytes,
+		}
+		mediaProxy = mc
+		if *mediaPrefetchThumbnails > 0 {
+			width, height, err := parseThumbnailSize(*mediaPrefetchThumbnailSize)
+			if err != nil {
+				log.Fatalf("invalid --media-prefetch-thumbnail-size: %s", err)
+			}
+			prefetcher = newMediaPrefetcher(mc, homeserverRoot.Host, *mediaPrefetchThumbnails, width, height)
+		}
+	} else if *mediaPrefetchThumbnails > 0 {
+		log.Fatal("--media-prefetch-thumbnails requires --media-cache-bytes")
+	}
+	if *mediaBlurhashPreviews {
+		previews = newMediaPreviews(mediaProxy)
+		mediaProxy = previews
+	}
+	// wrapped outside the cache so truncated downloads abort before they can be cached, and outside the previews so
+	// the trailer covers the whole progressive response
+	mediaProxy = streamStatusHandler(mediaProxy)
 
-	http.HandleFunc("/", handler)
+	if *shadowHTTPSEnabled {
+		log.Printf("Shadowing GET requests over HTTPS to %v", homeserverRoot)
+		shadow = &shadowHTTPS{
+			client:  &http.Client{Timeout: time.Minute},
+			baseURL: homeserverRoot.String(),
+		}
+	}
+
+	var h http.Handler = http.HandlerFunc(handler)
+	if len(policies) > 0 && *responseCacheBytes > 0 {
+		h = &responseCache{
+			cache:    lb.NewLRUCache(*responseCacheBytes),
+			next:     h,
+			policies: policies,
+			maxSize:  *responseCacheBytes,
+		}
+	}
+	if *filterCacheBytes > 0 {
+		h = &filterCache{
+			cache:   lb.NewLRUCache(*filterCacheBytes),
+			next:    h,
+			maxSize: *filterCacheBytes,
+		}
+	}
+	if *capabilitiesCacheTTL > 0 {
+		h = &capabilitiesCache{
+			cache: lb.NewLRUCache(capabilitiesCacheBytes),
+			next:  h,
+			ttl:   *capabilitiesCacheTTL,
+		}
+	}
+	if *messagesPrefetchPages > 0 {
+		h = &messagesPrefetcher{
+			cache:   lb.NewLRUCache(*messagesCacheBytes),
+			next:    h,
+			pages:   *messagesPrefetchPages,
+			ttl:     messagesCacheTTL,
+			maxSize: *messagesCacheBytes,
+		}
+	}
+	http.Handle("/", h)
 
-	srv := http.Server{
-		ReadTimeout:       5 * time.Minute,
-		WriteTimeout:      5 * time.Minute,
-		IdleTimeout:       5 * time.Minute,
-		ReadHeaderTimeout: 5 * time.Minute,
-	}
-	srv.Addr = *httpBindAddr
-	srv.Handler = http.DefaultServeMux
+	if *adminAddr != "" {
+		if *adminToken == "" {
+			log.Fatal("--admin-addr needs --admin-token")
+		}
+		go func() {
+			log.Printf("Serving admin endpoints on %v", *adminAddr)
+			if err := http.ListenAndServe(*adminAddr, adminHandler(*adminToken)); err != nil {
+				log.Fatalf("admin ListenAndServe: %v", err)
+			}
+		}()
+	}
+
+	srv := newHTTPServer(*httpBindAddr, http.DefaultServeMux, *httpIdleTimeout, *httpKeepAlive)
+	if *connectHosts != "" {
+		hosts, err := parseConnectHosts(*connectHosts, *homeserverAddr)
+		if err != nil {
+			log.Fatalf("invalid --connect-hosts: %s", err)
+		}
+		p := &connectProxy{
+			hosts:       hosts,
+			next:        http.DefaultServeMux,
+			idleTimeout: srv.IdleTimeout,
+		}
+		if *connectCert != "" || *connectKey != "" {
+			cert, err := tls.LoadX509KeyPair(*connectCert, *connectKey)
+			if err != nil {
+				log.Fatalf("invalid --connect-cert or --connect-key: %s", err)
+			}
+			p.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		srv.Handler = p
+	}
 	log.Printf("Listening on %v forwarding to %v", *httpBindAddr, *homeserverAddr)
 	if err := srv.ListenAndServe(); err != http.ErrServerClosed && err != nil {
 		log.Fatalf("ListenAndServe: %v", err)
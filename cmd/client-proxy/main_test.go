@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/lb/mobile"
+)
+
+func TestHandlerSendOptions(t *testing.T) {
+	var got mobile.SendOptions
+	oldSend, oldHomeserverAddr := sendRequestWithOptions, *homeserverAddr
+	sendRequestWithOptions = func(method, hsURL, token, body string, opts *mobile.SendOptions) *mobile.Response {
+		got = *opts
+		return &mobile.Response{Code: 200, Body: `{}`}
+	}
+	*homeserverAddr = "example.com:8008"
+	t.Cleanup(func() {
+		sendRequestWithOptions, *homeserverAddr = oldSend, oldHomeserverAddr
+	})
+
+	testCases := []struct {
+		name   string
+		header map[string]string
+		want   mobile.SendOptions
+	}{
+		{name: "no headers"},
+		{
+			name:   "conditions",
+			header: map[string]string{"If-Match": `"a"`, "If-None-Match": `"b"`},
+			want:   mobile.SendOptions{IfMatch: `"a"`, IfNoneMatch: `"b"`},
+		},
+		{name: "no dictionary", header: map[string]string{"X-LB-No-Dictionary": "1"}, want: mobile.SendOptions{NoDictionary: true}},
+		{name: "dictionary", header: map[string]string{"X-LB-No-Dictionary": "false"}},
+		{
+			name:   "trace",
+			header: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			want:   mobile.SendOptions{TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/_matrix/client/versions", nil)
+			for k, v := range tc.header {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+			if w.Code != 200 {
+				t.Fatalf("got HTTP %d: %s", w.Code, w.Body.String())
+			}
+			if got != tc.want {
+				t.Errorf("got options %+v want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandlerDictionaryVersion(t *testing.T) {
+	var resp *mobile.Response
+	oldSend, oldHomeserverAddr, oldEnabled := sendRequestWithOptions, *homeserverAddr, *dictionaryHeaderEnabled
+	sendRequestWithOptions = func(method, hsURL, token, body string, opts *mobile.SendOptions) *mobile.Response {
+		return resp
+	}
+	*homeserverAddr = "example.com:8008"
+	t.Cleanup(func() {
+		sendRequestWithOptions, *homeserverAddr, *dictionaryHeaderEnabled = oldSend, oldHomeserverAddr, oldEnabled
+	})
+	testCases := []struct {
+		enabled    bool
+		dictionary string
+		want       string
+	}{
+		{enabled: true, dictionary: "v2", want: "v2"},
+		{enabled: true, dictionary: "none", want: "none"},
+		{enabled: true, dictionary: ""},
+		{enabled: false, dictionary: "v1"},
+	}
+	for _, tc := range testCases {
+		*dictionaryHeaderEnabled = tc.enabled
+		resp = &mobile.Response{Code: 200, Body: `{}`, Dictionary: tc.dictionary}
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/_matrix/client/versions", nil))
+		if got := w.Header().Get("X-LB-Dict-Version"); got != tc.want {
+			t.Errorf("enabled=%v Dictionary %q: got X-LB-Dict-Version %q want %q", tc.enabled, tc.dictionary, got, tc.want)
+		}
+	}
+}
+
+func TestHandlerCacheControl(t *testing.T) {
+	var resp *mobile.Response
+	oldSend, oldHomeserverAddr := sendRequestWithOptions, *homeserverAddr
+	sendRequestWithOptions = func(method, hsURL, token, body string, opts *mobile.SendOptions) *mobile.Response {
+		return resp
+	}
+	*homeserverAddr = "example.com:8008"
+	t.Cleanup(func() {
+		sendRequestWithOptions, *homeserverAddr = oldSend, oldHomeserverAddr
+	})
+	for cacheControl, want := range map[string]string{
+		"max-age=3600": "max-age=3600",
+		"max-age=0":    "max-age=0",
+		"":             "",
+	} {
+		resp = &mobile.Response{Code: 200, Body: `{}`, CacheControl: cacheControl}
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/.well-known/matrix/client", nil))
+		if got := w.Header().Get("Cache-Control"); got != want {
+			t.Errorf("CacheControl %q: got Cache-Control %q want %q", cacheControl, got, want)
+		}
+	}
+}
+
+func TestHandlerContentLength(t *testing.T) {
+	oldSend, oldHomeserverAddr, oldMediaProxy, oldHomeserverRoot := sendRequestWithOptions, *homeserverAddr, mediaProxy, homeserverRoot
+	sendRequestWithOptions = func(method, hsURL, token, body string, opts *mobile.SendOptions) *mobile.Response {
+		return &mobile.Response{Code: 200, Body: `{"versions":["r0.6.1"]}`}
+	}
+	*homeserverAddr = "example.com:8008"
+	homeserverRoot = &url.URL{Scheme: "https", Host: "example.com:8008"}
+	mediaProxy = streamStatusHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("media"))
+	}))
+	t.Cleanup(func() {
+		sendRequestWithOptions, *homeserverAddr, mediaProxy, homeserverRoot = oldSend, oldHomeserverAddr, oldMediaProxy, oldHomeserverRoot
+	})
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	defer srv.Close()
+
+	// buffered responses know their length, so must not be sent chunked
+	res, err := http.Get(srv.URL + "/_matrix/client/versions")
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.ContentLength != int64(len(`{"versions":["r0.6.1"]}`)) {
+		t.Errorf("got Content-Length %d want %d", res.ContentLength, len(`{"versions":["r0.6.1"]}`))
+	}
+	if len(res.Trailer) != 0 {
+		t.Errorf("buffered response announced trailers: %v", res.Trailer)
+	}
+
+	// streamed media still says whether the body is complete
+	res, err = http.Get(srv.URL + "/_matrix/client/v1/media/download/example.com/abc")
+	if err != nil {
+		t.Fatalf("GET media failed: %s", err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if got := res.Trailer.Get(streamStatusTrailer); got != streamStatusOK {
+		t.Errorf("got media %s trailer %q want %q", streamStatusTrailer, got, streamStatusOK)
+	}
+}
+
+// TestHandlerExpectContinue checks uploads from clients which wait for 100 Continue do not hang, whether they are sent
+// over CoAP or proxied to the homeserver, which decides whether to accept the body
+func TestHandlerExpectContinue(t *testing.T) {
+	oldSend, oldHomeserverAddr, oldMediaProxy, oldHomeserverRoot := sendRequestWithOptions, *homeserverAddr, mediaProxy, homeserverRoot
+	sendRequestWithOptions = func(method, hsURL, token, body string, opts *mobile.SendOptions) *mobile.Response {
+		return &mobile.Response{Code: 200, Body: strconv.Itoa(len(body))}
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/_matrix/client/v1/media/too_large" {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write([]byte(strconv.Itoa(len(body))))
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("cannot parse upstream URL: %s", err)
+	}
+	*homeserverAddr = "example.com:8008"
+	homeserverRoot = upstreamURL
+	mediaProxy = streamStatusHandler(httputil.NewSingleHostReverseProxy(upstreamURL))
+	t.Cleanup(func() {
+		sendRequestWithOptions, *homeserverAddr, mediaProxy, homeserverRoot = oldSend, oldHomeserverAddr, oldMediaProxy, oldHomeserverRoot
+	})
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	defer srv.Close()
+	// long enough that the test times out if the client never gets 100 Continue
+	transport := &http.Transport{ExpectContinueTimeout: time.Minute}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	testCases := []struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{path: "/_matrix/media/v3/upload", wantCode: 200, wantBody: "100000"},
+		{path: "/_matrix/client/v1/media/upload", wantCode: 200, wantBody: "100000"},
+		{path: "/_matrix/client/v1/media/too_large", wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range testCases {
+		req, err := http.NewRequest("POST", srv.URL+tc.path, bytes.NewReader(make([]byte, 100000)))
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		req.Header.Set("Expect", "100-continue")
+		start := time.Now()
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: upload failed: %s", tc.path, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tc.wantCode || string(body) != tc.wantBody {
+			t.Errorf("%s: got HTTP %d %q want HTTP %d %q", tc.path, res.StatusCode, body, tc.wantCode, tc.wantBody)
+		}
+		if took := time.Since(start); took > 5*time.Second {
+			t.Errorf("%s: upload took %v", tc.path, took)
+		}
+	}
+}
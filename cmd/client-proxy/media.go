@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/lb"
+)
+
+// Headers which are stored alongside cached media
+var mediaCacheHeaders = []string{"Content-Type", "Content-Disposition", "Content-Security-Policy", "Cache-Control", "ETag"}
+
+// mediaCache is an http.Handler which caches successful GET responses from next, serving Range requests for cached
+// media from the cache. Range requests for uncached media are passed to next and not cached. Media is immutable, so
+// entries only expire to bound how long stale deletions are served. The cache key is the request path and query:
+// this proxy sits alongside a single client, so responses are not separated by access token. Paths which match one
+// of the policies are cached as it says instead.
+type mediaCache struct {
+	cache    lb.Cache
+	next     http.Handler
+	ttl      time.Duration
+	policies cachePolicies
+	// responses larger than this are never cached
+	maxSize int64
+	// optional: called with the cache key whenever a response is served from the cache
+	onHit func(key string)
+}
+
+// mediaCacheKey returns the cache key for a media URL. Query parameters are sorted, so thumbnails requested
+// with the same parameters in a different order are the same entry.
+func mediaCacheKey(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.EscapedPath()
+	}
+	return u.EscapedPath() + "?" + u.Query().Encode()
+}
+
+// key returns the cache key of a media request
+func (m *mediaCache) key(req *http.Request) string {
+	if policy := m.policies.match(req.URL.Path); policy != nil {
+		return policy.key(req, mediaCacheKey(req.URL))
+	}
+	return mediaCacheKey(req.URL)
+}
+
+func (m *mediaCache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	policy := m.policies.match(req.URL.Path)
+	if (policy == nil && req.Method != "GET") || (policy != nil && !policy.cacheable(req.Method)) {
+		m.next.ServeHTTP(w, req)
+		return
+	}
+	key := m.key(req)
+	if data, ok := m.cache.Get(key); ok {
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+		if err == nil {
+			defer res.Body.Close()
+			if m.onHit != nil {
+				m.onHit(key)
+			}
+			for k, v := range res.Header {
+				w.Header()[k] = v
+			}
+			if req.Header.Get("Range") != "" {
+				// ranges of cached media, e.g a resumed download, are served from the cache too
+				body, err := ioutil.ReadAll(res.Body)
+				if err == nil {
+					http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(body))
+					return
+				}
+			}
+			w.WriteHeader(res.StatusCode)
+			io.Copy(w, res.Body)
+			return
+		}
+		// corrupt entry, refetch it
+		m.cache.Delete(key)
+	}
+	bw := &bufferingWriter{
+		ResponseWriter: w,
+		maxSize:        m.maxSize,
+	}
+	m.next.ServeHTTP(bw, req)
+	if bw.statusCode != http.StatusOK || bw.overflowed {
+		return
+	}
+	ttl, ok := cacheTTL(w.Header(), m.ttl)
+	if policy != nil {
+		ttl, ok = policy.ttl(w.Header())
+	}
+	if !ok {
+		return
+	}
+	data, err := encodeCachedResponse(w.Header(), mediaCacheHeaders, &bw.buf)
+	if err != nil {
+		return
+	}
+	m.cache.Set(key, data, ttl)
+}
+
+// encodeCachedResponse returns a 200 OK response with body and the headers of h which are listed, to be cached
+func encodeCachedResponse(h http.Header, headers []string, body *bytes.Buffer) ([]byte, error) {
+	res := http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(body.Len()),
+		Body:          ioutil.NopCloser(body),
+	}
+	for _, k := range headers {
+		if v := h.Get(k); v != "" {
+			res.Header.Set(k, v)
+		}
+	}
+	var data bytes.Buffer
+	if err := res.Write(&data); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// serveCachedResponse writes a response from encodeCachedResponse to w. Returns false if data is not a response, in
+// which case nothing has been written.
+func serveCachedResponse(w http.ResponseWriter, req *http.Request, data []byte) bool {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+	for k, v := range res.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+	return true
+}
+
+// cacheTTL returns how long a response with the headers h can be cached for, which is at most ttl, or false if it
+// must not be cached. A ttl of 0 is no expiry, so the response's max-age or Expires is used if it has one.
+func cacheTTL(h http.Header, ttl time.Duration) (time.Duration, bool) {
+	maxAge, ok := lb.ResponseMaxAge(h)
+	if !ok {
+		return ttl, true
+	}
+	if maxAge == 0 {
+		return 0, false
+	}
+	if d := time.Duration(maxAge) * time.Second; ttl == 0 || d < ttl {
+		return d, true
+	}
+	return ttl, true
+}
+
+// bufferingWriter writes through to the underlying http.ResponseWriter, keeping a copy of up to maxSize bytes
+type bufferingWriter struct {
+	http.ResponseWriter
+	maxSize    int64
+	statusCode int
+	buf        bytes.Buffer
+	overflowed bool
+}
+
+func (b *bufferingWriter) WriteHeader(statusCode int) {
+	if b.statusCode == 0 {
+		b.statusCode = statusCode
+	}
+	b.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (b *bufferingWriter) Write(data []byte) (int, error) {
+	if b.statusCode == 0 {
+		b.statusCode = http.StatusOK
+	}
+	if !b.overflowed {
+		if int64(b.buf.Len()+len(data)) > b.maxSize {
+			b.overflowed = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(data)
+		}
+	}
+	return b.ResponseWriter.Write(data)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockCache records calls made to it
+type mockCache struct {
+	data map[string][]byte
+	ttls map[string]time.Duration
+	gets int
+}
+
+func newMockCache() *mockCache {
+	return &mockCache{
+		data: make(map[string][]byte),
+		ttls: make(map[string]time.Duration),
+	}
+}
+
+func (c *mockCache) Get(key string) ([]byte, bool) {
+	c.gets++
+	v, ok := c.data[key]
+	return v, ok
+}
+
+func (c *mockCache) Set(key string, value []byte, ttl time.Duration) {
+	c.data[key] = value
+	c.ttls[key] = ttl
+}
+
+func (c *mockCache) Delete(key string) {
+	delete(c.data, key)
+}
+
+func TestMediaCache(t *testing.T) {
+	hits := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits++
+		switch req.URL.Path {
+		case "/_matrix/client/v1/media/download/example.com/abc":
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Content-Disposition", "inline; filename=cat.png")
+			w.WriteHeader(200)
+			w.Write([]byte("PNGDATA"))
+		case "/_matrix/client/v1/media/download/example.com/big":
+			w.Write([]byte("this is larger than the max size"))
+		default:
+			w.WriteHeader(404)
+		}
+	})
+	cache := newMockCache()
+	mc := &mediaCache{
+		cache:   cache,
+		next:    next,
+		ttl:     time.Hour,
+		maxSize: 16,
+	}
+	do := func(method, path string) *http.Response {
+		w := httptest.NewRecorder()
+		mc.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w.Result()
+	}
+
+	// miss then hit
+	for i := 0; i < 2; i++ {
+		res := do("GET", "/_matrix/client/v1/media/download/example.com/abc")
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != 200 || string(body) != "PNGDATA" {
+			t.Fatalf("request %d: got %d %s", i, res.StatusCode, string(body))
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "image/png" {
+			t.Errorf("request %d: wrong Content-Type: %s", i, ct)
+		}
+		if cd := res.Header.Get("Content-Disposition"); cd != "inline; filename=cat.png" {
+			t.Errorf("request %d: wrong Content-Disposition: %s", i, cd)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("media was fetched %d times, want 1", hits)
+	}
+	if ttl := cache.ttls["/_matrix/client/v1/media/download/example.com/abc"]; ttl != time.Hour {
+		t.Errorf("wrong ttl: %v", ttl)
+	}
+
+	// errors, large responses and non-GET requests are not cached
+	do("GET", "/_matrix/client/v1/media/download/example.com/missing")
+	do("GET", "/_matrix/client/v1/media/download/example.com/big")
+	do("POST", "/_matrix/client/v1/media/download/example.com/abc")
+	if len(cache.data) != 1 {
+		t.Errorf("cache has %d entries, want 1: %v", len(cache.data), cache.data)
+	}
+}
+
+func TestMediaCacheMaxAge(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if cc := req.URL.Query().Get("cc"); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		w.Write([]byte("PNGDATA"))
+	})
+	cache := newMockCache()
+	mc := &mediaCache{
+		cache:   cache,
+		next:    next,
+		ttl:     time.Hour,
+		maxSize: 16,
+	}
+	testCases := []struct {
+		cacheControl string
+		wantTTL      time.Duration // 0 if it must not be cached
+	}{
+		{cacheControl: "", wantTTL: time.Hour},
+		{cacheControl: "public, max-age=60", wantTTL: time.Minute},
+		{cacheControl: "max-age=86400, immutable", wantTTL: time.Hour},
+		{cacheControl: "max-age=0"},
+		{cacheControl: "no-store"},
+		{cacheControl: "private, no-cache"},
+		{cacheControl: "max-age=soon"},
+	}
+	for _, tc := range testCases {
+		u := "/_matrix/client/v1/media/download/example.com/abc?" + url.Values{"cc": {tc.cacheControl}}.Encode()
+		req := httptest.NewRequest("GET", u, nil)
+		key := mediaCacheKey(req.URL)
+		w := httptest.NewRecorder()
+		mc.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%q: got HTTP %d", tc.cacheControl, w.Code)
+		}
+		_, cached := cache.data[key]
+		if tc.wantTTL == 0 {
+			if cached {
+				t.Errorf("%q: response was cached", tc.cacheControl)
+			}
+			continue
+		}
+		if !cached || cache.ttls[key] != tc.wantTTL {
+			t.Errorf("%q: got cached=%v ttl %v want ttl %v", tc.cacheControl, cached, cache.ttls[key], tc.wantTTL)
+		}
+	}
+}
+
+// TestMediaCacheRange checks that Range requests for cached media are served from the cache, and that Range
+// requests for uncached media are passed on without caching the partial response
+func TestMediaCacheRange(t *testing.T) {
+	hits := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader("0123456789"))
+	})
+	cache := newMockCache()
+	mc := &mediaCache{
+		cache:   cache,
+		next:    next,
+		ttl:     time.Hour,
+		maxSize: 1024,
+	}
+	do := func(rangeHeader string) (*http.Response, string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/_matrix/media/r0/download/example.com/abc", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		mc.ServeHTTP(w, req)
+		res := w.Result()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	res, body := do("bytes=2-4")
+	if res.StatusCode != 206 || body != "234" {
+		t.Fatalf("uncached range: got %d %s want 206 234", res.StatusCode, body)
+	}
+	if len(cache.data) != 0 {
+		t.Errorf("partial response was cached: %v", cache.data)
+	}
+	do("")
+	for _, tc := range []struct {
+		rangeHeader  string
+		wantCode     int
+		wantBody     string
+		contentRange string
+	}{
+		{rangeHeader: "bytes=2-4", wantCode: 206, wantBody: "234", contentRange: "bytes 2-4/10"},
+		{rangeHeader: "bytes=8-", wantCode: 206, wantBody: "89", contentRange: "bytes 8-9/10"},
+		{rangeHeader: "", wantCode: 200, wantBody: "0123456789"},
+	} {
+		res, body = do(tc.rangeHeader)
+		if res.StatusCode != tc.wantCode || body != tc.wantBody {
+			t.Errorf("cached range %q: got %d %s want %d %s", tc.rangeHeader, res.StatusCode, body, tc.wantCode, tc.wantBody)
+		}
+		if got := res.Header.Get("Content-Range"); got != tc.contentRange {
+			t.Errorf("cached range %q: got Content-Range %q want %q", tc.rangeHeader, got, tc.contentRange)
+		}
+	}
+	if hits != 2 {
+		t.Errorf("media was fetched %d times, want 2", hits)
+	}
+}
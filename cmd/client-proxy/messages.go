@@ -0,0 +1,167 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/lb"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// messagesPathRegexp matches GET /rooms/{roomId}/messages
+var messagesPathRegexp = regexp.MustCompile(`^/_matrix/client/(r0|v3)/rooms/[^/]+/messages$`)
+
+// messagesPrefetchStats are served at /debug/vars
+var messagesPrefetchStats = expvar.NewMap("messages_prefetch")
+
+// How long prefetched pages are cached for. History rarely changes, but redactions and edits do change it.
+const messagesCacheTTL = 5 * time.Minute
+
+// messagesPrefetcher is an http.Handler which fetches the next pages of a room's history into a cache after a page
+// of /messages is returned, using its end token, so scrolling back does not wait for the network. It is bounded:
+// at most pages pages ahead of the page the client fetched are prefetched, and a page which is not in the cache or
+// any request which is not a GET cancels prefetching, so it never competes with what the user is doing. A cached
+// page is only served to the access token which fetched it, as history depends on what the user can see.
+type messagesPrefetcher struct {
+	cache lb.Cache
+	next  http.Handler
+	// the max number of pages to fetch ahead
+	pages int
+	ttl   time.Duration
+	// pages larger than this are never cached
+	maxSize int64
+
+	mu sync.Mutex
+	// closed to cancel the running prefetch, nil if there isn't one
+	cancel chan struct{}
+}
+
+func (p *messagesPrefetcher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		p.stop()
+		p.next.ServeHTTP(w, req)
+		return
+	}
+	if !messagesPathRegexp.MatchString(req.URL.Path) {
+		p.next.ServeHTTP(w, req)
+		return
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	// copied before next changes the request's URL
+	u := &url.URL{Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+	key := messagesCacheKey(token, u)
+	page, ok := p.cache.Get(key)
+	if ok {
+		messagesPrefetchStats.Add("hits", 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(page)
+	} else {
+		// the user has jumped somewhere else in history, or into another room
+		p.stop()
+		bw := &bufferingWriter{
+			ResponseWriter: w,
+			maxSize:        p.maxSize,
+		}
+		p.next.ServeHTTP(bw, req)
+		if bw.statusCode != http.StatusOK || bw.overflowed {
+			return
+		}
+		page = bw.buf.Bytes()
+	}
+	// after a hit, the prefetch which cached the page may still be fetching the pages after it
+	if cancel, ok := p.start(); ok {
+		go p.prefetch(cancel, token, u, page)
+	}
+}
+
+// messagesCacheKey returns the cache key of the page at u, with the query parameters in a fixed order
+func messagesCacheKey(token string, u *url.URL) string {
+	return token + " " + u.Path + "?" + u.Query().Encode()
+}
+
+// start returns the channel which cancels a new prefetch, or false if one is already running
+func (p *messagesPrefetcher) start() (chan struct{}, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		return nil, false
+	}
+	p.cancel = make(chan struct{})
+	return p.cancel, true
+}
+
+// stop cancels the running prefetch, if any. A page which is being fetched is still cached, but no more are fetched.
+func (p *messagesPrefetcher) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		close(p.cancel)
+		p.cancel = nil
+	}
+}
+
+// prefetch fetches the pages after page, which is the page at u, into the cache until pages have been fetched, there
+// is no more history or cancel is closed. It blocks until then, so callers should run it in the background.
+func (p *messagesPrefetcher) prefetch(cancel chan struct{}, token string, u *url.URL, page []byte) {
+	defer func() {
+		p.mu.Lock()
+		if p.cancel == cancel {
+			p.cancel = nil
+		}
+		p.mu.Unlock()
+	}()
+	for i := 0; i < p.pages; i++ {
+		end := gjson.GetBytes(page, "end").String()
+		// there is no more history when the end token is missing, or the chunk is empty
+		if end == "" || len(gjson.GetBytes(page, "chunk").Array()) == 0 {
+			return
+		}
+		q := u.Query()
+		q.Set("from", end)
+		u = &url.URL{Path: u.Path, RawQuery: q.Encode()}
+		key := messagesCacheKey(token, u)
+		if cached, ok := p.cache.Get(key); ok {
+			page = cached
+			continue
+		}
+		select {
+		case <-cancel:
+			messagesPrefetchStats.Add("cancelled", 1)
+			return
+		default:
+		}
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		bw := &bufferingWriter{
+			ResponseWriter: &discardWriter{header: make(http.Header)},
+			maxSize:        p.maxSize,
+		}
+		p.next.ServeHTTP(bw, req)
+		if bw.statusCode != http.StatusOK || bw.overflowed {
+			logrus.WithField("path", u.Path).Debugf("Failed to prefetch page of history: HTTP %d", bw.statusCode)
+			messagesPrefetchStats.Add("failed", 1)
+			return
+		}
+		page = bw.buf.Bytes()
+		ttl, ok := cacheTTL(bw.Header(), p.ttl)
+		if !ok {
+			return
+		}
+		p.cache.Set(key, page, ttl)
+		messagesPrefetchStats.Add("prefetched", 1)
+	}
+}
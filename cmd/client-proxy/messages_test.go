@@ -0,0 +1,168 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/lb"
+)
+
+func messagesPrefetchStat(name string) int64 {
+	v, ok := messagesPrefetchStats.Get(name).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+// historyServer serves numPages pages of history, recording the from token of every GET
+type historyServer struct {
+	numPages int
+	mu       sync.Mutex
+	fetched  []string
+	// if set, requests for this from token block until it is closed
+	blockFrom string
+	unblock   chan struct{}
+}
+
+func (h *historyServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		return
+	}
+	from := req.URL.Query().Get("from")
+	h.mu.Lock()
+	h.fetched = append(h.fetched, from)
+	block := h.unblock != nil && from == h.blockFrom
+	h.mu.Unlock()
+	if block {
+		<-h.unblock
+	}
+	if req.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(401)
+		return
+	}
+	var n int
+	if from != "" {
+		fmt.Sscanf(from, "t%d", &n)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if n >= h.numPages {
+		w.Write([]byte(`{"chunk":[],"start":"` + from + `"}`))
+		return
+	}
+	w.Write([]byte(fmt.Sprintf(`{"chunk":[{"event_id":"$%d"}],"start":"%s","end":"t%d"}`, n, from, n+1)))
+}
+
+func (h *historyServer) fetchedFrom() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.fetched...)
+}
+
+func waitForFetched(t *testing.T, h *historyServer, want []string) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if reflect.DeepEqual(h.fetchedFrom(), want) {
+			// and make sure nothing more is fetched
+			time.Sleep(50 * time.Millisecond)
+			break
+		}
+	}
+	if got := h.fetchedFrom(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("fetched pages from %v want %v", got, want)
+	}
+}
+
+func getMessages(t *testing.T, p http.Handler, query string) string {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/_matrix/client/v3/rooms/!a:example.com/messages?"+query, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("GET /messages?%s: got HTTP %d", query, w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestMessagesPrefetch(t *testing.T) {
+	h := &historyServer{numPages: 4}
+	p := &messagesPrefetcher{
+		cache:   lb.NewLRUCache(1024 * 1024),
+		next:    h,
+		pages:   2,
+		ttl:     time.Hour,
+		maxSize: 1024,
+	}
+	before := map[string]int64{}
+	for _, name := range []string{"prefetched", "hits"} {
+		before[name] = messagesPrefetchStat(name)
+	}
+
+	getMessages(t, p, "dir=b&limit=1")
+	// the 2 pages after the first are prefetched
+	waitForFetched(t, h, []string{"", "t1", "t2"})
+	if got := messagesPrefetchStat("prefetched") - before["prefetched"]; got != 2 {
+		t.Errorf("prefetched: got %d want 2", got)
+	}
+
+	// the client asks for the next page with its parameters in a different order, which is served from the cache,
+	// then the page after the cached ones is prefetched
+	if got, want := getMessages(t, p, "from=t1&limit=1&dir=b"), `{"chunk":[{"event_id":"$1"}],"start":"t1","end":"t2"}`; got != want {
+		t.Errorf("got page %s want %s", got, want)
+	}
+	waitForFetched(t, h, []string{"", "t1", "t2", "t3"})
+	if got := messagesPrefetchStat("hits") - before["hits"]; got != 1 {
+		t.Errorf("hits: got %d want 1", got)
+	}
+
+	// prefetching stops at the end of history, which is the empty page at t4
+	getMessages(t, p, "dir=b&limit=1&from=t2")
+	getMessages(t, p, "dir=b&limit=1&from=t3")
+	waitForFetched(t, h, []string{"", "t1", "t2", "t3", "t4"})
+	getMessages(t, p, "dir=b&limit=1&from=t4")
+	waitForFetched(t, h, []string{"", "t1", "t2", "t3", "t4"})
+
+	// pages are not served to other users
+	req := httptest.NewRequest("GET", "/_matrix/client/v3/rooms/!a:example.com/messages?dir=b&limit=1&from=t1", nil)
+	req.Header.Set("Authorization", "Bearer other")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	waitForFetched(t, h, []string{"", "t1", "t2", "t3", "t4", "t1"})
+}
+
+func TestMessagesPrefetchCancelled(t *testing.T) {
+	h := &historyServer{numPages: 10, blockFrom: "t1", unblock: make(chan struct{})}
+	p := &messagesPrefetcher{
+		cache:   lb.NewLRUCache(1024 * 1024),
+		next:    h,
+		pages:   5,
+		ttl:     time.Hour,
+		maxSize: 1024,
+	}
+	before := messagesPrefetchStat("cancelled")
+	getMessages(t, p, "dir=b")
+	waitForFetched(t, h, []string{"", "t1"})
+
+	// sending a message is new user activity, so nothing more is fetched after the page being fetched
+	req := httptest.NewRequest("PUT", "/_matrix/client/v3/rooms/!a:example.com/send/m.room.message/1", nil)
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	close(h.unblock)
+	waitForFetched(t, h, []string{"", "t1"})
+	if got := messagesPrefetchStat("cancelled") - before; got != 1 {
+		t.Errorf("cancelled: got %d want 1", got)
+	}
+
+	// the page which was being fetched is still cached, and scrolling back to it starts prefetching again
+	hits := messagesPrefetchStat("hits")
+	getMessages(t, p, "dir=b&from=t1")
+	if got := messagesPrefetchStat("hits") - hits; got != 1 {
+		t.Errorf("hits: got %d want 1", got)
+	}
+	waitForFetched(t, h, []string{"", "t1", "t2", "t3", "t4", "t5", "t6"})
+}
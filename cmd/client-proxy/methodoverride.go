@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// methodOverrideHeader lets clients behind middleboxes which only allow GET and POST send other methods, by
+// POSTing with the method they want in this header
+const methodOverrideHeader = "X-HTTP-Method-Override"
+
+// overrideMethods are the methods the client-server API uses, which are the only ones a request can be overridden to
+var overrideMethods = map[string]bool{
+	"GET":    true,
+	"PUT":    true,
+	"POST":   true,
+	"DELETE": true,
+}
+
+// effectiveMethod returns the method to forward the request with, which is the X-HTTP-Method-Override header if
+// it is set. Returns an error if the override is not allowed.
+func effectiveMethod(req *http.Request) (string, error) {
+	override := req.Header.Get(methodOverrideHeader)
+	if override == "" {
+		return req.Method, nil
+	}
+	// overriding other methods could turn a GET the client expects to be safe into a DELETE
+	if req.Method != "POST" {
+		return "", fmt.Errorf("%s can only be used on POST requests, not %s", methodOverrideHeader, req.Method)
+	}
+	method := strings.ToUpper(strings.TrimSpace(override))
+	if !overrideMethods[method] {
+		return "", fmt.Errorf("%s: method %q is not used by Matrix", methodOverrideHeader, override)
+	}
+	return method, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/lb/mobile"
+)
+
+func TestMethodOverride(t *testing.T) {
+	var gotMethod, gotURL, gotBody string
+	oldSend, oldHomeserverAddr := sendRequestWithOptions, *homeserverAddr
+	sendRequestWithOptions = func(method, hsURL, token, body string, opts *mobile.SendOptions) *mobile.Response {
+		gotMethod, gotURL, gotBody = method, hsURL, body
+		return &mobile.Response{Code: 200, Body: `{}`}
+	}
+	*homeserverAddr = "example.com:8008"
+	t.Cleanup(func() {
+		sendRequestWithOptions, *homeserverAddr = oldSend, oldHomeserverAddr
+	})
+	path := "/_matrix/client/r0/rooms/!a:b/send/m.room.message/txn1"
+
+	testCases := []struct {
+		name       string
+		method     string
+		override   string
+		wantCode   int
+		wantMethod string
+	}{
+		{name: "POST overridden to PUT", method: "POST", override: "PUT", wantCode: 200, wantMethod: "PUT"},
+		{name: "lower case override", method: "POST", override: "delete", wantCode: 200, wantMethod: "DELETE"},
+		{name: "no override", method: "POST", wantCode: 200, wantMethod: "POST"},
+		{name: "method which Matrix does not use", method: "POST", override: "TRACE", wantCode: 400},
+		{name: "override on a GET", method: "GET", override: "DELETE", wantCode: 400},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotMethod = ""
+			req := httptest.NewRequest(tc.method, path, strings.NewReader(`{"body":"hi"}`))
+			if tc.override != "" {
+				req.Header.Set("X-HTTP-Method-Override", tc.override)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+			if w.Code != tc.wantCode {
+				t.Fatalf("got HTTP %d want %d: %s", w.Code, tc.wantCode, w.Body.String())
+			}
+			if gotMethod != tc.wantMethod {
+				t.Errorf("forwarded as %q want %q", gotMethod, tc.wantMethod)
+			}
+			if tc.wantCode == 200 && (gotURL != "//example.com:8008"+path || gotBody != `{"body":"hi"}`) {
+				t.Errorf("forwarded %s with body %s", gotURL, gotBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	coapnet "github.com/matrix-org/go-coap/v2/net"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/lb"
+	piondtls "github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+)
+
+// mockScript is what the mock homeserver serves, loaded from --mock-script
+type mockScript struct {
+	// The user every login is for, and the access token they are given
+	UserID      string `json:"user_id"`
+	AccessToken string `json:"access_token"`
+	// The /sync responses to serve in order, without next_batch, which the mock sets. Once they have all been served,
+	// /sync waits for its timeout then returns nothing new, as a quiet homeserver does.
+	Sync []json.RawMessage `json:"sync"`
+	// How long each /sync with a since token waits before returning the next response, so a demo shows events
+	// arriving over time rather than all at once
+	SyncDelayMS int `json:"sync_delay_ms"`
+}
+
+// The longest a /sync waits once the script has run out, whatever its timeout
+const mockMaxSyncWait = 30 * time.Second
+
+// defaultMockScript is served when --mock-script is not set: a room with a couple of messages, then another message
+// a few seconds later
+const defaultMockScript = `{
+	"user_id": "@demo:localhost",
+	"access_token": "mock_access_token",
+	"sync_delay_ms": 5000,
+	"sync": [
+		{"rooms": {"join": {"!demo:localhost": {
+			"state": {"events": [
+				{"type": "m.room.create", "state_key": "", "sender": "@demo:localhost", "event_id": "$create", "origin_server_ts": 1600000000000, "content": {"creator": "@demo:localhost"}},
+				{"type": "m.room.member", "state_key": "@demo:localhost", "sender": "@demo:localhost", "event_id": "$join", "origin_server_ts": 1600000000001, "content": {"membership": "join"}},
+				{"type": "m.room.name", "state_key": "", "sender": "@demo:localhost", "event_id": "$name", "origin_server_ts": 1600000000002, "content": {"name": "Low bandwidth demo"}}
+			]},
+			"timeline": {"events": [
+				{"type": "m.room.message", "sender": "@demo:localhost", "event_id": "$msg1", "origin_server_ts": 1600000000003, "content": {"msgtype": "m.text", "body": "Hello over CoAP!"}},
+				{"type": "m.room.message", "sender": "@demo:localhost", "event_id": "$msg2", "origin_server_ts": 1600000000004, "content": {"msgtype": "m.text", "body": "This request and response were CBOR encoded."}}
+			], "limited": false}
+		}}}},
+		{"rooms": {"join": {"!demo:localhost": {
+			"timeline": {"events": [
+				{"type": "m.room.message", "sender": "@demo:localhost", "event_id": "$msg3", "origin_server_ts": 1600000005000, "content": {"msgtype": "m.text", "body": "This one arrived a little later."}}
+			], "limited": false}
+		}}}}
+	]
+}`
+
+// loadMockScript reads a mock script, which is JSON in the same form as defaultMockScript
+func loadMockScript(path string) (*mockScript, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	script, err := parseMockScript(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return script, nil
+}
+
+func parseMockScript(data []byte) (*mockScript, error) {
+	var script mockScript
+	if err := json.Unmarshal(data, &script); err != nil {
+		return nil, err
+	}
+	if script.UserID == "" {
+		script.UserID = "@demo:localhost"
+	}
+	if script.AccessToken == "" {
+		script.AccessToken = "mock_access_token"
+	}
+	for i, res := range script.Sync {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(res, &obj); err != nil {
+			return nil, fmt.Errorf("sync response %d is not a JSON object: %w", i, err)
+		}
+	}
+	return &script, nil
+}
+
+// mockHomeserver is an http.Handler serving the endpoints a client needs to log in and sync from a mockScript
+type mockHomeserver struct {
+	script *mockScript
+
+	mu          sync.Mutex
+	accountData map[string]json.RawMessage // type -> content
+}
+
+func (m *mockHomeserver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	if path == "/_matrix/client/versions" {
+		writeMockJSON(w, 200, map[string]interface{}{"versions": []string{"r0.6.1", "v1.1"}})
+		return
+	}
+	// clients use whichever of r0 and v3 they support
+	for _, prefix := range []string{"/_matrix/client/r0", "/_matrix/client/v3"} {
+		if strings.HasPrefix(path, prefix+"/") {
+			path = strings.TrimPrefix(path, prefix)
+			break
+		}
+	}
+	switch {
+	case path == "/login" && req.Method == "GET":
+		writeMockJSON(w, 200, map[string]interface{}{"flows": []map[string]string{{"type": "m.login.password"}}})
+		return
+	case path == "/login" && req.Method == "POST":
+		// any credentials will do
+		writeMockJSON(w, 200, map[string]interface{}{
+			"user_id":      m.script.UserID,
+			"access_token": m.script.AccessToken,
+			"device_id":    "MOCKDEVICE",
+		})
+		return
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		writeMockJSON(w, 401, map[string]string{"errcode": "M_MISSING_TOKEN", "error": "Missing access token"})
+		return
+	}
+	if token != m.script.AccessToken {
+		writeMockJSON(w, 401, map[string]string{"errcode": "M_UNKNOWN_TOKEN", "error": "Unknown access token"})
+		return
+	}
+	switch {
+	case path == "/account/whoami" && req.Method == "GET":
+		writeMockJSON(w, 200, map[string]string{"user_id": m.script.UserID, "device_id": "MOCKDEVICE"})
+	case path == "/sync" && req.Method == "GET":
+		m.serveSync(w, req)
+	case strings.HasPrefix(path, "/user/"+m.script.UserID+"/account_data/"):
+		m.serveAccountData(w, req, strings.TrimPrefix(path, "/user/"+m.script.UserID+"/account_data/"))
+	default:
+		writeMockJSON(w, 404, map[string]string{"errcode": "M_UNRECOGNIZED", "error": "The mock homeserver does not serve this endpoint"})
+	}
+}
+
+// serveAccountData stores and returns the user's global account data, which is kept in memory
+func (m *mockHomeserver) serveAccountData(w http.ResponseWriter, req *http.Request, eventType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch req.Method {
+	case "PUT":
+		var content map[string]json.RawMessage
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			writeMockJSON(w, 400, map[string]string{"errcode": "M_NOT_JSON", "error": "Content is not a JSON object"})
+			return
+		}
+		if m.accountData == nil {
+			m.accountData = make(map[string]json.RawMessage)
+		}
+		m.accountData[eventType], _ = json.Marshal(content)
+		writeMockJSON(w, 200, map[string]string{})
+	case "GET":
+		content, ok := m.accountData[eventType]
+		if !ok {
+			writeMockJSON(w, 404, map[string]string{"errcode": "M_NOT_FOUND", "error": "Account data not found"})
+			return
+		}
+		writeMockJSON(w, 200, content)
+	default:
+		writeMockJSON(w, 405, map[string]string{"errcode": "M_UNRECOGNIZED", "error": "Method not allowed"})
+	}
+}
+
+// serveSync returns the script's /sync response after the one the since token is for. The tokens are the number of
+// responses served so far, e.g mock_1 after the first.
+func (m *mockHomeserver) serveSync(w http.ResponseWriter, req *http.Request) {
+	next := 0
+	since := req.URL.Query().Get("since")
+	if n, err := strconv.Atoi(strings.TrimPrefix(since, "mock_")); err == nil && n > 0 {
+		next = n
+	}
+	wait := time.Duration(0)
+	if since != "" {
+		wait = time.Duration(m.script.SyncDelayMS) * time.Millisecond
+	}
+	if next >= len(m.script.Sync) {
+		next = len(m.script.Sync)
+		timeout, _ := strconv.Atoi(req.URL.Query().Get("timeout"))
+		wait = time.Duration(timeout) * time.Millisecond
+		if wait > mockMaxSyncWait {
+			wait = mockMaxSyncWait
+		}
+	}
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return
+		}
+	}
+	res := make(map[string]json.RawMessage)
+	if next < len(m.script.Sync) {
+		// checked when the script was loaded
+		_ = json.Unmarshal(m.script.Sync[next], &res)
+		next++
+	}
+	res["next_batch"], _ = json.Marshal(fmt.Sprintf("mock_%d", next))
+	writeMockJSON(w, 200, res)
+}
+
+func writeMockJSON(w http.ResponseWriter, code int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		code, data = 500, []byte(`{"errcode":"M_UNKNOWN","error":"failed to marshal response"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// startMockHomeserver serves script over CoAP on a local port, with the same CBOR and CoAP handling as cmd/proxy bar block-wise transfers, so
+// requests take the whole low bandwidth path without a real homeserver. Returns the address to use as --homeserver
+// and a function to stop it. The certificate is self-signed, so InsecureSkipVerify must be set to connect.
+func startMockHomeserver(script *mockScript) (string, func(), error) {
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate certificate: %w", err)
+	}
+	l, err := coapnet.NewDTLSListener("udp", "127.0.0.1:0", &piondtls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	codec := lb.NewCBORCodecV1(true)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	handler := lb.CBORToJSONHandler(&mockHomeserver{script: script}, codec, nil)
+	caps := lb.Capabilities{
+		BlockSize:          int(blockwise.SZX1024.Size()),
+		DictionaryVersion:  lb.DictionaryV1,
+		DictionaryVersions: lb.DictionaryVersions,
+		Observe:            true,
+	}
+	s := dtls.NewServer(
+		dtls.WithMux(coapHTTP.CoAPHTTPHandler(
+			lb.CapabilitiesHandler(lb.BatchHandler(handler, codec), codec, caps), lb.NewSyncObservations(handler, coapHTTP.Paths, codec),
+		)),
+		// go-coap sends block-wise messages with message ID 0, so the client can take the first /sync notification
+		// for a duplicate of the registration's ACK and drop it. The script's responses fit in a single message.
+		dtls.WithBlockwise(false, blockwise.SZX1024, 2*time.Minute),
+	)
+	go s.Serve(l)
+	return l.Addr().String(), func() {
+		s.Stop()
+		l.Close()
+	}, nil
+}
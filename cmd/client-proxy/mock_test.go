@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/lb/mobile"
+	"github.com/tidwall/gjson"
+)
+
+// TestMockHomeserver checks that the mock homeserver serves a scripted /sync loaded from a file, through the proxy
+// and over CoAP, after logging in with the script's access token
+func TestMockHomeserver(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"user_id": "@alice:localhost",
+		"access_token": "alice_token",
+		"sync": [
+			{"rooms": {"join": {"!a:localhost": {"timeline": {"events": [{"type": "m.room.message", "event_id": "$1", "content": {"msgtype": "m.text", "body": "first"}}]}}}}},
+			{"rooms": {"join": {"!a:localhost": {"timeline": {"events": [{"type": "m.room.message", "event_id": "$2", "content": {"msgtype": "m.text", "body": "second"}}]}}}}}
+		]
+	}`)
+	script, err := loadMockScript(path)
+	if err != nil {
+		t.Fatalf("loadMockScript: %s", err)
+	}
+	addr, stop, err := startMockHomeserver(script)
+	if err != nil {
+		t.Fatalf("startMockHomeserver: %s", err)
+	}
+	oldParams, oldHomeserverAddr := *mobile.Params(), *homeserverAddr
+	cp := oldParams
+	cp.InsecureSkipVerify = true
+	if err = mobile.SetParams(&cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	*homeserverAddr = addr
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(func() {
+		srv.Close()
+		mobile.SetParams(&oldParams)
+		*homeserverAddr = oldHomeserverAddr
+		stop()
+	})
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	do := func(method, path, token, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+		defer res.Body.Close()
+		resBody, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(resBody)
+	}
+
+	code, body := do("GET", "/_matrix/client/versions", "", "")
+	if code != 200 || !gjson.Get(body, "versions").IsArray() {
+		t.Fatalf("/versions: got %d %s", code, body)
+	}
+	code, body = do("POST", "/_matrix/client/r0/login", "", `{"type":"m.login.password","user":"alice","password":"anything"}`)
+	token := gjson.Get(body, "access_token").Str
+	if code != 200 || token != "alice_token" || gjson.Get(body, "user_id").Str != "@alice:localhost" {
+		t.Fatalf("/login: got %d %s", code, body)
+	}
+	if code, body = do("GET", "/_matrix/client/r0/sync", "wrong_token", ""); code != 401 {
+		t.Errorf("/sync with the wrong token: got %d %s want 401", code, body)
+	}
+
+	testCases := []struct {
+		since         string
+		wantBody      string
+		wantNextBatch string
+	}{
+		{since: "", wantBody: "first", wantNextBatch: "mock_1"},
+		{since: "mock_1", wantBody: "second", wantNextBatch: "mock_2"},
+		// the script has run out, so nothing new until the timeout
+		{since: "mock_2", wantBody: "", wantNextBatch: "mock_2"},
+	}
+	for _, tc := range testCases {
+		code, body = do("GET", "/_matrix/client/r0/sync?timeout=100&since="+tc.since, token, "")
+		if code != 200 {
+			t.Fatalf("/sync since %q: got %d %s", tc.since, code, body)
+		}
+		if got := gjson.Get(body, "next_batch").Str; got != tc.wantNextBatch {
+			t.Errorf("/sync since %q: got next_batch %q want %q", tc.since, got, tc.wantNextBatch)
+		}
+		got := gjson.Get(body, `rooms.join.!a:localhost.timeline.events.0.content.body`).Str
+		if got != tc.wantBody {
+			t.Errorf("/sync since %q: got message %q want %q", tc.since, got, tc.wantBody)
+		}
+	}
+}
+
+func TestParseMockScript(t *testing.T) {
+	if _, err := parseMockScript([]byte(defaultMockScript)); err != nil {
+		t.Errorf("default script: %s", err)
+	}
+	if _, err := parseMockScript([]byte(`{"sync":[{"next_batch":"a"},"not an object"]}`)); err == nil {
+		t.Errorf("parsed a script with a sync response which is not an object")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// prefetchStats are served at /debug/vars
+var prefetchStats = expvar.NewMap("media_prefetch")
+
+// The max number of prefetched thumbnails remembered to count hits. Older ones are still cached, but hits on them
+// are not counted.
+const maxPrefetchedKeys = 1000
+
+// mediaPrefetcher warms the media cache with the thumbnails a client is most likely to fetch after a /sync: those
+// of the newest images in the timeline. It is bounded: at most max thumbnails are fetched per /sync, and a /sync
+// which arrives while thumbnails are still being fetched for a previous one is skipped.
+type mediaPrefetcher struct {
+	media *mediaCache
+	// the Host to send media requests to
+	host string
+	// the max number of thumbnails to fetch per /sync
+	max int
+	// the thumbnail size to fetch, which must be the size the client asks for to be useful
+	width, height int
+	running       chan struct{}
+	mu            sync.Mutex
+	// cache keys of thumbnails which have been prefetched but not yet served
+	prefetched map[string]bool
+}
+
+func newMediaPrefetcher(media *mediaCache, host string, max, width, height int) *mediaPrefetcher {
+	p := &mediaPrefetcher{
+		media:      media,
+		host:       host,
+		max:        max,
+		width:      width,
+		height:     height,
+		running:    make(chan struct{}, 1),
+		prefetched: make(map[string]bool),
+	}
+	media.onHit = p.hit
+	return p
+}
+
+// parseThumbnailSize parses a WIDTHxHEIGHT thumbnail size e.g 800x600
+func parseThumbnailSize(s string) (width, height int, err error) {
+	wh := strings.SplitN(s, "x", 2)
+	if len(wh) == 2 {
+		width, err = strconv.Atoi(wh[0])
+		if err == nil {
+			height, err = strconv.Atoi(wh[1])
+		}
+	}
+	if len(wh) != 2 || err != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("%q is not of the form WIDTHxHEIGHT", s)
+	}
+	return width, height, nil
+}
+
+// thumbnailsFromSync returns the mxc:// URIs of the thumbnails of images in a /sync response, newest first
+func thumbnailsFromSync(syncBody string) []string {
+	type image struct {
+		mxc string
+		ts  int64
+	}
+	var images []image
+	gjson.Get(syncBody, "rooms.join").ForEach(func(_, room gjson.Result) bool {
+		room.Get("timeline.events").ForEach(func(_, ev gjson.Result) bool {
+			evType := ev.Get("type").String()
+			isImage := evType == "m.sticker" || (evType == "m.room.message" && ev.Get("content.msgtype").String() == "m.image")
+			if !isImage {
+				return true
+			}
+			// unencrypted images only: encrypted thumbnails are in content.info.thumbnail_file
+			mxc := ev.Get("content.info.thumbnail_url").String()
+			if mxc == "" {
+				mxc = ev.Get("content.url").String()
+			}
+			if strings.HasPrefix(mxc, "mxc://") {
+				images = append(images, image{mxc: mxc, ts: ev.Get("origin_server_ts").Int()})
+			}
+			return true
+		})
+		return true
+	})
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].ts > images[j].ts
+	})
+	seen := make(map[string]bool)
+	var mxcs []string
+	for _, img := range images {
+		if !seen[img.mxc] {
+			seen[img.mxc] = true
+			mxcs = append(mxcs, img.mxc)
+		}
+	}
+	return mxcs
+}
+
+// thumbnailURL returns the URL a client fetches the thumbnail for an mxc:// URI from
+func (p *mediaPrefetcher) thumbnailURL(mxc string) (*url.URL, bool) {
+	serverAndID := strings.SplitN(strings.TrimPrefix(mxc, "mxc://"), "/", 2)
+	if len(serverAndID) != 2 || serverAndID[0] == "" || serverAndID[1] == "" {
+		return nil, false
+	}
+	q := make(url.Values)
+	q.Set("width", strconv.Itoa(p.width))
+	q.Set("height", strconv.Itoa(p.height))
+	q.Set("method", "scale")
+	return &url.URL{
+		Path:     "/_matrix/client/v1/media/thumbnail/" + serverAndID[0] + "/" + serverAndID[1],
+		RawQuery: q.Encode(),
+	}, true
+}
+
+// prefetch fetches the thumbnails of the newest images in the /sync response into the media cache. It blocks until
+// they have been fetched, so callers should run it in the background.
+func (p *mediaPrefetcher) prefetch(syncBody, token string) {
+	select {
+	case p.running <- struct{}{}:
+		defer func() { <-p.running }()
+	default:
+		prefetchStats.Add("skipped", 1)
+		return
+	}
+	mxcs := thumbnailsFromSync(syncBody)
+	if len(mxcs) > p.max {
+		mxcs = mxcs[:p.max]
+	}
+	for _, mxc := range mxcs {
+		u, ok := p.thumbnailURL(mxc)
+		if !ok {
+			continue
+		}
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			continue
+		}
+		req.Host = p.host
+		req.Header.Set("Authorization", "Bearer "+token)
+		key := p.media.key(req)
+		if _, ok := p.media.cache.Get(key); ok {
+			continue
+		}
+		w := &discardWriter{header: make(http.Header)}
+		p.media.ServeHTTP(w, req)
+		if w.statusCode != http.StatusOK {
+			logrus.WithField("mxc", mxc).Debugf("Failed to prefetch thumbnail: HTTP %d", w.statusCode)
+			prefetchStats.Add("failed", 1)
+			continue
+		}
+		prefetchStats.Add("prefetched", 1)
+		p.mu.Lock()
+		if len(p.prefetched) < maxPrefetchedKeys {
+			p.prefetched[key] = true
+		}
+		p.mu.Unlock()
+	}
+}
+
+// hit is called when the media cache serves key
+func (p *mediaPrefetcher) hit(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.prefetched[key] {
+		delete(p.prefetched, key)
+		prefetchStats.Add("hits", 1)
+	}
+}
+
+// discardWriter is an http.ResponseWriter which only keeps the status code
+type discardWriter struct {
+	header     http.Header
+	statusCode int
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) WriteHeader(statusCode int) {
+	if d.statusCode == 0 {
+		d.statusCode = statusCode
+	}
+}
+
+func (d *discardWriter) Write(data []byte) (int, error) {
+	if d.statusCode == 0 {
+		d.statusCode = http.StatusOK
+	}
+	return len(data), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/lb"
+)
+
+func prefetchStat(name string) int64 {
+	v, ok := prefetchStats.Get(name).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestThumbnailsFromSync(t *testing.T) {
+	sync := `{"rooms":{"join":{
+		"!a:example.com":{"timeline":{"events":[
+			{"type":"m.room.message","origin_server_ts":1,"content":{"msgtype":"m.image","url":"mxc://example.com/old"}},
+			{"type":"m.room.message","origin_server_ts":3,"content":{"msgtype":"m.image","url":"mxc://example.com/full","info":{"thumbnail_url":"mxc://example.com/thumb"}}},
+			{"type":"m.room.message","origin_server_ts":4,"content":{"msgtype":"m.text","body":"mxc://example.com/text"}}
+		]}},
+		"!b:example.com":{"timeline":{"events":[
+			{"type":"m.sticker","origin_server_ts":2,"content":{"url":"mxc://example.com/sticker"}},
+			{"type":"m.room.message","origin_server_ts":5,"content":{"msgtype":"m.image","file":{"url":"mxc://example.com/encrypted"}}}
+		]}}
+	}}}`
+	got := thumbnailsFromSync(sync)
+	want := []string{"mxc://example.com/thumb", "mxc://example.com/sticker", "mxc://example.com/old"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestMediaPrefetch(t *testing.T) {
+	var fetched []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fetched = append(fetched, req.URL.RequestURI())
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("THUMB:" + req.URL.Path))
+	})
+	mc := &mediaCache{
+		cache:   lb.NewLRUCache(1024 * 1024),
+		next:    next,
+		ttl:     time.Hour,
+		maxSize: 1024,
+	}
+	p := newMediaPrefetcher(mc, "example.com", 2, 800, 600)
+	before := map[string]int64{}
+	for _, name := range []string{"prefetched", "hits", "failed"} {
+		before[name] = prefetchStat(name)
+	}
+	sync := `{"rooms":{"join":{"!a:example.com":{"timeline":{"events":[
+		{"type":"m.room.message","origin_server_ts":1,"content":{"msgtype":"m.image","url":"mxc://example.com/oldest"}},
+		{"type":"m.room.message","origin_server_ts":2,"content":{"msgtype":"m.image","url":"mxc://example.com/cat"}},
+		{"type":"m.room.message","origin_server_ts":3,"content":{"msgtype":"m.image","url":"mxc://example.com/dog"}}
+	]}}}}}`
+	p.prefetch(sync, "secret")
+
+	// only the 2 newest are fetched
+	want := []string{
+		"/_matrix/client/v1/media/thumbnail/example.com/dog?height=600&method=scale&width=800",
+		"/_matrix/client/v1/media/thumbnail/example.com/cat?height=600&method=scale&width=800",
+	}
+	if !reflect.DeepEqual(fetched, want) {
+		t.Fatalf("prefetched %v want %v", fetched, want)
+	}
+	if got := prefetchStat("prefetched") - before["prefetched"]; got != 2 {
+		t.Errorf("prefetched: got %d want 2", got)
+	}
+
+	// the client asks for the thumbnail with its parameters in a different order, which is served from the cache
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		mc.ServeHTTP(w, httptest.NewRequest("GET", "/_matrix/client/v1/media/thumbnail/example.com/cat?width=800&height=600&method=scale", nil))
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		if w.Code != 200 || string(body) != "THUMB:/_matrix/client/v1/media/thumbnail/example.com/cat" {
+			t.Fatalf("request %d: got %d %s", i, w.Code, string(body))
+		}
+	}
+	if len(fetched) != 2 {
+		t.Errorf("thumbnail was fetched again: %v", fetched)
+	}
+	// only the first use of a prefetched thumbnail is a hit
+	if got := prefetchStat("hits") - before["hits"]; got != 1 {
+		t.Errorf("hits: got %d want 1", got)
+	}
+
+	// thumbnails which are already cached are not fetched again, and failures are not cached
+	fetched = nil
+	p.prefetch(sync, "wrong")
+	if len(fetched) != 0 {
+		t.Errorf("cached thumbnails were fetched again: %v", fetched)
+	}
+	p.max = 3
+	p.prefetch(sync, "wrong")
+	if got := prefetchStat("failed") - before["failed"]; got != 1 || len(fetched) != 1 {
+		t.Errorf("failed: got %d want 1, fetched %v", got, fetched)
+	}
+}
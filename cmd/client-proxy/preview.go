@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/lb"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// previewStats are served at /debug/vars
+var previewStats = expvar.NewMap("media_previews")
+
+const (
+	// progressiveContentType is what clients put in Accept to be sent a preview before the full image
+	progressiveContentType = "multipart/x-mixed-replace"
+	// blurhashHeader is set on the preview part to the blurhash it was rendered from, for clients which would
+	// rather render it themselves
+	blurhashHeader = "X-LB-Blurhash"
+	// previewStatusHeader is set on the full image part when the homeserver did not respond with 200 OK, as the
+	// status of the response as a whole was sent with the preview
+	previewStatusHeader = "X-LB-Status"
+	// the longest side of preview images in pixels
+	previewSize = 32
+	// blurhashes are tiny, so this remembers tens of thousands of images
+	previewCacheBytes = 1024 * 1024
+)
+
+// mediaPreviews serves images progressively: clients which accept multipart/x-mixed-replace are sent a blurry
+// preview as the first part, then the full image from next as the second part once it arrives. Rendering the
+// preview costs nothing on the link, as the blurhash (MSC2448) was already sent in the event in /sync, so this
+// only applies to images which have been seen in a /sync response. Other requests go straight to next.
+type mediaPreviews struct {
+	// mxc://server/id -> "width height blurhash"
+	cache lb.Cache
+	next  http.Handler
+}
+
+func newMediaPreviews(next http.Handler) *mediaPreviews {
+	return &mediaPreviews{
+		cache: lb.NewLRUCache(previewCacheBytes),
+		next:  next,
+	}
+}
+
+// learn remembers the blurhashes of the images in a /sync response
+func (p *mediaPreviews) learn(syncBody string) {
+	gjson.Get(syncBody, "rooms.join").ForEach(func(_, room gjson.Result) bool {
+		room.Get("timeline.events").ForEach(func(_, ev gjson.Result) bool {
+			evType := ev.Get("type").String()
+			isImage := evType == "m.sticker" || (evType == "m.room.message" && ev.Get("content.msgtype").String() == "m.image")
+			if !isImage {
+				return true
+			}
+			info := ev.Get("content.info")
+			hash := info.Get(`xyz\.amorgan\.blurhash`).String()
+			if validBlurhash(hash) != nil {
+				return true
+			}
+			value := []byte(fmt.Sprintf("%d %d %s", info.Get("w").Int(), info.Get("h").Int(), hash))
+			// the thumbnail is the same picture, so gets the same preview
+			for _, mxc := range []string{ev.Get("content.url").String(), info.Get("thumbnail_url").String()} {
+				if strings.HasPrefix(mxc, "mxc://") {
+					p.cache.Set(mxc, value, 0)
+					previewStats.Add("learned", 1)
+				}
+			}
+			return true
+		})
+		return true
+	})
+}
+
+// mxcFromMediaPath returns the mxc:// URI a download or thumbnail request is for
+func mxcFromMediaPath(path string) (string, bool) {
+	i := strings.Index(path, "/media/")
+	if i < 0 {
+		return "", false
+	}
+	segments := strings.Split(path[i+len("/media/"):], "/")
+	if len(segments) < 3 || (segments[0] != "download" && segments[0] != "thumbnail") || segments[1] == "" || segments[2] == "" {
+		return "", false
+	}
+	return "mxc://" + segments[1] + "/" + segments[2], true
+}
+
+// previewDimensions scales width x height so the longest side is previewSize, or is square if the size is unknown
+func previewDimensions(width, height int) (int, int) {
+	if width <= 0 || height <= 0 {
+		return previewSize, previewSize
+	}
+	if width >= height {
+		return previewSize, max(1, previewSize*height/width)
+	}
+	return max(1, previewSize*width/height), previewSize
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// preview renders the preview of an mxc:// URI as a PNG
+func (p *mediaPreviews) preview(mxc string) (data []byte, hash string, ok bool) {
+	value, ok := p.cache.Get(mxc)
+	if !ok {
+		return nil, "", false
+	}
+	fields := strings.SplitN(string(value), " ", 3)
+	if len(fields) != 3 {
+		return nil, "", false
+	}
+	width, _ := strconv.Atoi(fields[0])
+	height, _ := strconv.Atoi(fields[1])
+	width, height = previewDimensions(width, height)
+	img, err := decodeBlurhash(fields[2], width, height)
+	if err != nil {
+		return nil, "", false
+	}
+	var buf bytes.Buffer
+	if err := encodePNG(&buf, img); err != nil {
+		return nil, "", false
+	}
+	return buf.Bytes(), fields[2], true
+}
+
+var encodePNG = (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode
+
+func (p *mediaPreviews) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	mxc, ok := mxcFromMediaPath(req.URL.Path)
+	if !ok || req.Method != "GET" || !strings.Contains(req.Header.Get("Accept"), progressiveContentType) {
+		p.next.ServeHTTP(w, req)
+		return
+	}
+	preview, hash, ok := p.preview(mxc)
+	if !ok {
+		previewStats.Add("misses", 1)
+		p.next.ServeHTTP(w, req)
+		return
+	}
+	previewStats.Add("served", 1)
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", progressiveContentType+"; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusOK)
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":   {"image/png"},
+		"Content-Length": {strconv.Itoa(len(preview))},
+		blurhashHeader:   {hash},
+	})
+	if err != nil {
+		return
+	}
+	if _, err := part.Write(preview); err != nil {
+		return
+	}
+	// the point is for the preview to arrive before the full image has been fetched
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	// the homeserver would not know what to do with this
+	req = req.Clone(req.Context())
+	req.Header.Del("Accept")
+	pw := &partWriter{mw: mw, w: w, header: make(http.Header)}
+	p.next.ServeHTTP(pw, req)
+	pw.WriteHeader(http.StatusOK)
+	if err := mw.Close(); err != nil {
+		logrus.WithError(err).WithField("mxc", mxc).Warn("Failed to finish progressive media response")
+	}
+}
+
+// partWriter writes a response as the next part of a multipart response
+type partWriter struct {
+	mw     *multipart.Writer
+	w      http.ResponseWriter
+	header http.Header
+	part   io.Writer
+	err    error
+}
+
+func (pw *partWriter) Header() http.Header {
+	return pw.header
+}
+
+func (pw *partWriter) WriteHeader(statusCode int) {
+	if pw.part != nil || pw.err != nil {
+		return
+	}
+	h := make(textproto.MIMEHeader)
+	for _, name := range []string{"Content-Type", "Content-Length", "Content-Disposition"} {
+		if v := pw.header.Get(name); v != "" {
+			h.Set(name, v)
+		}
+	}
+	if statusCode != http.StatusOK {
+		h.Set(previewStatusHeader, strconv.Itoa(statusCode))
+	}
+	pw.part, pw.err = pw.mw.CreatePart(h)
+}
+
+func (pw *partWriter) Write(data []byte) (int, error) {
+	pw.WriteHeader(http.StatusOK)
+	if pw.err != nil {
+		return 0, pw.err
+	}
+	return pw.part.Write(data)
+}
+
+// Flush allows streaming handlers like httputil.ReverseProxy to flush the full image as it arrives
+func (pw *partWriter) Flush() {
+	pw.WriteHeader(http.StatusOK)
+	if f, ok := pw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the example from https://blurha.sh, 4x3 components
+const testBlurhash = "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+
+func TestDecodeBlurhash(t *testing.T) {
+	img, err := decodeBlurhash(testBlurhash, 32, 24)
+	if err != nil {
+		t.Fatalf("decodeBlurhash: %s", err)
+	}
+	if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 24 {
+		t.Errorf("got a %dx%d image", b.Dx(), b.Dy())
+	}
+	for _, hash := range []string{"", "LEHV6", testBlurhash + "a", "LEHV6nWB2yk8pyo0adR*.7kCMdn\""} {
+		if _, err := decodeBlurhash(hash, 32, 32); err == nil {
+			t.Errorf("decodeBlurhash(%q) did not fail", hash)
+		}
+	}
+}
+
+func TestMxcFromMediaPath(t *testing.T) {
+	testCases := map[string]string{
+		"/_matrix/client/v1/media/download/example.com/abc":            "mxc://example.com/abc",
+		"/_matrix/client/v1/media/download/example.com/abc/cat.jpg":    "mxc://example.com/abc",
+		"/_matrix/client/v1/media/thumbnail/example.com/abc":           "mxc://example.com/abc",
+		"/_matrix/client/v1/media/config":                              "",
+		"/_matrix/client/v1/media/download/example.com/":               "",
+		"/_matrix/client/v1/media/preview_url/example.com/abc/cat.jpg": "",
+	}
+	for path, want := range testCases {
+		got, ok := mxcFromMediaPath(path)
+		if got != want || ok != (want != "") {
+			t.Errorf("%s: got %q %v want %q", path, got, ok, want)
+		}
+	}
+}
+
+// TestMediaPreviews checks the preview is sent before the full image has even been fetched
+func TestMediaPreviews(t *testing.T) {
+	fetch := make(chan struct{})
+	var mu sync.Mutex
+	var gotAccept string
+	p := newMediaPreviews(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		gotAccept = req.Header.Get("Accept")
+		mu.Unlock()
+		select {
+		case <-fetch:
+		case <-time.After(5 * time.Second):
+			http.Error(w, "the preview was not sent first", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("full image"))
+	}))
+	p.learn(`{"rooms":{"join":{"!a:example.com":{"timeline":{"events":[
+		{"type":"m.room.message","content":{"msgtype":"m.image","url":"mxc://example.com/cat",
+			"info":{"w":800,"h":600,"xyz.amorgan.blurhash":"` + testBlurhash + `"}}},
+		{"type":"m.room.message","content":{"msgtype":"m.image","url":"mxc://example.com/bad","info":{"xyz.amorgan.blurhash":"nope"}}}
+	]}}}}}`)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/_matrix/client/v1/media/download/example.com/cat", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %s", err)
+	}
+	req.Header.Set("Accept", "multipart/x-mixed-replace, image/*")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer res.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || mediaType != progressiveContentType {
+		t.Fatalf("got Content-Type %q", res.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(res.Body, params["boundary"])
+
+	preview, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("reading preview: %s", err)
+	}
+	if preview.Header.Get("Content-Type") != "image/png" || preview.Header.Get(blurhashHeader) != testBlurhash {
+		t.Errorf("got preview headers %v", preview.Header)
+	}
+	img, err := png.Decode(preview)
+	if err != nil {
+		t.Fatalf("preview is not a PNG: %s", err)
+	}
+	if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 24 {
+		t.Errorf("got a %dx%d preview of an 800x600 image", b.Dx(), b.Dy())
+	}
+	// the full image can only be fetched once the preview has arrived
+	close(fetch)
+	full, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("reading full image: %s", err)
+	}
+	body, _ := ioutil.ReadAll(full)
+	if full.Header.Get("Content-Type") != "image/jpeg" || string(body) != "full image" {
+		t.Errorf("got full image %v %q", full.Header, body)
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("got %v after the full image, want EOF", err)
+	}
+	mu.Lock()
+	if gotAccept != "" {
+		t.Errorf("sent Accept: %s to the homeserver", gotAccept)
+	}
+	mu.Unlock()
+
+	// images without a valid blurhash, and clients which don't ask, get the image as usual
+	for _, tc := range []struct {
+		path, accept string
+	}{
+		{"/_matrix/client/v1/media/download/example.com/bad", progressiveContentType},
+		{"/_matrix/client/v1/media/download/example.com/unknown", progressiveContentType},
+		{"/_matrix/client/v1/media/download/example.com/cat", "image/*"},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+tc.path, nil)
+		req.Header.Set("Accept", tc.accept)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %s", tc.path, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.Header.Get("Content-Type") != "image/jpeg" || string(body) != "full image" {
+			t.Errorf("%s Accept %s: got %s %q", tc.path, tc.accept, res.Header.Get("Content-Type"), body)
+		}
+	}
+}
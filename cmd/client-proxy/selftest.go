@@ -0,0 +1,200 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/lb/mobile"
+	"github.com/tidwall/gjson"
+)
+
+// selfTestCheck is the result of a single self-test check
+type selfTestCheck struct {
+	Name       string `json:"name"`
+	Passed     bool   `json:"passed"`
+	Skipped    bool   `json:"skipped,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// selfTestReport is the result of running all self-test checks
+type selfTestReport struct {
+	Homeserver string          `json:"homeserver"`
+	Passed     bool            `json:"passed"`
+	Checks     []selfTestCheck `json:"checks"`
+}
+
+// runSelfTest runs a series of checks against the homeserver and writes a report to w. If token is empty,
+// checks which require authentication are skipped, and the CBOR round-trip only checks the server's responses are CBOR.
+// Returns true if all checks that ran passed.
+func runSelfTest(w io.Writer, hsURL, token string, asJSON bool) bool {
+	report := selfTestReport{
+		Homeserver: hsURL,
+		Passed:     true,
+	}
+	run := func(name string, fn func() error) {
+		start := time.Now()
+		err := fn()
+		check := selfTestCheck{
+			Name:       name,
+			Passed:     err == nil,
+			DurationMS: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			check.Error = err.Error()
+			report.Passed = false
+		}
+		report.Checks = append(report.Checks, check)
+	}
+	skip := func(name, reason string) {
+		report.Checks = append(report.Checks, selfTestCheck{
+			Name:    name,
+			Passed:  true,
+			Skipped: true,
+			Error:   reason,
+		})
+	}
+
+	var versionsBody, versionsDictionary string
+	run("dtls_handshake", func() error {
+		return mobile.Connect(hsURL)
+	})
+	run("versions", func() error {
+		res := mobile.SendRequest("GET", hsURL+"/_matrix/client/versions", "", "")
+		if res == nil {
+			return fmt.Errorf("failed to send request")
+		}
+		if res.Code != 200 {
+			return fmt.Errorf("returned HTTP %d: %s", res.Code, res.Body)
+		}
+		if !gjson.Get(res.Body, "versions").IsArray() {
+			return fmt.Errorf("response is missing 'versions': %s", res.Body)
+		}
+		versionsBody, versionsDictionary = res.Body, res.Dictionary
+		return nil
+	})
+	run("cbor_round_trip", func() error {
+		if versionsBody == "" {
+			return fmt.Errorf("no /versions response to check")
+		}
+		// the server sends JSON if it is not converting to CBOR, which the client passes through
+		if versionsDictionary == "" {
+			return fmt.Errorf("/versions response was not CBOR")
+		}
+		if token == "" {
+			return nil
+		}
+		return accountDataRoundTrip(hsURL, token)
+	})
+	if token == "" {
+		skip("observe_registration", "no --self-test-token given")
+	} else {
+		run("observe_registration", func() error {
+			defaultParams := *mobile.Params()
+			cp := defaultParams
+			cp.ObserveEnabled = true
+			if err := mobile.SetParams(&cp); err != nil {
+				return err
+			}
+			defer mobile.SetParams(&defaultParams)
+			res := mobile.SendRequest("GET", hsURL+"/_matrix/client/r0/sync?timeout=0", token, "")
+			if res == nil {
+				return fmt.Errorf("failed to observe /sync")
+			}
+			if res.Code != 200 {
+				return fmt.Errorf("returned HTTP %d: %s", res.Code, res.Body)
+			}
+			// the client answers with a fake /sync with the since token it was given, which is none here, if the server
+			// did not answer within ObserveNoResponseTimeoutSecs
+			if gjson.Get(res.Body, "next_batch").Str == "" {
+				return fmt.Errorf("no /sync response within %ds", cp.ObserveNoResponseTimeoutSecs)
+			}
+			return nil
+		})
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return report.Passed
+	}
+	fmt.Fprintf(w, "Self-test against %s\n", hsURL)
+	for _, c := range report.Checks {
+		status := "PASS"
+		if c.Skipped {
+			status = "SKIP"
+		} else if !c.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "  %s %-22s %6dms %s\n", status, c.Name, c.DurationMS, c.Error)
+	}
+	if report.Passed {
+		fmt.Fprintf(w, "All checks passed\n")
+	} else {
+		fmt.Fprintf(w, "One or more checks failed\n")
+	}
+	return report.Passed
+}
+
+// selfTestAccountDataType is the account data the CBOR round-trip writes then reads back
+const selfTestAccountDataType = "org.matrix.lb.self_test"
+
+// accountDataRoundTrip writes account data then reads it back through the server, so the request body is converted
+// to CBOR by the client then back to JSON for the homeserver, and the response the other way. The content uses keys
+// and values in the dictionary, so it fails if the peers disagree on it. The account data is left on the account of
+// the token, as Matrix has no way to delete it, and is overwritten by the next self-test.
+func accountDataRoundTrip(hsURL, token string) error {
+	res := mobile.SendRequest("GET", hsURL+"/_matrix/client/r0/account/whoami", token, "")
+	if res == nil {
+		return fmt.Errorf("failed to send /account/whoami")
+	}
+	userID := gjson.Get(res.Body, "user_id").Str
+	if res.Code != 200 || userID == "" {
+		return fmt.Errorf("/account/whoami returned HTTP %d: %s", res.Code, res.Body)
+	}
+	// a millisecond timestamp, as JSON numbers are decoded as float64 so larger ones lose precision
+	ts := time.Now().UnixNano() / int64(time.Millisecond)
+	content := fmt.Sprintf(`{"algorithm":"m.megolm.v1.aes-sha2","body":"self-test","msgtype":"m.text","ts":%d}`, ts)
+	path := hsURL + "/_matrix/client/r0/user/" + url.PathEscape(userID) + "/account_data/" + selfTestAccountDataType
+	res = mobile.SendRequest("PUT", path, token, content)
+	if res == nil {
+		return fmt.Errorf("failed to send account data")
+	}
+	if res.Code != 200 {
+		return fmt.Errorf("PUT account data returned HTTP %d: %s", res.Code, res.Body)
+	}
+	res = mobile.SendRequest("GET", path, token, "")
+	if res == nil {
+		return fmt.Errorf("failed to get account data")
+	}
+	if res.Code != 200 {
+		return fmt.Errorf("GET account data returned HTTP %d: %s", res.Code, res.Body)
+	}
+	got, err := gomatrixserverlib.CanonicalJSON([]byte(res.Body))
+	if err != nil {
+		return fmt.Errorf("account data is not JSON: %w", err)
+	}
+	if string(got) != content {
+		return fmt.Errorf("round-trip mismatch: got %s want %s", string(got), content)
+	}
+	return nil
+}
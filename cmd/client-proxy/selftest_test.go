@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/lb/mobile"
+)
+
+// startSelfTestHomeserver runs the mock homeserver and allows its self-signed certificate, returning its URL and
+// access token
+func startSelfTestHomeserver(t *testing.T) (string, string) {
+	t.Helper()
+	script, err := parseMockScript([]byte(defaultMockScript))
+	if err != nil {
+		t.Fatalf("parseMockScript: %s", err)
+	}
+	addr, stop, err := startMockHomeserver(script)
+	if err != nil {
+		t.Fatalf("startMockHomeserver: %s", err)
+	}
+	oldParams := *mobile.Params()
+	cp := oldParams
+	cp.InsecureSkipVerify = true
+	if err = mobile.SetParams(&cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	t.Cleanup(func() {
+		mobile.SetParams(&oldParams)
+		stop()
+	})
+	return "https://" + addr, script.AccessToken
+}
+
+func TestSelfTest(t *testing.T) {
+	hsURL, token := startSelfTestHomeserver(t)
+	var out bytes.Buffer
+	if !runSelfTest(&out, hsURL, token, false) {
+		t.Fatalf("runSelfTest failed against the mock homeserver:\n%s", out.String())
+	}
+	for _, name := range []string{"dtls_handshake", "versions", "cbor_round_trip", "observe_registration"} {
+		if !strings.Contains(out.String(), "PASS "+name) {
+			t.Errorf("report does not say %s passed:\n%s", name, out.String())
+		}
+	}
+	if !strings.HasSuffix(out.String(), "All checks passed\n") {
+		t.Errorf("report does not end with a pass:\n%s", out.String())
+	}
+}
+
+func TestSelfTestJSON(t *testing.T) {
+	hsURL, token := startSelfTestHomeserver(t)
+	testCases := []struct {
+		name       string
+		token      string
+		wantPassed bool
+		// check name -> "pass", "fail" or "skip"
+		wantChecks map[string]string
+	}{
+		{
+			name:       "without a token",
+			wantPassed: true,
+			wantChecks: map[string]string{
+				"dtls_handshake": "pass", "versions": "pass", "cbor_round_trip": "pass", "observe_registration": "skip",
+			},
+		},
+		{
+			name:       "with a token",
+			token:      token,
+			wantPassed: true,
+			wantChecks: map[string]string{
+				"dtls_handshake": "pass", "versions": "pass", "cbor_round_trip": "pass", "observe_registration": "pass",
+			},
+		},
+		{
+			name:       "with the wrong token",
+			token:      "wrong_token",
+			wantPassed: false,
+			wantChecks: map[string]string{
+				"dtls_handshake": "pass", "versions": "pass", "cbor_round_trip": "fail", "observe_registration": "fail",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			passed := runSelfTest(&out, hsURL, tc.token, true)
+			var report selfTestReport
+			if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+				t.Fatalf("report is not JSON: %s\n%s", err, out.String())
+			}
+			if passed != tc.wantPassed || report.Passed != tc.wantPassed {
+				t.Errorf("got passed %v and report passed %v want %v", passed, report.Passed, tc.wantPassed)
+			}
+			if report.Homeserver != hsURL {
+				t.Errorf("got homeserver %s want %s", report.Homeserver, hsURL)
+			}
+			got := make(map[string]string)
+			for _, c := range report.Checks {
+				switch {
+				case c.Skipped:
+					got[c.Name] = "skip"
+				case c.Passed:
+					got[c.Name] = "pass"
+				default:
+					got[c.Name] = "fail"
+					if c.Error == "" {
+						t.Errorf("check %s failed without an error", c.Name)
+					}
+				}
+			}
+			for name, want := range tc.wantChecks {
+				if got[name] != want {
+					t.Errorf("check %s: got %q want %q", name, got[name], want)
+				}
+			}
+			if len(got) != len(tc.wantChecks) {
+				t.Errorf("got checks %v want %v", got, tc.wantChecks)
+			}
+		})
+	}
+}
+
+// TestSelfTestFailure checks that the report says which check failed and why when the server cannot be reached
+func TestSelfTestFailure(t *testing.T) {
+	oldParams := *mobile.Params()
+	cp := oldParams
+	cp.HandshakeTimeoutSecs = 1
+	if err := mobile.SetParams(&cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	defer mobile.SetParams(&oldParams)
+	var out bytes.Buffer
+	if runSelfTest(&out, "https://127.0.0.1:1", "", false) {
+		t.Fatalf("runSelfTest passed without a server:\n%s", out.String())
+	}
+	for _, want := range []string{"FAIL dtls_handshake", "FAIL versions", "FAIL cbor_round_trip", "SKIP observe_registration"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report does not contain %q:\n%s", want, out.String())
+		}
+	}
+	if !strings.HasSuffix(out.String(), "One or more checks failed\n") {
+		t.Errorf("report does not end with a failure:\n%s", out.String())
+	}
+}
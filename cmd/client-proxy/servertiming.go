@@ -0,0 +1,75 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/lb/mobile"
+	"github.com/sirupsen/logrus"
+)
+
+// serverTiming returns a Server-Timing header value for the timings, see https://www.w3.org/TR/server-timing/
+// The handshake and block-wise stages are left out if they did not happen.
+func serverTiming(t *mobile.Timings) string {
+	metrics := []struct {
+		name, desc string
+		millis     float64
+		optional   bool
+	}{
+		{"handshake", "DTLS handshake", t.HandshakeMillis, true},
+		{"coap", "CoAP exchange", t.ExchangeMillis, false},
+		{"blockwise", "Block-wise transfer", t.BlockwiseMillis, true},
+		{"cbor", "CBOR decode", t.DecodeMillis, false},
+	}
+	var parts []string
+	for _, m := range metrics {
+		if m.optional && m.millis == 0 {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf(`%s;desc="%s";dur=%.1f`, m.name, m.desc, m.millis))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// isLongPoll returns true if the request asks the homeserver to wait for something to happen, e.g /sync with a
+// timeout, so is meant to be slow
+func isLongPoll(req *http.Request) bool {
+	timeout := req.URL.Query().Get("timeout")
+	return timeout != "" && timeout != "0"
+}
+
+// logSlowRequest logs a request which took longer than --slow-request-threshold, with the time taken by each stage.
+// Only the path is logged, as the query can contain an access token. resp is nil if the request failed.
+func logSlowRequest(method, path string, took time.Duration, resp *mobile.Response) {
+	fields := logrus.Fields{
+		"method":   method,
+		"path":     path,
+		"total_ms": float64(took) / float64(time.Millisecond),
+	}
+	if resp != nil {
+		fields["code"] = resp.Code
+	}
+	if resp != nil && resp.Timings != nil {
+		fields["handshake_ms"] = resp.Timings.HandshakeMillis
+		fields["coap_ms"] = resp.Timings.ExchangeMillis
+		fields["blockwise_ms"] = resp.Timings.BlockwiseMillis
+		fields["cbor_ms"] = resp.Timings.DecodeMillis
+	}
+	logrus.WithFields(fields).Info("Slow request")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/lb/mobile"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestServerTiming(t *testing.T) {
+	testCases := []struct {
+		timings mobile.Timings
+		want    string
+	}{
+		{
+			timings: mobile.Timings{ExchangeMillis: 12.34, DecodeMillis: 0.05},
+			want:    `coap;desc="CoAP exchange";dur=12.3, cbor;desc="CBOR decode";dur=0.1`,
+		},
+		{
+			timings: mobile.Timings{HandshakeMillis: 150, ExchangeMillis: 20, BlockwiseMillis: 80, DecodeMillis: 1.5},
+			want: `handshake;desc="DTLS handshake";dur=150.0, coap;desc="CoAP exchange";dur=20.0, ` +
+				`blockwise;desc="Block-wise transfer";dur=80.0, cbor;desc="CBOR decode";dur=1.5`,
+		},
+	}
+	for _, tc := range testCases {
+		if got := serverTiming(&tc.timings); got != tc.want {
+			t.Errorf("serverTiming(%+v):\ngot  %s\nwant %s", tc.timings, got, tc.want)
+		}
+	}
+}
+
+func TestSlowRequestThreshold(t *testing.T) {
+	oldSend, oldHomeserverAddr, oldThreshold := sendRequestWithOptions, *homeserverAddr, *slowRequestThreshold
+	sendRequestWithOptions = func(method, hsURL, token, body string, opts *mobile.SendOptions) *mobile.Response {
+		return &mobile.Response{Code: 200, Body: `{}`, Timings: &mobile.Timings{HandshakeMillis: 150, ExchangeMillis: 20}}
+	}
+	*homeserverAddr = "example.com:8008"
+	t.Cleanup(func() {
+		sendRequestWithOptions, *homeserverAddr, *slowRequestThreshold = oldSend, oldHomeserverAddr, oldThreshold
+	})
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	testCases := []struct {
+		name      string
+		threshold time.Duration
+		path      string
+		wantLog   bool
+	}{
+		{name: "over", threshold: time.Nanosecond, path: "/_matrix/client/r0/account/whoami?access_token=secret", wantLog: true},
+		{name: "under", threshold: time.Hour, path: "/_matrix/client/r0/account/whoami"},
+		{name: "disabled", threshold: 0, path: "/_matrix/client/r0/account/whoami"},
+		{name: "long poll", threshold: time.Nanosecond, path: "/_matrix/client/r0/sync?timeout=30000"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hook.Reset()
+			*slowRequestThreshold = tc.threshold
+			handler(httptest.NewRecorder(), httptest.NewRequest("GET", tc.path, nil))
+			slow := 0
+			for _, e := range hook.AllEntries() {
+				if e.Message == "Slow request" {
+					slow++
+					if e.Data["path"] != "/_matrix/client/r0/account/whoami" || e.Data["handshake_ms"] != 150.0 || e.Data["coap_ms"] != 20.0 {
+						t.Errorf("wrong fields: %v", e.Data)
+					}
+				}
+			}
+			if gotLog := slow > 0; gotLog != tc.wantLog {
+				t.Errorf("got slow request logged %v want %v", gotLog, tc.wantLog)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/matrix-org/lb"
+	"github.com/matrix-org/lb/mobile"
+	"github.com/sirupsen/logrus"
+)
+
+// shadowHTTPS repeats requests over HTTPS in the background and compares the responses with the CoAP responses,
+// to catch codec or translation bugs. Only the endpoint and the structure of the responses are logged, never the
+// values, query parameters or identifiers.
+type shadowHTTPS struct {
+	client  *http.Client
+	baseURL string // e.g https://example.com
+	// counters, accessed atomically
+	requests   uint64
+	mismatches uint64
+	errors     uint64
+}
+
+// shouldShadow returns true if the request is safe and useful to repeat over HTTPS. Only GET requests are
+// repeated, as repeating other requests may have side effects e.g creating a room twice. /sync is not repeated
+// as two /sync requests made at different times will rarely return the same thing.
+func shouldShadow(method, path string) bool {
+	return method == "GET" && !strings.HasSuffix(path, "/sync")
+}
+
+// compare sends the request over HTTPS and logs any structural differences with the CoAP response
+func (s *shadowHTTPS) compare(requestURI, token string, coapRes *mobile.Response) {
+	requests := atomic.AddUint64(&s.requests, 1)
+	logger := logrus.WithField("shadow", shadowEndpoint(requestURI))
+	req, err := http.NewRequest("GET", s.baseURL+requestURI, nil)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		logger.WithError(err).Warn("Shadow: failed to create HTTPS request")
+		return
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		logger.WithError(err).Warn("Shadow: HTTPS request failed")
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		logger.WithError(err).Warn("Shadow: failed to read HTTPS response")
+		return
+	}
+	diffs := responseDiff(coapRes.Code, []byte(coapRes.Body), res.StatusCode, body)
+	if len(diffs) == 0 {
+		logger.Debug("Shadow: CoAP and HTTPS responses match")
+		return
+	}
+	mismatches := atomic.AddUint64(&s.mismatches, 1)
+	logger.WithField("mismatches", mismatches).WithField("requests", requests).Warnf(
+		"Shadow: CoAP and HTTPS responses differ: %s", strings.Join(diffs, "; "),
+	)
+}
+
+// the endpoint logged for requests which have no CoAP path mapping
+const shadowEndpointOther = "other"
+
+var shadowPaths = lb.NewCoAPPathV2()
+
+// shadowEndpoint returns the endpoint of a request URI to log, which is its CoAP path mapping with the version
+// prefix removed e.g /rooms/{roomId}/messages, so access tokens, sync tokens and identifiers are never logged
+func shadowEndpoint(requestURI string) string {
+	u, err := url.ParseRequestURI(requestURI)
+	if err != nil {
+		return shadowEndpointOther
+	}
+	template, ok := shadowPaths.HTTPPathTemplate(u.Path)
+	if !ok {
+		return shadowEndpointOther
+	}
+	template = strings.TrimPrefix(template, "/_matrix/client")
+	return strings.TrimPrefix(template, "/r0")
+}
+
+// the path element logged for object keys which are identifiers e.g room IDs in /sync or user IDs in /keys/query
+const shadowIdentifierKey = "{id}"
+
+// isIdentifierKey returns true if an object key is an identifier such as a room, user or event ID, a room alias,
+// or a key ID like ed25519:DEVICEID, rather than a field name
+func isIdentifierKey(key string) bool {
+	return strings.ContainsAny(key, ":!@$#")
+}
+
+// responseDiff returns the structural differences between the CoAP and HTTPS responses
+func responseDiff(coapCode int, coapBody []byte, httpsCode int, httpsBody []byte) []string {
+	var diffs []string
+	if coapCode != httpsCode {
+		diffs = append(diffs, fmt.Sprintf("status differs (coap %d, https %d)", coapCode, httpsCode))
+	}
+	var coapJSON, httpsJSON interface{}
+	coapErr := unmarshalNumbers(coapBody, &coapJSON)
+	httpsErr := unmarshalNumbers(httpsBody, &httpsJSON)
+	if coapErr != nil || httpsErr != nil {
+		if !bytes.Equal(coapBody, httpsBody) {
+			diffs = append(diffs, "non-JSON body differs")
+		}
+		return diffs
+	}
+	return append(diffs, jsonDiff("$", coapJSON, httpsJSON)...)
+}
+
+func unmarshalNumbers(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// jsonDiff returns the paths at which a and b differ, without including any values
+func jsonDiff(path string, a, b interface{}) []string {
+	if jsonType(a) != jsonType(b) {
+		return []string{fmt.Sprintf("%s: type differs (coap %s, https %s)", path, jsonType(a), jsonType(b))}
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv := b.(map[string]interface{})
+		keys := make(map[string]bool)
+		for k := range av {
+			keys[k] = true
+		}
+		for k := range bv {
+			keys[k] = true
+		}
+		sortedKeys := make([]string, 0, len(keys))
+		for k := range keys {
+			sortedKeys = append(sortedKeys, k)
+		}
+		sort.Strings(sortedKeys)
+		var diffs []string
+		seen := make(map[string]bool)
+		for _, k := range sortedKeys {
+			aval, aok := av[k]
+			bval, bok := bv[k]
+			keyPath := path + "." + k
+			if isIdentifierKey(k) {
+				keyPath = path + "." + shadowIdentifierKey
+			}
+			var keyDiffs []string
+			switch {
+			case !bok:
+				keyDiffs = []string{fmt.Sprintf("%s: only in coap", keyPath)}
+			case !aok:
+				keyDiffs = []string{fmt.Sprintf("%s: only in https", keyPath)}
+			default:
+				keyDiffs = jsonDiff(keyPath, aval, bval)
+			}
+			// identifiers all have the same path, so their differences are only logged once
+			for _, d := range keyDiffs {
+				if !seen[d] {
+					seen[d] = true
+					diffs = append(diffs, d)
+				}
+			}
+		}
+		return diffs
+	case []interface{}:
+		bv := b.([]interface{})
+		if len(av) != len(bv) {
+			return []string{fmt.Sprintf("%s: length differs (coap %d, https %d)", path, len(av), len(bv))}
+		}
+		var diffs []string
+		for i := range av {
+			diffs = append(diffs, jsonDiff(fmt.Sprintf("%s[%d]", path, i), av[i], bv[i])...)
+		}
+		return diffs
+	case json.Number:
+		// the same number can be written differently e.g 1.0 and 1
+		af, aerr := av.Float64()
+		bf, berr := b.(json.Number).Float64()
+		if aerr != nil || berr != nil || af != bf {
+			return []string{fmt.Sprintf("%s: number value differs", path)}
+		}
+		return nil
+	default:
+		if a != b {
+			return []string{fmt.Sprintf("%s: %s value differs", path, jsonType(a))}
+		}
+		return nil
+	}
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "bool"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/lb/mobile"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestResponseDiff(t *testing.T) {
+	testCases := []struct {
+		name      string
+		coapCode  int
+		coapBody  string
+		httpsCode int
+		httpsBody string
+		want      []string
+	}{
+		{
+			name:      "same",
+			coapCode:  200,
+			coapBody:  `{"a":1,"b":["x",{"c":true}]}`,
+			httpsCode: 200,
+			httpsBody: `{"b":["x",{"c":true}],"a":1.0}`,
+		},
+		{
+			name:      "status",
+			coapCode:  200,
+			coapBody:  `{}`,
+			httpsCode: 404,
+			httpsBody: `{}`,
+			want:      []string{"status differs (coap 200, https 404)"},
+		},
+		{
+			name:      "structure",
+			coapCode:  200,
+			coapBody:  `{"displayname":"Alice","avatar_url":"mxc://a/b","list":[1,2],"n":null,"secret":"hunter2"}`,
+			httpsCode: 200,
+			httpsBody: `{"displayname":"Bob","list":[1],"n":5,"extra":{},"secret":"hunter3"}`,
+			want: []string{
+				"$.avatar_url: only in coap",
+				"$.displayname: string value differs",
+				"$.extra: only in https",
+				"$.list: length differs (coap 2, https 1)",
+				"$.n: type differs (coap null, https number)",
+				"$.secret: string value differs",
+			},
+		},
+		{
+			name:      "identifiers",
+			coapCode:  200,
+			coapBody:  `{"rooms":{"join":{"!a:example.com":{"n":1},"!b:example.com":{"n":1},"!c:example.com":{}}}}`,
+			httpsCode: 200,
+			httpsBody: `{"rooms":{"join":{"!a:example.com":{"n":2},"!b:example.com":{"n":3},"!d:example.com":{}}}}`,
+			want: []string{
+				"$.rooms.join.{id}.n: number value differs",
+				"$.rooms.join.{id}: only in coap",
+				"$.rooms.join.{id}: only in https",
+			},
+		},
+		{
+			name:      "not JSON",
+			coapCode:  200,
+			coapBody:  `{}`,
+			httpsCode: 200,
+			httpsBody: `<html>`,
+			want:      []string{"non-JSON body differs"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := responseDiff(tc.coapCode, []byte(tc.coapBody), tc.httpsCode, []byte(tc.httpsBody))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q want %q", got, tc.want)
+			}
+			// values must never be logged
+			for _, d := range got {
+				for _, secret := range []string{"Alice", "Bob", "hunter", "mxc://", "example.com"} {
+					if strings.Contains(d, secret) {
+						t.Errorf("diff %q contains the value %q", d, secret)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestShadowEndpoint(t *testing.T) {
+	testCases := map[string]string{
+		"/_matrix/client/r0/sync?since=s1_abc&access_token=secret":            "/sync",
+		"/_matrix/client/r0/rooms/!a:example.com/messages?from=t1&dir=b":      "/rooms/{roomId}/messages",
+		"/_matrix/client/v3/rooms/!a:example.com/messages":                    "/v3/rooms/{roomId}/messages",
+		"/_matrix/client/r0/profile/@alice:example.com":                       "/profile/{userId}",
+		"/_matrix/client/unstable/org.example/@alice:example.com?token=hello": "other",
+	}
+	for uri, want := range testCases {
+		if got := shadowEndpoint(uri); got != want {
+			t.Errorf("shadowEndpoint(%s): got %s want %s", uri, got, want)
+		}
+	}
+}
+
+func TestShadowHTTPSCompare(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(401)
+			w.Write([]byte(`{"errcode":"M_MISSING_TOKEN"}`))
+			return
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(`{"user_id":"@alice:example.com"}`))
+	}))
+	defer srv.Close()
+	s := &shadowHTTPS{
+		client:  srv.Client(),
+		baseURL: srv.URL,
+	}
+	s.compare("/_matrix/client/r0/account/whoami", "secret", &mobile.Response{Code: 200, Body: `{"user_id":"@alice:example.com"}`})
+	s.compare("/_matrix/client/r0/account/whoami", "secret", &mobile.Response{Code: 200, Body: `{"user_id":"@bob:example.com"}`})
+	if s.requests != 2 || s.mismatches != 1 || s.errors != 0 {
+		t.Errorf("got requests=%d mismatches=%d errors=%d, want 2, 1, 0", s.requests, s.mismatches, s.errors)
+	}
+	// only the endpoint is logged, without the query or identifiers
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	s.compare("/_matrix/client/r0/rooms/!room:example.com/messages?access_token=secret&from=s1_abc", "secret",
+		&mobile.Response{Code: 200, Body: `{"user_id":"@bob:example.com"}`})
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatalf("nothing was logged for a mismatch")
+	}
+	if got := entry.Data["shadow"]; got != "/rooms/{roomId}/messages" {
+		t.Errorf("logged shadow endpoint %v want /rooms/{roomId}/messages", got)
+	}
+	for _, e := range hook.AllEntries() {
+		line, _ := e.String()
+		for _, secret := range []string{"secret", "s1_abc", "!room", "example.com"} {
+			if strings.Contains(line, secret) {
+				t.Errorf("log line %q contains %q", line, secret)
+			}
+		}
+	}
+	if shouldShadow("PUT", "/_matrix/client/r0/rooms/!a:b/send/m.room.message/1") || shouldShadow("GET", "/_matrix/client/r0/sync") {
+		t.Errorf("shouldShadow returned true for a request which should not be repeated")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/lb/mobile"
+	"github.com/sirupsen/logrus"
+)
+
+// The max number of notifications buffered for a client which is reading them slower than they arrive
+const eventStreamBufferSize = 16
+
+// eventStream is an observation which can be cancelled, to allow tests to mock mobile.ObserveStream
+type eventStream interface {
+	Cancel()
+}
+
+// observeStream observes a resource at the URL, returning nil if it could not be observed
+var observeStream = func(hsURL, token string, cb mobile.StreamCallback) eventStream {
+	s := mobile.ObserveStream(hsURL, token, cb)
+	if s == nil {
+		return nil
+	}
+	return s
+}
+
+// wantsEventStream returns true if the request asks for a server-sent events stream rather than a single response
+func wantsEventStream(req *http.Request) bool {
+	if req.Method != "GET" {
+		return false
+	}
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err == nil && mediaType == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+type eventStreamNotification struct {
+	code int
+	body string
+}
+
+// eventStreamCallback passes notifications to the HTTP handler. It must never block after the handler has
+// returned, as it is called by the CoAP connection.
+type eventStreamCallback struct {
+	notifications chan eventStreamNotification
+	closed        chan struct{}
+	done          chan struct{} // closed when the handler returns
+}
+
+func (c *eventStreamCallback) OnNotification(code int, body string) {
+	select {
+	case c.notifications <- eventStreamNotification{code: code, body: body}:
+	case <-c.done:
+	}
+}
+
+func (c *eventStreamCallback) OnClosed() {
+	close(c.closed)
+}
+
+// serveEventStream observes hsURL over CoAP and writes each notification as a server-sent event, until the client
+// disconnects or the observation ends. The stream ends after a notification with an error status code, as the
+// server stops observing then.
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+func serveEventStream(w http.ResponseWriter, req *http.Request, hsURL, token string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(`{"errcode":"PROXY","error":"streaming is not supported on this connection"}`))
+		return
+	}
+	cb := &eventStreamCallback{
+		notifications: make(chan eventStreamNotification, eventStreamBufferSize),
+		closed:        make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	defer close(cb.done)
+	stream := observeStream(hsURL, token, cb)
+	if stream == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`{"errcode":"PROXY","error":"failed to observe resource on homeserver"}`))
+		return
+	}
+	defer stream.Cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-req.Context().Done():
+			logrus.WithField("path", req.URL.Path).Debug("Event stream client disconnected")
+			return
+		case <-cb.closed:
+			return
+		case n := <-cb.notifications:
+			if err := writeEvent(w, n); err != nil {
+				return
+			}
+			flusher.Flush()
+			if n.code < 200 || n.code >= 300 {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes a notification as an event. Notifications with an error status code are "error" events,
+// everything else is the default "message" event. The body is JSON, but may still contain newlines, which must
+// be split over several data lines.
+func writeEvent(w io.Writer, n eventStreamNotification) error {
+	var b strings.Builder
+	if n.code < 200 || n.code >= 300 {
+		b.WriteString("event: error\n")
+		if n.body == "" {
+			n.body = fmt.Sprintf(`{"errcode":"PROXY","error":"homeserver returned HTTP %d"}`, n.code)
+		}
+	}
+	for _, line := range strings.Split(n.body, "\n") {
+		b.WriteString("data: ")
+		b.WriteString(strings.TrimSuffix(line, "\r"))
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/lb/mobile"
+)
+
+type mockEventStream struct {
+	hsURL     string
+	token     string
+	cb        mobile.StreamCallback
+	once      sync.Once
+	cancelled chan struct{}
+}
+
+func (s *mockEventStream) Cancel() {
+	s.once.Do(func() {
+		close(s.cancelled)
+		s.cb.OnClosed()
+	})
+}
+
+// readEvent reads lines up to the blank line which ends an event
+func readEvent(t *testing.T, scanner *bufio.Scanner) []string {
+	t.Helper()
+	var lines []string
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			return lines
+		}
+		lines = append(lines, scanner.Text())
+	}
+	t.Fatalf("stream ended mid-event after %v: %v", lines, scanner.Err())
+	return nil
+}
+
+func TestEventStream(t *testing.T) {
+	streams := make(chan *mockEventStream, 1)
+	oldObserveStream, oldHomeserverAddr := observeStream, *homeserverAddr
+	observeStream = func(hsURL, token string, cb mobile.StreamCallback) eventStream {
+		s := &mockEventStream{hsURL: hsURL, token: token, cb: cb, cancelled: make(chan struct{})}
+		streams <- s
+		return s
+	}
+	*homeserverAddr = "example.com:8008"
+	t.Cleanup(func() {
+		observeStream, *homeserverAddr = oldObserveStream, oldHomeserverAddr
+	})
+	srv := httptest.NewServer(streamStatusHandler(http.HandlerFunc(handler)))
+	defer srv.Close()
+
+	connect := func(path string) (*http.Response, *mockEventStream) {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Do: %s", err)
+		}
+		if res.StatusCode != 200 || res.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("got HTTP %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+		}
+		return res, <-streams
+	}
+
+	t.Run("client disconnect cancels the observation", func(t *testing.T) {
+		res, s := connect("/_matrix/client/unstable/org.example/stream?filter=1")
+		if want := "//example.com:8008/_matrix/client/unstable/org.example/stream?filter=1"; s.hsURL != want || s.token != "secret" {
+			t.Errorf("observed %s with token %s, want %s with token secret", s.hsURL, s.token, want)
+		}
+		scanner := bufio.NewScanner(res.Body)
+		s.cb.OnNotification(200, `{"n":1}`)
+		if got, want := readEvent(t, scanner), []string{`data: {"n":1}`}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got event %v want %v", got, want)
+		}
+		s.cb.OnNotification(200, "{\n\"n\":2\n}")
+		if got, want := readEvent(t, scanner), []string{`data: {`, `data: "n":2`, `data: }`}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got event %v want %v", got, want)
+		}
+		res.Body.Close()
+		select {
+		case <-s.cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("observation was not cancelled when the client disconnected")
+		}
+		// late notifications must not block the connection
+		done := make(chan struct{})
+		go func() {
+			s.cb.OnNotification(200, `{"n":3}`)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("notification after disconnect blocked")
+		}
+	})
+
+	t.Run("error notification ends the stream", func(t *testing.T) {
+		res, s := connect("/_matrix/client/unstable/org.example/stream")
+		defer res.Body.Close()
+		scanner := bufio.NewScanner(res.Body)
+		s.cb.OnNotification(502, "")
+		want := []string{"event: error", `data: {"errcode":"PROXY","error":"homeserver returned HTTP 502"}`}
+		if got := readEvent(t, scanner); !reflect.DeepEqual(got, want) {
+			t.Errorf("got event %v want %v", got, want)
+		}
+		for scanner.Scan() {
+			t.Errorf("unexpected line after error: %s", scanner.Text())
+		}
+		select {
+		case <-s.cancelled:
+		default:
+			t.Errorf("observation was not cancelled after the stream ended")
+		}
+	})
+
+	t.Run("requests without Accept are not streamed", func(t *testing.T) {
+		if wantsEventStream(httptest.NewRequest("GET", "/sync", nil)) {
+			t.Errorf("request without Accept wants an event stream")
+		}
+		req := httptest.NewRequest("GET", "/sync", nil)
+		req.Header.Set("Accept", "application/json, text/event-stream;q=0.9")
+		if !wantsEventStream(req) {
+			t.Errorf("request accepting text/event-stream does not want an event stream")
+		}
+		req = httptest.NewRequest("PUT", "/sync", strings.NewReader("{}"))
+		req.Header.Set("Accept", "text/event-stream")
+		if wantsEventStream(req) {
+			t.Errorf("PUT request wants an event stream")
+		}
+	})
+}
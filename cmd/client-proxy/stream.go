@@ -0,0 +1,104 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// streamStatusTrailer is sent after the body to say whether the body is complete
+const streamStatusTrailer = "X-LB-Stream-Status"
+
+const (
+	streamStatusOK        = "ok"
+	streamStatusTruncated = "truncated"
+)
+
+// streamStatusHandler tells clients whether a streamed media body is complete, as an error can happen after the
+// status code and headers have been sent, e.g the upstream connection failing mid-download. Buffered responses
+// know their length up front and send Content-Length instead, so they must not be wrapped. HTTP/1.1 clients are
+// sent the X-LB-Stream-Status trailer with "ok" or "truncated". HTTP/1.0 clients cannot be sent trailers, so
+// the connection is closed before the end of the body instead, which they see as a body shorter than
+// Content-Length, or no response at all.
+func streamStatusHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sw := &streamStatusWriter{
+			ResponseWriter: w,
+			trailers:       req.ProtoAtLeast(1, 1),
+		}
+		defer func() {
+			r := recover()
+			if r != nil && r != http.ErrAbortHandler {
+				panic(r)
+			}
+			status := streamStatusOK
+			if r != nil {
+				status = streamStatusTruncated
+				logrus.WithField("path", req.URL.Path).Warn("Response body was truncated")
+			}
+			if !sw.trailers {
+				if r != nil {
+					// abort the connection so the client sees less than Content-Length
+					panic(r)
+				}
+				return
+			}
+			if !sw.wroteHeader {
+				sw.WriteHeader(http.StatusOK)
+			}
+			sw.Header().Set(streamStatusTrailer, status)
+		}()
+		next.ServeHTTP(sw, req)
+	})
+}
+
+// streamStatusWriter announces the X-LB-Stream-Status trailer before the headers are written
+type streamStatusWriter struct {
+	http.ResponseWriter
+	trailers    bool
+	wroteHeader bool
+}
+
+func (w *streamStatusWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.trailers {
+		// trailers are only sent with chunked responses, which can't have a Content-Length
+		w.Header().Del("Content-Length")
+		w.Header().Add("Trailer", streamStatusTrailer)
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *streamStatusWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush allows streaming handlers like httputil.ReverseProxy to flush through this writer
+func (w *streamStatusWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
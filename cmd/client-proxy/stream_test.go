@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func TestStreamStatusTrailer(t *testing.T) {
+	// an upstream which sends half of the body it promised, then closes the connection
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/complete" {
+			w.Write([]byte("all of the data"))
+			return
+		}
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(200)
+		w.Write([]byte("half of the data"))
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %s", err)
+			return
+		}
+		conn.Close()
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	srv := httptest.NewServer(streamStatusHandler(proxy))
+	defer srv.Close()
+
+	testCases := []struct {
+		path       string
+		wantBody   string
+		wantStatus string
+	}{
+		{path: "/complete", wantBody: "all of the data", wantStatus: streamStatusOK},
+		{path: "/truncated", wantBody: "half of the data", wantStatus: streamStatusTruncated},
+	}
+	for _, tc := range testCases {
+		res, err := http.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatalf("%s: GET failed: %s", tc.path, err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: failed to read body: %s", tc.path, err)
+		}
+		if string(body) != tc.wantBody {
+			t.Errorf("%s: got body %q want %q", tc.path, string(body), tc.wantBody)
+		}
+		if got := res.Trailer.Get(streamStatusTrailer); got != tc.wantStatus {
+			t.Errorf("%s: got %s trailer %q want %q", tc.path, streamStatusTrailer, got, tc.wantStatus)
+		}
+	}
+
+	// HTTP/1.0 clients can't read trailers, so they must see a short body
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("GET /truncated HTTP/1.0\r\n\r\n")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	// the response may be aborted before the headers have been sent
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Trailer") != "" {
+		t.Errorf("HTTP/1.0 response announced trailers: %s", res.Header.Get("Trailer"))
+	}
+	if body, err := ioutil.ReadAll(res.Body); err == nil {
+		t.Errorf("HTTP/1.0 response was not truncated, read %q", string(body))
+	}
+}
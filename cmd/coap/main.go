@@ -152,6 +152,8 @@ func mainDTLS(targetURL string, keyLogWriter io.Writer) {
 	}
 	dtlsConfig := &piondtls.Config{
 		InsecureSkipVerify: flagInsecure,
+		// pion/dtls only checks the certificate is for the host with a ServerName
+		ServerName:         turl.Hostname(),
 		KeyLogWriter:       keyLogWriter,
 	}
 	co, err := dtls.Dial(turl.Host, dtlsConfig,
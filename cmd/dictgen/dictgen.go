@@ -0,0 +1,248 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/lb"
+)
+
+// corpus counts the keys and string values of sample JSON documents
+type corpus struct {
+	docs   []json.RawMessage
+	keys   map[string]int
+	values map[string]int
+}
+
+func newCorpus() *corpus {
+	return &corpus{
+		keys:   make(map[string]int),
+		values: make(map[string]int),
+	}
+}
+
+// add counts the keys and values of the JSON documents read from r, which may be several documents one after the
+// other e.g one per line
+func (c *corpus) add(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var doc json.RawMessage
+		if err := decoder.Decode(&doc); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("document %d: %w", len(c.docs)+1, err)
+		}
+		var v interface{}
+		if err := json.Unmarshal(doc, &v); err != nil {
+			return fmt.Errorf("document %d: %w", len(c.docs)+1, err)
+		}
+		c.count(v)
+		c.docs = append(c.docs, doc)
+	}
+}
+
+func (c *corpus) count(v interface{}) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if !isIdentifier(k) {
+				c.keys[k]++
+			}
+			c.count(child)
+		}
+	case []interface{}:
+		for _, child := range val {
+			c.count(child)
+		}
+	case string:
+		if !isIdentifier(val) {
+			c.values[val]++
+		}
+	}
+}
+
+// isIdentifier returns true for strings which are specific to a user or server, like user IDs, room IDs, key IDs and
+// URLs, which a dictionary shared by every client must not contain however often they are in the corpus
+func isIdentifier(s string) bool {
+	return s != "" && (strings.IndexByte("@!$#+", s[0]) >= 0 || strings.Contains(s, ":"))
+}
+
+// entry is a key or value of a proposed dictionary
+type entry struct {
+	name  string
+	count int
+	// the bytes saved across the corpus by sending this entry as its index rather than as a string
+	saving int
+}
+
+// proposal is a dictionary proposed from a corpus, with the entries in index order
+type proposal struct {
+	file   lb.DictionaryFile
+	keys   []entry
+	values []entry
+}
+
+// propose returns the dictionary of the most frequent keys and values in the corpus, with at most maxKeys keys and
+// maxValues values. Entries which appear fewer than minCount times, or which would not save any bytes, are left out.
+func propose(c *corpus, maxKeys, maxValues, minCount int) *proposal {
+	p := &proposal{
+		// keys are sent as their index
+		keys: choose(c.keys, maxKeys, minCount, cborUintSize),
+		// values are sent as tag 6 wrapping their index, and the tag takes one byte
+		values: choose(c.values, maxValues, minCount, func(i int) int { return 1 + cborUintSize(i) }),
+	}
+	p.file.Keys = make(map[string]int, len(p.keys))
+	for i, e := range p.keys {
+		p.file.Keys[e.name] = i
+	}
+	for _, e := range p.values {
+		p.file.Values = append(p.file.Values, e.name)
+	}
+	return p
+}
+
+// choose returns the most frequent of counts in index order, so the most frequent entries get the smallest indexes.
+// size returns the number of bytes entry i is sent as.
+func choose(counts map[string]int, max, minCount int, size func(i int) int) []entry {
+	var candidates []entry
+	for name, count := range counts {
+		if count >= minCount {
+			candidates = append(candidates, entry{name: name, count: count})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].count != candidates[j].count {
+			return candidates[i].count > candidates[j].count
+		}
+		return candidates[i].name < candidates[j].name
+	})
+	var chosen []entry
+	for _, e := range candidates {
+		if len(chosen) == max {
+			break
+		}
+		e.saving = e.count * (cborUintSize(len(e.name)) + len(e.name) - size(len(chosen)))
+		if e.saving > 0 {
+			chosen = append(chosen, e)
+		}
+	}
+	return chosen
+}
+
+// cborUintSize returns the number of bytes needed to encode an unsigned integer or the header for a string of length n
+func cborUintSize(n int) int {
+	switch {
+	case n < 24:
+		return 1
+	case n <= 0xff:
+		return 2
+	case n <= 0xffff:
+		return 3
+	case n <= 0xffffffff:
+		return 5
+	default:
+		return 9
+	}
+}
+
+// savings are the total sizes of the corpus in bytes as JSON and as CBOR with each dictionary
+type savings struct {
+	json     int
+	plain    int
+	v1       int
+	v2       int
+	proposed int
+}
+
+// measure encodes every document in the corpus with each dictionary
+func measure(c *corpus, p *proposal) (*savings, error) {
+	proposed, err := lb.NewCBORCodecWithValues(p.file.Keys, p.file.Values, p.file.Prefixes, false)
+	if err != nil {
+		return nil, err
+	}
+	v1 := lb.NewCBORCodecV1(false)
+	s := &savings{}
+	for _, doc := range c.docs {
+		s.json += len(doc)
+		for _, m := range []struct {
+			codec *lb.CBORCodec
+			total *int
+		}{
+			{v1.WithoutDictionary(), &s.plain},
+			{v1, &s.v1},
+			{lb.NewCBORCodecV2(false), &s.v2},
+			{proposed, &s.proposed},
+		} {
+			b, err := m.codec.JSONToCBOR(bytes.NewReader(doc))
+			if err != nil {
+				return nil, err
+			}
+			*m.total += len(b)
+		}
+	}
+	return s, nil
+}
+
+// writeReport writes the top entries of the proposal with their counts, and the projected savings
+func writeReport(w io.Writer, c *corpus, p *proposal, s *savings, top int) {
+	fmt.Fprintf(w, "%d documents, %d distinct keys, %d distinct values\n\n", len(c.docs), len(c.keys), len(c.values))
+	for _, list := range []struct {
+		name    string
+		entries []entry
+	}{
+		{"keys", p.keys},
+		{"values", p.values},
+	} {
+		saved := 0
+		for _, e := range list.entries {
+			saved += e.saving
+		}
+		fmt.Fprintf(w, "%d %s, saving %d bytes:\n", len(list.entries), list.name, saved)
+		for i, e := range list.entries {
+			if i == top {
+				fmt.Fprintf(w, "  ... %d more\n", len(list.entries)-top)
+				break
+			}
+			fmt.Fprintf(w, "  %4d %-40q %8d times %8d bytes\n", i, e.name, e.count, e.saving)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "JSON                 %10d bytes\n", s.json)
+	for _, size := range []struct {
+		name  string
+		bytes int
+	}{
+		{"CBOR", s.plain},
+		{"CBOR v1 dictionary", s.v1},
+		{"CBOR v2 dictionary", s.v2},
+		{"CBOR proposed", s.proposed},
+	} {
+		fmt.Fprintf(w, "%-20s %10d bytes %5.1f%% smaller than JSON\n", size.name, size.bytes, percentSmaller(s.json, size.bytes))
+	}
+	fmt.Fprintf(w, "The proposed dictionary is %.1f%% smaller than v2\n", percentSmaller(s.v2, s.proposed))
+}
+
+func percentSmaller(before, after int) float64 {
+	if before == 0 {
+		return 0
+	}
+	return 100 * float64(before-after) / float64(before)
+}
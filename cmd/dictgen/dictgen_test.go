@@ -0,0 +1,155 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/lb"
+)
+
+// testCorpus is two /sync responses, one per line, with five events between them. Two events have unsigned.
+func testCorpus() string {
+	event := func(n int, unsigned bool) string {
+		ev := fmt.Sprintf(`{"type":"m.room.message","sender":"@alice:example.com","event_id":"$%d","origin_server_ts":%d,`+
+			`"content":{"msgtype":"m.text","body":"hello"}`, n, 1620000000000+n)
+		if unsigned {
+			ev += `,"unsigned":{"age":1}`
+		}
+		return ev + "}"
+	}
+	sync := func(batch string, events ...string) string {
+		return `{"next_batch":"` + batch + `","rooms":{"join":{"!room:example.com":{"timeline":{"events":[` +
+			strings.Join(events, ",") + `],"limited":false}}}}}`
+	}
+	return sync("s1", event(1, true), event(2, true), event(3, false)) + "\n" + sync("s2", event(4, false), event(5, false))
+}
+
+func names(entries []entry) []string {
+	var n []string
+	for _, e := range entries {
+		n = append(n, e.name)
+	}
+	return n
+}
+
+func TestProposeDictionary(t *testing.T) {
+	c := newCorpus()
+	if err := c.add(strings.NewReader(testCorpus())); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+	if len(c.docs) != 2 {
+		t.Fatalf("got %d documents want 2", len(c.docs))
+	}
+	testCases := []struct {
+		name       string
+		maxKeys    int
+		minCount   int
+		wantKeys   []string
+		wantValues []string
+	}{
+		{
+			name:    "all",
+			maxKeys: 256, minCount: 2,
+			// the keys of every event first, then ties in name order. The room ID key is an identifier.
+			wantKeys: []string{
+				"body", "content", "event_id", "msgtype", "origin_server_ts", "sender", "type",
+				"age", "events", "join", "limited", "next_batch", "rooms", "timeline", "unsigned",
+			},
+			// event and user IDs are identifiers, and sync tokens only appear once
+			wantValues: []string{"hello", "m.room.message", "m.text"},
+		},
+		{
+			name:    "min count",
+			maxKeys: 256, minCount: 3,
+			wantKeys:   []string{"body", "content", "event_id", "msgtype", "origin_server_ts", "sender", "type"},
+			wantValues: []string{"hello", "m.room.message", "m.text"},
+		},
+		{
+			name:    "max keys",
+			maxKeys: 3, minCount: 2,
+			wantKeys:   []string{"body", "content", "event_id"},
+			wantValues: []string{"hello", "m.room.message", "m.text"},
+		},
+	}
+	for _, tc := range testCases {
+		p := propose(c, tc.maxKeys, 256, tc.minCount)
+		if got := names(p.keys); !reflect.DeepEqual(got, tc.wantKeys) {
+			t.Errorf("%s: got keys %v want %v", tc.name, got, tc.wantKeys)
+		}
+		if got := names(p.values); !reflect.DeepEqual(got, tc.wantValues) {
+			t.Errorf("%s: got values %v want %v", tc.name, got, tc.wantValues)
+		}
+		for i, k := range tc.wantKeys {
+			if p.file.Keys[k] != i {
+				t.Errorf("%s: key %s is %d want %d", tc.name, k, p.file.Keys[k], i)
+			}
+		}
+	}
+
+	p := propose(c, 256, 256, 2)
+	// body is 5 bytes as a CBOR string and 1 byte as a key, 5 times
+	if p.keys[0].count != 5 || p.keys[0].saving != 20 {
+		t.Errorf("got body %+v want 5 times saving 20 bytes", p.keys[0])
+	}
+	s, err := measure(c, p)
+	if err != nil {
+		t.Fatalf("measure: %s", err)
+	}
+	if s.proposed >= s.plain || s.plain >= s.json {
+		t.Errorf("got %+v want proposed < plain CBOR < JSON", s)
+	}
+	var report bytes.Buffer
+	writeReport(&report, c, p, s, 5)
+	if !strings.Contains(report.String(), "... 10 more") {
+		t.Errorf("report does not list the top 5 keys:\n%s", report.String())
+	}
+
+	// the dictionary file round trips the corpus
+	file, err := json.Marshal(p.file)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	codec, err := lb.LoadDictionary(bytes.NewReader(file), true)
+	if err != nil {
+		t.Fatalf("LoadDictionary: %s", err)
+	}
+	for _, doc := range c.docs {
+		b, err := codec.JSONToCBOR(bytes.NewReader(doc))
+		if err != nil {
+			t.Fatalf("JSONToCBOR: %s", err)
+		}
+		got, err := codec.CBORToJSON(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("CBORToJSON: %s", err)
+		}
+		want, _ := gomatrixserverlib.CanonicalJSON(doc)
+		if string(got) != string(want) {
+			t.Errorf("round trip:\ngot  %s\nwant %s", got, want)
+		}
+	}
+}
+
+func TestCorpusInvalidJSON(t *testing.T) {
+	if err := newCorpus().add(strings.NewReader(`{"a":1}` + "\n" + `{"b":`)); err == nil {
+		t.Errorf("add accepted invalid JSON")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+var (
+	flagMaxKeys   = flag.Int("max-keys", 256, "The max number of keys in the dictionary. Keys from 256 take 3 bytes, so only long keys are worth it.")
+	flagMaxValues = flag.Int("max-values", 256, "The max number of string values in the dictionary")
+	flagMinCount  = flag.Int("min-count", 2, "Leave out keys and values which appear fewer times than this in the corpus")
+	flagTop       = flag.Int("top", 20, "The number of keys and values to list in the report")
+	flagOutput    = flag.String("out", "-", "Output file to write the dictionary to. If '-' prints to stdout")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of dictgen:\n")
+		flag.PrintDefaults()
+		fmt.Println("\nMust supply one or more files of JSON documents e.g captured /sync responses, or stdin '-'")
+		fmt.Println(`Example:  ./dictgen -out dictionary.json sync1.json sync2.json`)
+		fmt.Println(`Example:  cat responses.jsonl | ./dictgen -`)
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	c := newCorpus()
+	for _, path := range flag.Args() {
+		var err error
+		if path == "-" {
+			err = c.add(os.Stdin)
+		} else {
+			var f *os.File
+			f, err = os.Open(path)
+			if err == nil {
+				err = c.add(f)
+				f.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("FATAL reading %s: %s", path, err)
+			os.Exit(1)
+		}
+	}
+
+	p := propose(c, *flagMaxKeys, *flagMaxValues, *flagMinCount)
+	s, err := measure(c, p)
+	if err != nil {
+		log.Printf("FATAL: failed to measure the proposed dictionary: %s", err)
+		os.Exit(1)
+	}
+	// the report goes to stderr, so the dictionary can be piped
+	writeReport(os.Stderr, c, p, s, *flagTop)
+
+	output, err := json.MarshalIndent(p.file, "", "  ")
+	if err != nil {
+		log.Printf("FATAL: %s", err)
+		os.Exit(1)
+	}
+	output = append(output, '\n')
+	if *flagOutput == "-" {
+		os.Stdout.Write(output)
+	} else if err = ioutil.WriteFile(*flagOutput, output, 0644); err != nil {
+		log.Printf("FATAL writing %s: %s", *flagOutput, err)
+		os.Exit(1)
+	}
+}
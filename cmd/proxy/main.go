@@ -17,11 +17,15 @@ package main
 import (
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
 
+	"github.com/matrix-org/go-coap/v2/message"
 	"github.com/matrix-org/lb"
+	piondtls "github.com/pion/dtls/v2"
 	"github.com/sirupsen/logrus"
 )
 
@@ -31,10 +35,50 @@ var (
 	advertise    = flag.String("advertise", "",
 		"Optional: the public address of this proxy. If set, sniffs logins/registrations for homeserver discovery information and replaces the base_url with this advertising address. "+
 			"This is useful when the local server is not on the same machine as the proxy.")
-	certFile = flag.String("tls-cert", "", "The PEM formatted X509 certificate to use for TLS")
-	keyFile  = flag.String("tls-key", "", "The PEM private key to use for TLS")
+	certFile       = flag.String("tls-cert", "", "The PEM formatted X509 certificate to use for TLS")
+	keyFile        = flag.String("tls-key", "", "The PEM private key to use for TLS")
+	maxRequestSize = flag.Uint("max-request-size", 0,
+		"Optional: the maximum request body size in bytes. Larger requests are rejected with a 4.13 and the maximum size, without being forwarded. 0 means no limit.")
+	internIdentifiers = flag.Bool("intern-identifiers", false,
+		"Optional: replace user IDs, room IDs, event IDs and mxc:// URIs which are repeated within a response with references. Only enable this once all clients can decode them.")
+	compactErrors = flag.Bool("compact-errors", false,
+		"Optional: send standard Matrix error responses as a compact array of errcode, error and retry_after_ms rather than a map. Only enable this once all clients can decode them.")
+	binaryBase64 = flag.Bool("binary-base64", false,
+		"Optional: send base64 signatures, keys and hashes as raw bytes rather than base64 text. Only enable this once all clients can decode them.")
+	signedKeys = flag.Bool("signed-keys", false,
+		"Optional: send the dictionary keys from 24 to 47 as negative integers, which take one byte rather than two. Only enable this once all clients can decode them.")
+	observeWindow = flag.Int("observe-window", 0,
+		"Optional: the max number of OBSERVE notifications sent to each client at once. Waiting notifications are sent highest priority first. 0 means no limit.")
+	metricsAddr = flag.String("metrics-addr", "",
+		"Optional: the address to serve Prometheus metrics on over HTTP e.g :9090. Metrics are served at /metrics.")
+	customOptions = flag.String("custom-options", "",
+		"Optional: comma separated number=header pairs which map custom CoAP options to HTTP headers in both directions e.g 2049=X-Tenant-ID. Numbers must be from 2048 to 65535.")
+	dtlsSessionTTL = flag.Duration("dtls-session-ttl", 0,
+		"Optional: how long to keep DTLS sessions for, so clients can resume them with an abbreviated handshake e.g 24h. 0 means sessions are not resumed.")
+	stripFields = flag.String("strip-fields", "",
+		"Optional: LOSSY. Fields to strip from responses before sending them, as semicolon separated endpoint=field,field entries e.g '/sync=rooms.join.*.timeline.events.*.unsigned.age_ts'. Clients never see stripped fields.")
 )
 
+// parseCustomOptions parses the -custom-options flag
+func parseCustomOptions(s string) (lb.HeaderOptions, error) {
+	opts := make(lb.HeaderOptions)
+	for _, kv := range strings.Split(s, ",") {
+		kvs := strings.SplitN(kv, "=", 2)
+		if len(kvs) != 2 || kvs[1] == "" {
+			return nil, fmt.Errorf("%q is not of the form number=header", kv)
+		}
+		id, err := strconv.ParseUint(kvs[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%q has an invalid number: %s", kv, err)
+		}
+		if err = lb.ValidateCustomOptionID(message.OptionID(id)); err != nil {
+			return nil, err
+		}
+		opts[message.OptionID(id)] = kvs[1]
+	}
+	return opts, nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -62,15 +106,52 @@ func main() {
 		}
 	}
 
+	// v2 paths are a superset of v1, so this serves clients which know either
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV2())
+	coapHTTP.MaxRequestSize = uint32(*maxRequestSize)
+	// clients only compress paths once they see the dictionary version in the capabilities
+	coapHTTP.PathSegments = lb.NewPathSegmentsV1()
+	if *customOptions != "" {
+		opts, err := parseCustomOptions(*customOptions)
+		if err != nil {
+			logrus.WithError(err).Panicf("invalid -custom-options")
+		}
+		coapHTTP.Options = opts
+	}
+
+	codec := lb.NewCBORCodecV1(false)
+	codec.InternIdentifiers = *internIdentifiers
+	codec.CompactErrors = *compactErrors
+	codec.BinaryBase64 = *binaryBase64
+	codec.SignedKeys = *signedKeys
+
+	var fieldFilter *lb.FieldFilter
+	if *stripFields != "" {
+		fieldFilter, err = lb.NewFieldFilter(*stripFields)
+		if err != nil {
+			logrus.WithError(err).Panicf("invalid -strip-fields")
+		}
+		logrus.Warnf("Stripping fields from responses, clients will not see them: %s", *stripFields)
+	}
+
+	var sessions piondtls.SessionStore
+	if *dtlsSessionTTL > 0 {
+		sessions = newSessionStore(lb.NewLRUCache(sessionCacheBytes), *dtlsSessionTTL)
+	}
+
 	err = RunProxyServer(&Config{
-		ListenDTLS:       *dtlsBindAddr,
-		LocalAddr:        *localAddr,
-		Certificates:     certs,
-		KeyLogWriter:     keyLogWriter,
-		Advertise:        *advertise,
-		AdvertiseOnHTTPS: *advertise != "" && strings.HasPrefix(*advertise, "https://"),
-		CBORCodec:        lb.NewCBORCodecV1(false),
-		CoAPHTTP:         lb.NewCoAPHTTP(lb.NewCoAPPathV1()),
+		ListenDTLS:                  *dtlsBindAddr,
+		LocalAddr:                   *localAddr,
+		Certificates:                certs,
+		KeyLogWriter:                keyLogWriter,
+		Advertise:                   *advertise,
+		AdvertiseOnHTTPS:            *advertise != "" && strings.HasPrefix(*advertise, "https://"),
+		CBORCodec:                   codec,
+		CoAPHTTP:                    coapHTTP,
+		MetricsAddr:                 *metricsAddr,
+		FieldFilter:                 fieldFilter,
+		MaxOutstandingNotifications: *observeWindow,
+		SessionStore:                sessions,
 	})
 	if err != nil {
 		logrus.Panicf("RunProxyServer: %s", err)
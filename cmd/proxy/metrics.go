@@ -0,0 +1,78 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/matrix-org/lb"
+)
+
+const (
+	directionRequest  = "request"
+	directionResponse = "response"
+)
+
+// The endpoint label for paths which are not mapped to CoAP enum paths. These are not labelled with their path as
+// they could be anything, which would make a new time series for every path seen.
+const endpointOther = "other"
+
+// compressionRatioBuckets are the upper bounds of the compression ratio histogram buckets. The ratio is the size of
+// the CBOR body over the size of the JSON body, so lower is better.
+var compressionRatioBuckets = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1}
+
+// compressionMetrics records how well JSON bodies compress to CBOR, broken down by endpoint so operators can see
+// where the CBOR dictionary helps and where it doesn't.
+type compressionMetrics struct {
+	paths *lb.CoAPPath
+	sink  lb.MetricsSink
+}
+
+func newCompressionMetrics(paths *lb.CoAPPath, sink lb.MetricsSink) *compressionMetrics {
+	lb.DescribeMetric(sink, "lb_compression_ratio",
+		"The size of CBOR bodies as a fraction of the size of the JSON bodies they were converted from.", compressionRatioBuckets)
+	lb.DescribeMetric(sink, "lb_json_bytes_total", "The total size of JSON bodies converted to or from CBOR.", nil)
+	lb.DescribeMetric(sink, "lb_cbor_bytes_total", "The total size of CBOR bodies converted to or from JSON.", nil)
+	return &compressionMetrics{
+		paths: paths,
+		sink:  sink,
+	}
+}
+
+// endpoint returns the endpoint label for an HTTP path, which is its CoAP path mapping with the version prefix
+// removed e.g /rooms/{roomId}/messages
+func (m *compressionMetrics) endpoint(path string) string {
+	template, ok := m.paths.HTTPPathTemplate(path)
+	if !ok {
+		return endpointOther
+	}
+	template = strings.TrimPrefix(template, "/_matrix/client")
+	return strings.TrimPrefix(template, "/r0")
+}
+
+// observe records a body which was jsonSize bytes as JSON and cborSize bytes as CBOR. Empty bodies are ignored,
+// as they have no ratio. Safe to call on a nil *compressionMetrics.
+func (m *compressionMetrics) observe(path, direction string, jsonSize, cborSize int) {
+	if m == nil || jsonSize == 0 {
+		return
+	}
+	labels := map[string]string{
+		"endpoint":  m.endpoint(path),
+		"direction": direction,
+	}
+	m.sink.Histogram("lb_compression_ratio", labels, float64(cborSize)/float64(jsonSize))
+	m.sink.Counter("lb_json_bytes_total", labels, float64(jsonSize))
+	m.sink.Counter("lb_cbor_bytes_total", labels, float64(cborSize))
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/lb"
+)
+
+func TestCompressionMetrics(t *testing.T) {
+	syncBody := `{"next_batch":"s1","rooms":{"join":{"!foo:bar":{"timeline":{"events":[{"type":"m.room.message","content":{"body":"hi","msgtype":"m.text"}}]}}}}}`
+	messagesBody := `{"chunk":[],"start":"t1","end":"t2"}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case req.URL.Path == "/_matrix/client/r0/sync":
+			w.Write([]byte(syncBody))
+		case strings.HasSuffix(req.URL.Path, "/messages"):
+			w.Write([]byte(messagesBody))
+		default:
+			w.Write([]byte(`{"unknown":true}`))
+		}
+	}))
+	defer upstream.Close()
+	codec := lb.NewCBORCodecV1(false)
+	sink := lb.NewPrometheusSink()
+	cfg := &Config{
+		LocalAddr: upstream.URL,
+		CBORCodec: codec,
+		Client:    upstream.Client(),
+		metrics:   newCompressionMetrics(lb.NewCoAPPathV1(), sink),
+	}
+	handler := forwardToLocalAddr(cfg)
+	sendBody := `{"msgtype":"m.text","body":"hello world"}`
+	sendCBOR, err := codec.JSONToCBOR(bytes.NewBufferString(sendBody))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	requests := []*http.Request{
+		httptest.NewRequest("GET", "/_matrix/client/r0/sync", nil),
+		httptest.NewRequest("GET", "/_matrix/client/r0/sync?since=s1", nil),
+		httptest.NewRequest("GET", "/_matrix/client/r0/rooms/!foo:bar/messages", nil),
+		httptest.NewRequest("GET", "/_matrix/client/r0/rooms/!baz:bar/messages", nil),
+		httptest.NewRequest("GET", "/_matrix/client/r0/some/unmapped/path", nil),
+	}
+	sendReq := httptest.NewRequest("PUT", "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/txn1", bytes.NewReader(sendCBOR))
+	sendReq.Header.Set("Content-Type", "application/cbor")
+	requests = append(requests, sendReq)
+	for _, req := range requests {
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%s: got HTTP %d", req.URL.Path, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	sink.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := w.Body.String()
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(metrics, "\n") {
+		lines[line] = true
+	}
+
+	// the lines for a body: the bucket it should be in, the bucket below it, and the totals
+	bucketLines := func(labels, jsonBody string, cborSize, count int) []string {
+		ratio := float64(cborSize) / float64(len(jsonBody))
+		i := sort.SearchFloat64s(compressionRatioBuckets, ratio)
+		var want []string
+		if i > 0 {
+			want = append(want, fmt.Sprintf(`lb_compression_ratio_bucket{%s,le="%s"} 0`, labels, strconv.FormatFloat(compressionRatioBuckets[i-1], 'f', -1, 64)))
+		}
+		if i < len(compressionRatioBuckets) {
+			want = append(want, fmt.Sprintf(`lb_compression_ratio_bucket{%s,le="%s"} %d`, labels, strconv.FormatFloat(compressionRatioBuckets[i], 'f', -1, 64), count))
+		}
+		return append(want,
+			fmt.Sprintf(`lb_compression_ratio_bucket{%s,le="+Inf"} %d`, labels, count),
+			fmt.Sprintf(`lb_compression_ratio_count{%s} %d`, labels, count),
+			fmt.Sprintf(`lb_json_bytes_total{%s} %d`, labels, count*len(jsonBody)),
+			fmt.Sprintf(`lb_cbor_bytes_total{%s} %d`, labels, count*cborSize),
+		)
+	}
+	cborSize := func(jsonBody string) int {
+		b, err := codec.JSONToCBOR(bytes.NewBufferString(jsonBody))
+		if err != nil {
+			t.Fatalf("JSONToCBOR: %s", err)
+		}
+		return len(b)
+	}
+	var want []string
+	want = append(want, bucketLines(`direction="response",endpoint="/sync"`, syncBody, cborSize(syncBody), 2)...)
+	// room IDs are not labels, so both rooms are in the same series
+	want = append(want, bucketLines(`direction="response",endpoint="/rooms/{roomId}/messages"`, messagesBody, cborSize(messagesBody), 2)...)
+	want = append(want, bucketLines(`direction="response",endpoint="other"`, `{"unknown":true}`, cborSize(`{"unknown":true}`), 1)...)
+	// request bodies are measured against the JSON they are converted to
+	sendJSON, err := codec.CBORToJSON(bytes.NewReader(sendCBOR))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	want = append(want, bucketLines(`direction="request",endpoint="/rooms/{roomId}/send/{eventType}/{txnId}"`, string(sendJSON), len(sendCBOR), 1)...)
+	for _, line := range want {
+		if !lines[line] {
+			t.Errorf("missing line: %s", line)
+		}
+	}
+	if strings.Contains(metrics, "!foo:bar") || strings.Contains(metrics, "unmapped") {
+		t.Errorf("metrics contain path variables:\n%s", metrics)
+	}
+	if t.Failed() {
+		t.Logf("metrics:\n%s", metrics)
+	}
+}
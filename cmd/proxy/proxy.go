@@ -62,6 +62,22 @@ type Config struct {
 	CoAPHTTP          *lb.CoAPHTTP
 	KeyLogWriter      io.Writer
 	Client            *http.Client
+	MetricsAddr       string // optional: where to serve /metrics over HTTP e.g :9090
+	// optional: where to emit metrics, from the codec, the CoAP transport and the proxy. If nil and MetricsAddr is
+	// set, they are served at MetricsAddr in the Prometheus text format.
+	Metrics lb.MetricsSink
+	// optional: fields to strip from successful JSON responses before they are converted to CBOR. This is lossy.
+	FieldFilter *lb.FieldFilter
+	// optional: the max number of notifications sent to each client at once, see
+	// lb.Observations.MaxOutstandingNotifications. 0 means no limit.
+	MaxOutstandingNotifications int
+	// optional: where to emit the spans of requests which carry a trace context, see lb.CoAPHTTP.Spans
+	Spans lb.SpanSink
+	// optional: where to keep DTLS sessions, so clients can resume them with an abbreviated handshake. If nil, every
+	// handshake is a full one.
+	SessionStore piondtls.SessionStore
+
+	metrics *compressionMetrics
 }
 
 type handler interface {
@@ -93,14 +109,23 @@ func forwardToLocalAddr(cfg *Config) http.HandlerFunc {
 			w.Write([]byte(`Failed to read request body: ` + err.Error()))
 			return
 		}
-		if req.Header.Get("Content-Type") == "application/cbor" {
-			body, err = cfg.CBORCodec.CBORToJSON(bytes.NewBuffer(body))
+		// clients which negotiated v2 or asked for plain CBOR say so in the Content-Type and Accept
+		if reqCodec := cfg.CBORCodec.ForContentType(req.Header.Get("Content-Type")); reqCodec != nil {
+			cborSize := len(body)
+			body, err = reqCodec.CBORToJSON(bytes.NewBuffer(body))
 			if err != nil {
 				logrus.WithError(err).Error("failed to convert incoming request body from JSON to CBOR")
 				w.WriteHeader(500)
 				w.Write([]byte(`Failed to convert CBOR to JSON: ` + err.Error()))
 				return
 			}
+			req.Header.Set("Content-Type", "application/json")
+			cfg.metrics.observe(req.URL.Path, directionRequest, len(body), cborSize)
+		}
+		resCodec, resContentType := cfg.CBORCodec.ForAccept(req.Header.Get("Accept"))
+		if resContentType != "application/cbor" {
+			// the homeserver only speaks JSON, so doesn't need to know
+			req.Header.Del("Accept")
 		}
 		reqURL := *req.URL
 		reqURL.Scheme = localURL.Scheme
@@ -119,6 +144,10 @@ func forwardToLocalAddr(cfg *Config) http.HandlerFunc {
 				newReq.Header.Add(k, v)
 			}
 		}
+		// forward the Host for virtual hosted homeservers if the client sent Uri-Host, else it is localhost
+		if req.Host != "localhost" {
+			newReq.Host = req.Host
+		}
 		res, err := cfg.Client.Do(newReq)
 		if err != nil {
 			logrus.WithError(err).Error("failed to contact local address")
@@ -126,7 +155,7 @@ func forwardToLocalAddr(cfg *Config) http.HandlerFunc {
 			w.Write([]byte("Failed to contact local address"))
 			return
 		}
-		resBody := writeResponse(cfg, res, w)
+		resBody := writeResponse(cfg, req.URL.Path, res, w, resCodec, resContentType)
 		if res.StatusCode != 200 {
 			logrus.Warnf("%s %s returned %d from local address with body: %s",
 				newReq.Method, reqURL.String(), res.StatusCode, string(resBody))
@@ -136,7 +165,8 @@ func forwardToLocalAddr(cfg *Config) http.HandlerFunc {
 	}
 }
 
-func writeResponse(cfg *Config, res *http.Response, w http.ResponseWriter) []byte {
+// writeResponse converts the homeserver's response to CBOR with codec, labelled with contentType, and writes it to w
+func writeResponse(cfg *Config, path string, res *http.Response, w http.ResponseWriter, codec *lb.CBORCodec, contentType string) []byte {
 	var resBody []byte
 	if res.Body != nil {
 		defer res.Body.Close()
@@ -165,14 +195,23 @@ func writeResponse(cfg *Config, res *http.Response, w http.ResponseWriter) []byt
 				}
 			}
 		}
+		if cfg.FieldFilter != nil && len(jsonBody) > 0 && res.StatusCode >= 200 && res.StatusCode < 300 {
+			filtered, err := cfg.FieldFilter.Filter(path, jsonBody)
+			if err != nil {
+				logrus.WithError(err).Warn("failed to strip fields from response, sending it as-is")
+			} else {
+				jsonBody = filtered
+			}
+		}
 		if len(jsonBody) > 0 {
-			resBody, err = cfg.CBORCodec.JSONToCBOR(bytes.NewBuffer(jsonBody))
+			resBody, err = codec.JSONToCBOR(bytes.NewBuffer(jsonBody))
 			if err != nil {
 				logrus.WithError(err).WithField("body", string(jsonBody)).Error("failed to convert response body from JSON to CBOR")
 				w.WriteHeader(http.StatusBadGateway)
 				w.Write([]byte("Failed to convert response body from JSON to CBOR"))
 				return resBody
 			}
+			cfg.metrics.observe(path, directionResponse, len(jsonBody), len(resBody))
 		}
 	}
 	for k, vs := range res.Header {
@@ -180,6 +219,9 @@ func writeResponse(cfg *Config, res *http.Response, w http.ResponseWriter) []byt
 			w.Header().Add(k, v)
 		}
 	}
+	if len(resBody) > 0 {
+		w.Header().Set("Content-Type", contentType)
+	}
 	w.WriteHeader(res.StatusCode)
 	w.Write(resBody)
 	return resBody
@@ -191,6 +233,9 @@ func (l *logger) Printf(format string, v ...interface{}) {
 	logrus.Infof(format+"\n", v...)
 }
 
+// blockwiseSZX is the largest block size used for block-wise transfers
+const blockwiseSZX = blockwise.SZX1024
+
 // listenAndServeDTLS Starts a server on address and network over DTLS specified Invoke handler
 // for incoming queries.
 func listenAndServeDTLS(network string, addr string, config *piondtls.Config, waitACK time.Duration, handler coapmux.Handler) error {
@@ -241,16 +286,46 @@ func listenAndServeDTLS(network string, addr string, config *piondtls.Config, wa
 			timer.Stop()
 		}),
 		// increase transfer time from 5s to 2min due to large inital sync responses
-		dtls.WithBlockwise(true, blockwise.SZX1024, 2*time.Minute),
+		dtls.WithBlockwise(true, blockwiseSZX, 2*time.Minute),
 	)
 	return s.Serve(l)
 }
 
+// newCoAPRouter returns the router for CoAP requests, which converts them to HTTP and CBOR to JSON then forwards them
+// to cfg.LocalAddr
+func newCoAPRouter(cfg *Config) *coapmux.Router {
+	r := coapmux.NewRouter()
+	handler := http.HandlerFunc(forwardToLocalAddr(cfg))
+	observations := lb.NewSyncObservations(handler, cfg.CoAPHTTP.Paths, cfg.CBORCodec)
+	observations.Log = &logger{}
+	cfg.CoAPHTTP.Log = &logger{}
+	observations.Metrics = cfg.Metrics
+	observations.MaxOutstandingNotifications = cfg.MaxOutstandingNotifications
+	cfg.CoAPHTTP.Metrics = cfg.Metrics
+	if cfg.Spans != nil {
+		cfg.CoAPHTTP.Spans = cfg.Spans
+	}
+	caps := lb.Capabilities{
+		BlockSize:          int(blockwiseSZX.Size()),
+		DictionaryVersion:  lb.DictionaryV1,
+		DictionaryVersions: lb.DictionaryVersions,
+		Observe:            true,
+	}
+	if cfg.CoAPHTTP.PathSegments != nil {
+		caps.PathSegmentsVersion = cfg.CoAPHTTP.PathSegments.Version()
+	}
+	r.DefaultHandle(cfg.CoAPHTTP.CoAPHTTPHandler(
+		lb.CapabilitiesHandler(lb.BatchHandler(handler, cfg.CBORCodec), cfg.CBORCodec, caps), observations,
+	))
+	return r
+}
+
 func RunProxyServer(cfg *Config) error {
 	// run the DTLS server
 	dtlsConfig := &piondtls.Config{
 		Certificates: cfg.Certificates,
 		KeyLogWriter: cfg.KeyLogWriter,
+		SessionStore: cfg.SessionStore,
 	}
 
 	if cfg.Client == nil {
@@ -263,15 +338,25 @@ func RunProxyServer(cfg *Config) error {
 		cfg.WaitTimeBeforeACK = 5 * time.Second
 	}
 
+	if cfg.Metrics == nil && cfg.MetricsAddr != "" {
+		sink := lb.NewPrometheusSink()
+		cfg.Metrics = sink
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", sink)
+			logrus.Infof("Serving metrics on %s/metrics", cfg.MetricsAddr)
+			if err := http.ListenAndServe(cfg.MetricsAddr, mux); err != nil {
+				logrus.WithError(err).Panicf("failed to serve metrics")
+			}
+		}()
+	}
+	if cfg.Metrics != nil {
+		cfg.metrics = newCompressionMetrics(cfg.CoAPHTTP.Paths, cfg.Metrics)
+		cfg.CBORCodec.Metrics = cfg.Metrics
+	}
+
 	go func() {
-		r := coapmux.NewRouter()
-		handler := http.HandlerFunc(forwardToLocalAddr(cfg))
-		observations := lb.NewSyncObservations(handler, cfg.CoAPHTTP.Paths, cfg.CBORCodec)
-		observations.Log = &logger{}
-		cfg.CoAPHTTP.Log = &logger{}
-		r.DefaultHandle(cfg.CoAPHTTP.CoAPHTTPHandler(
-			handler, observations,
-		))
+		r := newCoAPRouter(cfg)
 		logrus.Infof("Listening for DTLS on %s - ACK piggyback period: %v", cfg.ListenDTLS, cfg.WaitTimeBeforeACK)
 		if err := listenAndServeDTLS("udp", cfg.ListenDTLS, dtlsConfig, cfg.WaitTimeBeforeACK, r); err != nil {
 			logrus.WithError(err).Panicf("Failed to ListenAndServeDTLS")
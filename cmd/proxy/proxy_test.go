@@ -0,0 +1,147 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	coapnet "github.com/matrix-org/go-coap/v2/net"
+	"github.com/matrix-org/lb"
+	"github.com/matrix-org/lb/mobile"
+	piondtls "github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+)
+
+// startProxy runs the proxy's CoAP handling over DTLS in front of the homeserver given, and allows its self-signed
+// certificate in the mobile client. Returns the https:// URL to use with mobile.SendRequest.
+func startProxy(t *testing.T, homeserver *httptest.Server) string {
+	t.Helper()
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %s", err)
+	}
+	l, err := coapnet.NewDTLSListener("udp", "127.0.0.1:0", &piondtls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV2())
+	coapHTTP.PathSegments = lb.NewPathSegmentsV1()
+	cfg := &Config{
+		LocalAddr: homeserver.URL,
+		CBORCodec: lb.NewCBORCodecV1(false),
+		CoAPHTTP:  coapHTTP,
+		Client:    homeserver.Client(),
+	}
+	s := dtls.NewServer(
+		dtls.WithMux(newCoAPRouter(cfg)),
+		dtls.WithBlockwise(true, blockwiseSZX, time.Minute),
+	)
+	go s.Serve(l)
+	oldParams := *mobile.Params()
+	t.Cleanup(func() {
+		mobile.SetParams(&oldParams)
+		s.Stop()
+		l.Close()
+	})
+	return "https://" + l.Addr().String()
+}
+
+// TestProxyDictionary checks that a mobile client's request and response bodies are converted between JSON and CBOR
+// with the dictionary it negotiated with the proxy
+func TestProxyDictionary(t *testing.T) {
+	// the keys and values are only in the v2 dictionary
+	reqJSON := `{"algorithm":"m.megolm.v1.aes-sha2","ciphertext":"AwgAEnAC","device_id":"ABCDEF","sender_key":"abc","session_id":"xyz"}`
+	resJSON := `{"device_keys":{"@alice:localhost":{"ABCDEF":{"algorithms":["m.olm.v1.curve25519-aes-sha2","m.megolm.v1.aes-sha2"]}}}}`
+	var mu sync.Mutex
+	var gotBody, gotContentType, gotAccept string
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		gotBody, gotContentType, gotAccept = string(body), req.Header.Get("Content-Type"), req.Header.Get("Accept")
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(resJSON))
+	}))
+	defer homeserver.Close()
+
+	testCases := []struct {
+		name         string
+		dictionaryV2 bool
+		noDictionary bool
+		// the dictionary the response reports it was encoded with
+		wantDictionary string
+	}{
+		{name: "v1", dictionaryV2: false, wantDictionary: lb.DictionaryV1},
+		{name: "v2", dictionaryV2: true, wantDictionary: lb.DictionaryV2},
+		// X-LB-No-Dictionary
+		{name: "plain CBOR", dictionaryV2: true, noDictionary: true, wantDictionary: "none"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hsURL := startProxy(t, homeserver)
+			cp := mobile.Params()
+			cp.InsecureSkipVerify = true
+			cp.DictionaryV2 = tc.dictionaryV2
+			if err := mobile.SetParams(cp); err != nil {
+				t.Fatalf("SetParams: %s", err)
+			}
+			res := mobile.SendRequestWithOptions(
+				"PUT", hsURL+"/_matrix/client/r0/rooms/!a:localhost/send/m.room.encrypted/1", "", reqJSON,
+				&mobile.SendOptions{NoDictionary: tc.noDictionary},
+			)
+			if res == nil || res.Code != 200 {
+				t.Fatalf("SendRequest: got %+v", res)
+			}
+			assertJSONEqual(t, "response body", res.Body, resJSON)
+			if res.Dictionary != tc.wantDictionary {
+				t.Errorf("got response Dictionary %q want %q", res.Dictionary, tc.wantDictionary)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			assertJSONEqual(t, "homeserver request body", gotBody, reqJSON)
+			if gotContentType != "application/json" {
+				t.Errorf("homeserver got Content-Type %q want application/json", gotContentType)
+			}
+			if gotAccept != "" {
+				t.Errorf("homeserver got Accept %q want none", gotAccept)
+			}
+		})
+	}
+}
+
+func assertJSONEqual(t *testing.T, name, got, want string) {
+	t.Helper()
+	var gotVal, wantVal interface{}
+	if err := json.Unmarshal([]byte(got), &gotVal); err != nil {
+		t.Errorf("%s is not JSON: %s: %s", name, err, got)
+		return
+	}
+	json.Unmarshal([]byte(want), &wantVal)
+	if !reflect.DeepEqual(gotVal, wantVal) {
+		t.Errorf("%s: got %s want %s", name, got, want)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/matrix-org/lb"
+	piondtls "github.com/pion/dtls/v2"
+)
+
+// sessionCacheBytes bounds the memory used by DTLS sessions. Each is a 48 byte master secret keyed by a 32 byte
+// session ID, so this holds tens of thousands.
+const sessionCacheBytes = 2 * 1024 * 1024
+
+// sessionStore keeps the DTLS sessions of clients, so they can resume them with an abbreviated handshake rather than
+// a full one, e.g after the app restarts. Sessions are forgotten after the ttl, or sooner if the cache is full, after
+// which clients do a full handshake.
+type sessionStore struct {
+	cache lb.Cache
+	ttl   time.Duration
+}
+
+func newSessionStore(cache lb.Cache, ttl time.Duration) *sessionStore {
+	return &sessionStore{
+		cache: cache,
+		ttl:   ttl,
+	}
+}
+
+// Set implements piondtls.SessionStore. The server keys sessions by their ID.
+func (s *sessionStore) Set(key []byte, session piondtls.Session) error {
+	s.cache.Set(string(key), session.Secret, s.ttl)
+	return nil
+}
+
+// Get implements piondtls.SessionStore, returning an empty session if the session has been forgotten
+func (s *sessionStore) Get(key []byte) (piondtls.Session, error) {
+	secret, ok := s.cache.Get(string(key))
+	if !ok {
+		return piondtls.Session{}, nil
+	}
+	return piondtls.Session{ID: key, Secret: secret}, nil
+}
+
+// Del implements piondtls.SessionStore
+func (s *sessionStore) Del(key []byte) error {
+	s.cache.Delete(string(key))
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/lb"
+	piondtls "github.com/pion/dtls/v2"
+)
+
+func TestSessionStore(t *testing.T) {
+	s := newSessionStore(lb.NewLRUCache(sessionCacheBytes), time.Hour)
+	id := []byte("session-id")
+	if got, err := s.Get(id); err != nil || got.ID != nil {
+		t.Fatalf("Get of an unknown session: got %+v, %v want an empty session", got, err)
+	}
+	if err := s.Set(id, piondtls.Session{ID: id, Secret: []byte("secret")}); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	got, err := s.Get(id)
+	if err != nil || !bytes.Equal(got.ID, id) || string(got.Secret) != "secret" {
+		t.Errorf("Get: got %+v, %v want the session", got, err)
+	}
+	if err = s.Del(id); err != nil {
+		t.Fatalf("Del: %s", err)
+	}
+	if got, err = s.Get(id); err != nil || got.ID != nil {
+		t.Errorf("Get of a deleted session: got %+v, %v want an empty session", got, err)
+	}
+}
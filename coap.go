@@ -43,6 +43,7 @@ func init() {
 	for k, v := range statusCodes {
 		responseCodes[v] = k
 	}
+	responseCodes[codes.Changed] = http.StatusOK
 	for k, v := range contentTypeToContentFormat {
 		contentFormatToContentType[v] = k
 	}
@@ -75,6 +76,7 @@ func init() {
 // | 4.12 Precondition Failed      | 412 Precondition Failed    |      |
 // | 4.13 Request Ent. Too Large   | 413 Payload Too Large      | 11   |
 // | 4.15 Unsupported Content-Fmt. | 415 Unsupported Media Type |      |
+// | 4.29 Too Many Requests        | 429 Too Many Requests      |      |
 // | 5.00 Internal Server Error    | 500 Internal Server Error  |      |
 // | 5.01 Not Implemented          | 501 Not Implemented        |      |
 // | 5.02 Bad Gateway              | 502 Bad Gateway            |      |
@@ -86,23 +88,56 @@ func init() {
 // 			  Table 2: CoAP-HTTP Response Code Mappings
 var statusCodes = map[int]codes.Code{
 	http.StatusOK:                    codes.Content,               // 200
+	http.StatusCreated:               codes.Created,               // 201
+	http.StatusNotModified:           codes.Valid,                 // 304
 	http.StatusBadRequest:            codes.BadRequest,            // 400
 	http.StatusUnauthorized:          codes.Unauthorized,          // 401
 	http.StatusForbidden:             codes.Forbidden,             // 403
 	http.StatusNotFound:              codes.NotFound,              // 404
 	http.StatusMethodNotAllowed:      codes.MethodNotAllowed,      // 405
+	http.StatusPreconditionFailed:    codes.PreconditionFailed,    // 412
 	http.StatusRequestEntityTooLarge: codes.RequestEntityTooLarge, // 413
+	http.StatusTooManyRequests:       codeTooManyRequests,         // 429
 	http.StatusInternalServerError:   codes.InternalServerError,   // 500
 	http.StatusBadGateway:            codes.BadGateway,            // 502
+	http.StatusServiceUnavailable:    codes.ServiceUnavailable,    // 503
 	http.StatusGatewayTimeout:        codes.GatewayTimeout,        // 504
 }
 var responseCodes = map[codes.Code]int{}
 
+// coapCode returns the CoAP code to send for an HTTP status code. CoAP has no 2.02 Accepted, so a 202 is sent as 2.04
+// Changed, but 2.04 is received as a 200, as it is what other servers send for a PUT which succeeded.
+func coapCode(statusCode int) (codes.Code, bool) {
+	if statusCode == http.StatusAccepted {
+		return codes.Changed, true
+	}
+	code, ok := statusCodes[statusCode]
+	return code, ok
+}
+
+// codeTooManyRequests is 4.29 Too Many Requests from RFC 8516, which go-coap does not define. It lets clients back
+// off from rate limiting rather than treating it as a permanent failure.
+const codeTooManyRequests codes.Code = 157
+
+// ContentTypePlainCBOR is the Content-Type of CBOR bodies encoded without the dictionary of keys and values, which
+// clients can ask for with Accept to see whether a mismatch is caused by the dictionary or the base codec. It is
+// sent over CoAP as ContentFormatPlainCBOR, which is in the experimental range as it is specific to this library.
+const ContentTypePlainCBOR = "application/cbor; dictionary=none"
+const ContentFormatPlainCBOR message.MediaType = 65060
+
+// ContentTypeCBORV2 is the Content-Type of CBOR bodies encoded with the v2 dictionary, which clients send and Accept
+// once the server's Capabilities list DictionaryV2. It is sent over CoAP as ContentFormatCBORV2. application/cbor
+// bodies always use the v1 dictionary, so peers which only know v1 never misread a v2 body.
+const ContentTypeCBORV2 = "application/cbor; dictionary=v2"
+const ContentFormatCBORV2 message.MediaType = 65061
+
 var contentTypeToContentFormat = map[string]message.MediaType{
 	"application/json":         message.AppJSON,
 	"application/cbor":         message.AppCBOR,
 	"application/octet-stream": message.AppOctets,
 	"text/plain":               message.TextPlain,
+	ContentTypePlainCBOR:       ContentFormatPlainCBOR,
+	ContentTypeCBORV2:          ContentFormatCBORV2,
 }
 var contentFormatToContentType = map[message.MediaType]string{}
 
@@ -110,9 +145,18 @@ var contentFormatToContentType = map[message.MediaType]string{}
 type coapResponseWriter struct {
 	coapmux.ResponseWriter
 	headers    http.Header
+	buf        []byte
 	body       *bytes.Reader
 	logger     Logger
 	statusCode int
+	// returns the custom options to send for the response headers
+	options func(h http.Header) []message.Option
+	// if set, the access token reference to return to the client
+	tokenRef []byte
+	// if set, shortens ETags which are too long for CoAP
+	etagRefs *etagRefs
+	// true once the response has been set
+	written bool
 }
 
 func (w *coapResponseWriter) Header() http.Header {
@@ -127,9 +171,19 @@ func (w *coapResponseWriter) log(format string, v ...interface{}) {
 }
 
 func (w *coapResponseWriter) Write(b []byte) (int, error) {
-	w.body = bytes.NewReader(b)
+	// handlers may write the body in several parts, e.g http.ServeContent, so the response is the concatenation
+	w.buf = append(w.buf, b...)
+	w.body = bytes.NewReader(w.buf)
+	w.written = true
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
 
-	code, ok := statusCodes[w.statusCode]
+	code, ok := coapCode(w.statusCode)
+	contentRange, partial := contentRangeOption(w.headers)
+	if w.statusCode == http.StatusPartialContent && partial {
+		code, ok = codes.Content, true
+	}
 	if !ok {
 		w.log("cannot map HTTP status %d to CoAP code, using codes.Empty", w.statusCode)
 		code = codes.Empty
@@ -141,8 +195,30 @@ func (w *coapResponseWriter) Write(b []byte) (int, error) {
 	if !ok {
 		contentFormat = message.AppOctets
 	}
-	// TODO: convert HTTP headers to options?
-	w.ResponseWriter.SetResponse(code, contentFormat, w.body)
+	var opts []message.Option
+	if w.options != nil {
+		opts = w.options(w.headers)
+	}
+	if w.tokenRef != nil {
+		opts = append(opts, message.Option{
+			ID:    OptionIDAccessTokenRef,
+			Value: w.tokenRef,
+		})
+	}
+	if etag := w.headers.Get("ETag"); etag != "" {
+		if opt, ok := w.etagRefs.option(etag); ok {
+			opts = append(opts, opt)
+		} else {
+			w.log("cannot send ETag %s over CoAP, dropping it", etag)
+		}
+	}
+	if opt, ok := maxAgeOption(w.headers); ok {
+		opts = append(opts, opt)
+	}
+	if w.statusCode == http.StatusPartialContent && partial {
+		opts = append(opts, contentRange)
+	}
+	w.ResponseWriter.SetResponse(code, contentFormat, w.body, opts...)
 	return len(b), nil
 }
 
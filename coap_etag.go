@@ -0,0 +1,222 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/udp/client"
+)
+
+// Entity tags are used for optimistic concurrency by endpoints like MSC4108 rendezvous sessions, which only
+// update a session if its ETag matches If-Match, else return 412 Precondition Failed. They are mapped to CoAP
+// as per https://datatracker.ietf.org/doc/html/rfc8075#section-6.3.3 :
+//   ETag: "abc"        <=> ETag option "abc", on responses
+//   If-Match: "abc"    <=> If-Match option "abc"
+//   If-Match: *        <=> If-Match option with an empty value
+//   If-None-Match: *   <=> If-None-Match option
+//   If-None-Match: "a" <=> ETag option "a", on GET requests, which the server answers with 2.03 Valid (304)
+// The quotes are not sent. CoAP entity tags are at most 8 bytes, so CoAPHTTPHandler replaces longer ETags from
+// the HTTP handler with a short reference, which it swaps back when the client sends it in a request.
+
+// The max number of bytes in a CoAP ETag or If-Match option. https://datatracker.ietf.org/doc/html/rfc7252#section-5.10
+const maxETagLength = 8
+
+// encodeEntityTag returns the CoAP option value for an HTTP entity tag e.g "abc" or W/"abc"
+func encodeEntityTag(tag string) ([]byte, error) {
+	tag = strings.TrimSpace(tag)
+	if len(tag) >= 2 && tag[0] == '"' && tag[len(tag)-1] == '"' {
+		tag = tag[1 : len(tag)-1]
+	}
+	if tag == "" || len(tag) > maxETagLength {
+		return nil, fmt.Errorf("entity tag %q must be 1-%d bytes to be sent over CoAP", tag, maxETagLength)
+	}
+	return []byte(tag), nil
+}
+
+// decodeEntityTag returns the HTTP entity tag for a CoAP option value
+func decodeEntityTag(value []byte) string {
+	if strings.HasPrefix(string(value), `W/"`) {
+		return string(value)
+	}
+	return `"` + string(value) + `"`
+}
+
+// isHTTPEntityTag returns true if the CoAP option value can be sent as an HTTP entity tag. go-coap gives responses
+// which have no ETag option a binary checksum as their entity tag, which would corrupt an HTTP header.
+// https://datatracker.ietf.org/doc/html/rfc7232#section-2.3
+func isHTTPEntityTag(value []byte) bool {
+	tag := string(value)
+	if strings.HasPrefix(tag, `W/"`) && strings.HasSuffix(tag, `"`) && len(tag) > 3 {
+		tag = tag[3 : len(tag)-1]
+	}
+	if tag == "" {
+		return false
+	}
+	for i := 0; i < len(tag); i++ {
+		if c := tag[i]; c != 0x21 && (c < 0x23 || c > 0x7e) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitEntityTags splits a header like If-Match: "a", "b" into each entity tag. Entity tags cannot contain
+// commas. https://datatracker.ietf.org/doc/html/rfc7232#section-2.3
+func splitEntityTags(h http.Header, key string) []string {
+	var tags []string
+	for _, v := range h.Values(key) {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// entityTagOptions returns the CoAP options for the conditional request headers of an HTTP request
+func entityTagOptions(method string, h http.Header) ([]message.Option, error) {
+	var opts []message.Option
+	for _, tag := range splitEntityTags(h, "If-Match") {
+		if tag == "*" {
+			opts = append(opts, message.Option{ID: message.IfMatch, Value: []byte{}})
+			continue
+		}
+		v, err := encodeEntityTag(tag)
+		if err != nil {
+			return nil, fmt.Errorf("If-Match: %w", err)
+		}
+		opts = append(opts, message.Option{ID: message.IfMatch, Value: v})
+	}
+	for _, tag := range splitEntityTags(h, "If-None-Match") {
+		if tag == "*" {
+			opts = append(opts, message.Option{ID: message.IfNoneMatch, Value: []byte{}})
+			continue
+		}
+		// CoAP only has entity tags on requests to validate a cached GET response
+		if method != "GET" {
+			return nil, fmt.Errorf("If-None-Match: entity tags can only be sent over CoAP on GET requests")
+		}
+		v, err := encodeEntityTag(tag)
+		if err != nil {
+			return nil, fmt.Errorf("If-None-Match: %w", err)
+		}
+		opts = append(opts, message.Option{ID: message.ETag, Value: v})
+	}
+	return opts, nil
+}
+
+// setEntityTagHeaders sets the conditional request headers for the CoAP request options
+func setEntityTagHeaders(opts message.Options, h http.Header) {
+	var ifMatch, ifNoneMatch []string
+	for _, opt := range opts {
+		switch opt.ID {
+		case message.IfMatch:
+			if len(opt.Value) == 0 {
+				ifMatch = append(ifMatch, "*")
+			} else {
+				ifMatch = append(ifMatch, decodeEntityTag(opt.Value))
+			}
+		case message.IfNoneMatch:
+			ifNoneMatch = append(ifNoneMatch, "*")
+		case message.ETag:
+			ifNoneMatch = append(ifNoneMatch, decodeEntityTag(opt.Value))
+		}
+	}
+	if len(ifMatch) > 0 {
+		h.Set("If-Match", strings.Join(ifMatch, ", "))
+	}
+	if len(ifNoneMatch) > 0 {
+		h.Set("If-None-Match", strings.Join(ifNoneMatch, ", "))
+	}
+}
+
+const ctxValETagRefs = "ctxValETagRefs"
+
+// The max number of long ETags remembered per connection. When a connection sees more ETags than this, the oldest is
+// forgotten. Requests with a forgotten reference are sent to the HTTP handler with the reference as the entity tag,
+// which fails If-Match and passes If-None-Match, so the worst case is a 412 or a full response rather than a lost update.
+const maxETagRefs = 32
+
+// etagRefs are the short references to long ETags sent on a single connection
+type etagRefs struct {
+	mu    sync.Mutex
+	byRef map[string]string // ref -> ETag
+	order []string          // refs, oldest first
+}
+
+// etagRefsMu guards creating etagRefs for a connection
+var etagRefsMu sync.Mutex
+
+func etagRefsFor(conn *client.ClientConn) *etagRefs {
+	etagRefsMu.Lock()
+	defer etagRefsMu.Unlock()
+	refs, ok := conn.Context().Value(ctxValETagRefs).(*etagRefs)
+	if !ok {
+		refs = &etagRefs{
+			byRef: make(map[string]string),
+		}
+		conn.SetContextValue(ctxValETagRefs, refs)
+	}
+	return refs
+}
+
+// option returns the ETag option for an ETag response header, replacing it with a reference if it is too long.
+// References are derived from the ETag, so the same ETag has the same reference on every connection.
+func (t *etagRefs) option(etag string) (message.Option, bool) {
+	if v, err := encodeEntityTag(etag); err == nil {
+		return message.Option{ID: message.ETag, Value: v}, true
+	}
+	if t == nil {
+		return message.Option{}, false
+	}
+	hash := sha256.Sum256([]byte(etag))
+	ref := base64.RawURLEncoding.EncodeToString(hash[:6])
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.byRef[ref]; !ok {
+		if len(t.order) >= maxETagRefs {
+			delete(t.byRef, t.order[0])
+			t.order = t.order[1:]
+		}
+		t.byRef[ref] = etag
+		t.order = append(t.order, ref)
+	}
+	return message.Option{ID: message.ETag, Value: []byte(ref)}, true
+}
+
+// resolve swaps references in the conditional request headers for the ETags they refer to
+func (t *etagRefs) resolve(h http.Header) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range []string{"If-Match", "If-None-Match"} {
+		tags := splitEntityTags(h, key)
+		for i, tag := range tags {
+			if etag, ok := t.byRef[strings.Trim(tag, `"`)]; ok {
+				tags[i] = etag
+			}
+		}
+		if len(tags) > 0 {
+			h.Set(key, strings.Join(tags, ", "))
+		}
+	}
+}
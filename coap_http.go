@@ -16,16 +16,21 @@ package lb
 
 import (
 	"bytes"
-	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
 	coapmux "github.com/matrix-org/go-coap/v2/mux"
 	"github.com/matrix-org/go-coap/v2/udp/client"
 	udpmessage "github.com/matrix-org/go-coap/v2/udp/message"
@@ -46,6 +51,27 @@ type CoAPHTTP struct {
 	Paths *CoAPPath
 	// Custom generator for CoAP tokens. NewCoAPHTTP uses a monotonically increasing integer.
 	NextToken func() message.Token
+	// If true, HTTPRequestToCoAP sets the Uri-Host and Uri-Port options from the request URL so a
+	// single CoAP gateway can front multiple homeservers. This costs extra bytes on every request,
+	// so it is off by default. Uri-Host is omitted for IP literals, as per RFC 7252 Section 6.4.
+	URIHost bool
+	// If non-zero, CoAPHTTPHandler rejects request bodies larger than this many bytes with a
+	// 4.13 Request Entity Too Large and a Size1 option stating the maximum, as per RFC 7959 Section 4.
+	MaxRequestSize uint32
+	// Optional codec for custom CoAP options. If set, custom options are converted to and from HTTP headers
+	// on every request and response, so handlers can read and set them like any other header.
+	Options OptionCodec
+	// Optional sink for metrics about the requests CoAPHTTPHandler handles
+	Metrics MetricsSink
+	// Optional sink for the spans of traced requests CoAPHTTPHandler handles. If set, the traceparent header passed
+	// to the HTTP handler is the SpanCoAPRequest span, rather than the client's span.
+	Spans SpanSink
+	// Optional custom mapping of the paths and queries of particular endpoints, which is tried before Paths
+	PathRewriter PathRewriter
+	// Optional dictionary of path segments. If set, CoAPToHTTPRequest expands paths made with PathSegments.Compress,
+	// and HTTPRequestToCoAP compresses paths which have no enum path, so only set it for clients once the server
+	// supports the dictionary version.
+	PathSegments *PathSegments
 }
 
 // NewCoAPHTTP returns various mapping functions and a wrapped HTTP handler for transparently
@@ -60,12 +86,11 @@ func NewCoAPHTTP(paths *CoAPPath) *CoAPHTTP {
 	}
 }
 
-var count = 0
+var count uint64
 
 func counter() message.Token {
-	count++
 	buf := make([]byte, 8, 8)
-	return buf[:binary.PutUvarint(buf, uint64(count))]
+	return buf[:binary.PutUvarint(buf, atomic.AddUint64(&count, 1))]
 }
 
 func (co *CoAPHTTP) log(format string, v ...interface{}) {
@@ -75,6 +100,13 @@ func (co *CoAPHTTP) log(format string, v ...interface{}) {
 	co.Log.Printf(format, v...)
 }
 
+// observeRequest emits the metrics for a request which began at start
+func (co *CoAPHTTP) observeRequest(method string, statusCode int, start time.Time) {
+	m := metricsOrNop(co.Metrics)
+	m.Counter(metricCoAPRequests, map[string]string{"method": method, "code": strconv.Itoa(statusCode)}, 1)
+	m.Histogram(metricCoAPRequestDuration, map[string]string{"method": method}, time.Since(start).Seconds())
+}
+
 // CoAPHTTPHandler transparently wraps an HTTP handler to accept and produce CoAP.
 //
 // `Observations` is an optional and allows the HTTP request to be observed in accordance with
@@ -93,33 +125,69 @@ func (co *CoAPHTTP) CoAPHTTPHandler(next http.Handler, ob *Observations) coapmux
 		// non-confirmable only because the request for more blocks is piggy-backed off
 		// an ACK from the first block. TODO: Actually I think the fact that it's non-con is
 		// due to a go-coap bug
-		if !r.IsConfirmable {
+		//
+		// The exception to this are non-confirmable requests with a No-Response option, which
+		// clients send for fire-and-forget requests like typing notifications. These are handled
+		// like any other request: the No-Response option stops a response being sent.
+		// https://datatracker.ietf.org/doc/html/rfc7967
+		if !r.IsConfirmable && !r.Options.HasOption(message.NoResponse) {
 			if ob != nil {
 				ob.HandleBlockwise(w, r)
 			}
 			return
 		}
+		if co.MaxRequestSize > 0 && r.Body != nil {
+			size, err := r.Body.Seek(0, io.SeekEnd)
+			if err == nil && size > int64(co.MaxRequestSize) {
+				co.log("request body is %d bytes, rejecting with max size %d", size, co.MaxRequestSize)
+				w.SetResponse(codes.RequestEntityTooLarge, message.TextPlain, nil, size1Option(co.MaxRequestSize))
+				return
+			}
+			_, _ = r.Body.Seek(0, io.SeekStart)
+		}
 		req := co.CoAPToHTTPRequest(r.Message)
 		if req == nil {
 			co.log("failed to map coap request to http, ignoring")
 			return
 		}
-		// set an access token if we know it and one hasn't been given
+		// swap a token reference for the token it refers to, or issue one if the client asks for it
+		var issuedRef []byte
+		if r.Options.HasOption(OptionIDAccessTokenRef) {
+			udpConn, ok := w.Client().ClientConn().(*client.ClientConn)
+			ref, _ := r.Options.GetBytes(OptionIDAccessTokenRef)
+			var token string
+			if ok && len(ref) > 0 {
+				token, ok = tokenRefsFor(udpConn).resolve(req.Host, ref)
+			}
+			if !ok {
+				co.log("unknown access token reference %x, rejecting", ref)
+				w.SetResponse(codes.BadOption, message.TextPlain, nil)
+				return
+			}
+			if len(ref) > 0 {
+				req.Header.Set("Authorization", "Bearer "+token)
+			} else if accessToken, err := r.Options.GetString(OptionIDAccessToken); err == nil && accessToken != "" {
+				issuedRef = tokenRefsFor(udpConn).issue(req.Host, accessToken)
+			}
+		}
+		// set an access token if we know it and one hasn't been given. An empty access token means the request
+		// is deliberately unauthenticated e.g /versions, so the remembered token is not used. Tokens are
+		// remembered for the host they were sent to, as a connection may carry requests for several.
 		authHeader := req.Header.Get("Authorization")
-		if authHeader == "" {
+		_, tokenErr := r.Options.GetString(OptionIDAccessToken)
+		if authHeader == "" && tokenErr != nil {
 			// look for one on the connection
 			udpConn, ok := w.Client().ClientConn().(*client.ClientConn)
 			if ok {
-				token := udpConn.Context().Value(ctxValAccessToken)
-				if token != nil {
-					req.Header.Set("Authorization", token.(string))
+				if token := accessTokensFor(udpConn).get(req.Host); token != "" {
+					req.Header.Set("Authorization", token)
 				}
 			}
-		} else {
+		} else if authHeader != "" {
 			//set the auth header
 			udpConn, ok := w.Client().ClientConn().(*client.ClientConn)
 			if ok {
-				udpConn.SetContextValue(ctxValAccessToken, authHeader)
+				accessTokensFor(udpConn).remember(req.Host, authHeader)
 			}
 		}
 
@@ -140,11 +208,37 @@ func (co *CoAPHTTP) CoAPHTTPHandler(next http.Handler, ob *Observations) coapmux
 			}
 			return
 		}
-		next.ServeHTTP(&coapResponseWriter{
+		var etags *etagRefs
+		if udpConn, ok := w.Client().ClientConn().(*client.ClientConn); ok {
+			etags = etagRefsFor(udpConn)
+			etags.resolve(req.Header)
+		}
+		rw := &coapResponseWriter{
 			ResponseWriter: w,
 			headers:        make(http.Header),
 			logger:         co.Log,
-		}, req)
+			options:        co.encodeCustomOptions,
+			tokenRef:       issuedRef,
+			etagRefs:       etags,
+		}
+		var span *Span
+		if parent, err := ParseTraceParent(req.Header.Get(traceParentHeader)); err == nil && co.Spans != nil {
+			span = StartSpan(SpanCoAPRequest, parent)
+			span.Attributes["http.method"] = req.Method
+			span.Attributes["http.target"] = req.URL.Path
+			req.Header.Set(traceParentHeader, span.Context.String())
+		}
+		start := time.Now()
+		next.ServeHTTP(rw, req)
+		// responses without a body e.g 304 Not Modified only call WriteHeader
+		if !rw.written {
+			rw.Write(nil)
+		}
+		co.observeRequest(req.Method, rw.statusCode, start)
+		if span != nil {
+			span.Attributes["http.status_code"] = strconv.Itoa(rw.statusCode)
+			span.Finish(co.Spans, nil)
+		}
 	})
 }
 
@@ -157,6 +251,8 @@ func (co *CoAPHTTP) CoAPHTTPHandler(next http.Handler, ob *Observations) coapmux
 //   Uri-Query = "access_token=foobar"
 //   Uri-Query = "limit=5"
 //   => example.net/_matrix/client/versions?access_token=foobar&limit=5
+// If there is no Uri-Host option, the host is "localhost". If there is a Uri-Port option as well as a
+// Uri-Host option, the port is included in the host.
 func (co *CoAPHTTP) CoAPToHTTPRequest(r *message.Message) *http.Request {
 	method, ok := methodCodes[r.Code]
 	if !ok {
@@ -172,10 +268,6 @@ func (co *CoAPHTTP) CoAPToHTTPRequest(r *message.Message) *http.Request {
 	if !strings.HasPrefix(optPath, "/") {
 		optPath = "/" + optPath
 	}
-	path := co.Paths.CoAPPathToHTTPPath(optPath)
-	if strings.HasPrefix(path, "/") {
-		path = path[1:]
-	}
 	// go-coap doesn't combine queries nor does it separate key/values
 	queries, err := r.Options.Queries()
 	if err != nil && err != message.ErrOptionNotFound {
@@ -194,6 +286,17 @@ func (co *CoAPHTTP) CoAPToHTTPRequest(r *message.Message) *http.Request {
 		q = append(q, kvs[1])
 		query[kvs[0]] = q
 	}
+	var path string
+	if rewritten, rewrittenQuery, ok := co.rewriteCoAPToHTTP(method, optPath, query); ok {
+		path, query = rewritten, rewrittenQuery
+	} else if expanded, ok := co.PathSegments.Expand(optPath); ok {
+		path = expanded
+	} else {
+		path = co.Paths.CoAPPathToHTTPPath(optPath)
+	}
+	if strings.HasPrefix(path, "/") {
+		path = path[1:]
+	}
 	var body []byte
 	if r.Body != nil {
 		body, err = ioutil.ReadAll(r.Body)
@@ -202,9 +305,20 @@ func (co *CoAPHTTP) CoAPToHTTPRequest(r *message.Message) *http.Request {
 			return nil
 		}
 	}
-	req, err := http.NewRequest(method, "https://localhost/"+path+"?"+query.Encode(), bytes.NewReader(body))
+	host := "localhost"
+	if uriHost, err := r.Options.GetString(message.URIHost); err == nil && uriHost != "" {
+		if port, err := r.Options.GetUint32(message.URIPort); err == nil {
+			host = net.JoinHostPort(uriHost, strconv.FormatUint(uint64(port), 10))
+		} else if strings.Contains(uriHost, ":") {
+			host = "[" + uriHost + "]" // IPv6 literal
+		} else {
+			host = uriHost
+		}
+	}
+	req, err := http.NewRequest(method, "https://"+host+"/"+path+"?"+query.Encode(), bytes.NewReader(body))
 	if err != nil {
 		co.log("CoAPToHTTPRequest: failed to create HTTP request: %s", err)
+		return nil
 	}
 
 	format, err := r.Options.ContentFormat()
@@ -215,10 +329,22 @@ func (co *CoAPHTTP) CoAPToHTTPRequest(r *message.Message) *http.Request {
 		}
 	}
 
+	if accept, err := r.Options.Accept(); err == nil {
+		if contentType := contentFormatToContentType[accept]; contentType != "" {
+			req.Header.Set("Accept", contentType)
+		}
+	}
+
 	accessToken, _ := r.Options.GetString(OptionIDAccessToken)
 	if accessToken != "" {
 		req.Header.Set("Authorization", "Bearer "+accessToken)
 	}
+	setEntityTagHeaders(r.Options, req.Header)
+	if method == "GET" {
+		setRangeHeader(r.Options, req.Header)
+	}
+	setTraceParentHeader(r.Options, req.Header)
+	co.decodeCustomOptions(r.Options, req.Header)
 	return req
 }
 
@@ -236,17 +362,74 @@ func (co *CoAPHTTP) CoAPToHTTPResponse(r *pool.Message) *http.Response {
 	}
 	res := &http.Response{
 		StatusCode: resCode,
+		Header:     make(http.Header),
 		Body:       body,
 	}
+	if format, err := r.Options().ContentFormat(); err == nil {
+		if contentType := contentFormatToContentType[format]; contentType != "" {
+			res.Header.Set("Content-Type", contentType)
+		}
+	}
+	if etag, err := r.Options().GetBytes(message.ETag); err == nil && isHTTPEntityTag(etag) {
+		res.Header.Set("ETag", decodeEntityTag(etag))
+	}
+	setCacheControl(r.Options(), res.Header)
+	if r.Code() == codes.Content && setContentRangeHeader(r.Options(), res.Header) {
+		res.StatusCode = http.StatusPartialContent
+	}
+	co.decodeCustomOptions(r.Options(), res.Header)
 	return res
 }
 
+// URIHostOptions returns the Uri-Host and Uri-Port options for the URL. Uri-Host is omitted for IP
+// literals and Uri-Port is omitted if the URL has no port, as per RFC 7252 Section 6.4.
+func URIHostOptions(u *url.URL) ([]message.Option, error) {
+	var opts []message.Option
+	if host := u.Hostname(); host != "" && net.ParseIP(host) == nil {
+		opts = append(opts, message.Option{
+			ID:    message.URIHost,
+			Value: []byte(host),
+		})
+	}
+	if port := u.Port(); port != "" {
+		portNum, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port: %s", port)
+		}
+		buf := make([]byte, 4)
+		n, err := message.EncodeUint32(buf, uint32(portNum))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, message.Option{
+			ID:    message.URIPort,
+			Value: buf[:n],
+		})
+	}
+	return opts, nil
+}
+
+// The max number of bytes in a Uri-Query option. https://datatracker.ietf.org/doc/html/rfc7252#section-5.10
+const maxQueryLength = 255
+
+// size1Option returns a Size1 option, which on a 4.13 response is the maximum body size the server accepts.
+// https://datatracker.ietf.org/doc/html/rfc7959#section-4
+func size1Option(size uint32) message.Option {
+	buf := make([]byte, 4)
+	n, _ := message.EncodeUint32(buf, size)
+	return message.Option{
+		ID:    message.Size1,
+		Value: buf[:n],
+	}
+}
+
 // HTTPRequestToCoAP converts an HTTP request to a CoAP message then invokes doFn. This
 // callback MUST immediately make the CoAP request and not hold a reference to the Message
 // as it will be de-allocated back to a sync.Pool when the function ends. Returns an error
 // if it wasn't possible to convert the HTTP request to CoAP, or if doFn returns an error.
+// The CoAP message has the context of the HTTP request, so cancelling it aborts the CoAP request.
 func (co *CoAPHTTP) HTTPRequestToCoAP(req *http.Request, doFn func(*pool.Message) error) error {
-	msg := pool.AcquireMessage(context.Background())
+	msg := pool.AcquireMessage(req.Context())
 	code, ok := methodToCodes[req.Method]
 	if !ok {
 		return fmt.Errorf("Unknown method: %s", req.Method)
@@ -254,11 +437,43 @@ func (co *CoAPHTTP) HTTPRequestToCoAP(req *http.Request, doFn func(*pool.Message
 	msg.SetType(udpmessage.Confirmable)
 	msg.SetToken(co.NextToken())
 	msg.SetCode(code)
-	msg.SetPath(co.Paths.HTTPPathToCoapPath(req.URL.Path))
 	queries := req.URL.Query()
-	for k, vs := range queries {
-		for _, v := range vs {
-			msg.AddQuery(k + "=" + v)
+	if coapPath, coapQuery, ok := co.rewriteHTTPToCoAP(req.Method, req.URL.Path, queries); ok {
+		msg.SetPath(coapPath)
+		queries = coapQuery
+	} else {
+		coapPath := co.Paths.HTTPPathToCoapPath(req.URL.Path)
+		if coapPath == req.URL.Path && co.PathSegments != nil {
+			// there is no enum path for this path
+			coapPath = co.PathSegments.Compress(coapPath)
+		}
+		msg.SetPath(coapPath)
+	}
+	if co.URIHost {
+		opts, err := URIHostOptions(req.URL)
+		if err != nil {
+			return err
+		}
+		for _, opt := range opts {
+			msg.SetOptionBytes(opt.ID, opt.Value)
+		}
+	}
+	// go-coap keeps options sorted by ID but repeated options stay in the order they are added, so add queries in
+	// key order to serialise the same request to the same bytes every time.
+	keys := make([]string, 0, len(queries))
+	for k := range queries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range queries[k] {
+			// the server would silently drop a longer option, which for pagination tokens means fetching the first
+			// page forever
+			if q := k + "=" + v; len(q) <= maxQueryLength {
+				msg.AddQuery(q)
+			} else {
+				return fmt.Errorf("query parameter %s is %d bytes, which is too long to send over CoAP", k, len(q))
+			}
 		}
 	}
 	if req.Body != nil {
@@ -275,9 +490,32 @@ func (co *CoAPHTTP) HTTPRequestToCoAP(req *http.Request, doFn func(*pool.Message
 		contentFormat = message.AppOctets
 	}
 	msg.SetContentFormat(contentFormat)
+	if accept, ok := contentTypeToContentFormat[req.Header.Get("Accept")]; ok {
+		msg.SetOptionUint32(message.Accept, uint32(accept))
+	}
 	authHeader := req.Header.Get("Authorization")
 	if strings.HasPrefix(authHeader, "Bearer ") {
 		msg.SetOptionString(OptionIDAccessToken, strings.TrimPrefix(authHeader, "Bearer "))
 	}
+	// conditional requests must not be sent without their conditions, as an update could overwrite someone else's
+	etagOpts, err := entityTagOptions(req.Method, req.Header)
+	if err != nil {
+		return err
+	}
+	for _, opt := range etagOpts {
+		msg.AddOptionBytes(opt.ID, opt.Value)
+	}
+	if req.Method == "GET" {
+		if opt, ok := rangeOption(req.Header); ok {
+			msg.SetOptionBytes(opt.ID, opt.Value)
+		}
+	}
+	// a malformed trace context would be dropped by the server, so it is not sent
+	if tc, err := ParseTraceParent(req.Header.Get(traceParentHeader)); err == nil {
+		msg.SetOptionBytes(OptionIDTraceContext, traceContextOption(tc))
+	}
+	for _, opt := range co.encodeCustomOptions(req.Header) {
+		msg.AddOptionBytes(opt.ID, opt.Value)
+	}
 	return doFn(msg)
 }
@@ -0,0 +1,550 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	udpmessage "github.com/matrix-org/go-coap/v2/udp/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+// TestCoAPHTTPURIHost checks that the Host survives the HTTP -> CoAP -> HTTP round trip when URIHost is set
+func TestCoAPHTTPURIHost(t *testing.T) {
+	testCases := []struct {
+		url      string
+		uriHost  bool
+		wantHost string
+	}{
+		{url: "https://hs1.example.com:8448/_matrix/client/versions", uriHost: true, wantHost: "hs1.example.com:8448"},
+		{url: "https://hs2.example.com/_matrix/client/versions", uriHost: true, wantHost: "hs2.example.com"},
+		// IP literals are the destination address so are not sent
+		{url: "https://127.0.0.1/_matrix/client/versions", uriHost: true, wantHost: "localhost"},
+		{url: "https://hs1.example.com:8448/_matrix/client/versions", uriHost: false, wantHost: "localhost"},
+	}
+	for _, tc := range testCases {
+		co := NewCoAPHTTP(NewCoAPPathV1())
+		co.URIHost = tc.uriHost
+		httpReq, err := http.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		var got *http.Request
+		err = co.HTTPRequestToCoAP(httpReq, func(msg *pool.Message) error {
+			got = co.CoAPToHTTPRequest(&message.Message{
+				Code:    msg.Code(),
+				Token:   msg.Token(),
+				Options: msg.Options(),
+				Body:    msg.Body(),
+			})
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("HTTPRequestToCoAP: %s", err)
+		}
+		if got == nil {
+			t.Fatalf("%s: CoAPToHTTPRequest returned nil", tc.url)
+		}
+		if got.Host != tc.wantHost {
+			t.Errorf("%s (URIHost=%v): got Host %s want %s", tc.url, tc.uriHost, got.Host, tc.wantHost)
+		}
+		if got.URL.Path != "/_matrix/client/versions" {
+			t.Errorf("%s: got path %s", tc.url, got.URL.Path)
+		}
+	}
+}
+
+// TestCoAPHTTPCustomOptions checks that custom options survive the HTTP -> CoAP -> HTTP round trip, and that
+// options with reserved IDs are never sent
+func TestCoAPHTTPCustomOptions(t *testing.T) {
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	co.Options = HeaderOptions{
+		2049:                "X-Tenant-ID",
+		2050:                "X-Trace",
+		OptionIDAccessToken: "X-Not-A-Token",
+	}
+	httpReq, err := http.NewRequest("GET", "https://localhost/_matrix/client/versions", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %s", err)
+	}
+	httpReq.Header.Set("X-Tenant-ID", "tenant-a")
+	httpReq.Header.Add("X-Trace", "span-1")
+	httpReq.Header.Add("X-Trace", "span-2")
+	httpReq.Header.Set("X-Not-A-Token", "nope")
+	var got *http.Request
+	err = co.HTTPRequestToCoAP(httpReq, func(msg *pool.Message) error {
+		if msg.Options().HasOption(OptionIDAccessToken) {
+			t.Errorf("option with a reserved ID was sent")
+		}
+		got = co.CoAPToHTTPRequest(&message.Message{
+			Code:    msg.Code(),
+			Token:   msg.Token(),
+			Options: msg.Options(),
+			Body:    msg.Body(),
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("HTTPRequestToCoAP: %s", err)
+	}
+	if got == nil {
+		t.Fatalf("CoAPToHTTPRequest returned nil")
+	}
+	if v := got.Header.Get("X-Tenant-ID"); v != "tenant-a" {
+		t.Errorf("got X-Tenant-ID %q want tenant-a", v)
+	}
+	if v := got.Header.Values("X-Trace"); len(v) != 2 || v[0] != "span-1" || v[1] != "span-2" {
+		t.Errorf("got X-Trace %v want [span-1 span-2]", v)
+	}
+	if v := got.Header.Get("X-Not-A-Token"); v != "" {
+		t.Errorf("got X-Not-A-Token %q want none", v)
+	}
+}
+
+// TestCoAPHTTPOptionOrder checks that a request with many options is always serialised to the same bytes, with its
+// options in ascending option number order and repeated options in a stable order.
+func TestCoAPHTTPOptionOrder(t *testing.T) {
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	co.URIHost = true
+	co.Options = HeaderOptions{
+		2051: "X-C",
+		2049: "X-A",
+		2050: "X-B",
+	}
+	serialise := func() []byte {
+		httpReq, err := http.NewRequest("GET", "https://example.com:8448/_matrix/client/r0/sync?timeout=30000&since=s1&filter=1&full_state=false&set_presence=offline", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		httpReq.Header.Set("Authorization", "Bearer secret")
+		httpReq.Header.Set("X-A", "a")
+		httpReq.Header.Add("X-B", "b1")
+		httpReq.Header.Add("X-B", "b2")
+		httpReq.Header.Set("X-C", "c")
+		var data []byte
+		err = co.HTTPRequestToCoAP(httpReq, func(msg *pool.Message) error {
+			msg.SetToken(message.Token("token"))
+			msg.SetMessageID(1)
+			data, err = msg.Marshal()
+			return err
+		})
+		if err != nil {
+			t.Fatalf("HTTPRequestToCoAP: %s", err)
+		}
+		return data
+	}
+
+	want := serialise()
+	for i := 0; i < 20; i++ {
+		if got := serialise(); !bytes.Equal(got, want) {
+			t.Fatalf("serialisation %d differs:\ngot  %x\nwant %x", i, got, want)
+		}
+	}
+
+	msg := udpmessage.Message{
+		Options: make(message.Options, 0, 16),
+	}
+	if _, err := msg.Unmarshal(want); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	var queries, custom []string
+	for i, opt := range msg.Options {
+		if i > 0 && opt.ID < msg.Options[i-1].ID {
+			t.Errorf("option %d (ID %d) is after option ID %d", i, opt.ID, msg.Options[i-1].ID)
+		}
+		switch {
+		case opt.ID == message.URIQuery:
+			queries = append(queries, string(opt.Value))
+		case opt.ID >= minCustomOptionID:
+			custom = append(custom, string(opt.Value))
+		}
+	}
+	wantQueries := []string{"filter=1", "full_state=false", "set_presence=offline", "since=s1", "timeout=30000"}
+	if !reflect.DeepEqual(queries, wantQueries) {
+		t.Errorf("got queries %v want %v", queries, wantQueries)
+	}
+	wantCustom := []string{"a", "b1", "b2", "c"}
+	if !reflect.DeepEqual(custom, wantCustom) {
+		t.Errorf("got custom options %v want %v", custom, wantCustom)
+	}
+}
+
+// TestCoAPHTTPQueryLength checks that query parameters survive the HTTP -> CoAP -> HTTP round trip, and that
+// requests with query parameters which are too long for a Uri-Query option are not sent at all.
+func TestCoAPHTTPQueryLength(t *testing.T) {
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	roundTrip := func(from string) (url.Values, error) {
+		q := url.Values{"from": {from}, "limit": {"2"}}
+		httpReq, err := http.NewRequest("GET", "https://example.com/_matrix/client/v1/rooms/!a:b/hierarchy?"+q.Encode(), nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		var got url.Values
+		err = co.HTTPRequestToCoAP(httpReq, func(msg *pool.Message) error {
+			got = co.CoAPToHTTPRequest(&message.Message{
+				Code:    msg.Code(),
+				Token:   msg.Token(),
+				Options: msg.Options(),
+				Body:    msg.Body(),
+			}).URL.Query()
+			return nil
+		})
+		return got, err
+	}
+	// pagination tokens are opaque, so can contain anything
+	for _, from := range []string{"t1", "a=b&c=d", "+/=%20 ?#", strings.Repeat("x", maxQueryLength-len("from="))} {
+		got, err := roundTrip(from)
+		if err != nil {
+			t.Fatalf("HTTPRequestToCoAP with %q: %s", from, err)
+		}
+		if want := (url.Values{"from": {from}, "limit": {"2"}}); !reflect.DeepEqual(got, want) {
+			t.Errorf("got queries %v want %v", got, want)
+		}
+	}
+	if _, err := roundTrip(strings.Repeat("x", maxQueryLength)); err == nil {
+		t.Errorf("HTTPRequestToCoAP with a long token: got no error")
+	}
+}
+
+// TestCoAPHTTPPathDictionary checks that dictionary paths are sent as their short CoAP path and survive the
+// HTTP -> CoAP -> HTTP round trip, and that other paths use the enum paths
+func TestCoAPHTTPPathDictionary(t *testing.T) {
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	co.PathRewriter = PathDictionary{
+		"/_matrix/client/v3/keys/device_signing/upload": "/~dsu",
+	}
+	for _, tc := range []struct {
+		path     string
+		coapPath string
+	}{
+		{path: "/_matrix/client/v3/keys/device_signing/upload", coapPath: "~dsu"},
+		{path: "/_matrix/client/r0/sync", coapPath: "7"},
+	} {
+		httpReq, err := http.NewRequest("POST", "https://localhost"+tc.path+"?since=s1", bytes.NewBufferString("{}"))
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		var got *http.Request
+		err = co.HTTPRequestToCoAP(httpReq, func(msg *pool.Message) error {
+			if p, err := msg.Options().Path(); err != nil || p != tc.coapPath {
+				t.Errorf("%s: got CoAP path %q want %q", tc.path, p, tc.coapPath)
+			}
+			got = co.CoAPToHTTPRequest(&message.Message{
+				Code:    msg.Code(),
+				Token:   msg.Token(),
+				Options: msg.Options(),
+				Body:    msg.Body(),
+			})
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("HTTPRequestToCoAP: %s", err)
+		}
+		if got == nil {
+			t.Fatalf("%s: CoAPToHTTPRequest returned nil", tc.path)
+		}
+		if got.URL.Path != tc.path || got.URL.RawQuery != "since=s1" {
+			t.Errorf("got %s want %s?since=s1", got.URL, tc.path)
+		}
+	}
+}
+
+// TestCoAPHTTPEntityTags checks that conditional request headers survive the HTTP -> CoAP -> HTTP round trip, and
+// that requests whose conditions cannot be sent over CoAP are not sent at all.
+func TestCoAPHTTPEntityTags(t *testing.T) {
+	testCases := []struct {
+		method  string
+		header  string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{method: "PUT", header: "If-Match", value: `"abc"`, want: `"abc"`},
+		{method: "PUT", header: "If-Match", value: `"abc", "12345678"`, want: `"abc", "12345678"`},
+		{method: "PUT", header: "If-Match", value: `*`, want: `*`},
+		{method: "PUT", header: "If-None-Match", value: `*`, want: `*`},
+		{method: "GET", header: "If-None-Match", value: `"abc"`, want: `"abc"`},
+		{method: "GET", header: "If-None-Match", value: `W/"abc"`, want: `W/"abc"`},
+		{method: "PUT", header: "If-Match", value: `"123456789"`, wantErr: true},
+		{method: "PUT", header: "If-None-Match", value: `"abc"`, wantErr: true},
+	}
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	for _, tc := range testCases {
+		httpReq, err := http.NewRequest(tc.method, "https://localhost/_matrix/client/unstable/org.matrix.msc4108/rendezvous/abc", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		httpReq.Header.Set(tc.header, tc.value)
+		var got *http.Request
+		err = co.HTTPRequestToCoAP(httpReq, func(msg *pool.Message) error {
+			got = co.CoAPToHTTPRequest(&message.Message{
+				Code:    msg.Code(),
+				Token:   msg.Token(),
+				Options: msg.Options(),
+				Body:    msg.Body(),
+			})
+			return nil
+		})
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s %s: %s: got no error, want one", tc.method, tc.header, tc.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s %s: %s: HTTPRequestToCoAP: %s", tc.method, tc.header, tc.value, err)
+		}
+		if v := got.Header.Get(tc.header); v != tc.want {
+			t.Errorf("%s %s: %s: got %q want %q", tc.method, tc.header, tc.value, v, tc.want)
+		}
+	}
+
+	// response codes and ETags
+	for coapCode, wantCode := range map[codes.Code]int{
+		codes.PreconditionFailed: http.StatusPreconditionFailed,
+		codes.Valid:              http.StatusNotModified,
+		codes.Created:            http.StatusCreated,
+		// a 202 is sent as 2.04, but 2.04 is also what other servers send for a 200 to a PUT
+		codes.Changed: http.StatusOK,
+	} {
+		msg := pool.AcquireMessage(context.Background())
+		msg.SetCode(coapCode)
+		msg.SetOptionBytes(message.ETag, []byte("v2"))
+		res := co.CoAPToHTTPResponse(msg)
+		pool.ReleaseMessage(msg)
+		if res == nil {
+			t.Fatalf("CoAPToHTTPResponse(%v) returned nil", coapCode)
+		}
+		if res.StatusCode != wantCode || res.Header.Get("ETag") != `"v2"` {
+			t.Errorf("CoAPToHTTPResponse(%v): got HTTP %d ETag %s want HTTP %d ETag \"v2\"",
+				coapCode, res.StatusCode, res.Header.Get("ETag"), wantCode)
+		}
+	}
+	// 202 is only mapped on the way out
+	if code, ok := coapCode(http.StatusAccepted); !ok || code != codes.Changed {
+		t.Errorf("coapCode(202): got %v want %v", code, codes.Changed)
+	}
+	if code, ok := coapCode(http.StatusOK); !ok || code != codes.Content {
+		t.Errorf("coapCode(200): got %v want %v", code, codes.Content)
+	}
+	// the checksums go-coap sends as the ETag of responses without one are not valid HTTP entity tags
+	for _, etag := range []string{"\xf7\xce\n\x18R4", `a"b`, `W/"a b"`} {
+		msg := pool.AcquireMessage(context.Background())
+		msg.SetCode(codes.Content)
+		msg.SetOptionBytes(message.ETag, []byte(etag))
+		res := co.CoAPToHTTPResponse(msg)
+		pool.ReleaseMessage(msg)
+		if res == nil || res.Header.Get("ETag") != "" {
+			t.Errorf("CoAPToHTTPResponse with ETag option %q: got %+v want no ETag", etag, res)
+		}
+	}
+	if !isHTTPEntityTag([]byte(`W/"abc"`)) {
+		t.Errorf(`isHTTPEntityTag(W/"abc"): got false`)
+	}
+}
+
+// TestETagRefs checks that ETags which are too long for CoAP are replaced with a reference which is swapped back
+func TestETagRefs(t *testing.T) {
+	refs := &etagRefs{byRef: make(map[string]string)}
+	long := `"1626267853969-aBcDeFgHiJkLmNoP"`
+	opt, ok := refs.option(long)
+	if !ok || len(opt.Value) > maxETagLength {
+		t.Fatalf("option(%s): got %q, %v want a reference of at most %d bytes", long, opt.Value, ok, maxETagLength)
+	}
+	if again, _ := refs.option(long); !bytes.Equal(again.Value, opt.Value) {
+		t.Errorf("option(%s) changed: got %q then %q", long, opt.Value, again.Value)
+	}
+	if short, _ := refs.option(`"abc"`); string(short.Value) != "abc" {
+		t.Errorf(`option("abc"): got %q want abc`, short.Value)
+	}
+
+	h := make(http.Header)
+	h.Set("If-Match", decodeEntityTag(opt.Value)+`, "unknown"`)
+	refs.resolve(h)
+	if got, want := h.Get("If-Match"), long+`, "unknown"`; got != want {
+		t.Errorf("resolve: got If-Match %s want %s", got, want)
+	}
+
+	// old references are forgotten
+	for i := 0; i < maxETagRefs; i++ {
+		refs.option(fmt.Sprintf(`"etag-number-%d"`, i))
+	}
+	h.Set("If-Match", decodeEntityTag(opt.Value))
+	refs.resolve(h)
+	if got, want := h.Get("If-Match"), decodeEntityTag(opt.Value); got != want {
+		t.Errorf("resolve after %d more ETags: got If-Match %s want %s", maxETagRefs, got, want)
+	}
+}
+
+// TestCoAPHTTPMaxAge checks that the Cache-Control header of a response is sent as Max-Age, and that Max-Age is
+// returned as Cache-Control
+func TestCoAPHTTPMaxAge(t *testing.T) {
+	testCases := []struct {
+		cacheControl string
+		// "" if the response has no Max-Age
+		want string
+	}{
+		{cacheControl: "public, max-age=3600", want: "max-age=3600"},
+		{cacheControl: "Max-Age=60", want: "max-age=60"},
+		{cacheControl: `max-age="120"`, want: "max-age=120"},
+		{cacheControl: "max-age=99999999999", want: "max-age=4294967295"},
+		{cacheControl: "max-age=0", want: "max-age=0"},
+		{cacheControl: "no-store", want: "max-age=0"},
+		{cacheControl: "max-age=3600, no-cache", want: "max-age=0"},
+		{cacheControl: "max-age=-1", want: "max-age=0"},
+		{cacheControl: "private", want: ""},
+		{cacheControl: "", want: ""},
+	}
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	for _, tc := range testCases {
+		h := make(http.Header)
+		if tc.cacheControl != "" {
+			h.Set("Cache-Control", tc.cacheControl)
+		}
+		msg := pool.AcquireMessage(context.Background())
+		msg.SetCode(codes.Content)
+		if opt, ok := maxAgeOption(h); ok {
+			msg.SetOptionBytes(opt.ID, opt.Value)
+		}
+		res := co.CoAPToHTTPResponse(msg)
+		pool.ReleaseMessage(msg)
+		if res == nil {
+			t.Fatalf("%q: CoAPToHTTPResponse returned nil", tc.cacheControl)
+		}
+		if got := res.Header.Get("Cache-Control"); got != tc.want {
+			t.Errorf("%q: got Cache-Control %q want %q", tc.cacheControl, got, tc.want)
+		}
+	}
+}
+
+// TestResponseMaxAgeClockSkew checks that a response's Expires header is fresh for as long after its Date header as
+// it says, however wrong the local clock is
+func TestResponseMaxAgeClockSkew(t *testing.T) {
+	date := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name    string
+		headers map[string]string
+		// -1 if the headers do not say how long the response is fresh for
+		want int64
+	}{
+		{name: "expires", headers: map[string]string{"Date": date.Format(http.TimeFormat), "Expires": date.Add(time.Hour).Format(http.TimeFormat)}, want: 3600},
+		{name: "expired", headers: map[string]string{"Date": date.Format(http.TimeFormat), "Expires": date.Add(-time.Hour).Format(http.TimeFormat)}, want: 0},
+		{name: "invalid expires", headers: map[string]string{"Date": date.Format(http.TimeFormat), "Expires": "0"}, want: 0},
+		{name: "max-age wins", headers: map[string]string{"Cache-Control": "max-age=60", "Date": date.Format(http.TimeFormat), "Expires": date.Add(time.Hour).Format(http.TimeFormat)}, want: 60},
+		{name: "age", headers: map[string]string{"Date": date.Format(http.TimeFormat), "Expires": date.Add(time.Hour).Format(http.TimeFormat), "Age": "600"}, want: 3000},
+		{name: "aged out", headers: map[string]string{"Cache-Control": "max-age=60", "Age": "61"}, want: 0},
+		{name: "none", headers: map[string]string{"Date": date.Format(http.TimeFormat)}, want: -1},
+	}
+	for _, tc := range testCases {
+		h := make(http.Header)
+		for k, v := range tc.headers {
+			h.Set(k, v)
+		}
+		got, ok := ResponseMaxAge(h)
+		if !ok && tc.want != -1 || ok && int64(got) != tc.want {
+			t.Errorf("%s: got %d,%v want %d", tc.name, got, ok, tc.want)
+		}
+	}
+	// the local clock being a day out either way makes no difference when the server sends its Date
+	h := make(http.Header)
+	h.Set("Date", date.Format(http.TimeFormat))
+	h.Set("Expires", date.Add(time.Hour).Format(http.TimeFormat))
+	for _, skew := range []time.Duration{-24 * time.Hour, 24 * time.Hour} {
+		if got, ok := expiresMaxAge(h, time.Now().Add(skew)); !ok || got != 3600 {
+			t.Errorf("clock %v out: got %d,%v want 3600", skew, got, ok)
+		}
+	}
+}
+
+// TestCoAPHTTPRange checks that byte ranges survive the HTTP -> CoAP -> HTTP round trip, and that 206 Partial Content
+// responses are turned back into 206s
+func TestCoAPHTTPRange(t *testing.T) {
+	testCases := []struct {
+		method string
+		value  string
+		// "" if the request has no Range
+		want string
+	}{
+		{method: "GET", value: "bytes=1024-2047", want: "bytes=1024-2047"},
+		{method: "GET", value: "bytes=1024-", want: "bytes=1024-"},
+		{method: "GET", value: "bytes=0-0", want: "bytes=0-0"},
+		{method: "GET", value: "bytes=-500", want: ""},
+		{method: "GET", value: "bytes=0-10,20-30", want: ""},
+		{method: "GET", value: "bytes=2047-1024", want: ""},
+		{method: "GET", value: "bytes=99999999999-", want: ""},
+		{method: "GET", value: "items=0-10", want: ""},
+		{method: "PUT", value: "bytes=1024-2047", want: ""},
+	}
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	for _, tc := range testCases {
+		httpReq, err := http.NewRequest(tc.method, "https://localhost/_matrix/media/r0/download/localhost/abc", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		httpReq.Header.Set("Range", tc.value)
+		var got *http.Request
+		err = co.HTTPRequestToCoAP(httpReq, func(msg *pool.Message) error {
+			got = co.CoAPToHTTPRequest(&message.Message{
+				Code:    msg.Code(),
+				Token:   msg.Token(),
+				Options: msg.Options(),
+				Body:    msg.Body(),
+			})
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s %s: HTTPRequestToCoAP: %s", tc.method, tc.value, err)
+		}
+		if v := got.Header.Get("Range"); v != tc.want {
+			t.Errorf("%s %s: got Range %q want %q", tc.method, tc.value, v, tc.want)
+		}
+	}
+
+	for contentRange, wantCode := range map[string]int{
+		"bytes 1024-2047/5000": http.StatusPartialContent,
+		"bytes 1024-2047/*":    http.StatusOK,
+		"bytes 1024-5000/5000": http.StatusOK,
+		"":                     http.StatusOK,
+	} {
+		h := make(http.Header)
+		h.Set("Content-Range", contentRange)
+		msg := pool.AcquireMessage(context.Background())
+		msg.SetCode(codes.Content)
+		if opt, ok := contentRangeOption(h); ok {
+			msg.SetOptionBytes(opt.ID, opt.Value)
+		}
+		res := co.CoAPToHTTPResponse(msg)
+		pool.ReleaseMessage(msg)
+		if res == nil {
+			t.Fatalf("%q: CoAPToHTTPResponse returned nil", contentRange)
+		}
+		if res.StatusCode != wantCode {
+			t.Errorf("%q: got HTTP %d want %d", contentRange, res.StatusCode, wantCode)
+		}
+		if wantCode == http.StatusPartialContent && res.Header.Get("Content-Range") != contentRange {
+			t.Errorf("%q: got Content-Range %q", contentRange, res.Header.Get("Content-Range"))
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+)
+
+// The freshness of cacheable responses, like media and well-known files, is mapped to CoAP as described in
+// https://datatracker.ietf.org/doc/html/rfc8075#section-7.1:
+//   Cache-Control: max-age=60   <=> Max-Age option 60
+//   Cache-Control: no-store      => Max-Age option 0, as is no-cache
+// CoAP treats a response without Max-Age as fresh for 60 seconds, but most Matrix responses must not be cached at
+// all, so a response without Max-Age has no Cache-Control header rather than max-age=60.
+//
+// A response with an Expires header but no max-age is fresh for the time between its Date and Expires headers, as
+// per https://datatracker.ietf.org/doc/html/rfc7234#section-4.2.1. Both are by the server's clock, so this is
+// unaffected by the client or proxy having the wrong time. Responses which have been in a cache for their Age are
+// fresh for that much less.
+
+// CacheControlMaxAge returns the max-age of the Cache-Control header value, in seconds. Returns 0 if the response must
+// not be cached, or false if the header does not say how long it is fresh for.
+func CacheControlMaxAge(cacheControl string) (uint32, bool) {
+	var maxAge uint32
+	found := false
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache":
+			return 0, true
+		case strings.HasPrefix(directive, "max-age="):
+			v := strings.Trim(strings.TrimPrefix(directive, "max-age="), `"`)
+			secs, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return 0, true // invalid values are treated as stale, as per RFC 7234 Section 4.2.1
+			}
+			if secs > math.MaxUint32 {
+				secs = math.MaxUint32
+			}
+			maxAge = uint32(secs)
+			found = true
+		}
+	}
+	return maxAge, found
+}
+
+// ResponseMaxAge returns how many more seconds a response with the headers h is fresh for, from its Cache-Control,
+// Expires, Date and Age headers. Returns 0 if the response must not be cached, or false if the headers do not say how
+// long it is fresh for.
+func ResponseMaxAge(h http.Header) (uint32, bool) {
+	maxAge, ok := CacheControlMaxAge(h.Get("Cache-Control"))
+	if !ok {
+		maxAge, ok = expiresMaxAge(h, time.Now())
+		if !ok {
+			return 0, false
+		}
+	}
+	if age, err := strconv.ParseUint(strings.TrimSpace(h.Get("Age")), 10, 32); err == nil {
+		if age >= uint64(maxAge) {
+			return 0, true
+		}
+		maxAge -= uint32(age)
+	}
+	return maxAge, true
+}
+
+// expiresMaxAge returns the freshness lifetime of a response from its Expires and Date headers, falling back to now
+// if it has no Date. Returns false if there is no Expires header.
+func expiresMaxAge(h http.Header, now time.Time) (uint32, bool) {
+	v := h.Get("Expires")
+	if v == "" {
+		return 0, false
+	}
+	expires, err := http.ParseTime(v)
+	if err != nil {
+		return 0, true // invalid dates, e.g "0", are in the past, as per RFC 7234 Section 5.3
+	}
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = now
+	}
+	lifetime := expires.Sub(date) / time.Second
+	if lifetime <= 0 {
+		return 0, true
+	}
+	if lifetime > math.MaxUint32 {
+		lifetime = math.MaxUint32
+	}
+	return uint32(lifetime), true
+}
+
+// maxAgeOption returns the Max-Age option for the Cache-Control or Expires response header, or false if there isn't
+// one
+func maxAgeOption(h http.Header) (message.Option, bool) {
+	maxAge, ok := ResponseMaxAge(h)
+	if !ok {
+		return message.Option{}, false
+	}
+	buf := make([]byte, 4)
+	n, err := message.EncodeUint32(buf, maxAge)
+	if err != nil {
+		return message.Option{}, false
+	}
+	return message.Option{ID: message.MaxAge, Value: buf[:n]}, true
+}
+
+// setCacheControl sets the Cache-Control header for the Max-Age option, if there is one
+func setCacheControl(opts message.Options, h http.Header) {
+	maxAge, err := opts.GetUint32(message.MaxAge)
+	if err != nil {
+		return
+	}
+	h.Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(maxAge), 10))
+}
@@ -25,8 +25,28 @@ import (
 	"github.com/matrix-org/go-coap/v2/message"
 	"github.com/matrix-org/go-coap/v2/message/codes"
 	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	udpmessage "github.com/matrix-org/go-coap/v2/udp/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
 )
 
+// The CoAP Option ID clients send empty on an OBSERVE registration to ask for non-confirmable notifications, for
+// loss-tolerant resources like presence where an ACK per notification costs more than the occasional lost one.
+// It is elective, so servers which do not support it send confirmable notifications as usual.
+var OptionIDNonConfirmableNotifications = message.OptionID(258)
+
+// Non-confirmable notifications are only sent if they fit into a single message, as block-wise transfers need
+// confirmable messages.
+const maxNonConfirmableNotification = 1024
+
+// Every this many notifications, a non-confirmable observation is sent a confirmable one instead, so the server
+// finds out when the client has gone away and stops long-polling for it.
+// https://tools.ietf.org/html/rfc7641#section-4.5
+const confirmableNotificationInterval = 16
+
+// How often the age of the observation which has gone longest without a notification is sent to Metrics
+const notificationAgeReportInterval = 10 * time.Second
+
 // ObserveUpdateFn is a function which can update the long-poll request between calls.
 // prevRespBody will be <nil> if this is the first call
 type ObserveUpdateFn func(path string, prevRespBody []byte, req *http.Request) *http.Request
@@ -42,6 +62,7 @@ type HasUpdatedFn func(path string, prevRespBody, respBody []byte) bool
 type Observations struct {
 	Codec         *CBORCodec
 	Log           Logger
+	Metrics       MetricsSink
 	updateFns     []ObserveUpdateFn
 	hasUpdatedFn  HasUpdatedFn
 	next          http.Handler
@@ -49,7 +70,15 @@ type Observations struct {
 	obs           map[string]*coapmux.Client // registration ID -> Client
 	accessTokens  map[string]int             // access_token -> num observations
 	lastMu        *sync.Mutex
-	lastResponses map[string][]byte // remote addr + path -> last data
+	lastResponses map[string][]byte    // remote addr + path -> last data
+	lastNotified  map[string]time.Time // registration ID -> when it was last notified, or registered
+	reportingAges bool                 // true if reportNotificationAges is running
+	windows       notificationWindows
+
+	// If set, at most this many notifications are sent to each client at once, each holding its slot until the
+	// client ACKs it. The rest wait for a slot, highest OptionIDObservePriority first, so a saturated link delivers
+	// the notifications the client cares most about first. 0 means no limit.
+	MaxOutstandingNotifications int
 }
 
 // NewObservations makes a new observations struct. `next` must be the normal HTTP handlers
@@ -67,6 +96,7 @@ func NewObservations(next http.Handler, codec *CBORCodec, hasUpdatedFn HasUpdate
 		lastResponses: make(map[string][]byte),
 		accessTokens:  make(map[string]int),
 		lastMu:        &sync.Mutex{},
+		lastNotified:  make(map[string]time.Time),
 		Codec:         codec,
 	}
 }
@@ -78,8 +108,10 @@ func (o *Observations) log(format string, v ...interface{}) {
 	o.Log.Printf(format, v...)
 }
 
-// longPoll will begin long-polling on the client's behalf
-func (o *Observations) longPoll(regID, path string, token []byte, req *http.Request) {
+// longPoll will begin long-polling on the client's behalf. If nonConfirmable is set, notifications are sent as
+// non-confirmable messages where possible. If delta is set, notifications are sent as deltas where possible, see
+// OptionIDObserveDelta. priority is the ObservePriority of the notifications.
+func (o *Observations) longPoll(regID, path string, token []byte, req *http.Request, nonConfirmable, delta bool, priority int) {
 	accessToken := req.Header.Get("Authorization")
 	defer func() {
 		o.removeRegistration(regID, accessToken)
@@ -87,6 +119,9 @@ func (o *Observations) longPoll(regID, path string, token []byte, req *http.Requ
 	var lastRespBody []byte
 	var err error
 	seqNum := uint32(2)
+	// the JSON of the latest notification the client ACKed, which deltas are from
+	var deltaBase []byte
+	var deltaBaseSeq uint32
 	for {
 		client := o.getRegistration(regID)
 		if client == nil {
@@ -121,10 +156,10 @@ func (o *Observations) longPoll(regID, path string, token []byte, req *http.Requ
 		if w.statusCode != 200 {
 			o.log("returned code %d - stopping long poll, body: %s", w.statusCode, string(respBody))
 			respCode := codes.BadGateway
-			if c, ok := statusCodes[w.statusCode]; ok {
+			if c, ok := coapCode(w.statusCode); ok {
 				respCode = c
 			}
-			o.sendResponse(*client, path, seqNum, token, respCode, nil, message.AppCBOR)
+			o.sendNotification(*client, priority, path, seqNum, token, respCode, nil, message.AppCBOR, false)
 			return
 		}
 
@@ -147,10 +182,27 @@ func (o *Observations) longPoll(regID, path string, token []byte, req *http.Requ
 		lastRespBody = respBody
 
 		// send the response back to the caller. We trust the client will NOT call OBSERVE
-		// again when they get this data, thus saving bandwidth. This will block until the client ACKs the response
-		err = o.sendResponse(*client, path, seqNum, token, codes.Content, lastRespBody, message.AppCBOR)
+		// again when they get this data, thus saving bandwidth. This will block until the client ACKs the response,
+		// unless it is non-confirmable
+		data, opts := lastRespBody, []message.Option(nil)
+		if delta && seqNum%fullNotificationInterval != 0 {
+			data, opts = o.deltaNotification(deltaBase, deltaBaseSeq, lastRespBody)
+		}
+		// notifications too big for a single message are confirmable whatever nonConfirmable says
+		confirmable := !nonConfirmable || seqNum%confirmableNotificationInterval == 0 || len(data) > maxNonConfirmableNotification
+		err = o.sendNotification(*client, priority, path, seqNum, token, codes.Content, data, message.AppCBOR, !confirmable, opts...)
+		if err == nil && delta && confirmable {
+			// the client has ACKed this, so it can be the base of the next deltas
+			var jsonErr error
+			if deltaBase, jsonErr = o.Codec.CBORToJSON(bytes.NewReader(lastRespBody)); jsonErr != nil {
+				o.log("LongPoll[%s]: failed to convert CBOR to JSON for deltas - sending full notifications: %s", regID, jsonErr)
+			}
+			deltaBaseSeq = seqNum
+		}
 		seqNum++
-		if err != nil {
+		if err == nil {
+			o.notified(regID)
+		} else {
 			// we will only remove this entry if there are >1 observations for this access token
 			if o.safeToRemove(accessToken) {
 				o.log("LongPoll[%s]: Removing registration due to error: %s", regID, err)
@@ -183,7 +235,9 @@ func (o *Observations) HandleRegistration(req *http.Request, w coapmux.ResponseW
 	if register {
 		added := o.addRegistration(w.Client(), regID, req.Header.Get("Authorization"))
 		if added {
-			go o.longPoll(regID, path, r.Token, req)
+			nonConfirmable := r.Options.HasOption(OptionIDNonConfirmableNotifications)
+			delta := r.Options.HasOption(OptionIDObserveDelta)
+			go o.longPoll(regID, path, r.Token, req, nonConfirmable, delta, observePriority(r.Options))
 		}
 		// send ACK
 		w.SetResponse(codes.Content, message.TextPlain, nil)
@@ -211,7 +265,22 @@ func (o *Observations) HandleBlockwise(w coapmux.ResponseWriter, r *coapmux.Mess
 	}
 }
 
-func (o *Observations) sendResponse(cc coapmux.Client, path string, seqNum uint32, token []byte, respCode codes.Code, data []byte, contentFormat message.MediaType) error {
+// sendNotification sends a notification to the client with sendResponse, once there is a slot for it in the client's
+// window of MaxOutstandingNotifications
+func (o *Observations) sendNotification(cc coapmux.Client, priority int, path string, seqNum uint32, token []byte, respCode codes.Code, data []byte, contentFormat message.MediaType, nonConfirmable bool, extraOpts ...message.Option) error {
+	max := o.MaxOutstandingNotifications
+	id := cc.RemoteAddr().String()
+	if err := o.windows.acquire(cc.Context(), id, max, priority); err != nil {
+		return fmt.Errorf("waiting for a notification slot: %w", err)
+	}
+	defer o.windows.release(id, max)
+	return o.sendResponse(cc, path, seqNum, token, respCode, data, contentFormat, nonConfirmable, extraOpts...)
+}
+
+// sendResponse sends a notification to the client. If nonConfirmable is set and the notification fits into a single
+// message, it is sent as a non-confirmable message, so this does not wait for an ACK and it is not retransmitted.
+// extraOpts are sent as well as the content format and observe options.
+func (o *Observations) sendResponse(cc coapmux.Client, path string, seqNum uint32, token []byte, respCode codes.Code, data []byte, contentFormat message.MediaType, nonConfirmable bool, extraOpts ...message.Option) error {
 	m := message.Message{
 		Code:    respCode,
 		Token:   token,
@@ -237,6 +306,9 @@ func (o *Observations) sendResponse(cc coapmux.Client, path string, seqNum uint3
 	if err != nil {
 		return fmt.Errorf("cannot set options to response: %w", err)
 	}
+	for _, opt := range extraOpts {
+		opts = opts.Add(opt)
+	}
 	m.Options = opts
 
 	// remember the last response in case it's big enough to mandate a blockwise xfer
@@ -247,8 +319,25 @@ func (o *Observations) sendResponse(cc coapmux.Client, path string, seqNum uint3
 	o.lastResponses[id] = data
 	o.lastMu.Unlock()
 
-	// Calls to WriteMessage using a UDP client always sets the confirmable flag. We want this.
-	// wait for the client to ACK this message - if they don't want to /sync anymore they will send a Reset message as per:
+	udpConn, ok := cc.ClientConn().(*client.ClientConn)
+	if !ok {
+		return cc.WriteMessage(&m)
+	}
+	msg, err := pool.ConvertFrom(&m)
+	if err != nil {
+		return fmt.Errorf("cannot convert response: %w", err)
+	}
+	defer pool.ReleaseMessage(msg)
+	if nonConfirmable && len(data) <= maxNonConfirmableNotification {
+		msg.SetType(udpmessage.NonConfirmable)
+		msg.SetMessageID(udpmessage.GetMID())
+		// write directly to the session as the blockwise layer would send this as a confirmable message
+		return udpConn.Session().WriteMessage(msg)
+	}
+
+	// Messages from the pool keep the type they were reset with, which is non-confirmable, so set it. We want this
+	// to be confirmable, and wait for the client to ACK this message - if they don't want to /sync anymore they will
+	// send a Reset message as per:
 	//    A client that is no longer interested in receiving notifications for
 	//    a resource can simply "forget" the observation.  When the server then
 	//    sends the next notification, the client will not recognize the token
@@ -257,7 +346,8 @@ func (o *Observations) sendResponse(cc coapmux.Client, path string, seqNum uint3
 	//    The entries in lists of observers are effectively "garbage collected"
 	//    by the server.
 	// https://tools.ietf.org/html/rfc7641#section-3.6
-	return cc.WriteMessage(&m)
+	msg.SetType(udpmessage.Confirmable)
+	return udpConn.WriteMessage(msg)
 }
 
 func (o *Observations) addRegistration(client coapmux.Client, regID, accessToken string) bool {
@@ -269,7 +359,13 @@ func (o *Observations) addRegistration(client coapmux.Client, regID, accessToken
 	}
 	o.obs[regID] = &client
 	o.accessTokens[accessToken] += 1
+	o.lastNotified[regID] = time.Now()
 	o.log("OBSERVE[%d]: add registration %s (new count=%d)", len(o.obs), regID, o.accessTokens[accessToken])
+	metricsOrNop(o.Metrics).Gauge(metricCoAPObservations, nil, float64(len(o.obs)))
+	if o.Metrics != nil && !o.reportingAges {
+		o.reportingAges = true
+		go o.reportNotificationAges()
+	}
 	return true
 }
 
@@ -277,8 +373,60 @@ func (o *Observations) removeRegistration(regID, accessToken string) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 	delete(o.obs, regID)
+	delete(o.lastNotified, regID)
 	o.accessTokens[accessToken] -= 1
 	o.log("OBSERVE[%d]: remove registration %s (new count=%d)", len(o.obs), regID, o.accessTokens[accessToken])
+	metricsOrNop(o.Metrics).Gauge(metricCoAPObservations, nil, float64(len(o.obs)))
+}
+
+// notified records that a notification was sent for the registration
+func (o *Observations) notified(regID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.lastNotified[regID]; ok {
+		o.lastNotified[regID] = time.Now()
+	}
+}
+
+// LastNotificationAge returns how long the observation which has gone longest without a notification has gone
+// without one, counting from when it was registered if it has never had one. Returns 0 if there are no
+// observations. An age which keeps growing while the client is still connected means its /sync has stalled, though
+// quiet accounts can also go a long time without a notification.
+func (o *Observations) LastNotificationAge() time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var oldest time.Duration
+	now := time.Now()
+	for _, at := range o.lastNotified {
+		if age := now.Sub(at); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
+
+// reportNotificationAges sends the LastNotificationAge to Metrics every notificationAgeReportInterval, until there
+// are no observations
+func (o *Observations) reportNotificationAges() {
+	for {
+		time.Sleep(notificationAgeReportInterval)
+		if !o.reportNotificationAge() {
+			return
+		}
+	}
+}
+
+// reportNotificationAge sends the LastNotificationAge to Metrics. Returns false, and stops reportNotificationAges,
+// if there are no observations.
+func (o *Observations) reportNotificationAge() bool {
+	metricsOrNop(o.Metrics).Gauge(metricObserveNotificationAge, nil, o.LastNotificationAge().Seconds())
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.obs) == 0 {
+		o.reportingAges = false
+		return false
+	}
+	return true
 }
 
 func (o *Observations) getRegistration(regID string) *coapmux.Client {
@@ -0,0 +1,178 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/matrix-org/go-coap/v2/message"
+)
+
+// The CoAP Option ID clients send empty on an OBSERVE registration to ask for notifications as deltas. The server
+// then sends notifications which are smaller as a JSON merge patch (https://tools.ietf.org/html/rfc7386) of an
+// earlier notification, with this option set to the Observe sequence number of that notification as a uint.
+// Only confirmable notifications which the client ACKed are used as the base of a delta, so losing a
+// non-confirmable one does not break the deltas after it. It is elective, so servers which do not support it send
+// every notification in full.
+var OptionIDObserveDelta = message.OptionID(262)
+
+// Every this many notifications of a delta observation are sent in full, so a client which has lost the base of the
+// deltas, e.g when the server did not see its ACK, can start applying them again.
+const fullNotificationInterval = 16
+
+// errNoMergePatch is returned when a JSON merge patch cannot express the change
+var errNoMergePatch = errors.New("change cannot be expressed as a merge patch")
+
+// MergePatch returns the JSON merge patch which turns the JSON object from into the JSON object to. Returns an error
+// if either is not an object, or if to has a null member of an object, which merge patches cannot express.
+func MergePatch(from, to []byte) ([]byte, error) {
+	fromObj, err := unmarshalObject(from)
+	if err != nil {
+		return nil, err
+	}
+	toObj, err := unmarshalObject(to)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := mergePatch(fromObj, toObj)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(patch)
+}
+
+// ApplyMergePatch returns the JSON object doc with the JSON merge patch applied
+func ApplyMergePatch(doc, patch []byte) ([]byte, error) {
+	docObj, err := unmarshalObject(doc)
+	if err != nil {
+		return nil, err
+	}
+	patchObj, err := unmarshalObject(patch)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(applyMergePatch(docObj, patchObj))
+}
+
+func unmarshalObject(data []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// keep numbers as they were, rather than round tripping them through float64
+	decoder.UseNumber()
+	var obj map[string]interface{}
+	if err := decoder.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("not a JSON object: %w", err)
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("not a JSON object: null")
+	}
+	return obj, nil
+}
+
+func mergePatch(from, to map[string]interface{}) (map[string]interface{}, error) {
+	patch := make(map[string]interface{})
+	for k, toVal := range to {
+		if toVal == nil {
+			return nil, errNoMergePatch
+		}
+		fromVal, ok := from[k]
+		fromObj, fromIsObj := fromVal.(map[string]interface{})
+		toObj, toIsObj := toVal.(map[string]interface{})
+		if ok && fromIsObj && toIsObj {
+			sub, err := mergePatch(fromObj, toObj)
+			if err != nil {
+				return nil, err
+			}
+			if len(sub) > 0 {
+				patch[k] = sub
+			}
+			continue
+		}
+		if ok && reflect.DeepEqual(fromVal, toVal) {
+			continue
+		}
+		// a new object is merged with an empty one, so it cannot have null members either
+		if toIsObj && hasNullMember(toObj) {
+			return nil, errNoMergePatch
+		}
+		patch[k] = toVal
+	}
+	for k := range from {
+		if _, ok := to[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	return patch, nil
+}
+
+// hasNullMember returns true if obj or any object in it has a null member. Arrays replace rather than merge, so
+// objects in arrays can.
+func hasNullMember(obj map[string]interface{}) bool {
+	for _, v := range obj {
+		if v == nil {
+			return true
+		}
+		if sub, ok := v.(map[string]interface{}); ok && hasNullMember(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+func applyMergePatch(doc, patch map[string]interface{}) map[string]interface{} {
+	for k, v := range patch {
+		if v == nil {
+			delete(doc, k)
+			continue
+		}
+		patchObj, ok := v.(map[string]interface{})
+		if !ok {
+			doc[k] = v
+			continue
+		}
+		docObj, ok := doc[k].(map[string]interface{})
+		if !ok {
+			docObj = make(map[string]interface{})
+		}
+		doc[k] = applyMergePatch(docObj, patchObj)
+	}
+	return doc
+}
+
+// deltaNotification returns the CBOR body to notify with and, if it is a delta, the options to send with it. base is
+// the JSON of the notification with the sequence number baseSeq which the client has, or nil. Deltas are only sent
+// if they are smaller than the full body and fit into a single message, so they are never sent block-wise.
+func (o *Observations) deltaNotification(base []byte, baseSeq uint32, respBody []byte) ([]byte, []message.Option) {
+	if base == nil {
+		return respBody, nil
+	}
+	respBodyJSON, err := o.Codec.CBORToJSON(bytes.NewReader(respBody))
+	if err != nil {
+		return respBody, nil
+	}
+	patch, err := MergePatch(base, respBodyJSON)
+	if err != nil {
+		return respBody, nil
+	}
+	delta, err := o.Codec.JSONToCBOR(bytes.NewReader(patch))
+	if err != nil || len(delta) >= len(respBody) || len(delta) > maxNonConfirmableNotification {
+		return respBody, nil
+	}
+	buf := make([]byte, 4)
+	n, _ := message.EncodeUint32(buf, baseSeq)
+	return delta, []message.Option{{ID: OptionIDObserveDelta, Value: buf[:n]}}
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/go-coap/v2/message"
+)
+
+// mustEqualJSON fails the test if the JSON objects got and want are not the same, whatever the order of their keys
+func mustEqualJSON(t *testing.T, got, want []byte) {
+	t.Helper()
+	gotObj, err := unmarshalObject(got)
+	if err != nil {
+		t.Fatalf("got %s: %s", got, err)
+	}
+	wantObj, err := unmarshalObject(want)
+	if err != nil {
+		t.Fatalf("want %s: %s", want, err)
+	}
+	if !reflect.DeepEqual(gotObj, wantObj) {
+		t.Errorf("got %s want %s", got, want)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	testCases := []struct {
+		name  string
+		from  string
+		to    string
+		patch string
+	}{
+		{
+			name:  "unchanged",
+			from:  `{"a":1,"b":{"c":"d"}}`,
+			to:    `{"a":1,"b":{"c":"d"}}`,
+			patch: `{}`,
+		},
+		{
+			name:  "changed and added members",
+			from:  `{"next_batch":"s1","rooms":{"join":{"!a":{"timeline":{"events":[{"type":"m.room.message"}],"limited":false}}}}}`,
+			to:    `{"next_batch":"s2","rooms":{"join":{"!a":{"timeline":{"events":[{"type":"m.reaction"}],"limited":false}},"!b":{"summary":{}}}}}`,
+			patch: `{"next_batch":"s2","rooms":{"join":{"!a":{"timeline":{"events":[{"type":"m.reaction"}]}},"!b":{"summary":{}}}}}`,
+		},
+		{
+			name:  "removed members",
+			from:  `{"a":{"b":1,"c":2},"d":[1]}`,
+			to:    `{"a":{"b":1}}`,
+			patch: `{"a":{"c":null},"d":null}`,
+		},
+		{
+			name:  "type changes",
+			from:  `{"a":{"b":1},"c":"d"}`,
+			to:    `{"a":[1],"c":{"e":2}}`,
+			patch: `{"a":[1],"c":{"e":2}}`,
+		},
+		{
+			name:  "big numbers",
+			from:  `{"a":9007199254740993}`,
+			to:    `{"a":9007199254740995}`,
+			patch: `{"a":9007199254740995}`,
+		},
+		{
+			name:  "nulls in arrays",
+			from:  `{"a":[]}`,
+			to:    `{"a":[null,{"b":null}]}`,
+			patch: `{"a":[null,{"b":null}]}`,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			patch, err := MergePatch([]byte(tc.from), []byte(tc.to))
+			if err != nil {
+				t.Fatalf("MergePatch: %s", err)
+			}
+			mustEqualJSON(t, patch, []byte(tc.patch))
+			got, err := ApplyMergePatch([]byte(tc.from), patch)
+			if err != nil {
+				t.Fatalf("ApplyMergePatch: %s", err)
+			}
+			mustEqualJSON(t, got, []byte(tc.to))
+		})
+	}
+}
+
+func TestMergePatchCannotExpress(t *testing.T) {
+	testCases := []struct {
+		name string
+		from string
+		to   string
+	}{
+		{"null member", `{"a":1}`, `{"a":null}`},
+		{"null member of a new object", `{}`, `{"a":{"b":{"c":null}}}`},
+		{"not an object", `{}`, `[]`},
+	}
+	for _, tc := range testCases {
+		if _, err := MergePatch([]byte(tc.from), []byte(tc.to)); err == nil {
+			t.Errorf("%s: MergePatch returned no error", tc.name)
+		}
+	}
+}
+
+func TestDeltaNotification(t *testing.T) {
+	o := NewObservations(nil, NewCBORCodecV1(true), nil)
+	toCBOR := func(js string) []byte {
+		t.Helper()
+		b, err := o.Codec.JSONToCBOR(bytes.NewBufferString(js))
+		if err != nil {
+			t.Fatalf("JSONToCBOR: %s", err)
+		}
+		return b
+	}
+	base := []byte(`{"next_batch":"s1","rooms":{"join":{"!a:localhost":{"timeline":{"events":[],"limited":false,"prev_batch":"p1"},"state":{"events":[]},"ephemeral":{"events":[]},"account_data":{"events":[]}}}}}`)
+	next := toCBOR(`{"next_batch":"s2","rooms":{"join":{"!a:localhost":{"timeline":{"events":[],"limited":false,"prev_batch":"p1"},"state":{"events":[]},"ephemeral":{"events":[]},"account_data":{"events":[]}}}}}`)
+
+	data, opts := o.deltaNotification(nil, 0, next)
+	if !bytes.Equal(data, next) || opts != nil {
+		t.Errorf("without a base: got a delta")
+	}
+	data, opts = o.deltaNotification(base, 7, next)
+	if len(data) >= len(next) {
+		t.Errorf("delta is %d bytes, full notification is %d", len(data), len(next))
+	}
+	if len(opts) != 1 || opts[0].ID != OptionIDObserveDelta {
+		t.Fatalf("got options %v want OptionIDObserveDelta", opts)
+	}
+	if seq, _, err := message.DecodeUint32(opts[0].Value); err != nil || seq != 7 {
+		t.Errorf("got base seq %d (%v) want 7", seq, err)
+	}
+	patch, err := o.Codec.CBORToJSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	mustEqualJSON(t, patch, []byte(`{"next_batch":"s2"}`))
+
+	// a delta which is no smaller is not sent
+	small := toCBOR(`{"a":2}`)
+	if data, opts = o.deltaNotification([]byte(`{"b":1}`), 7, small); !bytes.Equal(data, small) || opts != nil {
+		t.Errorf("got a delta bigger than the full notification")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"context"
+	"sync"
+
+	"github.com/matrix-org/go-coap/v2/message"
+)
+
+// The CoAP Option ID clients send on an OBSERVE registration with the priority of its notifications, as a uint from
+// ObservePriorityLow to ObservePriorityHigh. Registrations without it are ObservePriorityNormal. It is elective, so
+// servers which do not support it send notifications in the order they are ready.
+var OptionIDObservePriority = message.OptionID(260)
+
+// Observe priorities. They only matter when the client's notification window is full, see
+// Observations.MaxOutstandingNotifications: the next free slot goes to the highest priority notification waiting
+// for one, and to the oldest of those. Higher priorities never pre-empt notifications which are already being sent.
+const (
+	// e.g presence, typing and rooms the user is not looking at
+	ObservePriorityLow = 0
+	// e.g /sync
+	ObservePriorityNormal = 1
+	// e.g the room the user is looking at
+	ObservePriorityHigh = 2
+)
+
+// observePriority returns the priority asked for by an OBSERVE registration, clamped to the known priorities
+func observePriority(opts message.Options) int {
+	p, err := opts.GetUint32(OptionIDObservePriority)
+	if err != nil {
+		return ObservePriorityNormal
+	}
+	if p > ObservePriorityHigh {
+		return ObservePriorityHigh
+	}
+	return int(p)
+}
+
+// notificationWindow is the flow control window of one client. A notification holds its slot from when it is first
+// sent until the client ACKs it, or for as long as it takes to write if it is non-confirmable.
+type notificationWindow struct {
+	outstanding int
+	// closed when the waiter has been given a slot, oldest first within each priority
+	waiters [ObservePriorityHigh + 1][]chan struct{}
+}
+
+func (w *notificationWindow) waiting() int {
+	n := 0
+	for _, waiters := range w.waiters {
+		n += len(waiters)
+	}
+	return n
+}
+
+// notificationWindows are the notification windows of every client with notifications outstanding or waiting
+type notificationWindows struct {
+	mu      sync.Mutex
+	windows map[string]*notificationWindow // remote addr -> window
+}
+
+// acquire blocks until there is a slot for a notification to the client in a window of max notifications, then
+// takes it. Returns an error if ctx is done first. max <= 0 means there is no limit.
+func (n *notificationWindows) acquire(ctx context.Context, client string, max, priority int) error {
+	if max <= 0 {
+		return nil
+	}
+	n.mu.Lock()
+	if n.windows == nil {
+		n.windows = make(map[string]*notificationWindow)
+	}
+	w := n.windows[client]
+	if w == nil {
+		w = &notificationWindow{}
+		n.windows[client] = w
+	}
+	if w.outstanding < max && w.waiting() == 0 {
+		w.outstanding++
+		n.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	w.waiters[priority] = append(w.waiters[priority], ready)
+	n.mu.Unlock()
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		for i, waiter := range w.waiters[priority] {
+			if waiter == ready {
+				w.waiters[priority] = append(w.waiters[priority][:i], w.waiters[priority][i+1:]...)
+				n.forgetLocked(client, w)
+				return ctx.Err()
+			}
+		}
+		// the slot was handed over at the same time, so give it to the next waiter
+		n.releaseLocked(client, w, max)
+		return ctx.Err()
+	}
+}
+
+// release frees the slot of a notification which has been sent, handing it to the waiter with the highest priority
+// if there is one. max must be the max the slot was acquired with.
+func (n *notificationWindows) release(client string, max int) {
+	if max <= 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if w := n.windows[client]; w != nil {
+		n.releaseLocked(client, w, max)
+	}
+}
+
+func (n *notificationWindows) releaseLocked(client string, w *notificationWindow, max int) {
+	w.outstanding--
+	for p := ObservePriorityHigh; p >= ObservePriorityLow && w.outstanding < max; p-- {
+		for len(w.waiters[p]) > 0 && w.outstanding < max {
+			w.outstanding++
+			close(w.waiters[p][0])
+			w.waiters[p] = w.waiters[p][1:]
+		}
+	}
+	n.forgetLocked(client, w)
+}
+
+// forgetLocked removes the window of a client with nothing outstanding or waiting, so clients which have gone away
+// are not remembered
+func (n *notificationWindows) forgetLocked(client string, w *notificationWindow) {
+	if w.outstanding == 0 && w.waiting() == 0 {
+		delete(n.windows, client)
+	}
+}
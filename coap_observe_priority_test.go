@@ -0,0 +1,144 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+)
+
+// waitForWaiters waits until the client has n notifications waiting for a slot
+func waitForWaiters(t *testing.T, n *notificationWindows, client string, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		n.mu.Lock()
+		got := 0
+		if w := n.windows[client]; w != nil {
+			got = w.waiting()
+		}
+		n.mu.Unlock()
+		if got == want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d waiters", want)
+}
+
+func TestNotificationWindowPriority(t *testing.T) {
+	var n notificationWindows
+	const client = "127.0.0.1:5683"
+	const max = 1
+	// saturate the link with a notification which has not been ACKed yet
+	if err := n.acquire(context.Background(), client, max, ObservePriorityLow); err != nil {
+		t.Fatalf("acquire: %s", err)
+	}
+	delivered := make(chan string, 5)
+	notifications := []struct {
+		name     string
+		priority int
+	}{
+		{"low 1", ObservePriorityLow},
+		{"normal", ObservePriorityNormal},
+		{"low 2", ObservePriorityLow},
+		{"high 1", ObservePriorityHigh},
+		{"high 2", ObservePriorityHigh},
+	}
+	for i, notif := range notifications {
+		notif := notif
+		go func() {
+			if err := n.acquire(context.Background(), client, max, notif.priority); err != nil {
+				t.Errorf("acquire %s: %s", notif.name, err)
+				return
+			}
+			delivered <- notif.name
+			n.release(client, max)
+		}()
+		// queue them in order
+		waitForWaiters(t, &n, client, i+1)
+	}
+	n.release(client, max)
+	var got []string
+	for range notifications {
+		select {
+		case name := <-delivered:
+			got = append(got, name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for notifications, got %v", got)
+		}
+	}
+	want := []string{"high 1", "high 2", "normal", "low 1", "low 2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got notifications in order %v want %v", got, want)
+	}
+	if len(n.windows) != 0 {
+		t.Errorf("got %d windows after every notification was sent, want none", len(n.windows))
+	}
+}
+
+func TestNotificationWindowCancel(t *testing.T) {
+	var n notificationWindows
+	const client = "127.0.0.1:5683"
+	if err := n.acquire(context.Background(), client, 1, ObservePriorityNormal); err != nil {
+		t.Fatalf("acquire: %s", err)
+	}
+	// the client goes away while a notification is waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- n.acquire(ctx, client, 1, ObservePriorityHigh)
+	}()
+	waitForWaiters(t, &n, client, 1)
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("got %v want context.Canceled", err)
+	}
+	n.release(client, 1)
+	if len(n.windows) != 0 {
+		t.Errorf("got %d windows, want none", len(n.windows))
+	}
+	// no limit
+	for i := 0; i < 3; i++ {
+		if err := n.acquire(context.Background(), client, 0, ObservePriorityLow); err != nil {
+			t.Fatalf("acquire with no limit: %s", err)
+		}
+	}
+}
+
+func TestObservePriorityOption(t *testing.T) {
+	testCases := []struct {
+		value []byte
+		want  int
+	}{
+		{nil, ObservePriorityNormal},
+		{[]byte{}, ObservePriorityLow},
+		{[]byte{2}, ObservePriorityHigh},
+		{[]byte{9}, ObservePriorityHigh},
+	}
+	for _, tc := range testCases {
+		var opts message.Options
+		if tc.value != nil {
+			opts = append(opts, message.Option{ID: OptionIDObservePriority, Value: tc.value})
+		}
+		if got := observePriority(opts); got != tc.want {
+			t.Errorf("option %v: got priority %d want %d", tc.value, got, tc.want)
+		}
+	}
+}
@@ -21,7 +21,9 @@ import (
 	"github.com/tidwall/gjson"
 )
 
-// NewSyncObservations returns an Observations capable of processing Matrix /sync requests
+// NewSyncObservations returns an Observations capable of processing Matrix /sync requests. Each long-poll is made
+// from the next_batch of the previous response, so notifications carry the incremental /sync of the homeserver as it
+// sent it, i.e only the rooms which changed, and no notification is sent until next_batch changes.
 func NewSyncObservations(next http.Handler, c *CoAPPath, codec *CBORCodec) *Observations {
 	return NewObservations(next, codec, func(path string, prev, curr []byte) bool {
 		path = c.CoAPPathToHTTPPath(path)
@@ -0,0 +1,113 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/matrix-org/go-coap/v2/message"
+)
+
+// The lowest option ID which can be used for custom options. Lower IDs are assigned by IETF review, which includes
+// every option defined by the CoAP RFCs and OptionIDAccessToken. 2048-64999 are assigned by specification and
+// 65000-65535 are for experimental use. https://datatracker.ietf.org/doc/html/rfc7252#section-12.2
+const minCustomOptionID = 2048
+
+// ValidateCustomOptionID returns an error if id cannot be used for a custom option. As with every CoAP option, odd
+// IDs are critical: a server which does not understand them must reject the request, and even IDs are elective:
+// they are ignored by servers which do not understand them. https://datatracker.ietf.org/doc/html/rfc7252#section-5.4.1
+func ValidateCustomOptionID(id message.OptionID) error {
+	if id < minCustomOptionID {
+		return fmt.Errorf("option %d is in the range reserved for IETF assigned options, custom options must be %d-65535", id, minCustomOptionID)
+	}
+	return nil
+}
+
+// OptionCodec carries custom metadata as CoAP options, e.g a tenant ID or tracing context, by converting them to
+// and from HTTP headers. It is called for every request and response CoAPHTTP converts.
+type OptionCodec interface {
+	// EncodeOptions returns the custom options to send for the HTTP headers. Options with IDs which fail
+	// ValidateCustomOptionID are not sent.
+	EncodeOptions(h http.Header) []message.Option
+	// DecodeOptions sets HTTP headers from the custom options received. opts only contains options with IDs
+	// which pass ValidateCustomOptionID.
+	DecodeOptions(opts message.Options, h http.Header)
+}
+
+// HeaderOptions is an OptionCodec which maps each option ID to an HTTP header with the same value
+type HeaderOptions map[message.OptionID]string
+
+func (ho HeaderOptions) EncodeOptions(h http.Header) []message.Option {
+	ids := make([]message.OptionID, 0, len(ho))
+	for id := range ho {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	var opts []message.Option
+	for _, id := range ids {
+		header := ho[id]
+		for _, v := range h.Values(header) {
+			opts = append(opts, message.Option{
+				ID:    id,
+				Value: []byte(v),
+			})
+		}
+	}
+	return opts
+}
+
+func (ho HeaderOptions) DecodeOptions(opts message.Options, h http.Header) {
+	for _, opt := range opts {
+		if header, ok := ho[opt.ID]; ok {
+			h.Add(header, string(opt.Value))
+		}
+	}
+}
+
+// encodeCustomOptions returns the options co.Options makes from h, dropping any with invalid IDs
+func (co *CoAPHTTP) encodeCustomOptions(h http.Header) []message.Option {
+	if co.Options == nil {
+		return nil
+	}
+	var opts []message.Option
+	for _, opt := range co.Options.EncodeOptions(h) {
+		if err := ValidateCustomOptionID(opt.ID); err != nil {
+			co.log("not sending custom option: %s", err)
+			continue
+		}
+		opts = append(opts, opt)
+	}
+	return opts
+}
+
+// decodeCustomOptions sets headers in h from the custom options in opts
+func (co *CoAPHTTP) decodeCustomOptions(opts message.Options, h http.Header) {
+	if co.Options == nil {
+		return
+	}
+	var custom message.Options
+	for _, opt := range opts {
+		if ValidateCustomOptionID(opt.ID) == nil {
+			custom = append(custom, opt)
+		}
+	}
+	if len(custom) > 0 {
+		co.Options.DecodeOptions(custom, h)
+	}
+}
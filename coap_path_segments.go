@@ -0,0 +1,114 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"strings"
+)
+
+// PathSegmentsV1 is the version of the v1 dictionary of path segments, which peers agree on with the
+// Capabilities exchange
+const PathSegmentsV1 = "v1"
+
+// pathSegmentMarker begins every token of a path segment dictionary
+const pathSegmentMarker = "~"
+
+// The v1 path segments. A segment's token is ~ followed by the character at the same index of
+// pathSegmentTokenChars, so segments must only ever be appended to this list. Segments of two characters or fewer,
+// like API versions, are left out as their tokens would be no shorter.
+var pathSegmentsV1 = []string{
+	"_matrix", "client", "unstable", "rooms", "sync", "send", "state", "user",
+	"account_data", "keys", "query", "upload", "claim", "changes", "profile", "devices",
+	"pushrules", "media", "download", "thumbnail", "config", "versions", "capabilities", "login",
+	"logout", "refresh", "register", "filter", "messages", "members", "joined_members", "event",
+	"context", "relations", "threads", "read_markers", "receipt", "typing", "redact", "invite",
+	"join", "leave", "forget", "presence", "status", "room_keys", "version", "tags",
+	"sendToDevice", "m.room.message", "m.room.encrypted", "m.room.member", "m.reaction", "m.read", "displayname",
+	"avatar_url", "org.matrix.msc3575", "_lb", "federation",
+}
+
+// pathSegmentTokenChars are the characters of path segment tokens, which are all URI unreserved so tokens do not need
+// escaping
+const pathSegmentTokenChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// PathSegments is a dictionary of common path segments, which are sent as short tokens for paths which have no CoAP
+// enum path e.g /_matrix/client/v3/keys/device_signing/upload => /~0/~1/v3/~9/device_signing/~b
+//
+// Tokens are ~ followed by one character. Paths are only compressed if their first segment is in the dictionary, so
+// the first Uri-Path option of a compressed path always begins with ~, which neither CoAP enum paths nor HTTP paths
+// do. Other segments which begin with ~ are sent with another ~ in front, so they are never mistaken for a token.
+type PathSegments struct {
+	version  string
+	tokens   map[string]string
+	segments map[string]string
+}
+
+// NewPathSegmentsV1 returns the v1 dictionary of path segments. Only send compressed paths to servers which list
+// PathSegmentsV1 in their Capabilities.
+func NewPathSegmentsV1() *PathSegments {
+	p := &PathSegments{
+		version:  PathSegmentsV1,
+		tokens:   make(map[string]string, len(pathSegmentsV1)),
+		segments: make(map[string]string, len(pathSegmentsV1)),
+	}
+	for i, segment := range pathSegmentsV1 {
+		token := pathSegmentMarker + pathSegmentTokenChars[i:i+1]
+		p.tokens[segment] = token
+		p.segments[token] = segment
+	}
+	return p
+}
+
+// Version returns the version of the dictionary e.g PathSegmentsV1
+func (p *PathSegments) Version() string {
+	return p.version
+}
+
+// Compress returns the HTTP path with the segments in the dictionary replaced by their tokens. Returns the path as it
+// is if its first segment is not in the dictionary.
+func (p *PathSegments) Compress(path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if _, ok := p.tokens[segments[0]]; !ok {
+		return path
+	}
+	for i, segment := range segments {
+		if token, ok := p.tokens[segment]; ok {
+			segments[i] = token
+		} else if strings.HasPrefix(segment, pathSegmentMarker) {
+			segments[i] = pathSegmentMarker + segment
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// Expand returns the HTTP path of a path made with Compress. Returns false if the path was not compressed. Unknown
+// tokens, e.g from a newer dictionary, are left as they are.
+func (p *PathSegments) Expand(coapPath string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	segments := strings.Split(strings.TrimPrefix(coapPath, "/"), "/")
+	if _, ok := p.segments[segments[0]]; !ok {
+		return "", false
+	}
+	for i, segment := range segments {
+		if expanded, ok := p.segments[segment]; ok {
+			segments[i] = expanded
+		} else if strings.HasPrefix(segment, pathSegmentMarker+pathSegmentMarker) {
+			segments[i] = segment[len(pathSegmentMarker):]
+		}
+	}
+	return "/" + strings.Join(segments, "/"), true
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+func TestPathSegments(t *testing.T) {
+	p := NewPathSegmentsV1()
+	if len(pathSegmentsV1) > len(pathSegmentTokenChars) {
+		t.Fatalf("%d segments but only %d tokens", len(pathSegmentsV1), len(pathSegmentTokenChars))
+	}
+	cases := []struct {
+		http string
+		coap string
+	}{
+		{
+			http: "/_matrix/client/v3/keys/device_signing/upload",
+			coap: "/~0/~1/v3/~9/device_signing/~b",
+		},
+		// segments which begin with ~ are escaped
+		{
+			http: "/_matrix/client/v3/rooms/!a:b/send/m.room.message/~0",
+			coap: "/~0/~1/v3/~3/!a:b/~5/~N/~~0",
+		},
+		{
+			http: "/_matrix/client/v3/user/@alice:b/filter/~~x",
+			coap: "/~0/~1/v3/~7/@alice:b/~r/~~~x",
+		},
+		// trailing slashes are kept
+		{
+			http: "/_matrix/client/v3/sync/",
+			coap: "/~0/~1/v3/~4/",
+		},
+	}
+	for _, tc := range cases {
+		if got := p.Compress(tc.http); got != tc.coap {
+			t.Errorf("Compress(%s) got %s want %s", tc.http, got, tc.coap)
+		}
+		got, ok := p.Expand(tc.coap)
+		if !ok || got != tc.http {
+			t.Errorf("Expand(%s) got %s %v want %s", tc.coap, got, ok, tc.http)
+		}
+	}
+	// paths which do not begin with a segment in the dictionary are not compressed
+	for _, path := range []string{"/.well-known/matrix/client", "/7", "/r/@frank:localhost/m.direct", "/"} {
+		if got := p.Compress(path); got != path {
+			t.Errorf("Compress(%s) got %s want it unchanged", path, got)
+		}
+		if got, ok := p.Expand(path); ok {
+			t.Errorf("Expand(%s) got %s want it not to be expanded", path, got)
+		}
+	}
+	var none *PathSegments
+	if _, ok := none.Expand("/~0/~1"); ok {
+		t.Errorf("nil PathSegments expanded a path")
+	}
+}
+
+// TestCoAPHTTPPathSegments measures how many bytes compressing paths with no enum path saves, and checks they survive
+// the HTTP -> CoAP -> HTTP round trip
+func TestCoAPHTTPPathSegments(t *testing.T) {
+	paths := []string{
+		"/_matrix/client/v3/keys/device_signing/upload",
+		"/_matrix/client/v3/rooms/!636q39766251:example.com/state/m.room.member/@alice:example.com",
+		"/_matrix/client/v3/user/@alice:example.com/rooms/!636q39766251:example.com/account_data/m.fully_read",
+		"/_matrix/client/v1/rooms/!636q39766251:example.com/relations/$ev1/m.reaction",
+		"/_matrix/client/v3/pushrules/global/override/.m.rule.master/enabled",
+		"/_matrix/client/v3/profile/@alice:example.com/displayname",
+		"/_matrix/client/unstable/org.matrix.msc3575/sync",
+	}
+	plain := NewCoAPHTTP(NewCoAPPathV2())
+	compressing := NewCoAPHTTP(NewCoAPPathV2())
+	compressing.PathSegments = NewPathSegmentsV1()
+	size := func(co *CoAPHTTP, path string) int {
+		t.Helper()
+		req, err := http.NewRequest("GET", "https://localhost"+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		var n int
+		err = co.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+			data, err := msg.Marshal()
+			if err != nil {
+				return err
+			}
+			n = len(data)
+			got := co.CoAPToHTTPRequest(&message.Message{
+				Code:    msg.Code(),
+				Token:   msg.Token(),
+				Options: msg.Options(),
+			})
+			if got == nil {
+				t.Fatalf("%s: CoAPToHTTPRequest returned nil", path)
+			}
+			if got.URL.Path != path {
+				t.Errorf("round trip of %s got %s", path, got.URL.Path)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("HTTPRequestToCoAP: %s", err)
+		}
+		return n
+	}
+	var before, after int
+	for _, path := range paths {
+		before += size(plain, path)
+		after += size(compressing, path)
+	}
+	t.Logf("%d requests: %d bytes without the path dictionary, %d bytes with it (%.0f%% smaller)",
+		len(paths), before, after, 100*float64(before-after)/float64(before))
+	// /_matrix/client alone saves 9 bytes per request
+	if before-after < 9*len(paths) {
+		t.Errorf("path dictionary saved %d bytes, want at least %d", before-after, 9*len(paths))
+	}
+
+	// enum paths are sent as they were
+	if before, after := size(plain, "/_matrix/client/r0/sync"), size(compressing, "/_matrix/client/r0/sync"); before != after {
+		t.Errorf("enum path: got %d bytes with the path dictionary want %d", after, before)
+	}
+}
@@ -136,6 +136,22 @@ func (c *CoAPPath) HTTPPathToCoapPath(p string) string {
 	return p
 }
 
+// HTTPPathTemplate returns the mapping which matches an HTTP path, with placeholders rather than values e.g
+// returns /_matrix/client/r0/rooms/{roomId}/messages for /_matrix/client/r0/rooms/!foo:bar/messages
+// Returns false if this path isn't mapped to a coap enum path
+func (c *CoAPPath) HTTPPathTemplate(p string) (string, bool) {
+	path := p
+	if !strings.HasPrefix(p, "/") {
+		path = "/" + p
+	}
+	for r := range c.regexpsToCodes {
+		if r.regexp.MatchString(path) {
+			return r.template, true
+		}
+	}
+	return "", false
+}
+
 // ==================================================================
 // Uses gorilla/mux regexp handling code below, modified to just keep the path handling bits
 // Source: https://github.com/gorilla/mux/blob/v1.8.0/regexp.go
@@ -37,6 +37,15 @@ func TestPaths(t *testing.T) {
 			http: "/_matrix/client/r0/user/@frank:localhost/account_data/im.vector.setting.breadcrumbs",
 			code: "/r/@frank:localhost/im.vector.setting.breadcrumbs",
 		},
+		// filter upload and download
+		{
+			http: "/_matrix/client/r0/user/@frank:localhost/filter",
+			code: "/5/@frank:localhost",
+		},
+		{
+			http: "/_matrix/client/r0/user/@frank:localhost/filter/66697",
+			code: "/6/@frank:localhost/66697",
+		},
 	}
 	for _, tc := range cases {
 		gotHTTP := c.CoAPPathToHTTPPath(tc.code)
@@ -50,6 +59,60 @@ func TestPaths(t *testing.T) {
 	}
 }
 
+func TestPathsV2(t *testing.T) {
+	v1 := NewCoAPPathV1()
+	v2 := NewCoAPPathV2()
+	cases := []struct {
+		http string
+		code string
+	}{
+		// v1 paths are unchanged
+		{
+			http: "/_matrix/client/r0/sync",
+			code: "/7",
+		},
+		// MSC4108 rendezvous session creation and polling
+		{
+			http: "/_matrix/client/unstable/org.matrix.msc4108/rendezvous",
+			code: "/v",
+		},
+		{
+			http: "/_matrix/client/unstable/org.matrix.msc4108/rendezvous/e8da6355-550b-4a32-a193-1619d9830668",
+			code: "/w/e8da6355-550b-4a32-a193-1619d9830668",
+		},
+		// space hierarchy
+		{
+			http: "/_matrix/client/v1/rooms/space:localhost/hierarchy",
+			code: "/x/space:localhost",
+		},
+		// pagination
+		{
+			http: "/_matrix/client/v3/rooms/room:localhost/messages",
+			code: "/y/room:localhost",
+		},
+	}
+	for _, tc := range cases {
+		gotHTTP := v2.CoAPPathToHTTPPath(tc.code)
+		if gotHTTP != tc.http {
+			t.Errorf("CoAPPathToHTTPPath with %s got %s want %s", tc.code, gotHTTP, tc.http)
+		}
+		gotCode := v2.HTTPPathToCoapPath(tc.http)
+		if gotCode != tc.code {
+			t.Errorf("HTTPPathToCoapPath with %s got %s want %s", tc.http, gotCode, tc.code)
+		}
+		// v1 clients send the new paths in full, which v2 servers still understand
+		if v1Code := v1.HTTPPathToCoapPath(tc.http); v1Code != tc.code && v2.CoAPPathToHTTPPath(v1Code) != tc.http {
+			t.Errorf("v2 CoAPPathToHTTPPath with v1 path %s got %s want %s", v1Code, v2.CoAPPathToHTTPPath(v1Code), tc.http)
+		}
+	}
+	// the new enums are not in v1
+	for _, code := range []string{"v", "w", "x", "y"} {
+		if _, ok := coapv1pathMappings[code]; ok {
+			t.Errorf("v1 path mappings contain %s", code)
+		}
+	}
+}
+
 func TestPathsURLEncoding(t *testing.T) {
 	c, err := NewCoAPPath(coapv1pathMappings)
 	if err != nil {
@@ -113,3 +176,41 @@ func TestInvalidCodePaths(t *testing.T) {
 		}
 	}
 }
+
+func TestHTTPPathTemplate(t *testing.T) {
+	c, err := NewCoAPPath(coapv1pathMappings)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cases := []struct {
+		input  string
+		output string
+		ok     bool
+	}{
+		{
+			input:  "/_matrix/client/r0/sync",
+			output: "/_matrix/client/r0/sync",
+			ok:     true,
+		},
+		{
+			input:  "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/txn1",
+			output: "/_matrix/client/r0/rooms/{roomId}/send/{eventType}/{txnId}",
+			ok:     true,
+		},
+		{
+			input:  "/_matrix/client/r0/user/@frank:localhost/filter/66697",
+			output: "/_matrix/client/r0/user/{userId}/filter/{filterId}",
+			ok:     true,
+		},
+		{
+			input: "/_matrix/client/r0/not/a/real/endpoint",
+			ok:    false,
+		},
+	}
+	for _, tc := range cases {
+		got, ok := c.HTTPPathTemplate(tc.input)
+		if got != tc.output || ok != tc.ok {
+			t.Errorf("HTTPPathTemplate with %s got (%s, %v) want (%s, %v)", tc.input, got, ok, tc.output, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+// The v2 path enums are the v1 path enums with more paths. Clients which only know v1 send these paths in full,
+// which a server which knows v2 still accepts.
+var coapv2pathMappings = withPathMappings(coapv1pathMappings, map[string]string{
+	"v": "/_matrix/client/unstable/org.matrix.msc4108/rendezvous",
+	"w": "/_matrix/client/unstable/org.matrix.msc4108/rendezvous/{sessionId}",
+	"x": "/_matrix/client/v1/rooms/{roomId}/hierarchy",
+	"y": "/_matrix/client/v3/rooms/{roomId}/messages",
+})
+
+// withPathMappings returns a new path map with the paths of base and the additions
+func withPathMappings(base, additions map[string]string) map[string]string {
+	paths := make(map[string]string, len(base)+len(additions))
+	for k, v := range base {
+		paths[k] = v
+	}
+	for k, v := range additions {
+		paths[k] = v
+	}
+	return paths
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/go-coap/v2/message"
+)
+
+// Byte ranges let clients fetch a large representation, e.g media, a part at a time, so an interrupted download can
+// resume where it stopped rather than start again. CoAP has no ranges, so they are mapped to options holding the
+// byte offsets as 4 byte big-endian integers (https://datatracker.ietf.org/doc/html/rfc7233):
+//   Range: bytes=1024-2047              <=> Range option of the first and last offsets, on GET requests
+//   Range: bytes=1024-                  <=> Range option of the first offset, on GET requests
+//   Content-Range: bytes 1024-2047/5000  => Content-Range option of the first and last offsets and the size
+// A 206 Partial Content response is sent as 2.05 Content with a Content-Range option, and turned back into a 206.
+// Other ranges, e.g suffixes and multiple ranges, are not sent, so the server returns the whole representation.
+
+// The CoAP Option ID of the byte range a GET request asks for. It is elective, so servers which do not support ranges
+// return the whole representation, as HTTP servers which do not support Range do.
+var OptionIDRange = message.OptionID(264)
+
+// The CoAP Option ID of the byte range a 2.05 Content response holds, which makes it a 206 Partial Content
+var OptionIDContentRange = message.OptionID(266)
+
+// ParseRange returns the first and last byte offsets of a Range header value, e.g "bytes=1024-2047". last is -1 if
+// the range is open-ended, e.g "bytes=1024-". Returns false for other ranges, e.g suffixes and multiple ranges.
+func ParseRange(value string) (first, last int64, ok bool) {
+	if !strings.HasPrefix(value, "bytes=") {
+		return 0, 0, false
+	}
+	first, last, ok = parseByteRange(strings.TrimPrefix(value, "bytes="), true)
+	return first, last, ok
+}
+
+// ParseContentRange returns the first and last byte offsets and the size of a Content-Range header value, e.g
+// "bytes 1024-2047/5000". Returns false if the size is not known, e.g "bytes 1024-2047/*".
+func ParseContentRange(value string) (first, last, size int64, ok bool) {
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, 0, false
+	}
+	kvs := strings.SplitN(strings.TrimPrefix(value, "bytes "), "/", 2)
+	if len(kvs) != 2 {
+		return 0, 0, 0, false
+	}
+	first, last, ok = parseByteRange(kvs[0], false)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	size, err := strconv.ParseInt(kvs[1], 10, 64)
+	if err != nil || last >= size {
+		return 0, 0, 0, false
+	}
+	return first, last, size, true
+}
+
+// parseByteRange parses first-last, where last may be omitted if openEnded is set
+func parseByteRange(value string, openEnded bool) (first, last int64, ok bool) {
+	kvs := strings.SplitN(value, "-", 2)
+	if len(kvs) != 2 {
+		return 0, 0, false
+	}
+	first, err := strconv.ParseInt(kvs[0], 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, false
+	}
+	if kvs[1] == "" && openEnded {
+		return first, -1, true
+	}
+	last, err = strconv.ParseInt(kvs[1], 10, 64)
+	if err != nil || last < first {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// encodeOffsets returns the option value for byte offsets, or false if one is too large to send
+func encodeOffsets(offsets ...int64) ([]byte, bool) {
+	buf := make([]byte, 4*len(offsets))
+	for i, off := range offsets {
+		if off > math.MaxUint32 {
+			return nil, false
+		}
+		binary.BigEndian.PutUint32(buf[4*i:], uint32(off))
+	}
+	return buf, true
+}
+
+// decodeOffsets returns the byte offsets of an option value
+func decodeOffsets(value []byte) []int64 {
+	offsets := make([]int64, 0, len(value)/4)
+	for i := 0; i+4 <= len(value); i += 4 {
+		offsets = append(offsets, int64(binary.BigEndian.Uint32(value[i:])))
+	}
+	return offsets
+}
+
+// rangeOption returns the Range option for the Range request header, or false if there isn't one which can be sent
+func rangeOption(h http.Header) (message.Option, bool) {
+	first, last, ok := ParseRange(h.Get("Range"))
+	if !ok {
+		return message.Option{}, false
+	}
+	offsets := []int64{first}
+	if last >= 0 {
+		offsets = append(offsets, last)
+	}
+	value, ok := encodeOffsets(offsets...)
+	return message.Option{ID: OptionIDRange, Value: value}, ok
+}
+
+// setRangeHeader sets the Range header for the Range option, if there is one
+func setRangeHeader(opts message.Options, h http.Header) {
+	value, err := opts.GetBytes(OptionIDRange)
+	if err != nil {
+		return
+	}
+	switch offsets := decodeOffsets(value); len(offsets) {
+	case 1:
+		h.Set("Range", fmt.Sprintf("bytes=%d-", offsets[0]))
+	case 2:
+		h.Set("Range", fmt.Sprintf("bytes=%d-%d", offsets[0], offsets[1]))
+	}
+}
+
+// contentRangeOption returns the Content-Range option for the Content-Range response header, or false if there
+// isn't one which can be sent
+func contentRangeOption(h http.Header) (message.Option, bool) {
+	first, last, size, ok := ParseContentRange(h.Get("Content-Range"))
+	if !ok {
+		return message.Option{}, false
+	}
+	value, ok := encodeOffsets(first, last, size)
+	return message.Option{ID: OptionIDContentRange, Value: value}, ok
+}
+
+// setContentRangeHeader sets the Content-Range header for the Content-Range option, returning false if there isn't
+// one
+func setContentRangeHeader(opts message.Options, h http.Header) bool {
+	value, err := opts.GetBytes(OptionIDContentRange)
+	if err != nil {
+		return false
+	}
+	offsets := decodeOffsets(value)
+	if len(offsets) != 3 {
+		return false
+	}
+	h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offsets[0], offsets[1], offsets[2]))
+	return true
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"net/url"
+)
+
+// PathRewriter customises how requests to particular endpoints are mapped between HTTP and CoAP, e.g to send long
+// paths as short CoAP paths from a dictionary the client and server share. Clients and servers must use rewriters
+// which are the inverse of each other. Rewritten CoAP paths must not clash with the CoAP enum paths, e.g by starting
+// with a character no enum path uses like ~.
+type PathRewriter interface {
+	// HTTPToCoAP returns the CoAP path and query to send for an HTTP request, or false to use the default mapping
+	HTTPToCoAP(method, path string, query url.Values) (coapPath string, coapQuery url.Values, ok bool)
+	// CoAPToHTTP returns the HTTP path and query of a CoAP request, or false to use the default mapping
+	CoAPToHTTP(method, coapPath string, coapQuery url.Values) (path string, query url.Values, ok bool)
+}
+
+// PathDictionary is a PathRewriter which maps each HTTP path to a CoAP path, e.g
+// "/_matrix/client/v3/keys/device_signing/upload" to "/~dsu". Queries are sent as they are.
+type PathDictionary map[string]string
+
+func (d PathDictionary) HTTPToCoAP(method, path string, query url.Values) (string, url.Values, bool) {
+	coapPath, ok := d[path]
+	return coapPath, query, ok
+}
+
+func (d PathDictionary) CoAPToHTTP(method, coapPath string, coapQuery url.Values) (string, url.Values, bool) {
+	for path, p := range d {
+		if p == coapPath {
+			return path, coapQuery, true
+		}
+	}
+	return "", nil, false
+}
+
+func (co *CoAPHTTP) rewriteHTTPToCoAP(method, path string, query url.Values) (string, url.Values, bool) {
+	if co.PathRewriter == nil {
+		return "", nil, false
+	}
+	return co.PathRewriter.HTTPToCoAP(method, path, query)
+}
+
+func (co *CoAPHTTP) rewriteCoAPToHTTP(method, coapPath string, coapQuery url.Values) (string, url.Values, bool) {
+	if co.PathRewriter == nil {
+		return "", nil, false
+	}
+	return co.PathRewriter.CoAPToHTTP(method, coapPath, coapQuery)
+}
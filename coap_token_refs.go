@@ -0,0 +1,148 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/udp/client"
+)
+
+// The CoAP Option ID for a short reference to an access token which has already been sent on the connection.
+// Clients send it empty alongside OptionIDAccessToken to ask for a reference, which the server returns in the
+// same option on the response. Subsequent requests on the connection to the same host send the reference instead of
+// the token.
+// It is critical, so servers which do not support references reject requests which use them rather than
+// treating them as unauthenticated. Servers reject references they do not know with 4.02 Bad Option, in which
+// case clients should send the full token again.
+var OptionIDAccessTokenRef = message.OptionID(257)
+
+const ctxValTokenRefs = "ctxValTokenRefs"
+
+// The max number of token references remembered per connection. When a connection uses more access tokens than
+// this, the oldest reference is forgotten.
+const maxTokenRefs = 8
+
+// tokenRefs are the access token references issued on a single connection. A connection may carry requests for
+// several virtual hosted homeservers, picked with Uri-Host, so a reference is only valid for requests to the host
+// it was issued for. Otherwise a reference issued for the token of one homeserver could send it to another.
+type tokenRefs struct {
+	mu      sync.Mutex
+	next    uint64
+	byRef   map[string]hostToken // ref -> the token and the host it was issued for
+	byToken map[hostToken][]byte // token and host -> ref
+	order   []string             // refs, oldest first
+}
+
+// hostToken is an access token sent to a host
+type hostToken struct {
+	host  string
+	token string
+}
+
+// tokenRefsMu guards creating tokenRefs and accessTokens for a connection
+var tokenRefsMu sync.Mutex
+
+func tokenRefsFor(conn *client.ClientConn) *tokenRefs {
+	tokenRefsMu.Lock()
+	defer tokenRefsMu.Unlock()
+	refs, ok := conn.Context().Value(ctxValTokenRefs).(*tokenRefs)
+	if !ok {
+		refs = &tokenRefs{
+			byRef:   make(map[string]hostToken),
+			byToken: make(map[hostToken][]byte),
+		}
+		conn.SetContextValue(ctxValTokenRefs, refs)
+	}
+	return refs
+}
+
+// issue returns the reference for the access token sent to host, issuing a new one if needed
+func (t *tokenRefs) issue(host, token string) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := hostToken{host: normaliseHost(host), token: token}
+	if ref, ok := t.byToken[key]; ok {
+		return ref
+	}
+	if len(t.order) >= maxTokenRefs {
+		oldest := t.order[0]
+		t.order = t.order[1:]
+		delete(t.byToken, t.byRef[oldest])
+		delete(t.byRef, oldest)
+	}
+	t.next++
+	buf := make([]byte, binary.MaxVarintLen64)
+	ref := buf[:binary.PutUvarint(buf, t.next)]
+	t.byRef[string(ref)] = key
+	t.byToken[key] = ref
+	t.order = append(t.order, string(ref))
+	return ref
+}
+
+// resolve returns the access token for the reference, or false if the reference is unknown or was issued for a
+// different host
+func (t *tokenRefs) resolve(host string, ref []byte) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key, ok := t.byRef[string(ref)]
+	if !ok || key.host != normaliseHost(host) {
+		return "", false
+	}
+	return key.token, true
+}
+
+// accessTokens are the Authorization headers last sent on a single connection for each host, which requests to the
+// host without an access token are sent with. Like tokenRefs, they are per host so the token of one virtual hosted
+// homeserver is never sent to another.
+type accessTokens struct {
+	mu     sync.Mutex
+	byHost map[string]string
+}
+
+func accessTokensFor(conn *client.ClientConn) *accessTokens {
+	tokenRefsMu.Lock()
+	defer tokenRefsMu.Unlock()
+	tokens, ok := conn.Context().Value(ctxValAccessToken).(*accessTokens)
+	if !ok {
+		tokens = &accessTokens{
+			byHost: make(map[string]string),
+		}
+		conn.SetContextValue(ctxValAccessToken, tokens)
+	}
+	return tokens
+}
+
+// remember sets the Authorization header for requests to host
+func (a *accessTokens) remember(host, authHeader string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.byHost[normaliseHost(host)] = authHeader
+}
+
+// get returns the Authorization header last sent to host, or "" if there is none
+func (a *accessTokens) get(host string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.byHost[normaliseHost(host)]
+}
+
+// normaliseHost returns host in the form used as a key, as host names are case insensitive
+func normaliseHost(host string) string {
+	return strings.ToLower(host)
+}
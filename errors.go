@@ -0,0 +1,65 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import "errors"
+
+// The causes of errors returned by this package and by the mobile transport. Check for them with errors.Is,
+// as the error messages are for humans and may change, e.g:
+//
+//	if errors.Is(err, lb.ErrTimeout) { ... }
+var (
+	// The DTLS handshake failed or did not complete
+	ErrHandshake = errors.New("handshake failed")
+	// The request or handshake timed out
+	ErrTimeout = errors.New("timed out")
+	// The connection was closed or reset while a request was in flight
+	ErrReset = errors.New("connection reset")
+	// The request or response is too large to send
+	ErrTooLarge = errors.New("too large")
+	// The body is not valid CBOR, or cannot be converted to JSON
+	ErrCBORDecode = errors.New("cbor decode failed")
+)
+
+// Error is an error with a known cause, which is one of the Err values in this package. errors.Is matches the
+// cause as well as anything Err wraps, and errors.As can be used to get the Error itself.
+type Error struct {
+	// The cause of the error e.g ErrTimeout
+	Cause error
+	// The underlying error, which may be nil
+	Err error
+}
+
+// NewError returns an Error with the cause, wrapping err
+func NewError(cause, err error) *Error {
+	return &Error{Cause: cause, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Cause.Error()
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is the cause of this error
+func (e *Error) Is(target error) bool {
+	return target == e.Cause
+}
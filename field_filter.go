@@ -0,0 +1,191 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// FieldFilter strips configured fields from JSON response bodies before they are converted to CBOR, for extreme
+// low bandwidth deployments where clients do not need e.g `unsigned.age_ts`. This is lossy: clients never see the
+// stripped fields, and cannot tell they were there, so only strip fields no client relies on.
+type FieldFilter struct {
+	endpoints []fieldFilterEndpoint
+}
+
+type fieldFilterEndpoint struct {
+	// the path segments after the client-server API version, where {placeholder} matches any one segment
+	template []string
+	// the fields to strip, as keys of nested objects where * matches every key or array element
+	fields [][]string
+}
+
+// NewFieldFilter parses a list of endpoints and the fields to strip from their responses, of the form
+// `endpoint=field,field;endpoint=field`, e.g `/sync=rooms.join.*.timeline.events.*.unsigned.age_ts`.
+// Endpoints are matched after the client-server API version, so /sync matches /_matrix/client/r0/sync and
+// /_matrix/client/v3/sync, and a {placeholder} segment matches any one segment e.g /rooms/{roomId}/messages.
+// Fields are dot separated keys of nested objects, where * matches every key of an object or element of an
+// array, and \. is a literal dot e.g `chunk.*.unsigned.m\.relations`.
+func NewFieldFilter(spec string) (*FieldFilter, error) {
+	f := &FieldFilter{}
+	for _, entry := range strings.Split(spec, ";") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("%q is not of the form endpoint=field,field", entry)
+		}
+		endpoint := kv[0]
+		if !strings.HasPrefix(endpoint, "/") || strings.Contains(endpoint, "//") || strings.HasSuffix(endpoint, "/") {
+			return nil, fmt.Errorf("endpoint %q must begin with / and have no empty segments", endpoint)
+		}
+		e := fieldFilterEndpoint{
+			template: strings.Split(endpoint[1:], "/"),
+		}
+		for _, field := range strings.Split(kv[1], ",") {
+			keys := splitFieldPath(strings.TrimSpace(field))
+			for _, k := range keys {
+				if k == "" {
+					return nil, fmt.Errorf("field %q of endpoint %s has an empty key", field, endpoint)
+				}
+			}
+			e.fields = append(e.fields, keys)
+		}
+		f.endpoints = append(f.endpoints, e)
+	}
+	return f, nil
+}
+
+// splitFieldPath splits a field on dots which are not escaped with a backslash
+func splitFieldPath(field string) []string {
+	var keys []string
+	var key strings.Builder
+	for i := 0; i < len(field); i++ {
+		switch {
+		case field[i] == '\\' && i+1 < len(field) && field[i+1] == '.':
+			key.WriteByte('.')
+			i++
+		case field[i] == '.':
+			keys = append(keys, key.String())
+			key.Reset()
+		default:
+			key.WriteByte(field[i])
+		}
+	}
+	return append(keys, key.String())
+}
+
+// Filter returns the JSON body of a response to the HTTP path with the configured fields stripped. Bodies of
+// endpoints with no fields configured are returned as they are. Returns an error if the body must be filtered
+// but is not valid JSON.
+func (f *FieldFilter) Filter(path string, body []byte) ([]byte, error) {
+	fields := f.fieldsFor(path)
+	if len(fields) == 0 {
+		return body, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// keep numbers as they were, rather than round tripping them through float64
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, fmt.Errorf("cannot filter response to %s: %w", path, err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("cannot filter response to %s: trailing data after JSON", path)
+	}
+	stripped := false
+	for _, keys := range fields {
+		stripped = stripField(v, keys) || stripped
+	}
+	if !stripped {
+		return body, nil
+	}
+	return json.Marshal(v)
+}
+
+// fieldsFor returns the fields to strip from responses to the HTTP path
+func (f *FieldFilter) fieldsFor(path string) [][]string {
+	if f == nil || !strings.HasPrefix(path, "/_matrix/client/") {
+		return nil
+	}
+	// skip the version
+	segments := strings.Split(strings.TrimPrefix(path, "/_matrix/client/"), "/")[1:]
+	var fields [][]string
+	for _, e := range f.endpoints {
+		if matchTemplate(e.template, segments) {
+			fields = append(fields, e.fields...)
+		}
+	}
+	return fields
+}
+
+// matchTemplate returns true if the segments match the template, where {placeholder} matches any one segment
+func matchTemplate(template, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+	for i, t := range template {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if t != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// stripField deletes the field at keys from v, returning true if anything was deleted
+func stripField(v interface{}, keys []string) bool {
+	key := keys[0]
+	last := len(keys) == 1
+	stripped := false
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if key == "*" {
+			for k, child := range val {
+				if last {
+					delete(val, k)
+					stripped = true
+				} else {
+					stripped = stripField(child, keys[1:]) || stripped
+				}
+			}
+			return stripped
+		}
+		child, ok := val[key]
+		if !ok {
+			return false
+		}
+		if last {
+			delete(val, key)
+			return true
+		}
+		return stripField(child, keys[1:])
+	case []interface{}:
+		// array elements can only be reached with *, and are never deleted as that would change the indexes
+		if key != "*" || last {
+			return false
+		}
+		for _, child := range val {
+			stripped = stripField(child, keys[1:]) || stripped
+		}
+		return stripped
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	stdjson "encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestFieldFilter(t *testing.T) {
+	f, err := NewFieldFilter(`/sync=rooms.join.*.timeline.events.*.unsigned.age_ts,rooms.join.*.timeline.events.*.unsigned.m\.relations;` +
+		`/rooms/{roomId}/messages=chunk.*.unsigned`)
+	if err != nil {
+		t.Fatalf("NewFieldFilter: %s", err)
+	}
+	syncBody := `{"next_batch":"s1","rooms":{"join":{"!a:b":{"timeline":{"events":[` +
+		`{"type":"m.room.message","content":{"body":"hi","age_ts":1},"unsigned":{"age_ts":1620000000000,"m.relations":{},"transaction_id":"t1"}},` +
+		`{"type":"m.room.member","unsigned":{"age":12}},` +
+		`{"type":"m.room.create"}` +
+		`]}},"!c:d":{"timeline":{"events":[{"unsigned":{"age_ts":9007199254740993}}]}}}}}`
+	testCases := []struct {
+		path string
+		body string
+		want string
+	}{
+		{
+			path: "/_matrix/client/r0/sync",
+			body: syncBody,
+			// fields with the same name elsewhere, e.g in content, are kept
+			want: `{"next_batch":"s1","rooms":{"join":{"!a:b":{"timeline":{"events":[` +
+				`{"content":{"age_ts":1,"body":"hi"},"type":"m.room.message","unsigned":{"transaction_id":"t1"}},` +
+				`{"type":"m.room.member","unsigned":{"age":12}},` +
+				`{"type":"m.room.create"}` +
+				`]}},"!c:d":{"timeline":{"events":[{"unsigned":{}}]}}}}}`,
+		},
+		{
+			path: "/_matrix/client/v3/sync",
+			body: syncBody,
+			want: `{"next_batch":"s1","rooms":{"join":{"!a:b":{"timeline":{"events":[` +
+				`{"content":{"age_ts":1,"body":"hi"},"type":"m.room.message","unsigned":{"transaction_id":"t1"}},` +
+				`{"type":"m.room.member","unsigned":{"age":12}},` +
+				`{"type":"m.room.create"}` +
+				`]}},"!c:d":{"timeline":{"events":[{"unsigned":{}}]}}}}}`,
+		},
+		{
+			path: "/_matrix/client/r0/rooms/!a:b/messages",
+			body: `{"start":"t1","chunk":[{"type":"m.room.message","unsigned":{"age":1}},{"type":"m.room.message"}]}`,
+			want: `{"chunk":[{"type":"m.room.message"},{"type":"m.room.message"}],"start":"t1"}`,
+		},
+		// other endpoints are not filtered, even if they have the same fields
+		{
+			path: "/_matrix/client/r0/rooms/!a:b/context/$ev",
+			body: `{"event":{"unsigned":{"age_ts":1}},"chunk":[{"unsigned":{}}]}`,
+			want: `{"event":{"unsigned":{"age_ts":1}},"chunk":[{"unsigned":{}}]}`,
+		},
+		{
+			path: "/_matrix/client/r0/rooms/!a:b/messages/extra",
+			body: `{"chunk":[{"unsigned":{}}]}`,
+			want: `{"chunk":[{"unsigned":{}}]}`,
+		},
+		// nothing to strip leaves the body as it was
+		{
+			path: "/_matrix/client/r0/sync",
+			body: `{"next_batch":"s2", "rooms":{}}`,
+			want: `{"next_batch":"s2", "rooms":{}}`,
+		},
+	}
+	for _, tc := range testCases {
+		got, err := f.Filter(tc.path, []byte(tc.body))
+		if err != nil {
+			t.Fatalf("%s: Filter: %s", tc.path, err)
+		}
+		if !stdjson.Valid(got) {
+			t.Fatalf("%s: Filter returned invalid JSON: %s", tc.path, got)
+		}
+		if tc.body == tc.want {
+			if string(got) != tc.want {
+				t.Errorf("%s: body was changed:\ngot  %s\nwant %s", tc.path, got, tc.want)
+			}
+			continue
+		}
+		// compare filtered bodies regardless of key order
+		canonical, err := gomatrixserverlib.CanonicalJSON(got)
+		if err != nil {
+			t.Fatalf("%s: CanonicalJSON: %s", tc.path, err)
+		}
+		want, err := gomatrixserverlib.CanonicalJSON([]byte(tc.want))
+		if err != nil {
+			t.Fatalf("%s: CanonicalJSON: %s", tc.path, err)
+		}
+		if string(canonical) != string(want) {
+			t.Errorf("%s:\ngot  %s\nwant %s", tc.path, canonical, want)
+		}
+	}
+
+	if _, err := f.Filter("/_matrix/client/r0/sync", []byte(`{"rooms":`)); err == nil {
+		t.Errorf("Filter accepted invalid JSON")
+	}
+	// numbers too large for a float64 are kept exactly
+	got, err := f.Filter("/_matrix/client/r0/rooms/!a:b/messages", []byte(`{"chunk":[{"unsigned":{}}],"ts":9007199254740993}`))
+	if err != nil {
+		t.Fatalf("Filter: %s", err)
+	}
+	if want := `{"chunk":[{}],"ts":9007199254740993}`; string(got) != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+}
+
+func TestNewFieldFilterInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"/sync",
+		"/sync=",
+		"sync=next_batch",
+		"/sync/=next_batch",
+		"/sync=rooms..join",
+		"/sync=rooms.join.",
+		"/sync=next_batch;",
+	} {
+		if _, err := NewFieldFilter(spec); err == nil {
+			t.Errorf("NewFieldFilter accepted %q", spec)
+		}
+	}
+}
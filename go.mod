@@ -1,6 +1,6 @@
 module github.com/matrix-org/lb
 
-go 1.14
+go 1.18
 
 require (
 	github.com/fxamacker/cbor/v2 v2.3.0
@@ -8,9 +8,29 @@ require (
 	github.com/matrix-org/go-coap/v2 v2.0.0-20210608155919-691db5a1ade4
 	github.com/matrix-org/gomatrixserverlib v0.0.0-20210817115641-f9416ac1a723
 	github.com/matrix-org/lb/mobile v0.0.0-20210916112530-c96d4b6f4a58
-	github.com/pion/dtls/v2 v2.0.10-0.20210502094952-3dc563b9aede
+	github.com/pion/dtls/v2 v2.1.5
 	github.com/sirupsen/logrus v1.8.1
 	github.com/tidwall/gjson v1.9.1
 	github.com/tidwall/sjson v1.2.2
-	golang.org/x/net v0.0.0-20210916014120-12bc252f5db8 // indirect
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/dsnet/golib/memfile v1.0.0 // indirect
+	github.com/matrix-org/gomatrix v0.0.0-20210324163249-be2af5ef2e16 // indirect
+	github.com/matrix-org/util v0.0.0-20200807132607-55161520e1d4 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/transport v0.13.0 // indirect
+	github.com/pion/udp v0.1.1 // indirect
+	github.com/plgd-dev/kit v0.0.0-20210614190235-99984a49de48 // indirect
+	github.com/tidwall/match v1.0.3 // indirect
+	github.com/tidwall/pretty v1.2.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	go.uber.org/atomic v1.9.0 // indirect
+	golang.org/x/crypto v0.0.0-20220427172511-eb4f295cb31f // indirect
+	golang.org/x/net v0.1.0 // indirect
+	golang.org/x/sys v0.1.0 // indirect
 )
@@ -0,0 +1,260 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lbtest contains helpers for testing low bandwidth clients and servers under adverse network conditions
+package lbtest
+
+import (
+	"container/heap"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// The extra delay for reordered packets when LossyConfig.ReorderDelay is not set
+const defaultReorderDelay = 20 * time.Millisecond
+
+// LossyConfig is the network conditions a LossyConn simulates. The zero value is a perfect link.
+type LossyConfig struct {
+	// The probability that each packet written is lost, from 0 to 1.
+	SendLoss float64
+	// The probability that each packet read is lost, from 0 to 1.
+	ReceiveLoss float64
+	// The delay added to each packet written, plus or minus up to Jitter. Packets are still sent in order unless
+	// they are reordered.
+	Latency time.Duration
+	Jitter  time.Duration
+	// The probability that each packet written is delayed by a further ReorderDelay, so packets written after it
+	// overtake it, from 0 to 1.
+	Reorder      float64
+	ReorderDelay time.Duration
+	// The seed for choosing which packets are lost and reordered, so runs with the same seed and the same packets
+	// lose and reorder the same packets. Only used by NewLossyConn.
+	Seed int64
+}
+
+// LossyStats counts the packets a LossyConn has handled
+type LossyStats struct {
+	Sent            int64
+	Received        int64
+	DroppedSent     int64
+	DroppedReceived int64
+	Reordered       int64
+}
+
+// LossyConn wraps a packet-oriented net.Conn, e.g a UDP socket, which loses, delays and reorders the packets
+// written to it and loses the packets read from it. Each Write is one packet, and each Read returns one packet.
+// Losses on writes are silent, as they are on a real link.
+type LossyConn struct {
+	net.Conn
+	mu           sync.Mutex
+	cfg          LossyConfig
+	rand         *rand.Rand
+	stats        LossyStats
+	dropSent     int
+	dropReceived int
+	// packets waiting to be written, ordered by when they are due
+	queue   packetQueue
+	lastDue time.Time
+	seq     int64
+	wake    chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// NewLossyConn wraps conn with the network conditions in cfg
+func NewLossyConn(conn net.Conn, cfg LossyConfig) *LossyConn {
+	c := &LossyConn{
+		Conn:   conn,
+		cfg:    cfg,
+		rand:   rand.New(rand.NewSource(cfg.Seed)),
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	go c.sendLoop()
+	return c
+}
+
+// SetConfig changes the network conditions for packets from now on. Packets already delayed are not affected.
+func (c *LossyConn) SetConfig(cfg LossyConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg = cfg
+}
+
+// DropSent loses the next n packets written, whatever the config says. This is for tests which need to lose a
+// particular packet, e.g the first response to a request.
+func (c *LossyConn) DropSent(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropSent += n
+}
+
+// DropReceived loses the next n packets read, whatever the config says
+func (c *LossyConn) DropReceived(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropReceived += n
+}
+
+// Stats returns a snapshot of the packet counters
+func (c *LossyConn) Stats() LossyStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Read returns the next packet which is not lost
+func (c *LossyConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(b)
+		if err != nil {
+			return n, err
+		}
+		c.mu.Lock()
+		c.stats.Received++
+		drop := c.dropReceived > 0 || c.chance(c.cfg.ReceiveLoss)
+		if drop {
+			if c.dropReceived > 0 {
+				c.dropReceived--
+			}
+			c.stats.DroppedReceived++
+		}
+		c.mu.Unlock()
+		if !drop {
+			return n, nil
+		}
+	}
+}
+
+// Write sends the packet after the configured latency, unless it is lost
+func (c *LossyConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.stats.Sent++
+	if c.dropSent > 0 || c.chance(c.cfg.SendLoss) {
+		if c.dropSent > 0 {
+			c.dropSent--
+		}
+		c.stats.DroppedSent++
+		c.mu.Unlock()
+		return len(b), nil
+	}
+	now := time.Now()
+	due := now.Add(c.cfg.Latency)
+	if c.cfg.Jitter > 0 {
+		due = due.Add(time.Duration((c.rand.Float64()*2 - 1) * float64(c.cfg.Jitter)))
+	}
+	reorder := c.chance(c.cfg.Reorder)
+	if reorder {
+		c.stats.Reordered++
+		delay := c.cfg.ReorderDelay
+		if delay == 0 {
+			delay = defaultReorderDelay
+		}
+		due = due.Add(delay)
+	} else {
+		// jitter does not reorder packets, as on most real links
+		if due.Before(c.lastDue) {
+			due = c.lastDue
+		}
+		c.lastDue = due
+	}
+	if !due.After(now) && len(c.queue) == 0 {
+		c.mu.Unlock()
+		return c.Conn.Write(b)
+	}
+	c.seq++
+	heap.Push(&c.queue, &packet{due: due, seq: c.seq, data: append([]byte(nil), b...)})
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return len(b), nil
+}
+
+// Close closes the underlying conn. Packets which are still delayed are lost.
+func (c *LossyConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// chance returns true with probability p. The caller must hold mu.
+func (c *LossyConn) chance(p float64) bool {
+	return p > 0 && c.rand.Float64() < p
+}
+
+// sendLoop writes delayed packets when they are due
+func (c *LossyConn) sendLoop() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		var wait time.Duration = time.Hour
+		var due []*packet
+		now := time.Now()
+		for len(c.queue) > 0 {
+			if next := c.queue[0]; next.due.After(now) {
+				wait = next.due.Sub(now)
+				break
+			}
+			due = append(due, heap.Pop(&c.queue).(*packet))
+		}
+		c.mu.Unlock()
+		for _, p := range due {
+			c.Conn.Write(p.data)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-c.closed:
+			return
+		case <-c.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+type packet struct {
+	due  time.Time
+	seq  int64
+	data []byte
+}
+
+// packetQueue is a heap of packets ordered by when they are due, then by when they were written
+type packetQueue []*packet
+
+func (q packetQueue) Len() int { return len(q) }
+func (q packetQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].due.Before(q[j].due)
+}
+func (q packetQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *packetQueue) Push(x interface{}) { *q = append(*q, x.(*packet)) }
+func (q *packetQueue) Pop() interface{} {
+	old := *q
+	p := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return p
+}
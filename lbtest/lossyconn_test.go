@@ -0,0 +1,130 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lbtest
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newUDPPair returns a LossyConn and the plain UDP socket it is connected to
+func newUDPPair(t *testing.T, cfg LossyConfig) (*LossyConn, net.PacketConn) {
+	t.Helper()
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	conn, err := net.Dial("udp", peer.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	c := NewLossyConn(conn, cfg)
+	t.Cleanup(func() {
+		c.Close()
+		peer.Close()
+	})
+	return c, peer
+}
+
+// receive reads packets from peer until none arrive for 100ms, returning the first byte of each
+func receive(t *testing.T, peer net.PacketConn) []byte {
+	t.Helper()
+	var got []byte
+	buf := make([]byte, 16)
+	for {
+		peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := peer.ReadFrom(buf)
+		if err != nil {
+			return got
+		}
+		if n != 1 {
+			t.Fatalf("got a %d byte packet want 1 byte", n)
+		}
+		got = append(got, buf[0])
+	}
+}
+
+func TestLossyConnSendLoss(t *testing.T) {
+	send := func() ([]byte, LossyStats) {
+		c, peer := newUDPPair(t, LossyConfig{SendLoss: 0.5, Seed: 42})
+		for i := 0; i < 50; i++ {
+			if n, err := c.Write([]byte{byte(i)}); n != 1 || err != nil {
+				t.Fatalf("Write: got %d, %v", n, err)
+			}
+		}
+		return receive(t, peer), c.Stats()
+	}
+	got, stats := send()
+	if len(got) < 10 || len(got) > 40 {
+		t.Errorf("got %d of 50 packets with 50%% loss", len(got))
+	}
+	if stats.Sent != 50 || stats.DroppedSent != int64(50-len(got)) {
+		t.Errorf("got stats %+v want 50 sent, %d dropped", stats, 50-len(got))
+	}
+	// the same seed loses the same packets
+	if again, _ := send(); !reflect.DeepEqual(got, again) {
+		t.Errorf("same seed: got packets %v then %v", got, again)
+	}
+}
+
+func TestLossyConnDropReceived(t *testing.T) {
+	c, peer := newUDPPair(t, LossyConfig{})
+	for i := 0; i < 3; i++ {
+		peer.WriteTo([]byte{byte(i)}, c.LocalAddr())
+	}
+	c.DropReceived(2)
+	buf := make([]byte, 16)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := c.Read(buf)
+	if err != nil || n != 1 || buf[0] != 2 {
+		t.Fatalf("Read: got %v, %v want the third packet", buf[:n], err)
+	}
+	if stats := c.Stats(); stats.Received != 3 || stats.DroppedReceived != 2 {
+		t.Errorf("got stats %+v want 3 received, 2 dropped", stats)
+	}
+}
+
+func TestLossyConnLatencyAndReorder(t *testing.T) {
+	c, peer := newUDPPair(t, LossyConfig{Latency: 50 * time.Millisecond, Jitter: 20 * time.Millisecond})
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		c.Write([]byte{byte(i)})
+	}
+	buf := make([]byte, 16)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := peer.ReadFrom(buf); err != nil {
+		t.Fatalf("ReadFrom: %s", err)
+	}
+	if took := time.Since(start); took < 30*time.Millisecond {
+		t.Errorf("first packet took %v want at least 30ms", took)
+	}
+	// jitter does not reorder packets
+	if got, want := receive(t, peer), []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got packets %v want %v", got, want)
+	}
+
+	c.SetConfig(LossyConfig{Reorder: 1})
+	c.Write([]byte{10})
+	c.SetConfig(LossyConfig{})
+	c.Write([]byte{11})
+	if got, want := receive(t, peer), []byte{11, 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got packets %v want %v", got, want)
+	}
+	if stats := c.Stats(); stats.Reordered != 1 {
+		t.Errorf("got stats %+v want 1 reordered", stats)
+	}
+}
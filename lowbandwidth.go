@@ -32,9 +32,39 @@ func NewCBORCodecV1(canonical bool) *CBORCodec {
 		// this should never happen as the key map is static
 		panic("failed to create cbor v1 codec: " + err.Error())
 	}
+	c.dictionary = DictionaryV1
 	return c
 }
 
+// NewCBORCodecV2 creates a v2 codec, which has more keys than v1 and also replaces frequent values and prefixes.
+// Only use it with peers which know v2, see DictionaryVersions. A v1 codec decodes bodies of ContentTypeCBORV2
+// with v2 in CBORToJSONHandler, so servers can use a v1 codec for both.
+func NewCBORCodecV2(canonical bool) *CBORCodec {
+	c, err := NewCBORCodecWithValues(cborv2Keys, cborv2Values, cborv2Prefixes, canonical)
+	if err != nil {
+		// this should never happen as the key map and values are static
+		panic("failed to create cbor v2 codec: " + err.Error())
+	}
+	c.dictionary = DictionaryV2
+	return c
+}
+
+// The versions of the dictionary of CBOR keys and values and CoAP path enums. v1 is used unless both peers know
+// v2, which they find out with the Capabilities exchange.
+const (
+	DictionaryV1 = "v1"
+	DictionaryV2 = "v2"
+)
+
+// DictionaryVersions are the dictionary versions this library knows, oldest first
+var DictionaryVersions = []string{DictionaryV1, DictionaryV2}
+
+// dictionaryCodecs are the codecs of each dictionary version, for ForDictionary
+var dictionaryCodecs = map[string]*CBORCodec{
+	DictionaryV1: NewCBORCodecV1(false),
+	DictionaryV2: NewCBORCodecV2(false),
+}
+
 // CBORToJSONHandler transparently wraps JSON http handlers to accept and produce CBOR.
 // It wraps the provided `next` handler and modifies it in two ways:
 //
@@ -44,22 +74,31 @@ func NewCBORCodecV1(canonical bool) *CBORCodec {
 //     JSON written via Write() into CBOR, if and only if the header 'application/json' is
 //     written first (before WriteHeader() is called).
 //
+// Requests with a ContentTypePlainCBOR body are decoded without the codec's dictionary, and requests which
+// Accept ContentTypePlainCBOR get responses encoded without it. Likewise, ContentTypeCBORV2 bodies are decoded,
+// and responses for requests which Accept it are encoded, with the v2 dictionary.
+//
 // This is the main function users of this library should use if they wish to transparently
 // handle CBOR. This needs to be combined with CoAP handling to handle all of MSC3079.
 func CBORToJSONHandler(next http.Handler, codec *CBORCodec, logger Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		if req.Header.Get("Content-Type") == "application/cbor" {
-			body, err := codec.CBORToJSON(req.Body)
+		if reqCodec := codec.ForContentType(req.Header.Get("Content-Type")); reqCodec != nil {
+			body, err := reqCodec.CBORToJSON(req.Body)
 			if err != nil && logger != nil {
 				logger.Printf("CBORToJSON: failed to convert - %s", err)
 			}
 			req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
 			req.Header.Set("Content-Type", "application/json")
 		}
-		next.ServeHTTP(&jsonToCBORWriter{
+		jw := &jsonToCBORWriter{
 			ResponseWriter: w,
-			CBORCodec:      codec,
-		}, req)
+		}
+		jw.CBORCodec, jw.contentType = codec.ForAccept(req.Header.Get("Accept"))
+		if jw.contentType != "application/cbor" {
+			// the homeserver only speaks JSON, so doesn't need to know
+			req.Header.Del("Accept")
+		}
+		next.ServeHTTP(jw, req)
 	})
 }
 
@@ -75,3 +114,14 @@ func NewCoAPPathV1() *CoAPPath {
 	}
 	return p
 }
+
+// NewCoAPPathV2 creates CoAP enum path mappings for version 2, which has more paths than version 1. Servers can
+// use it for clients which only know version 1, as they send the new paths in full.
+func NewCoAPPathV2() *CoAPPath {
+	p, err := NewCoAPPath(coapv2pathMappings)
+	if err != nil {
+		// this shouldn't be possible as the key map is static
+		panic("failed to create coap v2 paths: " + err.Error())
+	}
+	return p
+}
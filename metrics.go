@@ -0,0 +1,93 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+// MetricsSink is an interface which can be satisfied to collect metrics from the codec and the CoAP transport, e.g
+// to forward them to OpenTelemetry or statsd. PrometheusSink serves them in the Prometheus text format. It is
+// entirely optional, in which case no metrics are collected, as with NopMetricsSink.
+//
+// Metrics are identified by name and label values. Implementations must be safe to call from multiple goroutines.
+type MetricsSink interface {
+	// Counter adds delta, which is never negative, to the counter
+	Counter(name string, labels map[string]string, delta float64)
+	// Gauge sets the value of the gauge
+	Gauge(name string, labels map[string]string, value float64)
+	// Histogram records a single observation of value e.g how long something took, in seconds
+	Histogram(name string, labels map[string]string, value float64)
+}
+
+// NopMetricsSink is a MetricsSink which discards all metrics
+type NopMetricsSink struct{}
+
+func (NopMetricsSink) Counter(name string, labels map[string]string, delta float64)   {}
+func (NopMetricsSink) Gauge(name string, labels map[string]string, value float64)     {}
+func (NopMetricsSink) Histogram(name string, labels map[string]string, value float64) {}
+
+// The metrics emitted by this library
+const (
+	// Counter of CBORToJSON and JSONToCBOR calls, labelled with the conversion (cbor_to_json or json_to_cbor) and
+	// the result (ok or error)
+	metricCodecConversions = "lb_codec_conversions_total"
+	// Histogram of how long conversions took in seconds, labelled with the conversion
+	metricCodecDuration = "lb_codec_duration_seconds"
+	// Counter of CoAP requests handled by CoAPHTTPHandler, labelled with the HTTP method and the HTTP status code
+	// of the response. Requests which are rejected before they reach the HTTP handler are not counted.
+	metricCoAPRequests = "lb_coap_requests_total"
+	// Histogram of how long the HTTP handler took to respond to CoAP requests in seconds, labelled with the method
+	metricCoAPRequestDuration = "lb_coap_request_duration_seconds"
+	// Gauge of the number of OBSERVE registrations
+	metricCoAPObservations = "lb_coap_observations"
+	// Gauge of how long in seconds the OBSERVE registration which has gone longest without a notification has gone
+	// without one, see Observations.LastNotificationAge
+	metricObserveNotificationAge = "lb_observe_last_notification_age_seconds"
+)
+
+// libraryMetrics are the descriptions of the metrics emitted by this library, for sinks which use them
+var libraryMetrics = []struct {
+	name    string
+	help    string
+	buckets []float64
+}{
+	{metricCodecConversions, "The number of conversions between CBOR and JSON.", nil},
+	{metricCodecDuration, "How long conversions between CBOR and JSON took in seconds.",
+		[]float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1}},
+	{metricCoAPRequests, "The number of CoAP requests handled.", nil},
+	{metricCoAPRequestDuration, "How long CoAP requests took to handle in seconds.", nil},
+	{metricCoAPObservations, "The number of CoAP OBSERVE registrations.", nil},
+	{metricObserveNotificationAge, "How long the CoAP OBSERVE registration which has gone longest without a notification has gone without one in seconds.", nil},
+}
+
+// MetricsDescriber can be satisfied by a MetricsSink which needs to know more about a metric than its name, like
+// PrometheusSink, which needs help text and histogram buckets. Use DescribeMetric to describe a metric to any sink.
+type MetricsDescriber interface {
+	// Describe sets the help text of a metric and, if it is a histogram, the upper bounds of its buckets.
+	// buckets is nil for metrics which are not histograms, or to use the default buckets.
+	Describe(name, help string, buckets []float64)
+}
+
+// DescribeMetric describes the metric to the sink if it is a MetricsDescriber, and does nothing otherwise
+func DescribeMetric(sink MetricsSink, name, help string, buckets []float64) {
+	if d, ok := sink.(MetricsDescriber); ok {
+		d.Describe(name, help, buckets)
+	}
+}
+
+// metricsOrNop returns the sink, or a NopMetricsSink if it is nil
+func metricsOrNop(sink MetricsSink) MetricsSink {
+	if sink == nil {
+		return NopMetricsSink{}
+	}
+	return sink
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultHistogramBuckets are the histogram buckets PrometheusSink uses for histograms which have not been described
+// with buckets, which are the same as the Prometheus client's default buckets
+var DefaultHistogramBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+const (
+	prometheusCounter   = "counter"
+	prometheusGauge     = "gauge"
+	prometheusHistogram = "histogram"
+)
+
+// PrometheusSink is a MetricsSink which keeps metrics in memory and serves them in the Prometheus text format as an
+// http.Handler, usually at /metrics. It does not depend on the Prometheus client libraries. A metric is always the
+// kind it was first emitted as: emitting it as another kind is ignored.
+type PrometheusSink struct {
+	mu      sync.Mutex
+	metrics map[string]*prometheusMetric
+	help    map[string]string
+	buckets map[string][]float64
+}
+
+type prometheusMetric struct {
+	kind    string
+	buckets []float64
+	series  map[string]*prometheusSeries // formatted labels -> series
+}
+
+// prometheusSeries is the value of a metric for a single set of labels
+type prometheusSeries struct {
+	value float64 // counters and gauges
+	// histograms
+	buckets []uint64 // not cumulative, the last bucket is +Inf
+	count   uint64
+	sum     float64
+}
+
+// NewPrometheusSink returns a PrometheusSink which already describes the metrics emitted by this library
+func NewPrometheusSink() *PrometheusSink {
+	s := &PrometheusSink{
+		metrics: make(map[string]*prometheusMetric),
+		help:    make(map[string]string),
+		buckets: make(map[string][]float64),
+	}
+	for _, m := range libraryMetrics {
+		s.Describe(m.name, m.help, m.buckets)
+	}
+	return s
+}
+
+// Describe sets the HELP text of a metric and its histogram buckets. It must be called before the metric is first
+// emitted for the buckets to be used.
+func (s *PrometheusSink) Describe(name, help string, buckets []float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.help[name] = help
+	if len(buckets) > 0 {
+		sorted := append([]float64(nil), buckets...)
+		sort.Float64s(sorted)
+		s.buckets[name] = sorted
+	}
+}
+
+func (s *PrometheusSink) Counter(name string, labels map[string]string, delta float64) {
+	if delta < 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if series := s.series(name, prometheusCounter, labels); series != nil {
+		series.value += delta
+	}
+}
+
+func (s *PrometheusSink) Gauge(name string, labels map[string]string, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if series := s.series(name, prometheusGauge, labels); series != nil {
+		series.value = value
+	}
+}
+
+func (s *PrometheusSink) Histogram(name string, labels map[string]string, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	series := s.series(name, prometheusHistogram, labels)
+	if series == nil {
+		return
+	}
+	buckets := s.metrics[name].buckets
+	if series.buckets == nil {
+		series.buckets = make([]uint64, len(buckets)+1)
+	}
+	series.buckets[sort.SearchFloat64s(buckets, value)]++
+	series.count++
+	series.sum += value
+}
+
+// series returns the series of the metric for the labels, creating it if needed, or nil if the metric is another
+// kind. The caller must hold mu.
+func (s *PrometheusSink) series(name, kind string, labels map[string]string) *prometheusSeries {
+	m, ok := s.metrics[name]
+	if !ok {
+		m = &prometheusMetric{
+			kind:   kind,
+			series: make(map[string]*prometheusSeries),
+		}
+		if kind == prometheusHistogram {
+			m.buckets = s.buckets[name]
+			if m.buckets == nil {
+				m.buckets = DefaultHistogramBuckets
+			}
+		}
+		s.metrics[name] = m
+	}
+	if m.kind != kind {
+		return nil
+	}
+	key := formatPrometheusLabels(labels)
+	series, ok := m.series[key]
+	if !ok {
+		series = &prometheusSeries{}
+		m.series[key] = series
+	}
+	return series
+}
+
+// formatPrometheusLabels returns the labels sorted by name e.g direction="request",endpoint="/sync"
+func formatPrometheusLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, labels[name])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// withLabel returns the formatted labels with one more label appended, in the braces of a sample
+func withLabel(labels, name, value string) string {
+	if labels == "" {
+		return fmt.Sprintf("{%s=%q}", name, value)
+	}
+	return fmt.Sprintf("{%s,%s=%q}", labels, name, value)
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// formatPrometheusValue formats whole numbers without an exponent, so byte counts are exact
+func formatPrometheusValue(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (s *PrometheusSink) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.metrics))
+	for name := range s.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		m := s.metrics[name]
+		if help := s.help[name]; help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, m.kind)
+		keys := make([]string, 0, len(m.series))
+		for k := range m.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, labels := range keys {
+			series := m.series[labels]
+			if m.kind != prometheusHistogram {
+				fmt.Fprintf(&b, "%s%s %s\n", name, braces(labels), formatPrometheusValue(series.value))
+				continue
+			}
+			var cumulative uint64
+			for i, le := range m.buckets {
+				cumulative += series.buckets[i]
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, withLabel(labels, "le", strconv.FormatFloat(le, 'f', -1, 64)), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), series.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, braces(labels), strconv.FormatFloat(series.sum, 'g', -1, 64))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, braces(labels), series.count)
+		}
+	}
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,266 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+)
+
+// fakeMetricsSink records every metric emitted as "kind name{labels}"
+type fakeMetricsSink struct {
+	mu      sync.Mutex
+	emitted []string
+	values  map[string]float64
+}
+
+func (s *fakeMetricsSink) record(kind, name string, labels map[string]string, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := fmt.Sprintf("%s %s{%s}", kind, name, formatPrometheusLabels(labels))
+	s.emitted = append(s.emitted, key)
+	if s.values == nil {
+		s.values = make(map[string]float64)
+	}
+	s.values[key] = value
+}
+
+func (s *fakeMetricsSink) Counter(name string, labels map[string]string, delta float64) {
+	s.record("counter", name, labels, delta)
+}
+
+func (s *fakeMetricsSink) Gauge(name string, labels map[string]string, value float64) {
+	s.record("gauge", name, labels, value)
+}
+
+func (s *fakeMetricsSink) Histogram(name string, labels map[string]string, value float64) {
+	s.record("histogram", name, labels, value)
+}
+
+// fakeMuxClient is the client of a fakeResponseWriter, which is not a UDP connection
+type fakeMuxClient struct {
+	coapmux.Client
+}
+
+func (fakeMuxClient) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+}
+
+func (fakeMuxClient) ClientConn() interface{} {
+	return nil
+}
+
+// fakeResponseWriter records the CoAP response
+type fakeResponseWriter struct {
+	code codes.Code
+	body []byte
+}
+
+func (w *fakeResponseWriter) SetResponse(code codes.Code, contentFormat message.MediaType, d io.ReadSeeker, opts ...message.Option) error {
+	w.code = code
+	if d != nil {
+		w.body, _ = ioutil.ReadAll(d)
+	}
+	return nil
+}
+
+func (w *fakeResponseWriter) Client() coapmux.Client {
+	return fakeMuxClient{}
+}
+
+// TestMetricsSink checks the metrics emitted when a CoAP request with a CBOR body is handled
+func TestMetricsSink(t *testing.T) {
+	sink := &fakeMetricsSink{}
+	codec := NewCBORCodecV1(true)
+	codec.Metrics = sink
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	co.Metrics = sink
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"event_id":"$abc"}`))
+	})
+	h := co.CoAPHTTPHandler(CBORToJSONHandler(next, codec, nil), nil)
+
+	body, err := codec.JSONToCBOR(bytes.NewBufferString(`{"msgtype":"m.text","body":"hello"}`))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	sink.emitted = nil
+	var opts message.Options
+	buf := make([]byte, 256)
+	opts, n, err := opts.SetPath(buf, "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/txn1")
+	if err != nil {
+		t.Fatalf("SetPath: %s", err)
+	}
+	opts, _, err = opts.SetContentFormat(buf[n:], message.AppCBOR)
+	if err != nil {
+		t.Fatalf("SetContentFormat: %s", err)
+	}
+	w := &fakeResponseWriter{}
+	h.ServeCOAP(w, &coapmux.Message{
+		Message: &message.Message{
+			Code:    codes.PUT,
+			Token:   message.Token("1"),
+			Options: opts,
+			Body:    bytes.NewReader(body),
+		},
+		IsConfirmable: true,
+	})
+	if w.code != codes.Content {
+		t.Fatalf("got code %v want %v", w.code, codes.Content)
+	}
+	want := []string{
+		`counter lb_coap_requests_total{code="200",method="PUT"}`,
+		`counter lb_codec_conversions_total{conversion="cbor_to_json",result="ok"}`,
+		`counter lb_codec_conversions_total{conversion="json_to_cbor",result="ok"}`,
+		`histogram lb_coap_request_duration_seconds{method="PUT"}`,
+		`histogram lb_codec_duration_seconds{conversion="cbor_to_json"}`,
+		`histogram lb_codec_duration_seconds{conversion="json_to_cbor"}`,
+	}
+	got := append([]string(nil), sink.emitted...)
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got metrics:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if v := sink.values[`counter lb_coap_requests_total{code="200",method="PUT"}`]; v != 1 {
+		t.Errorf("lb_coap_requests_total: got delta %v want 1", v)
+	}
+
+	// failed conversions are counted as errors
+	sink.emitted = nil
+	if _, err := codec.CBORToJSON(bytes.NewReader([]byte{0xff})); err == nil {
+		t.Fatalf("CBORToJSON: got no error for invalid CBOR")
+	}
+	if want := `counter lb_codec_conversions_total{conversion="cbor_to_json",result="error"}`; len(sink.emitted) == 0 || sink.emitted[0] != want {
+		t.Errorf("got metrics %v want %s first", sink.emitted, want)
+	}
+
+	// the number of observations is a gauge
+	sink.emitted = nil
+	ob := NewObservations(next, codec, nil)
+	ob.Metrics = sink
+	ob.addRegistration(fakeMuxClient{}, "a", "token")
+	ob.addRegistration(fakeMuxClient{}, "b", "token")
+	ob.removeRegistration("a", "token")
+	if v := sink.values[`gauge lb_coap_observations{}`]; len(sink.emitted) != 3 || v != 1 {
+		t.Errorf("got metrics %v with lb_coap_observations %v, want 3 gauges ending at 1", sink.emitted, v)
+	}
+}
+
+// TestObserveNotificationAge checks the age of the stalest observation grows without notifications, and resets when
+// there is one
+func TestObserveNotificationAge(t *testing.T) {
+	sink := &fakeMetricsSink{}
+	ob := NewObservations(http.NotFoundHandler(), NewCBORCodecV1(true), nil)
+	ob.Metrics = sink
+	age := func() float64 {
+		t.Helper()
+		if !ob.reportNotificationAge() {
+			t.Fatalf("reportNotificationAge: got false with an observation")
+		}
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return sink.values[`gauge lb_observe_last_notification_age_seconds{}`]
+	}
+	ob.addRegistration(fakeMuxClient{}, "a", "token")
+	time.Sleep(20 * time.Millisecond)
+	first := age()
+	if first < 0.02 {
+		t.Errorf("got age %vs after 20ms without a notification", first)
+	}
+	time.Sleep(20 * time.Millisecond)
+	second := age()
+	if second <= first {
+		t.Errorf("age did not increase without a notification: got %vs then %vs", first, second)
+	}
+	ob.notified("a")
+	if got := age(); got >= first {
+		t.Errorf("age did not reset after a notification: got %vs want less than %vs", got, first)
+	}
+
+	// once the observations have gone, the age is 0 and reporting stops
+	ob.removeRegistration("a", "token")
+	if ob.reportNotificationAge() {
+		t.Errorf("reportNotificationAge: got true with no observations")
+	}
+	if got := sink.values[`gauge lb_observe_last_notification_age_seconds{}`]; got != 0 {
+		t.Errorf("got age %vs with no observations want 0", got)
+	}
+}
+
+func TestPrometheusSink(t *testing.T) {
+	sink := NewPrometheusSink()
+	sink.Describe("test_seconds", "How long tests take.", []float64{1, 0.5})
+	sink.Counter("test_total", map[string]string{"b": "2", "a": `say "hi"`}, 2)
+	sink.Counter("test_total", map[string]string{"a": `say "hi"`, "b": "2"}, 1000000)
+	sink.Counter("test_total", nil, -1) // counters never go down
+	sink.Gauge("test_connections", nil, 3)
+	sink.Gauge("test_connections", nil, 1)
+	sink.Histogram("test_seconds", map[string]string{"op": "x"}, 0.25)
+	sink.Histogram("test_seconds", map[string]string{"op": "x"}, 0.75)
+	sink.Histogram("test_seconds", map[string]string{"op": "x"}, 2)
+	sink.Counter("test_seconds", nil, 1) // already a histogram
+	sink.Histogram(metricCodecDuration, nil, 0.0003)
+
+	w := httptest.NewRecorder()
+	sink.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	got := w.Body.String()
+	want := `# HELP lb_codec_duration_seconds How long conversions between CBOR and JSON took in seconds.
+# TYPE lb_codec_duration_seconds histogram
+lb_codec_duration_seconds_bucket{le="0.0001"} 0
+lb_codec_duration_seconds_bucket{le="0.00025"} 0
+lb_codec_duration_seconds_bucket{le="0.0005"} 1
+lb_codec_duration_seconds_bucket{le="0.001"} 1
+lb_codec_duration_seconds_bucket{le="0.0025"} 1
+lb_codec_duration_seconds_bucket{le="0.005"} 1
+lb_codec_duration_seconds_bucket{le="0.01"} 1
+lb_codec_duration_seconds_bucket{le="0.025"} 1
+lb_codec_duration_seconds_bucket{le="0.05"} 1
+lb_codec_duration_seconds_bucket{le="0.1"} 1
+lb_codec_duration_seconds_bucket{le="+Inf"} 1
+lb_codec_duration_seconds_sum 0.0003
+lb_codec_duration_seconds_count 1
+# TYPE test_connections gauge
+test_connections 1
+# HELP test_seconds How long tests take.
+# TYPE test_seconds histogram
+test_seconds_bucket{op="x",le="0.5"} 1
+test_seconds_bucket{op="x",le="1"} 2
+test_seconds_bucket{op="x",le="+Inf"} 3
+test_seconds_sum{op="x"} 3
+test_seconds_count{op="x"} 3
+# TYPE test_total counter
+test_total{a="say \"hi\"",b="2"} 1000002
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
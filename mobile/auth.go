@@ -0,0 +1,90 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// DefaultRequireTokenPaths are client-server endpoints which always need an access token, for use with
+// ConnectionParams.RequireTokenPaths. Endpoints which only sometimes need one, like /register or /profile,
+// are deliberately not listed.
+const DefaultRequireTokenPaths = "/sync,/account/whoami,/joined_rooms,/logout,/logout/all,/keys/upload,/keys/query," +
+	"/keys/claim,/keys/changes,/sendToDevice/{eventType}/{txnId},/rooms/{roomId}/send/{eventType}/{txnId}," +
+	"/rooms/{roomId}/state/{eventType}/{stateKey},/rooms/{roomId}/typing/{userId}," +
+	"/rooms/{roomId}/receipt/{receiptType}/{eventId},/user/{userId}/filter,/user/{userId}/filter/{filterId}"
+
+// parseRequireTokenPaths parses RequireTokenPaths into the segments of each path, e.g "/sync,/rooms/{roomId}/send"
+func parseRequireTokenPaths(s string) ([][]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var paths [][]string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, "/") || strings.Contains(p, "//") || strings.HasSuffix(p, "/") {
+			return nil, fmt.Errorf("path %q must begin with / and have no empty segments", p)
+		}
+		paths = append(paths, strings.Split(p[1:], "/"))
+	}
+	return paths, nil
+}
+
+// requiresToken returns true if a request to hsURL cannot succeed without an access token, according to
+// RequireTokenPaths. Paths are matched after the client-server API version, e.g /_matrix/client/v3. A URL with an
+// access_token query parameter has its own token, so never requires one.
+func requiresToken(cp *ConnectionParams, hsURL string) bool {
+	// SetParams has already checked these
+	paths, _ := parseRequireTokenPaths(cp.RequireTokenPaths)
+	if len(paths) == 0 {
+		return false
+	}
+	u, err := url.Parse(hsURL)
+	if err != nil || !strings.HasPrefix(u.Path, "/_matrix/client/") {
+		return false
+	}
+	if u.Query().Get("access_token") != "" {
+		return false
+	}
+	// skip the version
+	segments := strings.Split(strings.TrimPrefix(u.Path, "/_matrix/client/"), "/")[1:]
+	for _, p := range paths {
+		if matchPathSegments(p, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathSegments returns true if the segments match the template, where {placeholder} matches any one segment
+func matchPathSegments(template, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+	for i, t := range template {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if t != segments[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequireTokenPaths(t *testing.T) {
+	received := make(chan string, 10)
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Method + " " + req.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	}))
+	cp := Params()
+	cp.RequireTokenPaths = DefaultRequireTokenPaths
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+
+	testCases := []struct {
+		method   string
+		path     string
+		token    string
+		wantCode int
+	}{
+		{method: "PUT", path: "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/txn1", wantCode: 401},
+		{method: "GET", path: "/_matrix/client/v3/sync", wantCode: 401},
+		{method: "PUT", path: "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/txn1", token: "secret", wantCode: 200},
+		// endpoints which may be used without a token are sent, as are unknown ones
+		{method: "GET", path: "/_matrix/client/versions", wantCode: 200},
+		{method: "POST", path: "/_matrix/client/r0/login", wantCode: 200},
+		{method: "GET", path: "/_matrix/client/r0/profile/@alice:bar", wantCode: 200},
+		{method: "GET", path: "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message", wantCode: 200},
+		// the token can be a query parameter instead, but not an empty one
+		{method: "GET", path: "/_matrix/client/v3/account/whoami?access_token=secret", wantCode: 200},
+		{method: "GET", path: "/_matrix/client/v3/account/whoami?access_token=", wantCode: 401},
+	}
+	for _, tc := range testCases {
+		res := SendRequest(tc.method, hsURL+tc.path, tc.token, "{}")
+		if res == nil {
+			t.Fatalf("%s %s: SendRequest returned nil", tc.method, tc.path)
+		}
+		if res.Code != tc.wantCode {
+			t.Errorf("%s %s: got code %d want %d: %s", tc.method, tc.path, res.Code, tc.wantCode, res.Body)
+		}
+		if tc.wantCode == 401 {
+			if res.Body != `{"errcode":"M_MISSING_TOKEN","error":"Missing access token"}` {
+				t.Errorf("%s %s: got body %s", tc.method, tc.path, res.Body)
+			}
+			if len(received) != 0 {
+				t.Errorf("%s %s: request was sent to the server: %s", tc.method, tc.path, <-received)
+			}
+		} else if got, want := <-received, tc.method+" "+strings.Split(tc.path, "?")[0]; got != want {
+			t.Errorf("%s %s: server got %s", tc.method, tc.path, got)
+		}
+	}
+}
+
+func TestRequireTokenPathsInvalid(t *testing.T) {
+	defaultParams := *Params()
+	t.Cleanup(func() { SetParams(&defaultParams) })
+	for _, paths := range []string{"sync", "/sync,", "/rooms//send", "/sync/"} {
+		cp := Params()
+		cp.RequireTokenPaths = paths
+		if err := SetParams(cp); err == nil {
+			t.Errorf("SetParams accepted RequireTokenPaths %q", paths)
+		}
+	}
+}
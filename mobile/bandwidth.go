@@ -0,0 +1,157 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	udpmessage "github.com/matrix-org/go-coap/v2/udp/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+// byteBudget is a token bucket of bytes which refills at MaxBytesPerMinute, holding at most a minute of traffic.
+// Requests wait for the bytes they send to be in the bucket. Responses are only known once they have arrived, so
+// their bytes are taken afterwards, which can leave the bucket in debt, delaying the requests which follow.
+// Background requests also wait for interactive requests which are waiting, so interactive requests go first.
+type byteBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	// the bytes per minute the bucket was last refilled at, so a new limit starts with a full bucket. 0 if the
+	// bucket has not been used since it was reset.
+	perMinute int
+	// the number of interactive requests waiting for bytes
+	waitingInteractive int
+
+	now   func() time.Time
+	after func(d time.Duration) <-chan time.Time
+}
+
+func newByteBudget() *byteBudget {
+	return &byteBudget{
+		now:   time.Now,
+		after: time.After,
+	}
+}
+
+var bandwidth = newByteBudget()
+
+// reset makes the bucket full the next time it is used, for when MaxBytesPerMinute changes
+func (b *byteBudget) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.perMinute = 0
+}
+
+// refillLocked adds the bytes earned since the last refill, up to a minute's worth
+func (b *byteBudget) refillLocked(perMinute int) {
+	now := b.now()
+	if perMinute != b.perMinute {
+		b.perMinute = perMinute
+		b.tokens = float64(perMinute)
+		b.last = now
+		return
+	}
+	b.tokens += now.Sub(b.last).Minutes() * float64(perMinute)
+	b.tokens = math.Min(b.tokens, float64(perMinute))
+	b.last = now
+}
+
+// wait blocks until n bytes can be sent, then takes them from the bucket. A request larger than the bucket
+// waits for a full bucket, rather than forever. Returns an error if ctx is done first.
+func (b *byteBudget) wait(ctx context.Context, perMinute int, n int64, background bool) error {
+	if perMinute <= 0 {
+		return nil
+	}
+	need := math.Min(float64(n), float64(perMinute))
+	b.mu.Lock()
+	if !background {
+		b.waitingInteractive++
+		defer func() {
+			b.mu.Lock()
+			b.waitingInteractive--
+			b.mu.Unlock()
+		}()
+	}
+	throttled := false
+	for {
+		b.refillLocked(perMinute)
+		if b.tokens >= need && (!background || b.waitingInteractive == 0) {
+			b.tokens -= float64(n)
+			b.mu.Unlock()
+			if throttled {
+				recordThrottledRequest()
+			}
+			return nil
+		}
+		// background requests poll while interactive requests are waiting, as they may be waiting on bytes too
+		delay := time.Duration((need - b.tokens) / float64(perMinute) * float64(time.Minute))
+		if delay < time.Millisecond {
+			delay = time.Millisecond
+		}
+		if background && b.waitingInteractive > 0 && delay > 100*time.Millisecond {
+			delay = 100 * time.Millisecond
+		}
+		b.mu.Unlock()
+		throttled = true
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-b.after(delay):
+		}
+		b.mu.Lock()
+	}
+}
+
+// take removes n bytes which were received from the bucket, which may leave it in debt
+func (b *byteBudget) take(perMinute int, n int64) {
+	if perMinute <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(perMinute)
+	b.tokens -= float64(n)
+}
+
+// remaining returns the bytes in the bucket, which is negative when in debt
+func (b *byteBudget) remaining(perMinute int) int64 {
+	if perMinute <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(perMinute)
+	return int64(b.tokens)
+}
+
+// takeNotificationBytes takes the bytes of an observe notification from the budget. Notifications are pushed by the
+// server so cannot be delayed, but they use up the budget for requests.
+func takeNotificationBytes(msg *pool.Message) {
+	cp := params()
+	if cp.MaxBytesPerMinute <= 0 {
+		return
+	}
+	headerSize, _ := udpmessage.Message{
+		Code:    msg.Code(),
+		Token:   msg.Token(),
+		Options: msg.Options(),
+	}.Size()
+	bodySize, _ := msg.BodySize()
+	bandwidth.take(cp.MaxBytesPerMinute, int64(headerSize)+bodySize)
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newFakeClockBudget returns a byteBudget whose clock only moves when it waits
+func newFakeClockBudget() (*byteBudget, func() time.Duration) {
+	start := time.Unix(1000, 0)
+	now := start
+	b := &byteBudget{
+		now: func() time.Time { return now },
+		after: func(d time.Duration) <-chan time.Time {
+			now = now.Add(d)
+			ch := make(chan time.Time, 1)
+			ch <- now
+			return ch
+		},
+	}
+	return b, func() time.Duration { return now.Sub(start) }
+}
+
+func TestByteBudgetCapsThroughput(t *testing.T) {
+	b, elapsed := newFakeClockBudget()
+	perMinute := 6000 // 100 bytes/sec
+	ctx := context.Background()
+	// the first minute's worth is sent straight away, then 24000 bytes more at 100 bytes/sec
+	for i := 0; i < 30; i++ {
+		if err := b.wait(ctx, perMinute, 1000, false); err != nil {
+			t.Fatalf("wait: %s", err)
+		}
+		if i == 5 && elapsed() != 0 {
+			t.Fatalf("the first %d bytes waited for %v", (i+1)*1000, elapsed())
+		}
+	}
+	if got := elapsed(); got < 239*time.Second || got > 241*time.Second {
+		t.Errorf("sending 30000 bytes took %v, want 240s", got)
+	}
+
+	// the bucket refills over time, up to one minute's worth
+	b.after(30 * time.Second)
+	if got := b.remaining(perMinute); got < 2990 || got > 3000 {
+		t.Errorf("after 30s: got %d bytes remaining, want 3000", got)
+	}
+	b.after(10 * time.Minute)
+	if got := b.remaining(perMinute); got != 6000 {
+		t.Errorf("after 10m: got %d bytes remaining, want 6000", got)
+	}
+
+	// a large response puts the bucket into debt, which delays the next request
+	b.take(perMinute, 9000)
+	if got := b.remaining(perMinute); got != -3000 {
+		t.Errorf("after response: got %d bytes remaining, want -3000", got)
+	}
+	before := elapsed()
+	if err := b.wait(ctx, perMinute, 100, false); err != nil {
+		t.Fatalf("wait: %s", err)
+	}
+	if got := elapsed() - before; got < 30*time.Second || got > 32*time.Second {
+		t.Errorf("request after debt waited %v, want 31s", got)
+	}
+
+	// requests larger than the bucket wait for a full bucket rather than forever
+	before = elapsed()
+	if err := b.wait(ctx, perMinute, 10000, false); err != nil {
+		t.Fatalf("wait: %s", err)
+	}
+	if got := elapsed() - before; got > 61*time.Second {
+		t.Errorf("large request waited %v, want at most 60s", got)
+	}
+
+	// no limit never waits
+	before = elapsed()
+	if err := b.wait(ctx, 0, 1<<30, false); err != nil || elapsed() != before {
+		t.Errorf("unlimited request waited %v: %v", elapsed()-before, err)
+	}
+}
+
+func TestByteBudgetPrioritisesInteractive(t *testing.T) {
+	b := newByteBudget()
+	perMinute := 60000 // 1000 bytes/sec
+	b.take(perMinute, 60000)
+	done := make(chan string, 2)
+	go func() {
+		b.wait(context.Background(), perMinute, 500, true)
+		done <- "background"
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		b.wait(context.Background(), perMinute, 500, false)
+		done <- "interactive"
+	}()
+	for _, want := range []string{"interactive", "background"} {
+		select {
+		case got := <-done:
+			if got != want {
+				t.Fatalf("got %s request first, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s request", want)
+		}
+	}
+
+	// waiting stops when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.wait(ctx, perMinute, 60000, false); err != context.DeadlineExceeded {
+		t.Errorf("wait: got %v want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSendRequestMaxBytesPerMinute(t *testing.T) {
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"versions":["r0.6.1"]}`))
+	}))
+	cp := Params()
+	cp.MaxBytesPerMinute = 60000
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest: got %+v", res)
+	}
+	// the request and response both use up the budget
+	if got := CurrentStats().BandwidthBudgetBytes; got >= 60000 || got < 59000 {
+		t.Errorf("BandwidthBudgetBytes: got %d want a little under 60000", got)
+	}
+
+	// use up the budget, so the next request has to wait for it to refill
+	bandwidth.take(cp.MaxBytesPerMinute, 60000)
+	before := CurrentStats()
+	if before.BandwidthBudgetBytes > 0 {
+		t.Fatalf("BandwidthBudgetBytes: got %d want <= 0", before.BandwidthBudgetBytes)
+	}
+	start := time.Now()
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest: got %+v", res)
+	}
+	if took := time.Since(start); took < 10*time.Millisecond {
+		t.Errorf("request over budget took %v, want it to wait for the budget", took)
+	}
+	if got := CurrentStats().ThrottledRequests - before.ThrottledRequests; got != 1 {
+		t.Errorf("ThrottledRequests: got %d want 1", got)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/matrix-org/lb"
+	"github.com/sirupsen/logrus"
+)
+
+// Batch is a list of requests to send in a single CoAP exchange with SendBatch. gomobile cannot bind
+// slices of structs, hence the builder.
+type Batch struct {
+	requests []lb.BatchRequest
+}
+
+// NewBatch creates an empty batch
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Add a request to the batch. The path includes the query string e.g "/_matrix/client/r0/profile/@alice:example.com".
+// The body is JSON, and can be empty.
+func (b *Batch) Add(method, path, body string) {
+	br := lb.BatchRequest{
+		Method: method,
+		Path:   path,
+	}
+	if body != "" {
+		br.Body = json.RawMessage(body)
+	}
+	b.requests = append(b.requests, br)
+}
+
+// Len returns the number of requests in the batch
+func (b *Batch) Len() int {
+	return len(b.requests)
+}
+
+// BatchResponses are the responses to a Batch, in the same order as the requests were added
+type BatchResponses struct {
+	responses []*Response
+}
+
+// Len returns the number of responses
+func (r *BatchResponses) Len() int {
+	return len(r.responses)
+}
+
+// Get the response to the i'th request in the batch
+func (r *BatchResponses) Get(i int) *Response {
+	if i < 0 || i >= len(r.responses) {
+		return nil
+	}
+	return r.responses[i]
+}
+
+// SendBatch sends all the requests in the batch to the target hsURL in a single CoAP exchange, which saves
+// round trips when making many small requests e.g on app startup. Requests are processed by the server
+// one at a time, in order. Each request succeeds or fails independently, so check the Code of every response.
+// Returns <nil> if the whole batch failed (e.g network error, or the server does not support batches) in
+// which case clients should send the requests individually.
+func SendBatch(hsURL, token string, b *Batch) *BatchResponses {
+	if b.Len() == 0 || b.Len() > lb.MaxBatchSize {
+		logrus.Errorf("SendBatch: batch must have between 1 and %d requests, got %d", lb.MaxBatchSize, b.Len())
+		return nil
+	}
+	for _, br := range b.requests {
+		if len(br.Body) > 0 && !json.Valid(br.Body) {
+			logrus.Errorf("SendBatch: request body for %s %s is not JSON", br.Method, br.Path)
+			return nil
+		}
+	}
+	body, err := json.Marshal(b.requests)
+	if err != nil {
+		logrus.WithError(err).Error("SendBatch: failed to marshal batch")
+		return nil
+	}
+	res := SendRequest("POST", strings.TrimSuffix(hsURL, "/")+lb.BatchPath, token, string(body))
+	if res == nil {
+		return nil
+	}
+	if res.Code != 200 {
+		logrus.Errorf("SendBatch: server returned HTTP %d: %s", res.Code, res.Body)
+		return nil
+	}
+	var batchRes []lb.BatchResponse
+	if err = json.Unmarshal([]byte(res.Body), &batchRes); err != nil || len(batchRes) != b.Len() {
+		logrus.WithError(err).Errorf("SendBatch: malformed response for %d requests: %s", b.Len(), res.Body)
+		return nil
+	}
+	responses := &BatchResponses{}
+	for _, br := range batchRes {
+		responses.responses = append(responses.responses, &Response{
+			Code: br.Status,
+			Body: string(br.Body),
+			// the responses were all encoded in the batch response
+			Dictionary: res.Dictionary,
+		})
+	}
+	return responses
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/lb"
+)
+
+func TestSendBatch(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		order = append(order, req.Method+" "+req.URL.RequestURI())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/_matrix/client/r0/profile/@alice:example.com":
+			if req.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(401)
+				w.Write([]byte(`{"errcode":"M_MISSING_TOKEN"}`))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(`{"displayname":"Alice"}`))
+		case "/_matrix/client/r0/user/@alice:example.com/filter":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"filter":` + string(body) + `}`))
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+		}
+	}))
+
+	b := NewBatch()
+	b.Add("GET", "/_matrix/client/r0/profile/@alice:example.com", "")
+	b.Add("GET", "/_matrix/client/r0/capabilities?foo=bar", "")
+	b.Add("POST", "/_matrix/client/r0/user/@alice:example.com/filter", `{"room":{}}`)
+	res := SendBatch(hsURL, "secret", b)
+	if res == nil {
+		t.Fatalf("SendBatch returned nil")
+	}
+	want := []Response{
+		{Code: 200, Body: `{"displayname":"Alice"}`, Dictionary: lb.DictionaryV1},
+		// a failure doesn't stop the rest of the batch
+		{Code: 404, Body: `{"errcode":"M_NOT_FOUND"}`, Dictionary: lb.DictionaryV1},
+		{Code: 200, Body: `{"filter":{"room":{}}}`, Dictionary: lb.DictionaryV1},
+	}
+	if res.Len() != len(want) {
+		t.Fatalf("got %d responses want %d", res.Len(), len(want))
+	}
+	for i := range want {
+		if got := res.Get(i); got == nil || *got != want[i] {
+			t.Errorf("response %d: got %+v want %+v", i, got, want[i])
+		}
+	}
+	wantOrder := []string{
+		"GET /_matrix/client/r0/profile/@alice:example.com",
+		"GET /_matrix/client/r0/capabilities?foo=bar",
+		"POST /_matrix/client/r0/user/@alice:example.com/filter",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != len(wantOrder) {
+		t.Fatalf("server got requests %v want %v", order, wantOrder)
+	}
+	for i := range wantOrder {
+		if order[i] != wantOrder[i] {
+			t.Errorf("request %d: got %s want %s", i, order[i], wantOrder[i])
+		}
+	}
+}
+
+// TestSendBatchDictionaryV2 checks that a batch, the requests in it and their responses use the v2 dictionary
+// once it is negotiated
+func TestSendBatchDictionaryV2(t *testing.T) {
+	filterJSON := `{"room":{"timeline":{"limit":5}}}`
+	var mu sync.Mutex
+	var gotFilter string
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		gotFilter = string(body)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"filter_id":"abc","algorithm":"m.megolm.v1.aes-sha2"}`))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	hsURL := newCBORTestServer(t, "127.0.0.1:0", lb.NewCoAPHTTP(lb.NewCoAPPathV2()), lb.CapabilitiesHandler(
+		lb.CBORToJSONHandler(next, codec, nil), codec, lb.Capabilities{
+			BlockSize:          1024,
+			DictionaryVersion:  lb.DictionaryV1,
+			DictionaryVersions: lb.DictionaryVersions,
+		},
+	))
+	cp := Params()
+	cp.DictionaryV2 = true
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	b := NewBatch()
+	b.Add("POST", "/_matrix/client/r0/user/@alice:example.com/filter", filterJSON)
+	res := SendBatch(hsURL, "secret", b)
+	if res == nil || res.Len() != 1 {
+		t.Fatalf("SendBatch: got %+v", res)
+	}
+	want := Response{Code: 200, Body: `{"algorithm":"m.megolm.v1.aes-sha2","filter_id":"abc"}`, Dictionary: lb.DictionaryV2}
+	if got := res.Get(0); *got != want {
+		t.Errorf("got response %+v want %+v", got, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if gotFilter != filterJSON {
+		t.Errorf("homeserver got filter %s want %s", gotFilter, filterJSON)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/sirupsen/logrus"
+)
+
+// CancelResult is what CancelAll cancelled
+type CancelResult struct {
+	// Requests is the number of requests which were in flight, including downloads
+	Requests int
+	// Observations is the number of /sync observations and streams which were ended
+	Observations int
+	// OutboxEntries is the number of queued requests which were removed from the outbox without being sent
+	OutboxEntries int
+}
+
+// CancelAll cancels every request in flight, ends every observation and empties the outbox, e.g when the user logs
+// out or switches account, so nothing made with the old account's access token completes afterwards:
+//   - SendRequest calls which are waiting return a 499 error rather than nil, so clients do not send the request
+//     again over HTTP. Downloads return without completing, and can be resumed.
+//   - Streams are closed, calling OnClosed. The listeners of ObserveDeviceLists and ObserveAccountData are removed
+//     without being called again, and /sync observations end with ObserveEndedCancelled.
+//   - Queued requests are removed from the outbox, and OnSent is not called for them, even if one was being sent.
+//   - Notifications deferred by EnterLowPowerObserveMode are dropped.
+//
+// No response or notification is delivered after CancelAll returns. Connections are kept, and requests made after
+// it are sent as usual.
+func CancelAll() *CancelResult {
+	result := &CancelResult{}
+	// empty the outbox first, so it does not send the next request when the one in flight is cancelled
+	obMu.Lock()
+	o := ob
+	obMu.Unlock()
+	if o != nil {
+		n, err := o.clear()
+		if err != nil {
+			logrus.WithError(err).Error("CancelAll: failed to save the empty outbox")
+		}
+		result.OutboxEntries = n
+	}
+	removeAllSyncListeners()
+
+	inFlightMu.Lock()
+	limits := inFlight
+	inFlight = make(map[*roundTripLimit]bool)
+	inFlightMu.Unlock()
+	for l := range limits {
+		atomic.StoreInt32(&l.cancelledAll, 1)
+		l.cancel()
+	}
+	result.Requests = len(limits)
+
+	type syncObservation struct {
+		conn    *client.ClientConn
+		refresh *observeRefresh
+	}
+	var syncs []syncObservation
+	dc.mu.Lock()
+	for _, conn := range dc.conns {
+		if refresh, ok := conn.Context().Value(ctxValObserveSyncRefresh).(*observeRefresh); ok && !refresh.isEnded() {
+			syncs = append(syncs, syncObservation{conn, refresh})
+		}
+	}
+	dc.mu.Unlock()
+	for _, s := range syncs {
+		s.refresh.end(s.conn, ObserveEndedCancelled)
+	}
+	liveStreamsMu.Lock()
+	var streams []*Stream
+	for s := range liveStreams {
+		streams = append(streams, s)
+	}
+	liveStreamsMu.Unlock()
+	// each deregistration can take as long as a confirmable request, so they are sent together
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		go func(s *Stream) {
+			defer wg.Done()
+			s.Cancel()
+		}(s)
+	}
+	wg.Wait()
+	result.Observations = len(syncs) + len(streams)
+	lowPower.dropNotifications()
+
+	logrus.Infof("CancelAll: cancelled %d requests, %d observations and %d queued requests",
+		result.Requests, result.Observations, result.OutboxEntries)
+	return result
+}
+
+// inFlight are the limits of the requests which have not finished, so CancelAll can cancel them
+var (
+	inFlightMu sync.Mutex
+	inFlight   = make(map[*roundTripLimit]bool)
+)
+
+// trackInFlight adds the request with the limit l to inFlight until l is cancelled, which happens when the request
+// finishes. Must be called before l is used.
+func trackInFlight(l *roundTripLimit) {
+	inFlightMu.Lock()
+	inFlight[l] = true
+	inFlightMu.Unlock()
+	cancel := l.cancel
+	l.cancel = func() {
+		cancel()
+		inFlightMu.Lock()
+		delete(inFlight, l)
+		inFlightMu.Unlock()
+	}
+}
+
+// wasCancelledAll returns true if CancelAll cancelled the request
+func (l *roundTripLimit) wasCancelledAll() bool {
+	return atomic.LoadInt32(&l.cancelledAll) == 1
+}
+
+// cancelledResponse returns an error stating the request was cancelled by CancelAll
+func cancelledResponse() *Response {
+	return &Response{
+		Code: 499,
+		Body: `{"errcode":"M_UNKNOWN","error":"Request was cancelled by CancelAll"}`,
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/lb"
+)
+
+// TestCancelAll checks that CancelAll cancels a request in flight, a stream, a /sync observation and the queued
+// requests of the outbox, and that no responses or notifications are delivered after it returns
+func TestCancelAll(t *testing.T) {
+	var polls int32
+	slow := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/_matrix/client/r0/rooms/!a:localhost/state/m.room.topic":
+			slow <- struct{}{}
+			select {
+			case <-release:
+			case <-req.Context().Done():
+				return
+			}
+		case "/_matrix/client/r0/account/whoami", "/_matrix/client/r0/sync":
+			time.Sleep(50 * time.Millisecond)
+		}
+		n := atomic.AddInt32(&polls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(fmt.Sprintf(`{"next_batch":"s%d","device_lists":{"changed":["@alice:localhost"]}}`, n)))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	handler := lb.CBORToJSONHandler(next, codec, nil)
+	observations := lb.NewSyncObservations(handler, coapHTTP.Paths, codec)
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapHTTP.CoAPHTTPHandler(handler, observations),
+		dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+	// go-coap sends every registration on a connection with the same message ID, so /sync is observed on another
+	syncURL := newCoAPTestServer(t, "127.0.0.1:0", coapHTTP.CoAPHTTPHandler(handler, observations),
+		dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	var sent int32
+	if err = SetOutbox(filepath.Join(dir, "outbox.json"), outboxFunc(func(txnID string, res *Response) {
+		atomic.AddInt32(&sent, 1)
+	})); err != nil {
+		t.Fatalf("SetOutbox: %s", err)
+	}
+	PauseSending()
+	t.Cleanup(func() {
+		ResumeSending()
+		SetOutbox("", nil)
+	})
+	for _, txnID := range []string{"txn1", "txn2"} {
+		if !QueueRequest("PUT", hsURL+"/_matrix/client/r0/rooms/!a:localhost/send/m.room.message/"+txnID, "secret", `{}`) {
+			t.Fatalf("QueueRequest %s returned false", txnID)
+		}
+	}
+
+	notifications := make(chan string, 100)
+	closed := make(chan struct{}, 1)
+	s := ObserveStream(hsURL+"/_matrix/client/r0/account/whoami", "secret", &streamFuncs{
+		notification: func(code int, body string) { notifications <- body },
+		closed:       func() { closed <- struct{}{} },
+	})
+	if s == nil {
+		t.Fatalf("ObserveStream returned nil")
+	}
+	if !ObserveDeviceLists(syncURL, "secret", deviceListsFunc(func(changed, left string) {
+		notifications <- "device lists " + changed
+	})) {
+		t.Fatalf("ObserveDeviceLists returned false")
+	}
+	waitFor(t, "notifications of the stream and /sync", func() bool {
+		return len(notifications) >= 4
+	})
+
+	responses := make(chan *Response, 1)
+	go func() {
+		responses <- SendRequest("GET", hsURL+"/_matrix/client/r0/rooms/!a:localhost/state/m.room.topic", "secret", "")
+	}()
+	select {
+	case <-slow:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server never received the request")
+	}
+
+	got := CancelAll()
+	if want := (CancelResult{Requests: 1, Observations: 2, OutboxEntries: 2}); *got != want {
+		t.Errorf("CancelAll: got %+v want %+v", *got, want)
+	}
+	select {
+	case res := <-responses:
+		if res == nil || res.Code != 499 {
+			t.Errorf("cancelled request: got %+v want a 499", res)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("cancelled request did not return")
+	}
+	select {
+	case <-closed:
+	default:
+		t.Errorf("OnClosed was not called by CancelAll")
+	}
+	if depth := CurrentStats().OutboxDepth; depth != 0 {
+		t.Errorf("OutboxDepth: got %d want 0", depth)
+	}
+
+	// nothing is delivered afterwards, even once sending resumes and the server would answer
+	for len(notifications) > 0 {
+		<-notifications
+	}
+	ResumeSending()
+	time.Sleep(time.Second)
+	select {
+	case n := <-notifications:
+		t.Errorf("notification after CancelAll: %s", n)
+	default:
+	}
+	if n := atomic.LoadInt32(&sent); n != 0 {
+		t.Errorf("OnSent was called %d times after CancelAll", n)
+	}
+
+	// new requests are sent as usual
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "secret", ""); res == nil || res.Code != 200 {
+		t.Errorf("request after CancelAll: got %+v want a 200", res)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/lb"
+	"github.com/sirupsen/logrus"
+)
+
+const ctxValEffectiveParams = "ctxValEffectiveParams"
+
+// NegotiatedParams are the parameters actually in use on a connection, which can differ from the requested
+// ConnectionParams if the server does not support them.
+type NegotiatedParams struct {
+	// The largest block size in bytes used for block-wise transfers. This is the smaller of the block size
+	// this library requests and the block size the server uses.
+	BlockSize int
+	// The version of the CBOR keys and CoAP path enums in use e.g "v1", which is "v2" if DictionaryV2 is set and
+	// the server supports it. Otherwise it is the version the server uses, and if this is not "v1" requests will
+	// probably fail, unless AllowUncompressedFallback is set, in which case it is "none".
+	DictionaryVersion string
+	// True if ObserveEnabled was requested and the server supports OBSERVE.
+	ObserveEnabled bool
+	// The version of the path segments dictionary paths are compressed with e.g "v1", if PathSegments is set and
+	// the server supports it. Otherwise it is empty and paths are sent in full.
+	PathSegmentsVersion string
+}
+
+// EffectiveParams returns the parameters in use on the connection to the host in hsURL, connecting if there
+// is no connection. These are worked out from the server's capabilities, which are fetched once per connection.
+// If the server does not advertise its capabilities, the requested parameters are assumed to be in use.
+// Returns <nil> if the capabilities could not be fetched, e.g because there is no connection.
+func EffectiveParams(hsURL string) *NegotiatedParams {
+	u, err := url.Parse(hsURL)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse HS URL")
+		return nil
+	}
+	if u.Host == "" {
+		logrus.WithField("url", hsURL).Error("HS URL missing host")
+		return nil
+	}
+	conn, err := dc.getClientForHost(u.Host)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get DTLS client for host %s", u.Host)
+		return nil
+	}
+	if np, ok := conn.Context().Value(ctxValEffectiveParams).(NegotiatedParams); ok {
+		return &np
+	}
+	cp := params()
+	np := NegotiatedParams{
+		BlockSize:         int(connBlockSZX(conn).Size()),
+		DictionaryVersion: lb.DictionaryV1,
+		ObserveEnabled:    cp.ObserveEnabled,
+	}
+	res := SendRequest("GET", "https://"+u.Host+lb.CapabilitiesPath, "", "")
+	if res == nil {
+		return nil
+	}
+	if res.Code == 200 {
+		var caps lb.Capabilities
+		if err := json.Unmarshal([]byte(res.Body), &caps); err != nil {
+			logrus.WithError(err).Errorf("Failed to unmarshal capabilities: %s", res.Body)
+			return nil
+		}
+		np = negotiateParams(cp, &caps, connBlockSZX(conn))
+		if np.DictionaryVersion == dictionaryNone {
+			recordUncompressedFallback()
+		}
+	} else {
+		logrus.Infof("Server returned HTTP %d for capabilities, assuming requested params are in use", res.Code)
+	}
+	conn.SetContextValue(ctxValEffectiveParams, np)
+	return &np
+}
+
+// negotiateParams returns the parameters which will be used with a server with the given capabilities, on a
+// connection using the block size szx
+func negotiateParams(cp *ConnectionParams, caps *lb.Capabilities, szx blockwise.SZX) NegotiatedParams {
+	np := NegotiatedParams{
+		BlockSize:         int(szx.Size()),
+		DictionaryVersion: lb.DictionaryV1,
+		ObserveEnabled:    cp.ObserveEnabled && caps.Observe,
+	}
+	if caps.BlockSize > 0 && caps.BlockSize < np.BlockSize {
+		np.BlockSize = caps.BlockSize
+	}
+	if cp.DictionaryV2 && supportsDictionary(caps, lb.DictionaryV2) {
+		np.DictionaryVersion = lb.DictionaryV2
+	}
+	if !supportsDictionary(caps, np.DictionaryVersion) {
+		if cp.AllowUncompressedFallback {
+			logrus.Warnf("Server uses dictionary version %s which this library does not know, falling back to plain CBOR and full paths", caps.DictionaryVersion)
+			np.DictionaryVersion = dictionaryNone
+		} else {
+			logrus.Warnf("Server uses dictionary version %s but this library uses %s", caps.DictionaryVersion, np.DictionaryVersion)
+			np.DictionaryVersion = caps.DictionaryVersion
+		}
+	}
+	if cp.PathSegments && caps.PathSegmentsVersion == lb.PathSegmentsV1 {
+		np.PathSegmentsVersion = lb.PathSegmentsV1
+	}
+	if cp.ObserveEnabled && !caps.Observe {
+		logrus.Warn("ObserveEnabled is set but the server does not support OBSERVE")
+	}
+	return np
+}
+
+// supportsDictionary returns true if a server with the given capabilities accepts the dictionary version. Servers
+// which do not advertise a version are assumed to use v1.
+func supportsDictionary(caps *lb.Capabilities, version string) bool {
+	if caps.DictionaryVersion == "" {
+		return version == lb.DictionaryV1
+	}
+	if caps.DictionaryVersion == version {
+		return true
+	}
+	for _, v := range caps.DictionaryVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/lb"
+)
+
+func TestEffectiveParams(t *testing.T) {
+	notFound := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(404)
+		w.Write([]byte(`{"errcode":"M_UNRECOGNIZED"}`))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	testCases := []struct {
+		name         string
+		handler      http.Handler
+		dictionaryV2 bool
+		want         NegotiatedParams
+	}{
+		{
+			name: "server downgrades block size and observe",
+			handler: lb.CapabilitiesHandler(lb.CBORToJSONHandler(notFound, codec, nil), codec, lb.Capabilities{
+				BlockSize:         256,
+				DictionaryVersion: "v1",
+				Observe:           false,
+			}),
+			want: NegotiatedParams{
+				BlockSize:         256,
+				DictionaryVersion: "v1",
+				ObserveEnabled:    false,
+			},
+		},
+		{
+			name: "server supports larger blocks than requested",
+			handler: lb.CapabilitiesHandler(lb.CBORToJSONHandler(notFound, codec, nil), codec, lb.Capabilities{
+				BlockSize:         4096,
+				DictionaryVersion: "v1",
+				Observe:           true,
+			}),
+			want: NegotiatedParams{
+				BlockSize:         1024,
+				DictionaryVersion: "v1",
+				ObserveEnabled:    true,
+			},
+		},
+		{
+			name: "server supports dictionary v2",
+			handler: lb.CapabilitiesHandler(lb.CBORToJSONHandler(notFound, codec, nil), codec, lb.Capabilities{
+				BlockSize:          1024,
+				DictionaryVersion:  "v1",
+				DictionaryVersions: []string{"v1", "v2"},
+				Observe:            true,
+			}),
+			dictionaryV2: true,
+			want: NegotiatedParams{
+				BlockSize:         1024,
+				DictionaryVersion: "v2",
+				ObserveEnabled:    true,
+			},
+		},
+		{
+			name: "dictionary v2 is not requested",
+			handler: lb.CapabilitiesHandler(lb.CBORToJSONHandler(notFound, codec, nil), codec, lb.Capabilities{
+				BlockSize:          1024,
+				DictionaryVersion:  "v1",
+				DictionaryVersions: []string{"v1", "v2"},
+				Observe:            true,
+			}),
+			want: NegotiatedParams{
+				BlockSize:         1024,
+				DictionaryVersion: "v1",
+				ObserveEnabled:    true,
+			},
+		},
+		{
+			name: "server without dictionary v2",
+			handler: lb.CapabilitiesHandler(lb.CBORToJSONHandler(notFound, codec, nil), codec, lb.Capabilities{
+				BlockSize:         1024,
+				DictionaryVersion: "v1",
+				Observe:           true,
+			}),
+			dictionaryV2: true,
+			want: NegotiatedParams{
+				BlockSize:         1024,
+				DictionaryVersion: "v1",
+				ObserveEnabled:    true,
+			},
+		},
+		{
+			name:         "server without capabilities",
+			dictionaryV2: true,
+			handler:      lb.CBORToJSONHandler(notFound, codec, nil),
+			want: NegotiatedParams{
+				BlockSize:         1024,
+				DictionaryVersion: "v1",
+				ObserveEnabled:    true,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hsURL := newCBORTestServer(t, "127.0.0.1:0", lb.NewCoAPHTTP(lb.NewCoAPPathV1()), tc.handler)
+			cp := Params()
+			cp.ObserveEnabled = true
+			cp.DictionaryV2 = tc.dictionaryV2
+			if err := SetParams(cp); err != nil {
+				t.Fatalf("SetParams: %s", err)
+			}
+			got := EffectiveParams(hsURL)
+			if got == nil {
+				t.Fatalf("EffectiveParams returned nil")
+			}
+			if *got != tc.want {
+				t.Errorf("EffectiveParams: got %+v want %+v", *got, tc.want)
+			}
+			// the requested params are unchanged
+			if !Params().ObserveEnabled {
+				t.Errorf("Params().ObserveEnabled was changed by negotiation")
+			}
+		})
+	}
+}
+
+// TestUncompressedFallback checks that requests to a server which supports none of the dictionaries are sent with
+// plain CBOR bodies and full paths if AllowUncompressedFallback is set, and with the dictionary if not
+func TestUncompressedFallback(t *testing.T) {
+	codec := lb.NewCBORCodecV1(false)
+	testCases := []struct {
+		name            string
+		fallback        bool
+		wantDictionary  string
+		wantContentType string
+		wantFallbacks   int64
+	}{
+		{name: "fallback", fallback: true, wantDictionary: "none", wantContentType: lb.ContentTypePlainCBOR, wantFallbacks: 1},
+		{name: "dictionary required", fallback: false, wantDictionary: "v9", wantContentType: "application/cbor"},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var paths, contentTypes []string
+			echo := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(200)
+				w.Write(body)
+			})
+			handler := lb.CapabilitiesHandler(lb.CBORToJSONHandler(echo, codec, nil), codec, lb.Capabilities{
+				BlockSize:          1024,
+				DictionaryVersion:  "v9",
+				DictionaryVersions: []string{"v9"},
+			})
+			// a server with a dictionary this library does not know, which has none of the v1 CoAP enum paths
+			hsURL := newCBORTestServer(t, "127.0.0.1:0", lb.NewCoAPHTTP(fullPaths), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != lb.CapabilitiesPath {
+					mu.Lock()
+					paths = append(paths, req.URL.Path)
+					contentTypes = append(contentTypes, req.Header.Get("Content-Type"))
+					mu.Unlock()
+				}
+				handler.ServeHTTP(w, req)
+			}))
+			cp := Params()
+			cp.AllowUncompressedFallback = tc.fallback
+			if err := SetParams(cp); err != nil {
+				t.Fatalf("SetParams: %s", err)
+			}
+			t.Cleanup(func() {
+				cp := Params()
+				cp.AllowUncompressedFallback = false
+				SetParams(cp)
+			})
+			before := CurrentStats()
+
+			path := "/_matrix/client/r0/rooms/!a:localhost/send/m.room.message/txn1"
+			body := `{"msgtype":"m.text","body":"hello"}`
+			res := SendRequest("PUT", hsURL+path, "secret", body)
+			if res == nil || res.Code != 200 {
+				t.Fatalf("got %+v want a 200", res)
+			}
+			if np := EffectiveParams(hsURL); np == nil || np.DictionaryVersion != tc.wantDictionary {
+				t.Errorf("EffectiveParams: got %+v want DictionaryVersion %s", np, tc.wantDictionary)
+			}
+			if got := CurrentStats().UncompressedFallbacks - before.UncompressedFallbacks; got != tc.wantFallbacks {
+				t.Errorf("UncompressedFallbacks: got %d more want %d", got, tc.wantFallbacks)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(contentTypes) != 1 || contentTypes[0] != tc.wantContentType {
+				t.Errorf("request was sent with Content-Type %v want %s", contentTypes, tc.wantContentType)
+			}
+			if !tc.fallback {
+				return
+			}
+			if len(paths) != 1 || paths[0] != path {
+				t.Errorf("request was sent to %v want the full path %s", paths, path)
+			}
+			if !strings.Contains(res.Body, `"body":"hello"`) || res.Dictionary != "none" {
+				t.Errorf("got body %s with dictionary %s want the message echoed without a dictionary", res.Body, res.Dictionary)
+			}
+		})
+	}
+}
@@ -18,18 +18,27 @@ package mobile
 import (
 	"bytes"
 	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/matrix-org/go-coap/v2/dtls"
 	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
 	"github.com/matrix-org/go-coap/v2/net/blockwise"
 	"github.com/matrix-org/go-coap/v2/udp/client"
+	udpmessage "github.com/matrix-org/go-coap/v2/udp/message"
 	"github.com/matrix-org/go-coap/v2/udp/message/pool"
 	"github.com/matrix-org/lb"
 	piondtls "github.com/pion/dtls/v2"
@@ -41,12 +50,44 @@ type ConnectionParams struct {
 	// If true, skips TLS certificate checks allowing this library to be used with self-signed certificates.
 	// This should be false in production!
 	InsecureSkipVerify bool
+	// The minimum DTLS version which will be negotiated with the server e.g "1.2". The underlying DTLS library
+	// only implements DTLS 1.2, so this is currently the only accepted value. If empty, defaults to "1.2".
+	// This exists so deployments can pin the version explicitly and fail loudly if it cannot be honoured.
+	DTLSMinVersion string
+	// A comma separated list of DTLS cipher suite names to offer during the handshake, in order of preference
+	// e.g "TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8,TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256". If empty, all cipher
+	// suites supported by the DTLS library are offered. Unknown names are rejected by SetParams.
+	// Constrained devices should use TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8: AES-CCM is commonly hardware accelerated
+	// and the 8 byte authentication tag saves 8 bytes per record compared to GCM. This requires the server to
+	// use an ECC certificate.
+	DTLSCipherSuites string
+	// The name to verify the homeserver's certificate against, which is also sent as the DTLS server name. If empty,
+	// the host being dialled is used. Set this when the certificate is for a different name than the one dialled,
+	// e.g dialling an IP address or an alternate host with split-horizon DNS, rather than skipping verification with
+	// InsecureSkipVerify.
+	ServerName string
+	// If true, send the host and port of the homeserver URL in the CoAP Uri-Host and Uri-Port options. This is
+	// required when a single CoAP gateway fronts multiple homeservers, but costs extra bytes on every request.
+	SendURIHost bool
 	// The retry rate when sending initial DTLS handshake packets. If this value is too low (lower than the
 	// RTT latency) the client will be unable to establish a DTLS session with the server because the client
 	// will always send another handshake before the server can respond. If this value is too high, the
 	// client will take longer than required to establish a DTLS session when under high packet
 	// loss network conditions.
 	FlightIntervalSecs int
+	// How long to wait for the DTLS handshake to complete before giving up on the connection. This only
+	// applies to setting up the connection: requests on it use TransmissionACKTimeoutSecs. When this is hit,
+	// Connect returns an error wrapping ErrHandshakeTimeout and HandshakeTimeouts in Stats is incremented.
+	// If this value is too low, handshakes on slow or lossy networks will never complete. If this value is too
+	// high, requests will block for a long time when the server is unreachable. 0 means no timeout, and it must not
+	// be negative.
+	HandshakeTimeoutSecs int
+	// The max number of DTLS handshakes which can be in progress at once, across all hosts, e.g when connecting to
+	// several homeservers or local addresses at startup. Handshakes are CPU heavy, so on constrained devices a burst of
+	// them causes a spike in CPU and battery use. Connections past the limit wait for a slot, oldest first, and
+	// HandshakeTimeoutSecs only starts once they have one. Stats has the number in progress and how often connections
+	// had to wait. 0 means there is no limit.
+	MaxConcurrentHandshakes int
 	// How frequently to send CoAP heartbeat packets (Empty messages). This adds bandwidth costs when no
 	// traffic is flowing but is required in order to keep NAT bindings active.
 	HeartbeatTimeoutSecs int
@@ -58,7 +99,19 @@ type ConnectionParams struct {
 	// blocking problems.
 	// The CoAP RFC recommends a value of 1. https://datatracker.ietf.org/doc/html/rfc7252#section-4.8
 	// XXX FIXME: This option is broken in go-coap: https://github.com/plgd-dev/go-coap/issues/226
+	// go-coap does not limit outstanding requests with it, it waits this many seconds after the ACK timeout
+	// before each retransmission. Use MaxConcurrentExchanges to limit outstanding requests.
 	TransmissionNStart int
+	// The max number of confirmable exchanges which can be outstanding at once, across all connections. This is the
+	// flow control window which TransmissionNStart should be: an exchange holds its slot from the first transmission
+	// of the request until the whole response has arrived, including every block of a block-wise transfer and every
+	// retransmission, which is stricter than NSTART, which ends when the request is ACKed. Requests past the window
+	// wait for a slot, oldest first, until their request times out. Non-confirmable requests and observations do not
+	// use the window. A long-polling /sync holds a slot for as long as it polls, so this should be at least 2 unless
+	// ObserveEnabled is set. Stats has the number outstanding and how often requests had to wait. Setting this to
+	// TransmissionNStart gives the RFC's congestion control, so a gateway serving many devices is not flooded by any
+	// of them. 0 means there is no limit.
+	MaxConcurrentExchanges int
 	// How long to wait after having sent a CoAP message for an ACK from the server. It is important that
 	// any CoAP server sends an ACK back before this timeout is hit. Servers which implement long poll /sync
 	// MUST NOT piggyback the ACK with the sync payload (that is, wait for the sync response before ACKing)
@@ -73,6 +126,21 @@ type ConnectionParams struct {
 	// packet loss gracefully.
 	// The CoAP RFC recommends a value of 4. https://datatracker.ietf.org/doc/html/rfc7252#section-4.8
 	TransmissionMaxRetransmits int
+	// If set, a connection is closed once requests on it have been retransmitted this many times in total since
+	// anything was last received on it, as the link has probably gone. TransmissionMaxRetransmits only bounds each
+	// request, so without this every request in flight on a dead link keeps retransmitting until it gives up on its
+	// own, which adds up to a storm of retransmissions when many are in flight. Requests on the closed connection
+	// fail straight away with an error which matches ErrRetransmitBudgetExhausted, and SendRequest sends them again
+	// on a new connection. Stats counts the retransmissions and the connections closed. 0 means there is no limit.
+	MaxConnectionRetransmits int
+	// The max number of times per minute requests are sent again after failing, across all requests, so retries
+	// cannot make a degraded link worse however many requests are failing at once. The budget refills continuously
+	// at this rate, up to one minute's worth. It covers requests SendRequest sends again on a new connection, uploads
+	// sent again after 4.08 Request Entity Incomplete and GET requests sent again by BlockwiseStallRetry, whatever
+	// IncompleteUploadRetries allows. When it is exhausted, requests fail straight away with a 503 and a Matrix
+	// error explaining why. CoAP retransmissions are not retries, see MaxConnectionRetransmits. Stats counts the
+	// retries made and refused. 0 means there is no limit.
+	RetryBudgetPerMinute int
 	// If set, enables /sync OBSERVE requests, meaning the server will push traffic to the client
 	// rather than relying on long-polling. Client implementations need no changes for this feature
 	// to work. Using OBSERVE carries risks as client syncing state is now stored server-side. If the
@@ -93,41 +161,604 @@ type ConnectionParams struct {
 	// back fake /sync responses (with no data and the same sync token) after a certain amount of time when waiting
 	// for OBSERVE data.
 	ObserveNoResponseTimeoutSecs int
+	// How often to re-register active OBSERVE requests. NATs can silently drop the mapping for the connection,
+	// and the server can lose its registration, without the client being told. The client would then think it is
+	// observing /sync when it isn't, and never receive new events. Re-registering uses the same CoAP token, so
+	// the server refreshes the existing registration if it is still alive, or re-establishes it from the latest
+	// sync token if not. https://datatracker.ietf.org/doc/html/rfc7641#section-3.3.1
+	// Setting this too low adds bandwidth costs, setting this too high means a dropped registration takes longer
+	// to be noticed. 0 disables re-registration.
+	ObserveRefreshSecs int
+	// If set, /sync observations which go this long without a notification are re-registered straight away, rather
+	// than waiting for ObserveRefreshSecs, so a stalled registration heals sooner. A quiet account can go a long time
+	// without a notification too, so set this well above the /sync timeout. A stall is noticed within twice this.
+	// Stats has the ObserveLastNotificationAgeSecs. 0 disables this.
+	ObserveStallSecs int
+	// If set, the /sync responses which arrive within this many milliseconds of each other are merged before
+	// ObserveDeviceLists and ObserveAccountData callbacks see them, so a busy account calls them once per window
+	// rather than once per notification. Device lists are joined, and only the latest account data event of each
+	// type is passed on. Responses to SendRequest are never merged. 0 passes each notification on as it arrives.
+	ObserveCoalesceMs int
+	// If set, OnAppForeground only resumes a /sync observation from the since token of the last notification if it
+	// arrived within this many seconds, as the server may have expired older tokens. An older token starts again from
+	// an initial sync, which SyncResetCallback listeners are told about. A since token which the server rejects also
+	// starts again from an initial sync, whatever its age. 0 resumes from a since token of any age.
+	ObserveSinceMaxAgeSecs int
+	// If set, /sync notifications returned by SendRequest leave out the rooms which are exactly as they were in an
+	// earlier notification of the same observation, for servers which repeat unchanged rooms rather than sending only
+	// what changed since the since token. A room is only left out if all of it, e.g its timeline, state, ephemeral
+	// events and unread counts, is unchanged, and next_batch and everything outside rooms is returned as it arrived,
+	// so a notification in which no room changed still advances the since token. The first notification of an
+	// observation, including after reconnecting, has every room. Servers which already send incremental /sync are
+	// unaffected. Stats counts the rooms left out.
+	ObserveChangedRoomsOnly bool
+	// How the notifications of the /sync observation are ordered: ObserveOrderingArrival delivers each as it arrives,
+	// discarding any which are older than one already delivered, and ObserveOrderingStrict holds a notification which
+	// overtook the one before it for up to ObserveReorderTimeoutMs, so they are delivered in sequence. Either way, a
+	// /sync notification which skips ObserveSeqGapThreshold or more which have not been delivered is replaced by
+	// fetching /sync again from the since token of the last one which was, but strict ordering skips fewer.
+	// ObserveStream and Observe use arrival ordering, which suits e.g presence where the latest version is all that
+	// matters; ObserveOrdered picks the ordering of a stream.
+	ObserveOrdering string
+	// How long ObserveOrderingStrict holds a notification which arrived out of order, waiting for the ones before it.
+	// If they have not arrived by then they were probably lost, so it is delivered after the gap. Notifications are
+	// ACKed once they are delivered, so keep this well below the server's ACK timeout or held notifications are
+	// retransmitted. Stats counts the notifications which were held, and those which waited the whole timeout.
+	ObserveReorderTimeoutMs int
+	// If either is set, the notifications of ObserveStream streams are delivered in batches, rather than one at a time,
+	// so the app can process them in bulk: a batch is delivered once it has ObserveBatchSize notifications, or
+	// ObserveBatchIntervalMs after its first notification, whichever comes first. Within a batch, notifications are in
+	// the order they would have been delivered one at a time, and batches are delivered in order. Callbacks which
+	// implement StreamBatchCallback get each batch in one call, others get a call to OnNotification for each
+	// notification of the batch. A notification which is not 2xx ends the stream, so it is delivered straight away with
+	// the batch, as are the notifications waiting when a stream is closed. If only ObserveBatchSize is set, a batch
+	// waits until it is full however long that takes. /sync responses for ObserveDeviceLists and ObserveAccountData are
+	// merged with ObserveCoalesceMs instead. 0 means no limit; if both are 0, notifications are delivered as they
+	// arrive.
+	ObserveBatchSize       int
+	ObserveBatchIntervalMs int
+	// If set, the ACK timeout and block size are picked from the measured round trip time and packet loss of the
+	// link to the homeserver, rather than using TransmissionACKTimeoutSecs and the largest block size. This helps
+	// on mobile links where latency and loss vary a lot over time. The ACK timeout is adjusted after every request,
+	// between AdaptiveMinACKTimeoutSecs and TransmissionACKTimeoutSecs. The block size cannot be changed on an
+	// existing connection, so it is picked when connecting, between AdaptiveMinBlockSize and 1024 bytes.
+	// See MeasuredLinkQuality for the measurements.
+	AdaptiveTransmission bool
+	// The lowest ACK timeout AdaptiveTransmission will use. If this value is too low, clients will retransmit
+	// packets needlessly when the server is slow to respond, as the server's processing time is part of the
+	// measured round trip time.
+	// The CoAP RFC recommends a value of 2. https://datatracker.ietf.org/doc/html/rfc7252#section-4.8
+	AdaptiveMinACKTimeoutSecs int
+	// The smallest block size in bytes AdaptiveTransmission will use on lossy links. Must be a power of 2 from
+	// 16 to 1024. Smaller blocks are retransmitted more cheaply, but every block repeats the request headers.
+	AdaptiveMinBlockSize int
+	// The max number of round trips a single block-wise transfer may take before it is aborted. This bounds the
+	// latency and battery cost of a transfer on a link which cannot sustain it, e.g a large /sync response with a
+	// small block size on a lossy link. Aborted requests return a 504 with a Matrix error explaining why, and
+	// BlockwiseAborts in Stats is incremented. Request bodies which would need more round trips are rejected
+	// without being sent. Round trips are counted from the messages received while the request is the only one in
+	// flight on its connection, so transfers which overlap other requests may take more. Retransmissions are bounded
+	// by TransmissionMaxRetransmits instead, though a duplicate response to one counts as a round trip.
+	// 0 means there is no limit.
+	MaxBlockwiseRoundTrips int
+	// How long a block-wise transfer can go without receiving anything once it has received a block, before it has
+	// stalled, e.g because the link has dropped partway through a large response. This is distinct from the
+	// retransmissions of TransmissionMaxRetransmits, which can take minutes to give up on a dead link. Stats counts
+	// the stalls. This should be longer than TransmissionACKTimeoutSecs, or a single lost block, which is
+	// retransmitted after the ACK timeout, stalls the transfer. Datagrams for other requests and observations on
+	// the connection count as progress, so a transfer which overlaps them may take longer to be seen as stalled,
+	// and blocks smaller than 32 bytes are not seen at all. 0 means transfers never stall.
+	BlockwiseStallTimeoutSecs int
+	// What to do when a block-wise transfer stalls: BlockwiseStallAbort returns a 504 with a Matrix error stating how
+	// many blocks were received, BlockwiseStallRetry sends GET requests again once, and aborts other requests as they
+	// may not be safe to repeat, and BlockwiseStallWait keeps waiting for retransmissions. Retries fetch the whole
+	// response again, as the CoAP library cannot resume a transfer from a block. If empty, defaults to
+	// BlockwiseStallAbort.
+	BlockwiseStallPolicy string
+	// How many times a block-wise upload is sent again when the server responds 4.08 Request Entity Incomplete, e.g
+	// because a block went missing or arrived out of order, which servers reassembling the body may not recover from.
+	// The CoAP library cannot re-send individual blocks, so the body is sent again from the first block, which
+	// servers take as the start of a new body. If the server still responds 4.08, the request returns a 408 with a
+	// Matrix error stating how many attempts were made. Stats counts both. 0 never sends the body again.
+	IncompleteUploadRetries int
+	// The largest datagram in bytes the network between the device and the homeserver carries without fragmenting it,
+	// including the IP and UDP headers, e.g 1280 for links which only guarantee the IPv6 minimum. Connections then use
+	// the largest block size which fits, leaving room for the DTLS and CoAP headers, and GET requests ask for their
+	// responses in blocks of that size, so block-wise transfers start with smaller bodies than they otherwise would. The
+	// path MTU is not probed, so this must be configured for the network. Servers send response bodies smaller than
+	// their own block size, 1024 bytes by default, whole, and the responses to other requests in their own block size,
+	// so these may still exceed it, as may requests with a long access token: such messages are logged and counted in
+	// MTUExceeded in Stats. Must be 0 or at least 229 bytes. 0 means no limit.
+	PathMTU int
+	// Custom CoAP options to send with every request, e.g a tenant ID, as a comma separated list of number=value.
+	// Numbers must be from 2048 to 65535, as lower numbers are reserved for options defined by the CoAP RFCs.
+	// Odd numbers are critical, so servers which do not understand them reject the request, even numbers are
+	// elective and ignored by servers which do not understand them. Every option adds its value plus 1-5 bytes to
+	// every request. Custom options on responses are passed to the callback given to SetResponseOptionsCallback.
+	RequestOptions string
+	// If set, the server is asked for a short reference to the access token the first time it is sent on a
+	// connection, which is sent instead of the token on subsequent requests. References are usually 1 byte, rather
+	// than the hundreds of bytes some access tokens take. References are only valid on the connection they were
+	// issued on, so the full token is sent again after reconnecting, or if the server has forgotten the reference.
+	// If unset, the token is omitted entirely after the first request on a connection and the server uses the last
+	// token it was sent. This is cheaper, but is ambiguous when requests with different tokens share a connection.
+	TokenCompression bool
+	// The max number of bytes of CoAP requests and responses per minute, for metered connections. Traffic over the
+	// budget is delayed rather than dropped: requests wait until enough of the budget has been refilled, which
+	// happens continuously at this rate, up to one minute's worth. Responses are counted when they arrive, so a large
+	// response delays the requests after it. /sync requests wait for all other waiting requests, so the app stays
+	// responsive while syncing. Only CoAP messages are counted, not DTLS, UDP or IP headers, retransmissions or
+	// keep-alives, so actual usage is somewhat higher. Stats has the budget remaining. 0 means there is no limit.
+	MaxBytesPerMinute int
+	// The max number of observations which can be registered at once, across all connections. Each one holds an
+	// entry in the server's observe table and a notification buffer on the device, so this stops a buggy client
+	// exhausting either. The /sync observation shared by SendRequest, ObserveDeviceLists and ObserveAccountData
+	// counts once per connection, and every ObserveStream counts until it is cancelled. Registrations past the
+	// limit are refused with ErrTooManyObserves, which is logged, and fail as if the server could not be reached.
+	// Stats has the number registered. 0 means there is no limit.
+	MaxObserves int
+	// Notifications of observations which are duplicates of, or older than, the latest are always discarded. If set,
+	// when this many notifications in a row are lost, which shows as a gap in their sequence numbers, the resource is
+	// fetched again with a normal request and that response is delivered instead of the notification after the gap.
+	// Stats counts both. 0 delivers the notification after the gap as-is. Small gaps are not always losses: the server
+	// skips a sequence number when it fails to send a notification, and sends what was in it with the next one. So
+	// this is a threshold rather than a switch, and should be more than 1 unless full fetches are cheap. The /sync
+	// observation uses ObserveSeqGapThreshold instead.
+	ObserveResyncGap int
+	// When this many /sync notifications in a row are skipped, which shows as a gap in their sequence numbers, /sync is
+	// fetched again from the since token of the last notification delivered, and that response is delivered instead
+	// of the notification after the gap. Skipped notifications were either lost or overtaken by the one after the gap,
+	// and an overtaken one is stale by the time it arrives so is discarded, so either way their events are missing
+	// unless /sync is fetched again. 1 fetches it again after any gap, so no events are missed. Larger thresholds avoid
+	// full fetches on benign gaps, where the server skipped a sequence number it failed to send and sent the same
+	// events with the next one, at the risk of missing the events of overtaken notifications. 0 never fetches /sync
+	// again for a gap. Stats counts the fetches in ObserveResyncs.
+	ObserveSeqGapThreshold int
+	// If set, OnAppBackground keeps connections with observations open rather than closing them, so notifications
+	// keep arriving for as long as the OS lets the app run in the background, e.g with a background task or VoIP
+	// mode on iOS. When the OS suspends the app the socket stops too, so OnAppForeground re-registers them
+	// straight away. This costs battery, as heartbeats and notifications keep the radio awake.
+	ObservePinInBackground bool
+	// The most stream notifications EnterLowPowerObserveMode buffers until ExitLowPowerObserveMode. When the buffer
+	// is full the oldest is dropped, as each version of a resource supersedes the last. /sync notifications for
+	// ObserveDeviceLists and ObserveAccountData are merged rather than buffered, so are never dropped. Stats counts
+	// the notifications deferred and dropped.
+	LowPowerMaxDeferredNotifications int
+	// How many blocks of the connection each range fetched by Download is, e.g 64 ranges of 64KB with 1024 byte
+	// blocks. Larger ranges need fewer requests, but an interrupted range is fetched again from its start, so on
+	// flaky links smaller ranges waste less. 0 fetches the whole file in one request, which cannot be resumed.
+	DownloadRangeBlocks int
+	// If set, responses with a body must have the content-format the request asked for, which is application/cbor,
+	// or plain CBOR for SendOptions.NoDictionary, or v2 CBOR with DictionaryV2. Other responses are rejected as if the server could not be
+	// reached, rather than the body being decoded as whatever it looks like, so a misconfigured proxy is caught
+	// early rather than silently tolerated. Stats counts the rejections. If unset, CBOR responses are decoded
+	// whatever their content-format, and JSON responses are passed through as-is.
+	StrictContentFormat bool
+	// If set, the JSON of successful responses to endpoints with a known schema, e.g /versions, /account/whoami and
+	// the basic shape of /sync, is checked against it after being decoded from CBOR, to catch codec corruption early
+	// during development. Fields which are not in the schema are allowed. Failures are logged and counted in Stats,
+	// and the response is returned as-is unless SchemaValidationReject is also set. /sync observations are not
+	// checked. This costs decoding every checked response twice, so leave it unset in production.
+	SchemaValidation bool
+	// If set with SchemaValidation, responses which fail validation are rejected as if the server could not be
+	// reached, rather than being returned.
+	SchemaValidationReject bool
+	// If set, request and response bodies use the v2 dictionary, which has more keys than v1 and also replaces
+	// frequent values like errcodes and algorithm names, on connections to servers which support it. The server's
+	// capabilities are fetched before the first request on each connection to find out, which costs a round trip.
+	// Requests to servers which do not list v2 in their capabilities use v1. EffectiveParams has the version in use.
+	DictionaryV2 bool
+	// If set, requests to servers whose capabilities list none of the dictionaries this library knows are sent with
+	// plain CBOR bodies and full paths, as neither the keys nor the CoAP enum paths would be understood, so they still
+	// work with less compression. /sync is then long-polled rather than observed. Like DictionaryV2, this fetches the
+	// server's capabilities before the first request on each connection. EffectiveParams has a DictionaryVersion of
+	// "none" on such connections, and Stats counts them in UncompressedFallbacks. If not set, requests are sent with
+	// the dictionary anyway, for deployments which require it.
+	AllowUncompressedFallback bool
+	// If set, paths which have no CoAP enum path, e.g most /_matrix/client/v3 endpoints, are sent with common segments
+	// like _matrix, client and rooms replaced by short tokens, on connections to servers which support it. Like
+	// DictionaryV2, this fetches the server's capabilities before the first request on each connection. Requests
+	// to servers which do not list the path segments version in their capabilities are sent with the full path.
+	PathSegments bool
+	// A comma separated list of paths which always need an access token, e.g DefaultRequireTokenPaths. Requests to
+	// them without a token get a 401 M_MISSING_TOKEN straight away, rather than after a round trip to the homeserver.
+	// Paths are matched after the API version, e.g "/sync" matches /_matrix/client/r0/sync and /_matrix/client/v3/sync,
+	// and a {placeholder} segment matches any one segment. Only list paths which need a token for every request, or
+	// requests which would succeed are rejected. If empty, requests without a token are always sent. An
+	// access_token query parameter counts as a token.
+	RequireTokenPaths string
+	// How long to remember the responses to requests with transaction IDs, e.g sending events and to-device messages.
+	// The same request sent again with the same access token in that time, e.g by an app retrying on top of this
+	// library retrying, gets the remembered response rather than being sent again, and one sent while it is in flight
+	// waits for its response. The homeserver would deduplicate it anyway, so this only saves the exchange. Only
+	// successful responses are remembered, and requests with SendOptions.NoDictionary are always sent. Stats counts
+	// the requests which were not sent. 0 disables this.
+	TxnCacheSecs int
+	// If set, ObserveStream asks for presence status notifications, e.g /_matrix/client/r0/presence/{userId}/status,
+	// to be sent as non-confirmable messages, so the device does not send an ACK for each one and the server does not
+	// retransmit them. Presence changes often and each notification supersedes the last, so a lost one is an acceptable
+	// trade-off. Notifications too large for a single message, and every 16th, are still confirmable so the server
+	// notices if the device has gone. Servers which do not support this send confirmable notifications as usual.
+	PresenceNonConfirmable bool
+	// How notifications of observations, e.g /sync, are compressed on top of CBOR: ObserveCompressionNone sends
+	// every notification in full, and ObserveCompressionDelta asks for notifications as a JSON merge patch of the
+	// previous confirmable one, for servers which support it. Consecutive /sync responses of a busy room repeat
+	// most of their structure, so deltas are smaller, but they cost the server and device decoding every
+	// notification to JSON. Deltas from a notification the device does not have are replaced by fetching the
+	// resource again, as with ObserveResyncGap. Stats counts both. Requests are unaffected.
+	ObserveCompression string
+	// If set, customises how requests sent with SendRequest and SendNonConfirmable are mapped to CoAP, e.g to send
+	// long paths as short CoAP paths from a dictionary shared with the server. The server proxy must apply the
+	// inverse with lb.CoAPHTTP.PathRewriter, or rewritten requests will 404. Observations use the usual mapping.
+	PathRewriter PathRewriter
 }
 
-var activeConnectionParams = ConnectionParams{
+var defaultConnectionParams = ConnectionParams{
 	InsecureSkipVerify:   false,
+	ServerName:           "",
 	ObserveEnabled:       false,
 	FlightIntervalSecs:   2,
+	HandshakeTimeoutSecs: 30,
 	HeartbeatTimeoutSecs: 60,
 	KeepAliveMaxRetries:  5,
 	KeepAliveTimeoutSecs: 30,
 	TransmissionNStart:   1,
 	// proxy is 5s, 3s grace period
-	TransmissionACKTimeoutSecs:   8,
-	TransmissionMaxRetransmits:   4,
-	ObserveBufferSize:            50,
-	ObserveNoResponseTimeoutSecs: 5,
+	TransmissionACKTimeoutSecs:       8,
+	TransmissionMaxRetransmits:       4,
+	MaxConnectionRetransmits:         0,
+	RetryBudgetPerMinute:             0,
+	ObserveBufferSize:                50,
+	ObserveNoResponseTimeoutSecs:     5,
+	ObserveRefreshSecs:               300,
+	ObserveStallSecs:                 0,
+	ObserveCoalesceMs:                0,
+	ObserveSinceMaxAgeSecs:           0,
+	ObserveChangedRoomsOnly:          false,
+	ObserveOrdering:                  ObserveOrderingArrival,
+	ObserveReorderTimeoutMs:          200,
+	ObserveBatchSize:                 0,
+	ObserveBatchIntervalMs:           0,
+	AdaptiveTransmission:             false,
+	AdaptiveMinACKTimeoutSecs:        2,
+	AdaptiveMinBlockSize:             256,
+	MaxBlockwiseRoundTrips:           0,
+	BlockwiseStallTimeoutSecs:        0,
+	BlockwiseStallPolicy:             BlockwiseStallAbort,
+	IncompleteUploadRetries:          2,
+	PathMTU:                          0,
+	RequestOptions:                   "",
+	TokenCompression:                 false,
+	MaxBytesPerMinute:                0,
+	MaxObserves:                      0,
+	ObserveResyncGap:                 0,
+	ObserveSeqGapThreshold:           1,
+	ObservePinInBackground:           false,
+	LowPowerMaxDeferredNotifications: 100,
+	DownloadRangeBlocks:              64,
+	StrictContentFormat:              false,
+	SchemaValidation:                 false,
+	SchemaValidationReject:           false,
+	MaxConcurrentExchanges:           0,
+	MaxConcurrentHandshakes:          0,
+	DictionaryV2:                     false,
+	AllowUncompressedFallback:        false,
+	PathSegments:                     false,
+	RequireTokenPaths:                "",
+	TxnCacheSecs:                     300,
+	PresenceNonConfirmable:           false,
+	ObserveCompression:               ObserveCompressionNone,
+	PathRewriter:                     nil,
+}
+
+// activeParams holds the current *ConnectionParams. The params are replaced on SetParams and never modified,
+// so they can be read without locking.
+var activeParams = func() *atomic.Value {
+	var v atomic.Value
+	v.Store(&defaultConnectionParams)
+	return &v
+}()
+
+// params returns the current connection parameters, which MUST NOT be modified
+func params() *ConnectionParams {
+	return activeParams.Load().(*ConnectionParams)
 }
 
+// ErrHandshakeTimeout is wrapped by the error returned from Connect when the DTLS handshake does not complete
+// within HandshakeTimeoutSecs. The error also matches lb.ErrHandshake and lb.ErrTimeout.
+var ErrHandshakeTimeout error = lb.NewError(lb.ErrTimeout, errors.New("handshake_timeout"))
+
+// ErrTooManyRoundTrips is wrapped by the error returned when a block-wise transfer would take more than
+// MaxBlockwiseRoundTrips round trips. The error also matches lb.ErrTooLarge.
+var ErrTooManyRoundTrips error = lb.NewError(lb.ErrTooLarge, errors.New("too_many_round_trips"))
+
+// ErrBlockwiseStalled is wrapped by the error returned when a block-wise transfer stalls for
+// BlockwiseStallTimeoutSecs and is aborted. The error also matches lb.ErrTimeout.
+var ErrBlockwiseStalled error = lb.NewError(lb.ErrTimeout, errors.New("blockwise_stalled"))
+
+// ErrRetransmitBudgetExhausted is wrapped by the error returned when the connection a request was in flight on was
+// closed for using up MaxConnectionRetransmits. The error also matches lb.ErrReset.
+var ErrRetransmitBudgetExhausted error = lb.NewError(lb.ErrReset, errors.New("retransmit_budget_exhausted"))
+
+// The BlockwiseStallPolicy values
+const (
+	BlockwiseStallAbort = "abort"
+	BlockwiseStallRetry = "retry"
+	BlockwiseStallWait  = "wait"
+)
+
+// The ObserveOrdering values
+const (
+	ObserveOrderingArrival = "arrival"
+	ObserveOrderingStrict  = "strict"
+)
+
+// The ObserveCompression values
+const (
+	ObserveCompressionNone  = "none"
+	ObserveCompressionDelta = "delta"
+)
+
+// transportError wraps an error from sending a request on conn with its cause, if it is known, so callers can
+// check it with errors.Is e.g lb.ErrTimeout
+func transportError(conn *client.ClientConn, err error) error {
+	switch {
+	case connRetransmitBudget(conn).isExhausted():
+		return fmt.Errorf("%w: connection closed after too many retransmissions without a response: %s",
+			ErrRetransmitBudgetExhausted, err)
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || conn.Context().Err() != nil:
+		// the connection was closed under the request, so it did not time out on its own
+		return lb.NewError(lb.ErrReset, err)
+	case isTimeout(err):
+		return lb.NewError(lb.ErrTimeout, err)
+	}
+	return err
+}
+
+// isTimeout returns true if the error is from a timeout
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// The block size to use for blockwise transfers
+const blockwiseSZX = blockwise.SZX1024
+
+// Request bodies of at least this many bytes are converted to CBOR with a streaming encoder, which does not hold the
+// decoded JSON in memory. It costs a byte for each object and array, which are sent with indefinite lengths, and
+// rejects objects with duplicate keys.
+const streamingBodyMinBytes = 64 * 1024
+
+// The No-Response option value which suppresses all responses: 2.xx, 4.xx and 5.xx
+// https://datatracker.ietf.org/doc/html/rfc7967#section-2.1
+const noResponseAll = 2 | 8 | 16
+
 const (
 	ctxValObserveSync     = "ctxValObserveSync"
 	ctxValSentAccessToken = "ctxValSentAccessToken"
+	ctxValHandshakeTiming = "ctxValHandshakeTiming"
+	ctxValBlockwiseSZX    = "ctxValBlockwiseSZX"
+	// why the conn was closed, an ObserveEnded reason, if it was closed on purpose
+	ctxValCloseReason = "ctxValCloseReason"
+	// the roundTripCounter which counts the datagrams received on the conn
+	ctxValRoundTripCounter = "ctxValRoundTripCounter"
+	// the retransmitBudget of the conn
+	ctxValRetransmitBudget = "ctxValRetransmitBudget"
+	// set once a /sync observation has been registered on the conn
+	ctxValObserveRegistered = "ctxValObserveRegistered"
 )
 
+// closeConn closes conn, remembering the reason for the /sync observation which ends with it
+func closeConn(conn *client.ClientConn, reason string) {
+	conn.SetContextValue(ctxValCloseReason, reason)
+	conn.Close()
+}
+
+// closeReason returns why conn was closed, which is ObserveEndedConnectionLost unless it was closed by closeConn
+func closeReason(conn *client.ClientConn) string {
+	if reason, ok := conn.Context().Value(ctxValCloseReason).(string); ok {
+		return reason
+	}
+	return ObserveEndedConnectionLost
+}
+
 var dc *dtlsClients = newDTLSClients()
 var cborCodec *lb.CBORCodec = lb.NewCBORCodecV1(false)
+var plainCBORCodec *lb.CBORCodec = cborCodec.WithoutDictionary()
+var cborCodecV2 *lb.CBORCodec = cborCodec.ForDictionary(lb.DictionaryV2)
 var coapHTTP *lb.CoAPHTTP = lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+var coapHTTPWithURIHost *lb.CoAPHTTP = func() *lb.CoAPHTTP {
+	co := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	co.URIHost = true
+	return co
+}()
+var coapHTTPFullPaths *lb.CoAPHTTP = lb.NewCoAPHTTP(fullPaths)
+var coapHTTPFullPathsWithURIHost *lb.CoAPHTTP = func() *lb.CoAPHTTP {
+	co := lb.NewCoAPHTTP(fullPaths)
+	co.URIHost = true
+	return co
+}()
+var coapHTTPV2 *lb.CoAPHTTP = lb.NewCoAPHTTP(lb.NewCoAPPathV2())
+var coapHTTPV2WithURIHost *lb.CoAPHTTP = func() *lb.CoAPHTTP {
+	co := lb.NewCoAPHTTP(lb.NewCoAPPathV2())
+	co.URIHost = true
+	return co
+}()
+
+// dictionaryNone is the dictionary of requests with SendOptions.NoDictionary, which have plain CBOR bodies
+const dictionaryNone = "none"
+
+// dictionaryFallback is the dictionary of requests to servers which support none of the dictionaries, with
+// AllowUncompressedFallback set. Their bodies are plain CBOR like dictionaryNone, and their paths are sent in full.
+const dictionaryFallback = "fallback"
+
+// Long-polling /sync requests take as long as the server waits for events, so they don't measure the link
+var coapSyncPath = coapHTTP.Paths.HTTPPathToCoapPath("/_matrix/client/r0/sync")
+
+// fullPaths has no CoAP enum paths, so every path is sent as it is
+var fullPaths = func() *lb.CoAPPath {
+	p, err := lb.NewCoAPPath(map[string]string{})
+	if err != nil {
+		// this shouldn't be possible as there are no mappings
+		panic("failed to create full paths: " + err.Error())
+	}
+	return p
+}()
+
+// coapHTTPFor returns the CoAP mapper to use for the params and request dictionary given, which compresses paths
+// with the path segments dictionary if pathSegments is set
+func coapHTTPFor(cp *ConnectionParams, dictionary string, pathSegments bool) *lb.CoAPHTTP {
+	if dictionary == dictionaryFallback {
+		if cp.SendURIHost {
+			return withPaths(coapHTTPFullPathsWithURIHost, cp, pathSegments)
+		}
+		return withPaths(coapHTTPFullPaths, cp, pathSegments)
+	}
+	if dictionary == lb.DictionaryV2 {
+		if cp.SendURIHost {
+			return withPaths(coapHTTPV2WithURIHost, cp, pathSegments)
+		}
+		return withPaths(coapHTTPV2, cp, pathSegments)
+	}
+	if cp.SendURIHost {
+		return withPaths(coapHTTPWithURIHost, cp, pathSegments)
+	}
+	return withPaths(coapHTTP, cp, pathSegments)
+}
+
+// requestFormat returns the codec and Content-Type of request bodies using the dictionary, and the content-format
+// the response is asked to have
+func requestFormat(dictionary string) (*lb.CBORCodec, string, message.MediaType) {
+	switch dictionary {
+	case dictionaryNone, dictionaryFallback:
+		return plainCBORCodec, lb.ContentTypePlainCBOR, lb.ContentFormatPlainCBOR
+	case lb.DictionaryV2:
+		return cborCodecV2, lb.ContentTypeCBORV2, lb.ContentFormatCBORV2
+	}
+	return cborCodec, "application/cbor", message.AppCBOR
+}
+
+// encodeBody converts a JSON request body to CBOR with codec. Large bodies are converted with the streaming encoder,
+// unless they repeat a key, in which case they are converted like small ones so the last value is kept.
+func encodeBody(codec *lb.CBORCodec, body string) ([]byte, error) {
+	if len(body) < streamingBodyMinBytes {
+		return codec.JSONToCBOR(bytes.NewBufferString(body))
+	}
+	var buf bytes.Buffer
+	enc := codec.NewStreamingEncoder(&buf)
+	_, err := io.WriteString(enc, body)
+	// Close has the conversion error, which fails the write too
+	if closeErr := enc.Close(); closeErr != nil {
+		err = closeErr
+	}
+	if errors.Is(err, lb.ErrDuplicateKey) {
+		return codec.JSONToCBOR(bytes.NewBufferString(body))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// responseCodec returns the codec to decode a response body with the Content-Type given. The server may not use
+// the dictionary the request asked for, e.g if it ignores the Accept option.
+func responseCodec(contentType string) *lb.CBORCodec {
+	switch contentType {
+	case lb.ContentTypePlainCBOR:
+		return plainCBORCodec
+	case lb.ContentTypeCBORV2:
+		return cborCodecV2
+	}
+	return cborCodec
+}
 
-// Params returns the current connection parameters.
+// codecDictionary returns the dictionary version of a codec from responseCodec, for Response.Dictionary
+func codecDictionary(codec *lb.CBORCodec) string {
+	if codec == plainCBORCodec {
+		return dictionaryNone
+	}
+	return codec.Dictionary()
+}
+
+// Params returns a copy of the current connection parameters. Modifying the copy has no effect until
+// it is passed to SetParams.
 func Params() *ConnectionParams {
-	return &activeConnectionParams
+	cp := *params()
+	return &cp
 }
 
 // SetParams changes the connection parameters to those given. Closes all DTLS connections.
-func SetParams(cp *ConnectionParams) {
-	activeConnectionParams = *cp
-	dc.closeAllConns()
+// Returns an error if the parameters are invalid, in which case the current parameters are kept.
+// It is safe to call this at any time: requests which are in-flight keep using the old parameters,
+// and the new parameters take effect for subsequent requests.
+func SetParams(cp *ConnectionParams) error {
+	dtlsConfig, err := newDTLSConfig(cp)
+	if err != nil {
+		return err
+	}
+	if cp.AdaptiveTransmission {
+		if _, err = szxForBlockSize(cp.AdaptiveMinBlockSize); err != nil {
+			return fmt.Errorf("AdaptiveMinBlockSize: %w", err)
+		}
+	}
+	if _, err = parseRequestOptions(cp.RequestOptions); err != nil {
+		return fmt.Errorf("RequestOptions: %w", err)
+	}
+	if _, err = parseRequireTokenPaths(cp.RequireTokenPaths); err != nil {
+		return fmt.Errorf("RequireTokenPaths: %w", err)
+	}
+	switch cp.BlockwiseStallPolicy {
+	case "", BlockwiseStallAbort, BlockwiseStallRetry, BlockwiseStallWait:
+	default:
+		return fmt.Errorf("BlockwiseStallPolicy: unknown policy %q", cp.BlockwiseStallPolicy)
+	}
+	switch cp.ObserveOrdering {
+	case "", ObserveOrderingArrival, ObserveOrderingStrict:
+	default:
+		return fmt.Errorf("ObserveOrdering: unknown ordering %q", cp.ObserveOrdering)
+	}
+	switch cp.ObserveCompression {
+	case "", ObserveCompressionNone, ObserveCompressionDelta:
+	default:
+		return fmt.Errorf("ObserveCompression: unknown compression %q", cp.ObserveCompression)
+	}
+	if cp.ObserveSeqGapThreshold < 0 {
+		return fmt.Errorf("ObserveSeqGapThreshold: must not be negative, got %d", cp.ObserveSeqGapThreshold)
+	}
+	if cp.LowPowerMaxDeferredNotifications < 0 {
+		return fmt.Errorf("LowPowerMaxDeferredNotifications: must not be negative, got %d", cp.LowPowerMaxDeferredNotifications)
+	}
+	if cp.ObserveBatchSize < 0 || cp.ObserveBatchIntervalMs < 0 {
+		return fmt.Errorf("ObserveBatchSize and ObserveBatchIntervalMs: must not be negative, got %d and %d", cp.ObserveBatchSize, cp.ObserveBatchIntervalMs)
+	}
+	if cp.IncompleteUploadRetries < 0 {
+		return fmt.Errorf("IncompleteUploadRetries: must not be negative, got %d", cp.IncompleteUploadRetries)
+	}
+	if cp.PathMTU != 0 {
+		if _, err = mtuBlockSZX(cp.PathMTU); err != nil {
+			return fmt.Errorf("PathMTU: %w", err)
+		}
+	}
+	if cp.DownloadRangeBlocks < 0 {
+		return fmt.Errorf("DownloadRangeBlocks: must not be negative, got %d", cp.DownloadRangeBlocks)
+	}
+	if cp.RetryBudgetPerMinute < 0 {
+		return fmt.Errorf("RetryBudgetPerMinute: must not be negative, got %d", cp.RetryBudgetPerMinute)
+	}
+	if cp.MaxBytesPerMinute != params().MaxBytesPerMinute {
+		bandwidth.reset()
+	}
+	if cp.RetryBudgetPerMinute != params().RetryBudgetPerMinute {
+		retries.reset()
+	}
+	newParams := *cp
+	dc.setParams(&newParams, dtlsConfig)
+	exchanges.resize(cp.MaxConcurrentExchanges)
+	handshakes.resize(cp.MaxConcurrentHandshakes)
+	return nil
 }
 
 // Response is a simple HTTP response
@@ -136,6 +767,51 @@ type Response struct {
 	Code int
 	// Body is the HTTP response body as a string
 	Body string
+	// ETag is the entity tag of the response, if the server sent one, for use with SendConditionalRequest
+	ETag string
+	// CacheControl is the HTTP Cache-Control header for the CoAP Max-Age option, if the server sent one e.g
+	// "max-age=3600". Responses without it must not be cached.
+	CacheControl string
+	// Timings is how long each stage of the request took. It is nil for responses which were not from a
+	// single CoAP exchange, e.g pushed OBSERVE /sync responses.
+	Timings *Timings
+	// Dictionary is the dictionary version the server encoded the body with, from its content-format, e.g "v1" or
+	// "v2", or "none" for plain CBOR. This may not be the dictionary the request asked for, e.g when the server is
+	// older than the client. It is empty if the body was not CBOR, e.g fake /sync responses and empty bodies.
+	Dictionary string
+}
+
+// Timings is how long each stage of a request took, in milliseconds. Stages which did not happen are 0.
+type Timings struct {
+	// The DTLS handshake, if the request made a new connection
+	HandshakeMillis float64
+	// The first CoAP round trip
+	ExchangeMillis float64
+	// The round trips after the first in a block-wise transfer. The CoAP library does not expose the time taken
+	// by each block, so this is estimated by splitting the total time evenly between round trips.
+	BlockwiseMillis float64
+	// Converting the response body from CBOR to JSON
+	DecodeMillis float64
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Connect establishes a DTLS connection to the host in hsURL, performing a DTLS handshake if there is
+// no existing connection. It is not required to call this before SendRequest, but it can be used to
+// check connectivity or to avoid the handshake latency on the first request. Handshake failures match
+// lb.ErrHandshake with errors.Is, and also lb.ErrTimeout if the handshake timed out.
+func Connect(hsURL string) error {
+	u, err := url.Parse(hsURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse HS URL: %w", err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("HS URL missing host: %s", hsURL)
+	}
+	_, err = dc.getClientForHost(u.Host)
+	return err
 }
 
 // SendRequest sends a CoAP request to the target hsURL. All of these parameters should be treated
@@ -145,57 +821,95 @@ type Response struct {
 //
 // This function will block until the response is returned, or the request times out.
 func SendRequest(method, hsURL, token, body string) *Response {
-	logrus.Infof("DTLS SendRequest -> %s %s", method, hsURL)
+	return sendRequest(method, hsURL, token, body, &SendOptions{})
+}
 
-	// convert JSON to CBOR
-	var reqBody io.ReadSeeker
-	if body != "" {
-		cborBody, err := cborCodec.JSONToCBOR(bytes.NewBufferString(body))
-		if err != nil {
-			logrus.WithError(err).Error("Failed to convert HTTP request body from JSON to CBOR")
-			return nil // send request normally
-		}
-		reqBody = bytes.NewReader(cborBody)
+// SendConditionalRequest is SendRequest with If-Match and If-None-Match headers, either of which may be empty,
+// for endpoints which use entity tags to stop concurrent updates overwriting each other, e.g MSC4108 rendezvous
+// sessions. Pass the Response.ETag of an earlier response. Returns <nil> if the conditions cannot be sent over
+// CoAP, as the request must not be sent without them. CoAP has no 202 Accepted, so an update which the server
+// accepts with a 202 returns a 200.
+func SendConditionalRequest(method, hsURL, token, body, ifMatch, ifNoneMatch string) *Response {
+	return SendRequestWithOptions(method, hsURL, token, body, &SendOptions{
+		IfMatch:     ifMatch,
+		IfNoneMatch: ifNoneMatch,
+	})
+}
+
+// SendOptions are the less common options for a single request
+type SendOptions struct {
+	// The If-Match and If-None-Match headers, which may be empty. See SendConditionalRequest.
+	IfMatch     string
+	IfNoneMatch string
+	// If set, the request and response bodies are plain CBOR without the dictionary of keys and values, to find
+	// out whether a mismatch is caused by the dictionary. Responses are still decoded if the server ignores this.
+	// This does not apply to /sync when ObserveEnabled is set, as /sync observations are shared.
+	NoDictionary bool
+	// The W3C traceparent header of the span the request is sent from, which may be empty. The trace context is
+	// sent to the server, and spans of the request are sent to the sink set with SetSpanSink. This does not apply
+	// to /sync when ObserveEnabled is set, as /sync observations are shared.
+	TraceParent string
+}
+
+// SendRequestWithOptions is SendRequest with options, which may be nil
+func SendRequestWithOptions(method, hsURL, token, body string, opts *SendOptions) *Response {
+	if opts == nil {
+		opts = &SendOptions{}
 	}
+	return sendRequest(method, hsURL, token, body, opts)
+}
 
-	// convert HTTP params into an HTTP request
-	req, err := http.NewRequest(method, hsURL, reqBody)
-	if err != nil {
-		logrus.WithError(err).Error("Failed to create HTTP request from params")
-		return nil
+func sendRequest(method, hsURL, token, body string, opts *SendOptions) *Response {
+	logrus.Infof("DTLS SendRequest -> %s %s", method, hsURL)
+	if token == "" && requiresToken(params(), hsURL) {
+		logrus.Infof("Rejecting %s %s without an access token", method, hsURL)
+		return missingTokenResponse()
 	}
-	if reqBody != nil {
-		req.Header.Set("Content-Type", "application/cbor")
+	// requests without the dictionary are for debugging what is sent, so are always sent
+	if cp := params(); cp.TxnCacheSecs > 0 && !opts.NoDictionary {
+		if key, ok := txnKey(method, hsURL, tokens.current(token)); ok {
+			return txns.do(key, time.Duration(cp.TxnCacheSecs)*time.Second, func() *Response {
+				return sendRequestOnce(method, hsURL, token, body, opts)
+			})
+		}
 	}
+	return sendRequestOnce(method, hsURL, token, body, opts)
+}
 
-	// fetch a DTLS client (either cached or makes a new conn)
-	u, err := url.Parse(hsURL)
-	if err != nil {
-		logrus.WithError(err).Error("Failed to parse HS URL")
-		return nil
+// sendRequestOnce is sendRequest without the transaction cache
+func sendRequestOnce(method, hsURL, token, body string, opts *SendOptions) *Response {
+	trace := newRequestTrace(opts.TraceParent, time.Now())
+	req, reqBody, u, conn, dictionary := newRequest(method, hsURL, body, opts.NoDictionary)
+	if req == nil {
+		return nil // send request normally
 	}
-	if u.Host == "" {
-		logrus.WithField("url", hsURL).Error("HS URL missing host")
-		return nil
+	if opts.IfMatch != "" {
+		req.Header.Set("If-Match", opts.IfMatch)
 	}
-	conn, err := dc.getClientForHost(u.Host)
-	if err != nil {
-		logrus.WithError(err).Errorf("Failed to get DTLS client for host %s", u.Host)
-		return nil
+	if opts.IfNoneMatch != "" {
+		req.Header.Set("If-None-Match", opts.IfNoneMatch)
 	}
 
-	// Check if we've sent an access token and set it if we need to
-	sentAccessToken := conn.Context().Value(ctxValSentAccessToken)
-	if sentAccessToken == nil || sentAccessToken != token {
-		req.Header.Set("Authorization", "Bearer "+token)
-		conn.SetContextValue(ctxValSentAccessToken, token)
+	token = tokens.current(token)
+	setAccessToken(conn, req, token)
+	timings := &Timings{
+		HandshakeMillis: takeHandshakeMillis(conn),
 	}
+	cp := params()
+	limit := newRequestLimit(cp)
+	limit.transfer = newTransferProgress(method, u.Path)
+	defer limit.cancel()
+	req = req.WithContext(limit.ctx)
 
 	// Check for /sync OBSERVE requests
-	if activeConnectionParams.ObserveEnabled && strings.Contains(u.Path, "/_matrix/client/r0/sync") {
+	if cp.ObserveEnabled && strings.Contains(u.Path, "/_matrix/client/r0/sync") && dictionary != dictionaryFallback {
 		queries := u.Query()
 		since := u.Query().Get("since")
-		ch := observe(conn, coapHTTP.Paths.HTTPPathToCoapPath("/_matrix/client/r0/sync"), token, queries)
+		var hostOpts []message.Option
+		if cp.SendURIHost {
+			hostOpts, _ = lb.URIHostOptions(u)
+		}
+		ch := observe(conn, u.Host, coapHTTP.Paths.HTTPPathToCoapPath("/_matrix/client/r0/sync"), token, queries, hostOpts)
 		if ch == nil {
 			return nil
 		}
@@ -203,7 +917,10 @@ func SendRequest(method, hsURL, token, body string) *Response {
 		case r := <-ch:
 			logrus.Infof("Returning real /sync response")
 			return r
-		case <-time.After(time.Duration(activeConnectionParams.ObserveNoResponseTimeoutSecs) * time.Second):
+		case <-limit.ctx.Done():
+			logrus.Infof("/sync was cancelled by CancelAll")
+			return cancelledResponse()
+		case <-time.After(time.Duration(cp.ObserveNoResponseTimeoutSecs) * time.Second):
 			// return a stub response - this keeps clients happy since they think they are syncing ok
 			logrus.Infof("Sending fake /sync response")
 			return &Response{
@@ -220,32 +937,105 @@ func SendRequest(method, hsURL, token, body string) *Response {
 		}
 	}
 
+	if trace != nil {
+		req.Header.Set("traceparent", trace.startExchange(method, u.Path))
+		defer trace.endExchange(0, errNoResponse, timings)
+	}
+
 	// send the request
 	var res *pool.Message
-	err = coapHTTP.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
-		res, err = conn.Do(msg)
+	rewindBody := func() {
+		if reqBody != nil {
+			_, _ = reqBody.Seek(0, 0)
+			req.Body = ioutil.NopCloser(reqBody)
+		}
+	}
+	send := func() error {
+		var err error
+		err = coapHTTPFor(cp, dictionary, requestPathSegments(conn, u)).HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+			res, err = do(conn, msg, timings, limit)
+			return err
+		})
+		if errors.Is(err, errTokenRefRejected) {
+			logrus.Info("Server has forgotten the access token reference, sending the full token")
+			rewindBody()
+			err = coapHTTPFor(cp, dictionary, requestPathSegments(conn, u)).HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+				res, err = do(conn, msg, timings, limit)
+				return err
+			})
+		}
 		return err
-	})
+	}
+	err := send()
+	for attempts := 1; err == nil && res.Code() == codes.RequestEntityIncomplete; attempts++ {
+		if attempts > cp.IncompleteUploadRetries {
+			logrus.Errorf("Server still has an incomplete request body after %d attempts", attempts)
+			recordIncompleteUploadFailure()
+			return requestIncompleteResponse(attempts)
+		}
+		if !allowRetry(cp, method, u.Path) {
+			return retryBudgetExhaustedResponse(cp.RetryBudgetPerMinute)
+		}
+		logrus.Warn("Server has an incomplete request body, sending it again from the first block")
+		recordIncompleteUploadRetry()
+		limit.cancel()
+		limit = newRequestLimit(cp)
+		limit.transfer = newTransferProgress(method, u.Path)
+		defer limit.cancel()
+		req = req.WithContext(limit.ctx)
+		rewindBody()
+		err = send()
+	}
+	if errors.Is(err, ErrBlockwiseStalled) && cp.BlockwiseStallPolicy == BlockwiseStallRetry && method == "GET" {
+		if !allowRetry(cp, method, u.Path) {
+			return retryBudgetExhaustedResponse(cp.RetryBudgetPerMinute)
+		}
+		logrus.WithError(err).Warn("Sending the request again")
+		limit.cancel()
+		limit = newRequestLimit(cp)
+		limit.transfer = newTransferProgress(method, u.Path)
+		defer limit.cancel()
+		req = req.WithContext(limit.ctx)
+		err = send()
+	}
+	if limit.wasCancelledAll() {
+		logrus.Infof("%s %s was cancelled by CancelAll", method, u.Path)
+		return cancelledResponse()
+	}
+	if errors.Is(err, ErrBlockwiseStalled) {
+		logrus.WithError(err).Error("Aborted stalled block-wise transfer")
+		return blockwiseStalledResponse(cp.BlockwiseStallTimeoutSecs, limit.stalledBlocks())
+	}
+	if errors.Is(err, ErrTooManyRoundTrips) {
+		logrus.WithError(err).Error("Aborted block-wise transfer")
+		return tooManyRoundTripsResponse(cp.MaxBlockwiseRoundTrips)
+	}
 	if err != nil {
 		logrus.WithError(err).Error("Failed to convert HTTP request to CoAP or to send request")
 
 		if dc.isConnClosed(u.Host) {
+			if !allowRetry(cp, method, u.Path) {
+				return retryBudgetExhaustedResponse(cp.RetryBudgetPerMinute)
+			}
 			logrus.Warn("Connection is closed, re-establishing")
 			conn, err = dc.getClientForHost(u.Host)
 			if err != nil {
 				logrus.WithError(err).Errorf("Failed to get DTLS client for host %s", u.Host)
 				return nil
 			}
-			req.Header.Set("Authorization", "Bearer "+token)
-			conn.SetContextValue(ctxValSentAccessToken, token)
-			if reqBody != nil {
-				_, _ = reqBody.Seek(0, 0)
-				req.Body = ioutil.NopCloser(reqBody)
+			// the token may have been refreshed while the request was failing
+			setAccessToken(conn, req, tokens.current(token))
+			timings.HandshakeMillis += takeHandshakeMillis(conn)
+			rewindBody()
+			err = send()
+			if errors.Is(err, ErrTooManyRoundTrips) {
+				logrus.WithError(err).Error("Aborted block-wise transfer")
+				return tooManyRoundTripsResponse(cp.MaxBlockwiseRoundTrips)
+			}
+			if limit.wasCancelledAll() {
+				logrus.Infof("%s %s was cancelled by CancelAll", method, u.Path)
+				return cancelledResponse()
 			}
-			err = coapHTTP.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
-				res, err = conn.Do(msg)
-				return err
-			})
 			if err != nil {
 				logrus.WithError(err).Error("Still failed to convert HTTP request to CoAP or to send request")
 				return nil
@@ -256,75 +1046,552 @@ func SendRequest(method, hsURL, token, body string) *Response {
 		}
 	}
 	logrus.Infof("Got response code: %v", res.Code())
+	notifyResponseOptions(u.Path, res.Options())
 
 	// convert CoAP to HTTP and return the response
 	httpRes := coapHTTP.CoAPToHTTPResponse(res)
 	if httpRes == nil {
 		return nil
 	}
+	trace.endExchange(httpRes.StatusCode, nil, timings)
+	// a 4.13 with a Size1 option means the CoAP server rejected the body before it got to the homeserver
+	if maxSize, err := res.Options().GetUint32(message.Size1); err == nil && httpRes.StatusCode == 413 {
+		logrus.Warnf("Request body is %d bytes, server accepts at most %d bytes", req.ContentLength, maxSize)
+		return requestTooLargeResponse(maxSize)
+	}
+	if cp.StrictContentFormat {
+		if err := checkContentFormat(res, dictionary); err != nil {
+			logrus.WithError(err).Errorf("Rejecting response to %s", u.Path)
+			recordContentFormatRejection()
+			return nil
+		}
+	}
 	// convert CBOR to JSON
-	resBody, err := cborCodec.CBORToJSON(httpRes.Body)
+	start := time.Now()
+	resBody, resDictionary, err := decodeResponseBody(responseCodec(httpRes.Header.Get("Content-Type")), httpRes.Body)
+	trace.decoded(start, resDictionary, err)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to read response body")
 		return nil
 	}
+	timings.DecodeMillis = millis(time.Since(start))
+	if cp.SchemaValidation && httpRes.StatusCode >= 200 && httpRes.StatusCode < 300 {
+		if err := validateResponse(u.Path, resBody); err != nil {
+			logrus.WithError(err).Errorf("Response to %s does not match its schema", u.Path)
+			recordSchemaViolation()
+			if cp.SchemaValidationReject {
+				return nil
+			}
+		}
+	}
+
+	return &Response{
+		Code:         httpRes.StatusCode,
+		Body:         string(resBody),
+		ETag:         httpRes.Header.Get("ETag"),
+		CacheControl: httpRes.Header.Get("Cache-Control"),
+		Timings:      timings,
+		Dictionary:   resDictionary,
+	}
+}
+
+// requestTooLargeResponse returns a Matrix M_TOO_LARGE error stating the maximum request size the server accepts
+func requestTooLargeResponse(maxSize uint32) *Response {
+	return &Response{
+		Code: 413,
+		Body: fmt.Sprintf(
+			`{"errcode":"M_TOO_LARGE","error":"Request body is too large, the server accepts at most %d bytes","max_size":%d}`,
+			maxSize, maxSize,
+		),
+	}
+}
 
+// missingTokenResponse returns the Matrix M_MISSING_TOKEN error the homeserver would have sent
+func missingTokenResponse() *Response {
 	return &Response{
-		Code: httpRes.StatusCode,
-		Body: string(resBody),
+		Code: 401,
+		Body: `{"errcode":"M_MISSING_TOKEN","error":"Missing access token"}`,
 	}
 }
 
-func observe(conn *client.ClientConn, path, token string, queries url.Values) chan *Response {
+// tooManyRoundTripsResponse returns an error stating the block-wise transfer was aborted
+func tooManyRoundTripsResponse(maxRoundTrips int) *Response {
+	return &Response{
+		Code: 504,
+		Body: fmt.Sprintf(
+			`{"errcode":"M_UNKNOWN","error":"Block-wise transfer was aborted as it needed more than %d round trips","max_round_trips":%d}`,
+			maxRoundTrips, maxRoundTrips,
+		),
+	}
+}
+
+// blockwiseStalledResponse returns an error stating the block-wise transfer was aborted after it stalled
+func blockwiseStalledResponse(stallTimeoutSecs int, blocks int64) *Response {
+	return &Response{
+		Code: 504,
+		Body: fmt.Sprintf(
+			`{"errcode":"M_UNKNOWN","error":"Block-wise transfer was aborted as nothing was received for %ds after %d blocks of the response","blocks_received":%d}`,
+			stallTimeoutSecs, blocks, blocks,
+		),
+	}
+}
+
+// requestIncompleteResponse returns an error stating the server never had the whole of a block-wise request body
+func requestIncompleteResponse(attempts int) *Response {
+	return &Response{
+		Code: 408,
+		Body: fmt.Sprintf(
+			`{"errcode":"M_UNKNOWN","error":"Block-wise request body was still incomplete at the server after %d attempts","attempts":%d}`,
+			attempts, attempts,
+		),
+	}
+}
+
+// checkContentFormat returns an error if the response has a body which is not in the content-format the request
+// asked for, which depends on the request dictionary
+func checkContentFormat(res *pool.Message, dictionary string) error {
+	if size, err := res.BodySize(); err != nil || size == 0 {
+		// e.g 304 Not Modified
+		return nil
+	}
+	_, _, want := requestFormat(dictionary)
+	got, err := res.Options().ContentFormat()
+	if err != nil {
+		return fmt.Errorf("response has a body but no content-format, want %v", want)
+	}
+	if got != want {
+		return fmt.Errorf("response has content-format %v, want %v", got, want)
+	}
+	return nil
+}
+
+// decodeResponseBody converts a CBOR response body to JSON. If the body is not CBOR but is valid JSON, e.g
+// because a misconfigured proxy is sending JSON, the body is returned as-is.
+func decodeResponseBody(codec *lb.CBORCodec, body io.Reader) ([]byte, string, error) {
+	// responses like 304 Not Modified have no body
+	if body == nil {
+		return nil, "", nil
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil || len(data) == 0 {
+		return data, "", err
+	}
+	resBody, err := codec.CBORToJSON(bytes.NewReader(data))
+	// Matrix responses are always objects. JSON objects begin with '{' which is a CBOR text string header,
+	// so JSON can successfully decode as a meaningless CBOR string rather than failing.
+	if err == nil && (len(resBody) == 0 || resBody[0] != '"') {
+		return resBody, codecDictionary(codec), nil
+	}
+	if !json.Valid(data) {
+		if err == nil {
+			err = lb.NewError(lb.ErrCBORDecode, errors.New("response body is a CBOR string, not an object"))
+		}
+		return nil, "", err
+	}
+	logrus.WithError(err).Warn("Response body is not CBOR but is valid JSON, passing it through as-is")
+	recordCBORDecodeFallback()
+	return data, "", nil
+}
+
+// do sends the request on conn and waits for the response, recording block-wise transfer stats and timings.
+// The request is aborted if it takes more round trips than the limit allows, in which case the error wraps
+// ErrTooManyRoundTrips. The message must have the limit's context.
+func do(conn *client.ClientConn, msg *pool.Message, timings *Timings, limit *roundTripLimit) (*pool.Message, error) {
+	cp := params()
+	addRequestOptions(msg, cp)
+	var sent *sentToken
+	if cp.TokenCompression {
+		sent = compressAccessToken(conn, msg)
+	}
+	path, _ := msg.Options().Path()
+	reqBodySize, _ := msg.BodySize()
+	if limit.max > 0 {
+		if reqBlocks := numBlocks(reqBodySize, connBlockSZX(conn).Size()); reqBlocks > limit.max {
+			recordBlockwiseAbort()
+			return nil, fmt.Errorf("%w: request body is %d bytes which needs %d round trips, the limit is %d",
+				ErrTooManyRoundTrips, reqBodySize, reqBlocks, limit.max)
+		}
+	}
+	if limit.max > 0 || limit.stallTimeout > 0 || limit.transfer != nil {
+		defer limit.track(conn)()
+	}
+	szx := connBlockSZX(conn)
+	// servers send responses in the block size of the request's Block2 option, but send bodies smaller than their own
+	// block size in a single message whatever it is
+	resBlockSize := int64(blockwiseSZX.Size())
+	if szx < blockwiseSZX && msg.Code() == codes.GET && !msg.HasOption(message.Block2) {
+		if block, err := blockwise.EncodeBlockOption(szx, 0, false); err == nil {
+			msg.SetOptionUint32(message.Block2, block)
+			resBlockSize = int64(szx.Size())
+		}
+	}
+	reqHeaderSize, _ := udpmessage.Message{
+		Code:    msg.Code(),
+		Token:   msg.Token(),
+		Options: msg.Options(),
+	}.Size()
+	checkDatagramSize(cp, "Request to "+path, reqHeaderSize, reqBodySize, int64(szx.Size()))
+	link, _ := conn.Context().Value(ctxValLinkEstimator).(*linkEstimator)
+	ackTimeout := time.Duration(cp.TransmissionACKTimeoutSecs) * time.Second
+	if link != nil && cp.AdaptiveTransmission {
+		ackTimeout = link.ackTimeout(cp)
+	}
+	if err := bandwidth.wait(msg.Context(), cp.MaxBytesPerMinute, int64(reqHeaderSize)+reqBodySize, path == coapSyncPath); err != nil {
+		return nil, err
+	}
+	if err := exchanges.acquire(msg.Context(), cp.MaxConcurrentExchanges); err != nil {
+		return nil, err
+	}
+	dc.acquire(conn)
+	limit.transfer.start(reqBodySize, int64(connBlockSZX(conn).Size()))
+	start := time.Now()
+	res, err := conn.Do(msg)
+	took := time.Since(start)
+	limit.stopWatching()
+	limit.transfer.finish(res, err)
+	dc.release(conn)
+	exchanges.release(params().MaxConcurrentExchanges)
+	if err != nil && limit.exceeded() {
+		recordBlockwiseAbort()
+		return nil, fmt.Errorf("%w: aborted after %d round trips: %s", ErrTooManyRoundTrips, limit.max, err)
+	}
+	if blocks := limit.stalledBlocks(); err != nil && blocks >= 0 {
+		return nil, fmt.Errorf("%w: nothing received for %v after %d blocks: %s", ErrBlockwiseStalled, limit.stallTimeout, blocks, err)
+	}
+	if err != nil {
+		// the request may have been cancelled by the connection closing rather than by the link
+		if link != nil && conn.Context().Err() == nil {
+			link.failed(ackTimeout)
+			adaptTransmission(conn, link, cp)
+		}
+		return nil, transportError(conn, err)
+	}
+	if err = sent.update(res); err != nil {
+		return nil, err
+	}
+	resBodySize, _ := res.BodySize()
+	transfer := newBlockwiseTransfer(connBlockSZX(conn).Size(), int64(reqHeaderSize), reqBodySize, resBodySize)
+	resHeaderSize, _ := udpmessage.Message{
+		Code:    res.Code(),
+		Token:   res.Token(),
+		Options: res.Options(),
+	}.Size()
+	if resBodySize < int64(blockwiseSZX.Size()) {
+		resBlockSize = resBodySize
+	}
+	checkDatagramSize(cp, "Response from "+path, resHeaderSize, resBodySize, resBlockSize)
+	// the request headers repeated on later round trips were sent after the bytes for the request were taken
+	bandwidth.take(cp.MaxBytesPerMinute, int64(resHeaderSize)+resBodySize+transfer.wastedBytes)
+	recordBlockwiseTransfer(path, transfer)
+	exchange := took / time.Duration(transfer.roundTrips)
+	timings.ExchangeMillis = millis(exchange)
+	timings.BlockwiseMillis = millis(took - exchange)
+	if link != nil && path != coapSyncPath {
+		link.sample(exchange, ackTimeout, time.Duration(cp.TransmissionNStart)*time.Second)
+		adaptTransmission(conn, link, cp)
+	}
+	return res, nil
+}
+
+// adaptTransmission applies the ACK timeout picked from the link measurements to the connection, if enabled
+func adaptTransmission(conn *client.ClientConn, link *linkEstimator, cp *ConnectionParams) {
+	if cp.AdaptiveTransmission {
+		conn.Transmission().SetTransmissionAcknowledgeTimeout(link.ackTimeout(cp))
+	}
+}
+
+// connBlockSZX returns the block size in use on the connection
+func connBlockSZX(conn *client.ClientConn) blockwise.SZX {
+	if szx, ok := conn.Context().Value(ctxValBlockwiseSZX).(blockwise.SZX); ok {
+		return szx
+	}
+	return blockwiseSZX
+}
+
+// SendNonConfirmable sends a Non-confirmable CoAP request to the target hsURL and does not wait for a
+// response. The parameters are the same as SendRequest. This is intended for ephemeral requests like
+// typing notifications, read receipts and presence, where the occasional lost request is an acceptable
+// trade-off for not waiting for ACKs. The server is told not to respond via the No-Response option
+// (RFC 7967), so no response will ever be returned. Returns false if the request could not be sent, in
+// which case clients should use normal Matrix over HTTP to send this request.
+func SendNonConfirmable(method, hsURL, token, body string) bool {
+	logrus.Infof("DTLS SendNonConfirmable -> %s %s", method, hsURL)
+
+	req, reqBody, u, conn, dictionary := newRequest(method, hsURL, body, false)
+	if req == nil {
+		return false
+	}
+	// Blockwise transfers need confirmable messages, so the body must fit into a single message.
+	if reqBody != nil {
+		size, _ := reqBody.Seek(0, io.SeekEnd)
+		_, _ = reqBody.Seek(0, io.SeekStart)
+		if size > int64(connBlockSZX(conn).Size()) {
+			logrus.Errorf("Cannot send non-confirmable request, body is too large: %d bytes", size)
+			return false
+		}
+	}
+	// Always send the access token as there is no guarantee this request will arrive, so we cannot
+	// rely on the server remembering it for subsequent requests.
+	req.Header.Set("Authorization", "Bearer "+tokens.current(token))
+
+	cp := params()
+	err := coapHTTPFor(cp, dictionary, requestPathSegments(conn, u)).HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+		addRequestOptions(msg, cp)
+		msg.SetType(udpmessage.NonConfirmable)
+		msg.SetMessageID(udpmessage.GetMID())
+		msg.SetOptionUint32(message.NoResponse, noResponseAll)
+		// write directly to the session as the blockwise layer would send this as a confirmable message
+		return conn.Session().WriteMessage(msg)
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Failed to convert HTTP request to CoAP or to send non-confirmable request")
+		return false
+	}
+	return true
+}
+
+// newRequest converts the JSON request into an HTTP request with a CBOR body, and returns it along with
+// the DTLS connection to send it on and the dictionary of the body. If noDictionary is set, the body is plain CBOR
+// and the response is asked to be. Returns a nil request if it is not possible to send this request over CoAP.
+func newRequest(method, hsURL, body string, noDictionary bool) (*http.Request, io.ReadSeeker, *url.URL, *client.ClientConn, string) {
+	// fetch a DTLS client (either cached or makes a new conn)
+	u, err := url.Parse(hsURL)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse HS URL")
+		return nil, nil, nil, nil, ""
+	}
+	if u.Host == "" {
+		logrus.WithField("url", hsURL).Error("HS URL missing host")
+		return nil, nil, nil, nil, ""
+	}
+	conn, err := dc.getClientForHost(u.Host)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get DTLS client for host %s", u.Host)
+		return nil, nil, nil, nil, ""
+	}
+
+	// convert JSON to CBOR
+	dictionary := requestDictionary(conn, u, noDictionary)
+	codec, contentType, _ := requestFormat(dictionary)
+	var reqBody io.ReadSeeker
+	if body != "" {
+		cborBody, err := encodeBody(codec, body)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to convert HTTP request body from JSON to CBOR")
+			return nil, nil, nil, nil, ""
+		}
+		reqBody = bytes.NewReader(cborBody)
+	}
+
+	// convert HTTP params into an HTTP request
+	req, err := http.NewRequest(method, hsURL, reqBody)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create HTTP request from params")
+		return nil, nil, nil, nil, ""
+	}
+	if reqBody != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if dictionary != lb.DictionaryV1 {
+		req.Header.Set("Accept", contentType)
+	}
+
+	return req, reqBody, u, conn, dictionary
+}
+
+// requestDictionary returns the dictionary to use for a request to u on conn. If DictionaryV2 or
+// AllowUncompressedFallback is set, this fetches the server's capabilities the first time it is called for a
+// connection, to find out which dictionaries it supports.
+func requestDictionary(conn *client.ClientConn, u *url.URL, noDictionary bool) string {
+	if noDictionary {
+		return dictionaryNone
+	}
+	cp := params()
+	// the capabilities request cannot wait for the capabilities
+	if (!cp.DictionaryV2 && !cp.AllowUncompressedFallback) || u.Path == lb.CapabilitiesPath {
+		return lb.DictionaryV1
+	}
+	np := connParams(conn, u)
+	switch {
+	case np == nil:
+		return lb.DictionaryV1
+	case np.DictionaryVersion == lb.DictionaryV2 && cp.DictionaryV2:
+		return lb.DictionaryV2
+	case np.DictionaryVersion == dictionaryNone && cp.AllowUncompressedFallback:
+		return dictionaryFallback
+	}
+	return lb.DictionaryV1
+}
+
+// connParams returns the parameters in use on conn, fetching the server's capabilities if this is the first time
+// they are needed for the connection. Returns nil if they could not be fetched.
+func connParams(conn *client.ClientConn, u *url.URL) *NegotiatedParams {
+	if np, ok := conn.Context().Value(ctxValEffectiveParams).(NegotiatedParams); ok {
+		return &np
+	}
+	return EffectiveParams("https://" + u.Host)
+}
+
+// handshakeTiming is how long the handshake for a connection took, which is reported in the Timings of the first
+// request on the connection only
+type handshakeTiming struct {
+	taken  int32 // accessed atomically
+	millis float64
+}
+
+// takeHandshakeMillis returns how long the handshake for conn took, if this is the first request on it
+func takeHandshakeMillis(conn *client.ClientConn) float64 {
+	h, ok := conn.Context().Value(ctxValHandshakeTiming).(*handshakeTiming)
+	if !ok || !atomic.CompareAndSwapInt32(&h.taken, 0, 1) {
+		return 0
+	}
+	return h.millis
+}
+
+// setAccessToken sets the access token on the request if it hasn't already been sent on this connection. The server
+// remembers the last access token sent on a connection and uses it for requests without one, so an empty token is
+// always sent for unauthenticated requests like /versions. With TokenCompression the token is always set, as do
+// replaces it with its reference.
+func setAccessToken(conn *client.ClientConn, req *http.Request, token string) {
+	if token == "" {
+		req.Header.Set("Authorization", "Bearer ")
+		return
+	}
+	if params().TokenCompression {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return
+	}
+	if conn.Context().Value(ctxValSentAccessToken) != token {
+		req.Header.Set("Authorization", "Bearer "+token)
+		conn.SetContextValue(ctxValSentAccessToken, token)
+	}
+}
+
+func observe(conn *client.ClientConn, host, path, token string, queries url.Values, hostOpts []message.Option) chan *Response {
+	return observeInto(conn, host, path, token, queries, hostOpts, nil)
+}
+
+// observeInto is observe with the channel to buffer notifications in, or nil to make a new one
+func observeInto(conn *client.ClientConn, host, path, token string, queries url.Values, hostOpts []message.Option, ch chan *Response) chan *Response {
+	if conn.Context().Value(ctxValObserveRegistered) != nil && conn.Context().Value(ctxValObserveSync) == nil {
+		// go-coap sends every registration with message ID 0 when block-wise transfers are enabled, so the server
+		// would answer a second registration on conn from its cache of the first. The new observation is made on a
+		// new connection, and conn is closed once its in-flight requests have finished.
+		dc.forget(conn)
+		go dc.drain(conn)
+		newConn, err := dc.getClientForHost(host)
+		if err != nil {
+			logrus.WithError(err).Errorf("Observe: failed to connect to host %s to observe path %s", host, path)
+			return nil
+		}
+		conn = newConn
+	}
 	ctx := conn.Context()
 	if ctx.Value(ctxValObserveSync) != nil {
 		logrus.Infof("Observe: connection already observing; returning existing channel")
 		return ctx.Value(ctxValObserveSync).(chan *Response)
 	}
+	if err := reserveObserve(); err != nil {
+		logrus.WithError(err).Errorf("Observe: refusing to observe path %s", path)
+		return nil
+	}
 	// make a channel which will buffer notifications then return it
-	ch := make(chan *Response, activeConnectionParams.ObserveBufferSize)
+	if ch == nil {
+		ch = make(chan *Response, params().ObserveBufferSize)
+	}
 	conn.SetContextValue(ctxValObserveSync, ch)
+	conn.SetContextValue(ctxValObserveRegistered, true)
 	logrus.Infof("Observing path: %s", path)
-	opts := []message.Option{
-		{
-			ID:    lb.OptionIDAccessToken,
-			Value: []byte(token),
-		},
+	refresh := &observeRefresh{
+		path:           path,
+		token:          token,
+		hostOpts:       hostOpts,
+		queries:        queries,
+		host:           host,
+		priority:       ObservePriorityNormal,
+		ordering:       params().ObserveOrdering,
+		syncGap:        true,
+		sinceAt:        time.Now(),
+		lastNotifiedAt: time.Now(),
+		done:           make(chan struct{}),
 	}
-	for k, v := range queries {
-		opts = append(opts, message.Option{
-			ID:    message.URIQuery,
-			Value: []byte(k + "=" + v[0]),
-		})
-	}
-	_, err := conn.Observe(context.Background(), path, func(req *pool.Message) {
+	conn.SetContextValue(ctxValObserveSyncRefresh, refresh)
+	obs, err := conn.Observe(context.Background(), path, func(notification *pool.Message) {
+		refresh.setCoAPToken(notification.Token())
+		takeNotificationBytes(notification)
+		req := refresh.filterNotification(conn, &refresh.seq, notification)
+		if req == nil {
+			return
+		}
+		defer refresh.seq.finish(notification)
+		if req != notification {
+			defer pool.ReleaseMessage(req)
+		}
 		// convert CoAP to HTTP and return the response
 		httpRes := coapHTTP.CoAPToHTTPResponse(req)
 		if httpRes == nil {
 			logrus.Warnf("Observe: failed to convert CoAP to HTTP for message %+v\n", req)
 			return
 		}
+		// the server stops observing after a notification which is an error, rather than the registration failing
+		if _, err := notification.Observe(); err == nil && httpRes.StatusCode/100 != 2 {
+			logrus.Warnf("Observe: server stopped observing %s with HTTP %d", path, httpRes.StatusCode)
+			refresh.end(conn, ObserveEndedServerError)
+			if refresh.sinceRejected(httpRes.StatusCode) {
+				logrus.Warnf("Observe: server rejected the since token of %s, starting again from an initial sync", path)
+				go resumeFromInitialSync(host, refresh, ch)
+			}
+			return
+		}
 		if httpRes.Body == nil {
 			logrus.Infof("Observe: ignoring nil response body from message %+v", req)
 			return
 		}
 		// convert CBOR to JSON
-		resBody, err := cborCodec.CBORToJSON(httpRes.Body)
+		codec := responseCodec(httpRes.Header.Get("Content-Type"))
+		resBody, err := codec.CBORToJSON(httpRes.Body)
 		if err != nil {
 			logrus.WithError(err).Error("Observe: failed to read response body (CBOR->JSON)")
 			return
 		}
+		if resBody, err = refresh.seq.reassemble(req, resBody); err != nil {
+			logrus.WithError(err).Error("Observe: failed to reassemble notification")
+			return
+		}
 		logrus.Infof("Observe: buffering response %s", string(resBody))
+		refresh.setSince(resBody)
 
-		ch <- &Response{
-			Code: httpRes.StatusCode,
-			Body: string(resBody),
+		// listeners are given every room, as they only look outside rooms
+		body, rooms := resBody, roomVersions(nil)
+		if params().ObserveChangedRoomsOnly {
+			body, rooms = refresh.rooms.filter(resBody)
+		}
+		res := &Response{
+			Code:       httpRes.StatusCode,
+			Body:       string(body),
+			Dictionary: codecDictionary(codec),
 		}
-	}, opts...)
+		if !notifySyncListeners(host, resBody) {
+			ch <- res
+			refresh.rooms.remember(rooms)
+			return
+		}
+		// there may be nobody calling SendRequest to drain the channel, so don't block the listeners
+		select {
+		case ch <- res:
+			refresh.rooms.remember(rooms)
+		default:
+			logrus.Infof("Observe: buffer full, dropping response for SendRequest")
+		}
+	}, refresh.options()...)
 	if err != nil {
 		logrus.WithError(err).Errorf("Observe: failed to observe path %s", path)
+		releaseObserve()
 		return nil
 	}
+	refresh.setObservation(obs)
+	// the observation lasts as long as the connection, unless it ends first
+	go refresh.run(conn, time.Duration(params().ObserveRefreshSecs)*time.Second, time.Duration(params().ObserveStallSecs)*time.Second)
 	return ch
 }
 
@@ -332,33 +1599,149 @@ type dtlsClients struct {
 	dtlsConfig *piondtls.Config
 	conns      map[string]*client.ClientConn // host -> conn
 	mu         sync.Mutex
+	// the number of requests waiting for a response on each conn
+	inFlight map[*client.ClientConn]int
+	// measurements of the link to each host, which are kept when conns are closed
+	links map[string]*linkEstimator
+	// true if the app is in the background, in which case conns are closed when they become idle
+	background bool
+	// hosts which had conns when the app went into the background, to reconnect to on foreground
+	backgroundHosts map[string]bool
+	// the /sync observations of backgroundHosts, to register again on foreground
+	suspendedObserves map[string]*observeRefresh
+	// true if ObservePinInBackground was set when the app went into the background, in which case pinned has the
+	// conns with observations, which are kept open
+	pinObserves bool
+	pinned      map[*client.ClientConn]bool
+	// the local address to send from, set by MigrateTo. nil lets the OS pick the interface.
+	localAddr *net.UDPAddr
+	// conns which were replaced by MigrateTo, which are closed when their in-flight requests finish
+	draining map[*client.ClientConn]bool
+	// host -> the connection being made to it, which other requests to the host wait for
+	dialing map[string]*pendingDial
+}
+
+// pendingDial is a connection being made, without holding dtlsClients.mu so a slow handshake to one host does not
+// hold up requests to others. done is closed once conn or err is set.
+type pendingDial struct {
+	done chan struct{}
+	conn *client.ClientConn
+	err  error
+}
+
+// dtlsCipherSuites maps cipher suite names to IDs for all suites supported by the DTLS library
+var dtlsCipherSuites = func() map[string]piondtls.CipherSuiteID {
+	suites := make(map[string]piondtls.CipherSuiteID)
+	for _, id := range []piondtls.CipherSuiteID{
+		piondtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM,
+		piondtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8,
+		piondtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		piondtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		piondtls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		piondtls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		piondtls.TLS_PSK_WITH_AES_128_CCM,
+		piondtls.TLS_PSK_WITH_AES_128_CCM_8,
+		piondtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+		piondtls.TLS_PSK_WITH_AES_128_CBC_SHA256,
+	} {
+		suites[piondtls.CipherSuiteName(id)] = id
+	}
+	return suites
+}()
+
+// dtlsRootCAs are the CAs trusted to sign the homeserver's certificate. If nil, the system roots are used.
+// Tests set this to trust their own CA.
+var dtlsRootCAs *x509.CertPool
+
+// newDTLSConfig makes a DTLS config from the connection params, returning an error if the params are invalid.
+func newDTLSConfig(cp *ConnectionParams) (*piondtls.Config, error) {
+	switch cp.DTLSMinVersion {
+	case "", "1.2":
+	default:
+		return nil, fmt.Errorf("unsupported DTLSMinVersion '%s': only 1.2 is supported", cp.DTLSMinVersion)
+	}
+	var cipherSuites []piondtls.CipherSuiteID
+	if cp.DTLSCipherSuites != "" {
+		for _, name := range strings.Split(cp.DTLSCipherSuites, ",") {
+			id, ok := dtlsCipherSuites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown DTLS cipher suite '%s'", strings.TrimSpace(name))
+			}
+			cipherSuites = append(cipherSuites, id)
+		}
+	}
+	if cp.HandshakeTimeoutSecs < 0 {
+		return nil, fmt.Errorf("HandshakeTimeoutSecs: must not be negative, got %d", cp.HandshakeTimeoutSecs)
+	}
+	handshakeTimeout := time.Duration(cp.HandshakeTimeoutSecs) * time.Second
+	return &piondtls.Config{
+		InsecureSkipVerify: cp.InsecureSkipVerify,
+		ServerName:         cp.ServerName,
+		RootCAs:            dtlsRootCAs,
+		FlightInterval:     time.Duration(cp.FlightIntervalSecs) * time.Second,
+		CipherSuites:       cipherSuites,
+		SessionStore:       dtlsSessions,
+		// handshake messages are fragmented to fit
+		MTU: dtlsMTU(cp),
+		ConnectContextMaker: func() (context.Context, func()) {
+			if handshakeTimeout == 0 {
+				return context.WithCancel(context.Background())
+			}
+			return context.WithTimeout(context.Background(), handshakeTimeout)
+		},
+	}, nil
 }
 
 func newDTLSClients() *dtlsClients {
-	dtlsConfig := &piondtls.Config{
-		InsecureSkipVerify: activeConnectionParams.InsecureSkipVerify,
-		FlightInterval:     time.Duration(activeConnectionParams.FlightIntervalSecs) * time.Second,
+	dtlsConfig, err := newDTLSConfig(params())
+	if err != nil {
+		// this should never happen as the default params are static
+		panic("failed to create dtls config: " + err.Error())
 	}
 	return &dtlsClients{
-		dtlsConfig: dtlsConfig,
-		conns:      make(map[string]*client.ClientConn),
+		dtlsConfig:        dtlsConfig,
+		conns:             make(map[string]*client.ClientConn),
+		inFlight:          make(map[*client.ClientConn]int),
+		links:             make(map[string]*linkEstimator),
+		backgroundHosts:   make(map[string]bool),
+		suspendedObserves: make(map[string]*observeRefresh),
+		pinned:            make(map[*client.ClientConn]bool),
+		draining:          make(map[*client.ClientConn]bool),
+		dialing:           make(map[string]*pendingDial),
+	}
+}
+
+// linkFor returns the measurements of the link to host, creating them if this is a new host
+func (c *dtlsClients) linkFor(host string) *linkEstimator {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.linkForLocked(host)
+}
+
+func (c *dtlsClients) linkForLocked(host string) *linkEstimator {
+	link, ok := c.links[host]
+	if !ok {
+		link = &linkEstimator{}
+		c.links[host] = link
 	}
+	return link
 }
 
-func (c *dtlsClients) closeAllConns() {
+// setParams stores the params and DTLS config to use for new connections, then closes all existing connections.
+func (c *dtlsClients) setParams(cp *ConnectionParams, dtlsConfig *piondtls.Config) {
 	var conns []*client.ClientConn
 	c.mu.Lock()
 	for _, con := range c.conns {
 		conns = append(conns, con)
 	}
+	// forget the old connections now rather than when they finish closing, so new requests make new connections
+	c.conns = make(map[string]*client.ClientConn)
+	// refresh the params and dtls config together, so new connections always see both
+	activeParams.Store(cp)
+	c.dtlsConfig = dtlsConfig
 	c.mu.Unlock()
 	for _, con := range conns {
-		con.Close()
-	}
-	// refresh the dtls config
-	c.dtlsConfig = &piondtls.Config{
-		InsecureSkipVerify: activeConnectionParams.InsecureSkipVerify,
-		FlightInterval:     time.Duration(activeConnectionParams.FlightIntervalSecs) * time.Second,
+		closeConn(con, ObserveEndedReconnect)
 	}
 }
 
@@ -371,14 +1754,81 @@ func (c *dtlsClients) isConnClosed(host string) bool {
 
 func (c *dtlsClients) getClientForHost(host string) (*client.ClientConn, error) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	co, ok := c.conns[host]
 	if ok {
+		c.mu.Unlock()
+		return co, nil
+	}
+	if d, ok := c.dialing[host]; ok {
+		c.mu.Unlock()
+		<-d.done
+		return d.conn, d.err
+	}
+	d := &pendingDial{done: make(chan struct{})}
+	c.dialing[host] = d
+	for {
+		dtlsConfig, localAddr, link := c.dtlsConfig, c.localAddr, c.linkForLocked(host)
+		c.mu.Unlock()
+		co, err := dialHost(host, dtlsConfig, localAddr, link)
+		c.mu.Lock()
+		if err == nil && (c.dtlsConfig != dtlsConfig || c.localAddr != localAddr) {
+			// SetParams or MigrateTo changed how to connect during the handshake
+			c.mu.Unlock()
+			logrus.Infof("Connection params changed while connecting to host %s, connecting again", host)
+			co.Close()
+			c.mu.Lock()
+			continue
+		}
+		delete(c.dialing, host)
+		if err == nil {
+			c.conns[host] = co
+			// delete the entry when the connection is closed so we'll make a new one
+			co.AddOnClose(func() {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				// the entry may already have been replaced with a new connection by setParams
+				if c.conns[host] == co {
+					delete(c.conns, host)
+				}
+				logrus.Infof("Removed dead connection for host %s", host)
+			})
+		}
+		d.conn, d.err = co, err
+		c.mu.Unlock()
+		close(d.done)
+		if err != nil {
+			return nil, err
+		}
+		// we may have just come back online, so send anything which was queued while offline
+		go flushOutbox()
 		return co, nil
 	}
-	co, err := dtls.Dial(
-		host, c.dtlsConfig, dtls.WithHeartBeat(time.Duration(activeConnectionParams.HeartbeatTimeoutSecs)*time.Second),
-		dtls.WithKeepAlive(uint32(activeConnectionParams.KeepAliveMaxRetries), time.Duration(activeConnectionParams.KeepAliveTimeoutSecs)*time.Second, func(cc interface {
+}
+
+// dialHost makes a connection to host, sending from localAddr if it is set
+func dialHost(host string, dtlsConfig *piondtls.Config, localAddr *net.UDPAddr, link *linkEstimator) (*client.ClientConn, error) {
+	cp := params()
+	szx := blockwiseSZX
+	ackTimeout := time.Duration(cp.TransmissionACKTimeoutSecs) * time.Second
+	if cp.AdaptiveTransmission {
+		szx = link.blockSZX(cp)
+		ackTimeout = link.ackTimeout(cp)
+	}
+	szx = fitPathMTU(cp, szx)
+	// the same timeout as the library's default dialer
+	dialer := &net.Dialer{Timeout: 3 * time.Second}
+	if localAddr != nil {
+		dialer.LocalAddr = localAddr
+	}
+	counter := newRoundTripCounter()
+	budget := newRetransmitBudget(cp.MaxConnectionRetransmits)
+	// the handshake cannot be cancelled while it waits, but the ones holding slots time out
+	handshakes.acquire(context.Background(), cp.MaxConcurrentHandshakes)
+	defer handshakes.release(params().MaxConcurrentHandshakes)
+	start := time.Now()
+	co, err := dialDTLS(
+		host, dtlsConfig, dialer, counter, budget, dtls.WithHeartBeat(time.Duration(cp.HeartbeatTimeoutSecs)*time.Second),
+		dtls.WithKeepAlive(uint32(cp.KeepAliveMaxRetries), time.Duration(cp.KeepAliveTimeoutSecs)*time.Second, func(cc interface {
 			Close() error
 			Context() context.Context
 		}) {
@@ -386,29 +1836,40 @@ func (c *dtlsClients) getClientForHost(host string) (*client.ClientConn, error)
 		}),
 		dtls.WithTransmission(
 			// FIXME? https://github.com/plgd-dev/go-coap/issues/226
-			time.Duration(activeConnectionParams.TransmissionNStart)*time.Second,
-			time.Duration(activeConnectionParams.TransmissionACKTimeoutSecs)*time.Second,
-			activeConnectionParams.TransmissionMaxRetransmits,
+			time.Duration(cp.TransmissionNStart)*time.Second,
+			ackTimeout,
+			cp.TransmissionMaxRetransmits,
 		),
 		// long blockwise timeout to handle large sync responses which take a huge number of blocks
-		dtls.WithBlockwise(true, blockwise.SZX1024, 2*time.Minute),
-		dtls.WithLogger(&logger{}),
+		dtls.WithBlockwise(true, szx, 2*time.Minute),
+		dtls.WithLogger(&logger{budget: budget}),
 	)
-	if err == nil {
-		c.conns[host] = co
-		// delete the entry when the connection is closed so we'll make a new one
-		co.AddOnClose(func() {
-			c.mu.Lock()
-			defer c.mu.Unlock()
-			delete(c.conns, host)
-			logrus.Infof("Removed dead connection for host %s", host)
-		})
+	if err != nil {
+		if isTimeout(err) {
+			recordHandshakeTimeout()
+			return nil, lb.NewError(lb.ErrHandshake, fmt.Errorf("%w: DTLS handshake with %s did not complete within %ds: %s",
+				ErrHandshakeTimeout, host, cp.HandshakeTimeoutSecs, err))
+		}
+		return nil, lb.NewError(lb.ErrHandshake, fmt.Errorf("DTLS handshake with %s failed: %w", host, err))
 	}
-	return co, err
+	co.SetContextValue(ctxValHandshakeTiming, &handshakeTiming{millis: millis(time.Since(start))})
+	co.SetContextValue(ctxValLinkEstimator, link)
+	co.SetContextValue(ctxValBlockwiseSZX, szx)
+	co.SetContextValue(ctxValTokenRefs, newTokenRefs())
+	co.SetContextValue(ctxValRoundTripCounter, counter)
+	co.SetContextValue(ctxValRetransmitBudget, budget)
+	budget.setConn(co)
+	return co, nil
 }
 
-type logger struct{}
+// logger logs the CoAP library's messages, counting the retransmissions it logs against the budget of the connection
+type logger struct {
+	budget *retransmitBudget
+}
 
 func (l *logger) Printf(format string, v ...interface{}) {
+	if l.budget != nil && strings.Contains(format, retransmitLogMessage) {
+		l.budget.retransmitted()
+	}
 	logrus.Infof(format+"\n", v...)
 }
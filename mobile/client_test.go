@@ -0,0 +1,1757 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	coapnet "github.com/matrix-org/go-coap/v2/net"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+	"github.com/matrix-org/lb"
+	piondtls "github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+)
+
+// newTestServer runs a DTLS CoAP server which serves the JSON handler given, in the same way as cmd/proxy.
+// Returns the https:// base URL to use with SendRequest. Connection params are reset when the test ends.
+func newTestServer(t *testing.T, next http.Handler) string {
+	t.Helper()
+	return newTestServerWithCoAPHTTP(t, lb.NewCoAPHTTP(lb.NewCoAPPathV1()), next)
+}
+
+// newTestServerWithCoAPHTTP is newTestServer with a custom CoAP to HTTP mapping
+func newTestServerWithCoAPHTTP(t *testing.T, coapHTTP *lb.CoAPHTTP, next http.Handler) string {
+	t.Helper()
+	return newCBORTestServer(t, "127.0.0.1:0", coapHTTP, lb.CBORToJSONHandler(next, lb.NewCBORCodecV1(false), nil))
+}
+
+// newCBORTestServer is newTestServer listening on addr, with a handler which serves CBOR rather than JSON
+func newCBORTestServer(t *testing.T, addr string, coapHTTP *lb.CoAPHTTP, handler http.Handler) string {
+	t.Helper()
+	codec := lb.NewCBORCodecV1(false)
+	observations := lb.NewSyncObservations(handler, coapHTTP.Paths, codec)
+	return newCoAPTestServer(t, addr, coapHTTP.CoAPHTTPHandler(lb.BatchHandler(handler, codec), observations))
+}
+
+// newCoAPTestServer is newTestServer listening on addr, with a CoAP handler rather than an HTTP handler and
+// optional server options
+func newCoAPTestServer(t *testing.T, addr string, handler coapmux.Handler, opts ...dtls.ServerOption) string {
+	t.Helper()
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %s", err)
+	}
+	return newCoAPTestServerWithCert(t, addr, cert, handler, opts...)
+}
+
+// newCoAPTestServerWithCert is newCoAPTestServer using the certificate given rather than a self-signed one
+func newCoAPTestServerWithCert(t *testing.T, addr string, cert tls.Certificate, handler coapmux.Handler, opts ...dtls.ServerOption) string {
+	t.Helper()
+	return newCoAPTestServerWithConfig(t, addr, &piondtls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, handler, opts...)
+}
+
+// newCoAPTestServerWithConfig is newCoAPTestServer using the DTLS config given
+func newCoAPTestServerWithConfig(t *testing.T, addr string, dtlsConfig *piondtls.Config, handler coapmux.Handler, opts ...dtls.ServerOption) string {
+	t.Helper()
+	l, err := coapnet.NewDTLSListener("udp", addr, dtlsConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	s := dtls.NewServer(append([]dtls.ServerOption{dtls.WithMux(handler)}, opts...)...)
+	go s.Serve(l)
+
+	defaultParams := *Params()
+	cp := defaultParams
+	cp.InsecureSkipVerify = true
+	if err := SetParams(&cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	t.Cleanup(func() {
+		SetParams(&defaultParams)
+		s.Stop()
+		l.Close()
+		syncListenersMu.Lock()
+		delete(syncListeners, l.Addr().String())
+		syncListenersMu.Unlock()
+	})
+	return "https://" + l.Addr().String()
+}
+
+func TestSendNonConfirmable(t *testing.T) {
+	received := make(chan string, 1)
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the client must not wait for this to return
+		time.Sleep(2 * time.Second)
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- req.Method + " " + req.URL.Path + " " + req.Header.Get("Authorization") + " " + string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	}))
+	// make the connection first so the handshake isn't included in the timing
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil {
+		t.Fatalf("SendRequest returned nil")
+	}
+	<-received
+
+	start := time.Now()
+	ok := SendNonConfirmable("PUT", hsURL+"/_matrix/client/r0/rooms/!foo:bar/typing/@alice:bar", "secret", `{"typing":true}`)
+	if !ok {
+		t.Fatalf("SendNonConfirmable returned false")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("SendNonConfirmable waited for a response, took %v", took)
+	}
+	select {
+	case got := <-received:
+		want := `PUT /_matrix/client/r0/rooms/!foo:bar/typing/@alice:bar Bearer secret {"typing":true}`
+		if got != want {
+			t.Errorf("server got wrong request:\ngot  %s\nwant %s", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server never received the non-confirmable request")
+	}
+}
+
+// TestSendRequestUnauthenticated checks that requests without an access token are forwarded without one, even
+// after an access token has been sent on the same connection.
+func TestSendRequestUnauthenticated(t *testing.T) {
+	authHeaders := make(chan string, 10)
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authHeaders <- req.URL.Path + " " + req.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"versions":["r0.6.1"]}`))
+	}))
+	testCases := []struct {
+		path  string
+		token string
+		want  string
+	}{
+		{path: "/_matrix/client/versions", want: "/_matrix/client/versions "},
+		{path: "/_matrix/client/r0/account/whoami", token: "secret", want: "/_matrix/client/r0/account/whoami Bearer secret"},
+		{path: "/_matrix/client/versions", want: "/_matrix/client/versions "},
+		// the server remembers the token, so it isn't sent again
+		{path: "/_matrix/client/r0/account/whoami", token: "secret", want: "/_matrix/client/r0/account/whoami Bearer secret"},
+	}
+	for _, tc := range testCases {
+		res := SendRequest("GET", hsURL+tc.path, tc.token, "")
+		if res == nil {
+			t.Fatalf("%s: SendRequest returned nil", tc.path)
+		}
+		if res.Code != 200 {
+			t.Errorf("%s: got code %d want 200", tc.path, res.Code)
+		}
+		select {
+		case got := <-authHeaders:
+			if got != tc.want {
+				t.Errorf("server got %q want %q", got, tc.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: server never received the request", tc.path)
+		}
+	}
+}
+
+// TestConnectHandshakeTimeout checks that a handshake which never completes fails after HandshakeTimeoutSecs,
+// regardless of the request timeouts.
+func TestConnectHandshakeTimeout(t *testing.T) {
+	// a server which reads handshake packets but never replies
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	defaultParams := *Params()
+	t.Cleanup(func() { SetParams(&defaultParams) })
+	cp := defaultParams
+	cp.HandshakeTimeoutSecs = 1
+	cp.TransmissionACKTimeoutSecs = 60
+	if err = SetParams(&cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	before := CurrentStats()
+	start := time.Now()
+	err = Connect("https://" + conn.LocalAddr().String())
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("Connect returned %v, want %v", err, ErrHandshakeTimeout)
+	}
+	if !errors.Is(err, lb.ErrHandshake) || !errors.Is(err, lb.ErrTimeout) {
+		t.Errorf("Connect returned %v, want it to match %v and %v", err, lb.ErrHandshake, lb.ErrTimeout)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Connect took %v, want about 1s", took)
+	}
+	if got := CurrentStats().HandshakeTimeouts - before.HandshakeTimeouts; got != 1 {
+		t.Errorf("HandshakeTimeouts increased by %d, want 1", got)
+	}
+}
+
+// TestSetParamsHandshakeTimeout checks that a negative HandshakeTimeoutSecs is rejected, and that 0 connects without a
+// timeout rather than timing out straight away
+func TestSetParamsHandshakeTimeout(t *testing.T) {
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		w.SetResponse(codes.Content, message.AppCBOR, nil)
+	}))
+	cp := Params()
+	cp.HandshakeTimeoutSecs = -1
+	if err := SetParams(cp); err == nil || !strings.Contains(err.Error(), "HandshakeTimeoutSecs") {
+		t.Errorf("SetParams with HandshakeTimeoutSecs -1: got %v want an error", err)
+	}
+	if Params().HandshakeTimeoutSecs != defaultConnectionParams.HandshakeTimeoutSecs {
+		t.Errorf("SetParams changed HandshakeTimeoutSecs to %d despite the error", Params().HandshakeTimeoutSecs)
+	}
+	cp.HandshakeTimeoutSecs = 0
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams with HandshakeTimeoutSecs 0: %s", err)
+	}
+	before := CurrentStats()
+	if err := Connect(hsURL); err != nil {
+		t.Errorf("Connect without a handshake timeout: %s", err)
+	}
+	if got := CurrentStats().HandshakeTimeouts - before.HandshakeTimeouts; got != 0 {
+		t.Errorf("HandshakeTimeouts increased by %d, want 0", got)
+	}
+}
+
+// TestSetParamsDTLS checks that DTLSMinVersion and DTLSCipherSuites are validated, and that a rejected value keeps
+// the current params
+func TestSetParamsDTLS(t *testing.T) {
+	defaultParams := *Params()
+	defer SetParams(&defaultParams)
+	testCases := []struct {
+		name         string
+		minVersion   string
+		cipherSuites string
+		wantErr      string
+		wantSuites   []piondtls.CipherSuiteID
+	}{
+		{name: "defaults"},
+		{name: "DTLS 1.2", minVersion: "1.2"},
+		{name: "DTLS 1.0", minVersion: "1.0", wantErr: "unsupported DTLSMinVersion '1.0'"},
+		{name: "DTLS 1.3", minVersion: "1.3", wantErr: "unsupported DTLSMinVersion '1.3'"},
+		{
+			name:         "constrained device suite",
+			cipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8",
+			wantSuites:   []piondtls.CipherSuiteID{piondtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8},
+		},
+		{
+			name:         "suites in order of preference with spaces",
+			minVersion:   "1.2",
+			cipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8",
+			wantSuites: []piondtls.CipherSuiteID{
+				piondtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, piondtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8,
+			},
+		},
+		{
+			name:         "unknown suite",
+			cipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8,TLS_RSA_WITH_RC4_128_MD5",
+			wantErr:      "unknown DTLS cipher suite 'TLS_RSA_WITH_RC4_128_MD5'",
+		},
+		{name: "empty suite name", cipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8,", wantErr: "unknown DTLS cipher suite ''"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := SetParams(&defaultParams); err != nil {
+				t.Fatalf("SetParams with the default params: %s", err)
+			}
+			cp := defaultParams
+			cp.DTLSMinVersion = tc.minVersion
+			cp.DTLSCipherSuites = tc.cipherSuites
+			err := SetParams(&cp)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("SetParams: got error %v want %q", err, tc.wantErr)
+				}
+				if got := Params(); got.DTLSMinVersion != defaultParams.DTLSMinVersion || got.DTLSCipherSuites != defaultParams.DTLSCipherSuites {
+					t.Errorf("SetParams changed the params to %q %q despite the error", got.DTLSMinVersion, got.DTLSCipherSuites)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SetParams: %s", err)
+			}
+			cfg, err := newDTLSConfig(Params())
+			if err != nil {
+				t.Fatalf("newDTLSConfig: %s", err)
+			}
+			if !reflect.DeepEqual(cfg.CipherSuites, tc.wantSuites) {
+				t.Errorf("cipher suites: got %v want %v", cfg.CipherSuites, tc.wantSuites)
+			}
+		})
+	}
+}
+
+// newTestCA makes a CA and a certificate for dnsName signed by it
+func newTestCA(t *testing.T, dnsName string) (*x509.CertPool, tls.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %s", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %s", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %s", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return roots, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestConnectServerName(t *testing.T) {
+	roots, cert := newTestCA(t, "hs.example.com")
+	oldRoots := dtlsRootCAs
+	dtlsRootCAs = roots
+	t.Cleanup(func() { dtlsRootCAs = oldRoots })
+	// dialled by IP, which is not on the certificate
+	hsURL := newCoAPTestServerWithCert(t, "127.0.0.1:0", cert, coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		w.SetResponse(codes.Content, message.AppCBOR, nil)
+	}))
+
+	testCases := []struct {
+		serverName string
+		wantErr    bool
+	}{
+		{serverName: "", wantErr: true},
+		{serverName: "other.example.com", wantErr: true},
+		{serverName: "hs.example.com", wantErr: false},
+	}
+	for _, tc := range testCases {
+		cp := Params()
+		cp.InsecureSkipVerify = false
+		cp.ServerName = tc.serverName
+		if err := SetParams(cp); err != nil {
+			t.Fatalf("SetParams: %s", err)
+		}
+		err := Connect(hsURL)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("ServerName %q: Connect returned %v, want error %v", tc.serverName, err, tc.wantErr)
+		}
+	}
+
+	// dialled by hostname, which the certificate is checked against without a ServerName
+	cp := Params()
+	cp.InsecureSkipVerify = false
+	cp.ServerName = ""
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	if err := Connect(strings.Replace(hsURL, "127.0.0.1", "localhost", 1)); err == nil {
+		t.Errorf("Connect to localhost with a certificate for hs.example.com succeeded")
+	}
+	roots, cert = newTestCA(t, "localhost")
+	dtlsRootCAs = roots
+	localURL := newCoAPTestServerWithCert(t, "127.0.0.1:0", cert, coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		w.SetResponse(codes.Content, message.AppCBOR, nil)
+	}))
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	if err := Connect(strings.Replace(localURL, "127.0.0.1", "localhost", 1)); err != nil {
+		t.Errorf("Connect to localhost with a certificate for localhost returned %v", err)
+	}
+}
+
+// TestConnectSlowHandshake checks that a handshake to one host does not hold up requests to others, and that
+// requests to the host share the handshake.
+func TestConnectSlowHandshake(t *testing.T) {
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	}))
+	// a server which reads handshake packets but never replies
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	cp := Params()
+	cp.HandshakeTimeoutSecs = 2
+	if err = SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	before := CurrentStats()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- Connect("https://" + conn.LocalAddr().String())
+		}()
+	}
+	waitFor(t, "the handshake to start", func() bool {
+		dc.mu.Lock()
+		defer dc.mu.Unlock()
+		return dc.dialing[conn.LocalAddr().String()] != nil
+	})
+	start := time.Now()
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest: got %+v", res)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("SendRequest to another host took %v during the handshake", took)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; !errors.Is(err, ErrHandshakeTimeout) {
+			t.Errorf("Connect returned %v, want %v", err, ErrHandshakeTimeout)
+		}
+	}
+	if got := CurrentStats().HandshakeTimeouts - before.HandshakeTimeouts; got != 1 {
+		t.Errorf("HandshakeTimeouts increased by %d, want 1 as the handshake is shared", got)
+	}
+}
+
+// TestTransportErrors checks that errors sending requests match their cause with errors.Is
+func TestTransportErrors(t *testing.T) {
+	release := make(chan struct{})
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	}))
+	defer close(release)
+	u, _ := url.Parse(hsURL)
+	conn, err := dc.getClientForHost(u.Host)
+	if err != nil {
+		t.Fatalf("getClientForHost: %s", err)
+	}
+	send := func(ctx context.Context) error {
+		msg, err := client.NewGetRequest(ctx, "/_matrix/client/versions")
+		if err != nil {
+			t.Fatalf("NewGetRequest: %s", err)
+		}
+		defer pool.ReleaseMessage(msg)
+		_, err = do(conn, msg, &Timings{}, newRoundTripLimit(0))
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := send(ctx); !errors.Is(err, lb.ErrTimeout) || errors.Is(err, lb.ErrReset) {
+		t.Errorf("request which timed out: got %v want %v", err, lb.ErrTimeout)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		conn.Close()
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := send(ctx); !errors.Is(err, lb.ErrReset) {
+		t.Errorf("request on a closed connection: got %v want %v", err, lb.ErrReset)
+	}
+
+	if !errors.Is(ErrTooManyRoundTrips, lb.ErrTooLarge) {
+		t.Errorf("%v does not match %v", ErrTooManyRoundTrips, lb.ErrTooLarge)
+	}
+	if _, _, err := decodeResponseBody(cborCodec, strings.NewReader("\xa2\x01")); !errors.Is(err, lb.ErrCBORDecode) {
+		t.Errorf("decodeResponseBody: got %v want %v", err, lb.ErrCBORDecode)
+	}
+}
+
+// TestSendConditionalRequestRendezvous runs the poll and update cycle of two devices logging in over an MSC4108
+// rendezvous session, which relies on ETags to stop the devices overwriting each other's messages.
+// TestSendRequestNoDictionary checks the bodies on the wire are plain CBOR when the dictionary is turned off
+func TestSendRequestNoDictionary(t *testing.T) {
+	reqJSON := `{"body":"hello","msgtype":"m.text"}`
+	resJSON := `{"event_id":"$abc:localhost"}`
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if body, _ := ioutil.ReadAll(req.Body); string(body) != reqJSON {
+			t.Errorf("homeserver got body %s want %s", body, reqJSON)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(resJSON))
+	})
+	cborHandler := lb.CBORToJSONHandler(next, lb.NewCBORCodecV1(false), nil)
+	type wireBody struct {
+		contentType string
+		body        []byte
+	}
+	var mu sync.Mutex
+	var gotReq, gotRes wireBody
+	// records the CBOR either side of the conversion to JSON
+	wire := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		reqContentType := req.Header.Get("Content-Type")
+		rec := httptest.NewRecorder()
+		cborHandler.ServeHTTP(rec, req)
+		mu.Lock()
+		gotReq = wireBody{reqContentType, body}
+		gotRes = wireBody{rec.Header().Get("Content-Type"), rec.Body.Bytes()}
+		mu.Unlock()
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	})
+	hsURL := newCBORTestServer(t, "127.0.0.1:0", lb.NewCoAPHTTP(lb.NewCoAPPathV1()), wire)
+	// plain CBOR has the keys as strings, and CBOR with the dictionary has them as integers
+	checkWire := func(t *testing.T, name string, got wireBody, wantContentType, wantJSON, key string, plain bool) {
+		t.Helper()
+		if got.contentType != wantContentType {
+			t.Errorf("%s: got Content-Type %s want %s", name, got.contentType, wantContentType)
+		}
+		if j, err := plainCBORCodec.CBORToJSON(bytes.NewReader(got.body)); plain && (err != nil || string(j) != wantJSON) {
+			t.Errorf("%s: got %x which is %s, %v as plain CBOR want %s", name, got.body, j, err, wantJSON)
+		}
+		if bytes.Contains(got.body, []byte(key)) != plain {
+			t.Errorf("%s: got %x, want key %s as a string: %v", name, got.body, key, plain)
+		}
+	}
+
+	testCases := []struct {
+		name         string
+		noDictionary bool
+		contentType  string
+		dictionary   string
+	}{
+		{name: "dictionary", contentType: "application/cbor", dictionary: lb.DictionaryV1},
+		{name: "no dictionary", noDictionary: true, contentType: lb.ContentTypePlainCBOR, dictionary: "none"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := SendRequestWithOptions("PUT", hsURL+"/_matrix/client/r0/rooms/!a:b/send/m.room.message/1", "", reqJSON,
+				&SendOptions{NoDictionary: tc.noDictionary})
+			if res == nil || res.Code != 200 || res.Body != resJSON {
+				t.Fatalf("SendRequestWithOptions: got %+v", res)
+			}
+			if res.Dictionary != tc.dictionary {
+				t.Errorf("got response Dictionary %q want %q", res.Dictionary, tc.dictionary)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			checkWire(t, "request", gotReq, tc.contentType, reqJSON, "msgtype", tc.noDictionary)
+			checkWire(t, "response", gotRes, tc.contentType, resJSON, "event_id", tc.noDictionary)
+		})
+	}
+}
+
+func TestSendRequestDictionaryV2(t *testing.T) {
+	reqJSON := `{"algorithm":"m.megolm.v1.aes-sha2","ciphertext":"AwgAEnAC","device_id":"ABCDEF","sender_key":"abc","session_id":"xyz"}`
+	resJSON := `{"errcode":"M_FORBIDDEN","error":"You are not allowed to send to this room"}`
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if body, _ := ioutil.ReadAll(req.Body); string(body) != reqJSON {
+			t.Errorf("homeserver got body %s want %s", body, reqJSON)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(403)
+		w.Write([]byte(resJSON))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	cborHandler := lb.CBORToJSONHandler(next, codec, nil)
+	var mu sync.Mutex
+	var gotReqType, gotResType string
+	var gotReq []byte
+	testCases := []struct {
+		name         string
+		versions     []string
+		dictionaryV2 bool
+		contentType  string
+		// the dictionary the response reports it was encoded with
+		dictionary string
+	}{
+		{name: "v1 server", versions: nil, dictionaryV2: true, contentType: "application/cbor", dictionary: lb.DictionaryV1},
+		{name: "v2 is not requested", versions: lb.DictionaryVersions, contentType: "application/cbor", dictionary: lb.DictionaryV1},
+		{name: "v2 server", versions: lb.DictionaryVersions, dictionaryV2: true, contentType: lb.ContentTypeCBORV2, dictionary: lb.DictionaryV2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// records the Content-Type either side of the conversion to JSON
+			wire := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				req.Body = ioutil.NopCloser(bytes.NewReader(body))
+				reqContentType := req.Header.Get("Content-Type")
+				rec := httptest.NewRecorder()
+				cborHandler.ServeHTTP(rec, req)
+				mu.Lock()
+				gotReqType, gotResType, gotReq = reqContentType, rec.Header().Get("Content-Type"), body
+				mu.Unlock()
+				for k, v := range rec.Header() {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(rec.Code)
+				w.Write(rec.Body.Bytes())
+			})
+			hsURL := newCBORTestServer(t, "127.0.0.1:0", lb.NewCoAPHTTP(lb.NewCoAPPathV2()), lb.CapabilitiesHandler(wire, codec, lb.Capabilities{
+				BlockSize:          1024,
+				DictionaryVersion:  lb.DictionaryV1,
+				DictionaryVersions: tc.versions,
+			}))
+			cp := Params()
+			cp.DictionaryV2 = tc.dictionaryV2
+			if err := SetParams(cp); err != nil {
+				t.Fatalf("SetParams: %s", err)
+			}
+			res := SendRequest("PUT", hsURL+"/_matrix/client/r0/rooms/!a:b/send/m.room.encrypted/1", "", reqJSON)
+			if res == nil || res.Code != 403 || res.Body != resJSON {
+				t.Fatalf("SendRequest: got %+v", res)
+			}
+			if res.Dictionary != tc.dictionary {
+				t.Errorf("got response Dictionary %q want %q", res.Dictionary, tc.dictionary)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if gotReqType != tc.contentType || gotResType != tc.contentType {
+				t.Errorf("got request Content-Type %s and response Content-Type %s, want %s", gotReqType, gotResType, tc.contentType)
+			}
+			if j, err := responseCodec(tc.contentType).CBORToJSON(bytes.NewReader(gotReq)); err != nil || string(j) != reqJSON {
+				t.Errorf("got request body %x which is %s, %v want %s", gotReq, j, err, reqJSON)
+			}
+		})
+	}
+}
+
+func TestSendConditionalRequestRendezvous(t *testing.T) {
+	const sessionPath = "/_matrix/client/unstable/org.matrix.msc4108/rendezvous/abc"
+	var mu sync.Mutex
+	var session string
+	version := 0
+	// longer than a CoAP ETag can be, as homeservers make them from timestamps and random strings
+	etag := func() string { return fmt.Sprintf(`"1626267853969-%d-aBcDeFgHiJkLmNoP"`, version) }
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(req.Body)
+		switch {
+		case req.Method == "POST" && req.URL.Path == "/_matrix/client/unstable/org.matrix.msc4108/rendezvous":
+			session = string(body)
+			version++
+			w.Header().Set("ETag", etag())
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(201)
+			w.Write([]byte(`{"url":"https://example.com` + sessionPath + `"}`))
+		case req.Method == "GET" && req.URL.Path == sessionPath:
+			w.Header().Set("ETag", etag())
+			if req.Header.Get("If-None-Match") == etag() {
+				w.WriteHeader(304)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			w.Write([]byte(session))
+		case req.Method == "PUT" && req.URL.Path == sessionPath:
+			if req.Header.Get("If-Match") != etag() {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(412)
+				w.Write([]byte(`{"errcode":"M_CONCURRENT_WRITE","error":"Session has been modified"}`))
+				return
+			}
+			session = string(body)
+			version++
+			w.Header().Set("ETag", etag())
+			w.WriteHeader(202)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	protocols := `{"homeserver":"https://example.com","protocols":["device_authorization_grant"],"type":"m.login.protocols"}`
+	protocol := `{"device_authorization_grant":{"verification_uri":"https://id.example.com/device"},"protocol":"device_authorization_grant","type":"m.login.protocol"}`
+
+	// the new device creates the session
+	created := SendRequest("POST", hsURL+"/_matrix/client/unstable/org.matrix.msc4108/rendezvous", "", protocols)
+	if created == nil || created.Code != 201 || created.ETag == "" {
+		t.Fatalf("create session: got %+v want HTTP 201 with an ETag", created)
+	}
+	// the existing device reads it from the QR code, then polls without anything changing
+	res := SendConditionalRequest("GET", hsURL+sessionPath, "", "", "", "")
+	if res == nil || res.Code != 200 || res.Body != protocols || res.ETag != created.ETag {
+		t.Fatalf("read session: got %+v want HTTP 200 %s with ETag %s", res, protocols, created.ETag)
+	}
+	res = SendConditionalRequest("GET", hsURL+sessionPath, "", "", "", created.ETag)
+	if res == nil || res.Code != 304 || res.Body != "" {
+		t.Fatalf("poll unchanged session: got %+v want HTTP 304", res)
+	}
+	// the existing device replies. The 202 is sent over CoAP as 2.04 Changed, which comes back as a 200.
+	updated := SendConditionalRequest("PUT", hsURL+sessionPath, "", protocol, created.ETag, "")
+	if updated == nil || updated.Code != 200 || updated.ETag == "" || updated.ETag == created.ETag {
+		t.Fatalf("update session: got %+v want HTTP 200 with a new ETag", updated)
+	}
+	// the new device's update with the old ETag must not overwrite the reply
+	res = SendConditionalRequest("PUT", hsURL+sessionPath, "", protocols, created.ETag, "")
+	if res == nil || res.Code != 412 || !strings.Contains(res.Body, "M_CONCURRENT_WRITE") {
+		t.Fatalf("update with a stale ETag: got %+v want HTTP 412 M_CONCURRENT_WRITE", res)
+	}
+	// the new device polls and sees the reply
+	res = SendConditionalRequest("GET", hsURL+sessionPath, "", "", "", created.ETag)
+	if res == nil || res.Code != 200 || res.Body != protocol || res.ETag != updated.ETag {
+		t.Fatalf("poll changed session: got %+v want HTTP 200 %s with ETag %s", res, protocol, updated.ETag)
+	}
+	res = SendConditionalRequest("PUT", hsURL+sessionPath, "", `{"type":"m.login.success"}`, updated.ETag, "")
+	if res == nil || res.Code != 200 {
+		t.Fatalf("update session: got %+v want HTTP 200", res)
+	}
+}
+
+func TestSendRequestTimings(t *testing.T) {
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"user_id":"@alice:localhost"}`))
+	}))
+	for i, wantHandshake := range []bool{true, false} {
+		res := SendRequest("GET", hsURL+"/_matrix/client/r0/account/whoami", "secret", "")
+		if res == nil || res.Timings == nil {
+			t.Fatalf("request %d: SendRequest returned no timings: %+v", i, res)
+		}
+		// only the first request on the connection includes the handshake
+		if gotHandshake := res.Timings.HandshakeMillis > 0; gotHandshake != wantHandshake {
+			t.Errorf("request %d: got HandshakeMillis %v, want handshake %v", i, res.Timings.HandshakeMillis, wantHandshake)
+		}
+		if res.Timings.ExchangeMillis <= 0 {
+			t.Errorf("request %d: got ExchangeMillis %v, want > 0", i, res.Timings.ExchangeMillis)
+		}
+		// the response fits in a single block
+		if res.Timings.BlockwiseMillis != 0 {
+			t.Errorf("request %d: got BlockwiseMillis %v, want 0", i, res.Timings.BlockwiseMillis)
+		}
+	}
+}
+
+func TestSendRequestJSONFallback(t *testing.T) {
+	// a Content-Type other than application/json means the body is sent as-is, like a misconfigured proxy
+	respBodies := map[string]string{
+		"/_matrix/client/r0/joined_rooms":   `{"joined_rooms":["!foo:bar","!this-is-long-enough-to-be-a-cbor-string:bar"]}`,
+		"/_matrix/client/r0/account/whoami": `{"user_id":"@a:b"}`,
+		"/_matrix/client/r0/pushrules/":     "\x7b\x00garbage",
+	}
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(200)
+		w.Write([]byte(respBodies[req.URL.Path]))
+	}))
+	before := CurrentStats()
+	for _, path := range []string{"/_matrix/client/r0/joined_rooms", "/_matrix/client/r0/account/whoami"} {
+		res := SendRequest("GET", hsURL+path, "", "")
+		if res == nil {
+			t.Fatalf("%s: SendRequest returned nil", path)
+		}
+		if res.Body != respBodies[path] {
+			t.Errorf("%s: got body %s want %s", path, res.Body, respBodies[path])
+		}
+	}
+	if res := SendRequest("GET", hsURL+"/_matrix/client/r0/pushrules/", "", ""); res != nil {
+		t.Errorf("SendRequest with a garbage response returned %+v, want nil", res)
+	}
+	if got := CurrentStats().CBORDecodeFallbacks - before.CBORDecodeFallbacks; got != 2 {
+		t.Errorf("CBORDecodeFallbacks: got %d want 2", got)
+	}
+}
+
+func TestSendRequestStrictContentFormat(t *testing.T) {
+	const body = `{"user_id":"@a:b"}`
+	contentTypes := map[string]string{
+		"/_matrix/client/r0/account/whoami": "application/json", // converted to CBOR
+		"/_matrix/client/r0/joined_rooms":   "application/octet-stream",
+		"/_matrix/client/r0/pushrules/":     "text/plain",
+	}
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentTypes[req.URL.Path])
+		w.WriteHeader(200)
+		w.Write([]byte(body))
+	}))
+	testCases := []struct {
+		name         string
+		path         string
+		noDictionary bool
+		wantStrict   bool // true if the response is accepted in strict mode
+	}{
+		{name: "CBOR", path: "/_matrix/client/r0/account/whoami", wantStrict: true},
+		{name: "plain CBOR", path: "/_matrix/client/r0/account/whoami", noDictionary: true, wantStrict: true},
+		{name: "JSON as octets", path: "/_matrix/client/r0/joined_rooms"},
+		{name: "JSON as text", path: "/_matrix/client/r0/pushrules/"},
+	}
+	for _, strict := range []bool{false, true} {
+		cp := Params()
+		cp.StrictContentFormat = strict
+		if err := SetParams(cp); err != nil {
+			t.Fatalf("SetParams: %s", err)
+		}
+		for _, tc := range testCases {
+			t.Run(fmt.Sprintf("%s strict=%v", tc.name, strict), func(t *testing.T) {
+				before := CurrentStats()
+				res := SendRequestWithOptions("GET", hsURL+tc.path, "", "", &SendOptions{NoDictionary: tc.noDictionary})
+				rejections := CurrentStats().ContentFormatRejections - before.ContentFormatRejections
+				if strict && !tc.wantStrict {
+					if res != nil || rejections != 1 {
+						t.Errorf("got %+v and %d rejections, want the response rejected", res, rejections)
+					}
+					return
+				}
+				// tolerant mode decodes CBOR and passes JSON through
+				if res == nil || res.Code != 200 || res.Body != body || rejections != 0 {
+					t.Errorf("got %+v and %d rejections, want the response accepted", res, rejections)
+				}
+			})
+		}
+	}
+}
+
+// Run with -race to check that params can be changed while requests are in-flight
+func TestSetParamsConcurrentWithSendRequest(t *testing.T) {
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"versions":["r0.6.1"]}`))
+	}))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				// may fail if SetParams closes the connection underneath it, but must not race
+				SendRequest("GET", hsURL+"/_matrix/client/versions", "", "")
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 5; j++ {
+			cp := Params()
+			cp.ObserveBufferSize = 50 + j
+			if err := SetParams(cp); err != nil {
+				t.Errorf("SetParams: %s", err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+
+	// the last params set are used for subsequent requests
+	if got := Params().ObserveBufferSize; got != 54 {
+		t.Errorf("ObserveBufferSize: got %d want 54", got)
+	}
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+		t.Errorf("SendRequest after SetParams failed: %+v", res)
+	}
+}
+
+func TestSendRequestTooLarge(t *testing.T) {
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	coapHTTP.MaxRequestSize = 64
+	received := make(chan string, 2)
+	hsURL := newTestServerWithCoAPHTTP(t, coapHTTP, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	}))
+	path := hsURL + "/_matrix/client/r0/user/@alice:bar/account_data/com.example.big"
+
+	res := SendRequest("PUT", path, "secret", `{"data":"`+strings.Repeat("a", 200)+`"}`)
+	if res == nil {
+		t.Fatalf("SendRequest returned nil")
+	}
+	if res.Code != 413 {
+		t.Errorf("got HTTP %d want 413", res.Code)
+	}
+	var errRes struct {
+		ErrCode string `json:"errcode"`
+		MaxSize int    `json:"max_size"`
+	}
+	if err := json.Unmarshal([]byte(res.Body), &errRes); err != nil {
+		t.Fatalf("failed to unmarshal response body %s: %s", res.Body, err)
+	}
+	if errRes.ErrCode != "M_TOO_LARGE" || errRes.MaxSize != 64 {
+		t.Errorf("got %+v want M_TOO_LARGE with max_size 64", errRes)
+	}
+	select {
+	case body := <-received:
+		t.Errorf("handler was called with a request that was too large: %s", body)
+	default:
+	}
+
+	res = SendRequest("PUT", path, "secret", `{"data":"small"}`)
+	if res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest with a small body failed: %+v", res)
+	}
+	if body := <-received; body != `{"data":"small"}` {
+		t.Errorf("handler got body %s", body)
+	}
+}
+
+func TestSendToDeviceBlockwise(t *testing.T) {
+	// a room key shared with many devices is larger than a single block
+	devices := make(map[string]interface{})
+	for i := 0; i < 20; i++ {
+		devices[fmt.Sprintf("DEVICE%02d", i)] = map[string]interface{}{
+			"algorithm":  "m.olm.v1.curve25519-aes-sha2",
+			"sender_key": "3C5BFWi2Y8MaVvjM8M22DBmh24PmgR0nPvJOIArzgyI",
+			"ciphertext": map[string]interface{}{
+				fmt.Sprintf("curve%02dBFWi2Y8MaVvjM8M22DBmh24PmgR0nPvJOIArz", i): map[string]interface{}{
+					"type": 0,
+					"body": strings.Repeat(fmt.Sprintf("AwogGJJzMhf%02d", i), 20),
+				},
+			},
+			"org.matrix.msgid": "a1b2c3d4e5f6",
+		}
+	}
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"messages": map[string]interface{}{"@alice:example.com": devices},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal request body: %s", err)
+	}
+	type received struct {
+		path string
+		body []byte
+	}
+	receivedCh := make(chan received, 1)
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		receivedCh <- received{path: req.URL.Path, body: body}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	}))
+	// make the connection first so only the to-device request is counted
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil {
+		t.Fatalf("SendRequest returned nil")
+	}
+	<-receivedCh
+
+	before := CurrentStats()
+	res := SendRequest("PUT", hsURL+"/_matrix/client/r0/sendToDevice/m.room.encrypted/txn1", "secret", string(reqBody))
+	if res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest failed: %+v", res)
+	}
+	after := CurrentStats()
+	got := <-receivedCh
+	if got.path != "/_matrix/client/r0/sendToDevice/m.room.encrypted/txn1" {
+		t.Errorf("handler got path %s", got.path)
+	}
+	var gotBody, wantBody interface{}
+	if err = json.Unmarshal(got.body, &gotBody); err != nil {
+		t.Fatalf("handler got invalid JSON %s: %s", string(got.body), err)
+	}
+	if err = json.Unmarshal(reqBody, &wantBody); err != nil {
+		t.Fatalf("failed to unmarshal request body: %s", err)
+	}
+	if !reflect.DeepEqual(gotBody, wantBody) {
+		t.Errorf("handler got body %s want %s", string(got.body), string(reqBody))
+	}
+	cborBody, err := lb.NewCBORCodecV1(false).JSONToCBOR(bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	wantReqBlocks := int64((len(cborBody) + 1023) / 1024)
+	t.Logf("to-device request: JSON %d bytes, CBOR %d bytes, %d blocks", len(reqBody), len(cborBody), wantReqBlocks)
+	if wantReqBlocks < 2 {
+		t.Fatalf("test request is %d bytes of CBOR, want more than 1 block", len(cborBody))
+	}
+	if got := after.BlockwiseTransfers - before.BlockwiseTransfers; got != 1 {
+		t.Errorf("BlockwiseTransfers: got %d want 1", got)
+	}
+	// plus the single response block
+	if got := after.BlockwiseBlocks - before.BlockwiseBlocks; got != wantReqBlocks+1 {
+		t.Errorf("BlockwiseBlocks: got %d want %d", got, wantReqBlocks+1)
+	}
+}
+
+// TestSendRequestStreamingBody checks that a large request body is converted to CBOR as it is read, rather than
+// decoded first, and arrives intact
+func TestSendRequestStreamingBody(t *testing.T) {
+	events := make([]map[string]interface{}, 600)
+	for i := range events {
+		events[i] = map[string]interface{}{
+			"type":    "m.room.message",
+			"content": map[string]interface{}{"msgtype": "m.text", "body": fmt.Sprintf("message number %d, which is long enough to look real", i)},
+		}
+	}
+	reqBody, err := json.Marshal(map[string]interface{}{"events": events})
+	if err != nil {
+		t.Fatalf("failed to marshal request body: %s", err)
+	}
+	if len(reqBody) < streamingBodyMinBytes {
+		t.Fatalf("test request is %d bytes, want at least %d", len(reqBody), streamingBodyMinBytes)
+	}
+	received := make(chan []byte, 1)
+	hsURL := newCBORTestServer(t, "127.0.0.1:0", lb.NewCoAPHTTP(lb.NewCoAPPathV1()), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- body
+		w.Header().Set("Content-Type", "application/cbor")
+		w.WriteHeader(200)
+		w.Write([]byte{0xa0})
+	}))
+	res := SendRequest("POST", hsURL+"/_matrix/client/r0/rooms/!foo:bar/batch_send", "secret", string(reqBody))
+	if res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest failed: %+v", res)
+	}
+	cborBody := <-received
+	if len(cborBody) == 0 || cborBody[0] != 0xbf {
+		t.Fatalf("handler got CBOR which is not an indefinite length map, so was not streamed")
+	}
+	gotJSON, err := lb.NewCBORCodecV1(false).CBORToJSON(bytes.NewReader(cborBody))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	var gotBody, wantBody interface{}
+	if err = json.Unmarshal(gotJSON, &gotBody); err != nil {
+		t.Fatalf("CBORToJSON returned invalid JSON: %s", err)
+	}
+	if err = json.Unmarshal(reqBody, &wantBody); err != nil {
+		t.Fatalf("failed to unmarshal request body: %s", err)
+	}
+	if !reflect.DeepEqual(gotBody, wantBody) {
+		t.Errorf("handler got a different body from the request")
+	}
+}
+
+// TestEncodeBodyDuplicateKeys checks that bodies which repeat a key are encoded the same way whether or not they are
+// large enough for the streaming encoder, keeping the last value of the key
+func TestEncodeBodyDuplicateKeys(t *testing.T) {
+	padding := strings.Repeat("x", streamingBodyMinBytes)
+	for _, body := range []string{
+		`{"type":"m.room.member","body":"small","type":"m.room.message"}`,
+		`{"type":"m.room.member","body":"` + padding + `","type":"m.room.message"}`,
+		`{"content":{"body":"first","body":"` + padding + `","body":"last"}}`,
+	} {
+		name := body
+		if len(name) > 40 {
+			name = name[:40] + "..."
+		}
+		// the codec is not canonical, so compare the JSON rather than the order of the keys
+		buffered, err := cborCodec.JSONToCBOR(strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: JSONToCBOR: %s", name, err)
+		}
+		want, err := cborCodec.CBORToJSON(bytes.NewReader(buffered))
+		if err != nil {
+			t.Fatalf("%s: CBORToJSON: %s", name, err)
+		}
+		encoded, err := encodeBody(cborCodec, body)
+		if err != nil {
+			t.Fatalf("%s: encodeBody: %s", name, err)
+		}
+		got, err := cborCodec.CBORToJSON(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("%s: CBORToJSON: %s", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: encodeBody and JSONToCBOR gave different documents", name)
+		}
+		if strings.Contains(string(got), "m.room.member") || strings.Contains(string(got), "first") {
+			t.Errorf("%s: the first value of a repeated key was kept", name)
+		}
+	}
+}
+
+func TestSendRequestFilter(t *testing.T) {
+	filter := `{"room":{"timeline":{"limit":10,"lazy_load_members":true}},"event_format":"client"}`
+	var mu sync.Mutex
+	var stored string
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/json")
+		mu.Lock()
+		defer mu.Unlock()
+		switch req.Method + " " + req.URL.Path {
+		case "POST /_matrix/client/r0/user/@alice:bar/filter":
+			stored = string(body)
+			w.WriteHeader(200)
+			w.Write([]byte(`{"filter_id":"66697"}`))
+		case "GET /_matrix/client/r0/user/@alice:bar/filter/66697":
+			w.WriteHeader(200)
+			w.Write([]byte(stored))
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"` + req.Method + " " + req.URL.Path + `"}`))
+		}
+	}))
+	res := SendRequest("POST", hsURL+"/_matrix/client/r0/user/@alice:bar/filter", "secret", filter)
+	if res == nil || res.Code != 200 || res.Body != `{"filter_id":"66697"}` {
+		t.Fatalf("upload: got %+v", res)
+	}
+	res = SendRequest("GET", hsURL+"/_matrix/client/r0/user/@alice:bar/filter/66697", "secret", "")
+	if res == nil || res.Code != 200 {
+		t.Fatalf("download: got %+v", res)
+	}
+	var got, want interface{}
+	if err := json.Unmarshal([]byte(res.Body), &got); err != nil {
+		t.Fatalf("download: invalid JSON %s: %s", res.Body, err)
+	}
+	if err := json.Unmarshal([]byte(filter), &want); err != nil {
+		t.Fatalf("failed to unmarshal filter: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("download: got %s want %s", res.Body, filter)
+	}
+}
+
+// TestSendRequestHierarchy pages through a space hierarchy, whose pagination tokens are opaque so must survive
+// being sent as Uri-Query options unchanged
+func TestSendRequestHierarchy(t *testing.T) {
+	// from token -> rooms, next_batch
+	pages := map[string][2]string{
+		"":         {`"!a:bar","!b:bar"`, "p2+/=&x"},
+		"p2+/=&x":  {`"!c:bar","!d:bar"`, "p3 %20#?"},
+		"p3 %20#?": {`"!e:bar"`, ""},
+	}
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		page, ok := pages[req.URL.Query().Get("from")]
+		if req.URL.Path != "/_matrix/client/v1/rooms/!space:bar/hierarchy" || !ok {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"errcode":"M_INVALID_PARAM","error":"` + req.URL.String() + `"}`))
+			return
+		}
+		var rooms []string
+		for _, roomID := range strings.Split(page[0], ",") {
+			rooms = append(rooms, `{"room_id":`+roomID+`,"num_joined_members":1,"children_state":[]}`)
+		}
+		res := `{"rooms":[` + strings.Join(rooms, ",") + `]`
+		if page[1] != "" {
+			res += `,"next_batch":"` + page[1] + `"`
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(res + "}"))
+	}))
+
+	var roomIDs []string
+	q := url.Values{"limit": {"2"}}
+	for requests := 0; ; requests++ {
+		if requests == len(pages) {
+			t.Fatalf("still paginating after %d requests", requests)
+		}
+		res := SendRequest("GET", hsURL+"/_matrix/client/v1/rooms/!space:bar/hierarchy?"+q.Encode(), "secret", "")
+		if res == nil || res.Code != 200 {
+			t.Fatalf("page %d: got %+v", requests, res)
+		}
+		var page struct {
+			Rooms []struct {
+				RoomID string `json:"room_id"`
+			} `json:"rooms"`
+			NextBatch string `json:"next_batch"`
+		}
+		if err := json.Unmarshal([]byte(res.Body), &page); err != nil {
+			t.Fatalf("page %d: invalid JSON %s: %s", requests, res.Body, err)
+		}
+		for _, room := range page.Rooms {
+			roomIDs = append(roomIDs, room.RoomID)
+		}
+		if page.NextBatch == "" {
+			break
+		}
+		q.Set("from", page.NextBatch)
+	}
+	if want := []string{"!a:bar", "!b:bar", "!c:bar", "!d:bar", "!e:bar"}; !reflect.DeepEqual(roomIDs, want) {
+		t.Errorf("got rooms %v want %v", roomIDs, want)
+	}
+}
+
+func TestMaxBlockwiseRoundTrips(t *testing.T) {
+	resBody := `{"data":"` + strings.Repeat("x", 2000) + `"}`
+	var mu sync.Mutex
+	var received []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		received = append(received, req.Method+" "+req.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		if req.URL.Path == "/_matrix/client/r0/joined_rooms" {
+			w.Write([]byte(resBody))
+			return
+		}
+		w.Write([]byte(`{}`))
+	})
+	// a server which forces tiny blocks, so large responses need a huge number of round trips
+	codec := lb.NewCBORCodecV1(false)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	handler := lb.CBORToJSONHandler(next, codec, nil)
+	observations := lb.NewSyncObservations(handler, coapHTTP.Paths, codec)
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapHTTP.CoAPHTTPHandler(handler, observations),
+		dtls.WithBlockwise(true, blockwise.SZX16, time.Minute))
+	cp := Params()
+	cp.MaxBlockwiseRoundTrips = 10
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+
+	// small responses fit within the limit
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 || res.Body != `{}` {
+		t.Fatalf("SendRequest with a small response failed: %+v", res)
+	}
+
+	before := CurrentStats()
+	res := SendRequest("GET", hsURL+"/_matrix/client/r0/joined_rooms", "secret", "")
+	if res == nil {
+		t.Fatalf("SendRequest returned nil")
+	}
+	if res.Code != 504 {
+		t.Errorf("got HTTP %d want 504", res.Code)
+	}
+	var errRes struct {
+		ErrCode       string `json:"errcode"`
+		MaxRoundTrips int    `json:"max_round_trips"`
+	}
+	if err := json.Unmarshal([]byte(res.Body), &errRes); err != nil {
+		t.Fatalf("failed to unmarshal response body %s: %s", res.Body, err)
+	}
+	if errRes.MaxRoundTrips != 10 {
+		t.Errorf("got %+v want max_round_trips 10", errRes)
+	}
+	after := CurrentStats()
+	if got := after.BlockwiseAborts - before.BlockwiseAborts; got != 1 {
+		t.Errorf("BlockwiseAborts: got %d want 1", got)
+	}
+
+	// the connection is still usable after an abort
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest after abort failed: %+v", res)
+	}
+
+	// request bodies which need too many round trips are not sent at all
+	cp.MaxBlockwiseRoundTrips = 2
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	mu.Lock()
+	received = nil
+	mu.Unlock()
+	res = SendRequest("PUT", hsURL+"/_matrix/client/r0/user/@alice:bar/account_data/com.example.big", "secret",
+		`{"data":"`+strings.Repeat("a", 3000)+`"}`)
+	if res == nil || res.Code != 504 {
+		t.Fatalf("SendRequest with a large body: got %+v want 504", res)
+	}
+	if got := CurrentStats().BlockwiseAborts - after.BlockwiseAborts; got != 1 {
+		t.Errorf("BlockwiseAborts: got %d want 1", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 0 {
+		t.Errorf("handler was called with a request which needed too many round trips: %v", received)
+	}
+}
+
+// stallingConn receives nothing after it has received a number of blocks, until it is resumed
+type stallingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	blocks  int
+	after   int
+	resumed bool
+}
+
+func (c *stallingConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(b)
+		if err != nil || n == 0 || b[0] != dtlsContentTypeApplicationData {
+			return n, err
+		}
+		c.mu.Lock()
+		drop := !c.resumed && c.blocks >= c.after
+		if !drop && n >= minBlockDatagramSize {
+			c.blocks++
+		}
+		c.mu.Unlock()
+		if !drop {
+			return n, err
+		}
+	}
+}
+
+func (c *stallingConn) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resumed = true
+}
+
+func TestBlockwiseStall(t *testing.T) {
+	resBody := `{"data":"` + strings.Repeat("x", 20000) + `"}`
+	testCases := []struct {
+		policy  string
+		resume  bool
+		wantErr bool
+	}{
+		{policy: BlockwiseStallAbort, wantErr: true},
+		// the retry is sent straight away, so resuming during it tests the retry rather than the stalled transfer
+		{policy: BlockwiseStallRetry, resume: true},
+		{policy: BlockwiseStallWait, resume: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.policy, func(t *testing.T) {
+			hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(200)
+				w.Write([]byte(resBody))
+			}))
+			cp := Params()
+			cp.TransmissionACKTimeoutSecs = 1
+			// longer than the ACK timeout, so blocks lost while resuming are retransmitted before the transfer stalls
+			cp.BlockwiseStallTimeoutSecs = 2
+			cp.BlockwiseStallPolicy = tc.policy
+			if err := SetParams(cp); err != nil {
+				t.Fatalf("SetParams: %s", err)
+			}
+			conns := make(chan *stallingConn, 1)
+			SetTransportWrapper(func(conn net.Conn) net.Conn {
+				stalling := &stallingConn{Conn: conn, after: 3}
+				conns <- stalling
+				return stalling
+			})
+			t.Cleanup(func() {
+				SetTransportWrapper(nil)
+			})
+
+			before := CurrentStats()
+			result := make(chan *Response, 1)
+			go func() {
+				result <- SendRequest("GET", hsURL+"/_matrix/client/r0/joined_rooms", "secret", "")
+			}()
+			conn := <-conns
+			waitFor(t, "the transfer to stall", func() bool {
+				return CurrentStats().BlockwiseStalls > before.BlockwiseStalls
+			})
+			if tc.resume {
+				conn.resume()
+			}
+			var res *Response
+			select {
+			case res = <-result:
+			case <-time.After(30 * time.Second):
+				t.Fatalf("timed out waiting for the response")
+			}
+			conn.resume()
+			if res == nil {
+				t.Fatalf("SendRequest returned nil")
+			}
+			if tc.wantErr {
+				var errRes struct {
+					ErrCode        string `json:"errcode"`
+					BlocksReceived int    `json:"blocks_received"`
+				}
+				if err := json.Unmarshal([]byte(res.Body), &errRes); err != nil {
+					t.Fatalf("failed to unmarshal response body %s: %s", res.Body, err)
+				}
+				if res.Code != 504 || errRes.ErrCode != "M_UNKNOWN" || errRes.BlocksReceived != 3 {
+					t.Errorf("got HTTP %d %+v want 504 with 3 blocks received", res.Code, errRes)
+				}
+			} else if res.Code != 200 || res.Body != resBody {
+				t.Errorf("got HTTP %d with a %d byte body, want the whole response", res.Code, len(res.Body))
+			}
+			if got := CurrentStats().BlockwiseStalls - before.BlockwiseStalls; got != 1 {
+				t.Errorf("BlockwiseStalls: got %d want 1", got)
+			}
+		})
+	}
+	cp := Params()
+	cp.BlockwiseStallPolicy = "skip"
+	if err := SetParams(cp); err == nil {
+		t.Errorf("SetParams accepted an unknown BlockwiseStallPolicy")
+	}
+}
+
+// TestRequestEntityIncomplete checks that a block-wise upload which the server responds 4.08 to partway through is
+// sent again from the first block, up to IncompleteUploadRetries times
+func TestRequestEntityIncomplete(t *testing.T) {
+	reqBody := `{"body":"` + strings.Repeat("x", 5000) + `"}`
+	testCases := []struct {
+		name         string
+		failAttempts int
+		wantCode     int
+		wantAttempts int
+	}{
+		{name: "recovers", failAttempts: 1, wantCode: 200, wantAttempts: 2},
+		{name: "persists", failAttempts: 10, wantCode: 408, wantAttempts: 3},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var body []byte
+			attempts := 0
+			// the handler sees every block, as the server does not reassemble them
+			hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+				block, err := r.Options.GetUint32(message.Block1)
+				if err != nil {
+					w.SetResponse(codes.BadRequest, message.TextPlain, nil)
+					return
+				}
+				_, num, more, _ := blockwise.DecodeBlockOption(block)
+				data, _ := ioutil.ReadAll(r.Body)
+				mu.Lock()
+				defer mu.Unlock()
+				if num == 0 {
+					attempts++
+					body = nil
+				}
+				if num == 2 && attempts <= tc.failAttempts {
+					w.SetResponse(codes.RequestEntityIncomplete, message.TextPlain, nil)
+					return
+				}
+				body = append(body, data...)
+				if more {
+					ack := make([]byte, 4)
+					n, _ := message.EncodeUint32(ack, block)
+					w.SetResponse(codes.Continue, message.TextPlain, nil, message.Option{ID: message.Block1, Value: ack[:n]})
+					return
+				}
+				if got, _ := cborCodec.CBORToJSON(bytes.NewReader(body)); string(got) != reqBody {
+					t.Errorf("server got body of %d bytes want %d", len(got), len(reqBody))
+				}
+				w.SetResponse(codes.Content, message.AppCBOR, bytes.NewReader(cborBody(t, `{"event_id":"$1"}`)))
+			}), dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+
+			before := CurrentStats()
+			res := SendRequest("PUT", hsURL+"/_matrix/client/r0/rooms/!a:localhost/send/m.room.message/1", "secret", reqBody)
+			if res == nil {
+				t.Fatalf("SendRequest returned nil")
+			}
+			if res.Code != tc.wantCode {
+				t.Errorf("got HTTP %d %s want %d", res.Code, res.Body, tc.wantCode)
+			}
+			if tc.wantCode == 408 {
+				var errRes struct {
+					ErrCode  string `json:"errcode"`
+					Attempts int    `json:"attempts"`
+				}
+				if err := json.Unmarshal([]byte(res.Body), &errRes); err != nil {
+					t.Fatalf("failed to unmarshal response body %s: %s", res.Body, err)
+				}
+				if errRes.ErrCode != "M_UNKNOWN" || errRes.Attempts != tc.wantAttempts {
+					t.Errorf("got %+v want M_UNKNOWN after %d attempts", errRes, tc.wantAttempts)
+				}
+			}
+			mu.Lock()
+			if attempts != tc.wantAttempts {
+				t.Errorf("server got %d attempts want %d", attempts, tc.wantAttempts)
+			}
+			mu.Unlock()
+			stats := CurrentStats()
+			if got := stats.IncompleteUploadRetries - before.IncompleteUploadRetries; got != int64(tc.wantAttempts-1) {
+				t.Errorf("IncompleteUploadRetries: got %d want %d", got, tc.wantAttempts-1)
+			}
+			wantFailures := int64(0)
+			if tc.wantCode == 408 {
+				wantFailures = 1
+			}
+			if got := stats.IncompleteUploadFailures - before.IncompleteUploadFailures; got != wantFailures {
+				t.Errorf("IncompleteUploadFailures: got %d want %d", got, wantFailures)
+			}
+		})
+	}
+}
+
+type responseOptionsRecorder struct {
+	mu   sync.Mutex
+	opts []string
+}
+
+func (r *responseOptionsRecorder) OnResponseOption(path string, number int, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.opts = append(r.opts, fmt.Sprintf("%s %d=%s", path, number, value))
+}
+
+func TestSendRequestCustomOptions(t *testing.T) {
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	coapHTTP.Options = lb.HeaderOptions{
+		2049:  "X-Tenant-ID",
+		65000: "X-Trace",
+	}
+	received := make(chan string, 1)
+	hsURL := newTestServerWithCoAPHTTP(t, coapHTTP, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Get("X-Tenant-ID") + " " + req.Header.Get("X-Trace")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Trace", "span-2")
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	}))
+	cp := Params()
+	cp.RequestOptions = "2049=tenant-a,65000=span-1"
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	rec := &responseOptionsRecorder{}
+	SetResponseOptionsCallback(rec)
+	defer SetResponseOptionsCallback(nil)
+
+	res := SendRequest("GET", hsURL+"/_matrix/client/r0/joined_rooms", "secret", "")
+	if res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest: got %+v", res)
+	}
+	if got := <-received; got != "tenant-a span-1" {
+		t.Errorf("handler got headers %q want %q", got, "tenant-a span-1")
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	want := []string{"/_matrix/client/r0/joined_rooms 65000=span-2"}
+	if !reflect.DeepEqual(rec.opts, want) {
+		t.Errorf("response options: got %v want %v", rec.opts, want)
+	}
+}
+
+func TestSetParamsRequestOptions(t *testing.T) {
+	defaultParams := *Params()
+	defer SetParams(&defaultParams)
+	for _, opts := range []string{"256=token", "12=format", "2049", "70000=big", "x=y"} {
+		cp := defaultParams
+		cp.RequestOptions = opts
+		if err := SetParams(&cp); err == nil {
+			t.Errorf("SetParams with RequestOptions %q: expected error", opts)
+		}
+	}
+	cp := defaultParams
+	cp.RequestOptions = "2048=a,65535=b"
+	if err := SetParams(&cp); err != nil {
+		t.Errorf("SetParams with valid RequestOptions: %s", err)
+	}
+}
+
+func TestSendRequestTokenCompression(t *testing.T) {
+	var mu sync.Mutex
+	var authHeaders []string
+	var sentOpts []string // what was on the wire: "token", "ref" or "token+ask"
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		authHeaders = append(authHeaders, req.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	handler := lb.CBORToJSONHandler(next, codec, nil)
+	coapHandler := coapHTTP.CoAPHTTPHandler(handler, lb.NewSyncObservations(handler, coapHTTP.Paths, codec))
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		ref, refErr := r.Options.GetBytes(lb.OptionIDAccessTokenRef)
+		_, tokenErr := r.Options.GetString(lb.OptionIDAccessToken)
+		sent := "none"
+		switch {
+		case tokenErr == nil && refErr == nil && len(ref) == 0:
+			sent = "token+ask"
+		case tokenErr == nil:
+			sent = "token"
+		case refErr == nil:
+			sent = "ref"
+		}
+		mu.Lock()
+		sentOpts = append(sentOpts, sent)
+		mu.Unlock()
+		coapHandler.ServeCOAP(w, r)
+	}))
+	cp := Params()
+	cp.TokenCompression = true
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	sendAndCheck := func(token string, wantSent ...string) {
+		t.Helper()
+		mu.Lock()
+		authHeaders = nil
+		sentOpts = nil
+		mu.Unlock()
+		res := SendRequest("GET", hsURL+"/_matrix/client/r0/joined_rooms", token, "")
+		if res == nil || res.Code != 200 {
+			t.Fatalf("SendRequest: got %+v", res)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(sentOpts, wantSent) {
+			t.Errorf("token %s: sent %v want %v", token, sentOpts, wantSent)
+		}
+		if len(authHeaders) != 1 || authHeaders[0] != "Bearer "+token {
+			t.Errorf("token %s: handler got Authorization %v", token, authHeaders)
+		}
+	}
+	sendAndCheck("secret", "token+ask")
+	sendAndCheck("secret", "ref")
+	sendAndCheck("secret", "ref")
+	// the server only remembers 8 references per connection, so the first one is forgotten
+	for i := 0; i < 8; i++ {
+		sendAndCheck(fmt.Sprintf("other%d", i), "token+ask")
+	}
+	// the client falls back to the full token, and gets a new reference
+	sendAndCheck("secret", "ref", "token+ask")
+	sendAndCheck("secret", "ref")
+	// references are only valid on the connection they were issued on, and SetParams reconnects
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	sendAndCheck("secret", "token+ask")
+}
+
+// TestAccessTokensPerHost checks that a connection carrying requests for several virtual hosted homeservers never
+// sends the access token of one to another, whether it was remembered or sent as a reference
+func TestAccessTokensPerHost(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		received = append(received, req.Host+" "+req.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	handler := lb.CBORToJSONHandler(next, codec, nil)
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapHTTP.CoAPHTTPHandler(handler, lb.NewSyncObservations(handler, coapHTTP.Paths, codec)))
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest failed: %+v", res)
+	}
+	u, _ := url.Parse(hsURL)
+	conn, err := dc.getClientForHost(u.Host)
+	if err != nil {
+		t.Fatalf("getClientForHost: %s", err)
+	}
+	// send sends a request for host on the connection with the token, or with the token reference if it is not
+	// nil, returning the response code and the reference issued if it asked for one
+	send := func(host, token string, ref []byte, askForRef bool) (codes.Code, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "https://"+host+"/_matrix/client/r0/joined_rooms", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		var code codes.Code
+		var issued []byte
+		err := coapHTTPWithURIHost.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+			switch {
+			case ref != nil:
+				msg.SetOptionBytes(lb.OptionIDAccessTokenRef, ref)
+			case askForRef:
+				msg.SetOptionBytes(lb.OptionIDAccessTokenRef, []byte{})
+			}
+			res, err := conn.Do(msg)
+			if err != nil {
+				return err
+			}
+			code = res.Code()
+			issued, _ = res.Options().GetBytes(lb.OptionIDAccessTokenRef)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", host, err)
+		}
+		return code, issued
+	}
+	check := func(want ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(received, want) {
+			t.Errorf("homeservers got %q want %q", received, want)
+		}
+		received = nil
+	}
+	mu.Lock()
+	received = nil
+	mu.Unlock()
+
+	_, refA := send("hs-a.example.com", "token-a", nil, true)
+	if len(refA) == 0 {
+		t.Fatalf("no token reference issued")
+	}
+	check("hs-a.example.com Bearer token-a")
+	// the token remembered for A is not used for B
+	send("hs-b.example.com", "", nil, false)
+	send("HS-A.example.com", "", nil, false)
+	check("hs-b.example.com ", "HS-A.example.com Bearer token-a")
+	// nor is the reference issued for A
+	if code, _ := send("hs-b.example.com", "", refA, false); code != codes.BadOption {
+		t.Errorf("reference issued for A sent to B: got %v want %v", code, codes.BadOption)
+	}
+	check()
+	if code, _ := send("hs-a.example.com", "", refA, false); code != codes.Content {
+		t.Errorf("reference issued for A sent to A: got %v want %v", code, codes.Content)
+	}
+	check("hs-a.example.com Bearer token-a")
+	// each host remembers its own token
+	send("hs-b.example.com", "token-b", nil, false)
+	send("hs-a.example.com", "", nil, false)
+	send("hs-b.example.com", "", nil, false)
+	check("hs-b.example.com Bearer token-b", "hs-a.example.com Bearer token-a", "hs-b.example.com Bearer token-b")
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/sirupsen/logrus"
+)
+
+const ctxValObserveSyncRefresh = "ctxValObserveSyncRefresh"
+
+type debugState struct {
+	Connections  []debugConnection  `json:"connections"`
+	Observations []debugObservation `json:"observations"`
+	Pool         debugPool          `json:"pool"`
+	// true if the homeserver's certificate is not being checked, which must never be the case in production
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+type debugConnection struct {
+	Host string `json:"host"`
+	// "open", or "closed" if the connection has closed but not been removed yet
+	DTLSState    string  `json:"dtls_state"`
+	InFlight     int     `json:"in_flight"`
+	BlockSize    int     `json:"block_size"`
+	RTTMillis    float64 `json:"rtt_ms"`
+	RTTVarMillis float64 `json:"rtt_var_ms"`
+	LossRate     float64 `json:"loss_rate"`
+	ACKTimeout   float64 `json:"ack_timeout_ms"`
+}
+
+type debugObservation struct {
+	// the host is empty for streams on connections which are being replaced by MigrateTo
+	Host string `json:"host"`
+	// the HTTP path, without query parameters which may contain secrets
+	Resource      string `json:"resource"`
+	Notifications int64  `json:"notifications"`
+	LastSeq       uint32 `json:"last_seq"`
+	// seconds since the latest notification, or since the observation was made if there has not been one
+	LastNotificationAgeSecs float64 `json:"last_notification_age_secs"`
+	// notifications waiting for SendRequest. Streams are unbuffered, so these are always 0 for them.
+	BufferUsed int `json:"buffer_used"`
+	BufferSize int `json:"buffer_size"`
+}
+
+type debugPool struct {
+	Connections int  `json:"connections"`
+	InFlight    int  `json:"in_flight"`
+	Draining    int  `json:"draining"`
+	Background  bool `json:"background"`
+	Observes    int  `json:"observes"`
+	MaxObserves int  `json:"max_observes"`
+}
+
+// DebugState returns a JSON snapshot of the connections to homeservers and the observations registered on them,
+// for support engineers to see what the client is doing without attaching a debugger. Access tokens and query
+// parameters are never included.
+func DebugState() string {
+	cp := params()
+	state := debugState{
+		Connections:        []debugConnection{},
+		Observations:       []debugObservation{},
+		InsecureSkipVerify: cp.InsecureSkipVerify,
+	}
+	hosts := make(map[*client.ClientConn]string)
+	dc.mu.Lock()
+	for host, conn := range dc.conns {
+		hosts[conn] = host
+		dtlsState := "open"
+		if conn.Context().Err() != nil {
+			dtlsState = "closed"
+		}
+		lq := dc.linkForLocked(host).quality(cp)
+		state.Connections = append(state.Connections, debugConnection{
+			Host:         host,
+			DTLSState:    dtlsState,
+			InFlight:     dc.inFlight[conn],
+			BlockSize:    int(connBlockSZX(conn).Size()),
+			RTTMillis:    lq.RTTMillis,
+			RTTVarMillis: lq.RTTVarMillis,
+			LossRate:     lq.LossRate,
+			ACKTimeout:   lq.ACKTimeoutMillis,
+		})
+		if ch, ok := conn.Context().Value(ctxValObserveSync).(chan *Response); ok {
+			obs := debugObservation{
+				Host:       host,
+				Resource:   "/_matrix/client/r0/sync",
+				BufferUsed: len(ch),
+				BufferSize: cap(ch),
+			}
+			if refresh, ok := conn.Context().Value(ctxValObserveSyncRefresh).(*observeRefresh); ok {
+				obs.Notifications, obs.LastSeq = refresh.debugCounters()
+				obs.LastNotificationAgeSecs = refresh.notificationAge().Seconds()
+			}
+			state.Observations = append(state.Observations, obs)
+		}
+	}
+	for _, n := range dc.inFlight {
+		state.Pool.InFlight += n
+	}
+	state.Pool.Connections = len(dc.conns)
+	state.Pool.Draining = len(dc.draining)
+	state.Pool.Background = dc.background
+	dc.mu.Unlock()
+
+	liveStreamsMu.Lock()
+	for s := range liveStreams {
+		obs := debugObservation{
+			Host:     hosts[s.currentConn()],
+			Resource: coapHTTP.Paths.CoAPPathToHTTPPath(s.reg.path),
+		}
+		obs.Notifications, obs.LastSeq = s.reg.debugCounters()
+		obs.LastNotificationAgeSecs = s.reg.notificationAge().Seconds()
+		state.Observations = append(state.Observations, obs)
+	}
+	liveStreamsMu.Unlock()
+
+	sort.Slice(state.Connections, func(i, j int) bool {
+		return state.Connections[i].Host < state.Connections[j].Host
+	})
+	sort.SliceStable(state.Observations, func(i, j int) bool {
+		a, b := state.Observations[i], state.Observations[j]
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Resource < b.Resource
+	})
+	state.Pool.Observes = int(CurrentStats().Observes)
+	state.Pool.MaxObserves = cp.MaxObserves
+	b, err := json.Marshal(state)
+	if err != nil {
+		logrus.WithError(err).Error("DebugState: failed to marshal state")
+		return "{}"
+	}
+	return string(b)
+}
+
+// debugCounters returns the number of notifications and the latest sequence number
+func (r *observeRefresh) debugCounters() (int64, uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.notifications, r.lastSeq
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/lb"
+)
+
+func TestDebugState(t *testing.T) {
+	var polls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		if req.URL.Path != "/_matrix/client/r0/account/whoami" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(fmt.Sprintf(`{"n":%d}`, atomic.AddInt32(&polls, 1))))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	handler := lb.CBORToJSONHandler(next, codec, nil)
+	observations := lb.NewSyncObservations(handler, coapHTTP.Paths, codec)
+	// as in TestObserveStream, notifications must not be block-wise
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapHTTP.CoAPHTTPHandler(handler, observations),
+		dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "secret_token", ""); res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest: got %+v", res)
+	}
+	notifications := make(chan struct{}, 100)
+	s := ObserveStream(hsURL+"/_matrix/client/r0/account/whoami?access_token=secret_query", "secret_token", &streamFuncs{
+		notification: func(code int, body string) {
+			notifications <- struct{}{}
+		},
+		closed: func() {},
+	})
+	if s == nil {
+		t.Fatalf("ObserveStream returned nil")
+	}
+	defer s.Cancel()
+	select {
+	case <-notifications:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a notification")
+	}
+
+	state := DebugState()
+	t.Logf("state: %s", state)
+	if strings.Contains(state, "secret") {
+		t.Errorf("state contains secrets: %s", state)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(state), &got); err != nil {
+		t.Fatalf("invalid JSON: %s", err)
+	}
+	wantKeys := map[string][]string{
+		"":             {"connections", "insecure_skip_verify", "observations", "pool"},
+		"connections":  {"ack_timeout_ms", "block_size", "dtls_state", "host", "in_flight", "loss_rate", "rtt_ms", "rtt_var_ms"},
+		"observations": {"buffer_size", "buffer_used", "host", "last_notification_age_secs", "last_seq", "notifications", "resource"},
+		"pool":         {"background", "connections", "draining", "in_flight", "max_observes", "observes"},
+	}
+	for field, want := range wantKeys {
+		obj := got
+		if field != "" {
+			v := got[field]
+			if list, ok := v.([]interface{}); ok {
+				if len(list) != 1 {
+					t.Fatalf("%s: got %d entries want 1", field, len(list))
+				}
+				v = list[0]
+			}
+			obj, _ = v.(map[string]interface{})
+		}
+		var keys []string
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("%s: got keys %v want %v", field, keys, want)
+		}
+	}
+
+	u, _ := url.Parse(hsURL)
+	conn := got["connections"].([]interface{})[0].(map[string]interface{})
+	if conn["host"] != u.Host || conn["dtls_state"] != "open" || conn["rtt_ms"].(float64) <= 0 {
+		t.Errorf("got connection %v want an open connection to %s with an RTT", conn, u.Host)
+	}
+	obs := got["observations"].([]interface{})[0].(map[string]interface{})
+	if obs["host"] != u.Host || obs["resource"] != "/_matrix/client/r0/account/whoami" || obs["notifications"].(float64) < 1 {
+		t.Errorf("got observation %v want the stream with notifications", obs)
+	}
+	if pool := got["pool"].(map[string]interface{}); pool["connections"] != 1.0 || pool["observes"] != 1.0 {
+		t.Errorf("got pool %v want 1 connection and 1 observe", pool)
+	}
+	// the test server's certificate is self-signed
+	if got["insecure_skip_verify"] != true {
+		t.Errorf("got insecure_skip_verify %v want true", got["insecure_skip_verify"])
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+	"github.com/matrix-org/lb"
+	"github.com/sirupsen/logrus"
+)
+
+// DownloadResult is how far Download got
+type DownloadResult struct {
+	// Code is the HTTP status code of the last response, which is 200 once the file is complete, or 0 if the server
+	// could not be reached or the download was paused
+	Code int
+	// Body is the JSON body of the last response if Code is not 2xx, e.g a Matrix error
+	Body string
+	// Complete is true once the whole file has been downloaded to the path given to Download
+	Complete bool
+	// Paused is true if the download was stopped by PauseDownload
+	Paused bool
+	// BytesDownloaded is how much of the file has been downloaded, including by earlier calls to Download
+	BytesDownloaded int64
+	// TotalBytes is the size of the file, or -1 if it is not known yet
+	TotalBytes int64
+}
+
+// downloadState is what the bytes downloaded so far are the start of, which is saved alongside them so the download
+// can resume in a later session
+type downloadState struct {
+	URL  string `json:"url"`
+	ETag string `json:"etag,omitempty"`
+	Size int64  `json:"size"`
+}
+
+var (
+	activeDownloadsMu sync.Mutex
+	// the downloads in progress, by file path, with the channel PauseDownload closes to pause them
+	activeDownloads = make(map[string]chan struct{})
+)
+
+// errDownloadRequest is returned when the request for a range could not be made, which has already been logged
+var errDownloadRequest = errors.New("failed to make request")
+
+// Download fetches hsURL, e.g a /_matrix/media/r0/download URL, to filePath, for files too large to fetch in a
+// single request. The file is fetched as a series of byte ranges of DownloadRangeBlocks blocks each, starting on a
+// block boundary, so every range is one block-wise transfer of whole blocks and losing the connection loses at most
+// the range in flight, rather than everything a single block-wise transfer had received. The bytes so far are kept
+// in filePath+".part", along with the URL and ETag they are from in filePath+".part.json", so calling Download again
+// resumes where it stopped, even after the app was killed. If the server has a different version of the file by
+// then it starts again. The file is moved to filePath once it is complete. Servers which do not support ranges
+// send the whole file in one response. Returns nil if the download could not be started, e.g it is already running.
+func Download(hsURL, token, filePath string) *DownloadResult {
+	pause := make(chan struct{})
+	activeDownloadsMu.Lock()
+	if _, ok := activeDownloads[filePath]; ok {
+		activeDownloadsMu.Unlock()
+		logrus.Errorf("Download: already downloading to %s", filePath)
+		return nil
+	}
+	activeDownloads[filePath] = pause
+	activeDownloadsMu.Unlock()
+	defer func() {
+		activeDownloadsMu.Lock()
+		delete(activeDownloads, filePath)
+		activeDownloadsMu.Unlock()
+	}()
+	d := &download{
+		url:   hsURL,
+		token: token,
+		path:  filePath,
+		pause: pause,
+	}
+	return d.run()
+}
+
+// PauseDownload stops the Download to filePath once the range in flight has been saved. Call Download again to
+// resume it. Returns false if there is no download to filePath in progress.
+func PauseDownload(filePath string) bool {
+	activeDownloadsMu.Lock()
+	defer activeDownloadsMu.Unlock()
+	pause, ok := activeDownloads[filePath]
+	if !ok {
+		return false
+	}
+	select {
+	case <-pause:
+	default:
+		close(pause)
+	}
+	return true
+}
+
+type download struct {
+	url, token, path string
+	pause            chan struct{}
+}
+
+func (d *download) run() *DownloadResult {
+	u, err := url.Parse(d.url)
+	if err != nil || u.Host == "" {
+		logrus.WithField("url", d.url).Error("Download: invalid HS URL")
+		return nil
+	}
+	conn, err := dc.getClientForHost(u.Host)
+	if err != nil {
+		logrus.WithError(err).Errorf("Download: failed to get DTLS client for host %s", u.Host)
+		return nil
+	}
+	blockSize := connBlockSZX(conn).Size()
+	rangeSize := int64(params().DownloadRangeBlocks) * blockSize
+
+	partPath, statePath := d.path+".part", d.path+".part.json"
+	part, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		logrus.WithError(err).Error("Download: failed to open file")
+		return nil
+	}
+	defer part.Close()
+	state := loadDownloadState(statePath, d.url)
+	var offset int64
+	if state != nil && rangeSize > 0 {
+		offset, err = part.Seek(0, io.SeekEnd)
+		if err != nil {
+			logrus.WithError(err).Error("Download: failed to read file")
+			return nil
+		}
+		// a range cut short by the app being killed may not end on a block boundary
+		offset -= offset % blockSize
+		logrus.Infof("Download: resuming %s from %d bytes", u.Path, offset)
+	} else {
+		state = &downloadState{URL: d.url, Size: -1}
+	}
+	if err = part.Truncate(offset); err != nil {
+		logrus.WithError(err).Error("Download: failed to truncate file")
+		return nil
+	}
+
+	result := &DownloadResult{}
+	for {
+		result.BytesDownloaded, result.TotalBytes = offset, state.Size
+		if offset == state.Size {
+			break
+		}
+		select {
+		case <-d.pause:
+			logrus.Infof("Download: paused %s at %d bytes", u.Path, offset)
+			result.Paused = true
+			return result
+		default:
+		}
+		last := int64(-1)
+		if rangeSize > 0 {
+			last = offset + rangeSize - 1
+		}
+		res, body, err := d.fetch(offset, last)
+		if err != nil {
+			logrus.WithError(err).Errorf("Download: failed to fetch %s from %d bytes", u.Path, offset)
+			return result
+		}
+		etag := res.Header.Get("ETag")
+		switch res.StatusCode {
+		case http.StatusPartialContent:
+			first, _, size, ok := lb.ParseContentRange(res.Header.Get("Content-Range"))
+			if !ok || first != offset {
+				logrus.Errorf("Download: asked for bytes from %d, got %s", offset, res.Header.Get("Content-Range"))
+				return result
+			}
+			if state.Size >= 0 && (etag != state.ETag || size != state.Size) {
+				logrus.Warnf("Download: %s has changed, starting again", u.Path)
+				offset = 0
+				state = &downloadState{URL: d.url, Size: -1}
+				if err = part.Truncate(0); err != nil {
+					logrus.WithError(err).Error("Download: failed to truncate file")
+					return result
+				}
+				continue
+			}
+			if state.Size < 0 {
+				// saved before the bytes, so they are never on disk without what they are from
+				state.ETag, state.Size = etag, size
+				if err = saveDownloadState(statePath, state); err != nil {
+					logrus.WithError(err).Error("Download: failed to save progress")
+					return result
+				}
+			}
+		case http.StatusOK:
+			// the whole file, as the server does not support ranges or none were asked for
+			offset = 0
+			state.ETag, state.Size = etag, int64(len(body))
+			if err = part.Truncate(0); err != nil {
+				logrus.WithError(err).Error("Download: failed to truncate file")
+				return result
+			}
+		default:
+			result.Code = res.StatusCode
+			if resBody, _, err := decodeResponseBody(responseCodec(res.Header.Get("Content-Type")), bytes.NewReader(body)); err == nil {
+				result.Body = string(resBody)
+			}
+			return result
+		}
+		if _, err = part.WriteAt(body, offset); err == nil {
+			err = part.Sync()
+		}
+		if err != nil {
+			logrus.WithError(err).Error("Download: failed to write file")
+			return result
+		}
+		offset += int64(len(body))
+		if offset > state.Size || (len(body) == 0 && offset < state.Size) {
+			logrus.Errorf("Download: got %d bytes of %s which is %d bytes", offset, u.Path, state.Size)
+			return result
+		}
+	}
+
+	if err = part.Close(); err == nil {
+		err = os.Rename(partPath, d.path)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Download: failed to move completed file")
+		return result
+	}
+	os.Remove(statePath)
+	result.Code = http.StatusOK
+	result.Complete = true
+	return result
+}
+
+// fetch sends a GET for the bytes of the file from first to last, or the whole file if last is -1, returning the
+// response and its body
+func (d *download) fetch(first, last int64) (*http.Response, []byte, error) {
+	req, _, u, conn, dictionary := newRequest("GET", d.url, "", false)
+	if req == nil {
+		return nil, nil, errDownloadRequest
+	}
+	if last >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, last))
+	}
+	setAccessToken(conn, req, tokens.current(d.token))
+	cp := params()
+	limit := newRequestLimit(cp)
+	defer limit.cancel()
+	req = req.WithContext(limit.ctx)
+	var res *pool.Message
+	send := func() error {
+		return coapHTTPFor(cp, dictionary, requestPathSegments(conn, u)).HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+			var err error
+			res, err = do(conn, msg, &Timings{}, limit)
+			return err
+		})
+	}
+	err := send()
+	if errors.Is(err, errTokenRefRejected) {
+		logrus.Info("Server has forgotten the access token reference, sending the full token")
+		err = send()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	httpRes := coapHTTP.CoAPToHTTPResponse(res)
+	if httpRes == nil {
+		return nil, nil, fmt.Errorf("failed to convert CoAP response %v to HTTP", res.Code())
+	}
+	var body []byte
+	if httpRes.Body != nil {
+		if body, err = ioutil.ReadAll(httpRes.Body); err != nil {
+			return nil, nil, err
+		}
+	}
+	return httpRes, body, nil
+}
+
+// loadDownloadState returns the saved progress of downloading hsURL, or nil if there is none
+func loadDownloadState(statePath, hsURL string) *downloadState {
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return nil
+	}
+	var state downloadState
+	if err = json.Unmarshal(data, &state); err != nil || state.URL != hsURL || state.Size < 0 {
+		return nil
+	}
+	return &state
+}
+
+// saveDownloadState writes the progress of a download to a temporary file then renames it, so a crash never leaves
+// partially written progress
+func saveDownloadState(statePath string, state *downloadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := statePath + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, statePath)
+}
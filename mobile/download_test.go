@@ -0,0 +1,123 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestDownloadResumes checks that a download interrupted part way through resumes from the saved offset in a later
+// call to Download, rather than fetching the bytes it already has again
+func TestDownloadResumes(t *testing.T) {
+	file := make([]byte, 20000)
+	rand.New(rand.NewSource(1)).Read(file)
+	var mu sync.Mutex
+	var ranges []string
+	fail := true
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/_matrix/media/r0/download/localhost/abc" {
+			w.WriteHeader(404)
+			return
+		}
+		mu.Lock()
+		ranges = append(ranges, req.Header.Get("Range"))
+		interrupt := fail && len(ranges) == 3
+		mu.Unlock()
+		if interrupt {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(502)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"upstream went away"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(file))
+	}))
+	cp := Params()
+	cp.DownloadRangeBlocks = 4
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "abc")
+	mediaURL := hsURL + "/_matrix/media/r0/download/localhost/abc"
+	rangeSize := int64(4 * blockwiseSZX.Size())
+
+	res := Download(mediaURL, "secret", path)
+	if res == nil {
+		t.Fatalf("Download returned nil")
+	}
+	if res.Complete || res.Code != 502 || !strings.Contains(res.Body, "M_UNKNOWN") {
+		t.Fatalf("got %+v want an incomplete download with the 502", res)
+	}
+	if res.BytesDownloaded != 2*rangeSize || res.TotalBytes != int64(len(file)) {
+		t.Errorf("got %d of %d bytes want %d of %d", res.BytesDownloaded, res.TotalBytes, 2*rangeSize, len(file))
+	}
+	for _, p := range []string{path + ".part", path + ".part.json"} {
+		if _, err = os.Stat(p); err != nil {
+			t.Errorf("progress not saved: %s", err)
+		}
+	}
+
+	// as if the app was killed part way through writing a range
+	part, err := os.OpenFile(path+".part", os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	part.Write([]byte("garbage"))
+	part.Close()
+
+	mu.Lock()
+	fail = false
+	ranges = nil
+	mu.Unlock()
+	res = Download(mediaURL, "secret", path)
+	if res == nil || !res.Complete || res.Code != 200 {
+		t.Fatalf("got %+v want a complete download", res)
+	}
+	if res.BytesDownloaded != int64(len(file)) {
+		t.Errorf("got %d bytes downloaded want %d", res.BytesDownloaded, len(file))
+	}
+	mu.Lock()
+	if len(ranges) == 0 || ranges[0] != "bytes=8192-12287" {
+		t.Errorf("resumed download asked for ranges %v want to start from bytes=8192-12287", ranges)
+	}
+	mu.Unlock()
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if !bytes.Equal(got, file) {
+		t.Errorf("downloaded file of %d bytes does not match the %d bytes served", len(got), len(file))
+	}
+	for _, p := range []string{path + ".part", path + ".part.json"} {
+		if _, err = os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after the download completed", p)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/sirupsen/logrus"
+)
+
+// OnAppBackground should be called when the app moves into the background, e.g when the device is about to
+// doze. Idle DTLS connections are closed, which stops heartbeats and OBSERVE notifications so the OS can
+// keep the radio asleep. Connections with requests in-flight are closed as soon as those requests finish.
+// Requests made while in the background still work, but open a new connection each time they are needed.
+//
+// If ObservePinInBackground is set, connections with observations are kept open, so notifications keep arriving
+// for as long as the OS lets the app run.
+func OnAppBackground() {
+	logrus.Info("App moved to the background, closing idle connections")
+	for _, conn := range dc.onBackground(params().ObservePinInBackground) {
+		closeConn(conn, ObserveEndedBackground)
+	}
+}
+
+// OnAppForeground should be called when the app moves into the foreground. Connections which were closed by
+// OnAppBackground are re-established in the background so the next request doesn't wait for a DTLS handshake.
+// The /sync observations of those connections are registered again from the since token of the last notification,
+// so the notifications the server sent while the app was in the background are buffered for the next /sync
+// request. Observations which were kept open by ObservePinInBackground are re-registered straight away, as the OS
+// may have suspended the socket long enough for the server to drop them, e.g on iOS.
+func OnAppForeground() {
+	hosts, suspended := dc.onForeground()
+	logrus.Infof("App moved to the foreground, reconnecting to %d hosts", len(hosts))
+	for _, host := range hosts {
+		go func(host string, refresh *observeRefresh) {
+			conn, err := dc.getClientForHost(host)
+			if err != nil {
+				logrus.WithError(err).Warnf("Failed to reconnect to host %s", host)
+				return
+			}
+			resumeObservations(conn, host, refresh)
+		}(host, suspended[host])
+	}
+}
+
+// resumeObservations re-registers the observations of conn after the app was in the background. refresh is the
+// /sync observation the host had when the app went into the background, if any.
+func resumeObservations(conn *client.ClientConn, host string, refresh *observeRefresh) {
+	timeout := streamRequestTimeout(params())
+	for _, s := range streamsOn(conn) {
+		s.migrate(conn)
+	}
+	if refresh == nil {
+		return
+	}
+	if conn.Context().Value(ctxValObserveSyncRefresh) == refresh {
+		// the connection was pinned and survived
+		refresh.refresh(conn, timeout)
+		return
+	}
+	logrus.Infof("Observe: resuming observation of %s on host %s", refresh.path, host)
+	observe(conn, host, refresh.path, refresh.token, refresh.resumeQueries(), refresh.hostOpts)
+}
+
+// isPinned returns true if conn must stay open in the background because it has observations
+func isPinned(conn *client.ClientConn, streamConns map[*client.ClientConn]bool) bool {
+	return conn.Context().Value(ctxValObserveSync) != nil || streamConns[conn]
+}
+
+// streamConns returns the conns which have streams on them
+func streamConns() map[*client.ClientConn]bool {
+	liveStreamsMu.Lock()
+	streams := make([]*Stream, 0, len(liveStreams))
+	for s := range liveStreams {
+		streams = append(streams, s)
+	}
+	liveStreamsMu.Unlock()
+	conns := make(map[*client.ClientConn]bool)
+	for _, s := range streams {
+		conns[s.currentConn()] = true
+	}
+	return conns
+}
+
+// onBackground marks the app as in the background and forgets all idle conns, which are returned so
+// they can be closed. All hosts are remembered so they can be reconnected to on foreground, along with their
+// /sync observations. If pin is set, conns with observations are never closed while in the background.
+func (c *dtlsClients) onBackground(pin bool) (idle []*client.ClientConn) {
+	var pinnedConns map[*client.ClientConn]bool
+	if pin {
+		pinnedConns = streamConns()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.background = true
+	c.pinObserves = pin
+	for host, conn := range c.conns {
+		c.backgroundHosts[host] = true
+		c.suspendObserveLocked(host, conn)
+		if pin && isPinned(conn, pinnedConns) {
+			c.pinned[conn] = true
+			continue
+		}
+		if c.inFlight[conn] == 0 {
+			idle = append(idle, conn)
+			delete(c.conns, host)
+		}
+	}
+	return idle
+}
+
+// suspendObserveLocked remembers the /sync observation of conn, if it has one, to resume on foreground
+func (c *dtlsClients) suspendObserveLocked(host string, conn *client.ClientConn) {
+	if refresh, ok := conn.Context().Value(ctxValObserveSyncRefresh).(*observeRefresh); ok {
+		c.suspendedObserves[host] = refresh
+	}
+}
+
+// onForeground marks the app as in the foreground and returns the hosts to reconnect to, and the /sync
+// observations they had
+func (c *dtlsClients) onForeground() (hosts []string, suspended map[string]*observeRefresh) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.background = false
+	c.pinObserves = false
+	for host := range c.backgroundHosts {
+		hosts = append(hosts, host)
+	}
+	suspended = c.suspendedObserves
+	c.backgroundHosts = make(map[string]bool)
+	c.suspendedObserves = make(map[string]*observeRefresh)
+	c.pinned = make(map[*client.ClientConn]bool)
+	return hosts, suspended
+}
+
+// acquire marks that a request is in-flight on conn
+func (c *dtlsClients) acquire(conn *client.ClientConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight[conn]++
+}
+
+// release marks that a request on conn has finished. If the app is in the background, or conn was replaced by
+// MigrateTo, and there are no other requests in-flight, the conn is closed.
+func (c *dtlsClients) release(conn *client.ClientConn) {
+	c.mu.Lock()
+	c.inFlight[conn]--
+	idle := c.inFlight[conn] <= 0
+	if idle {
+		delete(c.inFlight, conn)
+	}
+	// conns which start observing in the background are pinned too
+	pinned := c.pinned[conn] || (c.pinObserves && isPinned(conn, nil))
+	closing := idle && ((c.background && !pinned) || c.draining[conn])
+	reason := ObserveEndedReconnect
+	if c.background && !c.draining[conn] {
+		reason = ObserveEndedBackground
+	}
+	if closing {
+		for host, co := range c.conns {
+			if co == conn {
+				c.backgroundHosts[host] = true
+				if c.background {
+					c.suspendObserveLocked(host, conn)
+				}
+				delete(c.conns, host)
+			}
+		}
+	}
+	c.mu.Unlock()
+	if closing {
+		closeConn(conn, reason)
+	}
+}
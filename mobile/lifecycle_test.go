@@ -0,0 +1,268 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+)
+
+func waitFor(t *testing.T, msg string, fn func() bool) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if fn() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", msg)
+}
+
+func TestAppBackgroundForeground(t *testing.T) {
+	unblock := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/_matrix/client/r0/joined_rooms" {
+			entered <- struct{}{}
+			<-unblock
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(OnAppForeground)
+	host := strings.TrimPrefix(hsURL, "https://")
+
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil {
+		t.Fatalf("SendRequest returned nil")
+	}
+	if dc.isConnClosed(host) {
+		t.Fatalf("no connection after SendRequest")
+	}
+	OnAppBackground()
+	if !dc.isConnClosed(host) {
+		t.Errorf("OnAppBackground did not close the idle connection")
+	}
+	OnAppForeground()
+	waitFor(t, "OnAppForeground to reconnect", func() bool {
+		return !dc.isConnClosed(host)
+	})
+
+	// connections with requests in-flight stay open until the request completes
+	done := make(chan *Response)
+	go func() {
+		done <- SendRequest("GET", hsURL+"/_matrix/client/r0/joined_rooms", "", "")
+	}()
+	<-entered
+	OnAppBackground()
+	if dc.isConnClosed(host) {
+		t.Errorf("OnAppBackground closed a connection with a request in-flight")
+	}
+	close(unblock)
+	if res := <-done; res == nil || res.Code != 200 {
+		t.Fatalf("in-flight request failed: %+v", res)
+	}
+	if !dc.isConnClosed(host) {
+		t.Errorf("connection was not closed after the in-flight request completed")
+	}
+	OnAppForeground()
+	waitFor(t, "OnAppForeground to reconnect", func() bool {
+		return !dc.isConnClosed(host)
+	})
+}
+
+type syncRegistration struct {
+	token string
+	since string
+}
+
+// newSyncRegistrationServer runs a server which answers every /sync registration with the next batch, and sends
+// the token and since token of the registrations on the returned channel
+func newSyncRegistrationServer(t *testing.T) (string, chan syncRegistration) {
+	t.Helper()
+	registrations := make(chan syncRegistration, 10)
+	var batches int32
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		if obs, err := r.Options.Observe(); err != nil || obs != 0 {
+			w.SetResponse(codes.Content, message.AppCBOR, bytes.NewReader(cborBody(t, `{}`)))
+			return
+		}
+		reg := syncRegistration{token: r.Token.String()}
+		queries, _ := r.Options.Queries()
+		for _, q := range queries {
+			if strings.HasPrefix(q, "since=") {
+				reg.since = strings.TrimPrefix(q, "since=")
+			}
+		}
+		registrations <- reg
+		body := fmt.Sprintf(`{"next_batch":"s%d"}`, atomic.AddInt32(&batches, 1))
+		w.SetResponse(codes.Content, message.AppCBOR, bytes.NewReader(cborBody(t, body)))
+	}))
+	cp := Params()
+	cp.ObserveEnabled = true
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	return hsURL, registrations
+}
+
+func waitForRegistration(t *testing.T, registrations chan syncRegistration) syncRegistration {
+	t.Helper()
+	select {
+	case reg := <-registrations:
+		return reg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a /sync registration")
+	}
+	return syncRegistration{}
+}
+
+// TestAppForegroundResumesObserve checks that a /sync observation closed by OnAppBackground is registered again
+// by OnAppForeground, from the since token of the last notification rather than the one the app last sent.
+func TestAppForegroundResumesObserve(t *testing.T) {
+	hsURL, registrations := newSyncRegistrationServer(t)
+	t.Cleanup(OnAppForeground)
+	host := strings.TrimPrefix(hsURL, "https://")
+
+	if res := SendRequest("GET", hsURL+"/_matrix/client/r0/sync?since=s0", "secret", ""); res == nil ||
+		res.Body != `{"next_batch":"s1"}` {
+		t.Fatalf("SendRequest /sync: got %+v", res)
+	}
+	first := waitForRegistration(t, registrations)
+	if first.since != "s0" {
+		t.Errorf("registered with since %q want s0", first.since)
+	}
+	OnAppBackground()
+	if !dc.isConnClosed(host) {
+		t.Fatalf("OnAppBackground did not close the connection")
+	}
+
+	OnAppForeground()
+	resumed := waitForRegistration(t, registrations)
+	if resumed.since != "s1" || resumed.token == first.token {
+		t.Errorf("resumed registration %+v, want a new registration from since s1", resumed)
+	}
+	// the response to the resumed registration is waiting for the app's /sync, which still has the old since
+	start := time.Now()
+	if res := SendRequest("GET", hsURL+"/_matrix/client/r0/sync?since=s0", "secret", ""); res == nil ||
+		res.Body != `{"next_batch":"s2"}` {
+		t.Fatalf("SendRequest /sync after resuming: got %+v", res)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("SendRequest /sync after resuming took %v, want the buffered response", took)
+	}
+	select {
+	case reg := <-registrations:
+		t.Errorf("got another registration %+v", reg)
+	default:
+	}
+}
+
+// TestAppForegroundExpiredSince checks that a /sync observation whose since token is older than
+// ObserveSinceMaxAgeSecs is resumed from an initial sync, and that its listeners are told.
+func TestAppForegroundExpiredSince(t *testing.T) {
+	hsURL, registrations := newSyncRegistrationServer(t)
+	t.Cleanup(OnAppForeground)
+	host := strings.TrimPrefix(hsURL, "https://")
+	cp := Params()
+	cp.ObserveSinceMaxAgeSecs = 60
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	events := make(syncEvents, 10)
+	addSyncListener(host, deviceListsListener(events))
+	t.Cleanup(func() {
+		syncListenersMu.Lock()
+		delete(syncListeners, host)
+		syncListenersMu.Unlock()
+	})
+
+	if res := SendRequest("GET", hsURL+"/_matrix/client/r0/sync?since=s0", "secret", ""); res == nil {
+		t.Fatalf("SendRequest /sync returned nil")
+	}
+	waitForRegistration(t, registrations)
+	OnAppBackground()
+	events.wait(t, "ended "+ObserveEndedBackground)
+	// the app stays in the background for longer than the since token lasts
+	dc.mu.Lock()
+	refresh := dc.suspendedObserves[host]
+	dc.mu.Unlock()
+	if refresh == nil {
+		t.Fatalf("OnAppBackground did not suspend the observation")
+	}
+	refresh.mu.Lock()
+	refresh.sinceAt = refresh.sinceAt.Add(-time.Minute)
+	refresh.mu.Unlock()
+	before := CurrentStats()
+
+	OnAppForeground()
+	events.wait(t, "reset "+SyncResetExpired)
+	if resumed := waitForRegistration(t, registrations); resumed.since != "" {
+		t.Errorf("resumed from since %q, want an initial sync", resumed.since)
+	}
+	if got := CurrentStats().SyncResets - before.SyncResets; got != 1 {
+		t.Errorf("SyncResets: got %d more want 1 more", got)
+	}
+}
+
+// TestAppBackgroundPinsObserve checks that ObservePinInBackground keeps the /sync connection open in the background,
+// and that OnAppForeground re-registers the same observation in case the OS suspended the socket.
+func TestAppBackgroundPinsObserve(t *testing.T) {
+	hsURL, registrations := newSyncRegistrationServer(t)
+	cp := Params()
+	cp.ObservePinInBackground = true
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	t.Cleanup(OnAppForeground)
+	host := strings.TrimPrefix(hsURL, "https://")
+
+	if res := SendRequest("GET", hsURL+"/_matrix/client/r0/sync", "secret", ""); res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest /sync: got %+v", res)
+	}
+	first := waitForRegistration(t, registrations)
+	conn, err := dc.getClientForHost(host)
+	if err != nil {
+		t.Fatalf("getClientForHost: %s", err)
+	}
+	OnAppBackground()
+	if dc.isConnClosed(host) {
+		t.Fatalf("OnAppBackground closed the observing connection")
+	}
+	// requests in the background do not close it either
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest in the background: got %+v", res)
+	}
+	if dc.isConnClosed(host) {
+		t.Fatalf("a request in the background closed the observing connection")
+	}
+
+	OnAppForeground()
+	refreshed := waitForRegistration(t, registrations)
+	if refreshed.token != first.token || refreshed.since != "s1" {
+		t.Errorf("got registration %+v, want the first registration %s again from since s1", refreshed, first.token)
+	}
+	if got, err := dc.getClientForHost(host); err != nil || got != conn {
+		t.Errorf("OnAppForeground made a new connection")
+	}
+}
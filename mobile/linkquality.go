@@ -0,0 +1,207 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/sirupsen/logrus"
+)
+
+const ctxValLinkEstimator = "ctxValLinkEstimator"
+
+// Gains for the smoothed RTT and RTT variance, and the multiplier of the variance in the ACK timeout.
+// https://datatracker.ietf.org/doc/html/rfc6298#section-2
+const (
+	rttAlpha     = 1.0 / 8
+	rttBeta      = 1.0 / 4
+	rttVarFactor = 4
+)
+
+// The gain for the smoothed loss rate. Each round trip moves the estimate 1/8 of the way to the loss seen on it.
+const lossGain = 1.0 / 8
+
+// The block sizes used at each loss rate. On lossy links smaller blocks mean less data is retransmitted each time a
+// packet is lost, at the cost of more round trips. Loss rates higher than every threshold use the smallest size.
+var lossBlockSizes = []struct {
+	maxLoss float64
+	szx     blockwise.SZX
+}{
+	{maxLoss: 0.05, szx: blockwise.SZX1024},
+	{maxLoss: 0.15, szx: blockwise.SZX512},
+	{maxLoss: 0.30, szx: blockwise.SZX256},
+	{maxLoss: 0.50, szx: blockwise.SZX128},
+}
+
+// LinkQuality is the measured quality of the link to a homeserver, and the transmission parameters picked from it
+// when AdaptiveTransmission is enabled.
+type LinkQuality struct {
+	// The number of round trips which have been measured
+	Samples int
+	// The smoothed round trip time, in milliseconds. This includes the time taken by the server to respond.
+	RTTMillis float64
+	// The variance of the round trip time, in milliseconds
+	RTTVarMillis float64
+	// The smoothed fraction of packets which were lost, between 0 and 1
+	LossRate float64
+	// The ACK timeout in use, in milliseconds
+	ACKTimeoutMillis float64
+	// The block size in bytes which will be used for the next connection to the homeserver
+	BlockSize int
+}
+
+// linkEstimator tracks the round trip time and packet loss of the link to a single host. It outlives connections
+// to the host, so new connections start with the parameters which suit the link rather than the defaults.
+type linkEstimator struct {
+	mu      sync.Mutex
+	samples int
+	srtt    time.Duration
+	rttvar  time.Duration
+	loss    float64
+	// the ACK timeout before clamping, 0 until there is a sample
+	rto time.Duration
+}
+
+// sample records a round trip which took rtt. ackTimeout and retryGap are the transmission parameters which were in
+// use, which are needed to work out how many times the request was retransmitted: the CoAP library does not say.
+// A response which takes longer than the ACK timeout counts as a loss even if it was just a slow server, as the
+// request was retransmitted anyway.
+func (l *linkEstimator) sample(rtt, ackTimeout, retryGap time.Duration) {
+	retransmits := 0
+	if ackTimeout > 0 {
+		retransmits = int(rtt / (ackTimeout + retryGap))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loss += lossGain * (float64(retransmits)/float64(retransmits+1) - l.loss)
+	if retransmits > 0 {
+		// Karn's algorithm: retransmitted round trips are ambiguous so don't measure them, back off instead
+		l.backoff(ackTimeout)
+		return
+	}
+	if l.samples == 0 {
+		l.srtt = rtt
+		l.rttvar = rtt / 2
+	} else {
+		diff := l.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		l.rttvar = time.Duration((1-rttBeta)*float64(l.rttvar) + rttBeta*float64(diff))
+		l.srtt = time.Duration((1-rttAlpha)*float64(l.srtt) + rttAlpha*float64(rtt))
+	}
+	l.samples++
+	l.rto = l.srtt + rttVarFactor*l.rttvar
+}
+
+// failed records a request which was retransmitted until the CoAP library gave up, so every packet was lost
+func (l *linkEstimator) failed(ackTimeout time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loss += lossGain * (1 - l.loss)
+	l.backoff(ackTimeout)
+}
+
+func (l *linkEstimator) backoff(ackTimeout time.Duration) {
+	l.rto = 2 * ackTimeout
+}
+
+// ackTimeout returns the ACK timeout to use, between the bounds in cp
+func (l *linkEstimator) ackTimeout(cp *ConnectionParams) time.Duration {
+	max := time.Duration(cp.TransmissionACKTimeoutSecs) * time.Second
+	min := time.Duration(cp.AdaptiveMinACKTimeoutSecs) * time.Second
+	l.mu.Lock()
+	rto := l.rto
+	l.mu.Unlock()
+	if rto == 0 || rto > max {
+		return max
+	}
+	if rto < min {
+		return min
+	}
+	return rto
+}
+
+// blockSZX returns the block size to use for new connections, which is never smaller than AdaptiveMinBlockSize
+func (l *linkEstimator) blockSZX(cp *ConnectionParams) blockwise.SZX {
+	minSZX, err := szxForBlockSize(cp.AdaptiveMinBlockSize)
+	if err != nil {
+		// SetParams has already checked this
+		minSZX = blockwiseSZX
+	}
+	l.mu.Lock()
+	loss := l.loss
+	l.mu.Unlock()
+	szx := lossBlockSizes[len(lossBlockSizes)-1].szx
+	for _, b := range lossBlockSizes {
+		if loss < b.maxLoss {
+			szx = b.szx
+			break
+		}
+	}
+	if szx < minSZX {
+		return minSZX
+	}
+	return szx
+}
+
+func (l *linkEstimator) quality(cp *ConnectionParams) *LinkQuality {
+	l.mu.Lock()
+	lq := &LinkQuality{
+		Samples:      l.samples,
+		RTTMillis:    millis(l.srtt),
+		RTTVarMillis: millis(l.rttvar),
+		LossRate:     l.loss,
+	}
+	l.mu.Unlock()
+	lq.ACKTimeoutMillis = millis(time.Duration(cp.TransmissionACKTimeoutSecs) * time.Second)
+	szx := blockwiseSZX
+	if cp.AdaptiveTransmission {
+		lq.ACKTimeoutMillis = millis(l.ackTimeout(cp))
+		szx = l.blockSZX(cp)
+	}
+	lq.BlockSize = int(fitPathMTU(cp, szx).Size())
+	return lq
+}
+
+// szxForBlockSize returns the SZX for a block size in bytes, which must be a power of 2 from 16 to 1024
+func szxForBlockSize(size int) (blockwise.SZX, error) {
+	for szx := blockwise.SZX16; szx <= blockwiseSZX; szx++ {
+		if int(szx.Size()) == size {
+			return szx, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid block size %d: must be a power of 2 from 16 to %d", size, blockwiseSZX.Size())
+}
+
+// MeasuredLinkQuality returns the measured quality of the link to the host in hsURL. Round trips are measured
+// whether or not AdaptiveTransmission is enabled, so this can be used to decide whether to enable it. Returns <nil>
+// if hsURL is invalid.
+func MeasuredLinkQuality(hsURL string) *LinkQuality {
+	u, err := url.Parse(hsURL)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse HS URL")
+		return nil
+	}
+	if u.Host == "" {
+		logrus.WithField("url", hsURL).Error("HS URL missing host")
+		return nil
+	}
+	return dc.linkFor(u.Host).quality(params())
+}
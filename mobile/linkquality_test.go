@@ -0,0 +1,284 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/lb"
+)
+
+// simulatedLink is a link where each packet is lost with probability loss and round trips take rtt plus up to
+// jitter either way
+type simulatedLink struct {
+	rand   *rand.Rand
+	rtt    time.Duration
+	jitter time.Duration
+	loss   float64
+}
+
+// roundTrip returns how long a confirmable request takes to be answered with the ACK timeout given, or false if
+// every retransmission was lost
+func (s *simulatedLink) roundTrip(ackTimeout time.Duration, maxRetransmits int) (time.Duration, bool) {
+	var waited time.Duration
+	for i := 0; i <= maxRetransmits; i++ {
+		rtt := s.rtt + time.Duration((s.rand.Float64()*2-1)*float64(s.jitter))
+		// either the request or the response can be lost
+		if s.rand.Float64() >= s.loss && s.rand.Float64() >= s.loss {
+			return waited + rtt, true
+		}
+		waited += ackTimeout
+	}
+	return 0, false
+}
+
+func (s *simulatedLink) drive(l *linkEstimator, cp *ConnectionParams, roundTrips int) {
+	for i := 0; i < roundTrips; i++ {
+		ackTimeout := l.ackTimeout(cp)
+		rtt, ok := s.roundTrip(ackTimeout, cp.TransmissionMaxRetransmits)
+		if !ok {
+			l.failed(ackTimeout)
+			continue
+		}
+		l.sample(rtt, ackTimeout, 0)
+	}
+}
+
+func TestLinkEstimatorSimulatedLink(t *testing.T) {
+	cp := defaultConnectionParams
+	cp.AdaptiveTransmission = true
+	maxACKTimeout := time.Duration(cp.TransmissionACKTimeoutSecs) * time.Second
+	minACKTimeout := time.Duration(cp.AdaptiveMinACKTimeoutSecs) * time.Second
+	l := &linkEstimator{}
+	if got := l.ackTimeout(&cp); got != maxACKTimeout {
+		t.Errorf("ACK timeout without measurements: got %v want %v", got, maxACKTimeout)
+	}
+	if got := l.blockSZX(&cp).Size(); got != 1024 {
+		t.Errorf("block size without measurements: got %d want 1024", got)
+	}
+
+	link := &simulatedLink{
+		rand:   rand.New(rand.NewSource(42)),
+		rtt:    1500 * time.Millisecond,
+		jitter: 500 * time.Millisecond,
+	}
+	// a slow but reliable link, e.g 2G: the ACK timeout should come down but stay above the RTT
+	link.drive(l, &cp, 100)
+	q := l.quality(&cp)
+	t.Logf("slow link: %+v", q)
+	if q.ACKTimeoutMillis >= millis(maxACKTimeout) || q.ACKTimeoutMillis <= q.RTTMillis {
+		t.Errorf("slow link: got ACK timeout %vms want between RTT %vms and %v", q.ACKTimeoutMillis, q.RTTMillis, maxACKTimeout)
+	}
+	if q.BlockSize != 1024 || q.LossRate != 0 {
+		t.Errorf("slow link: got block size %d and loss rate %v want 1024 and 0", q.BlockSize, q.LossRate)
+	}
+
+	// a fast but lossy link: blocks should get smaller, and the ACK timeout should stay within bounds
+	link.rtt = 100 * time.Millisecond
+	link.jitter = 20 * time.Millisecond
+	link.loss = 0.15
+	link.drive(l, &cp, 200)
+	q = l.quality(&cp)
+	t.Logf("lossy link: %+v", q)
+	if q.BlockSize >= 1024 || q.BlockSize < cp.AdaptiveMinBlockSize {
+		t.Errorf("lossy link: got block size %d want less than 1024 and at least %d", q.BlockSize, cp.AdaptiveMinBlockSize)
+	}
+	if q.LossRate < 0.05 {
+		t.Errorf("lossy link: got loss rate %v want at least 0.05", q.LossRate)
+	}
+	if q.ACKTimeoutMillis < millis(minACKTimeout) || q.ACKTimeoutMillis > millis(maxACKTimeout) {
+		t.Errorf("lossy link: got ACK timeout %vms want between %v and %v", q.ACKTimeoutMillis, minACKTimeout, maxACKTimeout)
+	}
+	// the block size never goes below the configured minimum
+	minBlockParams := cp
+	minBlockParams.AdaptiveMinBlockSize = 1024
+	if got := l.blockSZX(&minBlockParams).Size(); got != 1024 {
+		t.Errorf("lossy link with AdaptiveMinBlockSize 1024: got block size %d", got)
+	}
+
+	// the link recovers
+	link.loss = 0
+	link.drive(l, &cp, 100)
+	q = l.quality(&cp)
+	t.Logf("recovered link: %+v", q)
+	if q.BlockSize != 1024 {
+		t.Errorf("recovered link: got block size %d want 1024", q.BlockSize)
+	}
+	if q.ACKTimeoutMillis != millis(minACKTimeout) {
+		t.Errorf("recovered link: got ACK timeout %vms want %v", q.ACKTimeoutMillis, minACKTimeout)
+	}
+
+	// the params are not used unless enabled
+	cp.AdaptiveTransmission = false
+	if q = l.quality(&cp); q.ACKTimeoutMillis != millis(maxACKTimeout) {
+		t.Errorf("AdaptiveTransmission disabled: got ACK timeout %vms want %v", q.ACKTimeoutMillis, maxACKTimeout)
+	}
+}
+
+// lossyRelay forwards UDP packets between clients and the server at serverAddr. When dropping is set, every third
+// packet from the server is dropped.
+type lossyRelay struct {
+	pc       net.PacketConn
+	dropping int32 // accessed atomically
+	dropped  int32 // accessed atomically
+	count    int32 // accessed atomically
+	sent     int32 // the number of packets from clients, accessed atomically
+}
+
+func newLossyRelay(t *testing.T, serverAddr string) *lossyRelay {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	r := &lossyRelay{pc: pc}
+	// each client gets its own socket to the server, so the server sees each connection coming from a new address
+	servers := make(map[string]net.Conn)
+	t.Cleanup(func() {
+		pc.Close()
+		for _, server := range servers {
+			server.Close()
+		}
+	})
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, clientAddr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server, ok := servers[clientAddr.String()]
+			if !ok {
+				server, err = net.Dial("udp", serverAddr)
+				if err != nil {
+					t.Errorf("failed to dial server: %s", err)
+					return
+				}
+				servers[clientAddr.String()] = server
+				go r.fromServer(server, clientAddr)
+			}
+			atomic.AddInt32(&r.sent, 1)
+			server.Write(buf[:n])
+		}
+	}()
+	return r
+}
+
+func (r *lossyRelay) fromServer(server net.Conn, clientAddr net.Addr) {
+	buf := make([]byte, 2048)
+	for {
+		n, err := server.Read(buf)
+		if err != nil {
+			return
+		}
+		if atomic.LoadInt32(&r.dropping) == 1 && atomic.AddInt32(&r.count, 1)%3 == 1 {
+			atomic.AddInt32(&r.dropped, 1)
+			continue
+		}
+		r.pc.WriteTo(buf[:n], clientAddr)
+	}
+}
+
+func TestAdaptiveTransmissionLossyLink(t *testing.T) {
+	serverURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	}))
+	relay := newLossyRelay(t, strings.TrimPrefix(serverURL, "https://"))
+	hsURL := "https://" + relay.pc.LocalAddr().String()
+	cp := Params()
+	cp.AdaptiveTransmission = true
+	cp.AdaptiveMinACKTimeoutSecs = 1
+	cp.TransmissionNStart = 0
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+
+	// a fast link should bring the ACK timeout down to the minimum
+	for i := 0; i < 5; i++ {
+		if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+			t.Fatalf("SendRequest failed: %+v", res)
+		}
+	}
+	q := MeasuredLinkQuality(hsURL)
+	t.Logf("fast link: %+v", q)
+	if q.Samples != 5 || q.ACKTimeoutMillis != 1000 || q.LossRate != 0 || q.BlockSize != 1024 {
+		t.Errorf("fast link: got %+v want 5 samples, 1000ms ACK timeout, no loss and 1024 byte blocks", q)
+	}
+
+	// lose a third of the responses
+	atomic.StoreInt32(&relay.dropping, 1)
+	for i := 0; i < 6; i++ {
+		if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+			t.Fatalf("SendRequest on lossy link failed: %+v", res)
+		}
+	}
+	atomic.StoreInt32(&relay.dropping, 0)
+	q = MeasuredLinkQuality(hsURL)
+	t.Logf("lossy link: %+v, dropped %d packets", q, atomic.LoadInt32(&relay.dropped))
+	if q.LossRate < 0.05 || q.BlockSize >= 1024 {
+		t.Fatalf("lossy link: got %+v want a loss rate of at least 0.05 and smaller blocks", q)
+	}
+
+	// new connections use the smaller block size
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	reqBody := `{"data":"` + strings.Repeat("x", 3000) + `"}`
+	cborBody, err := lb.NewCBORCodecV1(false).JSONToCBOR(bytes.NewBufferString(reqBody))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil {
+		t.Fatalf("SendRequest returned nil")
+	}
+	before := CurrentStats()
+	res := SendRequest("PUT", hsURL+"/_matrix/client/r0/user/@alice:bar/account_data/com.example.big", "secret", reqBody)
+	if res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest with a large body failed: %+v", res)
+	}
+	after := CurrentStats()
+	wantBlocks := numBlocks(int64(len(cborBody)), int64(q.BlockSize)) + 1
+	if got := after.BlockwiseBlocks - before.BlockwiseBlocks; got != wantBlocks {
+		t.Errorf("BlockwiseBlocks: got %d want %d for %d byte blocks", got, wantBlocks, q.BlockSize)
+	}
+}
+
+func TestSetParamsAdaptiveMinBlockSize(t *testing.T) {
+	defaultParams := *Params()
+	t.Cleanup(func() { SetParams(&defaultParams) })
+	cp := Params()
+	cp.AdaptiveTransmission = true
+	for _, size := range []int{0, 100, 2048} {
+		cp.AdaptiveMinBlockSize = size
+		if err := SetParams(cp); err == nil {
+			t.Errorf("SetParams accepted AdaptiveMinBlockSize %d", size)
+		}
+	}
+	cp.AdaptiveMinBlockSize = 512
+	if err := SetParams(cp); err != nil {
+		t.Errorf("SetParams with AdaptiveMinBlockSize 512: %s", err)
+	}
+}
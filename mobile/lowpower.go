@@ -0,0 +1,154 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EnterLowPowerObserveMode keeps observations alive as cheaply as possible while the app is in the background but
+// wants to keep sync warm, deferring their notifications until ExitLowPowerObserveMode. Call it instead of
+// OnAppBackground: idle connections without observations are closed just the same, but connections with
+// observations are kept open as with ObservePinInBackground. The only traffic the device then sends is the
+// keep-alive pings, CoAP Empty messages sent when the connection has been quiet for a while, and the ACKs of
+// notifications, which is enough for the DTLS session, the NAT binding and the server's registrations to survive.
+// Notifications keep arriving, but callbacks are not called so the app can stay asleep: up to
+// LowPowerMaxDeferredNotifications stream notifications are buffered, dropping the oldest when full, and /sync
+// notifications for ObserveDeviceLists and ObserveAccountData are merged as with ObserveCoalesceMs. /sync
+// responses are buffered for SendRequest up to ObserveBufferSize, as usual. The mode is in
+// CurrentStats().LowPowerObserveMode.
+func EnterLowPowerObserveMode() {
+	logrus.Info("Entering low-power observe mode, closing idle connections")
+	lowPower.enter()
+	for _, conn := range dc.onBackground(true) {
+		closeConn(conn, ObserveEndedBackground)
+	}
+}
+
+// ExitLowPowerObserveMode passes the notifications deferred since EnterLowPowerObserveMode to their callbacks, in
+// the order they arrived, then reconnects and refreshes observations as OnAppForeground does.
+func ExitLowPowerObserveMode() {
+	n := lowPower.exit()
+	logrus.Infof("Exited low-power observe mode, delivered %d deferred notifications", n)
+	OnAppForeground()
+}
+
+func isLowPowerObserveMode() bool {
+	lowPower.mu.Lock()
+	defer lowPower.mu.Unlock()
+	return lowPower.on
+}
+
+// lowPower holds the callbacks of observations while in low-power observe mode
+var lowPower lowPowerMode
+
+type lowPowerMode struct {
+	mu       sync.Mutex
+	on       bool
+	deferred []deferredCallback
+}
+
+// deferredCallback is a callback of an observation which is waiting for low-power observe mode to end
+type deferredCallback struct {
+	fn func()
+	// true for a notification, which can be dropped when the buffer is full, false for e.g OnClosed, which is
+	// always delivered
+	notification bool
+}
+
+func (m *lowPowerMode) enter() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.on = true
+}
+
+// exit calls the deferred callbacks and leaves low-power observe mode, returning the number of notifications
+// delivered. Callbacks deferred while delivering are delivered too, so none overtake those already waiting.
+func (m *lowPowerMode) exit() (notifications int) {
+	for {
+		m.mu.Lock()
+		deferred := m.deferred
+		m.deferred = nil
+		if len(deferred) == 0 {
+			m.on = false
+			m.mu.Unlock()
+			return notifications
+		}
+		m.mu.Unlock()
+		for _, d := range deferred {
+			if d.notification {
+				notifications++
+			}
+			d.fn()
+		}
+	}
+}
+
+// deliverObserveCallback calls fn, unless in low-power observe mode in which case it is deferred until the mode ends.
+// notification is true if fn passes on a notification.
+func deliverObserveCallback(notification bool, fn func()) {
+	lowPower.mu.Lock()
+	if !lowPower.on {
+		lowPower.mu.Unlock()
+		fn()
+		return
+	}
+	defer lowPower.mu.Unlock()
+	if notification {
+		recordDeferredNotification()
+		if lowPower.countNotificationsLocked() >= params().LowPowerMaxDeferredNotifications && !lowPower.dropOldestLocked() {
+			// there is no room at all
+			recordDroppedDeferredNotification()
+			return
+		}
+	}
+	lowPower.deferred = append(lowPower.deferred, deferredCallback{fn: fn, notification: notification})
+}
+
+func (m *lowPowerMode) countNotificationsLocked() (n int) {
+	for _, d := range m.deferred {
+		if d.notification {
+			n++
+		}
+	}
+	return n
+}
+
+// dropNotifications removes every deferred notification, keeping callbacks like OnClosed
+func (m *lowPowerMode) dropNotifications() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.deferred[:0]
+	for _, d := range m.deferred {
+		if !d.notification {
+			kept = append(kept, d)
+		}
+	}
+	m.deferred = kept
+}
+
+// dropOldestLocked removes the oldest deferred notification, returning false if there are none
+func (m *lowPowerMode) dropOldestLocked() bool {
+	for i, d := range m.deferred {
+		if d.notification {
+			m.deferred = append(m.deferred[:i], m.deferred[i+1:]...)
+			recordDroppedDeferredNotification()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/lb"
+)
+
+// TestLowPowerObserveMode checks that heartbeats keep the connection of a stream alive in low-power observe mode,
+// and that its notifications are only delivered on exit, dropping the oldest once the buffer is full
+func TestLowPowerObserveMode(t *testing.T) {
+	release := make(chan struct{})
+	var polls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+			return
+		}
+		n := atomic.AddInt32(&polls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(fmt.Sprintf(`{"n":%d}`, n)))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	handler := lb.CBORToJSONHandler(next, codec, nil)
+	observations := lb.NewSyncObservations(handler, coapHTTP.Paths, codec)
+	serverURL := newCoAPTestServer(t, "127.0.0.1:0", coapHTTP.CoAPHTTPHandler(handler, observations),
+		dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+	relay := newLossyRelay(t, strings.TrimPrefix(serverURL, "https://"))
+	host := relay.pc.LocalAddr().String()
+	cp := Params()
+	// ping after a second without traffic
+	cp.HeartbeatTimeoutSecs = 1
+	cp.KeepAliveTimeoutSecs = cp.KeepAliveMaxRetries + 1
+	cp.LowPowerMaxDeferredNotifications = 2
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+
+	notifications := make(chan string, 10)
+	s := ObserveStream("https://"+host+"/_matrix/client/r0/account/whoami", "secret", &streamFuncs{
+		notification: func(code int, body string) { notifications <- body },
+		closed:       func() {},
+	})
+	if s == nil {
+		t.Fatalf("ObserveStream returned nil")
+	}
+	defer close(release)
+	defer s.Cancel()
+	release <- struct{}{}
+	select {
+	case got := <-notifications:
+		if got != `{"n":1}` {
+			t.Errorf("got notification %s want n=1", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a notification")
+	}
+
+	EnterLowPowerObserveMode()
+	defer func() {
+		if isLowPowerObserveMode() {
+			ExitLowPowerObserveMode()
+		}
+	}()
+	if !CurrentStats().LowPowerObserveMode {
+		t.Errorf("CurrentStats().LowPowerObserveMode is false after EnterLowPowerObserveMode")
+	}
+	before := CurrentStats()
+	for i := 0; i < 3; i++ {
+		release <- struct{}{}
+	}
+	waitFor(t, "the notifications to be deferred", func() bool {
+		return CurrentStats().DeferredNotifications-before.DeferredNotifications == 3
+	})
+	if got := CurrentStats().DroppedDeferredNotifications - before.DroppedDeferredNotifications; got != 1 {
+		t.Errorf("DroppedDeferredNotifications: got %d more want 1", got)
+	}
+	// nothing is sent apart from the pings which keep the connection alive
+	sent := atomic.LoadInt32(&relay.sent)
+	time.Sleep(3 * time.Second)
+	if got := atomic.LoadInt32(&relay.sent) - sent; got < 1 {
+		t.Errorf("got %d packets sent in low-power observe mode want heartbeats", got)
+	}
+	if dc.isConnClosed(host) {
+		t.Errorf("connection of the stream was closed in low-power observe mode")
+	}
+	select {
+	case got := <-notifications:
+		t.Fatalf("got notification %s in low-power observe mode", got)
+	default:
+	}
+
+	// the oldest notification was dropped, and the rest are delivered in order before ExitLowPowerObserveMode returns
+	ExitLowPowerObserveMode()
+	for _, want := range []string{`{"n":3}`, `{"n":4}`} {
+		select {
+		case got := <-notifications:
+			if got != want {
+				t.Errorf("got deferred notification %s want %s", got, want)
+			}
+		default:
+			t.Fatalf("deferred notification %s was not delivered by ExitLowPowerObserveMode", want)
+		}
+	}
+	if CurrentStats().LowPowerObserveMode {
+		t.Errorf("CurrentStats().LowPowerObserveMode is true after ExitLowPowerObserveMode")
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/sirupsen/logrus"
+)
+
+// MigrateTo moves every connection onto another network interface, e.g from Wi-Fi which is fading to cellular.
+// The hint is an interface name (e.g "wlan0"), or a local IP address on the interface. An empty hint lets the OS
+// pick the interface again. New connections are made from the interface before the old ones are dropped, so
+// requests in-flight on the old connections finish first and new requests don't wait. Streams from ObserveStream
+// are registered again on the new connections, and /sync observations resume on the next /sync request. Returns
+// false if the hint is not a usable interface, in which case nothing changes, or if a connection could not be
+// made from the interface, in which case the old connection to that host is kept and new connections are made from
+// the previous interface again.
+func MigrateTo(interfaceHint string) bool {
+	local, err := localAddrFor(interfaceHint)
+	if err != nil {
+		logrus.WithError(err).Errorf("MigrateTo: cannot migrate to interface %q", interfaceHint)
+		return false
+	}
+	old, previous := dc.migrate(local)
+	logrus.Infof("MigrateTo: migrating %d connections to interface %q", len(old), interfaceHint)
+	ok := true
+	for host, oldConn := range old {
+		conn, err := dc.getClientForHost(host)
+		if err != nil {
+			logrus.WithError(err).Warnf("MigrateTo: failed to connect to host %s, keeping the old connection", host)
+			dc.restore(host, oldConn, local, previous)
+			ok = false
+			continue
+		}
+		for _, s := range streamsOn(oldConn) {
+			s.migrate(conn)
+		}
+		dc.drain(oldConn)
+	}
+	return ok
+}
+
+// localAddrFor returns the local address to send from for an interface hint, or nil if the hint is empty
+func localAddrFor(hint string) (*net.UDPAddr, error) {
+	if hint == "" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(hint); ip != nil {
+		return &net.UDPAddr{IP: ip}, nil
+	}
+	iface, err := net.InterfaceByName(hint)
+	if err != nil {
+		return nil, fmt.Errorf("unknown interface or address: %w", err)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface %s is down", hint)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of interface %s: %w", hint, err)
+	}
+	// prefer IPv4 as most homeservers have an A record. Link-local addresses can't reach a homeserver.
+	var v6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return &net.UDPAddr{IP: ipNet.IP}, nil
+		}
+		if v6 == nil {
+			v6 = ipNet.IP
+		}
+	}
+	if v6 == nil {
+		return nil, fmt.Errorf("interface %s has no usable address", hint)
+	}
+	return &net.UDPAddr{IP: v6}, nil
+}
+
+// migrate makes new connections send from local, then forgets all existing conns so the next request to each host
+// makes a new one. The old conns are returned so they can be replaced, along with the previous local address.
+func (c *dtlsClients) migrate(local *net.UDPAddr) (map[string]*client.ClientConn, *net.UDPAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := c.localAddr
+	c.localAddr = local
+	old := c.conns
+	c.conns = make(map[string]*client.ClientConn)
+	return old, previous
+}
+
+// restore puts back the old conn to host when a new one could not be made from local, unless another request has
+// made one. New connections are made from previous again, unless another migration has happened since.
+func (c *dtlsClients) restore(host string, conn *client.ClientConn, local, previous *net.UDPAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.conns[host]; !ok {
+		c.conns[host] = conn
+	}
+	if c.localAddr == local {
+		c.localAddr = previous
+	}
+}
+
+// forget removes conn from the conns, so the next request to its host makes a new one. It should then be drained.
+func (c *dtlsClients) forget(conn *client.ClientConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for host, co := range c.conns {
+		if co == conn {
+			delete(c.conns, host)
+		}
+	}
+}
+
+// drain closes a conn which has been replaced once its in-flight requests have finished
+func (c *dtlsClients) drain(conn *client.ClientConn) {
+	c.mu.Lock()
+	idle := c.inFlight[conn] <= 0
+	if !idle {
+		c.draining[conn] = true
+		conn.AddOnClose(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			delete(c.draining, conn)
+		})
+	}
+	c.mu.Unlock()
+	if idle {
+		closeConn(conn, ObserveEndedReconnect)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/lb"
+)
+
+// TestMigrateTo simulates switching interfaces by sending from another loopback address, which the server sees
+// as the client moving to a new address
+func TestMigrateTo(t *testing.T) {
+	var polls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		if req.URL.Path != "/_matrix/client/r0/account/whoami" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(fmt.Sprintf(`{"n":%d}`, atomic.AddInt32(&polls, 1))))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	handler := lb.CBORToJSONHandler(next, codec, nil)
+	observations := lb.NewSyncObservations(handler, coapHTTP.Paths, codec)
+	coapHandler := coapHTTP.CoAPHTTPHandler(handler, observations)
+	var mu sync.Mutex
+	var lastClientIP string
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		ip, _, _ := net.SplitHostPort(w.Client().RemoteAddr().String())
+		mu.Lock()
+		lastClientIP = ip
+		mu.Unlock()
+		coapHandler.ServeCOAP(w, r)
+	}), dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+	t.Cleanup(func() {
+		MigrateTo("")
+	})
+	clientIP := func() string {
+		if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+			t.Fatalf("SendRequest: got %+v", res)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return lastClientIP
+	}
+	if got := clientIP(); got != "127.0.0.1" {
+		t.Fatalf("client IP before migrating: got %s want 127.0.0.1", got)
+	}
+
+	notifications := make(chan string, 100)
+	closed := make(chan struct{}, 1)
+	s := ObserveStream(hsURL+"/_matrix/client/r0/account/whoami", "secret", &streamFuncs{
+		notification: func(code int, body string) {
+			notifications <- body
+		},
+		closed: func() {
+			closed <- struct{}{}
+		},
+	})
+	if s == nil {
+		t.Fatalf("ObserveStream returned nil")
+	}
+	defer s.Cancel()
+	waitForNotification := func(msg string) {
+		t.Helper()
+		select {
+		case <-notifications:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a notification %s", msg)
+		}
+	}
+	waitForNotification("before migrating")
+
+	if !MigrateTo("127.0.0.2") {
+		t.Fatalf("MigrateTo returned false")
+	}
+	if got := clientIP(); got != "127.0.0.2" {
+		t.Errorf("client IP after migrating: got %s want 127.0.0.2", got)
+	}
+	// the stream carries on over the new connection
+	for len(notifications) > 0 {
+		<-notifications
+	}
+	waitForNotification("after migrating")
+	select {
+	case <-closed:
+		t.Fatalf("stream was closed by migrating")
+	default:
+	}
+
+	// unusable interfaces change nothing
+	if MigrateTo("no-such-interface0") {
+		t.Errorf("MigrateTo an unknown interface returned true")
+	}
+	if got := clientIP(); got != "127.0.0.2" {
+		t.Errorf("client IP after failing to migrate: got %s want 127.0.0.2", got)
+	}
+
+	// an address which connections cannot be made from keeps the old connection, and new connections are made
+	// from the old interface
+	if MigrateTo("192.0.2.1") {
+		t.Errorf("MigrateTo an address which is not local returned true")
+	}
+	if got := clientIP(); got != "127.0.0.2" {
+		t.Errorf("client IP after failing to connect: got %s want 127.0.0.2", got)
+	}
+	u, _ := url.Parse(hsURL)
+	conn, err := dc.getClientForHost(u.Host)
+	if err != nil {
+		t.Fatalf("getClientForHost: %s", err)
+	}
+	dc.forget(conn)
+	dc.drain(conn)
+	if got := clientIP(); got != "127.0.0.2" {
+		t.Errorf("client IP of a new connection after failing to connect: got %s want 127.0.0.2", got)
+	}
+
+	// migrating back to the default interface
+	if !MigrateTo("") {
+		t.Fatalf("MigrateTo the default interface returned false")
+	}
+	if got := clientIP(); got != "127.0.0.1" {
+		t.Errorf("client IP after migrating back: got %s want 127.0.0.1", got)
+	}
+}
+
+func TestLocalAddrFor(t *testing.T) {
+	if addr, err := localAddrFor(""); addr != nil || err != nil {
+		t.Errorf("empty hint: got %v, %v want nil, nil", addr, err)
+	}
+	if addr, err := localAddrFor("10.1.2.3"); err != nil || addr.IP.String() != "10.1.2.3" {
+		t.Errorf("IP hint: got %v, %v want 10.1.2.3", addr, err)
+	}
+	if _, err := localAddrFor("no-such-interface0"); err == nil {
+		t.Errorf("unknown interface: got no error")
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("Interfaces: %s", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addr, err := localAddrFor(iface.Name)
+		if err != nil {
+			t.Fatalf("loopback interface %s: %s", iface.Name, err)
+		}
+		if !addr.IP.IsLoopback() {
+			t.Errorf("loopback interface %s: got address %s", iface.Name, addr.IP)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// The IPv6 and UDP headers of every datagram. IPv4 headers are smaller, so this is the worst case.
+	ipUDPOverhead = 40 + 8
+	// The DTLS record header, explicit nonce and AEAD tag around every CoAP message with AES-GCM
+	dtlsRecordOverhead = 13 + 8 + 16
+	// The room left in each datagram for the CoAP header, token and options when picking a block size for PathMTU.
+	// Requests with more options than this, e.g a long access token, are still sent, but are counted in MTUExceeded.
+	coapHeaderAllowance = 128
+	// The smallest PathMTU which fits a 16 byte block
+	minPathMTU = ipUDPOverhead + dtlsRecordOverhead + coapHeaderAllowance + 16
+)
+
+// mtuBlockSZX returns the largest block size which fits in a datagram of pathMTU bytes with room for the headers
+func mtuBlockSZX(pathMTU int) (blockwise.SZX, error) {
+	if pathMTU < minPathMTU {
+		return 0, fmt.Errorf("must be 0 or at least %d bytes to fit a block, got %d", minPathMTU, pathMTU)
+	}
+	room := pathMTU - ipUDPOverhead - dtlsRecordOverhead - coapHeaderAllowance
+	szx := blockwiseSZX
+	for int(szx.Size()) > room {
+		szx--
+	}
+	return szx, nil
+}
+
+// fitPathMTU returns szx, or a smaller block size if blocks of szx would not fit in PathMTU
+func fitPathMTU(cp *ConnectionParams, szx blockwise.SZX) blockwise.SZX {
+	if cp.PathMTU == 0 {
+		return szx
+	}
+	mtuSZX, err := mtuBlockSZX(cp.PathMTU)
+	if err != nil {
+		// SetParams has already checked this
+		return szx
+	}
+	if mtuSZX < szx {
+		return mtuSZX
+	}
+	return szx
+}
+
+// checkDatagramSize warns if a CoAP message with these header and body sizes, sent whole or as the first block of
+// blockSize, is a datagram larger than PathMTU, which the network may fragment or drop
+func checkDatagramSize(cp *ConnectionParams, what string, headerSize int, bodySize, blockSize int64) {
+	if cp.PathMTU == 0 {
+		return
+	}
+	if bodySize > blockSize {
+		bodySize = blockSize
+	}
+	size := ipUDPOverhead + dtlsRecordOverhead + int64(headerSize) + bodySize
+	if size <= int64(cp.PathMTU) {
+		return
+	}
+	logrus.Warnf("%s is a %d byte datagram with %d bytes of CoAP header and options, which exceeds PathMTU %d and may be fragmented or dropped",
+		what, size, headerSize, cp.PathMTU)
+	recordMTUExceeded()
+}
+
+// dtlsMTU returns the size to fragment DTLS handshake messages to, or 0 for the library's default
+func dtlsMTU(cp *ConnectionParams) int {
+	if cp.PathMTU == 0 {
+		return 0
+	}
+	return cp.PathMTU - ipUDPOverhead
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// datagramSizeConn records the size of the largest datagram of application data written to and read from a conn
+type datagramSizeConn struct {
+	net.Conn
+	mu           sync.Mutex
+	largestWrite int
+	largestRead  int
+}
+
+func (c *datagramSizeConn) Write(b []byte) (int, error) {
+	if len(b) > 0 && b[0] == dtlsContentTypeApplicationData {
+		c.mu.Lock()
+		if len(b) > c.largestWrite {
+			c.largestWrite = len(b)
+		}
+		c.mu.Unlock()
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *datagramSizeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && b[0] == dtlsContentTypeApplicationData {
+		c.mu.Lock()
+		if n > c.largestRead {
+			c.largestRead = n
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *datagramSizeConn) largest() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.largestWrite, c.largestRead
+}
+
+// TestPathMTU checks that with a small PathMTU, request and response bodies are sent block-wise in blocks which keep
+// every datagram under it, and that a request whose options alone exceed it is counted
+func TestPathMTU(t *testing.T) {
+	body := `{"data":"` + strings.Repeat("x", 3000) + `"}`
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reqBody, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		if req.Method == "PUT" {
+			w.Write([]byte(`{"size":` + strconv.Itoa(len(reqBody)) + `}`))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	cp := Params()
+	cp.PathMTU = 400
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	conns := make(chan *datagramSizeConn, 1)
+	SetTransportWrapper(func(conn net.Conn) net.Conn {
+		sized := &datagramSizeConn{Conn: conn}
+		conns <- sized
+		return sized
+	})
+	t.Cleanup(func() {
+		SetTransportWrapper(nil)
+		cp := Params()
+		cp.PathMTU = 0
+		SetParams(cp)
+	})
+	if lq := MeasuredLinkQuality(hsURL); lq == nil || lq.BlockSize != 128 {
+		t.Errorf("got link quality %+v want a block size of 128 for a PathMTU of 400", lq)
+	}
+
+	before := CurrentStats()
+	res := SendRequest("GET", hsURL+"/_matrix/client/r0/rooms/!a:localhost/state/m.room.topic", "secret", "")
+	if res == nil || res.Code != 200 || res.Body != body {
+		t.Fatalf("GET: got %+v want a 200 with the %d byte body", res, len(body))
+	}
+	res = SendRequest("PUT", hsURL+"/_matrix/client/r0/rooms/!a:localhost/state/m.room.topic", "secret", body)
+	if want := `{"size":` + strconv.Itoa(len(body)) + `}`; res == nil || res.Code != 200 || res.Body != want {
+		t.Fatalf("PUT: got %+v want a 200 with %s", res, want)
+	}
+	after := CurrentStats()
+	if got, want := after.BlockwiseBlocks-before.BlockwiseBlocks, int64(2*len(body)/128); got < want {
+		t.Errorf("got %d blocks want at least %d", got, want)
+	}
+	if after.MTUExceeded != before.MTUExceeded {
+		t.Errorf("got MTUExceeded %d more want none", after.MTUExceeded-before.MTUExceeded)
+	}
+	conn := <-conns
+	largestWrite, largestRead := conn.largest()
+	if limit := cp.PathMTU - ipUDPOverhead; largestWrite > limit || largestRead > limit {
+		t.Errorf("largest datagram written %d bytes and read %d bytes, want at most %d", largestWrite, largestRead, limit)
+	}
+
+	// a new access token is sent in full
+	SendRequest("GET", hsURL+"/_matrix/client/versions", strings.Repeat("t", 400), "")
+	if got := CurrentStats().MTUExceeded - after.MTUExceeded; got != 1 {
+		t.Errorf("request with a long access token: got MTUExceeded %d more want 1", got)
+	}
+}
@@ -0,0 +1,966 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	udpmessage "github.com/matrix-org/go-coap/v2/udp/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+	"github.com/matrix-org/lb"
+	"github.com/sirupsen/logrus"
+)
+
+// DeviceListsCallback is notified of device list changes, e.g to re-fetch keys
+type DeviceListsCallback interface {
+	// OnDeviceLists is called with comma separated lists of user IDs whose devices have changed, and
+	// user IDs who no longer share an encrypted room with the user. Either may be empty.
+	OnDeviceLists(changed, left string)
+}
+
+// AccountDataCallback is notified of global account data changes
+type AccountDataCallback interface {
+	// OnAccountData is called once per account data event with the event type and JSON content
+	OnAccountData(eventType, content string)
+}
+
+// SyncEndedCallback can be satisfied by the callbacks of ObserveDeviceLists and ObserveAccountData as well, to be told
+// when the /sync observation they are listening to ends. The listener stays registered, and is notified again once
+// /sync is observed again, which happens on the next SendRequest to /sync or call to ObserveDeviceLists or
+// ObserveAccountData.
+type SyncEndedCallback interface {
+	// OnSyncEnded is called with one of the ObserveEnded reasons
+	OnSyncEnded(reason string)
+}
+
+// The reasons a /sync observation ends, which are passed to SyncEndedCallback and counted in Stats. The connection
+// was closed in the first three, so the app should reconnect when it next needs to, whereas in the rest the server
+// stopped the observation on a connection which may still work, so the app can observe again straight away, which
+// makes a new connection. ObserveEndedCancelled is only counted in Stats, as CancelAll removes the listeners first.
+const (
+	// OnAppBackground closed the connection
+	ObserveEndedBackground = "background"
+	// MigrateTo or SetParams replaced the connection with a new one
+	ObserveEndedReconnect = "reconnect"
+	// The connection failed, e.g the DTLS session broke or keep-alives went unanswered, so the device may be offline
+	ObserveEndedConnectionLost = "connection_lost"
+	// The server did not answer a re-registration within ObserveRefreshSecs
+	ObserveEndedTimeout = "timeout"
+	// The server refused a re-registration, e.g because it no longer accepts the access token
+	ObserveEndedRejected = "rejected"
+	// The server stopped the observation with an error notification, e.g because the homeserver returned an error
+	ObserveEndedServerError = "server_error"
+	// CancelAll ended the observation, e.g because the user logged out
+	ObserveEndedCancelled = "cancelled"
+)
+
+// SyncResetCallback can be satisfied by the callbacks of ObserveDeviceLists and ObserveAccountData as well, to be told
+// when /sync starts again from an initial sync, rather than from the since token of the last notification. The
+// responses which follow are a full initial sync, so the app must not treat their device lists and account data as
+// changes since the ones it has already seen.
+type SyncResetCallback interface {
+	// OnSyncReset is called with one of the SyncReset reasons, before the initial sync arrives
+	OnSyncReset(reason string)
+}
+
+// The reasons /sync starts again from an initial sync, which are passed to SyncResetCallback
+const (
+	// The since token was older than ObserveSinceMaxAgeSecs when the observation was resumed
+	SyncResetExpired = "expired"
+	// The server rejected the since token, e.g because it had expired
+	SyncResetRejected = "rejected"
+)
+
+// syncSlices are the parts of a /sync response which can be observed separately
+type syncSlices struct {
+	AccountData struct {
+		Events []struct {
+			Type    string          `json:"type"`
+			Content json.RawMessage `json:"content"`
+		} `json:"events"`
+	} `json:"account_data"`
+	DeviceLists struct {
+		Changed []string `json:"changed"`
+		Left    []string `json:"left"`
+	} `json:"device_lists"`
+}
+
+// ErrTooManyObserves is wrapped by the error logged when an observation is refused because MaxObserves
+// observations are already registered
+var ErrTooManyObserves = errors.New("too_many_observes")
+
+// reserveObserve counts a new observation, returning an error wrapping ErrTooManyObserves if there are already
+// MaxObserves. The observation must be released with releaseObserve when it ends.
+func reserveObserve() error {
+	max := int64(params().MaxObserves)
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if max > 0 && stats.Observes >= max {
+		stats.RefusedObserves++
+		return fmt.Errorf("%w: %d observations are registered, the limit is %d", ErrTooManyObserves, stats.Observes, max)
+	}
+	stats.Observes++
+	return nil
+}
+
+func releaseObserve() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.Observes--
+}
+
+type syncListener struct {
+	fn    func(s *syncSlices)
+	ended func(reason string) // may be nil
+	reset func(reason string) // may be nil
+}
+
+var (
+	syncListenersMu sync.Mutex
+	syncListeners   = make(map[string][]*syncListener) // host -> listeners
+	// responses waiting for ObserveCoalesceMs to pass before the listeners see them
+	pendingSyncs = make(map[string]*pendingSync) // host -> responses
+	// held while delivering coalesced responses, so they reach listeners in order
+	syncDeliverMu sync.Mutex
+)
+
+// pendingSync is the merge of the /sync responses for a host which arrived within ObserveCoalesceMs
+type pendingSync struct {
+	slices syncSlices
+	timer  *time.Timer
+}
+
+// ObserveDeviceLists observes /sync on the homeserver and calls cb whenever device lists change, without the
+// client needing to parse whole /sync responses. Returns false if the observation could not be made.
+//
+// The observation is shared with SendRequest, so the /sync responses it sees are the same.
+func ObserveDeviceLists(hsURL, token string, cb DeviceListsCallback) bool {
+	return observeSync(hsURL, token, deviceListsListener(cb))
+}
+
+// ObserveAccountData observes /sync on the homeserver and calls cb for each global account data event.
+// Returns false if the observation could not be made.
+//
+// The observation is shared with SendRequest, so the /sync responses it sees are the same.
+func ObserveAccountData(hsURL, token string, cb AccountDataCallback) bool {
+	return observeSync(hsURL, token, accountDataListener(cb))
+}
+
+func deviceListsListener(cb DeviceListsCallback) *syncListener {
+	return &syncListener{fn: func(s *syncSlices) {
+		if len(s.DeviceLists.Changed) == 0 && len(s.DeviceLists.Left) == 0 {
+			return
+		}
+		cb.OnDeviceLists(strings.Join(s.DeviceLists.Changed, ","), strings.Join(s.DeviceLists.Left, ","))
+	}, ended: syncEndedFunc(cb), reset: syncResetFunc(cb)}
+}
+
+func accountDataListener(cb AccountDataCallback) *syncListener {
+	return &syncListener{fn: func(s *syncSlices) {
+		for _, ev := range s.AccountData.Events {
+			cb.OnAccountData(ev.Type, string(ev.Content))
+		}
+	}, ended: syncEndedFunc(cb), reset: syncResetFunc(cb)}
+}
+
+// syncEndedFunc returns OnSyncEnded if cb is a SyncEndedCallback, or nil
+func syncEndedFunc(cb interface{}) func(reason string) {
+	if e, ok := cb.(SyncEndedCallback); ok {
+		return e.OnSyncEnded
+	}
+	return nil
+}
+
+// syncResetFunc returns OnSyncReset if cb is a SyncResetCallback, or nil
+func syncResetFunc(cb interface{}) func(reason string) {
+	if r, ok := cb.(SyncResetCallback); ok {
+		return r.OnSyncReset
+	}
+	return nil
+}
+
+// observeSync registers a listener for /sync responses from the homeserver, then makes sure the connection
+// is observing /sync.
+func observeSync(hsURL, token string, l *syncListener) bool {
+	u, err := url.Parse(hsURL)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse HS URL")
+		return false
+	}
+	if u.Host == "" {
+		logrus.WithField("url", hsURL).Error("HS URL missing host")
+		return false
+	}
+	conn, err := dc.getClientForHost(u.Host)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get DTLS client for host %s", u.Host)
+		return false
+	}
+	// add the listener first so it sees the first response
+	addSyncListener(u.Host, l)
+
+	var hostOpts []message.Option
+	if params().SendURIHost {
+		hostOpts, _ = lb.URIHostOptions(u)
+	}
+	if observe(conn, u.Host, coapHTTP.Paths.HTTPPathToCoapPath("/_matrix/client/r0/sync"), token, nil, hostOpts) == nil {
+		removeSyncListener(u.Host, l)
+		return false
+	}
+	return true
+}
+
+func addSyncListener(host string, l *syncListener) {
+	syncListenersMu.Lock()
+	defer syncListenersMu.Unlock()
+	syncListeners[host] = append(syncListeners[host], l)
+}
+
+func removeSyncListener(host string, l *syncListener) {
+	syncListenersMu.Lock()
+	defer syncListenersMu.Unlock()
+	listeners := syncListeners[host]
+	for i := range listeners {
+		if listeners[i] == l {
+			syncListeners[host] = append(listeners[:i], listeners[i+1:]...)
+			break
+		}
+	}
+	if len(syncListeners[host]) == 0 {
+		delete(syncListeners, host)
+	}
+}
+
+// removeAllSyncListeners removes the listeners for every host, dropping any coalesced /sync responses they have not
+// seen yet
+func removeAllSyncListeners() {
+	syncListenersMu.Lock()
+	defer syncListenersMu.Unlock()
+	for _, p := range pendingSyncs {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+	}
+	syncListeners = make(map[string][]*syncListener)
+	pendingSyncs = make(map[string]*pendingSync)
+}
+
+// notifySyncListeners passes the /sync response body to any listeners for the host. Returns false if there
+// are no listeners.
+func notifySyncListeners(host string, body []byte) bool {
+	syncListenersMu.Lock()
+	listeners := append([]*syncListener(nil), syncListeners[host]...)
+	syncListenersMu.Unlock()
+	if len(listeners) == 0 {
+		return false
+	}
+	var s syncSlices
+	if err := json.Unmarshal(body, &s); err != nil {
+		logrus.WithError(err).Warn("Observe: failed to unmarshal /sync response for listeners")
+		return true
+	}
+	window := time.Duration(params().ObserveCoalesceMs) * time.Millisecond
+	deferring := isLowPowerObserveMode()
+	if window <= 0 && !deferring {
+		for _, l := range listeners {
+			l.fn(&s)
+		}
+		return true
+	}
+	syncListenersMu.Lock()
+	p, ok := pendingSyncs[host]
+	if !ok {
+		p = &pendingSync{}
+		if !deferring {
+			// the window starts at the first response, so no response waits longer than the window
+			p.timer = time.AfterFunc(window, func() {
+				deliverObserveCallback(false, func() {
+					flushSyncListeners(host)
+				})
+			})
+		}
+		pendingSyncs[host] = p
+	}
+	p.slices.merge(&s)
+	syncListenersMu.Unlock()
+	if !ok && deferring {
+		// merged until low-power observe mode ends
+		deliverObserveCallback(false, func() {
+			flushSyncListeners(host)
+		})
+	}
+	return true
+}
+
+// flushSyncListeners passes the coalesced /sync responses for the host, if there are any, to the listeners for the
+// host
+func flushSyncListeners(host string) {
+	syncDeliverMu.Lock()
+	defer syncDeliverMu.Unlock()
+	syncListenersMu.Lock()
+	p := pendingSyncs[host]
+	delete(pendingSyncs, host)
+	listeners := append([]*syncListener(nil), syncListeners[host]...)
+	syncListenersMu.Unlock()
+	if p == nil {
+		return
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	for _, l := range listeners {
+		l.fn(&p.slices)
+	}
+}
+
+// merge adds the slices of a later /sync response to s. An account data event replaces any earlier event of the same
+// type, as only the latest content of each type matters. Device lists are joined in the order the users arrived, and
+// a later entry for a user replaces an earlier one, so a user who left and then came back is only in changed, and a
+// user who changed and then left is only in left.
+func (s *syncSlices) merge(later *syncSlices) {
+	for _, ev := range later.AccountData.Events {
+		replaced := false
+		for i := range s.AccountData.Events {
+			if s.AccountData.Events[i].Type == ev.Type {
+				s.AccountData.Events[i] = ev
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			s.AccountData.Events = append(s.AccountData.Events, ev)
+		}
+	}
+	for _, user := range later.DeviceLists.Changed {
+		s.DeviceLists.Left = removeUser(s.DeviceLists.Left, user)
+		s.DeviceLists.Changed = append(removeUser(s.DeviceLists.Changed, user), user)
+	}
+	for _, user := range later.DeviceLists.Left {
+		s.DeviceLists.Changed = removeUser(s.DeviceLists.Changed, user)
+		s.DeviceLists.Left = append(removeUser(s.DeviceLists.Left, user), user)
+	}
+}
+
+// removeUser removes user from list, keeping the order of the rest
+func removeUser(list []string, user string) []string {
+	for i, l := range list {
+		if l == user {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// notifySyncListenersEnded tells the listeners for the host why the /sync observation ended, after passing them any
+// coalesced /sync responses
+func notifySyncListenersEnded(host, reason string) {
+	deliverObserveCallback(false, func() {
+		flushSyncListeners(host)
+		syncListenersMu.Lock()
+		listeners := append([]*syncListener(nil), syncListeners[host]...)
+		syncListenersMu.Unlock()
+		for _, l := range listeners {
+			if l.ended != nil {
+				l.ended(reason)
+			}
+		}
+	})
+}
+
+// notifySyncListenersReset tells the listeners for the host why /sync is starting again from an initial sync, after
+// passing them any coalesced /sync responses from before
+func notifySyncListenersReset(host, reason string) {
+	deliverObserveCallback(false, func() {
+		flushSyncListeners(host)
+		syncListenersMu.Lock()
+		listeners := append([]*syncListener(nil), syncListeners[host]...)
+		syncListenersMu.Unlock()
+		for _, l := range listeners {
+			if l.reset != nil {
+				l.reset(reason)
+			}
+		}
+	})
+}
+
+// observeRefresh re-registers an OBSERVE request with the same CoAP token, so the server refreshes the registration
+// if it still has it, or re-establishes it if not.
+type observeRefresh struct {
+	path     string
+	token    string // access token
+	hostOpts []message.Option
+	queries  url.Values
+	// asks the server for non-confirmable notifications
+	nonConfirmable bool
+	// the ObservePriority of the notifications. The /sync observation is ObservePriorityNormal.
+	priority int
+	// the ObserveOrdering of the notifications
+	ordering string
+	// fetch the resource again after ObserveSeqGapThreshold skipped notifications rather than ObserveResyncGap, as this
+	// is the /sync observation
+	syncGap bool
+
+	mu        sync.Mutex
+	coapToken message.Token
+	since     string // the latest next_batch, so a re-established registration does not repeat old events
+	// when since was received, or when the observation was made if none has been
+	sinceAt time.Time
+	// the number of notifications delivered and the Observe sequence number of the latest, for DebugState
+	notifications int64
+	lastSeq       uint32
+	// when the latest notification was delivered, or when the observation was made if none has been
+	lastNotifiedAt time.Time
+	// the sequence of /sync notifications, which is reset when the registration is refreshed
+	seq observeSeq
+	// the rooms of the /sync notifications delivered, for ObserveChangedRoomsOnly
+	rooms changedRooms
+	// the /sync observation and the host it is on, and whether it has ended, which closes done
+	obs   *client.Observation
+	host  string
+	ended bool
+	done  chan struct{}
+}
+
+// options returns the options for registering the observation
+func (r *observeRefresh) options() []message.Option {
+	r.mu.Lock()
+	since := r.since
+	r.mu.Unlock()
+	opts := []message.Option{
+		{
+			ID:    lb.OptionIDAccessToken,
+			Value: []byte(tokens.current(r.token)),
+		},
+	}
+	opts = append(opts, r.hostOpts...)
+	opts = append(opts, requestOptions(params())...)
+	if r.nonConfirmable {
+		opts = append(opts, message.Option{ID: lb.OptionIDNonConfirmableNotifications})
+	}
+	if params().ObserveCompression == ObserveCompressionDelta {
+		opts = append(opts, message.Option{ID: lb.OptionIDObserveDelta})
+	}
+	if r.priority != ObservePriorityNormal {
+		buf := make([]byte, 4)
+		n, _ := message.EncodeUint32(buf, uint32(r.priority))
+		opts = append(opts, message.Option{ID: lb.OptionIDObservePriority, Value: buf[:n]})
+	}
+	keys := make([]string, 0, len(r.queries))
+	for k := range r.queries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "since" && since != "" {
+			continue
+		}
+		opts = append(opts, message.Option{
+			ID:    message.URIQuery,
+			Value: []byte(k + "=" + r.queries[k][0]),
+		})
+	}
+	if since != "" {
+		opts = append(opts, message.Option{
+			ID:    message.URIQuery,
+			Value: []byte("since=" + since),
+		})
+	}
+	return opts
+}
+
+// resumeQueries returns the query parameters to register the observation again with, from the since token of the
+// last notification. If the since token is older than ObserveSinceMaxAgeSecs, they have no since token instead, and
+// the listeners are told /sync is starting again from an initial sync.
+func (r *observeRefresh) resumeQueries() url.Values {
+	r.mu.Lock()
+	since, sinceAt := r.since, r.sinceAt
+	r.mu.Unlock()
+	maxAge := time.Duration(params().ObserveSinceMaxAgeSecs) * time.Second
+	if maxAge > 0 && time.Since(sinceAt) > maxAge && (since != "" || r.queries.Get("since") != "") {
+		logrus.Infof("Observe: the since token of %s is %v old, starting again from an initial sync", r.path,
+			time.Since(sinceAt).Round(time.Second))
+		recordSyncReset()
+		notifySyncListenersReset(r.host, SyncResetExpired)
+		return r.initialSyncQueries()
+	}
+	queries := make(url.Values, len(r.queries))
+	for k, v := range r.queries {
+		queries[k] = v
+	}
+	if since != "" {
+		queries.Set("since", since)
+	}
+	return queries
+}
+
+// initialSyncQueries returns the query parameters to register the observation again with, without a since token
+func (r *observeRefresh) initialSyncQueries() url.Values {
+	queries := make(url.Values, len(r.queries))
+	for k, v := range r.queries {
+		if k != "since" {
+			queries[k] = v
+		}
+	}
+	return queries
+}
+
+// sinceRejected returns true if an error notification with the HTTP status code means the server rejected the since
+// token the observation was made from, e.g because it expired. Errors which have nothing to do with the token, like
+// an unknown access token or rate limiting, do not.
+func (r *observeRefresh) sinceRejected(code int) bool {
+	r.mu.Lock()
+	since := r.since
+	r.mu.Unlock()
+	if since == "" && r.queries.Get("since") == "" {
+		return false
+	}
+	return code/100 == 4 && code != http.StatusUnauthorized && code != http.StatusForbidden &&
+		code != http.StatusTooManyRequests
+}
+
+// resumeFromInitialSync observes /sync again on a new connection to the host without a since token, after the
+// server rejected the since token of the observation which ended, and tells the listeners why. The responses go to
+// ch, so a SendRequest waiting for the observation which ended gets the initial sync.
+func resumeFromInitialSync(host string, r *observeRefresh, ch chan *Response) {
+	recordSyncReset()
+	notifySyncListenersReset(host, SyncResetRejected)
+	conn, err := dc.getClientForHost(host)
+	if err != nil {
+		logrus.WithError(err).Warnf("Observe: failed to reconnect to host %s for an initial sync", host)
+		return
+	}
+	observeInto(conn, host, r.path, r.token, r.initialSyncQueries(), r.hostOpts, ch)
+}
+
+// setCoAPToken remembers the token of the observation, which go-coap does not expose
+func (r *observeRefresh) setCoAPToken(token message.Token) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.coapToken == nil {
+		r.coapToken = append(message.Token(nil), token...)
+	}
+}
+
+// The sequence numbers of notifications are 24 bits, and are compared as described in
+// https://datatracker.ietf.org/doc/html/rfc7641#section-3.4
+const (
+	observeSeqMask = 1<<24 - 1
+	observeSeqHalf = 1 << 23
+	// after this long without a notification, the server may have restarted its sequence numbers
+	observeSeqTimeout = 128 * time.Second
+)
+
+// observeSeq tracks the sequence numbers of the notifications of a single registration, as each registration has its
+// own sequence
+type observeSeq struct {
+	mu     sync.Mutex
+	valid  bool // false until the first notification, and after re-registering
+	last   uint32
+	lastAt time.Time
+	// with ObserveCompressionDelta, the JSON and sequence number of the latest confirmable notification, which the
+	// server sends deltas from
+	deltaBase    []byte
+	deltaBaseSeq uint32
+	// the number of notifications which next has accepted and which have not finished being delivered, and a
+	// channel which is closed when it, or last, changes, for await
+	delivering int
+	changed    chan struct{}
+}
+
+// next returns false if the notification is a duplicate of, or older than, the latest one, which happens when
+// notifications are retransmitted or overtake each other, so it must be discarded. If not, also returns how many
+// notifications were skipped since the latest, which were lost.
+func (o *observeSeq) next(msg *pool.Message) (bool, uint32) {
+	seq, err := msg.Observe()
+	if err != nil {
+		// e.g the response to the registration, which is not a notification
+		return true, 0
+	}
+	seq &= observeSeqMask
+	now := time.Now()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var skipped uint32
+	if o.valid && now.Sub(o.lastAt) <= observeSeqTimeout {
+		diff := (seq - o.last) & observeSeqMask
+		if diff == 0 || diff >= observeSeqHalf {
+			return false, 0
+		}
+		skipped = diff - 1
+	}
+	o.valid = true
+	o.last = seq
+	o.lastAt = now
+	o.delivering++
+	o.signalLocked()
+	return true, skipped
+}
+
+// finish is called once a notification which next accepted has been delivered, or dropped
+func (o *observeSeq) finish(msg *pool.Message) {
+	if _, err := msg.Observe(); err != nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.delivering--
+	o.signalLocked()
+}
+
+// await holds a notification which arrived ahead of the one after the latest, e.g because it overtook it, until
+// that one has been delivered, so notifications are delivered in order. If it does not arrive within timeout it was
+// probably lost, so the notification is delivered after the gap. Duplicates and older notifications are not held,
+// as next discards them.
+func (o *observeSeq) await(msg *pool.Message, timeout time.Duration) {
+	seq, err := msg.Observe()
+	if err != nil {
+		return
+	}
+	seq &= observeSeqMask
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	held := false
+	o.mu.Lock()
+	for o.valid && time.Since(o.lastAt) <= observeSeqTimeout {
+		diff := (seq - o.last) & observeSeqMask
+		if diff == 0 || diff >= observeSeqHalf || (diff == 1 && o.delivering == 0) {
+			break
+		}
+		if o.changed == nil {
+			o.changed = make(chan struct{})
+		}
+		changed := o.changed
+		o.mu.Unlock()
+		held = true
+		select {
+		case <-changed:
+		case <-timer.C:
+			logrus.Infof("Observe: notification %d arrived out of order, and the ones before it did not arrive in time", seq)
+			recordReorderTimeout()
+			return
+		}
+		o.mu.Lock()
+	}
+	o.mu.Unlock()
+	if held {
+		recordReorderedNotification()
+	}
+}
+
+// signalLocked wakes the notifications waiting in await
+func (o *observeSeq) signalLocked() {
+	if o.changed != nil {
+		close(o.changed)
+		o.changed = nil
+	}
+}
+
+// reset accepts the next notification whatever its sequence number, as the server may have started a new sequence
+func (o *observeSeq) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.valid = false
+	o.deltaBase = nil
+}
+
+// hasDeltaBase returns false if the notification is a delta from a notification other than the deltaBase
+func (o *observeSeq) hasDeltaBase(msg *pool.Message) bool {
+	base, err := msg.GetOptionUint32(lb.OptionIDObserveDelta)
+	if err != nil {
+		return true
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.deltaBase != nil && base&observeSeqMask == o.deltaBaseSeq
+}
+
+// reassemble returns the JSON body of a notification, applying it to the deltaBase if it is a delta. With
+// ObserveCompressionDelta, the result is the new deltaBase if the notification was confirmable, as the server only
+// sends deltas from notifications which the client has ACKed. The body of a message which is not a notification,
+// e.g the response to fetching the resource again, is returned as-is.
+func (o *observeSeq) reassemble(msg *pool.Message, body []byte) ([]byte, error) {
+	seq, err := msg.Observe()
+	if err != nil {
+		return body, nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, err = msg.GetOptionUint32(lb.OptionIDObserveDelta); err == nil {
+		if body, err = lb.ApplyMergePatch(o.deltaBase, body); err != nil {
+			return nil, fmt.Errorf("cannot apply delta notification: %w", err)
+		}
+		recordObserveDelta()
+	}
+	// block-wise notifications are delivered as the last response of the transfer, which is an ACK
+	if params().ObserveCompression == ObserveCompressionDelta && msg.Type() != udpmessage.NonConfirmable && len(body) > 0 {
+		o.deltaBase = body
+		o.deltaBaseSeq = seq & observeSeqMask
+	}
+	return body, nil
+}
+
+// filterNotification returns the message to deliver for a notification, or nil if it is stale. If more
+// notifications were skipped before it than ObserveResyncGap allows, or ObserveSeqGapThreshold with syncGap, or it is a
+// delta from a notification which is not the deltaBase, the resource is fetched again from the since token of the
+// last notification delivered, so nothing which was lost is missed, and the response is returned instead. A skipped
+// notification which arrives after all is then stale, as the response covers it. With ObserveOrderingStrict, a
+// notification which overtook the one before it is held until that has been delivered, see observeSeq.await. The
+// caller must release a message which is not msg, and call seq.finish with msg once it has delivered a message which
+// is returned.
+func (r *observeRefresh) filterNotification(conn *client.ClientConn, seq *observeSeq, msg *pool.Message) *pool.Message {
+	if r.ordering == ObserveOrderingStrict {
+		seq.await(msg, time.Duration(params().ObserveReorderTimeoutMs)*time.Millisecond)
+	}
+	fresh, skipped := seq.next(msg)
+	if !fresh {
+		recordStaleNotification()
+		logrus.Infof("Observe: discarding stale notification of %s", r.path)
+		return nil
+	}
+	if n, err := msg.Observe(); err == nil {
+		r.mu.Lock()
+		r.notifications++
+		r.lastSeq = n & observeSeqMask
+		r.lastNotifiedAt = time.Now()
+		r.mu.Unlock()
+	}
+	if !seq.hasDeltaBase(msg) {
+		logrus.Warnf("Observe: missing the notification a delta of %s is from, fetching it again", r.path)
+		recordObserveDeltaMiss()
+		return r.fetch(conn, msg)
+	}
+	gap := params().ObserveResyncGap
+	if r.syncGap {
+		gap = params().ObserveSeqGapThreshold
+	}
+	if gap <= 0 || skipped < uint32(gap) {
+		return msg
+	}
+	logrus.Warnf("Observe: %d notifications of %s were skipped, fetching it again", skipped, r.path)
+	recordObserveResync()
+	return r.fetch(conn, msg)
+}
+
+// fetch returns the response to fetching the resource again in place of the notification msg, or msg if it fails
+func (r *observeRefresh) fetch(conn *client.ClientConn, msg *pool.Message) *pool.Message {
+	ctx, cancel := context.WithTimeout(conn.Context(), streamRequestTimeout(params()))
+	defer cancel()
+	req, err := client.NewGetRequest(ctx, r.path, r.options()...)
+	if err != nil {
+		logrus.WithError(err).Error("Observe: failed to create resync request")
+		return msg
+	}
+	defer pool.ReleaseMessage(req)
+	res, err := do(conn, req, &Timings{}, newRoundTripLimit(0))
+	if err != nil {
+		logrus.WithError(err).Warnf("Observe: failed to fetch %s again, delivering the notification", r.path)
+		return msg
+	}
+	return res
+}
+
+// notificationAge returns how long it has been since the latest notification, or since the observation was made if
+// there has not been one
+func (r *observeRefresh) notificationAge() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Since(r.lastNotifiedAt)
+}
+
+// observeNotificationAge returns the notificationAge of the observation which has gone longest without a
+// notification, or 0 if there are no observations
+func observeNotificationAge() time.Duration {
+	var refreshes []*observeRefresh
+	dc.mu.Lock()
+	for _, conn := range dc.conns {
+		if refresh, ok := conn.Context().Value(ctxValObserveSyncRefresh).(*observeRefresh); ok && !refresh.isEnded() {
+			refreshes = append(refreshes, refresh)
+		}
+	}
+	dc.mu.Unlock()
+	liveStreamsMu.Lock()
+	for s := range liveStreams {
+		refreshes = append(refreshes, s.reg)
+	}
+	liveStreamsMu.Unlock()
+	var oldest time.Duration
+	for _, r := range refreshes {
+		if age := r.notificationAge(); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
+
+func (r *observeRefresh) setSince(body []byte) {
+	var res struct {
+		NextBatch string `json:"next_batch"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil || res.NextBatch == "" {
+		return
+	}
+	r.mu.Lock()
+	r.since = res.NextBatch
+	r.sinceAt = time.Now()
+	r.mu.Unlock()
+}
+
+// setObservation remembers the /sync observation to cancel when it ends, cancelling it straight away if it ended
+// while it was being registered
+func (r *observeRefresh) setObservation(obs *client.Observation) {
+	r.mu.Lock()
+	r.obs = obs
+	ended := r.ended
+	r.mu.Unlock()
+	if ended {
+		go cancelObservation(obs)
+	}
+}
+
+func (r *observeRefresh) isEnded() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ended
+}
+
+// end stops the /sync observation on conn, the first time it is called, then tells the listeners why. If conn is
+// still open, only the observation is cancelled, and other requests carry on over conn.
+func (r *observeRefresh) end(conn *client.ClientConn, reason string) {
+	r.mu.Lock()
+	if r.ended {
+		r.mu.Unlock()
+		return
+	}
+	r.ended = true
+	if r.done != nil {
+		close(r.done)
+	}
+	obs := r.obs
+	r.mu.Unlock()
+	releaseObserve()
+	recordObserveEnd(reason)
+	logrus.Infof("Observe: observation of %s on host %s ended: %s", r.path, r.host, reason)
+	if conn.Context().Err() == nil {
+		if conn.Context().Value(ctxValObserveSyncRefresh) == r {
+			conn.SetContextValue(ctxValObserveSync, nil)
+			conn.SetContextValue(ctxValObserveSyncRefresh, nil)
+		}
+		if obs != nil {
+			go cancelObservation(obs)
+		}
+	}
+	notifySyncListenersEnded(r.host, reason)
+}
+
+// cancelObservation tells the server to stop an observation which has ended, in case it has not stopped already
+func cancelObservation(obs *client.Observation) {
+	ctx, cancel := context.WithTimeout(context.Background(), streamRequestTimeout(params()))
+	defer cancel()
+	if err := obs.Cancel(ctx); err != nil {
+		logrus.WithError(err).Debug("Observe: deregistration returned an error")
+	}
+}
+
+// run re-registers the observation every interval, if it is set, until the observation ends, and ends it when the
+// connection is closed. If stall is set, the observation is also re-registered when it has gone that long without
+// a notification or a re-registration. The connection's OnClose handlers are not used, as they only run once its
+// read loop stops, which can be long after it was closed.
+func (r *observeRefresh) run(conn *client.ClientConn, interval, stall time.Duration) {
+	var tick, stallTick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	if stall > 0 {
+		ticker := time.NewTicker(stall)
+		defer ticker.Stop()
+		stallTick = ticker.C
+	}
+	lastRefresh := time.Now()
+	for !r.isEnded() {
+		select {
+		case <-r.done:
+			return
+		case <-conn.Context().Done():
+			r.end(conn, closeReason(conn))
+			return
+		case <-tick:
+			r.refresh(conn, interval)
+			lastRefresh = time.Now()
+		case <-stallTick:
+			if r.notificationAge() < stall || time.Since(lastRefresh) < stall {
+				continue
+			}
+			logrus.Warnf("Observe: no notification of %s for %v, re-registering", r.path, r.notificationAge().Round(time.Second))
+			recordObserveStallRefresh()
+			r.refresh(conn, stall)
+			lastRefresh = time.Now()
+		}
+	}
+}
+
+func (r *observeRefresh) refresh(conn *client.ClientConn, timeout time.Duration) {
+	r.mu.Lock()
+	coapToken := r.coapToken
+	r.mu.Unlock()
+	if coapToken == nil {
+		// the registration response hasn't arrived yet
+		return
+	}
+	ctx, cancel := context.WithTimeout(conn.Context(), timeout)
+	defer cancel()
+	req, err := client.NewGetRequest(ctx, r.path, r.options()...)
+	if err != nil {
+		logrus.WithError(err).Error("Observe: failed to create re-registration request")
+		return
+	}
+	defer pool.ReleaseMessage(req)
+	req.SetToken(coapToken)
+	req.SetObserve(0)
+	res, err := conn.Do(req)
+	if err != nil {
+		logrus.WithError(err).Warnf("Observe: failed to re-register observation of %s", r.path)
+		switch {
+		case conn.Context().Err() != nil:
+			// the observation ends with the connection
+		case ctx.Err() == context.DeadlineExceeded:
+			r.end(conn, ObserveEndedTimeout)
+		default:
+			r.end(conn, ObserveEndedRejected)
+		}
+		return
+	}
+	defer pool.ReleaseMessage(res)
+	if res.Code() != codes.Content {
+		logrus.Warnf("Observe: re-registering observation of %s returned %v", r.path, res.Code())
+		r.end(conn, ObserveEndedRejected)
+		return
+	}
+	r.seq.reset()
+	logrus.Infof("Observe: re-registered observation of %s", r.path)
+}
@@ -0,0 +1,995 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	udpmessage "github.com/matrix-org/go-coap/v2/udp/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+	"github.com/matrix-org/lb"
+)
+
+type deviceListsFunc func(changed, left string)
+
+func (f deviceListsFunc) OnDeviceLists(changed, left string) { f(changed, left) }
+
+type accountDataFunc func(eventType, content string)
+
+func (f accountDataFunc) OnAccountData(eventType, content string) { f(eventType, content) }
+
+func TestSyncListenersRouting(t *testing.T) {
+	var deviceLists, accountData []string
+	host := "listeners.example.org"
+	addSyncListener(host, deviceListsListener(deviceListsFunc(func(changed, left string) {
+		deviceLists = append(deviceLists, changed+"|"+left)
+	})))
+	addSyncListener(host, accountDataListener(accountDataFunc(func(eventType, content string) {
+		accountData = append(accountData, eventType+" "+content)
+	})))
+	t.Cleanup(func() {
+		syncListenersMu.Lock()
+		delete(syncListeners, host)
+		syncListenersMu.Unlock()
+	})
+
+	for _, body := range []string{
+		`{"next_batch":"1","account_data":{"events":[{"type":"m.direct","content":{"@bob:bar":["!dm:bar"]}}]}}`,
+		`{"next_batch":"2","device_lists":{"changed":["@bob:bar","@carol:bar"],"left":["@eve:bar"]}}`,
+		// room account data is not global account data
+		`{"next_batch":"3","rooms":{"join":{"!foo:bar":{"account_data":{"events":[{"type":"m.tag","content":{}}]}}}}}`,
+		`{"next_batch":"4","account_data":{"events":[{"type":"m.push_rules","content":{}}]},"device_lists":{"left":["@dave:bar"]}}`,
+	} {
+		if !notifySyncListeners(host, []byte(body)) {
+			t.Fatalf("notifySyncListeners returned false with listeners")
+		}
+	}
+	if notifySyncListeners("other.example.org", []byte(`{"device_lists":{"changed":["@bob:bar"]}}`)) {
+		t.Errorf("notifySyncListeners returned true for a host without listeners")
+	}
+
+	wantDeviceLists := []string{"@bob:bar,@carol:bar|@eve:bar", "|@dave:bar"}
+	if !reflect.DeepEqual(deviceLists, wantDeviceLists) {
+		t.Errorf("device lists: got %v want %v", deviceLists, wantDeviceLists)
+	}
+	wantAccountData := []string{`m.direct {"@bob:bar":["!dm:bar"]}`, "m.push_rules {}"}
+	if !reflect.DeepEqual(accountData, wantAccountData) {
+		t.Errorf("account data: got %v want %v", accountData, wantAccountData)
+	}
+}
+
+func TestSyncListenersCoalesce(t *testing.T) {
+	defaultParams := *Params()
+	cp := defaultParams
+	cp.ObserveCoalesceMs = 200
+	if err := SetParams(&cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	host := "coalesce.example.org"
+	var mu sync.Mutex
+	var deviceLists, accountData []string
+	delivered := make(chan struct{}, 10)
+	addSyncListener(host, deviceListsListener(deviceListsFunc(func(changed, left string) {
+		mu.Lock()
+		deviceLists = append(deviceLists, changed+"|"+left)
+		mu.Unlock()
+		delivered <- struct{}{}
+	})))
+	addSyncListener(host, accountDataListener(accountDataFunc(func(eventType, content string) {
+		mu.Lock()
+		accountData = append(accountData, eventType+" "+content)
+		mu.Unlock()
+	})))
+	t.Cleanup(func() {
+		SetParams(&defaultParams)
+		syncListenersMu.Lock()
+		delete(syncListeners, host)
+		syncListenersMu.Unlock()
+	})
+
+	for _, body := range []string{
+		`{"next_batch":"1","account_data":{"events":[{"type":"m.direct","content":{"@bob:bar":["!dm:bar"]}}]}}`,
+		`{"next_batch":"2","device_lists":{"changed":["@bob:bar","@carol:bar"],"left":["@eve:bar"]}}`,
+		`{"next_batch":"3","device_lists":{"changed":["@carol:bar","@dave:bar"]}}`,
+		`{"next_batch":"4","account_data":{"events":[{"type":"m.push_rules","content":{}},{"type":"m.direct","content":{}}]},` +
+			`"device_lists":{"left":["@frank:bar"]}}`,
+	} {
+		if !notifySyncListeners(host, []byte(body)) {
+			t.Fatalf("notifySyncListeners returned false with listeners")
+		}
+	}
+	mu.Lock()
+	if len(deviceLists) != 0 || len(accountData) != 0 {
+		t.Errorf("listeners were called before the window passed: %v %v", deviceLists, accountData)
+	}
+	mu.Unlock()
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("coalesced responses were never delivered")
+	}
+	// another response starts a new window
+	notifySyncListeners(host, []byte(`{"next_batch":"5","device_lists":{"changed":["@bob:bar"]}}`))
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("second window was never delivered")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	wantDeviceLists := []string{"@bob:bar,@carol:bar,@dave:bar|@eve:bar,@frank:bar", "@bob:bar|"}
+	if !reflect.DeepEqual(deviceLists, wantDeviceLists) {
+		t.Errorf("device lists: got %v want %v", deviceLists, wantDeviceLists)
+	}
+	// the later m.direct replaces the earlier one
+	wantAccountData := []string{"m.direct {}", "m.push_rules {}"}
+	if !reflect.DeepEqual(accountData, wantAccountData) {
+		t.Errorf("account data: got %v want %v", accountData, wantAccountData)
+	}
+}
+
+// TestSyncSlicesMergeDeviceLists checks that a user is only in the device list of their latest entry once /sync
+// responses are merged, and that the users stay in the order they arrived
+func TestSyncSlicesMergeDeviceLists(t *testing.T) {
+	testCases := []struct {
+		name                  string
+		responses             [][2][]string // changed, left
+		wantChanged, wantLeft []string
+	}{
+		{
+			name:        "left then changed",
+			responses:   [][2][]string{{{"@bob:bar"}, {"@eve:bar"}}, {{"@eve:bar", "@carol:bar"}, nil}},
+			wantChanged: []string{"@bob:bar", "@eve:bar", "@carol:bar"},
+		},
+		{
+			name:        "changed then left",
+			responses:   [][2][]string{{{"@bob:bar", "@eve:bar", "@carol:bar"}, {"@dave:bar"}}, {nil, {"@eve:bar"}}},
+			wantChanged: []string{"@bob:bar", "@carol:bar"},
+			wantLeft:    []string{"@dave:bar", "@eve:bar"},
+		},
+		{
+			name:        "changed, left then changed again",
+			responses:   [][2][]string{{{"@eve:bar", "@bob:bar"}, nil}, {nil, {"@eve:bar"}}, {{"@eve:bar"}, nil}},
+			wantChanged: []string{"@bob:bar", "@eve:bar"},
+		},
+	}
+	for _, tc := range testCases {
+		var merged syncSlices
+		for _, res := range tc.responses {
+			var s syncSlices
+			s.DeviceLists.Changed, s.DeviceLists.Left = res[0], res[1]
+			merged.merge(&s)
+		}
+		if fmt.Sprint(merged.DeviceLists.Changed) != fmt.Sprint(tc.wantChanged) ||
+			fmt.Sprint(merged.DeviceLists.Left) != fmt.Sprint(tc.wantLeft) {
+			t.Errorf("%s: got changed %v left %v want changed %v left %v", tc.name,
+				merged.DeviceLists.Changed, merged.DeviceLists.Left, tc.wantChanged, tc.wantLeft)
+		}
+	}
+}
+
+func TestObserveDeviceListsRegistersObserve(t *testing.T) {
+	received := make(chan string, 1)
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case received <- req.URL.Path + " " + req.Header.Get("Authorization"):
+		default:
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"next_batch":"1"}`))
+	}))
+	if !ObserveDeviceLists(hsURL, "secret", deviceListsFunc(func(changed, left string) {})) {
+		t.Fatalf("ObserveDeviceLists returned false")
+	}
+	select {
+	case got := <-received:
+		if want := "/_matrix/client/r0/sync Bearer secret"; got != want {
+			t.Errorf("server got %s want %s", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server never received /sync")
+	}
+}
+
+// TestObserveRefreshReestablishesRegistration checks that a registration which the server silently drops is
+// re-established with the same token by the periodic re-registration.
+func TestObserveRefreshReestablishesRegistration(t *testing.T) {
+	var mu sync.Mutex
+	registrations := make(map[string]bool) // token -> registered
+	registered := make(chan message.Token, 10)
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		if obs, err := r.Options.Observe(); err != nil || obs != 0 {
+			w.SetResponse(codes.NotFound, message.TextPlain, nil)
+			return
+		}
+		mu.Lock()
+		alive := registrations[r.Token.String()]
+		registrations[r.Token.String()] = true
+		mu.Unlock()
+		if !alive {
+			registered <- append(message.Token(nil), r.Token...)
+		}
+		w.SetResponse(codes.Content, message.TextPlain, nil)
+	}))
+	cp := Params()
+	cp.ObserveRefreshSecs = 1
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+
+	if !ObserveDeviceLists(hsURL, "secret", deviceListsFunc(func(changed, left string) {})) {
+		t.Fatalf("ObserveDeviceLists returned false")
+	}
+	var token message.Token
+	select {
+	case token = <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server never received the registration")
+	}
+	// refreshes of a live registration are not new registrations
+	select {
+	case <-registered:
+		t.Fatalf("refresh made a new registration")
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	// drop the registration without telling the client, like a server restart
+	mu.Lock()
+	delete(registrations, token.String())
+	mu.Unlock()
+	select {
+	case got := <-registered:
+		if !bytes.Equal(got, token) {
+			t.Errorf("re-registered with token %v, want %v", got, token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("registration was not re-established")
+	}
+}
+
+// TestObserveStallRefresh checks that a registration which goes ObserveStallSecs without a notification is
+// re-registered, even when periodic re-registration is off
+func TestObserveStallRefresh(t *testing.T) {
+	registrations := make(chan struct{}, 10)
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		if obs, err := r.Options.Observe(); err != nil || obs != 0 {
+			w.SetResponse(codes.NotFound, message.TextPlain, nil)
+			return
+		}
+		registrations <- struct{}{}
+		w.SetResponse(codes.Content, message.TextPlain, nil)
+	}))
+	cp := Params()
+	cp.ObserveRefreshSecs = 0
+	cp.ObserveStallSecs = 1
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	before := CurrentStats().ObserveStallRefreshes
+
+	if !ObserveDeviceLists(hsURL, "secret", deviceListsFunc(func(changed, left string) {})) {
+		t.Fatalf("ObserveDeviceLists returned false")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-registrations:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("server got %d registrations want 2", i)
+		}
+	}
+	if got := CurrentStats().ObserveStallRefreshes - before; got < 1 {
+		t.Errorf("ObserveStallRefreshes increased by %d, want at least 1", got)
+	}
+	if age := CurrentStats().ObserveLastNotificationAgeSecs; age < 1 {
+		t.Errorf("got ObserveLastNotificationAgeSecs %v want at least 1 with no notifications", age)
+	}
+}
+
+// cborBody returns the CBOR for a JSON body
+func cborBody(t *testing.T, body string) []byte {
+	t.Helper()
+	b, err := cborCodec.JSONToCBOR(bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	return b
+}
+
+func TestObserveStreamDiscardsStaleNotifications(t *testing.T) {
+	var got []string
+	s := &Stream{
+		reg:  &observeRefresh{path: "/o"},
+		done: make(chan struct{}),
+		cb: &streamFuncs{
+			notification: func(code int, body string) {
+				got = append(got, body)
+			},
+		},
+	}
+	notify := s.notifier()
+	send := func(seq uint32) {
+		msg := pool.AcquireMessage(context.Background())
+		defer pool.ReleaseMessage(msg)
+		msg.SetCode(codes.Content)
+		msg.SetObserve(seq)
+		msg.SetContentFormat(message.AppCBOR)
+		msg.SetBody(bytes.NewReader(cborBody(t, fmt.Sprintf(`{"n":%d}`, seq))))
+		notify(msg)
+	}
+	before := CurrentStats()
+	// duplicates, and older notifications which overtook newer ones
+	for _, seq := range []uint32{2, 2, 4, 3, 4, 5} {
+		send(seq)
+	}
+	if want := []string{`{"n":2}`, `{"n":4}`, `{"n":5}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got notifications %v want %v", got, want)
+	}
+
+	// a new registration has a new sequence, which wraps around at 24 bits
+	got = nil
+	notify = s.notifier()
+	for _, seq := range []uint32{1<<24 - 2, 1<<24 - 1, 1<<24 - 2, 0, 1<<24 - 1, 1} {
+		send(seq)
+	}
+	if want := []string{`{"n":16777214}`, `{"n":16777215}`, `{"n":0}`, `{"n":1}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wrapping around: got notifications %v want %v", got, want)
+	}
+	if stale := CurrentStats().StaleNotifications - before.StaleNotifications; stale != 5 {
+		t.Errorf("StaleNotifications: got %d want 5", stale)
+	}
+}
+
+// TestObserveStreamOrdering checks that notifications which overtake each other are delivered as they arrive with
+// ObserveOrderingArrival, and in sequence with ObserveOrderingStrict unless the ones before them are lost.
+func TestObserveStreamOrdering(t *testing.T) {
+	cp := Params()
+	cp.ObserveReorderTimeoutMs = 300
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	observe := func(ordering string) (send func(seq uint32), wait func(n int) []string) {
+		got := make(chan string, 10)
+		s := &Stream{
+			reg:  &observeRefresh{path: "/o", ordering: ordering},
+			done: make(chan struct{}),
+			cb: &streamFuncs{
+				notification: func(code int, body string) {
+					got <- body
+				},
+			},
+		}
+		notify := s.notifier()
+		// the library handles every notification in its own goroutine
+		send = func(seq uint32) {
+			msg := pool.AcquireMessage(context.Background())
+			msg.SetCode(codes.Content)
+			msg.SetObserve(seq)
+			msg.SetContentFormat(message.AppCBOR)
+			msg.SetBody(bytes.NewReader(cborBody(t, fmt.Sprintf(`{"n":%d}`, seq))))
+			go func() {
+				defer pool.ReleaseMessage(msg)
+				notify(msg)
+			}()
+			// let it reach the stream before the next one
+			time.Sleep(20 * time.Millisecond)
+		}
+		wait = func(n int) []string {
+			var bodies []string
+			for len(bodies) < n {
+				select {
+				case body := <-got:
+					bodies = append(bodies, body)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%s: got notifications %v, timed out waiting for %d", ordering, bodies, n)
+				}
+			}
+			return bodies
+		}
+		return send, wait
+	}
+
+	// 4 overtakes 3, so 3 is discarded as it is older than one already delivered
+	send, wait := observe(ObserveOrderingArrival)
+	before := CurrentStats()
+	for _, seq := range []uint32{2, 4, 3} {
+		send(seq)
+	}
+	if got, want := wait(2), []string{`{"n":2}`, `{"n":4}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("arrival: got notifications %v want %v", got, want)
+	}
+
+	// 4 waits for 3, and 7 for 5 and 6 until they are given up on, then 5 is discarded
+	send, wait = observe(ObserveOrderingStrict)
+	for _, seq := range []uint32{2, 4, 3} {
+		send(seq)
+	}
+	if got, want := wait(3), []string{`{"n":2}`, `{"n":3}`, `{"n":4}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("strict: got notifications %v want %v", got, want)
+	}
+	start := time.Now()
+	send(7)
+	if got, want := wait(1), []string{`{"n":7}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("strict with a gap: got notifications %v want %v", got, want)
+	}
+	if took := time.Since(start); took < 300*time.Millisecond {
+		t.Errorf("strict with a gap: notification delivered after %v want at least the reorder timeout", took)
+	}
+	send(5)
+	send(8)
+	if got, want := wait(1), []string{`{"n":8}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("strict after a gap: got notifications %v want %v", got, want)
+	}
+	after := CurrentStats()
+	if got := after.ReorderedNotifications - before.ReorderedNotifications; got != 1 {
+		t.Errorf("ReorderedNotifications: got %d more want 1", got)
+	}
+	if got := after.ReorderTimeouts - before.ReorderTimeouts; got != 1 {
+		t.Errorf("ReorderTimeouts: got %d more want 1", got)
+	}
+	if got := after.StaleNotifications - before.StaleNotifications; got != 2 {
+		t.Errorf("StaleNotifications: got %d more want 2", got)
+	}
+}
+
+// TestObserveStreamResyncGap checks that the resource is fetched again when ObserveResyncGap notifications are lost.
+// The notifications are given to the stream in turn, as the library handles each in its own goroutine so they could
+// overtake each other, which TestObserveStreamOrdering covers.
+func TestObserveStreamResyncGap(t *testing.T) {
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		w.SetResponse(codes.Content, message.AppCBOR, bytes.NewReader(cborBody(t, `{"n":"fetched"}`)))
+	}))
+	cp := Params()
+	cp.ObserveResyncGap = 3
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	conn, err := dc.getClientForHost(strings.TrimPrefix(hsURL, "https://"))
+	if err != nil {
+		t.Fatalf("getClientForHost: %s", err)
+	}
+	var got []string
+	s := &Stream{
+		reg:  &observeRefresh{path: "/_matrix/client/r0/account/whoami"},
+		done: make(chan struct{}),
+		conn: conn,
+		cb: &streamFuncs{
+			notification: func(code int, body string) {
+				got = append(got, body)
+			},
+		},
+	}
+	notify := s.notifier()
+	before := CurrentStats()
+	// 3, 4 and 5 are lost, then 7: 6 skips 3 notifications so the resource is fetched again, 8 only skips 1
+	for _, seq := range []uint32{2, 6, 8} {
+		msg := pool.AcquireMessage(context.Background())
+		msg.SetCode(codes.Content)
+		msg.SetObserve(seq)
+		msg.SetContentFormat(message.AppCBOR)
+		msg.SetBody(bytes.NewReader(cborBody(t, fmt.Sprintf(`{"n":%d}`, seq))))
+		notify(msg)
+		pool.ReleaseMessage(msg)
+	}
+	if want := []string{`{"n":2}`, `{"n":"fetched"}`, `{"n":8}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got notifications %v want %v", got, want)
+	}
+	if resyncs := CurrentStats().ObserveResyncs - before.ObserveResyncs; resyncs != 1 {
+		t.Errorf("ObserveResyncs: got %d want 1", resyncs)
+	}
+}
+
+// TestObserveSyncSeqGapThreshold checks that /sync is fetched again when ObserveSeqGapThreshold notifications are
+// skipped, and that smaller gaps are delivered as-is
+func TestObserveSyncSeqGapThreshold(t *testing.T) {
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		w.SetResponse(codes.Content, message.AppCBOR, bytes.NewReader(cborBody(t, `{"n":"fetched"}`)))
+	}))
+	cp := Params()
+	cp.ObserveResyncGap = 1
+	cp.ObserveSeqGapThreshold = 3
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	conn, err := dc.getClientForHost(strings.TrimPrefix(hsURL, "https://"))
+	if err != nil {
+		t.Fatalf("getClientForHost: %s", err)
+	}
+	var got []string
+	s := &Stream{
+		reg:  &observeRefresh{path: "/_matrix/client/r0/sync", syncGap: true},
+		done: make(chan struct{}),
+		conn: conn,
+		cb: &streamFuncs{
+			notification: func(code int, body string) {
+				got = append(got, body)
+			},
+		},
+	}
+	notify := s.notifier()
+	before := CurrentStats()
+	// 4 skips 1 notification and 6 skips 1, which are benign, then 10 skips 3 so /sync is fetched again
+	for _, seq := range []uint32{2, 4, 6, 10} {
+		msg := pool.AcquireMessage(context.Background())
+		msg.SetCode(codes.Content)
+		msg.SetObserve(seq)
+		msg.SetContentFormat(message.AppCBOR)
+		msg.SetBody(bytes.NewReader(cborBody(t, fmt.Sprintf(`{"n":%d}`, seq))))
+		notify(msg)
+		pool.ReleaseMessage(msg)
+	}
+	if want := []string{`{"n":2}`, `{"n":4}`, `{"n":6}`, `{"n":"fetched"}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got notifications %v want %v", got, want)
+	}
+	if resyncs := CurrentStats().ObserveResyncs - before.ObserveResyncs; resyncs != 1 {
+		t.Errorf("ObserveResyncs: got %d want 1", resyncs)
+	}
+}
+
+// TestObserveStreamDeltaMiss checks that a delta from a notification the client does not have is replaced by
+// fetching the resource again
+func TestObserveStreamDeltaMiss(t *testing.T) {
+	next := make(chan struct{}, 3)
+	var registered message.Options
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		if _, err := r.Options.Observe(); err != nil {
+			w.SetResponse(codes.Content, message.AppCBOR, bytes.NewReader(cborBody(t, `{"n":"fetched","room":"!a"}`)))
+			return
+		}
+		registered = append(message.Options(nil), r.Options...)
+		w.SetResponse(codes.Content, message.AppCBOR, nil)
+		cc, token := w.Client(), append(message.Token(nil), r.Token...)
+		go func() {
+			// 2 is in full, 3 is a delta from 2, and 4 is a delta from 2 but the client has 3
+			for _, n := range []struct {
+				seq, base uint32
+				body      string
+			}{{2, 0, `{"n":2,"room":"!a"}`}, {3, 2, `{"n":3}`}, {4, 2, `{"n":4}`}} {
+				select {
+				case <-next:
+				case <-time.After(5 * time.Second):
+					return
+				}
+				var opts message.Options
+				buf := make([]byte, 16)
+				opts, used, _ := opts.SetContentFormat(buf, message.AppCBOR)
+				opts, m, _ := opts.SetObserve(buf[used:], n.seq)
+				if n.base != 0 {
+					opts, _, _ = opts.SetUint32(buf[used+m:], lb.OptionIDObserveDelta, n.base)
+				}
+				msg, err := pool.ConvertFrom(&message.Message{
+					Code:    codes.Content,
+					Token:   token,
+					Context: cc.Context(),
+					Options: opts,
+					Body:    bytes.NewReader(cborBody(t, n.body)),
+				})
+				if err != nil {
+					return
+				}
+				// only confirmable notifications are the base of deltas
+				msg.SetType(udpmessage.Confirmable)
+				cc.ClientConn().(*client.ClientConn).WriteMessage(msg)
+				pool.ReleaseMessage(msg)
+			}
+		}()
+	}), dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+	cp := Params()
+	cp.ObserveCompression = ObserveCompressionDelta
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	notifications := make(chan string, 10)
+	before := CurrentStats()
+	s := ObserveStream(hsURL+"/_matrix/client/r0/account/whoami", "secret", &streamFuncs{
+		notification: func(code int, body string) {
+			notifications <- body
+		},
+		closed: func() {},
+	})
+	if s == nil {
+		t.Fatalf("ObserveStream returned nil")
+	}
+	defer s.Cancel()
+	if !registered.HasOption(lb.OptionIDObserveDelta) {
+		t.Errorf("registration did not ask for deltas")
+	}
+	var got []string
+	for len(got) < 3 {
+		next <- struct{}{}
+		select {
+		case body := <-notifications:
+			got = append(got, body)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for notifications, got %v", got)
+		}
+	}
+	if want := []string{`{"n":2,"room":"!a"}`, `{"n":3,"room":"!a"}`, `{"n":"fetched","room":"!a"}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got notifications %v want %v", got, want)
+	}
+	after := CurrentStats()
+	if deltas := after.ObserveDeltas - before.ObserveDeltas; deltas != 1 {
+		t.Errorf("ObserveDeltas: got %d want 1", deltas)
+	}
+	if misses := after.ObserveDeltaMisses - before.ObserveDeltaMisses; misses != 1 {
+		t.Errorf("ObserveDeltaMisses: got %d want 1", misses)
+	}
+}
+
+// syncEndedFuncs is a DeviceListsCallback which is told when the /sync observation ends
+type syncEndedFuncs struct {
+	ended chan string
+}
+
+func (f *syncEndedFuncs) OnDeviceLists(changed, left string) {}
+func (f *syncEndedFuncs) OnSyncEnded(reason string)          { f.ended <- reason }
+
+// TestObserveSyncEnded checks the reason passed to SyncEndedCallback for each way a /sync observation can end, and
+// that only the observation is cancelled when the server ended it, so the connection carries on and observing again
+// makes a new registration.
+func TestObserveSyncEnded(t *testing.T) {
+	testCases := []struct {
+		reason string
+		// how the server answers re-registrations: ignore them, or refuse them with this code
+		ignoreRefresh bool
+		refreshCode   codes.Code
+		// send an error notification after the registration
+		errorNotification bool
+		// end the observation from the client
+		end func(t *testing.T, host string)
+	}{
+		{
+			reason: ObserveEndedBackground,
+			end: func(t *testing.T, host string) {
+				t.Cleanup(OnAppForeground)
+				OnAppBackground()
+			},
+		},
+		{
+			reason: ObserveEndedReconnect,
+			end: func(t *testing.T, host string) {
+				if !MigrateTo("") {
+					t.Fatalf("MigrateTo returned false")
+				}
+			},
+		},
+		{
+			reason: ObserveEndedConnectionLost,
+			end: func(t *testing.T, host string) {
+				conn, err := dc.getClientForHost(host)
+				if err != nil {
+					t.Fatalf("getClientForHost: %s", err)
+				}
+				conn.Close()
+			},
+		},
+		{reason: ObserveEndedTimeout, ignoreRefresh: true},
+		{reason: ObserveEndedRejected, refreshCode: codes.Unauthorized},
+		{reason: ObserveEndedServerError, errorNotification: true},
+	}
+	observes := CurrentStats().Observes
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.reason, func(t *testing.T) {
+			// the observations of the last case end when its connections are closed
+			waitFor(t, "earlier observations to end", func() bool {
+				return CurrentStats().Observes == observes
+			})
+			var mu sync.Mutex
+			registered := make(map[string]bool) // token -> registered
+			registrations := make(chan string, 10)
+			hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+				if obs, err := r.Options.Observe(); err != nil || obs != 0 {
+					w.SetResponse(codes.Content, message.TextPlain, nil)
+					return
+				}
+				mu.Lock()
+				refresh := registered[r.Token.String()]
+				registered[r.Token.String()] = true
+				mu.Unlock()
+				if refresh {
+					if tc.ignoreRefresh {
+						// only ACK it, so the client waits for a response which never comes
+						return
+					}
+					if tc.refreshCode != 0 {
+						w.SetResponse(tc.refreshCode, message.TextPlain, nil)
+						return
+					}
+				} else {
+					registrations <- r.Token.String()
+				}
+				w.SetResponse(codes.Content, message.AppCBOR, bytes.NewReader(cborBody(t, `{"next_batch":"s1"}`)))
+				if !tc.errorNotification || refresh {
+					return
+				}
+				cc, token := w.Client(), append(message.Token(nil), r.Token...)
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					var opts message.Options
+					buf := make([]byte, 16)
+					opts, n, _ := opts.SetContentFormat(buf, message.AppCBOR)
+					opts, _, _ = opts.SetObserve(buf[n:], 2)
+					cc.WriteMessage(&message.Message{
+						Code:    codes.BadGateway,
+						Token:   token,
+						Context: cc.Context(),
+						Options: opts,
+					})
+				}()
+				// without block-wise transfers, so the notification has its own message ID
+			}), dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+			host := strings.TrimPrefix(hsURL, "https://")
+			t.Cleanup(func() {
+				syncListenersMu.Lock()
+				delete(syncListeners, host)
+				syncListenersMu.Unlock()
+			})
+			if tc.ignoreRefresh || tc.refreshCode != 0 {
+				cp := Params()
+				cp.ObserveRefreshSecs = 1
+				if err := SetParams(cp); err != nil {
+					t.Fatalf("SetParams: %s", err)
+				}
+			}
+			before := CurrentStats()
+			cb := &syncEndedFuncs{ended: make(chan string, 1)}
+			if !ObserveDeviceLists(hsURL, "secret", cb) {
+				t.Fatalf("ObserveDeviceLists returned false")
+			}
+			first := <-registrations
+			conn, err := dc.getClientForHost(host)
+			if err != nil {
+				t.Fatalf("getClientForHost: %s", err)
+			}
+			if tc.end != nil {
+				tc.end(t, host)
+			}
+			select {
+			case got := <-cb.ended:
+				if got != tc.reason {
+					t.Errorf("observation ended with reason %s want %s", got, tc.reason)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for the observation to end")
+			}
+			after := CurrentStats()
+			if after.ObserveEnds-before.ObserveEnds != 1 || after.LastObserveEndReason != tc.reason {
+				t.Errorf("got %d ObserveEnds with last reason %s, want 1 with %s",
+					after.ObserveEnds-before.ObserveEnds, after.LastObserveEndReason, tc.reason)
+			}
+			if after.Observes != before.Observes {
+				t.Errorf("Observes: got %d want %d", after.Observes, before.Observes)
+			}
+			if tc.end != nil {
+				return
+			}
+			// only the observation ended, so the connection is still used for other requests
+			if got, err := dc.getClientForHost(host); err != nil || got != conn {
+				t.Errorf("the connection was replaced when the observation ended")
+			}
+			if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+				t.Errorf("SendRequest after the observation ended: got %+v want a 200", res)
+			}
+			if got, err := dc.getClientForHost(host); err != nil || got != conn {
+				t.Errorf("the connection was replaced by a request after the observation ended")
+			}
+			if !ObserveDeviceLists(hsURL, "secret", cb) {
+				t.Fatalf("ObserveDeviceLists returned false after the observation ended")
+			}
+			select {
+			case token := <-registrations:
+				if token == first {
+					t.Errorf("observed again with the same token %s", token)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("observing again did not make a new registration")
+			}
+		})
+	}
+}
+
+// syncEvents records the callbacks of a sync listener in the order they were called
+type syncEvents chan string
+
+func (e syncEvents) OnDeviceLists(changed, left string) { e <- "device_lists " + changed }
+func (e syncEvents) OnSyncEnded(reason string)          { e <- "ended " + reason }
+func (e syncEvents) OnSyncReset(reason string)          { e <- "reset " + reason }
+
+func (e syncEvents) wait(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case got := <-e:
+		if got != want {
+			t.Errorf("got listener event %q want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for listener event %q", want)
+	}
+}
+
+// TestObserveSinceRejected checks that /sync starts again from an initial sync when the server rejects the since
+// token, and that a SendRequest waiting for the observation gets the initial sync.
+func TestObserveSinceRejected(t *testing.T) {
+	registrations := make(chan syncRegistration, 10)
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		if obs, err := r.Options.Observe(); err != nil || obs != 0 {
+			w.SetResponse(codes.Content, message.TextPlain, nil)
+			return
+		}
+		reg := syncRegistration{token: r.Token.String()}
+		queries, _ := r.Options.Queries()
+		for _, q := range queries {
+			if strings.HasPrefix(q, "since=") {
+				reg.since = strings.TrimPrefix(q, "since=")
+			}
+		}
+		registrations <- reg
+		if reg.since == "" {
+			w.SetResponse(codes.Content, message.AppCBOR, bytes.NewReader(cborBody(t,
+				`{"next_batch":"s1","device_lists":{"changed":["@bob:bar"]}}`)))
+			return
+		}
+		// the homeserver has expired the since token, so the server stops observing with an error notification
+		w.SetResponse(codes.Content, message.TextPlain, nil)
+		cc, token := w.Client(), append(message.Token(nil), r.Token...)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			var opts message.Options
+			buf := make([]byte, 16)
+			opts, n, _ := opts.SetContentFormat(buf, message.AppCBOR)
+			opts, _, _ = opts.SetObserve(buf[n:], 2)
+			cc.WriteMessage(&message.Message{
+				Code:    codes.BadRequest,
+				Token:   token,
+				Context: cc.Context(),
+				Options: opts,
+			})
+		}()
+		// without block-wise transfers, so the notification has its own message ID
+	}), dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+	cp := Params()
+	cp.ObserveEnabled = true
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	host := strings.TrimPrefix(hsURL, "https://")
+	events := make(syncEvents, 10)
+	addSyncListener(host, deviceListsListener(events))
+	t.Cleanup(func() {
+		syncListenersMu.Lock()
+		delete(syncListeners, host)
+		syncListenersMu.Unlock()
+	})
+	before := CurrentStats()
+
+	res := SendRequest("GET", hsURL+"/_matrix/client/r0/sync?since=expired", "secret", "")
+	if res == nil || !strings.Contains(res.Body, `"next_batch":"s1"`) {
+		t.Fatalf("SendRequest /sync: got %+v want the initial sync", res)
+	}
+	first := waitForRegistration(t, registrations)
+	if first.since != "expired" {
+		t.Errorf("registered with since %q want expired", first.since)
+	}
+	initial := waitForRegistration(t, registrations)
+	if initial.since != "" || initial.token == first.token {
+		t.Errorf("registered again with %+v, want a new registration without a since token", initial)
+	}
+	// the listener is told before the initial sync arrives
+	events.wait(t, "ended "+ObserveEndedServerError)
+	events.wait(t, "reset "+SyncResetRejected)
+	events.wait(t, "device_lists @bob:bar")
+	if got := CurrentStats().SyncResets - before.SyncResets; got != 1 {
+		t.Errorf("SyncResets: got %d more want 1 more", got)
+	}
+}
+
+// TestObserveSyncLateNotification checks that the events of a /sync notification which is overtaken by a newer one are
+// not lost, as the newer one is replaced by fetching /sync again from the since token of the last one delivered
+func TestObserveSyncLateNotification(t *testing.T) {
+	next := make(chan struct{}, 4)
+	fetches := make(chan string, 10)
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		if obs, err := r.Options.Observe(); err != nil || obs != 0 {
+			// fetching /sync again
+			queries, _ := r.Options.Queries()
+			since := ""
+			for _, q := range queries {
+				if strings.HasPrefix(q, "since=") {
+					since = strings.TrimPrefix(q, "since=")
+				}
+			}
+			fetches <- since
+			w.SetResponse(codes.Content, message.AppCBOR, bytes.NewReader(cborBody(t,
+				`{"next_batch":"s4","device_lists":{"changed":["@3:bar","@4:bar"]}}`)))
+			return
+		}
+		w.SetResponse(codes.Content, message.AppCBOR, bytes.NewReader(cborBody(t,
+			`{"next_batch":"s1","device_lists":{"changed":["@1:bar"]}}`)))
+		cc, token := w.Client(), append(message.Token(nil), r.Token...)
+		go func() {
+			// 4 is sent before 3, which is sent once /sync has been fetched again, so really does arrive late
+			for _, seq := range []uint32{2, 4, 3, 5} {
+				select {
+				case <-next:
+				case <-time.After(5 * time.Second):
+					return
+				}
+				var opts message.Options
+				buf := make([]byte, 16)
+				opts, n, _ := opts.SetContentFormat(buf, message.AppCBOR)
+				opts, _, _ = opts.SetObserve(buf[n:], seq)
+				cc.WriteMessage(&message.Message{
+					Code:    codes.Content,
+					Token:   token,
+					Context: cc.Context(),
+					Options: opts,
+					Body: bytes.NewReader(cborBody(t, fmt.Sprintf(
+						`{"next_batch":"s%d","device_lists":{"changed":["@%d:bar"]}}`, seq, seq))),
+				})
+			}
+		}()
+	}), dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+	cp := Params()
+	cp.ObserveEnabled = true
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	host := strings.TrimPrefix(hsURL, "https://")
+	events := make(syncEvents, 10)
+	addSyncListener(host, deviceListsListener(events))
+	before := CurrentStats()
+
+	res := SendRequest("GET", hsURL+"/_matrix/client/r0/sync", "secret", "")
+	if res == nil || !strings.Contains(res.Body, `"next_batch":"s1"`) {
+		t.Fatalf("SendRequest /sync: got %+v want the first batch", res)
+	}
+	events.wait(t, "device_lists @1:bar")
+	// 4 is replaced by /sync from s2, which has the events of 3 and 4, then 3 is stale
+	for _, want := range []string{"@2:bar", "@3:bar,@4:bar", "@5:bar"} {
+		next <- struct{}{}
+		if want == "@5:bar" {
+			next <- struct{}{}
+		}
+		events.wait(t, "device_lists "+want)
+	}
+	select {
+	case since := <-fetches:
+		if since != "s2" {
+			t.Errorf("fetched /sync again from since %q want s2", since)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for /sync to be fetched again")
+	}
+	after := CurrentStats()
+	if got := after.ObserveResyncs - before.ObserveResyncs; got != 1 {
+		t.Errorf("ObserveResyncs: got %d more want 1", got)
+	}
+}
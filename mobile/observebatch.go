@@ -0,0 +1,121 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"sync"
+	"time"
+)
+
+// NotificationBatch is the notifications of a stream delivered together, oldest first, when ObserveBatchSize or
+// ObserveBatchIntervalMs is set. gomobile cannot bind slices of structs, hence the accessors.
+type NotificationBatch struct {
+	codes  []int
+	bodies []string
+}
+
+// Len returns the number of notifications in the batch
+func (b *NotificationBatch) Len() int {
+	return len(b.codes)
+}
+
+// Code returns the HTTP status code of the i'th notification
+func (b *NotificationBatch) Code(i int) int {
+	return b.codes[i]
+}
+
+// Body returns the JSON body of the i'th notification
+func (b *NotificationBatch) Body(i int) string {
+	return b.bodies[i]
+}
+
+// StreamBatchCallback can be implemented by a StreamCallback to be given each batch of notifications in a single
+// call, rather than a call to OnNotification for each of them
+type StreamBatchCallback interface {
+	OnNotifications(batch *NotificationBatch)
+}
+
+// notificationBatcher collects the notifications of a stream into batches. The zero value is ready to use.
+type notificationBatcher struct {
+	// held while delivering, so batches reach the callback in the order they were collected
+	deliverMu sync.Mutex
+	mu        sync.Mutex
+	pending   *NotificationBatch
+	timer     *time.Timer
+}
+
+// add appends a notification to the pending batch, delivering the batch if it is full. A notification which is not
+// 2xx ends the stream, so it is delivered straight away with the notifications before it.
+func (nb *notificationBatcher) add(code int, body string, deliver func(*NotificationBatch)) {
+	cp := params()
+	nb.mu.Lock()
+	b := nb.pending
+	if b == nil {
+		b = &NotificationBatch{}
+		nb.pending = b
+		if cp.ObserveBatchIntervalMs > 0 {
+			// the interval starts at the first notification, so none waits longer than the interval
+			nb.timer = time.AfterFunc(time.Duration(cp.ObserveBatchIntervalMs)*time.Millisecond, func() {
+				deliverObserveCallback(false, func() {
+					nb.flush(b, deliver)
+				})
+			})
+		}
+	}
+	b.codes = append(b.codes, code)
+	b.bodies = append(b.bodies, body)
+	full := (cp.ObserveBatchSize > 0 && b.Len() >= cp.ObserveBatchSize) || code < 200 || code >= 300
+	nb.mu.Unlock()
+	if full {
+		nb.flush(b, deliver)
+	}
+}
+
+// flush delivers the pending batch if it is want, or whatever is pending if want is nil
+func (nb *notificationBatcher) flush(want *NotificationBatch, deliver func(*NotificationBatch)) {
+	nb.deliverMu.Lock()
+	defer nb.deliverMu.Unlock()
+	nb.mu.Lock()
+	b := nb.pending
+	if b == nil || (want != nil && b != want) {
+		// already delivered
+		nb.mu.Unlock()
+		return
+	}
+	nb.pending = nil
+	if nb.timer != nil {
+		nb.timer.Stop()
+		nb.timer = nil
+	}
+	nb.mu.Unlock()
+	recordNotificationBatch()
+	deliver(b)
+}
+
+// batchingNotifications returns true if stream notifications are delivered in batches
+func batchingNotifications(cp *ConnectionParams) bool {
+	return cp.ObserveBatchSize > 0 || cp.ObserveBatchIntervalMs > 0
+}
+
+// deliverBatch passes a batch of notifications to the stream's callback
+func (s *Stream) deliverBatch(b *NotificationBatch) {
+	if bcb, ok := s.cb.(StreamBatchCallback); ok {
+		bcb.OnNotifications(b)
+		return
+	}
+	for i := range b.codes {
+		s.cb.OnNotification(b.codes[i], b.bodies[i])
+	}
+}
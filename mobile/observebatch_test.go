@@ -0,0 +1,120 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+// batchRecorder is a StreamBatchCallback sending the bodies of each batch to a channel
+type batchRecorder struct {
+	batches chan []string
+}
+
+func (r *batchRecorder) OnNotification(code int, body string) {
+	r.batches <- []string{"unbatched " + body}
+}
+
+func (r *batchRecorder) OnNotifications(batch *NotificationBatch) {
+	var bodies []string
+	for i := 0; i < batch.Len(); i++ {
+		bodies = append(bodies, fmt.Sprintf("%d %s", batch.Code(i), batch.Body(i)))
+	}
+	r.batches <- bodies
+}
+
+func (r *batchRecorder) OnClosed() {}
+
+// TestObserveBatching checks that stream notifications are delivered in batches of ObserveBatchSize, or after
+// ObserveBatchIntervalMs if fewer arrive, in the order they arrived, and that a notification ending the stream is
+// delivered straight away
+func TestObserveBatching(t *testing.T) {
+	cp := Params()
+	cp.ObserveBatchSize = 3
+	cp.ObserveBatchIntervalMs = 300
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	t.Cleanup(func() {
+		cp := Params()
+		cp.ObserveBatchSize, cp.ObserveBatchIntervalMs = 0, 0
+		SetParams(cp)
+	})
+	r := &batchRecorder{batches: make(chan []string, 10)}
+	s := &Stream{
+		reg:  &observeRefresh{path: "/o"},
+		done: make(chan struct{}),
+		cb:   r,
+	}
+	notify := s.notifier()
+	send := func(seq uint32, code codes.Code) {
+		msg := pool.AcquireMessage(context.Background())
+		defer pool.ReleaseMessage(msg)
+		msg.SetCode(code)
+		msg.SetObserve(seq)
+		msg.SetContentFormat(message.AppCBOR)
+		msg.SetBody(bytes.NewReader(cborBody(t, fmt.Sprintf(`{"n":%d}`, seq))))
+		notify(msg)
+	}
+	next := func(timeout time.Duration) []string {
+		select {
+		case b := <-r.batches:
+			return b
+		case <-time.After(timeout):
+			return nil
+		}
+	}
+	before := CurrentStats()
+
+	for seq := uint32(1); seq <= 7; seq++ {
+		send(seq, codes.Content)
+	}
+	// full batches are delivered as soon as they are full
+	for _, want := range [][]string{
+		{`200 {"n":1}`, `200 {"n":2}`, `200 {"n":3}`},
+		{`200 {"n":4}`, `200 {"n":5}`, `200 {"n":6}`},
+	} {
+		if got := next(100 * time.Millisecond); !reflect.DeepEqual(got, want) {
+			t.Errorf("got batch %v want %v", got, want)
+		}
+	}
+	// the rest wait for the interval
+	start := time.Now()
+	if got := next(2 * time.Second); !reflect.DeepEqual(got, []string{`200 {"n":7}`}) {
+		t.Errorf("got batch %v want the last notification", got)
+	}
+	if took := time.Since(start); took < 200*time.Millisecond {
+		t.Errorf("partial batch was delivered after %v want the %dms interval", took, cp.ObserveBatchIntervalMs)
+	}
+
+	// a notification which ends the stream does not wait
+	send(8, codes.Content)
+	send(9, codes.NotFound)
+	if got := next(100 * time.Millisecond); len(got) != 2 || got[0] != `200 {"n":8}` || got[1][:3] != "404" {
+		t.Errorf("got batch %v want n=8 then the 404", got)
+	}
+	if got := CurrentStats().NotificationBatches - before.NotificationBatches; got != 4 {
+		t.Errorf("NotificationBatches: got %d more want 4", got)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+	"github.com/matrix-org/lb"
+)
+
+// ResponseOptionsCallback is notified of custom CoAP options on responses
+type ResponseOptionsCallback interface {
+	// OnResponseOption is called once per custom option on a response, with the HTTP path of the request, the
+	// option number and its value.
+	OnResponseOption(path string, number int, value string)
+}
+
+var (
+	responseOptionsCb   ResponseOptionsCallback
+	responseOptionsCbMu sync.Mutex
+)
+
+// SetResponseOptionsCallback sets the callback to notify of custom CoAP options on responses. Custom options
+// are those with numbers from 2048 to 65535. Pass <nil> to stop being notified.
+func SetResponseOptionsCallback(cb ResponseOptionsCallback) {
+	responseOptionsCbMu.Lock()
+	defer responseOptionsCbMu.Unlock()
+	responseOptionsCb = cb
+}
+
+// parseRequestOptions parses RequestOptions, e.g "2049=tenant-a,65000=abc"
+func parseRequestOptions(s string) ([]message.Option, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var opts []message.Option
+	for _, kv := range strings.Split(s, ",") {
+		kvs := strings.SplitN(kv, "=", 2)
+		if len(kvs) != 2 {
+			return nil, fmt.Errorf("option %q is not of the form number=value", kv)
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(kvs[0]), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("option %q has an invalid number: %w", kv, err)
+		}
+		if err = lb.ValidateCustomOptionID(message.OptionID(id)); err != nil {
+			return nil, err
+		}
+		opts = append(opts, message.Option{
+			ID:    message.OptionID(id),
+			Value: []byte(kvs[1]),
+		})
+	}
+	return opts, nil
+}
+
+// requestOptions returns the custom options to send with every request
+func requestOptions(cp *ConnectionParams) []message.Option {
+	// SetParams has already checked these
+	opts, _ := parseRequestOptions(cp.RequestOptions)
+	return opts
+}
+
+func addRequestOptions(msg *pool.Message, cp *ConnectionParams) {
+	for _, opt := range requestOptions(cp) {
+		msg.AddOptionBytes(opt.ID, opt.Value)
+	}
+}
+
+// notifyResponseOptions tells the ResponseOptionsCallback about the custom options in opts
+func notifyResponseOptions(path string, opts message.Options) {
+	responseOptionsCbMu.Lock()
+	cb := responseOptionsCb
+	responseOptionsCbMu.Unlock()
+	if cb == nil {
+		return
+	}
+	for _, opt := range opts {
+		if lb.ValidateCustomOptionID(opt.ID) == nil {
+			cb.OnResponseOption(path, int(opt.ID), string(opt.Value))
+		}
+	}
+}
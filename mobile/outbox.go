@@ -0,0 +1,418 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OutboxCallback is notified when a queued request has been sent
+type OutboxCallback interface {
+	// OnSent is called with the transaction ID of the request and the response from the server. The response
+	// may be an error, e.g if the access token has expired since the request was queued. Server errors and rate
+	// limiting (5xx and 429) are not passed on: the request stays queued and is sent again after a backoff.
+	OnSent(txnID string, res *Response)
+}
+
+// outboxEntry is a single queued request
+type outboxEntry struct {
+	TxnID  string `json:"txn_id"`
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Body   string `json:"body,omitempty"`
+	// urgent requests are sent even while sending is paused
+	Urgent bool `json:"urgent,omitempty"`
+}
+
+// outbox is a list of requests waiting to be sent, which is persisted to a file
+type outbox struct {
+	mu       sync.Mutex
+	path     string
+	cb       OutboxCallback
+	entries  []outboxEntry
+	flushing bool
+	// true if flush was called while flushing, in which case another pass is made
+	flushAgain bool
+	// the hosts whose requests are held until a backoff ends, as a request to them got a 5xx or 429, and the number
+	// of those responses in a row each request has had
+	retryAt  map[string]time.Time
+	attempts map[string]int
+	now      func() time.Time
+}
+
+// The backoff of a request which gets a 5xx or 429 doubles from outboxRetryMin with each one in a row, up to
+// outboxRetryMax. A 429 with a retry_after_ms waits that long instead.
+var (
+	outboxRetryMin = time.Second
+	outboxRetryMax = 5 * time.Minute
+)
+
+var (
+	ob   *outbox
+	obMu sync.Mutex
+	// true between PauseSending and ResumeSending
+	sendingPaused bool
+)
+
+// SetOutbox enables the outbox, which stores queued requests in the file at filePath so they survive the app
+// being killed. Requests already in the file are loaded and sent when there is a connection to their homeserver.
+// cb is notified when each queued request is sent. An empty filePath disables the outbox, but does not delete the
+// file. Returns an error if the file exists but cannot be read.
+//
+// The file contains access tokens, so it should be stored somewhere only the app can read.
+func SetOutbox(filePath string, cb OutboxCallback) error {
+	if filePath == "" {
+		obMu.Lock()
+		ob = nil
+		obMu.Unlock()
+		setOutboxDepth(0)
+		return nil
+	}
+	o := &outbox{
+		path:     filePath,
+		cb:       cb,
+		retryAt:  make(map[string]time.Time),
+		attempts: make(map[string]int),
+		now:      time.Now,
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read outbox: %w", err)
+	}
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, &o.entries); err != nil {
+			return fmt.Errorf("failed to unmarshal outbox: %w", err)
+		}
+	}
+	obMu.Lock()
+	ob = o
+	obMu.Unlock()
+	setOutboxDepth(len(o.entries))
+	go o.flush()
+	return nil
+}
+
+// QueueRequest queues a request with a transaction ID, e.g sending an event with
+// PUT /rooms/{roomId}/send/{eventType}/{txnId} or to-device messages with PUT /sendToDevice/{eventType}/{txnId},
+// then tries to send it. The parameters are the same as SendRequest.
+// If the request cannot be sent, e.g because there is no connection, it stays in the outbox and is retried when a
+// connection to the homeserver is made. The transaction ID is the last segment of the path. A request with the same
+// URL as one already in the outbox is ignored, as it would be deduplicated by the homeserver anyway. Transaction IDs
+// are scoped to the endpoint, so the same transaction ID can be queued for different endpoints.
+// Returns false if the request could not be queued, e.g because SetOutbox has not been called, in which case clients
+// should send the request themselves.
+func QueueRequest(method, hsURL, token, body string) bool {
+	return queueRequest(method, hsURL, token, body, false)
+}
+
+// QueueUrgentRequest is QueueRequest for requests which must not wait for ResumeSending, e.g a message the user has
+// just sent. While sending is paused, urgent requests are sent ahead of requests to the same host which were queued
+// before them. If the request is already queued, it becomes urgent.
+func QueueUrgentRequest(method, hsURL, token, body string) bool {
+	return queueRequest(method, hsURL, token, body, true)
+}
+
+// PauseSending holds requests in the outbox until ResumeSending is called, so apps can batch network activity into
+// windows and let the radio sleep in between. Requests queued with QueueUrgentRequest are still sent. Requests made
+// with SendRequest are not queued, so are not held. The paused state is in CurrentStats().SendingPaused, and the
+// number of requests waiting is OutboxDepth.
+func PauseSending() {
+	obMu.Lock()
+	sendingPaused = true
+	obMu.Unlock()
+	logrus.Info("Outbox: sending paused")
+}
+
+// ResumeSending sends the requests held since PauseSending, in the order they were queued
+func ResumeSending() {
+	obMu.Lock()
+	sendingPaused = false
+	obMu.Unlock()
+	logrus.Info("Outbox: sending resumed")
+	go flushOutbox()
+}
+
+func isSendingPaused() bool {
+	obMu.Lock()
+	defer obMu.Unlock()
+	return sendingPaused
+}
+
+func queueRequest(method, hsURL, token, body string, urgent bool) bool {
+	obMu.Lock()
+	o := ob
+	obMu.Unlock()
+	if o == nil {
+		logrus.Error("QueueRequest: outbox is not enabled, call SetOutbox")
+		return false
+	}
+	u, err := url.Parse(hsURL)
+	if err != nil {
+		logrus.WithError(err).Error("QueueRequest: failed to parse HS URL")
+		return false
+	}
+	if method != "PUT" {
+		logrus.Errorf("QueueRequest: %s requests do not have transaction IDs", method)
+		return false
+	}
+	txnID := path.Base(u.Path)
+	if txnID == "" || txnID == "/" || txnID == "." {
+		logrus.WithField("url", hsURL).Error("QueueRequest: URL has no transaction ID")
+		return false
+	}
+	if err = o.add(outboxEntry{
+		TxnID:  txnID,
+		Method: method,
+		URL:    hsURL,
+		Token:  token,
+		Body:   body,
+		Urgent: urgent,
+	}); err != nil {
+		logrus.WithError(err).Error("QueueRequest: failed to queue request")
+		return false
+	}
+	go o.flush()
+	return true
+}
+
+// flushOutbox sends queued requests, if the outbox is enabled
+func flushOutbox() {
+	obMu.Lock()
+	o := ob
+	obMu.Unlock()
+	if o != nil {
+		o.flush()
+	}
+}
+
+func (o *outbox) add(e outboxEntry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, existing := range o.entries {
+		if existing.URL != e.URL {
+			continue
+		}
+		logrus.WithField("txn_id", e.TxnID).Info("QueueRequest: request is already queued")
+		if e.Urgent && !existing.Urgent {
+			o.entries[i].Urgent = true
+			if err := o.save(); err != nil {
+				o.entries[i].Urgent = false
+				return err
+			}
+		}
+		return nil
+	}
+	o.entries = append(o.entries, e)
+	if err := o.save(); err != nil {
+		o.entries = o.entries[:len(o.entries)-1]
+		return err
+	}
+	setOutboxDepth(len(o.entries))
+	return nil
+}
+
+// flush sends queued requests in the order they were queued. If a flush is already running, it makes another pass
+// when it finishes rather than running concurrently.
+func (o *outbox) flush() {
+	o.mu.Lock()
+	if o.flushing {
+		o.flushAgain = true
+		o.mu.Unlock()
+		return
+	}
+	o.flushing = true
+	o.mu.Unlock()
+	for {
+		o.flushOnce()
+		o.mu.Lock()
+		if !o.flushAgain {
+			o.flushing = false
+			o.mu.Unlock()
+			return
+		}
+		o.flushAgain = false
+		o.mu.Unlock()
+	}
+}
+
+// flushOnce sends each queued request once. Once a request to a host fails, the rest of the requests to that host
+// are left until the next flush so they are still sent in order. Hosts which are backing off are left until the
+// backoff ends. While sending is paused, only urgent requests are sent.
+func (o *outbox) flushOnce() {
+	failedHosts := o.backingOff()
+	for {
+		e, ok := o.next(failedHosts, isSendingPaused())
+		if !ok {
+			return
+		}
+		res := SendRequest(e.Method, e.URL, e.Token, e.Body)
+		if res == nil {
+			u, _ := url.Parse(e.URL)
+			failedHosts[u.Host] = true
+			logrus.WithField("txn_id", e.TxnID).Info("Outbox: failed to send request, will retry on reconnect")
+			continue
+		}
+		if retryable(res.Code) {
+			u, _ := url.Parse(e.URL)
+			failedHosts[u.Host] = true
+			delay := o.backOff(u.Host, e.URL, res)
+			logrus.WithField("txn_id", e.TxnID).Infof("Outbox: got HTTP %d, will retry in %v", res.Code, delay)
+			continue
+		}
+		o.mu.Lock()
+		delete(o.attempts, e.URL)
+		o.mu.Unlock()
+		removed, err := o.remove(e.URL)
+		if err != nil {
+			logrus.WithError(err).WithField("txn_id", e.TxnID).Error("Outbox: failed to remove sent request")
+		}
+		if !removed {
+			// CancelAll emptied the outbox while the request was in flight
+			continue
+		}
+		if o.cb != nil {
+			o.cb.OnSent(e.TxnID, res)
+		}
+	}
+}
+
+// retryable returns true if a request which got the HTTP status code may succeed if it is sent again later, rather
+// than being a permanent failure
+func retryable(code int) bool {
+	return code == 429 || code/100 == 5
+}
+
+// backingOff returns the hosts which are backing off
+func (o *outbox) backingOff() map[string]bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	hosts := make(map[string]bool)
+	now := o.now()
+	for host, at := range o.retryAt {
+		if now.Before(at) {
+			hosts[host] = true
+		} else {
+			delete(o.retryAt, host)
+		}
+	}
+	return hosts
+}
+
+// backOff holds the requests to host until the backoff of the request to hsURL, which got res, ends, then flushes
+// the outbox again. Returns the backoff.
+func (o *outbox) backOff(host, hsURL string, res *Response) time.Duration {
+	o.mu.Lock()
+	o.attempts[hsURL]++
+	delay := retryAfter(res)
+	if delay == 0 {
+		delay = outboxRetryMin << uint(o.attempts[hsURL]-1)
+		if delay > outboxRetryMax || delay <= 0 {
+			delay = outboxRetryMax
+		}
+	}
+	o.retryAt[host] = o.now().Add(delay)
+	o.mu.Unlock()
+	time.AfterFunc(delay, func() {
+		// don't send requests from an outbox which SetOutbox has since replaced
+		obMu.Lock()
+		current := ob == o
+		obMu.Unlock()
+		if current {
+			o.flush()
+		}
+	})
+	return delay
+}
+
+// retryAfter returns how long the server asked for the request to wait before being sent again, or 0 if it did not
+// say. Matrix servers give this as the retry_after_ms of an M_LIMIT_EXCEEDED error, as well as the HTTP Retry-After
+// header, which CoAP has no option for.
+func retryAfter(res *Response) time.Duration {
+	var body struct {
+		RetryAfterMs int64 `json:"retry_after_ms"`
+	}
+	if res.Code != 429 || json.Unmarshal([]byte(res.Body), &body) != nil || body.RetryAfterMs <= 0 {
+		return 0
+	}
+	delay := time.Duration(body.RetryAfterMs) * time.Millisecond
+	if delay > outboxRetryMax {
+		delay = outboxRetryMax
+	}
+	return delay
+}
+
+// next returns the oldest queued request which isn't to a host in skipHosts, and is urgent if urgentOnly is set
+func (o *outbox) next(skipHosts map[string]bool, urgentOnly bool) (outboxEntry, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, e := range o.entries {
+		if urgentOnly && !e.Urgent {
+			continue
+		}
+		u, err := url.Parse(e.URL)
+		if err != nil || skipHosts[u.Host] {
+			continue
+		}
+		return e, true
+	}
+	return outboxEntry{}, false
+}
+
+// remove removes the request to hsURL, returning false if it was not queued
+func (o *outbox) remove(hsURL string) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := range o.entries {
+		if o.entries[i].URL == hsURL {
+			o.entries = append(o.entries[:i], o.entries[i+1:]...)
+			setOutboxDepth(len(o.entries))
+			return true, o.save()
+		}
+	}
+	return false, nil
+}
+
+// clear removes every queued request, returning how many there were
+func (o *outbox) clear() (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := len(o.entries)
+	o.entries = nil
+	setOutboxDepth(0)
+	return n, o.save()
+}
+
+// save writes the outbox to a temporary file then renames it, so a crash never leaves a partially written outbox
+func (o *outbox) save() error {
+	data, err := json.Marshal(o.entries)
+	if err != nil {
+		return err
+	}
+	tmpPath := o.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, o.path)
+}
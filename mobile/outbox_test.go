@@ -0,0 +1,297 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/lb"
+)
+
+type outboxFunc func(txnID string, res *Response)
+
+func (f outboxFunc) OnSent(txnID string, res *Response) { f(txnID, res) }
+
+func TestOutboxOfflineThenOnline(t *testing.T) {
+	// find a free port, then send to it before anything is listening
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	cp := Params()
+	cp.InsecureSkipVerify = true
+	// nothing is listening yet so don't wait long for handshakes
+	cp.HandshakeTimeoutSecs = 1
+	defaultParams := *Params()
+	if err = SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	t.Cleanup(func() { SetParams(&defaultParams) })
+
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	outboxPath := filepath.Join(dir, "outbox.json")
+
+	var mu sync.Mutex
+	var sent []string
+	cb := outboxFunc(func(txnID string, res *Response) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, txnID+" "+res.Body)
+	})
+	if err = SetOutbox(outboxPath, cb); err != nil {
+		t.Fatalf("SetOutbox: %s", err)
+	}
+	t.Cleanup(func() { SetOutbox("", nil) })
+
+	sendURL := "https://" + addr + "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/"
+	for _, txnID := range []string{"txn1", "txn2", "txn1"} {
+		if !QueueRequest("PUT", sendURL+txnID, "secret", `{"body":"`+txnID+`"}`) {
+			t.Fatalf("QueueRequest %s returned false", txnID)
+		}
+	}
+	// transaction IDs are scoped to the endpoint, so this isn't a duplicate
+	toDeviceURL := "https://" + addr + "/_matrix/client/r0/sendToDevice/m.room.encrypted/txn1"
+	if !QueueRequest("PUT", toDeviceURL, "secret", `{"messages":{}}`) {
+		t.Fatalf("QueueRequest to-device txn1 returned false")
+	}
+	if QueueRequest("POST", sendURL+"txn3", "secret", `{}`) {
+		t.Errorf("QueueRequest accepted a request without a transaction ID")
+	}
+	// make sure a flush has been attempted since the requests were queued
+	flushOutbox()
+	waitFor(t, "the offline flush to finish", func() bool {
+		ob.mu.Lock()
+		defer ob.mu.Unlock()
+		return !ob.flushing
+	})
+	if depth := CurrentStats().OutboxDepth; depth != 3 {
+		t.Fatalf("OutboxDepth: got %d want 3", depth)
+	}
+
+	// the outbox survives a restart
+	if err = SetOutbox(outboxPath, cb); err != nil {
+		t.Fatalf("SetOutbox after restart: %s", err)
+	}
+	if depth := CurrentStats().OutboxDepth; depth != 3 {
+		t.Fatalf("OutboxDepth after restart: got %d want 3", depth)
+	}
+
+	// go online
+	codec := lb.NewCBORCodecV1(false)
+	newCBORTestServer(t, addr, lb.NewCoAPHTTP(lb.NewCoAPPathV1()), lb.CBORToJSONHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			w.Write([]byte(`{"event_id":"$` + filepath.Base(req.URL.Path) + `","sent":` + string(body) + `}`))
+		}), codec, nil,
+	))
+	if err = Connect("https://" + addr); err != nil {
+		t.Fatalf("Connect: %s", err)
+	}
+	waitFor(t, "the outbox to be flushed", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent) == 3
+	})
+	want := []string{
+		`txn1 {"event_id":"$txn1","sent":{"body":"txn1"}}`,
+		`txn2 {"event_id":"$txn2","sent":{"body":"txn2"}}`,
+		`txn1 {"event_id":"$txn1","sent":{"messages":{}}}`,
+	}
+	mu.Lock()
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Errorf("sent[%d]: got %s want %s", i, sent[i], want[i])
+		}
+	}
+	mu.Unlock()
+	if depth := CurrentStats().OutboxDepth; depth != 0 {
+		t.Errorf("OutboxDepth after flush: got %d want 0", depth)
+	}
+	data, err := ioutil.ReadFile(outboxPath)
+	if err != nil {
+		t.Fatalf("failed to read outbox: %s", err)
+	}
+	if string(data) != "[]" {
+		t.Errorf("outbox file: got %s want []", string(data))
+	}
+}
+
+func TestOutboxPauseSending(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		received = append(received, filepath.Base(req.URL.Path))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"event_id":"$` + filepath.Base(req.URL.Path) + `"}`))
+	}))
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	var sent []string
+	cb := outboxFunc(func(txnID string, res *Response) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, txnID)
+	})
+	if err = SetOutbox(filepath.Join(dir, "outbox.json"), cb); err != nil {
+		t.Fatalf("SetOutbox: %s", err)
+	}
+	t.Cleanup(func() { SetOutbox("", nil) })
+
+	PauseSending()
+	t.Cleanup(ResumeSending)
+	if !CurrentStats().SendingPaused {
+		t.Errorf("SendingPaused is false after PauseSending")
+	}
+	sendURL := hsURL + "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/"
+	if !QueueRequest("PUT", sendURL+"txn1", "secret", `{"body":"later"}`) {
+		t.Fatalf("QueueRequest returned false")
+	}
+	if !QueueUrgentRequest("PUT", sendURL+"txn2", "secret", `{"body":"now"}`) {
+		t.Fatalf("QueueUrgentRequest returned false")
+	}
+	waitFor(t, "the urgent request to be sent", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent) == 1
+	})
+	flushOutbox()
+	mu.Lock()
+	if len(received) != 1 || received[0] != "txn2" {
+		t.Errorf("while paused the server received %v, want only txn2", received)
+	}
+	mu.Unlock()
+	if depth := CurrentStats().OutboxDepth; depth != 1 {
+		t.Errorf("OutboxDepth while paused: got %d want 1", depth)
+	}
+
+	ResumeSending()
+	if CurrentStats().SendingPaused {
+		t.Errorf("SendingPaused is true after ResumeSending")
+	}
+	waitFor(t, "the held request to be sent", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent) == 2
+	})
+	mu.Lock()
+	if sent[1] != "txn1" {
+		t.Errorf("sent %v want txn2 then txn1", sent)
+	}
+	mu.Unlock()
+	if depth := CurrentStats().OutboxDepth; depth != 0 {
+		t.Errorf("OutboxDepth after resuming: got %d want 0", depth)
+	}
+}
+
+// TestOutboxRetry checks that requests which get a 5xx or 429 stay queued, holding back later requests to the host,
+// and are sent again after a backoff which honours retry_after_ms, while permanent failures are dropped
+func TestOutboxRetry(t *testing.T) {
+	defaultMin := outboxRetryMin
+	outboxRetryMin = 50 * time.Millisecond
+	t.Cleanup(func() { outboxRetryMin = defaultMin })
+	const retryAfter = 300 * time.Millisecond
+
+	var mu sync.Mutex
+	var received []string
+	var times []time.Time
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		txnID := filepath.Base(req.URL.Path)
+		mu.Lock()
+		received = append(received, txnID)
+		times = append(times, time.Now())
+		attempt := len(received)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case txnID == "txn1" && attempt == 1:
+			w.WriteHeader(429)
+			w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":300}`))
+		case txnID == "txn1" && attempt == 2:
+			w.WriteHeader(503)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"Try again"}`))
+		case txnID == "txn2":
+			w.WriteHeader(403)
+			w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Not in room"}`))
+		default:
+			w.WriteHeader(200)
+			w.Write([]byte(`{"event_id":"$` + txnID + `"}`))
+		}
+	}))
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	var sent []string
+	cb := outboxFunc(func(txnID string, res *Response) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, fmt.Sprintf("%s %d", txnID, res.Code))
+	})
+	if err = SetOutbox(filepath.Join(dir, "outbox.json"), cb); err != nil {
+		t.Fatalf("SetOutbox: %s", err)
+	}
+	t.Cleanup(func() { SetOutbox("", nil) })
+
+	sendURL := hsURL + "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/"
+	for _, txnID := range []string{"txn1", "txn2", "txn3"} {
+		if !QueueRequest("PUT", sendURL+txnID, "secret", `{"body":"`+txnID+`"}`) {
+			t.Fatalf("QueueRequest %s returned false", txnID)
+		}
+	}
+	waitFor(t, "all requests to be sent", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent) == 3
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	wantSent := []string{"txn1 200", "txn2 403", "txn3 200"}
+	if fmt.Sprint(sent) != fmt.Sprint(wantSent) {
+		t.Errorf("OnSent got %v want %v", sent, wantSent)
+	}
+	wantReceived := []string{"txn1", "txn1", "txn1", "txn2", "txn3"}
+	if fmt.Sprint(received) != fmt.Sprint(wantReceived) {
+		t.Fatalf("server received %v want %v", received, wantReceived)
+	}
+	if wait := times[1].Sub(times[0]); wait < retryAfter {
+		t.Errorf("sent again %v after a 429 with retry_after_ms %v", wait, retryAfter)
+	}
+	if depth := CurrentStats().OutboxDepth; depth != 0 {
+		t.Errorf("OutboxDepth after sending: got %d want 0", depth)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/matrix-org/lb"
+	"github.com/sirupsen/logrus"
+)
+
+// PathRewriter customises how requests to particular endpoints are mapped to CoAP, for use with
+// ConnectionParams.PathRewriter
+type PathRewriter interface {
+	// RewritePath is called with the method, HTTP path and encoded query string of each request. It returns the
+	// CoAP path to send, optionally followed by ? and an encoded query string, e.g "/~rel/!foo:bar?limit=5", or an
+	// empty string to map the request as usual.
+	RewritePath(method, path, query string) string
+}
+
+// pathRewriter adapts a PathRewriter to lb.PathRewriter. It only rewrites requests, as responses have no path.
+type pathRewriter struct {
+	r PathRewriter
+}
+
+func (p pathRewriter) HTTPToCoAP(method, path string, query url.Values) (string, url.Values, bool) {
+	rewritten := p.r.RewritePath(method, path, query.Encode())
+	if rewritten == "" {
+		return "", nil, false
+	}
+	coapPath, rawQuery := rewritten, ""
+	if i := strings.Index(rewritten, "?"); i >= 0 {
+		coapPath, rawQuery = rewritten[:i], rewritten[i+1:]
+	}
+	coapQuery, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		logrus.WithError(err).Errorf("PathRewriter returned an invalid query for %s %s, not rewriting it", method, path)
+		return "", nil, false
+	}
+	return coapPath, coapQuery, true
+}
+
+func (p pathRewriter) CoAPToHTTP(method, coapPath string, coapQuery url.Values) (string, url.Values, bool) {
+	return "", nil, false
+}
+
+// pathSegments is the path segments dictionary requests are compressed with, if the server supports it
+var pathSegments = lb.NewPathSegmentsV1()
+
+// withPaths returns co with the PathRewriter of the params, if there is one, and which compresses paths with the
+// path segments dictionary if compress is set
+func withPaths(co *lb.CoAPHTTP, cp *ConnectionParams, compress bool) *lb.CoAPHTTP {
+	if cp.PathRewriter == nil && !compress {
+		return co
+	}
+	rewriting := *co
+	if cp.PathRewriter != nil {
+		rewriting.PathRewriter = pathRewriter{cp.PathRewriter}
+	}
+	if compress {
+		rewriting.PathSegments = pathSegments
+	}
+	return &rewriting
+}
+
+// requestPathSegments returns true if the request to u on conn should be compressed with the path segments
+// dictionary. If PathSegments is set, this fetches the server's capabilities the first time it is called for a
+// connection, to find out whether it supports them.
+func requestPathSegments(conn *client.ClientConn, u *url.URL) bool {
+	// the capabilities request cannot wait for the capabilities
+	if !params().PathSegments || u.Path == lb.CapabilitiesPath {
+		return false
+	}
+	np := connParams(conn, u)
+	return np != nil && np.PathSegmentsVersion == pathSegments.Version()
+}
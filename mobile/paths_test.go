@@ -0,0 +1,162 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/lb"
+)
+
+var relationsPathRegexp = regexp.MustCompile(`^/_matrix/client/v1/rooms/([^/]+)/relations/([^/]+)$`)
+
+// relationsRewriter sends /relations requests as /~rel/{roomId}/{eventId}, with the query unchanged
+type relationsRewriter struct {
+	// the CoAP paths the server received
+	coapPaths chan string
+}
+
+func (r *relationsRewriter) RewritePath(method, path, query string) string {
+	m := relationsPathRegexp.FindStringSubmatch(path)
+	if m == nil {
+		return ""
+	}
+	return "/~rel/" + m[1] + "/" + m[2] + "?" + query
+}
+
+func (r *relationsRewriter) HTTPToCoAP(method, path string, query url.Values) (string, url.Values, bool) {
+	return "", nil, false
+}
+
+func (r *relationsRewriter) CoAPToHTTP(method, coapPath string, coapQuery url.Values) (string, url.Values, bool) {
+	r.coapPaths <- coapPath
+	segments := strings.Split(coapPath, "/")
+	if len(segments) != 4 || segments[1] != "~rel" {
+		return "", nil, false
+	}
+	return "/_matrix/client/v1/rooms/" + segments[2] + "/relations/" + segments[3], coapQuery, true
+}
+
+func TestPathRewriter(t *testing.T) {
+	received := make(chan string, 1)
+	rewriter := &relationsRewriter{coapPaths: make(chan string, 1)}
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	coapHTTP.PathRewriter = rewriter
+	hsURL := newTestServerWithCoAPHTTP(t, coapHTTP, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Method + " " + req.URL.Path + "?" + req.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"chunk":[]}`))
+	}))
+	cp := Params()
+	cp.PathRewriter = rewriter
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+
+	path := "/_matrix/client/v1/rooms/!foo:bar/relations/$event:bar"
+	res := SendRequest("GET", hsURL+path+"?limit=5&dir=b", "secret", "")
+	if res == nil || res.Code != 200 || res.Body != `{"chunk":[]}` {
+		t.Fatalf("SendRequest: got %+v", res)
+	}
+	if got, want := <-rewriter.coapPaths, "/~rel/!foo:bar/$event:bar"; got != want {
+		t.Errorf("server got CoAP path %s want %s", got, want)
+	}
+	if got, want := <-received, "GET "+path+"?dir=b&limit=5"; got != want {
+		t.Errorf("server got %s want %s", got, want)
+	}
+
+	// other paths are mapped as usual
+	res = SendRequest("GET", hsURL+"/_matrix/client/r0/account/whoami", "secret", "")
+	if res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest: got %+v", res)
+	}
+	if got, want := <-rewriter.coapPaths, coapHTTP.Paths.HTTPPathToCoapPath("/_matrix/client/r0/account/whoami"); got != want {
+		t.Errorf("server got CoAP path %s want %s", got, want)
+	}
+	if got, want := <-received, "GET /_matrix/client/r0/account/whoami?"; got != want {
+		t.Errorf("server got %s want %s", got, want)
+	}
+}
+
+// coapPathRecorder records the CoAP paths the server receives, and maps them as usual
+type coapPathRecorder struct {
+	coapPaths chan string
+}
+
+func (r *coapPathRecorder) HTTPToCoAP(method, path string, query url.Values) (string, url.Values, bool) {
+	return "", nil, false
+}
+
+func (r *coapPathRecorder) CoAPToHTTP(method, coapPath string, coapQuery url.Values) (string, url.Values, bool) {
+	if coapPath != lb.CapabilitiesPath {
+		r.coapPaths <- coapPath
+	}
+	return "", nil, false
+}
+
+func TestPathSegments(t *testing.T) {
+	const path = "/_matrix/client/v3/keys/device_signing/upload"
+	codec := lb.NewCBORCodecV1(false)
+	testCases := []struct {
+		name         string
+		version      string
+		pathSegments bool
+		wantCoAPPath string
+	}{
+		{name: "server supports path segments", version: lb.PathSegmentsV1, pathSegments: true, wantCoAPPath: "/~0/~1/v3/~9/device_signing/~b"},
+		{name: "path segments are not requested", version: lb.PathSegmentsV1, wantCoAPPath: path},
+		{name: "server without path segments", pathSegments: true, wantCoAPPath: path},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			received := make(chan string, 1)
+			recorder := &coapPathRecorder{coapPaths: make(chan string, 1)}
+			coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+			coapHTTP.PathRewriter = recorder
+			coapHTTP.PathSegments = lb.NewPathSegmentsV1()
+			handler := lb.CBORToJSONHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				received <- req.URL.Path
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(200)
+				w.Write([]byte(`{}`))
+			}), codec, nil)
+			hsURL := newCBORTestServer(t, "127.0.0.1:0", coapHTTP, lb.CapabilitiesHandler(handler, codec, lb.Capabilities{
+				BlockSize:           1024,
+				DictionaryVersion:   lb.DictionaryV1,
+				PathSegmentsVersion: tc.version,
+			}))
+			cp := Params()
+			cp.PathSegments = tc.pathSegments
+			if err := SetParams(cp); err != nil {
+				t.Fatalf("SetParams: %s", err)
+			}
+			res := SendRequest("POST", hsURL+path, "secret", `{}`)
+			if res == nil || res.Code != 200 {
+				t.Fatalf("SendRequest: got %+v", res)
+			}
+			if got := <-recorder.coapPaths; got != tc.wantCoAPPath {
+				t.Errorf("server got CoAP path %s want %s", got, tc.wantCoAPPath)
+			}
+			if got := <-received; got != path {
+				t.Errorf("server got %s want %s", got, path)
+			}
+		})
+	}
+}
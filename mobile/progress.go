@@ -0,0 +1,225 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+// TransferProgressListener is notified of the progress of block-wise transfers, e.g to show a progress bar while
+// uploading or downloading media
+type TransferProgressListener interface {
+	// OnTransferProgress is called with the method and HTTP path of the request as blocks of its body are ACKed
+	// and blocks of its response arrive, and once more when each completes. Updates which arrive faster than the
+	// listener returns are merged, so not every block is reported.
+	OnTransferProgress(method, path string, progress *TransferProgress)
+}
+
+// TransferProgress is how far a block-wise transfer has got
+type TransferProgress struct {
+	// True while the request body is being sent, false while the response is being received
+	Upload           bool
+	BytesTransferred int64
+	// The size of the body being transferred, or -1 if it is not known yet. The CoAP library only gives the
+	// response, with its Size2 option, once the last block has arrived, so this is -1 for downloads until then.
+	TotalBytes int64
+	// The throughput of the transfer so far
+	BytesPerSecond int64
+	// The estimated time until the transfer completes at that throughput, or -1 if TotalBytes is not known
+	EstimatedMillisRemaining int64
+}
+
+var (
+	transferProgressListener   TransferProgressListener
+	transferProgressListenerMu sync.Mutex
+)
+
+// SetTransferProgressListener sets the listener to notify of the progress of block-wise transfers made by
+// SendRequest. Pass <nil> to stop being notified. Like MaxBlockwiseRoundTrips, blocks are counted as the datagrams
+// which carry them are received, so a transfer only makes progress while it is the only request in flight on its
+// connection: it is told how far it got when it completes.
+func SetTransferProgressListener(cb TransferProgressListener) {
+	transferProgressListenerMu.Lock()
+	defer transferProgressListenerMu.Unlock()
+	transferProgressListener = cb
+}
+
+// transferProgress reports the progress of a request's block-wise transfers to the TransferProgressListener.
+// Blocks are counted by the roundTripCounter of the connection, whose socket read loop must not wait for the
+// listener, so progress is reported from another goroutine.
+type transferProgress struct {
+	listener     TransferProgressListener
+	method, path string
+
+	mu        sync.Mutex
+	blockSize int64
+	upload    int64 // the size of the request body if it is sent block-wise, else 0
+	sent      int64
+	blocks    int64 // the number of blocks of the response received
+	started   time.Time
+	pending   []*TransferProgress // not reported yet, at most one for each direction
+	notify    chan struct{}
+	done      chan struct{} // nil while no transfer is in progress
+	reported  chan struct{} // closed once everything queued before done was closed has been reported
+}
+
+// newTransferProgress returns the transferProgress of a request, or nil if there is no listener to report to
+func newTransferProgress(method, path string) *transferProgress {
+	transferProgressListenerMu.Lock()
+	listener := transferProgressListener
+	transferProgressListenerMu.Unlock()
+	if listener == nil {
+		return nil
+	}
+	return &transferProgress{
+		listener: listener,
+		method:   method,
+		path:     path,
+	}
+}
+
+// start is called as the request is sent, with the size of its body and the block size of the connection
+func (p *transferProgress) start(reqBodySize, blockSize int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.blockSize = blockSize
+	p.upload = 0
+	if reqBodySize > blockSize {
+		p.upload = reqBodySize
+	}
+	p.sent = 0
+	p.blocks = 0
+	p.started = time.Now()
+	p.pending = nil
+	p.notify = make(chan struct{}, 1)
+	p.done = make(chan struct{})
+	p.reported = make(chan struct{})
+	go p.report(p.notify, p.done, p.reported)
+}
+
+// received is called for every datagram received for the request. block is true if it is big enough to be a block
+// of the response.
+func (p *transferProgress) received(block bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done == nil {
+		return
+	}
+	switch {
+	case p.sent < p.upload:
+		// each block of the request body is ACKed by the next datagram
+		p.sent += p.blockSize
+		if p.sent >= p.upload {
+			p.sent = p.upload
+			// which for the last block carries the first block of the response
+			p.blocks = 1
+		}
+		p.update(true, p.sent, p.upload)
+	case block:
+		p.blocks++
+		// the last block may be smaller, so only the blocks before it are known to be whole. A single block is the
+		// whole response, which is not a block-wise transfer.
+		if p.blocks > 1 {
+			p.update(false, (p.blocks-1)*p.blockSize, -1)
+		}
+	}
+}
+
+// finish is called when the request completes, with its response if it succeeded. It returns once the listener has
+// been told, so the final progress is reported before the response is returned.
+func (p *transferProgress) finish(res *pool.Message, err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	reported := p.reported
+	defer func() {
+		p.mu.Unlock()
+		if reported != nil {
+			<-reported
+		}
+	}()
+	if p.done == nil {
+		return
+	}
+	if err == nil {
+		if p.sent < p.upload {
+			p.update(true, p.upload, p.upload)
+		}
+		if resBodySize, _ := res.BodySize(); resBodySize > p.blockSize {
+			p.update(false, resBodySize, resBodySize)
+		}
+	}
+	close(p.done)
+	p.done = nil
+}
+
+// update queues the progress to report. Must be called with mu held.
+func (p *transferProgress) update(upload bool, transferred, total int64) {
+	progress := &TransferProgress{
+		Upload:                   upload,
+		BytesTransferred:         transferred,
+		TotalBytes:               total,
+		EstimatedMillisRemaining: -1,
+	}
+	if elapsed := time.Since(p.started); elapsed > 0 {
+		progress.BytesPerSecond = int64(float64(transferred) / elapsed.Seconds())
+	}
+	if total >= 0 && progress.BytesPerSecond > 0 {
+		progress.EstimatedMillisRemaining = (total - transferred) * 1000 / progress.BytesPerSecond
+	}
+	if n := len(p.pending); n > 0 && p.pending[n-1].Upload == upload {
+		p.pending[n-1] = progress
+	} else {
+		p.pending = append(p.pending, progress)
+	}
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// report tells the listener about queued progress until the transfer finishes
+func (p *transferProgress) report(notify, done, reported chan struct{}) {
+	for {
+		select {
+		case <-notify:
+			p.flush()
+		case <-done:
+			p.flush()
+			close(reported)
+			return
+		}
+	}
+}
+
+func (p *transferProgress) flush() {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = nil
+	p.mu.Unlock()
+	for _, progress := range pending {
+		p.listener.OnTransferProgress(p.method, p.path, progress)
+	}
+}
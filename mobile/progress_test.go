@@ -0,0 +1,114 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type transferProgressRecorder struct {
+	mu       sync.Mutex
+	progress []TransferProgress
+}
+
+func (r *transferProgressRecorder) OnTransferProgress(method, path string, progress *TransferProgress) {
+	if path != "/_matrix/media/r0/upload" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress = append(r.progress, *progress)
+}
+
+// split returns the progress of the upload and of the download
+func (r *transferProgressRecorder) split() (up, down []TransferProgress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.progress {
+		if p.Upload {
+			up = append(up, p)
+		} else {
+			down = append(down, p)
+		}
+	}
+	return
+}
+
+// checkProgress checks that the progress of a transfer increases until it has transferred all the bytes
+func checkProgress(t *testing.T, name string, progress []TransferProgress) {
+	t.Helper()
+	if len(progress) < 2 {
+		t.Fatalf("%s: got %d progress callbacks want several: %+v", name, len(progress), progress)
+	}
+	for i := 1; i < len(progress); i++ {
+		if progress[i].BytesTransferred <= progress[i-1].BytesTransferred {
+			t.Errorf("%s: progress went from %d to %d bytes", name, progress[i-1].BytesTransferred, progress[i].BytesTransferred)
+		}
+	}
+	last := progress[len(progress)-1]
+	if last.BytesTransferred != last.TotalBytes || last.EstimatedMillisRemaining != 0 {
+		t.Errorf("%s: last progress is %+v want all bytes transferred", name, last)
+	}
+}
+
+func TestTransferProgress(t *testing.T) {
+	resBody := `{"content_uri":"mxc://localhost/` + strings.Repeat("x", 5000) + `"}`
+	reqBody := `{"data":"` + strings.Repeat("y", 5000) + `"}`
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.URL.Path == "/_matrix/media/r0/upload" && string(body) != reqBody {
+			t.Errorf("server got body of %d bytes want %d", len(body), len(reqBody))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(resBody))
+	}))
+	// make the connection first, so the handshake is not counted as blocks
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest failed: %+v", res)
+	}
+	recorder := &transferProgressRecorder{}
+	SetTransferProgressListener(recorder)
+	defer SetTransferProgressListener(nil)
+
+	res := SendRequest("POST", hsURL+"/_matrix/media/r0/upload", "secret", reqBody)
+	if res == nil || res.Code != 200 || res.Body != resBody {
+		t.Fatalf("SendRequest failed: %+v", res)
+	}
+	up, down := recorder.split()
+	checkProgress(t, "upload", up)
+	checkProgress(t, "download", down)
+	total := up[0].TotalBytes
+	for _, p := range up {
+		if p.TotalBytes != total || total <= 0 {
+			t.Errorf("upload: got total %d want the request body size %d", p.TotalBytes, total)
+		}
+		if p.EstimatedMillisRemaining < 0 {
+			t.Errorf("upload: got no estimate with a known total: %+v", p)
+		}
+	}
+	for _, p := range down[:len(down)-1] {
+		if p.TotalBytes != -1 || p.EstimatedMillisRemaining != -1 {
+			t.Errorf("download: got a total before the last block: %+v", p)
+		}
+	}
+	if got := down[len(down)-1].TotalBytes; got < int64(len(resBody))/2 {
+		t.Errorf("download: got total %d want about the response body size %d", got, len(resBody))
+	}
+}
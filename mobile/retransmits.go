@@ -0,0 +1,95 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"sync"
+
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/sirupsen/logrus"
+)
+
+// The CoAP library does not report retransmissions other than by logging this, once for each
+const retransmitLogMessage = "ACK timeout expired, retrying"
+
+// retransmitBudget counts the retransmissions of every request on a connection since anything was last received on
+// it, and closes the connection when there are more than MaxConnectionRetransmits, as the link has probably gone.
+// Each request is only bounded by TransmissionMaxRetransmits, so many requests in flight on a dead link would
+// otherwise keep retransmitting until they each give up.
+type retransmitBudget struct {
+	max int // 0 means there is no limit
+
+	mu        sync.Mutex
+	conn      *client.ClientConn // nil until the handshake completes
+	used      int
+	exhausted bool
+}
+
+func newRetransmitBudget(max int) *retransmitBudget {
+	return &retransmitBudget{max: max}
+}
+
+// setConn sets the connection to close when the budget is exhausted
+func (b *retransmitBudget) setConn(conn *client.ClientConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn = conn
+}
+
+// retransmitted is called every time a request on the connection is retransmitted
+func (b *retransmitBudget) retransmitted() {
+	recordRetransmission()
+	b.mu.Lock()
+	b.used++
+	if b.max <= 0 || b.used <= b.max || b.exhausted || b.conn == nil {
+		b.mu.Unlock()
+		return
+	}
+	b.exhausted = true
+	conn := b.conn
+	b.mu.Unlock()
+	logrus.Warnf("Requests on the connection to %s were retransmitted %d times without a response, closing it", conn.RemoteAddr(), b.used)
+	recordRetransmitBudgetExhausted()
+	// forget it first, so requests which fail with it see it has closed and send again on a new connection
+	dc.forget(conn)
+	closeConn(conn, ObserveEndedConnectionLost)
+}
+
+// received is called every time a datagram of application data is received on the connection, which shows the link
+// still works
+func (b *retransmitBudget) received() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used = 0
+}
+
+// isExhausted returns true if the connection was closed for using up the budget. A nil budget never is.
+func (b *retransmitBudget) isExhausted() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exhausted
+}
+
+// connRetransmitBudget returns the retransmitBudget of conn, or nil if it has none
+func connRetransmitBudget(conn *client.ClientConn) *retransmitBudget {
+	b, _ := conn.Context().Value(ctxValRetransmitBudget).(*retransmitBudget)
+	return b
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+	"github.com/matrix-org/lb"
+	"github.com/matrix-org/lb/lbtest"
+)
+
+// TestMaxConnectionRetransmits checks that concurrent requests on a link which has gone fail as soon as they have
+// used up the connection's retransmissions between them, rather than each retransmitting until it gives up, and
+// that SendRequest sends them again on a new connection.
+func TestMaxConnectionRetransmits(t *testing.T) {
+	hsURL, lossyConns := newLossyTestServer(t, lbtest.LossyConfig{})
+	cp := Params()
+	cp.TransmissionACKTimeoutSecs = 1
+	cp.TransmissionNStart = 0
+	cp.TransmissionMaxRetransmits = 4
+	cp.MaxConnectionRetransmits = 3
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest failed: %+v", res)
+	}
+	u, _ := url.Parse(hsURL)
+	conn, err := dc.getClientForHost(u.Host)
+	if err != nil {
+		t.Fatalf("getClientForHost: %s", err)
+	}
+	before := CurrentStats()
+
+	// the link goes, and 3 requests are in flight: they retransmit once each after the ACK timeout, which uses up
+	// the budget. Without it, they would take 1+2+4+8+16 seconds to give up.
+	lossyConns()[0].SetConfig(lbtest.LossyConfig{SendLoss: 1})
+	start := time.Now()
+	var wg sync.WaitGroup
+	// one on the connection, to see its error
+	var doErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		msg, err := client.NewGetRequest(context.Background(), "/_matrix/client/versions")
+		if err != nil {
+			doErr = err
+			return
+		}
+		defer pool.ReleaseMessage(msg)
+		_, doErr = do(conn, msg, &Timings{}, newRoundTripLimit(0))
+	}()
+	// and the rest with SendRequest, which makes a new connection over a link which works again
+	codes := make([]int, 2)
+	for i := range codes {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res != nil {
+				codes[i] = res.Code
+			}
+		}()
+	}
+	wg.Wait()
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("requests took %v to fail, want them to fail after the first retransmissions", took)
+	}
+	if !errors.Is(doErr, ErrRetransmitBudgetExhausted) || !errors.Is(doErr, lb.ErrReset) {
+		t.Errorf("got error %v want ErrRetransmitBudgetExhausted and lb.ErrReset", doErr)
+	}
+	for i, code := range codes {
+		if code != 200 {
+			t.Errorf("SendRequest %d: got HTTP %d want it to succeed on a new connection", i, code)
+		}
+	}
+	if n := len(lossyConns()); n != 2 {
+		t.Errorf("got %d connections want 2", n)
+	}
+	after := CurrentStats()
+	if got := after.Retransmissions - before.Retransmissions; got < 3 {
+		t.Errorf("Retransmissions: got %d more want at least 3", got)
+	}
+	if got := after.RetransmitBudgetExhausted - before.RetransmitBudgetExhausted; got != 1 {
+		t.Errorf("RetransmitBudgetExhausted: got %d more want 1", got)
+	}
+}
+
+func TestRetransmitBudgetRefills(t *testing.T) {
+	b := newRetransmitBudget(2)
+	b.setConn(&client.ClientConn{})
+	// a lossy link which still delivers some packets never uses the budget up
+	for i := 0; i < 10; i++ {
+		b.retransmitted()
+		b.retransmitted()
+		b.received()
+	}
+	if b.isExhausted() {
+		t.Errorf("budget exhausted by retransmissions with datagrams received in between")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// retryBudget is a token bucket of retries which refills at RetryBudgetPerMinute, holding at most a minute of
+// retries. It is shared by every request, so however many are failing at once, they cannot send more than the
+// budget again between them.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	// the retries per minute the bucket was last refilled at, so a new limit starts with a full bucket. 0 if the
+	// bucket has not been used since it was reset.
+	perMinute int
+
+	now func() time.Time
+}
+
+func newRetryBudget() *retryBudget {
+	return &retryBudget{
+		now: time.Now,
+	}
+}
+
+var retries = newRetryBudget()
+
+// reset makes the bucket full the next time it is used, for when RetryBudgetPerMinute changes
+func (b *retryBudget) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.perMinute = 0
+}
+
+// allow takes a retry from the bucket, returning false if it is empty, in which case the request should fail rather
+// than be sent again. Always returns true if perMinute is 0.
+func (b *retryBudget) allow(perMinute int) bool {
+	if perMinute <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if perMinute != b.perMinute {
+		b.perMinute = perMinute
+		b.tokens = float64(perMinute)
+	} else {
+		b.tokens += now.Sub(b.last).Minutes() * float64(perMinute)
+		b.tokens = math.Min(b.tokens, float64(perMinute))
+	}
+	b.last = now
+	if b.tokens < 1 {
+		recordRetryRefused()
+		return false
+	}
+	b.tokens--
+	recordRetry()
+	return true
+}
+
+// allowRetry returns true if the request may be sent again, logging why not if it may not
+func allowRetry(cp *ConnectionParams, method, path string) bool {
+	if retries.allow(cp.RetryBudgetPerMinute) {
+		return true
+	}
+	logrus.Warnf("Not sending %s %s again, as the retry budget of %d per minute is exhausted", method, path, cp.RetryBudgetPerMinute)
+	return false
+}
+
+// retryBudgetExhaustedResponse returns an error stating the request failed and was not sent again
+func retryBudgetExhaustedResponse(perMinute int) *Response {
+	return &Response{
+		Code: 503,
+		Body: fmt.Sprintf(
+			`{"errcode":"M_UNKNOWN","error":"Request failed and was not sent again as the retry budget of %d retries per minute is exhausted","retry_budget_per_minute":%d}`,
+			perMinute, perMinute,
+		),
+	}
+}
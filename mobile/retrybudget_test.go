@@ -0,0 +1,123 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+)
+
+func TestRetryBudgetRefills(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := &retryBudget{now: func() time.Time { return now }}
+	for i := 0; i < 3; i++ {
+		if !b.allow(3) {
+			t.Fatalf("retry %d was refused with a budget of 3", i)
+		}
+	}
+	if b.allow(3) {
+		t.Errorf("4th retry was allowed with a budget of 3")
+	}
+	now = now.Add(20 * time.Second)
+	if !b.allow(3) {
+		t.Errorf("retry was refused after refilling for 20s")
+	}
+	if b.allow(3) {
+		t.Errorf("2nd retry was allowed after refilling for 20s")
+	}
+	// the bucket holds at most a minute of retries
+	now = now.Add(10 * time.Minute)
+	for i := 0; i < 3; i++ {
+		if !b.allow(3) {
+			t.Fatalf("retry %d was refused after refilling for 10 minutes", i)
+		}
+	}
+	if b.allow(3) {
+		t.Errorf("4th retry was allowed after refilling for 10 minutes")
+	}
+	if !b.allow(0) {
+		t.Errorf("retry was refused without a budget")
+	}
+}
+
+// TestRetryBudgetFailsFast checks that once the retry budget is used up, uploads which the server keeps answering with
+// 4.08 Request Entity Incomplete fail with a 503 rather than being sent again, however many IncompleteUploadRetries
+// they have left
+func TestRetryBudgetFailsFast(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		block, err := r.Options.GetUint32(message.Block1)
+		if err != nil {
+			w.SetResponse(codes.BadRequest, message.TextPlain, nil)
+			return
+		}
+		_, num, _, _ := blockwise.DecodeBlockOption(block)
+		if num == 0 {
+			mu.Lock()
+			attempts++
+			mu.Unlock()
+		}
+		if num == 2 {
+			w.SetResponse(codes.RequestEntityIncomplete, message.TextPlain, nil)
+			return
+		}
+		ack := make([]byte, 4)
+		n, _ := message.EncodeUint32(ack, block)
+		w.SetResponse(codes.Continue, message.TextPlain, nil, message.Option{ID: message.Block1, Value: ack[:n]})
+	}), dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+	cp := Params()
+	cp.IncompleteUploadRetries = 5
+	cp.RetryBudgetPerMinute = 2
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	t.Cleanup(func() {
+		cp := Params()
+		cp.IncompleteUploadRetries = defaultConnectionParams.IncompleteUploadRetries
+		cp.RetryBudgetPerMinute = 0
+		SetParams(cp)
+	})
+
+	reqBody := `{"body":"` + strings.Repeat("x", 5000) + `"}`
+	before := CurrentStats()
+	for i, wantAttempts := range []int{3, 4} {
+		res := SendRequest("PUT", hsURL+"/_matrix/client/r0/rooms/!a:localhost/send/m.room.message/"+strconv.Itoa(i), "secret", reqBody)
+		if res == nil || res.Code != 503 || !strings.Contains(res.Body, `"retry_budget_per_minute":2`) {
+			t.Errorf("request %d: got %+v want a 503 as the retry budget is exhausted", i, res)
+		}
+		mu.Lock()
+		if attempts != wantAttempts {
+			t.Errorf("request %d: server got %d attempts in total want %d", i, attempts, wantAttempts)
+		}
+		mu.Unlock()
+	}
+	after := CurrentStats()
+	if got := after.Retries - before.Retries; got != 2 {
+		t.Errorf("Retries: got %d want 2", got)
+	}
+	if got := after.RetriesRefused - before.RetriesRefused; got != 2 {
+		t.Errorf("RetriesRefused: got %d want 2", got)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/sirupsen/logrus"
+)
+
+// roundTripLimit cancels its context when a request makes more than max round trips, or when its block-wise transfer
+// stalls if watchStall has been called. The library does every block of a block-wise transfer within a single Do, so
+// round trips are counted by the roundTripCounter of the connection.
+type roundTripLimit struct {
+	max        int64
+	ctx        context.Context
+	cancel     context.CancelFunc
+	roundTrips int64 // accessed atomically
+
+	stallTimeout time.Duration
+	abortOnStall bool
+	stallMu      sync.Mutex
+	stallTimer   *time.Timer // started by the first block, nil until then
+	blocks       int64       // guarded by stallMu
+	stalled      int32       // accessed atomically
+
+	transfer *transferProgress // nil if progress is not reported
+	// set when CancelAll cancels the request, accessed atomically
+	cancelledAll int32
+}
+
+// newRoundTripLimit makes a limit of max round trips. 0 means there is no limit.
+func newRoundTripLimit(max int64) *roundTripLimit {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &roundTripLimit{
+		max:    max,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// newRequestLimit returns the limit of a request with the current params
+func newRequestLimit(cp *ConnectionParams) *roundTripLimit {
+	l := newRoundTripLimit(int64(cp.MaxBlockwiseRoundTrips))
+	l.watchStall(time.Duration(cp.BlockwiseStallTimeoutSecs)*time.Second, cp.BlockwiseStallPolicy != BlockwiseStallWait)
+	trackInFlight(l)
+	return l
+}
+
+// track counts round trips made on conn against the limit, until the returned function is called
+func (l *roundTripLimit) track(conn *client.ClientConn) func() {
+	counter, ok := conn.Context().Value(ctxValRoundTripCounter).(*roundTripCounter)
+	if !ok {
+		return func() {}
+	}
+	counter.mu.Lock()
+	counter.limits[l] = true
+	counter.mu.Unlock()
+	return func() {
+		counter.mu.Lock()
+		delete(counter.limits, l)
+		counter.mu.Unlock()
+	}
+}
+
+// exceeded returns true if the request was cancelled for making too many round trips
+func (l *roundTripLimit) exceeded() bool {
+	return l.max > 0 && atomic.LoadInt64(&l.roundTrips) > l.max
+}
+
+// count is called every time a message is received for the request, and cancels the request if it has exceeded
+// its limit. The response which completes a transfer is indistinguishable from one which needs another round trip,
+// so the request is cancelled on the round trip after the limit.
+func (l *roundTripLimit) count() {
+	if atomic.AddInt64(&l.roundTrips, 1) > l.max && l.max > 0 {
+		l.cancel()
+	}
+}
+
+// watchStall makes the transfer stall once it has received a block and then nothing for timeout. A stalled transfer
+// is cancelled if abort is set, else it is only logged and counted. Must be called before the request is sent.
+func (l *roundTripLimit) watchStall(timeout time.Duration, abort bool) {
+	l.stallTimeout = timeout
+	l.abortOnStall = abort
+}
+
+// progress is called every time a message is received which may be for the request. block is true if it definitely
+// is, and is big enough to be a block of a block-wise transfer rather than e.g an empty ACK of a request which the
+// homeserver is still working on, which starts the stall timer.
+func (l *roundTripLimit) progress(block bool) {
+	if l.stallTimeout <= 0 {
+		return
+	}
+	l.stallMu.Lock()
+	defer l.stallMu.Unlock()
+	if block {
+		l.blocks++
+	}
+	switch {
+	case l.stallTimer != nil:
+		l.stallTimer.Reset(l.stallTimeout)
+	case l.blocks > 0:
+		l.stallTimer = time.AfterFunc(l.stallTimeout, l.stall)
+	}
+}
+
+func (l *roundTripLimit) stall() {
+	l.stallMu.Lock()
+	blocks := l.blocks
+	l.stallMu.Unlock()
+	if !atomic.CompareAndSwapInt32(&l.stalled, 0, 1) {
+		return
+	}
+	recordBlockwiseStall()
+	if l.abortOnStall {
+		logrus.Warnf("Block-wise transfer stalled after %d blocks, aborting it", blocks)
+		l.cancel()
+	} else {
+		logrus.Warnf("Block-wise transfer stalled after %d blocks, still waiting for it", blocks)
+	}
+}
+
+// stalledBlocks returns the number of blocks received if the request was cancelled because its transfer stalled,
+// or -1 if it was not
+func (l *roundTripLimit) stalledBlocks() int64 {
+	if !l.abortOnStall || atomic.LoadInt32(&l.stalled) == 0 {
+		return -1
+	}
+	l.stallMu.Lock()
+	defer l.stallMu.Unlock()
+	return l.blocks
+}
+
+// stopWatching stops the stall timer once the request has finished
+func (l *roundTripLimit) stopWatching() {
+	l.stallMu.Lock()
+	defer l.stallMu.Unlock()
+	if l.stallTimer != nil {
+		l.stallTimer.Stop()
+	}
+}
+
+// roundTripCounter counts the messages received on a connection against the roundTripLimit of the request in
+// flight on it. It sees the socket below DTLS, so cannot tell which request a message is for: messages received
+// while more than one request is in flight are not counted, as they would abort long-polling requests like /sync
+// which receive nothing until they complete. The limit is a safety net for transfers which would take minutes,
+// so it may allow more round trips when requests overlap, rather than abort requests which are just waiting.
+type roundTripCounter struct {
+	mu     sync.Mutex
+	limits map[*roundTripLimit]bool
+}
+
+// minBlockDatagramSize is the size of the smallest datagram which is a block of a block-wise transfer. Empty CoAP
+// messages, e.g ACKs of requests the homeserver is still working on and keep-alive pongs, are at most 61 bytes with
+// any DTLS cipher suite, and blocks of 32 bytes or more are always bigger.
+const minBlockDatagramSize = 64
+
+func newRoundTripCounter() *roundTripCounter {
+	return &roundTripCounter{
+		limits: make(map[*roundTripLimit]bool),
+	}
+}
+
+// received is called for every datagram of application data read from the socket, with its size. Every request in
+// flight is treated as making progress, so overlapping requests are never mistaken for stalled transfers.
+func (c *roundTripCounter) received(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for l := range c.limits {
+		if len(c.limits) == 1 {
+			l.count()
+			l.transfer.received(size >= minBlockDatagramSize)
+		}
+		l.progress(len(c.limits) == 1 && size >= minBlockDatagramSize)
+	}
+}
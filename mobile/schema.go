@@ -0,0 +1,200 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// schema is the shape of a JSON value: its type and, for objects, the fields it must and may have. Fields which are
+// not listed are allowed, so newer homeservers adding fields do not fail validation.
+type schema struct {
+	// object, array, string, number or boolean, or empty for any type
+	kind     string
+	required map[string]*schema
+	optional map[string]*schema
+	// the schema of every item of an array, or of every field of an object keyed by IDs e.g rooms by room ID
+	values *schema
+}
+
+var (
+	stringSchema  = &schema{kind: "string"}
+	numberSchema  = &schema{kind: "number"}
+	booleanSchema = &schema{kind: "boolean"}
+	objectSchema  = &schema{kind: "object"}
+	// e.g the timeline of a room, or to-device messages
+	eventsSchema = &schema{kind: "object", optional: map[string]*schema{
+		"events": {kind: "array", values: objectSchema},
+	}}
+)
+
+// responseSchemas are the schemas of successful responses to key endpoints, checked when
+// ConnectionParams.SchemaValidation is set. Paths are matched like RequireTokenPaths, but including the API version.
+var responseSchemas = []struct {
+	path   []string
+	schema *schema
+}{
+	{
+		path: []string{"_matrix", "client", "versions"},
+		schema: &schema{kind: "object", required: map[string]*schema{
+			"versions": {kind: "array", values: stringSchema},
+		}, optional: map[string]*schema{
+			"unstable_features": {kind: "object", values: booleanSchema},
+		}},
+	},
+	{
+		path: []string{"_matrix", "client", "{version}", "account", "whoami"},
+		schema: &schema{kind: "object", required: map[string]*schema{
+			"user_id": stringSchema,
+		}},
+	},
+	{
+		path: []string{"_matrix", "client", "{version}", "sync"},
+		schema: &schema{kind: "object", required: map[string]*schema{
+			"next_batch": stringSchema,
+		}, optional: map[string]*schema{
+			"rooms": {kind: "object", optional: map[string]*schema{
+				"join": {kind: "object", values: &schema{kind: "object", optional: map[string]*schema{
+					"timeline":     eventsSchema,
+					"state":        eventsSchema,
+					"ephemeral":    eventsSchema,
+					"account_data": eventsSchema,
+				}}},
+				"invite": {kind: "object", values: objectSchema},
+				"leave":  {kind: "object", values: objectSchema},
+			}},
+			"presence":     eventsSchema,
+			"account_data": eventsSchema,
+			"to_device":    eventsSchema,
+			"device_lists": {kind: "object", optional: map[string]*schema{
+				"changed": {kind: "array", values: stringSchema},
+				"left":    {kind: "array", values: stringSchema},
+			}},
+			"device_one_time_keys_count": {kind: "object", values: numberSchema},
+		}},
+	},
+}
+
+// responseSchema returns the schema of successful responses to the path, or nil if there is none
+func responseSchema(path string) *schema {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for _, s := range responseSchemas {
+		if matchPathSegments(s.path, segments) {
+			return s.schema
+		}
+	}
+	return nil
+}
+
+// validateResponse returns an error if the JSON body of a successful response to the path does not conform to its
+// schema. Bodies of paths without a schema are not checked.
+func validateResponse(path string, body []byte) error {
+	s := responseSchema(path)
+	if s == nil {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("response is not JSON: %w", err)
+	}
+	return s.validate(v, "")
+}
+
+// validate returns an error naming the first field of v which does not conform to the schema. at is the location of
+// v in the response, e.g rooms.join, which is empty for the whole response.
+func (s *schema) validate(v interface{}, at string) error {
+	var ok bool
+	switch s.kind {
+	case "":
+		return nil
+	case "object":
+		_, ok = v.(map[string]interface{})
+	case "array":
+		_, ok = v.([]interface{})
+	case "string":
+		_, ok = v.(string)
+	case "number":
+		_, ok = v.(float64)
+	case "boolean":
+		_, ok = v.(bool)
+	}
+	if !ok {
+		if at == "" {
+			return fmt.Errorf("response is %s, want %s", jsonKind(v), s.kind)
+		}
+		return fmt.Errorf("%s is %s, want %s", at, jsonKind(v), s.kind)
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for field, fs := range s.required {
+			fv, ok := v[field]
+			if !ok {
+				return fmt.Errorf("%s is missing", fieldPath(at, field))
+			}
+			if err := fs.validate(fv, fieldPath(at, field)); err != nil {
+				return err
+			}
+		}
+		for field, fs := range s.optional {
+			if fv, ok := v[field]; ok {
+				if err := fs.validate(fv, fieldPath(at, field)); err != nil {
+					return err
+				}
+			}
+		}
+		if s.values != nil {
+			for field, fv := range v {
+				if err := s.values.validate(fv, fieldPath(at, field)); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if s.values != nil {
+			for i, item := range v {
+				if err := s.values.validate(item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func fieldPath(at, field string) string {
+	if at == "" {
+		return field
+	}
+	return at + "." + field
+}
+
+// jsonKind returns the schema kind of a decoded JSON value
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/lb"
+)
+
+func TestValidateResponse(t *testing.T) {
+	testCases := []struct {
+		path    string
+		body    string
+		wantErr string
+	}{
+		{path: "/_matrix/client/versions", body: `{"versions":["r0.6.1"],"unstable_features":{"m.lazy_load_members":true}}`},
+		{path: "/_matrix/client/versions", body: `{"versions":"r0.6.1"}`, wantErr: "versions is string, want array"},
+		{path: "/_matrix/client/versions", body: `{"unstable_features":{}}`, wantErr: "versions is missing"},
+		{path: "/_matrix/client/versions", body: `[]`, wantErr: "response is array, want object"},
+		{path: "/_matrix/client/r0/account/whoami", body: `{"user_id":"@alice:localhost","device_id":"ABC"}`},
+		{path: "/_matrix/client/v3/sync", body: `{"next_batch":"s1","rooms":{"join":{"!a:b":{"timeline":{"events":[{}]}}}}}`},
+		{path: "/_matrix/client/v3/sync", body: `{"next_batch":1}`, wantErr: "next_batch is number, want string"},
+		{
+			path:    "/_matrix/client/r0/sync",
+			body:    `{"next_batch":"s1","rooms":{"join":{"!a:b":{"timeline":{"events":[{},"$ev"]}}}}}`,
+			wantErr: "rooms.join.!a:b.timeline.events[1] is string, want object",
+		},
+		{path: "/_matrix/client/r0/sync", body: `{"next_batch":"s1","device_lists":{"changed":[null]}}`, wantErr: "device_lists.changed[0] is null, want string"},
+		// no schema
+		{path: "/_matrix/client/r0/joined_rooms", body: `"nope"`},
+	}
+	for _, tc := range testCases {
+		err := validateResponse(tc.path, []byte(tc.body))
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s %s: got error %s", tc.path, tc.body, err)
+			}
+		} else if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("%s %s: got error %v want %s", tc.path, tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+// TestSchemaValidationCorruptCBOR checks a CBOR response which decodes to the wrong shape is caught
+func TestSchemaValidationCorruptCBOR(t *testing.T) {
+	codec := lb.NewCBORCodecV1(false)
+	body, err := codec.JSONToCBOR(strings.NewReader(`{"versions":["r0.6.1"]}`))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	// replace the text string "r0.6.1" with the unsigned integer 42, which still decodes but as the wrong type
+	corrupt := bytes.Replace(body, append([]byte{0x66}, "r0.6.1"...), []byte{0x18, 42}, 1)
+	if bytes.Equal(corrupt, body) {
+		t.Fatalf("%x does not have the version as a text string", body)
+	}
+	var mu sync.Mutex
+	var resBody []byte
+	hsURL := newCBORTestServer(t, "127.0.0.1:0", lb.NewCoAPHTTP(lb.NewCoAPPathV1()), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/cbor")
+		w.WriteHeader(200)
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write(resBody)
+	}))
+
+	testCases := []struct {
+		name           string
+		body           []byte
+		validation     bool
+		reject         bool
+		wantResponse   bool
+		wantViolations int64
+	}{
+		{name: "valid", body: body, validation: true, reject: true, wantResponse: true},
+		{name: "disabled", body: corrupt, wantResponse: true},
+		{name: "pass through", body: corrupt, validation: true, wantResponse: true, wantViolations: 1},
+		{name: "reject", body: corrupt, validation: true, reject: true, wantViolations: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cp := Params()
+			cp.SchemaValidation = tc.validation
+			cp.SchemaValidationReject = tc.reject
+			if err := SetParams(cp); err != nil {
+				t.Fatalf("SetParams: %s", err)
+			}
+			mu.Lock()
+			resBody = tc.body
+			mu.Unlock()
+			before := CurrentStats()
+			res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", "")
+			if (res != nil) != tc.wantResponse {
+				t.Fatalf("got response %+v want a response: %v", res, tc.wantResponse)
+			}
+			if res != nil && res.Code != 200 {
+				t.Errorf("got HTTP %d", res.Code)
+			}
+			if got := CurrentStats().SchemaViolations - before.SchemaViolations; got != tc.wantViolations {
+				t.Errorf("got %d SchemaViolations want %d", got, tc.wantViolations)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	piondtls "github.com/pion/dtls/v2"
+)
+
+// dtlsSessionMaxAge is how long a session is kept for. RFC 5246 Appendix F.1.4 suggests servers forget sessions
+// within a day, so older ones would only cost a failed resumption.
+const dtlsSessionMaxAge = 24 * time.Hour
+
+// dtlsSessionStore is the DTLS sessions of the hosts connected to, so new connections can resume them with an
+// abbreviated handshake. Sessions are keyed by the remote address and server name of the connection, as pion/dtls
+// looks them up. If the server has forgotten a session, the handshake falls back to a full one, which replaces it.
+type dtlsSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*dtlsSession
+	now      func() time.Time
+}
+
+type dtlsSession struct {
+	ID      []byte    `json:"id"`
+	Secret  []byte    `json:"secret"`
+	Created time.Time `json:"created"`
+}
+
+// exportedSessions is the data of ExportSession
+type exportedSessions struct {
+	Version  int                     `json:"version"`
+	Sessions map[string]*dtlsSession `json:"sessions"`
+}
+
+func newDTLSSessionStore() *dtlsSessionStore {
+	return &dtlsSessionStore{
+		sessions: make(map[string]*dtlsSession),
+		now:      time.Now,
+	}
+}
+
+var dtlsSessions = newDTLSSessionStore()
+
+// Set implements piondtls.SessionStore
+func (s *dtlsSessionStore) Set(key []byte, session piondtls.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[string(key)] = &dtlsSession{ID: session.ID, Secret: session.Secret, Created: s.now()}
+	return nil
+}
+
+// Get implements piondtls.SessionStore, returning an empty session if there is none for the key
+func (s *dtlsSessionStore) Get(key []byte) (piondtls.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[string(key)]
+	if !ok {
+		return piondtls.Session{}, nil
+	}
+	if age := s.now().Sub(session.Created); age < 0 || age >= dtlsSessionMaxAge {
+		delete(s.sessions, string(key))
+		return piondtls.Session{}, nil
+	}
+	return piondtls.Session{ID: session.ID, Secret: session.Secret}, nil
+}
+
+// Del implements piondtls.SessionStore. When the server does not resume a session, pion/dtls deletes it by its
+// session ID rather than its key, so sessions with that ID are deleted too.
+func (s *dtlsSessionStore) Del(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, string(key))
+	for k, session := range s.sessions {
+		if bytes.Equal(session.ID, key) {
+			delete(s.sessions, k)
+		}
+	}
+	return nil
+}
+
+// sessionID returns the ID of the session which a connection to addr would resume, or nil if there is none
+func (s *dtlsSessionStore) sessionID(addr net.Addr, serverName string) []byte {
+	// pion/dtls does not send IP addresses as the server name
+	if net.ParseIP(serverName) != nil {
+		serverName = ""
+	}
+	session, _ := s.Get([]byte(addr.String() + "_" + serverName))
+	return session.ID
+}
+
+// ExportSession returns the DTLS sessions of the connections made so far, which ImportSession restores, e.g after the
+// app restarts, so the first connection to each host resumes its session with an abbreviated handshake rather than a
+// full one. The data includes the sessions' master secrets, which decrypt their traffic, so store it as securely as
+// the access token. Returns an empty string if there are no sessions.
+func ExportSession() string {
+	dtlsSessions.mu.Lock()
+	defer dtlsSessions.mu.Unlock()
+	exported := exportedSessions{
+		Version:  1,
+		Sessions: make(map[string]*dtlsSession),
+	}
+	for key, session := range dtlsSessions.sessions {
+		if dtlsSessions.now().Sub(session.Created) < dtlsSessionMaxAge {
+			exported.Sessions[key] = session
+		}
+	}
+	if len(exported.Sessions) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(exported)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// ImportSession restores the DTLS sessions returned by ExportSession, replacing any sessions made since the app
+// started, so call it before connecting. Sessions which have expired are dropped. A session which the server has
+// forgotten is not an error: the next connection does a full handshake instead, and ExportSession returns the new
+// session. Returns an error if the data is not from ExportSession, in which case no sessions are changed.
+func ImportSession(data string) error {
+	var imported exportedSessions
+	if err := json.Unmarshal([]byte(data), &imported); err != nil {
+		return fmt.Errorf("ImportSession: invalid data: %w", err)
+	}
+	if imported.Version != 1 {
+		return fmt.Errorf("ImportSession: unsupported version %d", imported.Version)
+	}
+	sessions := make(map[string]*dtlsSession)
+	now := dtlsSessions.now()
+	for key, session := range imported.Sessions {
+		if session == nil || len(session.ID) == 0 || len(session.Secret) == 0 {
+			return fmt.Errorf("ImportSession: session for %s is missing its ID or secret", key)
+		}
+		if age := now.Sub(session.Created); age < 0 || age >= dtlsSessionMaxAge {
+			continue
+		}
+		sessions[key] = session
+	}
+	dtlsSessions.mu.Lock()
+	dtlsSessions.sessions = sessions
+	dtlsSessions.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	piondtls "github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+)
+
+// closeConns closes every connection, as if the app had restarted
+func closeConns(t *testing.T) {
+	t.Helper()
+	if err := SetParams(Params()); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+}
+
+// TestExportImportSession checks that a session exported before the app restarts is resumed with an abbreviated
+// handshake once imported, and that a session which the server has forgotten falls back to a full handshake
+func TestExportImportSession(t *testing.T) {
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %s", err)
+	}
+	serverSessions := newDTLSSessionStore()
+	hsURL := newCoAPTestServerWithConfig(t, "127.0.0.1:0", &piondtls.Config{
+		Certificates: []tls.Certificate{cert},
+		SessionStore: serverSessions,
+	}, coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+		w.SetResponse(codes.Content, message.AppCBOR, nil)
+	}))
+	t.Cleanup(func() {
+		closeConns(t)
+		ImportSession(`{"version":1}`)
+	})
+	if err = ImportSession(`{"version":1}`); err != nil {
+		t.Fatalf("ImportSession: %s", err)
+	}
+	if data := ExportSession(); data != "" {
+		t.Fatalf("ExportSession without sessions: got %s want nothing", data)
+	}
+
+	// connect incrementing ResumedHandshakes by want
+	connect := func(name string, want int64) {
+		t.Helper()
+		before := CurrentStats().ResumedHandshakes
+		if err := Connect(hsURL); err != nil {
+			t.Fatalf("%s: Connect: %s", name, err)
+		}
+		if got := CurrentStats().ResumedHandshakes - before; got != want {
+			t.Errorf("%s: got %d resumed handshakes want %d", name, got, want)
+		}
+	}
+	sessionIDs := func(data string) []string {
+		t.Helper()
+		var exported exportedSessions
+		if err := json.Unmarshal([]byte(data), &exported); err != nil {
+			t.Fatalf("failed to unmarshal ExportSession %q: %s", data, err)
+		}
+		var ids []string
+		for _, s := range exported.Sessions {
+			ids = append(ids, string(s.ID))
+		}
+		return ids
+	}
+
+	connect("first connection", 0)
+	data := ExportSession()
+	if ids := sessionIDs(data); len(ids) != 1 {
+		t.Fatalf("ExportSession: got %d sessions want 1", len(ids))
+	}
+
+	// the app restarts, forgetting the session until it is imported
+	closeConns(t)
+	dtlsSessions.mu.Lock()
+	dtlsSessions.sessions = make(map[string]*dtlsSession)
+	dtlsSessions.mu.Unlock()
+	if err = ImportSession(data); err != nil {
+		t.Fatalf("ImportSession: %s", err)
+	}
+	connect("imported session", 1)
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+		t.Errorf("SendRequest on resumed session: got %+v want a 200", res)
+	}
+
+	// the server forgets the session, so the next connection does a full handshake and gets a new session
+	serverSessions.mu.Lock()
+	serverSessions.sessions = make(map[string]*dtlsSession)
+	serverSessions.mu.Unlock()
+	closeConns(t)
+	connect("forgotten session", 0)
+	newData := ExportSession()
+	if ids, oldIDs := sessionIDs(newData), sessionIDs(data); len(ids) != 1 || ids[0] == oldIDs[0] {
+		t.Errorf("ExportSession after a full handshake: got sessions %x want a new session, was %x", ids, oldIDs)
+	}
+	closeConns(t)
+	connect("new session", 1)
+
+	// sessions which are too old are not imported
+	old := dtlsSessions.now
+	dtlsSessions.now = func() time.Time { return old().Add(dtlsSessionMaxAge) }
+	err = ImportSession(newData)
+	dtlsSessions.now = old
+	if err != nil {
+		t.Fatalf("ImportSession of an expired session: %s", err)
+	}
+	if data := ExportSession(); data != "" {
+		t.Errorf("ExportSession after importing an expired session: got %s want nothing", data)
+	}
+
+	for _, data := range []string{"", "not json", `{"version":2,"sessions":{}}`, `{"version":1,"sessions":{"a":{"id":""}}}`} {
+		if err := ImportSession(data); err == nil {
+			t.Errorf("ImportSession(%q): got no error", data)
+		}
+	}
+}
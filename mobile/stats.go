@@ -0,0 +1,411 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Stats contains counters which are useful when tuning ConnectionParams. All counters are cumulative
+// since the process started, unless stated otherwise.
+type Stats struct {
+	// The number of requests which needed more than one round trip because the request or response body
+	// was larger than the block size.
+	BlockwiseTransfers int64
+	// The total number of blocks sent and received in block-wise transfers.
+	BlockwiseBlocks int64
+	// The total number of round trips made in block-wise transfers.
+	BlockwiseRoundTrips int64
+	// The total number of bytes spent repeating the request headers and options on every round trip after
+	// the first. This is a lower bound, as it does not include the response headers.
+	BlockwiseWastedBytes int64
+	// The number of block-wise transfers which were aborted for needing more than MaxBlockwiseRoundTrips round
+	// trips, including request bodies which were rejected before being sent.
+	BlockwiseAborts int64
+	// The number of block-wise transfers which stalled for BlockwiseStallTimeoutSecs, whatever the
+	// BlockwiseStallPolicy did about it.
+	BlockwiseStalls int64
+	// The number of block-wise uploads sent again after the server responded 4.08 Request Entity Incomplete, and
+	// the number which were still incomplete after IncompleteUploadRetries.
+	IncompleteUploadRetries  int64
+	IncompleteUploadFailures int64
+	// The number of CoAP messages sent or received as a datagram larger than PathMTU, e.g because of a long access
+	// token, which the network may fragment or drop.
+	MTUExceeded int64
+	// The number of responses which could not be decoded as CBOR but were valid JSON, so were returned as-is.
+	// If this is non-zero, the server or a proxy in front of it is probably misconfigured.
+	CBORDecodeFallbacks int64
+	// The number of connections to servers which support none of the dictionaries this library knows, whose requests
+	// were sent without a dictionary because AllowUncompressedFallback is set.
+	UncompressedFallbacks int64
+	// The number of DTLS handshakes which did not complete within HandshakeTimeoutSecs. If this is high but
+	// requests on established connections are fast, connection setup is the problem rather than the server.
+	HandshakeTimeouts int64
+	// The number of DTLS handshakes currently in progress, which is not cumulative, and the number of connections which
+	// had to wait to start their handshake because MaxConcurrentHandshakes were in progress.
+	Handshakes     int64
+	HandshakeWaits int64
+	// The number of DTLS handshakes which resumed the session of an earlier connection, including one restored by
+	// ImportSession, rather than doing a full handshake.
+	ResumedHandshakes int64
+	// The number of requests currently in the outbox waiting to be sent. This is not cumulative.
+	OutboxDepth int64
+	// True if PauseSending has been called without ResumeSending, so only urgent requests in the outbox are being
+	// sent. This is not cumulative.
+	SendingPaused bool
+	// True if EnterLowPowerObserveMode has been called without ExitLowPowerObserveMode, so the callbacks of
+	// observations are deferred. This is not cumulative.
+	LowPowerObserveMode bool
+	// The number of stream notifications which arrived in low-power observe mode, and the number of those which
+	// were dropped because LowPowerMaxDeferredNotifications were already buffered.
+	DeferredNotifications        int64
+	DroppedDeferredNotifications int64
+	// The number of requests which were delayed by MaxBytesPerMinute.
+	ThrottledRequests int64
+	// The bytes of the MaxBytesPerMinute budget which can be used now. This is negative when responses have used
+	// more than the budget had left, and 0 when there is no limit. This is not cumulative.
+	BandwidthBudgetBytes int64
+	// The number of observations currently registered, which MaxObserves limits. This is not cumulative.
+	Observes int64
+	// The number of observations which were refused because MaxObserves were already registered.
+	RefusedObserves int64
+	// The number of notifications which were discarded for being duplicates of, or older than, one already
+	// delivered.
+	StaleNotifications int64
+	// The number of times an observed resource was fetched again because ObserveResyncGap notifications were lost, or
+	// ObserveSeqGapThreshold /sync notifications were skipped.
+	ObserveResyncs int64
+	// The number of notifications which arrived as a delta with ObserveCompressionDelta and were reassembled.
+	ObserveDeltas int64
+	// The number of times an observed resource was fetched again because a delta notification was from a
+	// notification the device did not have.
+	ObserveDeltaMisses int64
+	// The number of notifications which ObserveOrderingStrict held until the ones before them were delivered.
+	ReorderedNotifications int64
+	// The number of notifications which ObserveOrderingStrict held for ObserveReorderTimeoutMs, as the ones before
+	// them did not arrive, then delivered.
+	ReorderTimeouts int64
+	// The number of batches of stream notifications delivered, if ObserveBatchSize or ObserveBatchIntervalMs is set.
+	NotificationBatches int64
+	// The number of times a CoAP message was retransmitted after its ACK timeout.
+	Retransmissions int64
+	// The number of connections which were closed for using up MaxConnectionRetransmits.
+	RetransmitBudgetExhausted int64
+	// The number of failed requests which were sent again, and the number which were not because RetryBudgetPerMinute
+	// was exhausted.
+	Retries        int64
+	RetriesRefused int64
+	// The number of rooms which were left out of /sync notifications by ObserveChangedRoomsOnly, as they were unchanged.
+	ObserveUnchangedRooms int64
+	// The number of responses which were rejected by StrictContentFormat.
+	ContentFormatRejections int64
+	// The number of responses which failed SchemaValidation, whether or not they were rejected.
+	SchemaViolations int64
+	// The number of confirmable exchanges waiting for a response, and the number of requests which had to wait for
+	// one of them to finish because MaxConcurrentExchanges were outstanding.
+	OutstandingExchanges int64
+	ExchangeWindowWaits  int64
+	// The number of /sync observations which have ended, and the ObserveEnded reason the latest one ended
+	ObserveEnds          int64
+	LastObserveEndReason string
+	// The number of requests with transaction IDs which were not sent, as the same request had been sent within
+	// TxnCacheSecs
+	DeduplicatedRequests int64
+	// How many seconds the observation which has gone longest without a notification has gone without one, or since
+	// it was made if it has never had one. This is 0 if there are no observations, and is not cumulative. If it
+	// keeps growing while the device is online, the observation has probably stalled.
+	ObserveLastNotificationAgeSecs float64
+	// The number of times a /sync observation was re-registered because it went ObserveStallSecs without a
+	// notification
+	ObserveStallRefreshes int64
+	// The number of times /sync started again from an initial sync, because the since token was older than
+	// ObserveSinceMaxAgeSecs or the server rejected it
+	SyncResets int64
+}
+
+// A block-wise transfer which needs more round trips than this probably has a block size which is too small
+// for the network, or a response which is too large.
+const blockwiseRoundTripsWarnThreshold = 32
+
+var (
+	stats   Stats
+	statsMu sync.Mutex
+)
+
+// CurrentStats returns a snapshot of the current stats.
+func CurrentStats() *Stats {
+	// this takes the connection and stream locks, so must be done before taking statsMu
+	age := observeNotificationAge()
+	paused := isSendingPaused()
+	lowPowerOn := isLowPowerObserveMode()
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	s := stats
+	s.ObserveLastNotificationAgeSecs = age.Seconds()
+	s.SendingPaused = paused
+	s.LowPowerObserveMode = lowPowerOn
+	s.BandwidthBudgetBytes = bandwidth.remaining(params().MaxBytesPerMinute)
+	s.OutstandingExchanges = exchanges.count()
+	s.Handshakes = handshakes.count()
+	return &s
+}
+
+// blockwiseTransfer is the cost of sending a single request and receiving its response with block-wise transfers
+type blockwiseTransfer struct {
+	blocks      int64
+	roundTrips  int64
+	wastedBytes int64
+}
+
+func numBlocks(bodySize, blockSize int64) int64 {
+	if bodySize <= blockSize {
+		return 1
+	}
+	return (bodySize + blockSize - 1) / blockSize
+}
+
+// newBlockwiseTransfer calculates the cost of a transfer. Block1 request blocks are sent first, and the response
+// to the final request block carries the first Block2 response block, so they share a round trip. Every other
+// round trip repeats the request headers.
+func newBlockwiseTransfer(blockSize, reqHeaderSize, reqBodySize, resBodySize int64) blockwiseTransfer {
+	reqBlocks := numBlocks(reqBodySize, blockSize)
+	resBlocks := numBlocks(resBodySize, blockSize)
+	roundTrips := reqBlocks + resBlocks - 1
+	return blockwiseTransfer{
+		blocks:      reqBlocks + resBlocks,
+		roundTrips:  roundTrips,
+		wastedBytes: (roundTrips - 1) * reqHeaderSize,
+	}
+}
+
+// recordBlockwiseTransfer adds the transfer to the stats if it needed more than one round trip
+func recordBlockwiseTransfer(path string, t blockwiseTransfer) {
+	if t.roundTrips <= 1 {
+		return
+	}
+	logger := logrus.WithField("path", path).WithField("blocks", t.blocks).WithField("round_trips", t.roundTrips).WithField("wasted_bytes", t.wastedBytes)
+	if t.roundTrips > blockwiseRoundTripsWarnThreshold {
+		logger.Warn("Block-wise transfer used an unusually high number of round trips, is the block size too small?")
+	} else {
+		logger.Debug("Block-wise transfer")
+	}
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.BlockwiseTransfers++
+	stats.BlockwiseBlocks += t.blocks
+	stats.BlockwiseRoundTrips += t.roundTrips
+	stats.BlockwiseWastedBytes += t.wastedBytes
+}
+
+func recordBlockwiseAbort() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.BlockwiseAborts++
+}
+
+func recordBlockwiseStall() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.BlockwiseStalls++
+}
+
+func recordIncompleteUploadRetry() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.IncompleteUploadRetries++
+}
+
+func recordIncompleteUploadFailure() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.IncompleteUploadFailures++
+}
+
+func recordUncompressedFallback() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.UncompressedFallbacks++
+}
+
+func recordMTUExceeded() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.MTUExceeded++
+}
+
+func recordCBORDecodeFallback() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.CBORDecodeFallbacks++
+}
+
+func recordContentFormatRejection() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.ContentFormatRejections++
+}
+
+func recordSchemaViolation() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.SchemaViolations++
+}
+
+func recordObserveEnd(reason string) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.ObserveEnds++
+	stats.LastObserveEndReason = reason
+}
+
+func recordObserveStallRefresh() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.ObserveStallRefreshes++
+}
+
+func recordSyncReset() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.SyncResets++
+}
+
+func recordHandshakeWait() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.HandshakeWaits++
+}
+
+func recordExchangeWindowWait() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.ExchangeWindowWaits++
+}
+
+func recordResumedHandshake() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.ResumedHandshakes++
+}
+
+func recordHandshakeTimeout() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.HandshakeTimeouts++
+}
+
+func recordStaleNotification() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.StaleNotifications++
+}
+
+func recordObserveResync() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.ObserveResyncs++
+}
+
+func recordObserveDelta() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.ObserveDeltas++
+}
+
+func recordObserveDeltaMiss() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.ObserveDeltaMisses++
+}
+
+func recordReorderedNotification() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.ReorderedNotifications++
+}
+
+func recordReorderTimeout() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.ReorderTimeouts++
+}
+
+func recordNotificationBatch() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.NotificationBatches++
+}
+
+func recordRetransmission() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.Retransmissions++
+}
+
+func recordRetransmitBudgetExhausted() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.RetransmitBudgetExhausted++
+}
+
+func recordRetry() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.Retries++
+}
+
+func recordRetryRefused() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.RetriesRefused++
+}
+
+func recordObserveUnchangedRooms(n int) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.ObserveUnchangedRooms += int64(n)
+}
+
+func recordDeferredNotification() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.DeferredNotifications++
+}
+
+func recordDroppedDeferredNotification() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.DroppedDeferredNotifications++
+}
+
+func setOutboxDepth(depth int) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.OutboxDepth = int64(depth)
+}
+
+func recordThrottledRequest() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.ThrottledRequests++
+}
+
+func recordDeduplicatedRequest() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.DeduplicatedRequests++
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/lb"
+)
+
+func TestBlockwiseStats(t *testing.T) {
+	resBody := `{"data":"` + strings.Repeat("x", 4000) + `"}`
+	cborBody, err := lb.NewCBORCodecV1(false).JSONToCBOR(bytes.NewBufferString(resBody))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(resBody))
+	}))
+	// make the connection first so only the multi-block request is counted
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil {
+		t.Fatalf("SendRequest returned nil")
+	}
+
+	before := CurrentStats()
+	res := SendRequest("GET", hsURL+"/_matrix/client/r0/joined_rooms", "", "")
+	if res == nil {
+		t.Fatalf("SendRequest returned nil")
+	}
+	if res.Body != resBody {
+		t.Fatalf("wrong response body, got %d bytes want %d", len(res.Body), len(resBody))
+	}
+	after := CurrentStats()
+
+	// 1 request block plus 4 response blocks
+	wantResBlocks := int64((len(cborBody) + 1023) / 1024)
+	if wantResBlocks != 4 {
+		t.Fatalf("test response is %d bytes of CBOR, want 4 blocks", len(cborBody))
+	}
+	if got := after.BlockwiseTransfers - before.BlockwiseTransfers; got != 1 {
+		t.Errorf("BlockwiseTransfers: got %d want 1", got)
+	}
+	if got := after.BlockwiseBlocks - before.BlockwiseBlocks; got != 1+wantResBlocks {
+		t.Errorf("BlockwiseBlocks: got %d want %d", got, 1+wantResBlocks)
+	}
+	if got := after.BlockwiseRoundTrips - before.BlockwiseRoundTrips; got != wantResBlocks {
+		t.Errorf("BlockwiseRoundTrips: got %d want %d", got, wantResBlocks)
+	}
+	if got := after.BlockwiseWastedBytes - before.BlockwiseWastedBytes; got <= 0 || got%(wantResBlocks-1) != 0 {
+		t.Errorf("BlockwiseWastedBytes: got %d want a positive multiple of %d", got, wantResBlocks-1)
+	}
+}
+
+func TestNewBlockwiseTransfer(t *testing.T) {
+	testCases := []struct {
+		name                  string
+		reqBodySize           int64
+		resBodySize           int64
+		wantBlocks, wantTrips int64
+		wantWasted            int64
+	}{
+		{name: "single block", reqBodySize: 10, resBodySize: 1024, wantBlocks: 2, wantTrips: 1, wantWasted: 0},
+		{name: "multi-block response", reqBodySize: 0, resBodySize: 3000, wantBlocks: 4, wantTrips: 3, wantWasted: 40},
+		{name: "multi-block request", reqBodySize: 2049, resBodySize: 2, wantBlocks: 4, wantTrips: 3, wantWasted: 40},
+		{name: "both", reqBodySize: 2048, resBodySize: 2048, wantBlocks: 4, wantTrips: 3, wantWasted: 40},
+	}
+	for _, tc := range testCases {
+		got := newBlockwiseTransfer(1024, 20, tc.reqBodySize, tc.resBodySize)
+		if got.blocks != tc.wantBlocks || got.roundTrips != tc.wantTrips || got.wastedBytes != tc.wantWasted {
+			t.Errorf("%s: got %+v want blocks=%d round trips=%d wasted=%d", tc.name, got, tc.wantBlocks, tc.wantTrips, tc.wantWasted)
+		}
+	}
+}
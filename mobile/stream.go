@@ -0,0 +1,310 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+	"github.com/matrix-org/lb"
+	"github.com/sirupsen/logrus"
+)
+
+// StreamCallback is notified of changes to a resource observed with ObserveStream
+type StreamCallback interface {
+	// OnNotification is called with the HTTP status code and JSON body of each notification. A code which is not
+	// 2xx means the server has stopped the observation, so no more notifications will arrive and the stream should
+	// be cancelled.
+	OnNotification(code int, body string)
+	// OnClosed is called once when the stream ends, because it was cancelled or the connection was closed
+	OnClosed()
+}
+
+// Stream is a resource observed with ObserveStream
+type Stream struct {
+	cb   StreamCallback
+	reg  *observeRefresh
+	done chan struct{}
+	once sync.Once
+	// the notifications waiting to be delivered together, if ObserveBatchSize or ObserveBatchIntervalMs is set
+	batch notificationBatcher
+
+	// guards the observation and its connection, which change when the stream is moved by MigrateTo
+	mu   sync.Mutex
+	obs  *client.Observation
+	conn *client.ClientConn
+}
+
+// presencePathRegexp matches the presence status of a user, which changes often and is superseded by the next change,
+// so losing the occasional notification does not matter
+var presencePathRegexp = regexp.MustCompile(`^/_matrix/client/[^/]+/presence/[^/]+/status$`)
+
+// liveStreams are the streams which have not been closed, so MigrateTo can move them to new connections
+var (
+	liveStreamsMu sync.Mutex
+	liveStreams   = make(map[*Stream]bool)
+)
+
+// streamsOn returns the live streams observing over conn
+func streamsOn(conn *client.ClientConn) []*Stream {
+	liveStreamsMu.Lock()
+	defer liveStreamsMu.Unlock()
+	var streams []*Stream
+	for s := range liveStreams {
+		if s.currentConn() == conn {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
+// Observe priorities, from lowest to highest. They only matter when the server's window of notifications to this
+// device is full: the server then sends waiting notifications highest priority first, e.g the room the user is
+// looking at before presence.
+const (
+	ObservePriorityLow    = lb.ObservePriorityLow
+	ObservePriorityNormal = lb.ObservePriorityNormal
+	ObservePriorityHigh   = lb.ObservePriorityHigh
+)
+
+// ObserveStream observes any resource on the homeserver and calls cb with each new version of it, for endpoints
+// which stream responses rather than needing to be polled. The server long-polls the resource on the client's
+// behalf. Unlike /sync observations, which are shared with SendRequest, every call makes a new observation which
+// must be ended with Cancel. Returns nil if the observation could not be made, or if MaxObserves observations are
+// already registered.
+func ObserveStream(hsURL, token string, cb StreamCallback) *Stream {
+	return Observe(hsURL, token, ObservePriorityNormal, cb)
+}
+
+// Observe is ObserveStream with the priority of the stream's notifications, from ObservePriorityLow to
+// ObservePriorityHigh. Servers which do not support priorities ignore it.
+func Observe(hsURL, token string, priority int, cb StreamCallback) *Stream {
+	return ObserveOrdered(hsURL, token, priority, ObserveOrderingArrival, cb)
+}
+
+// ObserveOrdered is Observe with the ObserveOrdering of the stream's notifications, e.g ObserveOrderingStrict for
+// resources where each version builds on the last.
+func ObserveOrdered(hsURL, token string, priority int, ordering string, cb StreamCallback) *Stream {
+	if priority < ObservePriorityLow || priority > ObservePriorityHigh {
+		logrus.WithField("priority", priority).Error("Observe: unknown priority, using normal priority")
+		priority = ObservePriorityNormal
+	}
+	if ordering != ObserveOrderingStrict && ordering != ObserveOrderingArrival {
+		logrus.WithField("ordering", ordering).Error("Observe: unknown ordering, using arrival ordering")
+		ordering = ObserveOrderingArrival
+	}
+	u, err := url.Parse(hsURL)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse HS URL")
+		return nil
+	}
+	if u.Host == "" {
+		logrus.WithField("url", hsURL).Error("HS URL missing host")
+		return nil
+	}
+	conn, err := dc.getClientForHost(u.Host)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get DTLS client for host %s", u.Host)
+		return nil
+	}
+	cp := params()
+	var hostOpts []message.Option
+	if cp.SendURIHost {
+		hostOpts, _ = lb.URIHostOptions(u)
+	}
+	// the options are the same as a /sync registration, without a since token
+	reg := &observeRefresh{
+		path:           coapHTTP.Paths.HTTPPathToCoapPath(u.Path),
+		token:          token,
+		hostOpts:       hostOpts,
+		queries:        u.Query(),
+		nonConfirmable: cp.PresenceNonConfirmable && presencePathRegexp.MatchString(u.Path),
+		priority:       priority,
+		ordering:       ordering,
+		lastNotifiedAt: time.Now(),
+	}
+	if err = reserveObserve(); err != nil {
+		logrus.WithError(err).Errorf("ObserveStream: refusing to observe path %s", u.Path)
+		return nil
+	}
+	s := &Stream{
+		cb:   cb,
+		reg:  reg,
+		done: make(chan struct{}),
+		conn: conn,
+	}
+	ctx, cancel := context.WithTimeout(conn.Context(), streamRequestTimeout(cp))
+	defer cancel()
+	s.obs, err = conn.Observe(ctx, reg.path, s.notifier(), reg.options()...)
+	if err != nil {
+		logrus.WithError(err).Errorf("ObserveStream: failed to observe path %s", u.Path)
+		releaseObserve()
+		return nil
+	}
+	logrus.Infof("ObserveStream: observing path %s", u.Path)
+	liveStreamsMu.Lock()
+	liveStreams[s] = true
+	liveStreamsMu.Unlock()
+	go s.watch(conn)
+	return s
+}
+
+// watch closes the stream when conn is closed, unless the stream has moved to another connection
+func (s *Stream) watch(conn *client.ClientConn) {
+	select {
+	case <-conn.Context().Done():
+		if s.currentConn() == conn {
+			s.close(false)
+		}
+	case <-s.done:
+	}
+}
+
+func (s *Stream) currentConn() *client.ClientConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// migrate registers the observation again on conn, then deregisters it from the old connection. The stream is
+// closed if the registration fails.
+func (s *Stream) migrate(conn *client.ClientConn) {
+	ctx, cancel := context.WithTimeout(conn.Context(), streamRequestTimeout(params()))
+	defer cancel()
+	obs, err := conn.Observe(ctx, s.reg.path, s.notifier(), s.reg.options()...)
+	if err != nil {
+		logrus.WithError(err).Errorf("ObserveStream: failed to move path %s to the new connection", s.reg.path)
+		s.close(true)
+		return
+	}
+	s.mu.Lock()
+	old := s.obs
+	select {
+	case <-s.done:
+		// cancelled while moving, so close deregisters the old observation and the new one is unused
+		old = obs
+	default:
+		s.obs, s.conn = obs, conn
+		go s.watch(conn)
+	}
+	s.mu.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), streamRequestTimeout(params()))
+	defer cancel()
+	if err := old.Cancel(ctx); err != nil {
+		logrus.WithError(err).Debug("ObserveStream: deregistration returned an error")
+	}
+}
+
+// Cancel ends the observation, telling the server to stop long-polling the resource. OnClosed is called before
+// Cancel returns, unless the stream has already been closed. Safe to call more than once.
+func (s *Stream) Cancel() {
+	s.close(true)
+}
+
+func (s *Stream) close(deregister bool) {
+	s.once.Do(func() {
+		close(s.done)
+		releaseObserve()
+		liveStreamsMu.Lock()
+		delete(liveStreams, s)
+		liveStreamsMu.Unlock()
+		if deregister {
+			s.mu.Lock()
+			obs := s.obs
+			s.mu.Unlock()
+			ctx, cancel := context.WithTimeout(context.Background(), streamRequestTimeout(params()))
+			defer cancel()
+			// the server ACKs deregistrations with 2.02 Deleted rather than the 2.05 Content go-coap wants, so an
+			// error here does not mean the server is still observing
+			if err := obs.Cancel(ctx); err != nil {
+				logrus.WithError(err).Debug("ObserveStream: deregistration returned an error")
+			}
+		}
+		deliverObserveCallback(false, func() {
+			// the notifications which arrived before the stream closed
+			s.batch.flush(nil, s.deliverBatch)
+			s.cb.OnClosed()
+		})
+	})
+}
+
+// notifier returns the function to handle the notifications of a new registration, which has its own sequence
+func (s *Stream) notifier() func(*pool.Message) {
+	seq := &observeSeq{}
+	return func(msg *pool.Message) {
+		s.notify(seq, msg)
+	}
+}
+
+// notify converts a notification to JSON and passes it to the callback
+func (s *Stream) notify(seq *observeSeq, notification *pool.Message) {
+	takeNotificationBytes(notification)
+	msg := s.reg.filterNotification(s.currentConn(), seq, notification)
+	if msg == nil {
+		return
+	}
+	defer seq.finish(notification)
+	if msg != notification {
+		defer pool.ReleaseMessage(msg)
+	}
+	httpRes := coapHTTP.CoAPToHTTPResponse(msg)
+	if httpRes == nil {
+		logrus.Warnf("ObserveStream: failed to convert CoAP to HTTP for message %+v", msg)
+		return
+	}
+	var body []byte
+	if httpRes.Body != nil {
+		var err error
+		body, err = responseCodec(httpRes.Header.Get("Content-Type")).CBORToJSON(httpRes.Body)
+		if err != nil {
+			logrus.WithError(err).Error("ObserveStream: failed to read notification body (CBOR->JSON)")
+			return
+		}
+		if body, err = seq.reassemble(msg, body); err != nil {
+			logrus.WithError(err).Error("ObserveStream: failed to reassemble notification")
+			return
+		}
+	}
+	// the registration is ACKed with an empty body, which is not a version of the resource
+	if len(body) == 0 && msg.Code() == codes.Content {
+		return
+	}
+	select {
+	case <-s.done:
+	default:
+		if batchingNotifications(params()) {
+			deliverObserveCallback(true, func() {
+				s.batch.add(httpRes.StatusCode, string(body), s.deliverBatch)
+			})
+			return
+		}
+		deliverObserveCallback(true, func() {
+			s.cb.OnNotification(httpRes.StatusCode, string(body))
+		})
+	}
+}
+
+// streamRequestTimeout is how long to wait for the response to a (de)registration, which is the time a confirmable
+// request can spend being retransmitted
+func streamRequestTimeout(cp *ConnectionParams) time.Duration {
+	return time.Duration(cp.TransmissionACKTimeoutSecs*(cp.TransmissionMaxRetransmits+1)) * time.Second
+}
@@ -0,0 +1,482 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/lb"
+)
+
+type streamFuncs struct {
+	notification func(code int, body string)
+	closed       func()
+}
+
+func (f *streamFuncs) OnNotification(code int, body string) { f.notification(code, body) }
+func (f *streamFuncs) OnClosed()                            { f.closed() }
+
+func TestObserveStream(t *testing.T) {
+	var polls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/_matrix/client/r0/account/whoami" || req.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(404)
+			return
+		}
+		n := atomic.AddInt32(&polls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(fmt.Sprintf(`{"user_id":"@alice:bar","n":%d}`, n)))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	handler := lb.CBORToJSONHandler(next, codec, nil)
+	observations := lb.NewSyncObservations(handler, coapHTTP.Paths, codec)
+	// notifications written block-wise are sent with message ID 0, so the client drops all but the first as
+	// duplicates. Disable block-wise on the server as the notifications are small.
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapHTTP.CoAPHTTPHandler(handler, observations),
+		dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+	notifications := make(chan string, 10)
+	closed := make(chan struct{}, 2)
+	s := ObserveStream(hsURL+"/_matrix/client/r0/account/whoami", "secret", &streamFuncs{
+		notification: func(code int, body string) {
+			notifications <- fmt.Sprintf("%d %s", code, body)
+		},
+		closed: func() {
+			closed <- struct{}{}
+		},
+	})
+	if s == nil {
+		t.Fatalf("ObserveStream returned nil")
+	}
+	for i := 1; i <= 2; i++ {
+		select {
+		case got := <-notifications:
+			if want := fmt.Sprintf(`200 {"n":%d,"user_id":"@alice:bar"}`, i); got != want {
+				t.Errorf("notification %d: got %s want %s", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for notification %d", i)
+		}
+	}
+
+	s.Cancel()
+	select {
+	case <-closed:
+	default:
+		t.Fatalf("OnClosed was not called by Cancel")
+	}
+	s.Cancel()
+	select {
+	case <-closed:
+		t.Errorf("OnClosed was called twice")
+	default:
+	}
+	// the server stops polling, apart from a poll which may be in flight
+	before := atomic.LoadInt32(&polls)
+	time.Sleep(2500 * time.Millisecond)
+	if after := atomic.LoadInt32(&polls); after > before+1 {
+		t.Errorf("server polled %d more times after Cancel", after-before)
+	}
+	select {
+	case got := <-notifications:
+		t.Errorf("notification after Cancel: %s", got)
+	default:
+	}
+}
+
+// TestObserveStreamNotificationAge checks the age of the last notification grows while there are none, and resets
+// when one arrives
+func TestObserveStreamNotificationAge(t *testing.T) {
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"user_id":"@alice:bar"}`))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	handler := lb.CBORToJSONHandler(next, codec, nil)
+	observations := lb.NewSyncObservations(handler, coapHTTP.Paths, codec)
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapHTTP.CoAPHTTPHandler(handler, observations),
+		dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+	notifications := make(chan struct{}, 10)
+	s := ObserveStream(hsURL+"/_matrix/client/r0/account/whoami", "secret", &streamFuncs{
+		notification: func(code int, body string) { notifications <- struct{}{} },
+		closed:       func() {},
+	})
+	if s == nil {
+		t.Fatalf("ObserveStream returned nil")
+	}
+	defer close(release)
+	defer s.Cancel()
+
+	time.Sleep(100 * time.Millisecond)
+	first := s.reg.notificationAge()
+	time.Sleep(100 * time.Millisecond)
+	second := s.reg.notificationAge()
+	if second <= first || second < 200*time.Millisecond {
+		t.Errorf("age did not increase without a notification: got %v then %v", first, second)
+	}
+	// the stats have the age of the stalest observation, which is at least this one
+	if got := CurrentStats().ObserveLastNotificationAgeSecs; got < second.Seconds() {
+		t.Errorf("got ObserveLastNotificationAgeSecs %v want at least %v", got, second.Seconds())
+	}
+
+	release <- struct{}{}
+	select {
+	case <-notifications:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a notification")
+	}
+	if got := s.reg.notificationAge(); got >= first {
+		t.Errorf("age did not reset after a notification: got %v want less than %v", got, first)
+	}
+}
+
+// TestObserveStreamMaxObserves checks that registrations past MaxObserves are refused until an observation ends
+func TestObserveStreamMaxObserves(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"user_id":"@alice:bar"}`))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	handler := lb.CBORToJSONHandler(next, codec, nil)
+	observations := lb.NewSyncObservations(handler, coapHTTP.Paths, codec)
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapHTTP.CoAPHTTPHandler(handler, observations),
+		dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+	cp := Params()
+	cp.MaxObserves = 1
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	cb := &streamFuncs{
+		notification: func(code int, body string) {},
+		closed:       func() {},
+	}
+	observe := func() *Stream {
+		return ObserveStream(hsURL+"/_matrix/client/r0/account/whoami", "secret", cb)
+	}
+
+	before := CurrentStats()
+	s := observe()
+	if s == nil {
+		t.Fatalf("first observation was refused, the limit is 1")
+	}
+	// refused before anything is sent
+	if s2 := observe(); s2 != nil {
+		s2.Cancel()
+		t.Fatalf("second observation was made, the limit is 1")
+	}
+	after := CurrentStats()
+	if got := after.Observes - before.Observes; got != 1 {
+		t.Errorf("Observes: got %d more want 1 more", got)
+	}
+	if got := after.RefusedObserves - before.RefusedObserves; got != 1 {
+		t.Errorf("RefusedObserves: got %d more want 1 more", got)
+	}
+
+	// cancelling the observation makes room for another
+	s.Cancel()
+	s.Cancel()
+	if got := CurrentStats().Observes; got != before.Observes {
+		t.Errorf("Observes after cancelling: got %d want %d", got, before.Observes)
+	}
+	if err := reserveObserve(); err != nil {
+		t.Fatalf("reserveObserve after cancelling: %s", err)
+	}
+	releaseObserve()
+}
+
+// trafficConn counts the packets and bytes sent and received on a connection
+type trafficConn struct {
+	net.Conn
+	sent, sentBytes, receivedBytes int64
+}
+
+func (c *trafficConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.receivedBytes, int64(n))
+	return n, err
+}
+
+func (c *trafficConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.sent, 1)
+	atomic.AddInt64(&c.sentBytes, int64(len(b)))
+	return c.Conn.Write(b)
+}
+
+// TestObserveStreamPresenceNonConfirmable checks that presence notifications are not ACKed when
+// PresenceNonConfirmable is set, and compares the traffic of a busy presence feed with confirmable notifications.
+func TestObserveStreamPresenceNonConfirmable(t *testing.T) {
+	const notifications = 3
+	type traffic struct {
+		packetsSent int64
+		bytes       int64
+	}
+	observePresence := func(nonConfirmable bool) traffic {
+		var polls int32
+		next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// a new presence every poll
+			n := atomic.AddInt32(&polls, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			w.Write([]byte(fmt.Sprintf(`{"presence":"online","last_active_ago":%d,"currently_active":true}`, n)))
+		})
+		codec := lb.NewCBORCodecV1(false)
+		coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+		handler := lb.CBORToJSONHandler(next, codec, nil)
+		observations := lb.NewSyncObservations(handler, coapHTTP.Paths, codec)
+		hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapHTTP.CoAPHTTPHandler(handler, observations),
+			dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+		cp := Params()
+		cp.PresenceNonConfirmable = nonConfirmable
+		if err := SetParams(cp); err != nil {
+			t.Fatalf("SetParams: %s", err)
+		}
+		conn := make(chan *trafficConn, 1)
+		SetTransportWrapper(func(c net.Conn) net.Conn {
+			tc := &trafficConn{Conn: c}
+			conn <- tc
+			return tc
+		})
+		defer SetTransportWrapper(nil)
+		if err := Connect(hsURL); err != nil {
+			t.Fatalf("Connect: %s", err)
+		}
+		tc := <-conn
+
+		// the counts when each notification arrives. ACKs are sent after the callback returns, so the ACK for a
+		// notification is only counted from the next one.
+		counts := make(chan traffic, notifications+5)
+		s := ObserveStream(hsURL+"/_matrix/client/r0/presence/@alice:bar/status", "secret", &streamFuncs{
+			notification: func(code int, body string) {
+				counts <- traffic{
+					packetsSent: atomic.LoadInt64(&tc.sent),
+					bytes:       atomic.LoadInt64(&tc.sentBytes) + atomic.LoadInt64(&tc.receivedBytes),
+				}
+			},
+			closed: func() {},
+		})
+		if s == nil {
+			t.Fatalf("ObserveStream returned nil")
+		}
+		defer s.Cancel()
+		var first, last traffic
+		for i := 0; i <= notifications; i++ {
+			select {
+			case last = <-counts:
+				if i == 0 {
+					first = last
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("nonConfirmable=%v: timed out waiting for notification %d", nonConfirmable, i+1)
+			}
+		}
+		return traffic{packetsSent: last.packetsSent - first.packetsSent, bytes: last.bytes - first.bytes}
+	}
+
+	nonConfirmable := observePresence(true)
+	if nonConfirmable.packetsSent != 0 {
+		t.Errorf("non-confirmable: client sent %d packets for %d notifications, want none", nonConfirmable.packetsSent, notifications)
+	}
+	confirmable := observePresence(false)
+	if confirmable.packetsSent != notifications {
+		t.Errorf("confirmable: client sent %d packets for %d notifications, want an ACK each", confirmable.packetsSent, notifications)
+	}
+	t.Logf("%d presence notifications: confirmable %d bytes, non-confirmable %d bytes (%.0f%% less)", notifications,
+		confirmable.bytes, nonConfirmable.bytes, 100*float64(confirmable.bytes-nonConfirmable.bytes)/float64(confirmable.bytes))
+}
+
+// chattyRoomSync is the nth /sync response of a busy room: every response has one new message, and the rest is the
+// same or nearly so
+func chattyRoomSync(n int) string {
+	return fmt.Sprintf(`{"next_batch":"s%d","rooms":{"join":{"!chatty:localhost":{"timeline":{"events":[{"type":"m.room.message",`+
+		`"sender":"@user%d:localhost","event_id":"$event%d","origin_server_ts":%d,"content":{"msgtype":"m.text","body":"message %d"},`+
+		`"unsigned":{"age":12}}],"limited":false,"prev_batch":"p%d"},"state":{"events":[]},"ephemeral":{"events":[{"type":"m.typing",`+
+		`"content":{"user_ids":["@bob:localhost"]}}]},"account_data":{"events":[]},"unread_notifications":{"highlight_count":0,`+
+		`"notification_count":%d},"summary":{"m.heroes":["@bob:localhost","@carol:localhost"],"m.joined_member_count":3,`+
+		`"m.invited_member_count":0}}}},"presence":{"events":[]},"account_data":{"events":[]},"to_device":{"events":[]},`+
+		`"device_lists":{"changed":[],"left":[]},"device_one_time_keys_count":{"signed_curve25519":50}}`,
+		n, n%3, n, 1600000000000+n, n, n, n)
+}
+
+// TestObserveStreamDeltaCompression checks that /sync notifications of a busy room are reassembled into the
+// responses the homeserver sent with ObserveCompressionDelta, and compares their traffic with full notifications.
+func TestObserveStreamDeltaCompression(t *testing.T) {
+	const notifications = 6
+	observeSync := func(compression string) int64 {
+		var polls int32
+		next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			n := atomic.AddInt32(&polls, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			w.Write([]byte(chattyRoomSync(int(n))))
+		})
+		codec := lb.NewCBORCodecV1(false)
+		coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+		handler := lb.CBORToJSONHandler(next, codec, nil)
+		observations := lb.NewSyncObservations(handler, coapHTTP.Paths, codec)
+		hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapHTTP.CoAPHTTPHandler(handler, observations),
+			dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+		cp := Params()
+		cp.ObserveCompression = compression
+		if err := SetParams(cp); err != nil {
+			t.Fatalf("SetParams: %s", err)
+		}
+		conn := make(chan *trafficConn, 1)
+		SetTransportWrapper(func(c net.Conn) net.Conn {
+			tc := &trafficConn{Conn: c}
+			conn <- tc
+			return tc
+		})
+		defer SetTransportWrapper(nil)
+		if err := Connect(hsURL); err != nil {
+			t.Fatalf("Connect: %s", err)
+		}
+		tc := <-conn
+
+		type notification struct {
+			body          string
+			receivedBytes int64
+		}
+		got := make(chan notification, notifications+5)
+		before := CurrentStats()
+		s := ObserveStream(hsURL+"/_matrix/client/r0/sync", "secret", &streamFuncs{
+			notification: func(code int, body string) {
+				got <- notification{body: body, receivedBytes: atomic.LoadInt64(&tc.receivedBytes)}
+			},
+			closed: func() {},
+		})
+		if s == nil {
+			t.Fatalf("ObserveStream returned nil")
+		}
+		defer s.Cancel()
+		var first, last int64
+		for i := 1; i <= notifications; i++ {
+			var n notification
+			select {
+			case n = <-got:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: timed out waiting for notification %d", compression, i)
+			}
+			var gotBody, wantBody interface{}
+			if err := json.Unmarshal([]byte(n.body), &gotBody); err != nil {
+				t.Fatalf("%s: notification %d is not JSON: %s", compression, i, err)
+			}
+			json.Unmarshal([]byte(chattyRoomSync(i)), &wantBody)
+			if !reflect.DeepEqual(gotBody, wantBody) {
+				t.Errorf("%s: notification %d: got %s want %s", compression, i, n.body, chattyRoomSync(i))
+			}
+			if i == 1 {
+				first = n.receivedBytes
+			}
+			last = n.receivedBytes
+		}
+		// the first notification is always in full
+		wantDeltas := int64(0)
+		if compression == ObserveCompressionDelta {
+			wantDeltas = notifications - 1
+		}
+		if deltas := CurrentStats().ObserveDeltas - before.ObserveDeltas; deltas != wantDeltas {
+			t.Errorf("%s: ObserveDeltas: got %d want %d", compression, deltas, wantDeltas)
+		}
+		return last - first
+	}
+
+	full := observeSync(ObserveCompressionNone)
+	delta := observeSync(ObserveCompressionDelta)
+	if delta >= full {
+		t.Errorf("deltas received %d bytes, full notifications %d", delta, full)
+	}
+	t.Logf("%d /sync notifications of a busy room: full %d bytes, deltas %d bytes (%.0f%% less)", notifications-1,
+		full, delta, 100*float64(full-delta)/float64(full))
+}
+
+// TestObservePriority checks the priority is sent with the registration, and normal priority is not sent at all
+func TestObservePriority(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"user_id":"@alice:bar"}`))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	handler := lb.CBORToJSONHandler(next, codec, nil)
+	observations := lb.NewSyncObservations(handler, coapHTTP.Paths, codec)
+	coapHandler := coapHTTP.CoAPHTTPHandler(handler, observations)
+
+	testCases := []struct {
+		priority int
+		want     int // -1 if the option is not sent
+	}{
+		{ObservePriorityHigh, ObservePriorityHigh},
+		{ObservePriorityLow, ObservePriorityLow},
+		{ObservePriorityNormal, -1},
+		{7, -1},
+	}
+	for _, tc := range testCases {
+		// a server each, as the notifications of a second observation on a connection would be dropped as
+		// duplicates, see TestObserveStream
+		priorities := make(chan int, 1)
+		hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
+			if obs, err := r.Options.Observe(); err == nil && obs == 0 {
+				got := -1
+				if p, err := r.Options.GetUint32(lb.OptionIDObservePriority); err == nil {
+					got = int(p)
+				}
+				select {
+				case priorities <- got:
+				default:
+				}
+			}
+			coapHandler.ServeCOAP(w, r)
+		}), dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+		s := Observe(hsURL+"/_matrix/client/r0/account/whoami", "secret", tc.priority, &streamFuncs{
+			notification: func(code int, body string) {},
+			closed:       func() {},
+		})
+		if s == nil {
+			t.Fatalf("priority %d: Observe returned nil", tc.priority)
+		}
+		select {
+		case got := <-priorities:
+			if got != tc.want {
+				t.Errorf("priority %d: server got priority option %d want %d", tc.priority, got, tc.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("priority %d: timed out waiting for the registration", tc.priority)
+		}
+		s.Cancel()
+	}
+}
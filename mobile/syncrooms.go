@@ -0,0 +1,98 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// roomVersions are the hashes of the rooms of a /sync response, keyed by membership and room ID, e.g "join !a:b"
+type roomVersions map[string][sha256.Size]byte
+
+// changedRooms remembers the version of each room delivered on a /sync observation, so ObserveChangedRoomsOnly can
+// leave out the rooms which a notification repeats unchanged. A room which moves to another membership, e.g from
+// invite to join, is a different room as far as this is concerned, so it is always delivered.
+type changedRooms struct {
+	mu        sync.Mutex
+	delivered roomVersions
+}
+
+// filter returns body without the rooms which are the same as when they were last delivered, along with the versions
+// of the rooms in body to pass to remember once it has been delivered. Everything outside rooms, including
+// next_batch, is returned as it is, as are the membership sections of rooms even if every room in them is left out.
+// Returns body unchanged if it is not a /sync response.
+func (c *changedRooms) filter(body []byte) ([]byte, roomVersions) {
+	var res map[string]json.RawMessage
+	if err := json.Unmarshal(body, &res); err != nil {
+		return body, nil
+	}
+	rawRooms, ok := res["rooms"]
+	if !ok {
+		return body, nil
+	}
+	var rooms map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(rawRooms, &rooms); err != nil {
+		return body, nil
+	}
+	versions := make(roomVersions)
+	unchanged := 0
+	c.mu.Lock()
+	for membership, section := range rooms {
+		for roomID, room := range section {
+			key := membership + " " + roomID
+			versions[key] = sha256.Sum256(room)
+			if prev, ok := c.delivered[key]; ok && prev == versions[key] {
+				delete(section, roomID)
+				unchanged++
+			}
+		}
+	}
+	c.mu.Unlock()
+	if unchanged == 0 {
+		return body, versions
+	}
+	var err error
+	if res["rooms"], err = json.Marshal(rooms); err != nil {
+		logrus.WithError(err).Error("Observe: failed to leave unchanged rooms out of notification")
+		return body, versions
+	}
+	filtered, err := json.Marshal(res)
+	if err != nil {
+		logrus.WithError(err).Error("Observe: failed to leave unchanged rooms out of notification")
+		return body, versions
+	}
+	recordObserveUnchangedRooms(unchanged)
+	return filtered, versions
+}
+
+// remember records the versions of the rooms which have been delivered. Rooms which were not in the notification
+// keep the version they were last delivered with.
+func (c *changedRooms) remember(versions roomVersions) {
+	if len(versions) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.delivered == nil {
+		c.delivered = make(roomVersions)
+	}
+	for key, version := range versions {
+		c.delivered[key] = version
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/lb"
+)
+
+// TestObserveChangedRoomsOnly checks that /sync notifications from a server which repeats unchanged rooms only have
+// the rooms which changed, and that the since token advances with each of them, even when no room changed
+func TestObserveChangedRoomsOnly(t *testing.T) {
+	roomA := `{"timeline":{"events":[{"type":"m.room.message","event_id":"$1","content":{"body":"hi"}}]}}`
+	responses := map[string]string{
+		"":   `{"next_batch":"s1","rooms":{"join":{"!a:localhost":` + roomA + `,"!b:localhost":{"timeline":{"events":[{"event_id":"$2"}]}}}}}`,
+		"s1": `{"next_batch":"s2","rooms":{"join":{"!a:localhost":` + roomA + `,"!b:localhost":{"timeline":{"events":[{"event_id":"$3"}]}}},"invite":{"!c:localhost":{}}}}`,
+		"s2": `{"next_batch":"s3","rooms":{"join":{"!a:localhost":` + roomA + `,"!b:localhost":{"timeline":{"events":[{"event_id":"$3"}]}}}},"account_data":{"events":[]}}`,
+	}
+	var mu sync.Mutex
+	var sinces []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		since := req.URL.Query().Get("since")
+		body, ok := responses[since]
+		if !ok {
+			// nothing new, which is not notified as next_batch is unchanged
+			time.Sleep(100 * time.Millisecond)
+			body = `{"next_batch":"` + since + `"}`
+		} else {
+			mu.Lock()
+			sinces = append(sinces, since)
+			mu.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(body))
+	})
+	codec := lb.NewCBORCodecV1(false)
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	handler := lb.CBORToJSONHandler(next, codec, nil)
+	// without block-wise transfers, so each notification has its own message ID
+	hsURL := newCoAPTestServer(t, "127.0.0.1:0", coapHTTP.CoAPHTTPHandler(handler, lb.NewSyncObservations(handler, coapHTTP.Paths, codec)),
+		dtls.WithBlockwise(false, blockwise.SZX1024, time.Minute))
+	cp := Params()
+	cp.ObserveEnabled = true
+	cp.ObserveChangedRoomsOnly = true
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	t.Cleanup(func() {
+		cp := Params()
+		cp.ObserveEnabled = false
+		cp.ObserveChangedRoomsOnly = false
+		SetParams(cp)
+	})
+	before := CurrentStats()
+
+	type syncResponse struct {
+		NextBatch   string                                `json:"next_batch"`
+		Rooms       map[string]map[string]json.RawMessage `json:"rooms"`
+		AccountData json.RawMessage                       `json:"account_data"`
+	}
+	testCases := []struct {
+		since     string
+		nextBatch string
+		rooms     map[string][]string
+	}{
+		{since: "", nextBatch: "s1", rooms: map[string][]string{"join": {"!a:localhost", "!b:localhost"}}},
+		{since: "s1", nextBatch: "s2", rooms: map[string][]string{"join": {"!b:localhost"}, "invite": {"!c:localhost"}}},
+		{since: "s2", nextBatch: "s3", rooms: map[string][]string{"join": nil}},
+	}
+	for _, tc := range testCases {
+		path := "/_matrix/client/r0/sync"
+		if tc.since != "" {
+			path += "?since=" + tc.since
+		}
+		res := SendRequest("GET", hsURL+path, "secret", "")
+		if res == nil || res.Code != 200 {
+			t.Fatalf("since %q: got %+v want a 200", tc.since, res)
+		}
+		var got syncResponse
+		if err := json.Unmarshal([]byte(res.Body), &got); err != nil {
+			t.Fatalf("since %q: failed to unmarshal %s: %s", tc.since, res.Body, err)
+		}
+		if got.NextBatch != tc.nextBatch {
+			t.Errorf("since %q: got next_batch %q want %q", tc.since, got.NextBatch, tc.nextBatch)
+		}
+		if len(got.Rooms) != len(tc.rooms) {
+			t.Errorf("since %q: got rooms %s want %v", tc.since, res.Body, tc.rooms)
+		}
+		for membership, want := range tc.rooms {
+			section, ok := got.Rooms[membership]
+			if !ok || len(section) != len(want) {
+				t.Errorf("since %q: got %s rooms %s want %v", tc.since, membership, res.Body, want)
+				continue
+			}
+			for _, roomID := range want {
+				if _, ok := section[roomID]; !ok {
+					t.Errorf("since %q: %s rooms are missing %s: %s", tc.since, membership, roomID, res.Body)
+				}
+			}
+		}
+		// everything outside rooms is passed on
+		if tc.since == "s2" && string(got.AccountData) != `{"events":[]}` {
+			t.Errorf("since %q: got account_data %s", tc.since, string(got.AccountData))
+		}
+	}
+
+	mu.Lock()
+	if got := strings.Join(sinces, ","); got != ",s1,s2" {
+		t.Errorf("homeserver got since tokens %q want the initial sync then s1 then s2", got)
+	}
+	mu.Unlock()
+	if got := CurrentStats().ObserveUnchangedRooms - before.ObserveUnchangedRooms; got != 3 {
+		t.Errorf("ObserveUnchangedRooms: got %d want 3", got)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// accessTokens remembers which access tokens have been refreshed, so requests made with an old token, e.g from the
+// outbox or retries, are sent with the token which replaced it. Tokens are replaced by the old token rather than
+// by which was used last, so several accounts can refresh their tokens independently.
+type accessTokens struct {
+	mu sync.Mutex
+	// old token -> the latest token which replaced it
+	replaced map[string]string
+}
+
+var tokens = &accessTokens{
+	replaced: make(map[string]string),
+}
+
+// UpdateToken replaces the access token oldToken with newToken, after the client has refreshed it. Requests made
+// after this with oldToken are sent with newToken instead, including requests waiting in the outbox, requests
+// retried after reconnecting and observation re-registrations, so nothing is sent with the old token once the
+// server has invalidated it. The connection is kept, and newToken is sent on the next request. Requests already
+// sent are not affected, nor are requests with other tokens e.g of another account. Empty tokens are ignored.
+func UpdateToken(oldToken, newToken string) {
+	tokens.update(oldToken, newToken)
+}
+
+func (t *accessTokens) update(oldToken, newToken string) {
+	if oldToken == "" || newToken == "" {
+		logrus.Warn("UpdateToken: ignoring empty access token")
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// the client may have refreshed a token which had already replaced oldToken
+	if latest, ok := t.replaced[oldToken]; ok {
+		oldToken = latest
+	}
+	if oldToken != newToken {
+		for old, latest := range t.replaced {
+			if latest == oldToken {
+				t.replaced[old] = newToken
+			}
+		}
+		t.replaced[oldToken] = newToken
+	}
+	// the new token may be one which was replaced before
+	delete(t.replaced, newToken)
+}
+
+// current returns the token to send for a request made with token
+func (t *accessTokens) current(token string) string {
+	if token == "" {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if latest, ok := t.replaced[token]; ok {
+		return latest
+	}
+	return token
+}
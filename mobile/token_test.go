@@ -0,0 +1,143 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func resetTokens(t *testing.T) {
+	reset := func() {
+		tokens.mu.Lock()
+		defer tokens.mu.Unlock()
+		tokens.replaced = make(map[string]string)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestUpdateToken(t *testing.T) {
+	resetTokens(t)
+	var mu sync.Mutex
+	var auth []string
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		auth = append(auth, req.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	}))
+	send := func(token string) string {
+		t.Helper()
+		if res := SendRequest("GET", hsURL+"/_matrix/client/r0/account/whoami", token, ""); res == nil || res.Code != 200 {
+			t.Fatalf("SendRequest with token %q: got %+v", token, res)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return auth[len(auth)-1]
+	}
+	if got := send("old"); got != "Bearer old" {
+		t.Fatalf("before refreshing: got %q want the old token", got)
+	}
+	u, _ := url.Parse(hsURL)
+	conn, err := dc.getClientForHost(u.Host)
+	if err != nil {
+		t.Fatalf("getClientForHost: %s", err)
+	}
+
+	UpdateToken("old", "new")
+	// e.g a retry which was made with the token from before the refresh
+	if got := send("old"); got != "Bearer new" {
+		t.Errorf("old token after refreshing: got %q want the new token", got)
+	}
+	if got := send("new"); got != "Bearer new" {
+		t.Errorf("new token after refreshing: got %q want the new token", got)
+	}
+	// unauthenticated requests stay unauthenticated
+	if got := send(""); got != "" {
+		t.Errorf("no token after refreshing: got %q want none", got)
+	}
+	if got, err := dc.getClientForHost(u.Host); err != nil || got != conn {
+		t.Errorf("refreshing the token made a new connection")
+	}
+}
+
+func TestAccessTokensChain(t *testing.T) {
+	resetTokens(t)
+	UpdateToken("a", "b")
+	UpdateToken("b", "c")
+	UpdateToken("b", "")
+	UpdateToken("", "d")
+	for _, token := range []string{"a", "b", "c"} {
+		if got := tokens.current(token); got != "c" {
+			t.Errorf("current(%q): got %q want c", token, got)
+		}
+	}
+	// refreshing a token which was already replaced replaces the latest one
+	UpdateToken("a", "d")
+	for _, token := range []string{"a", "b", "c", "d"} {
+		if got := tokens.current(token); got != "d" {
+			t.Errorf("current(%q): got %q want d", token, got)
+		}
+	}
+	// tokens which were never replaced, e.g another account's, are sent as-is
+	if got := tokens.current("other"); got != "other" {
+		t.Errorf("current(other): got %q want other", got)
+	}
+}
+
+func TestUpdateTokenTwoAccounts(t *testing.T) {
+	resetTokens(t)
+	var mu sync.Mutex
+	var auth []string
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		auth = append(auth, req.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	}))
+	send := func(token string) string {
+		t.Helper()
+		if res := SendRequest("GET", hsURL+"/_matrix/client/r0/account/whoami", token, ""); res == nil || res.Code != 200 {
+			t.Fatalf("SendRequest with token %q: got %+v", token, res)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return auth[len(auth)-1]
+	}
+	// account A sends, then account B sends, then A refreshes its token
+	send("a1")
+	send("b1")
+	UpdateToken("a1", "a2")
+	if got := send("b1"); got != "Bearer b1" {
+		t.Errorf("account B after A refreshed: got %q want B's token", got)
+	}
+	if got := send("a1"); got != "Bearer a2" {
+		t.Errorf("account A's old token after refreshing: got %q want A's new token", got)
+	}
+	UpdateToken("b1", "b2")
+	if got := send("b1"); got != "Bearer b2" {
+		t.Errorf("account B's old token after refreshing: got %q want B's new token", got)
+	}
+	if got := send("a2"); got != "Bearer a2" {
+		t.Errorf("account A after B refreshed: got %q want A's new token", got)
+	}
+}
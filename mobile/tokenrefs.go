@@ -0,0 +1,95 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+	"github.com/matrix-org/lb"
+)
+
+const ctxValTokenRefs = "ctxValTokenRefs"
+
+// errTokenRefRejected is returned by do when the server does not know the token reference sent, e.g because it has
+// forgotten it. The request must be sent again with the full access token.
+var errTokenRefRejected = errors.New("token reference rejected")
+
+// tokenRefs are the access token references the server has issued on a single connection. They are stored on the
+// connection as they are only valid on the connection they were issued on.
+type tokenRefs struct {
+	mu   sync.Mutex
+	refs map[string][]byte // token -> ref
+}
+
+func newTokenRefs() *tokenRefs {
+	return &tokenRefs{
+		refs: make(map[string][]byte),
+	}
+}
+
+// sentToken is the access token sent on a request, and whether it was sent as a reference
+type sentToken struct {
+	refs  *tokenRefs
+	token string
+	ref   bool
+}
+
+// compressAccessToken replaces the access token on msg with its reference if the server has issued one on conn, or
+// asks the server to issue one if not. Returns nil if msg has no access token.
+func compressAccessToken(conn *client.ClientConn, msg *pool.Message) *sentToken {
+	refs, ok := conn.Context().Value(ctxValTokenRefs).(*tokenRefs)
+	if !ok {
+		return nil
+	}
+	token, err := msg.Options().GetString(lb.OptionIDAccessToken)
+	if err != nil || token == "" {
+		return nil
+	}
+	refs.mu.Lock()
+	ref, ok := refs.refs[token]
+	refs.mu.Unlock()
+	if !ok {
+		msg.SetOptionBytes(lb.OptionIDAccessTokenRef, []byte{})
+		return &sentToken{refs: refs, token: token}
+	}
+	msg.Remove(lb.OptionIDAccessToken)
+	msg.SetOptionBytes(lb.OptionIDAccessTokenRef, ref)
+	return &sentToken{refs: refs, token: token, ref: true}
+}
+
+// update stores the reference the server issued in res, or forgets the reference if the server rejected it, in
+// which case errTokenRefRejected is returned.
+func (s *sentToken) update(res *pool.Message) error {
+	if s == nil {
+		return nil
+	}
+	s.refs.mu.Lock()
+	defer s.refs.mu.Unlock()
+	if s.ref {
+		if res.Code() == codes.BadOption {
+			delete(s.refs.refs, s.token)
+			return errTokenRefRejected
+		}
+		return nil
+	}
+	if ref, err := res.Options().GetBytes(lb.OptionIDAccessTokenRef); err == nil && len(ref) > 0 {
+		s.refs.refs[s.token] = append([]byte(nil), ref...)
+	}
+	return nil
+}
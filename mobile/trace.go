@@ -0,0 +1,112 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/lb"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	spanSinkMu sync.Mutex
+	spanSink   lb.SpanSink
+)
+
+// SetSpanSink sets where the spans of requests sent with a SendOptions.TraceParent go, e.g to export them to
+// OpenTelemetry. Without a sink no spans are recorded, but the trace context is still sent to the server. This is
+// only usable from Go: gomobile does not export it.
+func SetSpanSink(sink lb.SpanSink) {
+	spanSinkMu.Lock()
+	defer spanSinkMu.Unlock()
+	spanSink = sink
+}
+
+// errNoResponse is the error of an exchange span which ended without a response
+var errNoResponse = errors.New("no response")
+
+// requestTrace records the spans of a traced request
+type requestTrace struct {
+	sink     lb.SpanSink
+	parent   lb.TraceContext
+	start    time.Time
+	exchange *lb.Span
+}
+
+// newRequestTrace returns the trace of a request which began at start, or nil if traceParent is not a valid
+// traceparent header
+func newRequestTrace(traceParent string, start time.Time) *requestTrace {
+	if traceParent == "" {
+		return nil
+	}
+	parent, err := lb.ParseTraceParent(traceParent)
+	if err != nil {
+		logrus.WithError(err).Warn("Not tracing request with an invalid traceparent")
+		return nil
+	}
+	spanSinkMu.Lock()
+	sink := spanSink
+	spanSinkMu.Unlock()
+	return &requestTrace{sink: sink, parent: parent, start: start}
+}
+
+// startExchange starts the SpanCoAPExchange span and returns the traceparent header to send, which is the exchange
+// span, or the parent if there is no sink
+func (t *requestTrace) startExchange(method, path string) string {
+	if t.sink == nil {
+		return t.parent.String()
+	}
+	t.exchange = lb.StartSpan(lb.SpanCoAPExchange, t.parent)
+	t.exchange.Attributes["http.method"] = method
+	t.exchange.Attributes["http.target"] = path
+	return t.exchange.Context.String()
+}
+
+// endExchange ends the exchange span with the HTTP status code of the response, or the error if there was none,
+// along with a SpanDTLSHandshake span if the request made a new connection. Only the first call does anything, so
+// it can be deferred to end spans of requests which fail.
+func (t *requestTrace) endExchange(code int, err error, timings *Timings) {
+	if t == nil || t.exchange == nil || !t.exchange.End.IsZero() {
+		return
+	}
+	if timings.HandshakeMillis > 0 {
+		handshake := lb.StartSpan(lb.SpanDTLSHandshake, t.parent)
+		handshake.Start = t.start
+		handshake.End = t.start.Add(time.Duration(timings.HandshakeMillis * float64(time.Millisecond)))
+		t.sink.Span(handshake)
+	}
+	if code != 0 {
+		t.exchange.Attributes["http.status_code"] = strconv.Itoa(code)
+	}
+	t.exchange.Finish(t.sink, err)
+}
+
+// decoded records a SpanCBORDecode span, for converting the response body which began at start, as a child of the
+// exchange
+func (t *requestTrace) decoded(start time.Time, dictionary string, err error) {
+	if t == nil || t.exchange == nil {
+		return
+	}
+	span := lb.StartSpan(lb.SpanCBORDecode, t.exchange.Context)
+	span.Start = start
+	if dictionary != "" {
+		span.Attributes["lb.dictionary"] = dictionary
+	}
+	span.Finish(t.sink, err)
+}
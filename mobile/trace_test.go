@@ -0,0 +1,105 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/lb"
+)
+
+type recordingSpanSink struct {
+	mu    sync.Mutex
+	spans map[string]*lb.Span // name -> span
+}
+
+func (s *recordingSpanSink) Span(span *lb.Span) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spans[span.Name] = span
+}
+
+// TestSendRequestTraceParent checks the trace of a request continues on the server, and that spans are recorded for
+// each part of the hop in the same trace
+func TestSendRequestTraceParent(t *testing.T) {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	parent, err := lb.ParseTraceParent(traceParent)
+	if err != nil {
+		t.Fatalf("ParseTraceParent: %s", err)
+	}
+	clientSpans := &recordingSpanSink{spans: make(map[string]*lb.Span)}
+	SetSpanSink(clientSpans)
+	t.Cleanup(func() {
+		SetSpanSink(nil)
+	})
+	serverSpans := &recordingSpanSink{spans: make(map[string]*lb.Span)}
+	server := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	server.Spans = serverSpans
+	var mu sync.Mutex
+	var gotTraceParent string
+	hsURL := newCBORTestServer(t, "127.0.0.1:0", server, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		gotTraceParent = req.Header.Get("traceparent")
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"user_id":"@alice:localhost"}`))
+	}))
+
+	res := SendRequestWithOptions("GET", hsURL+"/_matrix/client/r0/account/whoami", "", "", &SendOptions{
+		TraceParent: traceParent,
+	})
+	if res == nil || res.Code != 200 {
+		t.Fatalf("SendRequestWithOptions: got %+v", res)
+	}
+
+	clientSpans.mu.Lock()
+	defer clientSpans.mu.Unlock()
+	for _, name := range []string{lb.SpanDTLSHandshake, lb.SpanCoAPExchange, lb.SpanCBORDecode} {
+		span := clientSpans.spans[name]
+		if span == nil {
+			t.Fatalf("no %s span, got %v", name, clientSpans.spans)
+		}
+		if span.Context.TraceID != parent.TraceID || span.Err != nil {
+			t.Errorf("%s: got span %+v want one in trace %x", name, span, parent.TraceID)
+		}
+	}
+	exchange := clientSpans.spans[lb.SpanCoAPExchange]
+	if exchange.ParentSpanID != parent.SpanID || exchange.Attributes["http.status_code"] != "200" {
+		t.Errorf("got exchange span %+v want a child of %s", exchange, traceParent)
+	}
+	if decode := clientSpans.spans[lb.SpanCBORDecode]; decode.ParentSpanID != exchange.Context.SpanID {
+		t.Errorf("got decode span %+v want a child of the exchange", decode)
+	}
+
+	// the server's span ends after the response has been sent
+	var span *lb.Span
+	waitFor(t, "the server span", func() bool {
+		serverSpans.mu.Lock()
+		defer serverSpans.mu.Unlock()
+		span = serverSpans.spans[lb.SpanCoAPRequest]
+		return span != nil
+	})
+	if span.Context.TraceID != parent.TraceID || span.ParentSpanID != exchange.Context.SpanID {
+		t.Errorf("got server span %+v want a child of the exchange %s", span, exchange.Context)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if gotTraceParent != span.Context.String() {
+		t.Errorf("homeserver got traceparent %q want the server span %s", gotTraceParent, span.Context)
+	}
+}
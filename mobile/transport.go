@@ -0,0 +1,118 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	piondtls "github.com/pion/dtls/v2"
+)
+
+var (
+	transportWrapper   func(conn net.Conn) net.Conn
+	transportWrapperMu sync.Mutex
+)
+
+// SetTransportWrapper wraps the UDP socket of every new connection, below DTLS, e.g with lbtest.LossyConn to run
+// clients over a lossy link in tests. The wrapper is given each socket once it is connected to the host, and
+// must return a conn which sends and receives whole packets. Existing connections are not affected. A nil
+// wrapper sends over the socket as-is. This is only usable from Go: gomobile does not export it.
+func SetTransportWrapper(wrap func(conn net.Conn) net.Conn) {
+	transportWrapperMu.Lock()
+	defer transportWrapperMu.Unlock()
+	transportWrapper = wrap
+}
+
+// dialDTLS is dtls.Dial with the transport wrapper applied to the socket before the handshake. Datagrams received
+// on the socket are counted by counter, and refill budget.
+func dialDTLS(host string, dtlsConfig *piondtls.Config, dialer *net.Dialer, counter *roundTripCounter, budget *retransmitBudget, opts ...dtls.DialOption) (*client.ClientConn, error) {
+	conn, err := dialer.Dial("udp", host)
+	if err != nil {
+		return nil, err
+	}
+	transportWrapperMu.Lock()
+	wrap := transportWrapper
+	transportWrapperMu.Unlock()
+	if wrap != nil {
+		conn = wrap(conn)
+	}
+	conn = &countingConn{Conn: conn, counter: counter, budget: budget}
+	dtlsConfig = verifyHost(dtlsConfig, host, conn.RemoteAddr())
+	session := dtlsSessions.sessionID(conn.RemoteAddr(), dtlsConfig.ServerName)
+	dtlsConn, err := piondtls.Client(conn, dtlsConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if id := dtlsConn.ConnectionState().SessionID; len(session) > 0 && bytes.Equal(id, session) {
+		recordResumedHandshake()
+	}
+	return dtls.Client(dtlsConn, append(opts, dtls.WithCloseSocket())...), nil
+}
+
+// verifyHost returns dtlsConfig, checking that the certificate is for the host being dialled if there is no
+// ServerName. pion/dtls does not check the name of the certificate at all without a ServerName, so a hostname is used
+// as the ServerName, and an IP address, which is not a valid server name, is checked against the address the socket
+// is connected to.
+func verifyHost(dtlsConfig *piondtls.Config, host string, addr net.Addr) *piondtls.Config {
+	if dtlsConfig.InsecureSkipVerify || dtlsConfig.ServerName != "" {
+		return dtlsConfig
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil && net.ParseIP(hostname) == nil {
+		cfg := *dtlsConfig
+		cfg.ServerName = hostname
+		return &cfg
+	}
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		ip = addr.String()
+	}
+	cfg := *dtlsConfig
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if len(chains) == 0 || len(chains[0]) == 0 {
+			return fmt.Errorf("no verified certificate chain for %s", ip)
+		}
+		return chains[0][0].VerifyHostname(ip)
+	}
+	return &cfg
+}
+
+// The DTLS record content type of application data, which is the first byte of the record header. Records of this
+// type are CoAP messages, rather than the handshake or alerts.
+const dtlsContentTypeApplicationData = 23
+
+// countingConn counts the datagrams of application data read from the socket, which is how round trips of block-wise
+// transfers are seen as the library makes them all within a single Do, and how the retransmitBudget sees that the
+// link still works
+type countingConn struct {
+	net.Conn
+	counter *roundTripCounter
+	budget  *retransmitBudget
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && b[0] == dtlsContentTypeApplicationData {
+		c.counter.received(n)
+		c.budget.received()
+	}
+	return n, err
+}
@@ -0,0 +1,208 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+	"github.com/matrix-org/lb/lbtest"
+)
+
+// newLossyTestServer is newTestServer with every new connection to it sent over a LossyConn. The conns are
+// returned in the order they were made.
+func newLossyTestServer(t *testing.T, cfg lbtest.LossyConfig) (string, func() []*lbtest.LossyConn) {
+	t.Helper()
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+	}))
+	var mu sync.Mutex
+	var conns []*lbtest.LossyConn
+	SetTransportWrapper(func(conn net.Conn) net.Conn {
+		mu.Lock()
+		defer mu.Unlock()
+		lossy := lbtest.NewLossyConn(conn, cfg)
+		conns = append(conns, lossy)
+		return lossy
+	})
+	t.Cleanup(func() {
+		SetTransportWrapper(nil)
+	})
+	return hsURL, func() []*lbtest.LossyConn {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*lbtest.LossyConn(nil), conns...)
+	}
+}
+
+func TestRetransmissionLossyConn(t *testing.T) {
+	hsURL, lossyConns := newLossyTestServer(t, lbtest.LossyConfig{Latency: 10 * time.Millisecond})
+	cp := Params()
+	cp.TransmissionACKTimeoutSecs = 1
+	cp.TransmissionNStart = 0
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	send := func(msg string) *Response {
+		t.Helper()
+		res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", "")
+		if res == nil || res.Code != 200 {
+			t.Fatalf("%s: got %+v", msg, res)
+		}
+		return res
+	}
+	res := send("no loss")
+	if res.Timings.ExchangeMillis >= 1000 {
+		t.Errorf("no loss: got ExchangeMillis %v want less than the ACK timeout", res.Timings.ExchangeMillis)
+	}
+	conns := lossyConns()
+	if len(conns) != 1 {
+		t.Fatalf("got %d conns want 1", len(conns))
+	}
+	lossy := conns[0]
+
+	// a lost request is retransmitted after the ACK timeout
+	before := lossy.Stats()
+	lossy.DropSent(1)
+	res = send("lost request")
+	after := lossy.Stats()
+	if res.Timings.ExchangeMillis < 1000 {
+		t.Errorf("lost request: got ExchangeMillis %v want at least the ACK timeout", res.Timings.ExchangeMillis)
+	}
+	if got := after.Sent - before.Sent; got != 2 {
+		t.Errorf("lost request: sent %d packets want 2", got)
+	}
+
+	// so is a request whose response is lost, which the server answers again
+	before = after
+	lossy.DropReceived(1)
+	res = send("lost response")
+	after = lossy.Stats()
+	if res.Timings.ExchangeMillis < 1000 {
+		t.Errorf("lost response: got ExchangeMillis %v want at least the ACK timeout", res.Timings.ExchangeMillis)
+	}
+	if got := after.Received - before.Received; got != 2 {
+		t.Errorf("lost response: received %d packets want 2", got)
+	}
+	if got := lossyConns(); len(got) != 1 {
+		t.Errorf("got %d conns want the same conn throughout", len(got))
+	}
+}
+
+func TestBackoffLossyConn(t *testing.T) {
+	hsURL, lossyConns := newLossyTestServer(t, lbtest.LossyConfig{})
+	cp := Params()
+	cp.AdaptiveTransmission = true
+	cp.AdaptiveMinACKTimeoutSecs = 1
+	cp.TransmissionACKTimeoutSecs = 4
+	cp.TransmissionMaxRetransmits = 1
+	cp.TransmissionNStart = 0
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+			t.Fatalf("SendRequest failed: %+v", res)
+		}
+	}
+	if q := MeasuredLinkQuality(hsURL); q.ACKTimeoutMillis != 1000 {
+		t.Fatalf("fast link: got %+v want a 1000ms ACK timeout", q)
+	}
+
+	// the link goes down, so every retransmission is lost and the ACK timeout backs off
+	u, _ := url.Parse(hsURL)
+	conn, err := dc.getClientForHost(u.Host)
+	if err != nil {
+		t.Fatalf("getClientForHost: %s", err)
+	}
+	lossy := lossyConns()[0]
+	lossy.SetConfig(lbtest.LossyConfig{SendLoss: 1})
+	msg, err := client.NewGetRequest(context.Background(), "/_matrix/client/versions")
+	if err != nil {
+		t.Fatalf("NewGetRequest: %s", err)
+	}
+	start := time.Now()
+	_, err = do(conn, msg, &Timings{}, newRoundTripLimit(0))
+	took := time.Since(start)
+	pool.ReleaseMessage(msg)
+	if err == nil {
+		t.Fatalf("request on a dead link: got no error")
+	}
+	if took < time.Second {
+		t.Errorf("request on a dead link: gave up after %v want at least the 1s ACK timeout", took)
+	}
+	q := MeasuredLinkQuality(hsURL)
+	if q.ACKTimeoutMillis != 2000 || q.LossRate <= 0 {
+		t.Errorf("dead link: got %+v want the ACK timeout to double to 2000ms and some loss", q)
+	}
+
+	// once the link is back, requests succeed and the ACK timeout recovers
+	lossy.SetConfig(lbtest.LossyConfig{})
+	for i := 0; i < 5; i++ {
+		if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+			t.Fatalf("SendRequest after the link came back failed: %+v", res)
+		}
+	}
+	if q := MeasuredLinkQuality(hsURL); q.ACKTimeoutMillis != 1000 {
+		t.Errorf("recovered link: got %+v want a 1000ms ACK timeout", q)
+	}
+}
+
+// TestCountingConn checks that only application data counts as a round trip, and only for a lone request
+func TestCountingConn(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	counter := newRoundTripCounter()
+	conn := &countingConn{Conn: local, counter: counter}
+	receive := func(contentType byte) {
+		t.Helper()
+		go remote.Write([]byte{contentType, 0xfe, 0xfd})
+		buf := make([]byte, 64)
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("Read: %s", err)
+		}
+	}
+	limit := newRoundTripLimit(2)
+	counter.limits[limit] = true
+	// a handshake record
+	receive(22)
+	receive(dtlsContentTypeApplicationData)
+	if got := limit.roundTrips; got != 1 {
+		t.Errorf("got %d round trips want 1", got)
+	}
+	// e.g a long-polling /sync while a transfer is in flight
+	other := newRoundTripLimit(2)
+	counter.limits[other] = true
+	receive(dtlsContentTypeApplicationData)
+	if limit.roundTrips != 1 || other.roundTrips != 0 {
+		t.Errorf("got %d and %d round trips with 2 requests in flight, want 1 and 0", limit.roundTrips, other.roundTrips)
+	}
+	delete(counter.limits, other)
+	receive(dtlsContentTypeApplicationData)
+	receive(dtlsContentTypeApplicationData)
+	if !limit.exceeded() || limit.ctx.Err() == nil {
+		t.Errorf("request was not cancelled after %d round trips", limit.roundTrips)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/lb"
+	"github.com/sirupsen/logrus"
+)
+
+// txnPathRegexp matches endpoints with a transaction ID as the last segment, which the homeserver deduplicates
+// per access token: sending events, redactions and to-device messages
+var txnPathRegexp = regexp.MustCompile(
+	`^/_matrix/client/[^/]+/(rooms/[^/]+/send/[^/]+|rooms/[^/]+/redact/[^/]+|sendToDevice/[^/]+)/[^/]+$`,
+)
+
+// The most bytes of responses the transaction cache holds. Responses to sends are small, e.g an event ID, so this
+// is thousands of transactions.
+const txnCacheBytes = 256 * 1024
+
+// txnCache remembers the responses to recent requests with transaction IDs, so that the same request sent again,
+// e.g an app retrying on top of this library retrying, gets the homeserver's response without another exchange.
+// A request which is sent while the same one is in flight waits for its response.
+type txnCache struct {
+	mu       sync.Mutex
+	cache    *lb.LRUCache
+	inflight map[string]chan struct{}
+}
+
+var txns = &txnCache{
+	cache:    lb.NewLRUCache(txnCacheBytes),
+	inflight: make(map[string]chan struct{}),
+}
+
+// txnKey returns the key for the request in the transaction cache, or false if the request has no transaction ID
+func txnKey(method, hsURL, token string) (string, bool) {
+	if method != "PUT" {
+		return "", false
+	}
+	u, err := url.Parse(hsURL)
+	if err != nil || !txnPathRegexp.MatchString(u.Path) {
+		return "", false
+	}
+	// transaction IDs are scoped to the access token
+	return u.Host + u.Path + " " + token, true
+}
+
+// do returns the cached response for the key, or calls send, caching successful responses for ttl. Errors are not
+// cached, so the request can be retried. If the request is in flight, this waits for it first.
+func (c *txnCache) do(key string, ttl time.Duration, send func() *Response) *Response {
+	for {
+		c.mu.Lock()
+		if data, ok := c.cache.Get(key); ok {
+			c.mu.Unlock()
+			var res Response
+			if err := json.Unmarshal(data, &res); err == nil {
+				logrus.Info("Returning the response to an earlier request with the same transaction ID")
+				recordDeduplicatedRequest()
+				return &res
+			}
+			c.cache.Delete(key)
+		} else if done, ok := c.inflight[key]; ok {
+			c.mu.Unlock()
+			<-done
+			// the response is cached now, unless it failed in which case this sends it again
+			continue
+		} else {
+			done := make(chan struct{})
+			c.inflight[key] = done
+			c.mu.Unlock()
+			res := send()
+			if res != nil && res.Code >= 200 && res.Code < 300 {
+				cached := *res
+				// the timings were for the original request
+				cached.Timings = nil
+				if data, err := json.Marshal(&cached); err == nil {
+					c.cache.Set(key, data, ttl)
+				}
+			}
+			c.mu.Lock()
+			delete(c.inflight, key)
+			c.mu.Unlock()
+			close(done)
+			return res
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSendRequestTxnCache(t *testing.T) {
+	var exchanges int32
+	release := make(chan struct{})
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&exchanges, 1)
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/failing":
+			w.WriteHeader(500)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN"}`))
+			return
+		case "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/slow":
+			<-release
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(fmt.Sprintf(`{"event_id":"$%d:bar"}`, n)))
+	}))
+	send := func(txnID, token string) *Response {
+		t.Helper()
+		res := SendRequest("PUT", hsURL+"/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/"+txnID, token, `{"body":"hello"}`)
+		if res == nil {
+			t.Fatalf("%s: SendRequest returned nil", txnID)
+		}
+		return res
+	}
+	before := CurrentStats()
+
+	// the same transaction is only sent once
+	first := send("txn1", "secret")
+	second := send("txn1", "secret")
+	if got := atomic.LoadInt32(&exchanges); got != 1 {
+		t.Errorf("got %d exchanges want 1", got)
+	}
+	if second.Code != 200 || second.Body != first.Body {
+		t.Errorf("second send got %d %s want the first response %d %s", second.Code, second.Body, first.Code, first.Body)
+	}
+	if got := CurrentStats().DeduplicatedRequests - before.DeduplicatedRequests; got != 1 {
+		t.Errorf("DeduplicatedRequests increased by %d, want 1", got)
+	}
+
+	// transaction IDs are scoped to the access token
+	send("txn1", "other")
+	if got := atomic.LoadInt32(&exchanges); got != 2 {
+		t.Errorf("other token: got %d exchanges want 2", got)
+	}
+
+	// errors are not remembered
+	send("failing", "secret")
+	if res := send("failing", "secret"); res.Code != 500 {
+		t.Errorf("failing: got %d want 500", res.Code)
+	}
+	if got := atomic.LoadInt32(&exchanges); got != 4 {
+		t.Errorf("failing: got %d exchanges want 4", got)
+	}
+
+	// a retry while the request is in flight waits for its response
+	var wg sync.WaitGroup
+	bodies := make([]string, 2)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// not send, which can't fail the test from another goroutine
+			if res := SendRequest("PUT", hsURL+"/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/slow", "secret", `{}`); res != nil {
+				bodies[i] = res.Body
+			}
+		}(i)
+		if i == 0 {
+			waitFor(t, "the first send to reach the server", func() bool { return atomic.LoadInt32(&exchanges) == 5 })
+		}
+	}
+	close(release)
+	wg.Wait()
+	if bodies[0] == "" || bodies[0] != bodies[1] {
+		t.Errorf("in flight: got different responses %v", bodies)
+	}
+	if got := atomic.LoadInt32(&exchanges); got != 5 {
+		t.Errorf("in flight: got %d exchanges want 5", got)
+	}
+
+	// turned off, every send is sent
+	cp := Params()
+	cp.TxnCacheSecs = 0
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	send("txn2", "secret")
+	send("txn2", "secret")
+	if got := atomic.LoadInt32(&exchanges); got != 7 {
+		t.Errorf("disabled: got %d exchanges want 7", got)
+	}
+}
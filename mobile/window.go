@@ -0,0 +1,102 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"context"
+	"sync"
+)
+
+// exchangeWindow is a flow control window of MaxConcurrentExchanges confirmable exchanges, across all connections.
+// An exchange holds its slot from when the request is first sent until the whole response has arrived, including
+// every block of a block-wise transfer. Requests which do not fit in the window wait for a slot in the order they
+// arrived, so a burst of requests cannot starve the ones before it. The same window limits DTLS handshakes to
+// MaxConcurrentHandshakes.
+type exchangeWindow struct {
+	mu          sync.Mutex
+	outstanding int
+	// closed when the waiter has been given a slot, oldest first
+	waiters []chan struct{}
+	// called when acquire has to wait, if set
+	onWait func()
+}
+
+var exchanges = &exchangeWindow{onWait: recordExchangeWindowWait}
+var handshakes = &exchangeWindow{onWait: recordHandshakeWait}
+
+// acquire blocks until there is a slot for an exchange in a window of max exchanges, then takes it. Returns an
+// error if ctx is done first. max <= 0 means there is no limit, but the exchange is still counted, so a limit which
+// is set while exchanges are outstanding includes them.
+func (w *exchangeWindow) acquire(ctx context.Context, max int) error {
+	w.mu.Lock()
+	if max <= 0 || (w.outstanding < max && len(w.waiters) == 0) {
+		w.outstanding++
+		w.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	w.waiters = append(w.waiters, ready)
+	w.mu.Unlock()
+	if w.onWait != nil {
+		w.onWait()
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for i, waiter := range w.waiters {
+			if waiter == ready {
+				w.waiters = append(w.waiters[:i], w.waiters[i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// the slot was handed over at the same time, so give it to the next waiter
+		w.outstanding--
+		w.handOffLocked(max)
+		return ctx.Err()
+	}
+}
+
+// release frees the slot of an exchange which has finished, handing it to the oldest waiter if there is one
+func (w *exchangeWindow) release(max int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.outstanding--
+	w.handOffLocked(max)
+}
+
+// resize wakes waiters which fit in a new window of max exchanges, for when MaxConcurrentExchanges changes
+func (w *exchangeWindow) resize(max int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.handOffLocked(max)
+}
+
+// count returns the number of outstanding exchanges
+func (w *exchangeWindow) count() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return int64(w.outstanding)
+}
+
+func (w *exchangeWindow) handOffLocked(max int) {
+	for len(w.waiters) > 0 && (max <= 0 || w.outstanding < max) {
+		w.outstanding++
+		close(w.waiters[0])
+		w.waiters = w.waiters[1:]
+	}
+}
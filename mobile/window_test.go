@@ -0,0 +1,234 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExchangeWindow(t *testing.T) {
+	w := &exchangeWindow{}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := w.acquire(ctx, 2); err != nil {
+			t.Fatalf("acquire: %s", err)
+		}
+	}
+
+	// waiters get slots in the order they arrived
+	order := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		i := i
+		go func() {
+			if err := w.acquire(ctx, 2); err != nil {
+				t.Errorf("acquire %d: %s", i, err)
+			}
+			order <- i
+		}()
+		waitFor(t, "waiter", func() bool {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			return len(w.waiters) == i+1
+		})
+	}
+
+	// a waiter whose context is done gives up its place
+	cancelled, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := w.acquire(cancelled, 2); err != context.DeadlineExceeded {
+		t.Errorf("acquire: got %v want %v", err, context.DeadlineExceeded)
+	}
+
+	for i := 0; i < 2; i++ {
+		w.release(2)
+		select {
+		case got := <-order:
+			if got != i {
+				t.Errorf("waiter %d got a slot, want waiter %d", got, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for waiter %d", i)
+		}
+	}
+	if got := w.count(); got != 2 {
+		t.Errorf("count: got %d want 2", got)
+	}
+
+	// growing the window wakes waiters straight away
+	woken := make(chan struct{})
+	go func() {
+		w.acquire(ctx, 2)
+		close(woken)
+	}()
+	waitFor(t, "waiter", func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return len(w.waiters) == 1
+	})
+	w.resize(3)
+	select {
+	case <-woken:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for resize to wake the waiter")
+	}
+}
+
+// TestSendRequestMaxConcurrentExchanges checks that no more than MaxConcurrentExchanges requests are outstanding
+func TestSendRequestMaxConcurrentExchanges(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	hsURL := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"versions":["r0.6.1"]}`))
+	}))
+	cp := Params()
+	cp.MaxConcurrentExchanges = 2
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	// the connection is made before the burst, so every request in the burst is on it
+	if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+		t.Fatalf("SendRequest: got %+v", res)
+	}
+	before := CurrentStats()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res := SendRequest("GET", hsURL+"/_matrix/client/versions", "", ""); res == nil || res.Code != 200 {
+				t.Errorf("SendRequest: got %+v", res)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxInFlight != 2 {
+		t.Errorf("got %d requests in flight at once, want 2", maxInFlight)
+	}
+	after := CurrentStats()
+	if got := after.ExchangeWindowWaits - before.ExchangeWindowWaits; got < 3 {
+		t.Errorf("ExchangeWindowWaits: got %d want at least 3", got)
+	}
+	if after.OutstandingExchanges != 0 {
+		t.Errorf("OutstandingExchanges: got %d want 0", after.OutstandingExchanges)
+	}
+}
+
+// handshakeConn tracks when the DTLS handshake on a conn is in progress: from when the conn is made, which is after
+// the handshake has a slot, until the server's ChangeCipherSpec arrives, which is before the slot is released
+type handshakeConn struct {
+	net.Conn
+	done func()
+	once sync.Once
+}
+
+// The DTLS record content type of ChangeCipherSpec, which the server sends at the end of the handshake
+const dtlsContentTypeChangeCipherSpec = 20
+
+func (c *handshakeConn) Write(b []byte) (int, error) {
+	// slow the handshake down, so handshakes on different conns would overlap without the limit
+	time.Sleep(10 * time.Millisecond)
+	return c.Conn.Write(b)
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && (b[0] == dtlsContentTypeChangeCipherSpec || b[0] == dtlsContentTypeApplicationData) {
+		c.once.Do(c.done)
+	}
+	return n, err
+}
+
+// TestMaxConcurrentHandshakes checks that no more than MaxConcurrentHandshakes handshakes are in progress at once
+// when connecting to several hosts together
+func TestMaxConcurrentHandshakes(t *testing.T) {
+	var hsURLs []string
+	for i := 0; i < 4; i++ {
+		hsURLs = append(hsURLs, newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			w.Write([]byte(`{"versions":["r0.6.1"]}`))
+		})))
+	}
+	cp := Params()
+	cp.MaxConcurrentHandshakes = 2
+	if err := SetParams(cp); err != nil {
+		t.Fatalf("SetParams: %s", err)
+	}
+	var mu sync.Mutex
+	inProgress, maxInProgress := 0, 0
+	SetTransportWrapper(func(conn net.Conn) net.Conn {
+		mu.Lock()
+		defer mu.Unlock()
+		inProgress++
+		if inProgress > maxInProgress {
+			maxInProgress = inProgress
+		}
+		return &handshakeConn{Conn: conn, done: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			inProgress--
+		}}
+	})
+	t.Cleanup(func() {
+		SetTransportWrapper(nil)
+		cp := Params()
+		cp.MaxConcurrentHandshakes = 0
+		SetParams(cp)
+	})
+	before := CurrentStats()
+
+	var wg sync.WaitGroup
+	for _, hsURL := range hsURLs {
+		hsURL := hsURL
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := Connect(hsURL); err != nil {
+				t.Errorf("Connect: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	if maxInProgress != 2 {
+		t.Errorf("got %d handshakes in progress at once, want 2", maxInProgress)
+	}
+	mu.Unlock()
+	after := CurrentStats()
+	if got := after.HandshakeWaits - before.HandshakeWaits; got < 2 {
+		t.Errorf("HandshakeWaits: got %d want at least 2", got)
+	}
+	if after.Handshakes != 0 {
+		t.Errorf("Handshakes: got %d want 0", after.Handshakes)
+	}
+}
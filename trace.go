@@ -0,0 +1,170 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+)
+
+// The CoAP Option ID of the W3C trace context of a request. HTTPRequestToCoAP sends it for a traceparent header and
+// CoAPToHTTPRequest turns it back into one, so a trace continues across the low bandwidth hop. It is sent as the 25
+// bytes of the trace ID, the parent ID and the trace flags rather than the 55 characters of the header. It is
+// elective, and is not part of the cache key. The tracestate header is not sent.
+// https://www.w3.org/TR/trace-context/#traceparent-header
+var OptionIDTraceContext = message.OptionID(284)
+
+const (
+	traceParentHeader = "traceparent"
+	// the only version of the traceparent header, which is the only one sent over CoAP
+	traceParentVersion = "00"
+	traceContextLength = 16 + 8 + 1
+)
+
+// TraceContext is the W3C trace context of a request: the trace it is part of and the span it was sent from
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// ParseTraceParent parses a traceparent header e.g 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+// Returns an error for versions other than 00, and for the all-zero trace and span IDs, which are invalid.
+func ParseTraceParent(header string) (TraceContext, error) {
+	var tc TraceContext
+	if len(header) != 55 || header[2] != '-' || header[35] != '-' || header[52] != '-' {
+		return tc, fmt.Errorf("traceparent %q is malformed", header)
+	}
+	if header[:2] != traceParentVersion {
+		return tc, fmt.Errorf("traceparent version %s is not supported", header[:2])
+	}
+	flags := make([]byte, 1)
+	for _, field := range []struct {
+		dst []byte
+		hex string
+	}{
+		{tc.TraceID[:], header[3:35]},
+		{tc.SpanID[:], header[36:52]},
+		{flags, header[53:]},
+	} {
+		if _, err := hex.Decode(field.dst, []byte(field.hex)); err != nil {
+			return tc, fmt.Errorf("traceparent %q is malformed: %w", header, err)
+		}
+	}
+	tc.Flags = flags[0]
+	if !tc.IsValid() {
+		return tc, fmt.Errorf("traceparent %q has an all-zero ID", header)
+	}
+	return tc, nil
+}
+
+// String returns the traceparent header of the trace context
+func (tc TraceContext) String() string {
+	return traceParentVersion + "-" + hex.EncodeToString(tc.TraceID[:]) + "-" + hex.EncodeToString(tc.SpanID[:]) +
+		"-" + hex.EncodeToString([]byte{tc.Flags})
+}
+
+// IsValid returns false if the trace or span ID is all zeros
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+// traceContextOption returns the OptionIDTraceContext value of the trace context
+func traceContextOption(tc TraceContext) []byte {
+	value := make([]byte, 0, traceContextLength)
+	value = append(value, tc.TraceID[:]...)
+	value = append(value, tc.SpanID[:]...)
+	return append(value, tc.Flags)
+}
+
+// setTraceParentHeader sets the traceparent header from the OptionIDTraceContext option, if there is a valid one
+func setTraceParentHeader(opts message.Options, h http.Header) {
+	value, err := opts.GetBytes(OptionIDTraceContext)
+	if err != nil || len(value) != traceContextLength {
+		return
+	}
+	var tc TraceContext
+	copy(tc.TraceID[:], value[:16])
+	copy(tc.SpanID[:], value[16:24])
+	tc.Flags = value[24]
+	if tc.IsValid() {
+		h.Set(traceParentHeader, tc.String())
+	}
+}
+
+// The spans recorded by this library
+const (
+	// The DTLS handshake of a client request which made a new connection
+	SpanDTLSHandshake = "lb.dtls_handshake"
+	// A client request, from sending it over CoAP until the whole response has arrived
+	SpanCoAPExchange = "lb.coap_exchange"
+	// Converting the CBOR body of a response to JSON on the client
+	SpanCBORDecode = "lb.cbor_decode"
+	// A request handled by CoAPHTTPHandler, from receiving it until the HTTP handler has responded
+	SpanCoAPRequest = "lb.coap_request"
+)
+
+// SpanSink is an interface which can be satisfied to collect the spans of traced requests, e.g to export them to
+// OpenTelemetry, so operators can see the low bandwidth hop in their tracing backend. A request is traced if it has
+// a traceparent header, or an OptionIDTraceContext option. Implementations must be safe to call from multiple
+// goroutines.
+type SpanSink interface {
+	// Span is called once with each span after it has ended
+	Span(span *Span)
+}
+
+// Span is one operation of a traced request, like a span in OpenTelemetry
+type Span struct {
+	// One of the Span constants
+	Name string
+	// The trace the span is part of and the ID of the span, which is the parent of spans it causes
+	Context TraceContext
+	// The ID of the span which caused this one, e.g on the server the span of the client which sent the request
+	ParentSpanID [8]byte
+	Start        time.Time
+	End          time.Time
+	// e.g http.method, http.target and http.status_code
+	Attributes map[string]string
+	// The error the operation failed with, if it did
+	Err error
+}
+
+// StartSpan starts a span in the trace of parent, as a child of the span parent was sent from
+func StartSpan(name string, parent TraceContext) *Span {
+	s := &Span{
+		Name:         name,
+		Context:      parent,
+		ParentSpanID: parent.SpanID,
+		Start:        time.Now(),
+		Attributes:   make(map[string]string),
+	}
+	// span IDs only need to be unique, so a failed read leaves the parent's ID rather than failing the request
+	_, _ = rand.Read(s.Context.SpanID[:])
+	return s
+}
+
+// Finish ends the span with the error it failed with, which may be nil, and sends it to sink if it is not nil
+func (s *Span) Finish(sink SpanSink, err error) {
+	s.End = time.Now()
+	s.Err = err
+	if sink != nil {
+		sink.Span(s)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+type recordingSpanSink struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (s *recordingSpanSink) Span(span *Span) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spans = append(s.spans, span)
+}
+
+func TestParseTraceParent(t *testing.T) {
+	tc, err := ParseTraceParent(testTraceParent)
+	if err != nil {
+		t.Fatalf("ParseTraceParent: %s", err)
+	}
+	if tc.String() != testTraceParent {
+		t.Errorf("got %s want %s", tc.String(), testTraceParent)
+	}
+	if tc.Flags != 1 || tc.TraceID[0] != 0x4b || tc.SpanID[7] != 0xb7 {
+		t.Errorf("parsed %+v", tc)
+	}
+	for _, header := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+	} {
+		if _, err := ParseTraceParent(header); err == nil {
+			t.Errorf("ParseTraceParent accepted %q", header)
+		}
+	}
+}
+
+// TestCoAPHTTPTraceContext checks the trace context of a request is sent over CoAP and passed to the HTTP handler,
+// and that CoAPHTTPHandler records a span in the trace
+func TestCoAPHTTPTraceContext(t *testing.T) {
+	testCases := []struct {
+		name        string
+		traceParent string
+		spans       bool
+	}{
+		{name: "spans", traceParent: testTraceParent, spans: true},
+		{name: "no spans", traceParent: testTraceParent},
+		{name: "malformed", traceParent: "00-nope", spans: true},
+	}
+	for _, tc := range testCases {
+		client := NewCoAPHTTP(NewCoAPPathV1())
+		req, err := http.NewRequest("GET", "https://localhost/_matrix/client/r0/account/whoami", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		req.Header.Set("traceparent", tc.traceParent)
+		var opts message.Options
+		err = client.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+			opts = append(opts, msg.Options()...)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: HTTPRequestToCoAP: %s", tc.name, err)
+		}
+		value, err := opts.GetBytes(OptionIDTraceContext)
+		parent, parseErr := ParseTraceParent(tc.traceParent)
+		if parseErr != nil {
+			if err == nil {
+				t.Errorf("%s: sent a trace context option for a malformed traceparent", tc.name)
+			}
+		} else if len(value) != 25 {
+			t.Errorf("%s: got a %d byte trace context option want 25 bytes", tc.name, len(value))
+		}
+
+		server := NewCoAPHTTP(NewCoAPPathV1())
+		sink := &recordingSpanSink{}
+		if tc.spans {
+			server.Spans = sink
+		}
+		var gotTraceParent string
+		h := server.CoAPHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			gotTraceParent = req.Header.Get("traceparent")
+			w.WriteHeader(200)
+		}), nil)
+		h.ServeCOAP(&fakeResponseWriter{}, &coapmux.Message{
+			Message:       &message.Message{Code: methodToCodes["GET"], Token: message.Token("1"), Options: opts},
+			IsConfirmable: true,
+		})
+
+		switch {
+		case parseErr != nil:
+			if gotTraceParent != "" || len(sink.spans) != 0 {
+				t.Errorf("%s: got traceparent %q and %d spans want none", tc.name, gotTraceParent, len(sink.spans))
+			}
+		case !tc.spans:
+			// the client's span is the parent of whatever the HTTP handler does
+			if gotTraceParent != tc.traceParent {
+				t.Errorf("%s: HTTP handler got traceparent %q want %q", tc.name, gotTraceParent, tc.traceParent)
+			}
+		default:
+			if len(sink.spans) != 1 {
+				t.Fatalf("%s: got %d spans want 1", tc.name, len(sink.spans))
+			}
+			span := sink.spans[0]
+			if span.Name != SpanCoAPRequest || span.Context.TraceID != parent.TraceID ||
+				span.ParentSpanID != parent.SpanID || span.Context.SpanID == parent.SpanID {
+				t.Errorf("%s: got span %+v, want a child of %s", tc.name, span, tc.traceParent)
+			}
+			if span.Attributes["http.status_code"] != "200" || span.Attributes["http.target"] != "/_matrix/client/r0/account/whoami" {
+				t.Errorf("%s: got attributes %v", tc.name, span.Attributes)
+			}
+			if span.End.Before(span.Start) {
+				t.Errorf("%s: span ended at %v before it started at %v", tc.name, span.End, span.Start)
+			}
+			// the server's span is the parent of whatever the HTTP handler does
+			if gotTraceParent != span.Context.String() {
+				t.Errorf("%s: HTTP handler got traceparent %q want the span %s", tc.name, gotTraceParent, span.Context)
+			}
+		}
+	}
+}